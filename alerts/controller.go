@@ -0,0 +1,144 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nabatshy/openapi"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type AlertController struct {
+	service *AlertService
+}
+
+func NewAlertController(service *AlertService) *AlertController {
+	return &AlertController{service: service}
+}
+
+func (c *AlertController) listRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := c.service.ListRules(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list alert rules: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func (c *AlertController) getRule(w http.ResponseWriter, r *http.Request) {
+	rule, found, err := c.service.GetRule(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get alert rule: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "alert rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (c *AlertController) createRule(w http.ResponseWriter, r *http.Request) {
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "invalid alert rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = ""
+	if err := rule.Validate(); err != nil {
+		http.Error(w, "invalid alert rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveRule(r.Context(), &rule); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create alert rule: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (c *AlertController) updateRule(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, found, err := c.service.GetRule(r.Context(), id); err != nil {
+		http.Error(w, fmt.Sprintf("failed to get alert rule: %v", err), http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(w, "alert rule not found", http.StatusNotFound)
+		return
+	}
+
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "invalid alert rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = id
+	if err := rule.Validate(); err != nil {
+		http.Error(w, "invalid alert rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveRule(r.Context(), &rule); err != nil {
+		http.Error(w, fmt.Sprintf("failed to update alert rule: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (c *AlertController) deleteRule(w http.ResponseWriter, r *http.Request) {
+	if err := c.service.DeleteRule(r.Context(), chi.URLParam(r, "id")); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete alert rule: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *AlertController) listEvents(w http.ResponseWriter, r *http.Request) {
+	dr, err := utils.ParseDateRange(r.URL.Query(), "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	events, err := c.service.ListEvents(r.Context(), dr, r.URL.Query().Get("rule_id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list alert events: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func (c *AlertController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/alerts/rules", Summary: "Alert rules", Response: []Rule{}},
+		{Method: http.MethodPost, Path: "/v1/alerts/rules", Summary: "Create an alert rule", Request: Rule{}, Response: Rule{}, Status: http.StatusCreated},
+		{Method: http.MethodGet, Path: "/v1/alerts/rules/{id}", Summary: "An alert rule", Response: Rule{}},
+		{Method: http.MethodPut, Path: "/v1/alerts/rules/{id}", Summary: "Update an alert rule", Request: Rule{}, Response: Rule{}},
+		{Method: http.MethodDelete, Path: "/v1/alerts/rules/{id}", Summary: "Delete an alert rule", Status: http.StatusNoContent},
+		{Method: http.MethodGet, Path: "/v1/alerts/events", Summary: "Alerts that fired and resolved", Response: []Event{},
+			Query: append([]openapi.Param{{Name: "rule_id", Description: "only the events of the rule"}}, openapi.DateRange...)},
+	}
+}
+
+func (c *AlertController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/alerts/rules", c.listRules)
+	r.Post("/v1/alerts/rules", c.createRule)
+	r.Get("/v1/alerts/rules/{id}", c.getRule)
+	r.Put("/v1/alerts/rules/{id}", c.updateRule)
+	r.Delete("/v1/alerts/rules/{id}", c.deleteRule)
+	r.Get("/v1/alerts/events", c.listEvents)
+}
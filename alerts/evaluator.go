@@ -0,0 +1,123 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Evaluator periodically evaluates every enabled rule and records an event
+// whenever a rule starts or stops firing
+type Evaluator struct {
+	service  *AlertService
+	interval time.Duration
+	states   map[string]string
+}
+
+func NewEvaluator(service *AlertService, interval time.Duration) *Evaluator {
+	return &Evaluator{
+		service:  service,
+		interval: interval,
+		states:   make(map[string]string),
+	}
+}
+
+// Run evaluates the rules every interval until ctx is done
+func (e *Evaluator) Run(ctx context.Context) {
+	// pick up where we left off so a restart doesn't re-fire everything
+	states, err := e.service.lastStates(ctx)
+	if err != nil {
+		log.Printf("alerts: failed to load last states: %v\n", err)
+	} else {
+		e.states = states
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.evaluateAll(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Evaluator) evaluateAll(ctx context.Context, now time.Time) {
+	rules, err := e.service.ListRules(ctx)
+	if err != nil {
+		log.Printf("alerts: failed to list rules: %v\n", err)
+		return
+	}
+
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		value, firing, err := e.service.Evaluate(ctx, rule, now)
+		if err != nil {
+			log.Printf("alerts: failed to evaluate rule %s: %v\n", rule.Name, err)
+			continue
+		}
+
+		state := StateResolved
+		if firing {
+			state = StateFiring
+		}
+		previous, known := e.states[rule.ID]
+		if previous == state || (!known && state == StateResolved) {
+			continue
+		}
+		e.states[rule.ID] = state
+
+		metadata := e.service.serviceMetadata(ctx, rule)
+		event := Event{
+			RuleID:       rule.ID,
+			RuleName:     rule.Name,
+			State:        state,
+			Value:        value,
+			Threshold:    rule.Threshold,
+			Message:      describe(rule, value, state),
+			RunbookURL:   metadata.RunbookURL,
+			DashboardURL: metadata.DashboardURL,
+			Owner:        metadata.Owner,
+			Time:         now,
+		}
+		if event.RunbookURL != "" {
+			event.Message += " runbook: " + event.RunbookURL
+		}
+		if event.Owner != nil {
+			event.Message += " owner: " + event.Owner.Team
+		}
+		log.Printf("alerts: %s\n", event.Message)
+		if err := e.service.recordEvent(ctx, event); err != nil {
+			log.Printf("alerts: failed to record event for rule %s: %v\n", rule.Name, err)
+		}
+		if e.service.Notifier != nil {
+			e.service.Notifier.Notify(ctx, rule, event)
+		}
+	}
+}
+
+func describe(rule Rule, value float64, state string) string {
+	subject := rule.Service
+	switch rule.Scope {
+	case ScopeEdge:
+		subject = rule.Source + " -> " + rule.Target
+	case ScopeSearch:
+		subject = "saved search " + rule.SavedSearchID
+	}
+	what := rule.Metric
+	if rule.Comparison == ComparisonChange {
+		what += " change %"
+	}
+	return fmt.Sprintf("[%s] %s: %s %s is %.2f (threshold %s %.2f over %s)",
+		state, rule.Name, subject, what, value, rule.Operator, rule.Threshold, rule.Window)
+}
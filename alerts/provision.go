@@ -0,0 +1,25 @@
+package alerts
+
+import (
+	"nabatshy/provision"
+)
+
+// NewProvider manages alert rules from the "alerts" section of a provisioning
+// file. Rules are matched by name.
+func NewProvider(s *AlertService) provision.Provider {
+	return &provision.DocumentProvider[Rule, *Rule]{
+		Section: "alerts",
+		Noun:    "rule",
+		List:    s.ListRules,
+		Save:    s.SaveRule,
+		Delete:  s.DeleteRule,
+	}
+}
+
+func (r *Rule) DocumentName() string { return r.Name }
+
+func (r *Rule) DocumentID() string { return r.ID }
+
+func (r *Rule) Adopt(current Rule) {
+	r.ID, r.UpdatedAt = current.ID, current.UpdatedAt
+}
@@ -0,0 +1,450 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"nabatshy/api"
+	"nabatshy/catalog"
+	"nabatshy/db"
+	"nabatshy/searches"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/google/uuid"
+)
+
+const rulesTable = "alert_rules"
+
+// Rule scopes
+const (
+	ScopeService = "service"
+	ScopeEdge    = "edge"
+	ScopeSearch  = "search"
+)
+
+// Rule metrics
+const (
+	MetricErrorRate  = "error_rate"  // percentage of spans with an exception event
+	MetricP95Latency = "p95_latency" // milliseconds
+	MetricThroughput = "throughput"  // spans per second
+	MetricAnomalies  = "anomalies"   // anomalies detected for the service's endpoints
+	MetricMatches    = "matches"     // spans matching the saved search, traces for trace searches
+	MetricNewErrors  = "new_errors"  // error groups first seen in the window, see newErrorHistory
+)
+
+// newErrorHistory is how far back an error group must not have occurred to count
+// as new, like api.ErrorHistory
+const newErrorHistory = 7 * 24 * time.Hour
+
+// Rule comparisons
+const (
+	ComparisonValue  = "value"  // the metric itself
+	ComparisonChange = "change" // percent change of the metric vs the previous window
+)
+
+type Rule struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Scope is "service" for rules on a single service, "edge" for rules on the
+	// calls from Source to Target in the service dependency graph or "search" for
+	// rules on the matches of a saved search. Search rules may set Service to route
+	// their events to its owner.
+	Scope         string  `json:"scope"`
+	Service       string  `json:"service,omitempty"`
+	Source        string  `json:"source,omitempty"`
+	Target        string  `json:"target,omitempty"`
+	SavedSearchID string  `json:"saved_search_id,omitempty"`
+	Metric        string  `json:"metric"`
+	Comparison    string  `json:"comparison"`
+	Operator      string  `json:"operator"` // ">", ">=", "<" or "<="
+	Threshold     float64 `json:"threshold"`
+	Window        string  `json:"window"` // e.g. "5m"
+	Enabled       bool    `json:"enabled"`
+	// RunbookURL and DashboardURL default to the ones in the service metadata
+	RunbookURL   string `json:"runbook_url,omitempty"`
+	DashboardURL string `json:"dashboard_url,omitempty"`
+	// Channels are the IDs or names of the notification channels state changes are sent to
+	Channels  []string  `json:"channels,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Event struct {
+	RuleID       string  `json:"rule_id"`
+	RuleName     string  `json:"rule_name"`
+	State        string  `json:"state"` // "firing" or "resolved"
+	Value        float64 `json:"value"`
+	Threshold    float64 `json:"threshold"`
+	Message      string  `json:"message"`
+	RunbookURL   string  `json:"runbook_url,omitempty"`
+	DashboardURL string  `json:"dashboard_url,omitempty"`
+	// Owner is the owner of the service the rule watches, notifications are routed to it
+	Owner *catalog.Owner `json:"owner,omitempty"`
+	Time  time.Time      `json:"time"`
+}
+
+type AlertService struct {
+	Ch *clickhouse.Conn
+	DB *goqu.DialectWrapper
+	// Catalog provides the links and owners of services, may be nil
+	Catalog *catalog.CatalogService
+	// Notifier delivers events to the channels of their rule, may be nil
+	Notifier Notifier
+	// Searches and SearchCounter evaluate search rules, search rules fail without them
+	Searches      *searches.SearchService
+	SearchCounter SearchCounter
+}
+
+// SearchCounter counts the spans matching a search query, in the syntax of /v1/search
+type SearchCounter interface {
+	CountSearch(ctx context.Context, query, traceOrSpan string, start, end time.Time) (uint64, error)
+}
+
+// Notifier delivers alert events, it must not block the evaluator
+type Notifier interface {
+	Notify(ctx context.Context, rule Rule, event Event)
+}
+
+// Validate checks the rule and fills in defaults
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch r.Scope {
+	case ScopeService:
+		if r.Service == "" {
+			return fmt.Errorf("service is required for service rules")
+		}
+	case ScopeEdge:
+		if r.Source == "" || r.Target == "" {
+			return fmt.Errorf("source and target are required for edge rules")
+		}
+	case ScopeSearch:
+		if r.SavedSearchID == "" || r.Metric != MetricMatches {
+			return fmt.Errorf("search rules need a saved_search_id and the %q metric", MetricMatches)
+		}
+	default:
+		return fmt.Errorf("invalid scope %q, use %q, %q or %q", r.Scope, ScopeService, ScopeEdge, ScopeSearch)
+	}
+	switch r.Metric {
+	case MetricErrorRate, MetricP95Latency, MetricThroughput:
+		if r.Scope == ScopeSearch {
+			return fmt.Errorf("search rules only support the %q metric", MetricMatches)
+		}
+	case MetricMatches:
+		if r.Scope != ScopeSearch {
+			return fmt.Errorf("the %q metric is only for search rules", MetricMatches)
+		}
+	case MetricAnomalies, MetricNewErrors:
+		if r.Scope != ScopeService || (r.Comparison != "" && r.Comparison != ComparisonValue) {
+			return fmt.Errorf("%s rules must be service rules comparing the value", r.Metric)
+		}
+	default:
+		return fmt.Errorf("invalid metric %q", r.Metric)
+	}
+	if r.Comparison == "" {
+		r.Comparison = ComparisonValue
+	}
+	if r.Comparison != ComparisonValue && r.Comparison != ComparisonChange {
+		return fmt.Errorf("invalid comparison %q", r.Comparison)
+	}
+	switch r.Operator {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("invalid operator %q", r.Operator)
+	}
+	if r.Window == "" {
+		r.Window = "5m"
+	}
+	if _, err := utils.ParseTimeRange(r.Window); err != nil {
+		return fmt.Errorf("invalid window: %w", err)
+	}
+	if err := catalog.ValidateURL(r.RunbookURL); err != nil {
+		return fmt.Errorf("invalid runbook_url: %w", err)
+	}
+	if err := catalog.ValidateURL(r.DashboardURL); err != nil {
+		return fmt.Errorf("invalid dashboard_url: %w", err)
+	}
+	return nil
+}
+
+func (s *AlertService) ListRules(ctx context.Context) ([]Rule, error) {
+	return db.ListDocuments[Rule](ctx, *s.Ch, rulesTable)
+}
+
+func (s *AlertService) GetRule(ctx context.Context, id string) (Rule, bool, error) {
+	return db.GetDocument[Rule](ctx, *s.Ch, rulesTable, id)
+}
+
+// SaveRule creates the rule when it has no ID, otherwise replaces it
+func (s *AlertService) SaveRule(ctx context.Context, rule *Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	if rule.ID == "" {
+		rule.ID = uuid.New().String()
+	}
+	rule.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, rulesTable, rule.ID, rule.Name, rule)
+}
+
+func (s *AlertService) DeleteRule(ctx context.Context, id string) error {
+	return db.DeleteDocument(ctx, *s.Ch, rulesTable, id)
+}
+
+// ListEvents returns alert state changes in the date range, newest first
+func (s *AlertService) ListEvents(ctx context.Context, dateRange utils.DateRange, ruleID string) ([]Event, error) {
+	ds := s.DB.
+		From("alert_events").
+		Select("rule_id", "rule_name", "state", "value", "threshold", "message", "runbook_url", "dashboard_url", "owner_team", "owner_slack_channel", "owner_escalation", "time").
+		Where(
+			goqu.C("time").Gte(dateRange.Start),
+			goqu.C("time").Lte(dateRange.End),
+		).
+		Order(goqu.C("time").Desc())
+	if ruleID != "" {
+		ds = ds.Where(goqu.C("rule_id").Eq(ruleID))
+	}
+
+	sqlStr, args, err := ds.Prepared(true).ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		var owner catalog.Owner
+		if err := rows.Scan(&e.RuleID, &e.RuleName, &e.State, &e.Value, &e.Threshold, &e.Message, &e.RunbookURL, &e.DashboardURL, &owner.Team, &owner.SlackChannel, &owner.Escalation, &e.Time); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		if owner.Team != "" {
+			e.Owner = &owner
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *AlertService) recordEvent(ctx context.Context, e Event) error {
+	var owner catalog.Owner
+	if e.Owner != nil {
+		owner = *e.Owner
+	}
+	return (*s.Ch).Exec(ctx,
+		"INSERT INTO alert_events (rule_id, rule_name, state, value, threshold, message, runbook_url, dashboard_url, owner_team, owner_slack_channel, owner_escalation, time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.RuleID, e.RuleName, e.State, e.Value, e.Threshold, e.Message, e.RunbookURL, e.DashboardURL, owner.Team, owner.SlackChannel, owner.Escalation, e.Time,
+	)
+}
+
+// serviceMetadata returns the metadata of the service a rule watches (the target
+// for edge rules) with the links of the rule taking precedence
+func (s *AlertService) serviceMetadata(ctx context.Context, rule Rule) catalog.Metadata {
+	service := rule.Service
+	if rule.Scope == ScopeEdge {
+		service = rule.Target
+	}
+
+	metadata := catalog.Metadata{Service: service}
+	if s.Catalog != nil {
+		if m, found, err := s.Catalog.GetMetadata(ctx, service); err == nil && found {
+			metadata = m
+		}
+	}
+	if rule.RunbookURL != "" {
+		metadata.RunbookURL = rule.RunbookURL
+	}
+	if rule.DashboardURL != "" {
+		metadata.DashboardURL = rule.DashboardURL
+	}
+	return metadata
+}
+
+// lastStates returns the latest recorded state of every rule
+func (s *AlertService) lastStates(ctx context.Context) (map[string]string, error) {
+	rows, err := (*s.Ch).Query(ctx, "SELECT rule_id, argMax(state, time) FROM alert_events GROUP BY rule_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]string)
+	for rows.Next() {
+		var id, state string
+		if err := rows.Scan(&id, &state); err != nil {
+			return nil, err
+		}
+		states[id] = state
+	}
+	return states, rows.Err()
+}
+
+type windowStats struct {
+	Count  uint64
+	Errors uint64
+	P95    float64
+}
+
+// metric returns the value of a rule metric for stats collected over window
+func metric(name string, stats windowStats, window time.Duration) float64 {
+	switch name {
+	case MetricErrorRate:
+		if stats.Count == 0 {
+			return 0
+		}
+		return float64(stats.Errors) / float64(stats.Count) * 100
+	case MetricP95Latency:
+		return stats.P95
+	case MetricThroughput:
+		return float64(stats.Count) / window.Seconds()
+	}
+	return 0
+}
+
+// queryStats computes the span count, error count and p95 latency the rule looks at
+// between start and end. Edge rules look at the calls from the source service to
+// the target service, the calls of the dependency graph (see api.EdgeCallsSQL).
+func (s *AlertService) queryStats(ctx context.Context, rule Rule, start, end time.Time) (windowStats, error) {
+	var ds *goqu.SelectDataset
+	switch rule.Scope {
+	case ScopeEdge:
+		ds = s.DB.
+			From(goqu.L("("+api.EdgeCallsSQL(start, end)+")")).
+			Select(
+				// each call once, a span may be stored twice, see api.uniqueSpans
+				goqu.L("uniqExact(trace_id, span_id)"),
+				goqu.L("uniqExactIf(trace_id, span_id, failed)"),
+				goqu.L("if(count() = 0, 0, quantile(0.95)(duration_ms))"),
+			).
+			Where(
+				goqu.C("source").Eq(rule.Source),
+				goqu.C("target").Eq(rule.Target),
+			)
+	default:
+		ds = s.DB.
+			From("denormalized_span").
+			Select(
+				// each span once, see api.uniqueSpans
+				goqu.L("uniqExact(trace_id, span_id)"),
+				goqu.L("uniqExactIf(trace_id, span_id, has(events.name, 'exception'))"),
+				// quantile is NaN without spans, which JSON can't encode
+				goqu.L("if(count() = 0, 0, quantile(0.95)(duration_ns / 1000000))"),
+			).
+			Where(
+				goqu.C("scope_name").Eq(rule.Service),
+				goqu.C("start_time_unix_nano").Gte(start.UnixNano()),
+				goqu.C("start_time_unix_nano").Lt(end.UnixNano()),
+			)
+	}
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return windowStats{}, err
+	}
+	var stats windowStats
+	if err := (*s.Ch).QueryRow(ctx, sqlStr, args...).Scan(&stats.Count, &stats.Errors, &stats.P95); err != nil {
+		return windowStats{}, fmt.Errorf("failed to query rule stats: %w", err)
+	}
+	return stats, nil
+}
+
+// Evaluate computes the current value of the rule and whether it breaches its threshold
+func (s *AlertService) Evaluate(ctx context.Context, rule Rule, now time.Time) (float64, bool, error) {
+	window, err := utils.ParseTimeRange(rule.Window)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if rule.Metric == MetricAnomalies {
+		var count uint64
+		if err := (*s.Ch).QueryRow(ctx,
+			"SELECT count() FROM anomalies WHERE service = ? AND time >= ? AND time < ?",
+			rule.Service, now.Add(-window), now,
+		).Scan(&count); err != nil {
+			return 0, false, fmt.Errorf("failed to count anomalies: %w", err)
+		}
+		return float64(count), breaches(float64(count), rule.Operator, rule.Threshold), nil
+	}
+
+	if rule.Metric == MetricNewErrors {
+		var count uint64
+		if err := (*s.Ch).QueryRow(ctx, `
+			SELECT count() FROM (
+				SELECT fingerprint, min(start_time_unix_nano) AS first_seen
+				FROM denormalized_span
+				ARRAY JOIN error_fingerprints AS fingerprint
+				WHERE scope_name = ? AND start_time_unix_nano >= ? AND start_time_unix_nano < ?
+				GROUP BY fingerprint
+				HAVING first_seen >= ?
+			)`,
+			rule.Service, now.Add(-newErrorHistory).UnixNano(), now.UnixNano(), now.Add(-window).UnixNano(),
+		).Scan(&count); err != nil {
+			return 0, false, fmt.Errorf("failed to count new errors: %w", err)
+		}
+		return float64(count), breaches(float64(count), rule.Operator, rule.Threshold), nil
+	}
+
+	windowValue := func(start, end time.Time) (float64, error) {
+		if rule.Metric == MetricMatches {
+			return s.countMatches(ctx, rule, start, end)
+		}
+		stats, err := s.queryStats(ctx, rule, start, end)
+		return metric(rule.Metric, stats, window), err
+	}
+
+	value, err := windowValue(now.Add(-window), now)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if rule.Comparison == ComparisonChange {
+		prevValue, err := windowValue(now.Add(-2*window), now.Add(-window))
+		if err != nil {
+			return 0, false, err
+		}
+		if prevValue == 0 {
+			// no baseline to compare against
+			return 0, false, nil
+		}
+		value = (value - prevValue) / prevValue * 100
+	}
+
+	return value, breaches(value, rule.Operator, rule.Threshold), nil
+}
+
+// countMatches counts the matches of the rule's saved search between start and end
+func (s *AlertService) countMatches(ctx context.Context, rule Rule, start, end time.Time) (float64, error) {
+	if s.Searches == nil || s.SearchCounter == nil {
+		return 0, fmt.Errorf("search rules aren't supported")
+	}
+	search, found, err := s.Searches.GetSearch(ctx, rule.SavedSearchID)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("saved search %s not found", rule.SavedSearchID)
+	}
+	n, err := s.SearchCounter.CountSearch(ctx, search.Query, search.TraceOrSpan, start, end)
+	return float64(n), err
+}
+
+func breaches(value float64, operator string, threshold float64) bool {
+	switch operator {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package annotations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"nabatshy/openapi"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxWebhookBody bounds the webhook payloads read before checking their signature,
+// GitHub caps them at 25MB
+const maxWebhookBody = 25 << 20
+
+type AnnotationController struct {
+	service AnnotationService
+	// Webhook secrets, the matching webhook route is disabled when empty
+	GitHubSecret string
+	GitLabSecret string
+}
+
+func NewAnnotationController(service AnnotationService, gitHubSecret, gitLabSecret string) *AnnotationController {
+	return &AnnotationController{
+		service:      service,
+		GitHubSecret: gitHubSecret,
+		GitLabSecret: gitLabSecret,
+	}
+}
+
+func (c *AnnotationController) listAnnotations(w http.ResponseWriter, r *http.Request) {
+	dr, err := utils.ParseDateRange(r.URL.Query(), "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	annotations, err := c.service.ListAnnotations(r.Context(), dr, r.URL.Query().Get("service"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list annotations: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotations)
+}
+
+func (c *AnnotationController) createAnnotation(w http.ResponseWriter, r *http.Request) {
+	var a Annotation
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "invalid annotation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if a.Title == "" {
+		http.Error(w, "annotation title is required", http.StatusBadRequest)
+		return
+	}
+	a.Source = "api"
+
+	if err := c.service.CreateAnnotation(r.Context(), &a); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create annotation: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func (c *AnnotationController) gitHubWebhook(w http.ResponseWriter, r *http.Request) {
+	if c.GitHubSecret == "" {
+		http.Error(w, "github webhook is not configured", http.StatusNotFound)
+		return
+	}
+	body, ok := readWebhookBody(w, r)
+	if !ok {
+		return
+	}
+	if !verifyGitHubSignature(c.GitHubSecret, body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	switch event {
+	case "ping":
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "deployment", "deployment_status":
+	default:
+		// Acknowledge events we don't turn into annotations so GitHub doesn't retry them
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	a, err := gitHubAnnotation(event, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.storeWebhookAnnotation(w, r, a)
+}
+
+func (c *AnnotationController) gitLabWebhook(w http.ResponseWriter, r *http.Request) {
+	if c.GitLabSecret == "" {
+		http.Error(w, "gitlab webhook is not configured", http.StatusNotFound)
+		return
+	}
+	if !verifyGitLabToken(c.GitLabSecret, r.Header.Get("X-Gitlab-Token")) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-Gitlab-Event") != "Deployment Hook" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	body, ok := readWebhookBody(w, r)
+	if !ok {
+		return
+	}
+	a, err := gitLabAnnotation(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.storeWebhookAnnotation(w, r, a)
+}
+
+// storeWebhookAnnotation saves an annotation built from a webhook. The service
+// can be overridden with ?service= since repository names rarely match service names.
+func (c *AnnotationController) storeWebhookAnnotation(w http.ResponseWriter, r *http.Request, a *Annotation) {
+	if service := r.URL.Query().Get("service"); service != "" {
+		a.Service = service
+	}
+	if err := c.service.CreateAnnotation(r.Context(), a); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create annotation: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func (c *AnnotationController) Operations() []openapi.Operation {
+	service := openapi.Param{Name: "service", Description: "service of the annotations"}
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/annotations", Summary: "Annotations like deployments", Response: []Annotation{},
+			Query: append([]openapi.Param{service}, openapi.DateRange...)},
+		{Method: http.MethodPost, Path: "/v1/annotations", Summary: "Create an annotation", Request: Annotation{}, Response: Annotation{}, Status: http.StatusCreated},
+		{Method: http.MethodPost, Path: "/v1/webhooks/github", Summary: "Annotate GitHub deployments",
+			Request: map[string]any{}, Response: Annotation{}, Status: http.StatusCreated, Query: []openapi.Param{service},
+			Description: "Takes the deployment and deployment_status events of a GitHub webhook signed with X-Hub-Signature-256, other events are answered 202"},
+		{Method: http.MethodPost, Path: "/v1/webhooks/gitlab", Summary: "Annotate GitLab deployments",
+			Request: map[string]any{}, Response: Annotation{}, Status: http.StatusCreated, Query: []openapi.Param{service},
+			Description: "Takes the Deployment Hook events of a GitLab webhook with the X-Gitlab-Token secret, other events are answered 202"},
+	}
+}
+
+func (c *AnnotationController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/annotations", c.listAnnotations)
+	r.Post("/v1/annotations", c.createAnnotation)
+	r.Post("/v1/webhooks/github", c.gitHubWebhook)
+	r.Post("/v1/webhooks/gitlab", c.gitLabWebhook)
+}
+
+// readWebhookBody reads the body of a webhook up to maxWebhookBody, answering the
+// error when it can't
+func readWebhookBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	case err != nil:
+		http.Error(w, "failed to read body: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
@@ -0,0 +1,96 @@
+package annotations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/google/uuid"
+)
+
+type Annotation struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Title   string    `json:"title"`
+	Text    string    `json:"text"`
+	Tags    []string  `json:"tags"`
+	Service string    `json:"service"`
+	Source  string    `json:"source"` // "api", "github" or "gitlab"
+	URL     string    `json:"url"`
+}
+
+type AnnotationService struct {
+	Ch *clickhouse.Conn
+	DB *goqu.DialectWrapper
+}
+
+// CreateAnnotation stores an annotation, filling in its ID and time when missing
+func (s *AnnotationService) CreateAnnotation(ctx context.Context, a *Annotation) error {
+	if a.ID == "" {
+		a.ID = uuid.New().String()
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	if a.Tags == nil {
+		a.Tags = []string{}
+	}
+
+	err := (*s.Ch).Exec(ctx,
+		"INSERT INTO annotations (id, time, title, text, tags, service, source, url) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		a.ID, a.Time, a.Title, a.Text, a.Tags, a.Service, a.Source, a.URL,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert annotation: %w", err)
+	}
+	return nil
+}
+
+// ListAnnotations returns the annotations in the date range, optionally for a single service
+func (s *AnnotationService) ListAnnotations(ctx context.Context, dateRange utils.DateRange, service string) ([]Annotation, error) {
+	ds := s.DB.
+		From("annotations").
+		Select(
+			goqu.L("toString(id)"),
+			goqu.C("time"),
+			goqu.C("title"),
+			goqu.C("text"),
+			goqu.C("tags"),
+			goqu.C("service"),
+			goqu.C("source"),
+			goqu.C("url"),
+		).
+		Where(
+			goqu.C("time").Gte(dateRange.Start),
+			goqu.C("time").Lte(dateRange.End),
+		).
+		Order(goqu.C("time").Asc())
+	if service != "" {
+		ds = ds.Where(goqu.C("service").Eq(service))
+	}
+
+	sqlStr, args, err := ds.Prepared(true).ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	annotations := []Annotation{}
+	for rows.Next() {
+		var a Annotation
+		if err := rows.Scan(&a.ID, &a.Time, &a.Title, &a.Text, &a.Tags, &a.Service, &a.Source, &a.URL); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, rows.Err()
+}
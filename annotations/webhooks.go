@@ -0,0 +1,140 @@
+package annotations
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// verifyGitHubSignature checks the X-Hub-Signature-256 header, an HMAC SHA256 of
+// the body keyed with the webhook secret
+func verifyGitHubSignature(secret string, body []byte, signature string) bool {
+	sig, found := strings.CutPrefix(signature, "sha256=")
+	if !found {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// verifyGitLabToken checks the X-Gitlab-Token header, which GitLab sends verbatim
+func verifyGitLabToken(secret string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1
+}
+
+type gitHubDeploymentEvent struct {
+	Deployment struct {
+		SHA         string    `json:"sha"`
+		Ref         string    `json:"ref"`
+		Environment string    `json:"environment"`
+		Description string    `json:"description"`
+		URL         string    `json:"url"`
+		CreatedAt   time.Time `json:"created_at"`
+	} `json:"deployment"`
+	DeploymentStatus *struct {
+		State       string    `json:"state"`
+		Description string    `json:"description"`
+		TargetURL   string    `json:"target_url"`
+		LogURL      string    `json:"log_url"`
+		CreatedAt   time.Time `json:"created_at"`
+	} `json:"deployment_status"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+// gitHubAnnotation converts a "deployment" or "deployment_status" event into an annotation
+func gitHubAnnotation(event string, body []byte) (*Annotation, error) {
+	var e gitHubDeploymentEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, fmt.Errorf("invalid github payload: %w", err)
+	}
+
+	d := e.Deployment
+	a := &Annotation{
+		Time:    d.CreatedAt,
+		Service: e.Repository.Name,
+		Source:  "github",
+		Tags:    []string{"deployment", "env:" + d.Environment},
+		Text:    d.Description,
+		URL:     e.Repository.HTMLURL + "/commit/" + d.SHA,
+	}
+	state := "started"
+	if event == "deployment_status" && e.DeploymentStatus != nil {
+		ds := e.DeploymentStatus
+		state = ds.State
+		a.Time = ds.CreatedAt
+		if ds.Description != "" {
+			a.Text = ds.Description
+		}
+		if ds.LogURL != "" {
+			a.URL = ds.LogURL
+		} else if ds.TargetURL != "" {
+			a.URL = ds.TargetURL
+		}
+	}
+	a.Tags = append(a.Tags, "state:"+state)
+	a.Title = fmt.Sprintf("Deploy %s@%s to %s %s", e.Repository.FullName, shortSHA(d.SHA), d.Environment, state)
+	return a, nil
+}
+
+type gitLabDeploymentEvent struct {
+	ObjectKind      string `json:"object_kind"`
+	Status          string `json:"status"`
+	StatusChangedAt string `json:"status_changed_at"`
+	DeployableURL   string `json:"deployable_url"`
+	Environment     string `json:"environment"`
+	ShortSHA        string `json:"short_sha"`
+	Ref             string `json:"ref"`
+	CommitTitle     string `json:"commit_title"`
+	Project         struct {
+		Name              string `json:"name"`
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+}
+
+// gitLabAnnotation converts a "Deployment Hook" event into an annotation
+func gitLabAnnotation(body []byte) (*Annotation, error) {
+	var e gitLabDeploymentEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, fmt.Errorf("invalid gitlab payload: %w", err)
+	}
+	if e.ObjectKind != "deployment" {
+		return nil, fmt.Errorf("unsupported gitlab object_kind %q", e.ObjectKind)
+	}
+
+	// GitLab sends e.g. "2021-04-28 21:50:00 +0200"
+	changedAt, err := time.Parse("2006-01-02 15:04:05 -0700", e.StatusChangedAt)
+	if err != nil {
+		changedAt = time.Now().UTC()
+	}
+
+	return &Annotation{
+		Time:    changedAt,
+		Title:   fmt.Sprintf("Deploy %s@%s to %s %s", e.Project.PathWithNamespace, e.ShortSHA, e.Environment, e.Status),
+		Text:    e.CommitTitle,
+		Tags:    []string{"deployment", "env:" + e.Environment, "state:" + e.Status},
+		Service: e.Project.Name,
+		Source:  "gitlab",
+		URL:     e.DeployableURL,
+	}, nil
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
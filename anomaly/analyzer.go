@@ -0,0 +1,42 @@
+package anomaly
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Analyzer runs detection over consecutive windows and records the anomalies
+type Analyzer struct {
+	service *AnomalyService
+	window  time.Duration
+}
+
+func NewAnalyzer(service *AnomalyService, window time.Duration) *Analyzer {
+	return &Analyzer{service: service, window: window}
+}
+
+// Run detects anomalies every window until ctx is done
+func (a *Analyzer) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			anomalies, err := a.service.Detect(ctx, now, a.window)
+			if err != nil {
+				log.Printf("anomaly: detection failed: %v\n", err)
+				continue
+			}
+			for _, an := range anomalies {
+				log.Printf("anomaly: %s %s %s is %.2f (baseline %.2f, score %.1f)\n",
+					an.Service, an.Endpoint, an.Metric, an.Value, an.Baseline, an.Score)
+			}
+			if err := a.service.recordAnomalies(ctx, anomalies); err != nil {
+				log.Printf("anomaly: failed to record anomalies: %v\n", err)
+			}
+		}
+	}
+}
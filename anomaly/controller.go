@@ -0,0 +1,48 @@
+package anomaly
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nabatshy/openapi"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type AnomalyController struct {
+	service *AnomalyService
+}
+
+func NewAnomalyController(service *AnomalyService) *AnomalyController {
+	return &AnomalyController{service: service}
+}
+
+func (c *AnomalyController) listAnomalies(w http.ResponseWriter, r *http.Request) {
+	dr, err := utils.ParseDateRange(r.URL.Query(), "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	anomalies, err := c.service.ListAnomalies(r.Context(), dr, r.URL.Query().Get("service"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list anomalies: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(anomalies)
+}
+
+func (c *AnomalyController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/anomalies", Summary: "Detected anomalies", Response: []Anomaly{},
+			Query: append([]openapi.Param{{Name: "service", Description: "service name"}}, openapi.DateRange...)},
+	}
+}
+
+func (c *AnomalyController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/anomalies", c.listAnomalies)
+}
@@ -0,0 +1,227 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// Anomaly metrics
+const (
+	MetricP95Latency = "p95_latency" // milliseconds
+	MetricErrorRate  = "error_rate"  // percentage of spans with an exception event
+)
+
+const (
+	// seasons is how many previous days the baseline is built from, the same time
+	// of day is used so daily traffic patterns don't look anomalous
+	seasons = 7
+	// minSeasons is the least number of previous days with traffic needed for a baseline
+	minSeasons = 3
+	// minSpans is the least number of spans in a window for it to be judged
+	minSpans = 20
+	// threshold is the robust z-score above which a window is anomalous
+	threshold = 3.5
+)
+
+// Anomaly is an interval where an endpoint's metric deviated from its baseline
+type Anomaly struct {
+	Time     time.Time `json:"time"` // end of the interval
+	Service  string    `json:"service"`
+	Endpoint string    `json:"endpoint"`
+	Metric   string    `json:"metric"`
+	Value    float64   `json:"value"`
+	Baseline float64   `json:"baseline"` // median of the previous days
+	Score    float64   `json:"score"`    // robust z-score, (value - median) / (1.4826 * MAD)
+}
+
+type AnomalyService struct {
+	Ch *clickhouse.Conn
+	DB *goqu.DialectWrapper
+}
+
+type endpointKey struct {
+	service  string
+	endpoint string
+}
+
+type sample struct {
+	count     uint64
+	p95       float64
+	errorRate float64
+}
+
+// Detect compares the window ending at now with the same window on each of the
+// previous days for every endpoint (root span name per service)
+func (s *AnomalyService) Detect(ctx context.Context, now time.Time, window time.Duration) ([]Anomaly, error) {
+	const day = int64(24 * time.Hour)
+	nowNano := now.UnixNano()
+
+	var windows []goqu.Expression
+	for d := int64(0); d <= seasons; d++ {
+		end := nowNano - d*day
+		windows = append(windows, goqu.And(
+			goqu.C("start_time_unix_nano").Gte(end-int64(window)),
+			goqu.C("start_time_unix_nano").Lt(end),
+		))
+	}
+
+	ds := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("scope_name"),
+			goqu.C("name"),
+			goqu.L("intDiv(? - start_time_unix_nano, ?)", nowNano, day).As("days_ago"),
+			goqu.L("count()"),
+			goqu.L("quantile(0.95)(duration_ns / 1000000)"),
+			goqu.L("countIf(has(events.name, 'exception')) * 100 / count()"),
+		).
+		Where(
+			goqu.C("parent_span_id").Eq(""),
+			goqu.Or(windows...),
+		).
+		GroupBy(goqu.C("scope_name"), goqu.C("name"), goqu.C("days_ago"))
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	current := make(map[endpointKey]sample)
+	history := make(map[endpointKey][]sample)
+	for rows.Next() {
+		var key endpointKey
+		var daysAgo int64
+		var smp sample
+		if err := rows.Scan(&key.service, &key.endpoint, &daysAgo, &smp.count, &smp.p95, &smp.errorRate); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		if daysAgo == 0 {
+			current[key] = smp
+		} else {
+			history[key] = append(history[key], smp)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var anomalies []Anomaly
+	for key, cur := range current {
+		past := history[key]
+		if cur.count < minSpans || len(past) < minSeasons {
+			continue
+		}
+
+		latencies := make([]float64, len(past))
+		errorRates := make([]float64, len(past))
+		for i, p := range past {
+			latencies[i] = p.p95
+			errorRates[i] = p.errorRate
+		}
+
+		// only increases are interesting, endpoints getting faster or failing less aren't
+		if median, score := robustScore(cur.p95, latencies, 1); score > threshold {
+			anomalies = append(anomalies, Anomaly{
+				Time: now, Service: key.service, Endpoint: key.endpoint,
+				Metric: MetricP95Latency, Value: cur.p95, Baseline: median, Score: score,
+			})
+		}
+		if median, score := robustScore(cur.errorRate, errorRates, 1); score > threshold {
+			anomalies = append(anomalies, Anomaly{
+				Time: now, Service: key.service, Endpoint: key.endpoint,
+				Metric: MetricErrorRate, Value: cur.errorRate, Baseline: median, Score: score,
+			})
+		}
+	}
+	return anomalies, nil
+}
+
+// robustScore returns the median of the baseline and how many scaled median absolute
+// deviations value is above it. The MAD is floored at minMAD and 5% of the median
+// so a perfectly stable baseline doesn't flag every tiny change.
+func robustScore(value float64, baseline []float64, minMAD float64) (float64, float64) {
+	med := median(baseline)
+	deviations := make([]float64, len(baseline))
+	for i, v := range baseline {
+		deviations[i] = math.Abs(v - med)
+	}
+	mad := math.Max(median(deviations), math.Max(minMAD, 0.05*med))
+	return med, (value - med) / (1.4826 * mad)
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func (s *AnomalyService) recordAnomalies(ctx context.Context, anomalies []Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	batch, err := (*s.Ch).PrepareBatch(ctx, "INSERT INTO anomalies (time, service, endpoint, metric, value, baseline, score)")
+	if err != nil {
+		return err
+	}
+	for _, a := range anomalies {
+		if err := batch.Append(a.Time, a.Service, a.Endpoint, a.Metric, a.Value, a.Baseline, a.Score); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
+
+// ListAnomalies returns the anomalies detected in the date range, newest first
+func (s *AnomalyService) ListAnomalies(ctx context.Context, dateRange utils.DateRange, service string) ([]Anomaly, error) {
+	ds := s.DB.
+		From("anomalies").
+		Select("time", "service", "endpoint", "metric", "value", "baseline", "score").
+		Where(
+			goqu.C("time").Gte(dateRange.Start),
+			goqu.C("time").Lte(dateRange.End),
+		).
+		Order(goqu.C("time").Desc())
+	if service != "" {
+		ds = ds.Where(goqu.C("service").Eq(service))
+	}
+
+	sqlStr, args, err := ds.Prepared(true).ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	anomalies := []Anomaly{}
+	for rows.Next() {
+		var a Anomaly
+		if err := rows.Scan(&a.Time, &a.Service, &a.Endpoint, &a.Metric, &a.Value, &a.Baseline, &a.Score); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		anomalies = append(anomalies, a)
+	}
+	return anomalies, rows.Err()
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"sort"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// LatencyAttribution splits the time of a workload, a sample of traces, between the
+// services that spent it
+type LatencyAttribution struct {
+	Traces int `json:"traces"`
+	// TotalMs is the summed duration of the root spans of the traces
+	TotalMs  float64               `json:"total_ms"`
+	Services []ServiceLatencyShare `json:"services"`
+}
+
+// ServiceLatencyShare is the exclusive time of a service's spans, the time they
+// weren't waiting on a child span. Concurrent spans each count their own time, so
+// the shares of traces with parallel calls add up to more than their duration.
+type ServiceLatencyShare struct {
+	Service string  `json:"service"`
+	SelfMs  float64 `json:"self_ms"`
+	// Share is the part of the exclusive time of every service, between 0 and 1
+	Share float64 `json:"share"`
+	// Traces is how many traces the service took part in, AvgPerTraceMs its average
+	// exclusive time in those
+	Traces        int     `json:"traces"`
+	AvgPerTraceMs float64 `json:"avg_per_trace_ms"`
+	Spans         int     `json:"spans"`
+}
+
+// GetLatencyAttribution attributes the time of up to limit traces with spans matching
+// query to their services, the services spending the most first
+func (s *TelemetryService) GetLatencyAttribution(ctx context.Context, dateRange DateRange, query string, limit uint) (LatencyAttribution, error) {
+	timeConds := []goqu.Expression{
+		goqu.I("start_time_unix_nano").Gte(dateRange.Start.UnixNano()),
+		goqu.I("start_time_unix_nano").Lte(dateRange.End.UnixNano()),
+	}
+
+	traceIDs := s.DB.
+		From("denormalized_span").
+		Select(goqu.C("trace_id")).
+		Distinct().
+		Where(append(timeConds, s.searchConditions(query, "")...)...).
+		Limit(limit)
+
+	ds := s.DB.
+		From("denormalized_span").
+		Select(spanNodeColumns...).
+		Where(append(timeConds, goqu.C("trace_id").In(traceIDs))...)
+
+	spans, err := s.querySpanNodes(ctx, ds)
+	if err != nil {
+		return LatencyAttribution{}, err
+	}
+	return attributeLatency(buildSpanTree(spans)), nil
+}
+
+// attributeLatency sums the self time of the spans of the trees by service
+func attributeLatency(roots []*spanNode) LatencyAttribution {
+	shares := make(map[string]*ServiceLatencyShare)
+	traces := make(map[string]map[string]bool)
+	var total, selfTotal int64
+
+	var walk func(n *spanNode)
+	walk = func(n *spanNode) {
+		share, ok := shares[n.Service]
+		if !ok {
+			share = &ServiceLatencyShare{Service: n.Service}
+			shares[n.Service] = share
+			traces[n.Service] = make(map[string]bool)
+		}
+		self := selfTime(n)
+		share.SelfMs += float64(self) / 1e6
+		share.Spans++
+		selfTotal += self
+		traces[n.Service][n.TraceID] = true
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	traceIDs := make(map[string]bool)
+	for _, r := range roots {
+		traceIDs[r.TraceID] = true
+		total += max(r.End-r.Start, 0)
+		walk(r)
+	}
+
+	attribution := LatencyAttribution{
+		Traces:   len(traceIDs),
+		TotalMs:  float64(total) / 1e6,
+		Services: make([]ServiceLatencyShare, 0, len(shares)),
+	}
+	for service, share := range shares {
+		share.Traces = len(traces[service])
+		share.AvgPerTraceMs = share.SelfMs / float64(share.Traces)
+		if selfTotal > 0 {
+			share.Share = share.SelfMs * 1e6 / float64(selfTotal)
+		}
+		attribution.Services = append(attribution.Services, *share)
+	}
+	sort.Slice(attribution.Services, func(i, j int) bool {
+		if attribution.Services[i].SelfMs != attribution.Services[j].SelfMs {
+			return attribution.Services[i].SelfMs > attribution.Services[j].SelfMs
+		}
+		return attribution.Services[i].Service < attribution.Services[j].Service
+	})
+	return attribution
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// AttributeStats describes the values of an attribute over the spans of a range
+type AttributeStats struct {
+	Key string `json:"key"`
+	// Spans is how many spans matched, WithValue how many of them had the attribute
+	Spans     uint64 `json:"spans"`
+	WithValue uint64 `json:"with_value"`
+	// DistinctValues is approximate for high cardinality attributes
+	DistinctValues uint64                `json:"distinct_values"`
+	TopValues      []AttributeValueCount `json:"top_values"`
+	// Numeric is set when every value of the attribute is a number
+	Numeric *NumericDistribution `json:"numeric,omitempty"`
+}
+
+// NumericDistribution is the distribution of the values of a numeric attribute
+type NumericDistribution struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// GetAttributeStats returns the cardinality, the k most common values and, for
+// numeric attributes, the distribution of an attribute among the spans matching query
+func (s *TelemetryService) GetAttributeStats(ctx context.Context, dateRange DateRange, key, query string, k uint) (AttributeStats, error) {
+	stats := AttributeStats{Key: key, TopValues: []AttributeValueCount{}}
+	spans := s.DB.
+		From("denormalized_span").
+		Select(goqu.L("?", s.attributeValue(key)).As("value")).
+		Where(s.searchSpanConditions(dateRange, query, "")...)
+	values := s.DB.
+		From(spans.As("spans")).
+		Select(goqu.C("value"), goqu.L("toFloat64OrNull(value)").As("number"))
+
+	ds := s.DB.
+		From(values.As("values")).
+		Select(
+			goqu.L("count()"),
+			goqu.L("countIf(value != '')"),
+			goqu.L("uniqIf(value, value != '')"),
+			goqu.L("countIf(number IS NOT NULL)"),
+			goqu.L("minIf(assumeNotNull(number), number IS NOT NULL)"),
+			goqu.L("maxIf(assumeNotNull(number), number IS NOT NULL)"),
+			goqu.L("avgIf(assumeNotNull(number), number IS NOT NULL)"),
+			goqu.L("quantilesIf(0.5, 0.9, 0.99)(assumeNotNull(number), number IS NOT NULL)"),
+		)
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return stats, err
+	}
+	var numbers uint64
+	var dist NumericDistribution
+	var quantiles []float64
+	err = (*s.Ch).QueryRow(ctx, sqlStr, args...).Scan(
+		&stats.Spans, &stats.WithValue, &stats.DistinctValues, &numbers,
+		&dist.Min, &dist.Max, &dist.Avg, &quantiles,
+	)
+	if err != nil {
+		return stats, fmt.Errorf("query error: %w", err)
+	}
+	if numbers > 0 && numbers == stats.WithValue && len(quantiles) == 3 {
+		dist.P50, dist.P90, dist.P99 = quantiles[0], quantiles[1], quantiles[2]
+		stats.Numeric = &dist
+	}
+	if stats.WithValue == 0 {
+		return stats, nil
+	}
+
+	top := s.DB.
+		From(spans.As("spans")).
+		Select(goqu.C("value"), goqu.L("count()").As("count")).
+		Where(goqu.C("value").Neq("")).
+		GroupBy(goqu.C("value")).
+		Order(goqu.C("count").Desc(), goqu.C("value").Asc()).
+		Limit(k)
+	sqlStr, args, err = top.ToSQL()
+	if err != nil {
+		return stats, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return stats, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v AttributeValueCount
+		if err := rows.Scan(&v.Value, &v.Count); err != nil {
+			return stats, fmt.Errorf("scan error: %w", err)
+		}
+		stats.TopValues = append(stats.TopValues, v)
+	}
+	return stats, rows.Err()
+}
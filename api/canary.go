@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// DefaultCanaryWindow is the window canaries are analyzed over when none is given
+const DefaultCanaryWindow = "1h"
+
+// canarySplits are the shorthands of the split parameter, other values are
+// attribute keys
+var canarySplits = map[string]string{
+	"version":    "service.version",
+	"deployment": "k8s.deployment.name",
+}
+
+// Latency increases of the canary, in percent, above which a significant
+// regression fails the analysis
+const (
+	canaryP50Tolerance = 10
+	canaryP99Tolerance = 25
+)
+
+// Canary verdicts
+const (
+	CanaryPass = "pass"
+	CanaryWarn = "warn"
+	CanaryFail = "fail"
+)
+
+// CanaryRequest compares the spans of a service whose Split attribute is Canary
+// with those where it's Baseline
+type CanaryRequest struct {
+	DateRange DateRange
+	Service   string
+	Split     string
+	Baseline  string
+	Canary    string
+}
+
+// CanaryCohort is the stats of the baseline or the canary
+type CanaryCohort struct {
+	CohortStats
+	// Throughput is in spans per second, it follows the share of the traffic the
+	// cohort gets and isn't judged
+	Throughput float64 `json:"throughput"`
+}
+
+type CanaryAnalysis struct {
+	Service      string             `json:"service"`
+	Split        string             `json:"split"`
+	Baseline     CanaryCohort       `json:"baseline"`
+	Canary       CanaryCohort       `json:"canary"`
+	Deltas       CohortDeltas       `json:"deltas"`
+	Significance CohortSignificance `json:"significance"`
+	Verdict      string             `json:"verdict"`
+	// Reasons explain a warn or fail verdict
+	Reasons []string `json:"reasons"`
+}
+
+// ParseCanaryRequest reads the service, split, baseline and canary parameters and
+// the start/end or timeRange window, the last DefaultCanaryWindow by default
+func ParseCanaryRequest(q url.Values) (CanaryRequest, error) {
+	req := CanaryRequest{
+		Service:  q.Get("service"),
+		Split:    q.Get("split"),
+		Baseline: q.Get("baseline"),
+		Canary:   q.Get("canary"),
+	}
+	if req.Service == "" || req.Baseline == "" || req.Canary == "" {
+		return req, fmt.Errorf("service, baseline and canary are required")
+	}
+	if req.Baseline == req.Canary {
+		return req, fmt.Errorf("baseline and canary must differ")
+	}
+	if req.Split == "" {
+		req.Split = "version"
+	}
+	if key, ok := canarySplits[req.Split]; ok {
+		req.Split = key
+	}
+	dateRange, err := parseDateRangeOr(q, DefaultCanaryWindow)
+	if err != nil {
+		return req, fmt.Errorf("invalid date range")
+	}
+	req.DateRange = dateRange
+	return req, nil
+}
+
+// AnalyzeCanary compares the server and root spans of the canary with those of the
+// baseline and judges whether the canary regressed
+func (s *TelemetryService) AnalyzeCanary(ctx context.Context, req CanaryRequest) (CanaryAnalysis, error) {
+	conds := func(value string) []goqu.Expression {
+		return []goqu.Expression{
+			goqu.C("start_time_unix_nano").Gte(req.DateRange.Start.UnixNano()),
+			goqu.C("start_time_unix_nano").Lte(req.DateRange.End.UnixNano()),
+			resourceAttribute("service.name").Eq(req.Service),
+			goqu.Or(goqu.C("kind").Eq("server"), goqu.C("parent_span_id").Eq("")),
+			goqu.L("? = ?", s.attributeValue(req.Split), value),
+		}
+	}
+	cohorts, err := s.cohortStats(ctx, conds(req.Baseline), conds(req.Canary))
+	if err != nil {
+		return CanaryAnalysis{}, err
+	}
+	cohorts[0].Query, cohorts[1].Query = req.Baseline, req.Canary
+	cmp := compareCohorts(cohorts[0], cohorts[1])
+
+	seconds := req.DateRange.End.Sub(req.DateRange.Start).Seconds()
+	analysis := CanaryAnalysis{
+		Service:      req.Service,
+		Split:        req.Split,
+		Baseline:     CanaryCohort{CohortStats: cmp.A, Throughput: float64(cmp.A.Spans) / seconds},
+		Canary:       CanaryCohort{CohortStats: cmp.B, Throughput: float64(cmp.B.Spans) / seconds},
+		Deltas:       cmp.Deltas,
+		Significance: cmp.Significance,
+	}
+	analysis.Verdict, analysis.Reasons = canaryVerdict(cmp)
+	return analysis, nil
+}
+
+// canaryVerdict fails a canary whose errors or latency are significantly worse than
+// the baseline's, and warns when they're likely worse or there's too little data
+func canaryVerdict(cmp CohortComparison) (string, []string) {
+	verdict, reasons := CanaryPass, []string{}
+	flag := func(v, reason string) {
+		if v == CanaryFail || verdict == CanaryPass {
+			verdict = v
+		}
+		reasons = append(reasons, reason)
+	}
+
+	sig := cmp.Significance
+	if sig.Errors == InsufficientSamples {
+		flag(CanaryWarn, fmt.Sprintf("fewer than %d spans in a cohort to judge", minCohortSpans))
+		return verdict, reasons
+	}
+	if sig.ErrorsZ > 0 {
+		switch sig.Errors {
+		case Significant:
+			flag(CanaryFail, fmt.Sprintf("error rate rose from %.2f%% to %.2f%%", cmp.A.ErrorRate*100, cmp.B.ErrorRate*100))
+		case LikelySignificant:
+			flag(CanaryWarn, fmt.Sprintf("error rate may have risen from %.2f%% to %.2f%%", cmp.A.ErrorRate*100, cmp.B.ErrorRate*100))
+		}
+	}
+	if sig.LatencyZ > 0 && sig.Latency != NotSignificant {
+		regressed := cmp.Deltas.P50Pct > canaryP50Tolerance || cmp.Deltas.P99Pct > canaryP99Tolerance
+		switch {
+		case sig.Latency == Significant && regressed:
+			flag(CanaryFail, fmt.Sprintf("latency rose, p50 %+.1f%% and p99 %+.1f%%", cmp.Deltas.P50Pct, cmp.Deltas.P99Pct))
+		case regressed:
+			flag(CanaryWarn, fmt.Sprintf("latency may have risen, p50 %+.1f%% and p99 %+.1f%%", cmp.Deltas.P50Pct, cmp.Deltas.P99Pct))
+		}
+	}
+	return verdict, reasons
+}
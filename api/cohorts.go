@@ -0,0 +1,217 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// DefaultCohortRange is the range cohorts are compared over when none is given
+const DefaultCohortRange = "24h"
+
+// minCohortSpans is the fewest spans of each cohort a comparison is judged on
+const minCohortSpans = 30
+
+// Significance hints of a cohort comparison
+const (
+	Significant         = "significant"
+	LikelySignificant   = "likely"
+	NotSignificant      = "not_significant"
+	InsufficientSamples = "insufficient_data"
+)
+
+// CohortRequest compares the spans matching query A with those matching query B,
+// both search queries like region=eu
+type CohortRequest struct {
+	DateRange DateRange
+	A         string
+	B         string
+}
+
+// CohortStats is the latency and error distribution of a cohort
+type CohortStats struct {
+	Query     string  `json:"query"`
+	Spans     uint64  `json:"spans"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	AvgMs     float64 `json:"avg_ms"`
+	P50Ms     float64 `json:"p50_ms"`
+	P90Ms     float64 `json:"p90_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+
+	// the mean and variance of the log durations, for the latency test
+	logMean float64
+	logVar  float64
+}
+
+// CohortDeltas are the differences of cohort B from cohort A
+type CohortDeltas struct {
+	AvgMs     float64 `json:"avg_ms"`
+	P50Ms     float64 `json:"p50_ms"`
+	P90Ms     float64 `json:"p90_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	// P50Pct and P99Pct are the deltas relative to cohort A, in percent
+	P50Pct float64 `json:"p50_pct"`
+	P99Pct float64 `json:"p99_pct"`
+}
+
+// CohortSignificance hints whether the differences are more than noise. Latency
+// is judged with Welch's t-test on the log durations, errors with a two-proportion
+// z-test, both approximated with the normal distribution. They're hints, not proof.
+type CohortSignificance struct {
+	Latency  string  `json:"latency"`
+	LatencyZ float64 `json:"latency_z"`
+	Errors   string  `json:"errors"`
+	ErrorsZ  float64 `json:"errors_z"`
+}
+
+type CohortComparison struct {
+	A            CohortStats        `json:"a"`
+	B            CohortStats        `json:"b"`
+	Deltas       CohortDeltas       `json:"deltas"`
+	Significance CohortSignificance `json:"significance"`
+}
+
+// ParseCohortRequest reads the a and b queries and the start/end or timeRange
+// parameters, the last DefaultCohortRange by default
+func ParseCohortRequest(q url.Values) (CohortRequest, error) {
+	req := CohortRequest{A: q.Get("a"), B: q.Get("b")}
+	if req.A == "" || req.B == "" {
+		return req, fmt.Errorf("both cohorts 'a' and 'b' are required")
+	}
+	dateRange, err := parseDateRangeOr(q, DefaultCohortRange)
+	if err != nil {
+		return req, fmt.Errorf("invalid date range")
+	}
+	req.DateRange = dateRange
+	return req, nil
+}
+
+// CompareCohorts compares the latency and error distributions of two cohorts of
+// spans. A span matching both queries counts in both cohorts.
+func (s *TelemetryService) CompareCohorts(ctx context.Context, req CohortRequest) (CohortComparison, error) {
+	cohorts, err := s.cohortStats(ctx,
+		s.searchSpanConditions(req.DateRange, req.A, ""),
+		s.searchSpanConditions(req.DateRange, req.B, ""),
+	)
+	if err != nil {
+		return CohortComparison{}, err
+	}
+	cohorts[0].Query, cohorts[1].Query = req.A, req.B
+	return compareCohorts(cohorts[0], cohorts[1]), nil
+}
+
+// cohortStats returns the stats of the spans matching a and of those matching b
+func (s *TelemetryService) cohortStats(ctx context.Context, a, b []goqu.Expression) ([2]CohortStats, error) {
+	var cohorts [2]CohortStats
+	cohort := func(conds []goqu.Expression, index int) *goqu.SelectDataset {
+		return s.DB.
+			From("denormalized_span").
+			Select(
+				goqu.L("?", index).As("cohort"),
+				goqu.I("duration_ns"),
+				goqu.L("has(events.name, 'exception')").As("error"),
+			).
+			Where(conds...)
+	}
+	ds := s.DB.
+		From(cohort(a, 0).UnionAll(cohort(b, 1)).As("cohorts")).
+		Select(
+			goqu.C("cohort"),
+			goqu.L("count()"),
+			goqu.L("countIf(error)"),
+			goqu.L("avg(duration_ns) / 1e6"),
+			goqu.L("arrayMap(x -> x / 1e6, quantiles(0.5, 0.9, 0.95, 0.99)(duration_ns))"),
+			goqu.L("avg(log1p(duration_ns))"),
+			goqu.L("varSamp(log1p(duration_ns))"),
+		).
+		GroupBy(goqu.C("cohort"))
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return cohorts, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return cohorts, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var index uint8
+		var quantiles []float64
+		var c CohortStats
+		if err := rows.Scan(&index, &c.Spans, &c.Errors, &c.AvgMs, &quantiles, &c.logMean, &c.logVar); err != nil {
+			return cohorts, fmt.Errorf("scan error: %w", err)
+		}
+		if int(index) >= len(cohorts) || len(quantiles) != 4 {
+			continue
+		}
+		c.ErrorRate = float64(c.Errors) / float64(c.Spans)
+		c.P50Ms, c.P90Ms, c.P95Ms, c.P99Ms = quantiles[0], quantiles[1], quantiles[2], quantiles[3]
+		cohorts[index] = c
+	}
+	if err := rows.Err(); err != nil {
+		return cohorts, fmt.Errorf("rows error: %w", err)
+	}
+	return cohorts, nil
+}
+
+func compareCohorts(a, b CohortStats) CohortComparison {
+	cmp := CohortComparison{
+		A: a,
+		B: b,
+		Deltas: CohortDeltas{
+			AvgMs:     b.AvgMs - a.AvgMs,
+			P50Ms:     b.P50Ms - a.P50Ms,
+			P90Ms:     b.P90Ms - a.P90Ms,
+			P95Ms:     b.P95Ms - a.P95Ms,
+			P99Ms:     b.P99Ms - a.P99Ms,
+			ErrorRate: b.ErrorRate - a.ErrorRate,
+			P50Pct:    percentChange(a.P50Ms, b.P50Ms),
+			P99Pct:    percentChange(a.P99Ms, b.P99Ms),
+		},
+		Significance: CohortSignificance{Latency: InsufficientSamples, Errors: InsufficientSamples},
+	}
+	if a.Spans < minCohortSpans || b.Spans < minCohortSpans {
+		return cmp
+	}
+	na, nb := float64(a.Spans), float64(b.Spans)
+
+	if se := math.Sqrt(a.logVar/na + b.logVar/nb); se > 0 {
+		cmp.Significance.LatencyZ = (b.logMean - a.logMean) / se
+	}
+	cmp.Significance.Latency = significance(cmp.Significance.LatencyZ)
+
+	pooled := float64(a.Errors+b.Errors) / (na + nb)
+	if se := math.Sqrt(pooled * (1 - pooled) * (1/na + 1/nb)); se > 0 {
+		cmp.Significance.ErrorsZ = (float64(b.Errors)/nb - float64(a.Errors)/na) / se
+	}
+	cmp.Significance.Errors = significance(cmp.Significance.ErrorsZ)
+	return cmp
+}
+
+// significance hints at the significance of a z score, two-sided p < 0.01 being
+// significant and p < 0.05 likely
+func significance(z float64) string {
+	switch z = math.Abs(z); {
+	case z >= 2.576:
+		return Significant
+	case z >= 1.96:
+		return LikelySignificant
+	}
+	return NotSignificant
+}
+
+func percentChange(from, to float64) float64 {
+	if from == 0 {
+		return 0
+	}
+	return (to - from) / from * 100
+}
@@ -1,13 +1,16 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 
+	"nabatshy/auth"
 	"nabatshy/utils"
 
 	"github.com/go-chi/chi/v5"
@@ -25,6 +28,8 @@ var (
 
 type TelemetryController struct {
 	service TelemetryService
+	// shares signs the links of shared traces, sharing is disabled when nil
+	shares *auth.ShareSigner
 }
 
 func (c *TelemetryController) getTopNSlowestTraces(w http.ResponseWriter, r *http.Request) {
@@ -38,17 +43,20 @@ func (c *TelemetryController) getTopNSlowestTraces(w http.ResponseWriter, r *htt
 		return
 	}
 	n := uint(n64)
+	dateRange, err := parseDateRangeOr(r.URL.Query(), "24h")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Fetch data
-	traces, err := c.service.GetTopSlowTraces(r.Context(), n)
+	traces, err := c.service.GetTopSlowTraces(r.Context(), n, dateRange, r.URL.Query().Get("service"))
 	if err != nil {
 		http.Error(w, "failed to fetch traces: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Write JSON response
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(traces); err != nil {
+	if err := utils.WriteJSON(w, r, traces); err != nil {
 		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -63,8 +71,7 @@ func (c *TelemetryController) getServiceTraces(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(traces); err != nil {
+	if err := utils.WriteJSON(w, r, traces); err != nil {
 		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -79,55 +86,89 @@ func (c *TelemetryController) getTraceDetails(w http.ResponseWriter, r *http.Req
 	}
 
 	spans, err := c.service.GetTraceDetails(r.Context(), traceID)
+	if errors.Is(err, ErrTraceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "failed to fetch trace details: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(spans); err != nil {
+	if err := utils.WriteJSON(w, r, spans); err != nil {
 		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
 func (c *TelemetryController) getEndpointLatencies(w http.ResponseWriter, r *http.Request) {
-	latencies, err := c.service.GetEndpointLatencies(r.Context())
+	req, err := ParseEndpointLatencyRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	latencies, err := c.service.GetEndpointLatencies(r.Context(), req)
 	if err != nil {
 		http.Error(w, "failed to fetch endpoint latencies: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(latencies); err != nil {
+	if err := utils.WriteJSON(w, r, latencies); err != nil {
 		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
 func (c *TelemetryController) getServiceDependencies(w http.ResponseWriter, r *http.Request) {
-	dependencies, err := c.service.GetServiceDependencies(r.Context())
+	dateRange, err := parseDateRangeOr(r.URL.Query(), "24h")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dependencies, err := c.service.GetServiceDependencies(r.Context(), dateRange)
 	if err != nil {
 		http.Error(w, "failed to fetch service dependencies: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(dependencies); err != nil {
+	if err := utils.WriteJSON(w, r, dependencies); err != nil {
 		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+func (c *TelemetryController) getTraceList(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseTraceListRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	traces, err := c.service.GetTraceList(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list traces: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, traces)
+}
+
 func (c *TelemetryController) getTraceHeatmap(w http.ResponseWriter, r *http.Request) {
-	heatmap, err := c.service.GetTraceHeatmap(r.Context())
+	req, err := ParseTraceHeatmapRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	heatmap, err := c.service.GetTraceHeatmap(r.Context(), req)
 	if err != nil {
 		http.Error(w, "failed to fetch trace heatmap: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(heatmap); err != nil {
+	if err := utils.WriteJSON(w, r, heatmap); err != nil {
 		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -140,19 +181,39 @@ func (c *TelemetryController) getSpanDetails(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "invalid span_id", http.StatusBadRequest)
 		return
 	}
-	detail, err := c.service.GetSpanDetails(r.Context(), spanID)
+	cmp, err := ParseSpanComparison(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	detail, err := c.service.GetSpanDetails(r.Context(), spanID, cmp)
 	if err != nil {
 		http.Error(w, "failed to fetch span details: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(detail); err != nil {
+	if err := utils.WriteJSON(w, r, detail); err != nil {
 		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+func (c *TelemetryController) getSourceLink(w http.ResponseWriter, r *http.Request) {
+	spanID, err := url.QueryUnescape(chi.URLParam(r, "span_id"))
+	if err != nil {
+		http.Error(w, "invalid span_id", http.StatusBadRequest)
+		return
+	}
+
+	link, err := c.service.GetSourceLink(r.Context(), spanID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to build source link: %v", err), http.StatusNotFound)
+		return
+	}
+
+	utils.WriteJSON(w, r, link)
+}
+
 func (c *TelemetryController) searchTraces(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query().Get("query")
 	page, err := strconv.Atoi(r.URL.Query().Get("page"))
@@ -165,17 +226,7 @@ func (c *TelemetryController) searchTraces(w http.ResponseWriter, r *http.Reques
 		pageSize = 10
 	}
 
-	sortField := r.URL.Query().Get("sortField")
-
-	sortOrder := r.URL.Query().Get("sortOrder")
-	if sortOrder != "asc" && sortOrder != "desc" {
-		sortOrder = "desc" // default to descending
-	}
-
-	sort := SortOption{
-		Field: sortField,
-		Order: sortOrder,
-	}
+	sort := ParseSortOption(r.URL.Query())
 	var dateRange DateRange
 	startStr := r.URL.Query().Get("start")
 	endStr := r.URL.Query().Get("end")
@@ -193,14 +244,18 @@ func (c *TelemetryController) searchTraces(w http.ResponseWriter, r *http.Reques
 		dateRange = GetDateRangeFromQuery(timeRange)
 	}
 	traceOrSpan := r.URL.Query().Get("traceOrSpan")
-	results, err := c.service.SearchTraces(r.Context(), dateRange, query, page, pageSize, sort, traceOrSpan)
+	opts := SearchOptions{
+		IncludeFacets: r.URL.Query().Get("includeFacets") == "true",
+		Approx:        r.URL.Query().Get("approx") == "true",
+	}
+	results, err := c.service.SearchTraces(r.Context(), dateRange, query, page, pageSize, sort, traceOrSpan, opts)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to search traces: %v", err), http.StatusInternalServerError)
 		return
 	}
+	results.Meta = c.responseMeta(r.Context())
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(results)
+	utils.WriteJSON(w, r, results)
 }
 
 func (c *TelemetryController) getTraceMetrics(w http.ResponseWriter, r *http.Request) {
@@ -216,8 +271,7 @@ func (c *TelemetryController) getTraceMetrics(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(metrics)
+	utils.WriteJSON(w, r, metrics)
 }
 
 func (c *TelemetryController) getServiceMetrics(w http.ResponseWriter, r *http.Request) {
@@ -239,14 +293,18 @@ func (c *TelemetryController) getServiceMetrics(w http.ResponseWriter, r *http.R
 		}
 	}
 
-	metrics, err := c.service.GetServiceMetrics(r.Context(), timeRange, startTime, endTime)
+	ctx, err := c.listingContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metrics, err := c.service.GetServiceMetrics(ctx, timeRange, startTime, endTime)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to get service metrics: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(metrics)
+	utils.WriteJSON(w, r, metrics)
 }
 
 func (c *TelemetryController) getEndpointMetrics(w http.ResponseWriter, r *http.Request) {
@@ -262,8 +320,7 @@ func (c *TelemetryController) getEndpointMetrics(w http.ResponseWriter, r *http.
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(metrics)
+	utils.WriteJSON(w, r, metrics)
 }
 
 func (c *TelemetryController) getPMetrics(w http.ResponseWriter, r *http.Request) {
@@ -287,8 +344,7 @@ func (c *TelemetryController) getPMetrics(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(series)
+	utils.WriteJSON(w, r, series)
 }
 
 func (c *TelemetryController) getAvgDuration(w http.ResponseWriter, r *http.Request) {
@@ -305,8 +361,7 @@ func (c *TelemetryController) getAvgDuration(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(series)
+	utils.WriteJSON(w, r, series)
 }
 
 func (c *TelemetryController) getErrorCounts(w http.ResponseWriter, r *http.Request) {
@@ -323,8 +378,7 @@ func (c *TelemetryController) getErrorCounts(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(counts)
+	utils.WriteJSON(w, r, counts)
 }
 
 func (c *TelemetryController) getSearchMetrics(w http.ResponseWriter, r *http.Request) {
@@ -361,38 +415,518 @@ func (c *TelemetryController) getSearchMetrics(w http.ResponseWriter, r *http.Re
 		http.Error(w, fmt.Sprintf("failed to get search metrics: %v", err), http.StatusInternalServerError)
 		return
 	}
+	// the result may be shared with coalesced requests, annotate a copy
+	response := *metrics
+	response.Meta = c.responseMeta(r.Context())
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(metrics)
+	utils.WriteJSON(w, r, response)
+}
+
+// listingContext returns the context of a request listing services, which leaves
+// retired services out unless includeRetired=true
+func (c *TelemetryController) listingContext(r *http.Request) (context.Context, error) {
+	if r.URL.Query().Get("includeRetired") == "true" {
+		return r.Context(), nil
+	}
+	return c.service.WithoutRetired(r.Context())
 }
 
 func (c *TelemetryController) getUniqueServiceNames(w http.ResponseWriter, r *http.Request) {
-	services, err := c.service.GetUniqueServiceNames(r.Context())
+	ctx, err := c.listingContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	services, err := c.service.GetUniqueServiceNames(ctx)
 	if err != nil {
 		http.Error(w, "failed to get service names", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(services)
+	utils.WriteJSON(w, r, services)
+}
+
+func (c *TelemetryController) getAttributeKeys(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dr, err := ParseDateRange(q, "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	limit := uint(100)
+	if ls := q.Get("limit"); ls != "" {
+		l, err := strconv.ParseUint(ls, 10, 32)
+		if err != nil || l == 0 {
+			http.Error(w, "invalid parameter 'limit'", http.StatusBadRequest)
+			return
+		}
+		limit = uint(l)
+	}
+
+	keys, err := c.service.GetAttributeKeys(r.Context(), dr, q.Get("prefix"), limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get attribute keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, keys)
+}
+
+func (c *TelemetryController) getAttributeTopK(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dr, err := ParseDateRange(q, "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+	key := q.Get("key")
+	if key == "" {
+		http.Error(w, "missing parameter 'key'", http.StatusBadRequest)
+		return
+	}
+
+	k := uint(5)
+	if ks := q.Get("k"); ks != "" {
+		v, err := strconv.ParseUint(ks, 10, 32)
+		if err != nil || v == 0 || v > 100 {
+			http.Error(w, "invalid parameter 'k'", http.StatusBadRequest)
+			return
+		}
+		k = uint(v)
+	}
+
+	buckets, err := c.service.GetAttributeTopK(r.Context(), dr, key, q.Get("query"), k)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get attribute top values: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, buckets)
+}
+
+func (c *TelemetryController) getAttributeStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dr, err := ParseDateRange(q, "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+	key := q.Get("key")
+	if key == "" {
+		http.Error(w, "missing parameter 'key'", http.StatusBadRequest)
+		return
+	}
+
+	k := uint(10)
+	if ks := q.Get("k"); ks != "" {
+		v, err := strconv.ParseUint(ks, 10, 32)
+		if err != nil || v == 0 || v > 100 {
+			http.Error(w, "invalid parameter 'k'", http.StatusBadRequest)
+			return
+		}
+		k = uint(v)
+	}
+
+	stats, err := c.service.GetAttributeStats(r.Context(), dr, key, q.Get("query"), k)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get attribute stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, stats)
+}
+
+func (c *TelemetryController) compareCohorts(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseCohortRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	comparison, err := c.service.CompareCohorts(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to compare cohorts: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, comparison)
+}
+
+func (c *TelemetryController) getErrorGroups(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseErrorRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groups, err := c.service.GetErrorGroups(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get error groups: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, groups)
+}
+
+func (c *TelemetryController) getErrorOccurrences(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseErrorRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	occurrences, err := c.service.GetErrorOccurrences(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get errors: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, occurrences)
+}
+
+func (c *TelemetryController) getErrorInbox(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseInboxRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := c.service.GetErrorInbox(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get error inbox: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, entries)
+}
+
+// setErrorGroupStatus triages the error group of the fingerprint with a
+// {"status": "resolved"} body
+func (c *TelemetryController) setErrorGroupStatus(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch body.Status {
+	case ErrorGroupOpen, ErrorGroupResolved, ErrorGroupIgnored:
+	default:
+		http.Error(w, fmt.Sprintf("invalid status %q, use open, resolved or ignored", body.Status), http.StatusBadRequest)
+		return
+	}
+
+	state, err := c.service.SetErrorGroupStatus(r.Context(), chi.URLParam(r, "fingerprint"), body.Status)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to update error group: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, state)
+}
+
+func (c *TelemetryController) getDBQueries(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseDBQueryRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queries, err := c.service.GetDBQueries(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get database queries: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, queries)
+}
+
+func (c *TelemetryController) getDBQuerySpans(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseDBQueryRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Fingerprint = chi.URLParam(r, "fingerprint")
+
+	spans, err := c.service.GetDBQuerySpans(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get database query spans: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, spans)
+}
+
+func (c *TelemetryController) getHTTPEndpoints(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseHTTPEndpointRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	endpoints, err := c.service.GetHTTPEndpoints(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get http endpoints: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, endpoints)
+}
+
+func (c *TelemetryController) getServiceVersions(w http.ResponseWriter, r *http.Request) {
+	service, err := url.QueryUnescape(chi.URLParam(r, "service"))
+	if err != nil {
+		http.Error(w, "invalid service", http.StatusBadRequest)
+		return
+	}
+	dr, err := parseDateRangeOr(r.URL.Query(), DefaultVersionRange)
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	versions, err := c.service.GetServiceVersions(r.Context(), service, dr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get service versions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, versions)
+}
+
+func (c *TelemetryController) analyzeCanary(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseCanaryRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	analysis, err := c.service.AnalyzeCanary(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to analyze canary: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, analysis)
+}
+
+func (c *TelemetryController) getServiceCatalog(w http.ResponseWriter, r *http.Request) {
+	dr, err := ParseDateRange(r.URL.Query(), "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	ctx, err := c.listingContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	approx := r.URL.Query().Get("approx") == "true"
+	services, err := c.service.GetServiceCatalog(ctx, dr, approx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get services: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, services)
+}
+
+func (c *TelemetryController) getServiceHealth(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dr, err := ParseDateRange(q, "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	// the baseline is the period right before the selected window, a week by default
+	baselineParam := q.Get("baseline")
+	if baselineParam == "" {
+		baselineParam = "7d"
+	}
+	baselineRange := GetDateRangeFromQuery(baselineParam)
+	baseline := baselineRange.End.Sub(baselineRange.Start)
+	if baseline <= 0 {
+		http.Error(w, "invalid parameter 'baseline'", http.StatusBadRequest)
+		return
+	}
+
+	ctx, err := c.listingContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	health, err := c.service.GetServiceHealth(ctx, dr, baseline)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get service health: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, health)
+}
+
+func (c *TelemetryController) getQueueWait(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dr, err := ParseDateRange(q, "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	series, err := c.service.GetQueueWaitSeries(r.Context(), dr, q.Get("topic"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get queue wait series: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, series)
+}
+
+func (c *TelemetryController) getTraceFlamegraph(w http.ResponseWriter, r *http.Request) {
+	traceID, err := url.QueryUnescape(chi.URLParam(r, "trace_id"))
+	if err != nil {
+		http.Error(w, "invalid trace_id", http.StatusBadRequest)
+		return
+	}
+
+	flamegraph, err := c.service.GetTraceFlamegraph(r.Context(), traceID)
+	if errors.Is(err, ErrTraceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to build flamegraph: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, flamegraph)
+}
+
+func (c *TelemetryController) getTraceGraph(w http.ResponseWriter, r *http.Request) {
+	traceID, err := url.QueryUnescape(chi.URLParam(r, "trace_id"))
+	if err != nil {
+		http.Error(w, "invalid trace_id", http.StatusBadRequest)
+		return
+	}
+
+	graph, err := c.service.GetTraceGraph(r.Context(), traceID)
+	if errors.Is(err, ErrTraceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to build trace graph: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, graph)
+}
+
+func (c *TelemetryController) getAggregatedFlamegraph(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dr, err := ParseDateRange(q, "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	limit := uint(100)
+	if ls := q.Get("limit"); ls != "" {
+		l, err := strconv.ParseUint(ls, 10, 32)
+		if err != nil || l == 0 {
+			http.Error(w, "invalid parameter 'limit'", http.StatusBadRequest)
+			return
+		}
+		limit = uint(l)
+	}
+
+	flamegraph, err := c.service.GetAggregatedFlamegraph(r.Context(), dr, q.Get("query"), limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to build flamegraph: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, flamegraph)
+}
+
+func (c *TelemetryController) getLatencyAttribution(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dr, err := ParseDateRange(q, "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	limit := uint(100)
+	if ls := q.Get("limit"); ls != "" {
+		l, err := strconv.ParseUint(ls, 10, 32)
+		if err != nil || l == 0 {
+			http.Error(w, "invalid parameter 'limit'", http.StatusBadRequest)
+			return
+		}
+		limit = uint(l)
+	}
+
+	attribution, err := c.service.GetLatencyAttribution(r.Context(), dr, q.Get("query"), limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to attribute latency: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, attribution)
 }
 
 func (c *TelemetryController) RegisterRoutes(r chi.Router) {
-	r.Get("/v1/traces/slowest", c.getTopNSlowestTraces)
-	r.Get("/v1/traces/service/{service}", c.getServiceTraces)
-	r.Get("/v1/traces/{trace_id}", c.getTraceDetails)
-	r.Get("/v1/traces/endpoints", c.getEndpointLatencies)
-	r.Get("/v1/traces/dependencies", c.getServiceDependencies)
-	r.Get("/v1/traces/heatmap", c.getTraceHeatmap)
-	r.Get("/v1/spans/{span_id}", c.getSpanDetails)
-	r.Get("/v1/search", c.searchTraces)
-
-	r.Get("/api/metrics/traces", c.getTraceMetrics)
-	r.Get("/api/metrics/services", c.getServiceMetrics)
-	r.Get("/api/metrics/endpoints", c.getEndpointMetrics)
-	r.Get("/api/metrics/pseries", c.getPMetrics)
-	r.Get("/api/metrics/avg", c.getAvgDuration)
-	r.Get("/api/metrics/errors", c.getErrorCounts)
-	r.Get("/api/metrics/search", c.getSearchMetrics)
-	r.Get("/api/services", c.getUniqueServiceNames)
+	r.Group(func(r chi.Router) {
+		r.Use(c.queryMetaMiddleware)
+
+		r.Get("/v1/traces", c.getTraceList)
+		r.Get("/v1/traces/slowest", c.getTopNSlowestTraces)
+		r.Get("/v1/traces/service/{service}", c.getServiceTraces)
+		r.Get("/v1/traces/{trace_id}", c.getTraceDetails)
+		r.Get("/v1/traces/{trace_id}/flamegraph", c.getTraceFlamegraph)
+		r.Get("/v1/traces/{trace_id}/graph", c.getTraceGraph)
+		r.Post("/v1/traces/{trace_id}/share", c.shareTrace)
+		r.Get("/v1/shared/{token}", c.getSharedTrace)
+		r.Get("/v1/traces/endpoints", c.getEndpointLatencies)
+		r.Get("/v1/traces/dependencies", c.getServiceDependencies)
+		r.Get("/v1/traces/heatmap", c.getTraceHeatmap)
+		r.Get("/v1/spans/{span_id}", c.getSpanDetails)
+		r.Get("/v1/spans/{span_id}/source", c.getSourceLink)
+		r.Get("/v1/search", c.searchTraces)
+		r.Get("/v1/search/export", c.exportSearch)
+		r.Get("/v1/flamegraph", c.getAggregatedFlamegraph)
+		r.Get("/v1/attributes/keys", c.getAttributeKeys)
+		r.Get("/v1/attributes/topk", c.getAttributeTopK)
+		r.Get("/v1/attributes/stats", c.getAttributeStats)
+		r.Get("/v1/analytics/cohorts", c.compareCohorts)
+		r.Get("/v1/analytics/attribution", c.getLatencyAttribution)
+		r.Get("/v1/analysis/canary", c.analyzeCanary)
+		r.Get("/v1/errors", c.getErrorGroups)
+		r.Get("/v1/errors/occurrences", c.getErrorOccurrences)
+		r.Get("/v1/errors/inbox", c.getErrorInbox)
+		r.Put("/v1/errors/groups/{fingerprint}", c.setErrorGroupStatus)
+		r.Get("/v1/db/queries", c.getDBQueries)
+		r.Get("/v1/db/queries/{fingerprint}/spans", c.getDBQuerySpans)
+		r.Get("/v1/http/endpoints", c.getHTTPEndpoints)
+		r.Get("/v1/services", c.getServiceCatalog)
+		r.Get("/v1/services/health", c.getServiceHealth)
+		r.Get("/v1/services/{service}/versions", c.getServiceVersions)
+
+		r.Get("/api/metrics/traces", c.getTraceMetrics)
+		r.Get("/api/metrics/services", c.getServiceMetrics)
+		r.Get("/api/metrics/endpoints", c.getEndpointMetrics)
+		r.Get("/api/metrics/pseries", c.getPMetrics)
+		r.Get("/api/metrics/avg", c.getAvgDuration)
+		r.Get("/api/metrics/errors", c.getErrorCounts)
+		r.Get("/api/metrics/search", c.getSearchMetrics)
+		r.Get("/api/metrics/queue-wait", c.getQueueWait)
+		r.Get("/api/services", c.getUniqueServiceNames)
+
+		c.registerV2Routes(r)
+	})
 }
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// DefaultDBQueryRange is the range database queries are ranked over when none is given
+const DefaultDBQueryRange = "24h"
+
+const maxDBQueries = 500
+
+// dbQuerySorts are the orders database queries can be ranked by
+var dbQuerySorts = map[string]string{
+	"total": "total_ms",
+	"calls": "calls",
+	"p95":   "p95_ms",
+	"avg":   "avg_ms",
+}
+
+// DBQueryRequest ranks the statements of database spans, Fingerprint only applies
+// to the spans of a statement
+type DBQueryRequest struct {
+	DateRange   DateRange
+	Service     string
+	System      string
+	Fingerprint string
+	Sort        string
+	Limit       uint
+}
+
+// SpanRef points to a span
+type SpanRef struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+}
+
+// DBQuery is the statements of database spans sharing a fingerprint, i.e. the same
+// statement with different values
+type DBQuery struct {
+	Fingerprint string   `json:"fingerprint"`
+	Statement   string   `json:"statement"`
+	System      string   `json:"system"`
+	Services    []string `json:"services"`
+	Calls       uint64   `json:"calls"`
+	Errors      uint64   `json:"errors"`
+	TotalMs     float64  `json:"total_ms"`
+	AvgMs       float64  `json:"avg_ms"`
+	P95Ms       float64  `json:"p95_ms"`
+	// Slowest is the slowest span running the statement
+	Slowest SpanRef `json:"slowest"`
+}
+
+// DBQuerySpan is a database span running a statement
+type DBQuerySpan struct {
+	SpanRef
+	Service    string    `json:"service"`
+	Statement  string    `json:"statement"`
+	DurationMs float64   `json:"duration_ms"`
+	Time       time.Time `json:"time"`
+	HasError   bool      `json:"has_error"`
+}
+
+// ParseDBQueryRequest reads the start/end or timeRange, service, system, sort and
+// limit parameters, the 50 statements with the most total time over the last
+// DefaultDBQueryRange by default
+func ParseDBQueryRequest(q url.Values) (DBQueryRequest, error) {
+	req := DBQueryRequest{Service: q.Get("service"), System: q.Get("system"), Sort: q.Get("sort"), Limit: 50}
+	dateRange, err := parseDateRangeOr(q, DefaultDBQueryRange)
+	if err != nil {
+		return req, fmt.Errorf("invalid date range")
+	}
+	req.DateRange = dateRange
+	if req.Sort == "" {
+		req.Sort = "total"
+	}
+	if _, ok := dbQuerySorts[req.Sort]; !ok {
+		return req, fmt.Errorf("invalid sort %q, use total, calls, p95 or avg", req.Sort)
+	}
+	if ls := q.Get("limit"); ls != "" {
+		l, err := strconv.ParseUint(ls, 10, 32)
+		if err != nil || l == 0 || l > maxDBQueries {
+			return req, fmt.Errorf("invalid parameter 'limit'")
+		}
+		req.Limit = uint(l)
+	}
+	return req, nil
+}
+
+// dbSpans selects the database spans with a fingerprinted statement
+func (s *TelemetryService) dbSpans(req DBQueryRequest, columns ...any) *goqu.SelectDataset {
+	fingerprint := s.attributeValue("db.statement.fingerprint")
+	conds := []goqu.Expression{
+		goqu.C("start_time_unix_nano").Gte(req.DateRange.Start.UnixNano()),
+		goqu.C("start_time_unix_nano").Lte(req.DateRange.End.UnixNano()),
+		goqu.L("? != ''", fingerprint),
+	}
+	if req.Service != "" {
+		conds = append(conds, resourceAttribute("service.name").Eq(req.Service))
+	}
+	if req.System != "" {
+		conds = append(conds, goqu.L("? = ?", s.attributeValue("db.system"), req.System))
+	}
+	if req.Fingerprint != "" {
+		conds = append(conds, goqu.L("? = ?", fingerprint, req.Fingerprint))
+	}
+	columns = append([]any{
+		goqu.L("?", fingerprint).As("fingerprint"),
+		goqu.L("?", s.attributeValue("db.statement.normalized")).As("statement"),
+		goqu.L("?", s.attributeValue("db.system")).As("system"),
+		resourceAttribute("service.name").As("service"),
+		goqu.C("trace_id"),
+		goqu.C("span_id"),
+		goqu.L("duration_ns / 1e6").As("duration_ms"),
+		goqu.L("has(events.name, 'exception')").As("has_error"),
+	}, columns...)
+	spans := s.DB.From("denormalized_span").Select(columns...).Where(conds...)
+	return s.DB.From(spans.As("spans"))
+}
+
+// GetDBQueries ranks the statements of database spans
+func (s *TelemetryService) GetDBQueries(ctx context.Context, req DBQueryRequest) ([]DBQuery, error) {
+	ds := s.dbSpans(req).
+		Select(
+			goqu.C("fingerprint"),
+			goqu.L("any(statement)"),
+			goqu.L("any(system)"),
+			goqu.L("groupUniqArray(service)"),
+			goqu.L("count()").As("calls"),
+			goqu.L("countIf(has_error)"),
+			goqu.L("sum(duration_ms)").As("total_ms"),
+			goqu.L("avg(duration_ms)").As("avg_ms"),
+			goqu.L("quantile(0.95)(duration_ms)").As("p95_ms"),
+			goqu.L("argMax(trace_id, duration_ms)"),
+			goqu.L("argMax(span_id, duration_ms)"),
+		).
+		GroupBy(goqu.C("fingerprint")).
+		Order(goqu.C(dbQuerySorts[req.Sort]).Desc(), goqu.C("fingerprint").Asc()).
+		Limit(req.Limit)
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	queries := []DBQuery{}
+	for rows.Next() {
+		var q DBQuery
+		if err := rows.Scan(&q.Fingerprint, &q.Statement, &q.System, &q.Services, &q.Calls, &q.Errors, &q.TotalMs, &q.AvgMs, &q.P95Ms, &q.Slowest.TraceID, &q.Slowest.SpanID); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
+
+// GetDBQuerySpans lists the slowest spans running the statement of the fingerprint,
+// with the statement as sent
+func (s *TelemetryService) GetDBQuerySpans(ctx context.Context, req DBQueryRequest) ([]DBQuerySpan, error) {
+	ds := s.dbSpans(req,
+		goqu.L("if(? != '', ?, ?)", s.attributeValue("db.statement"), s.attributeValue("db.statement"), s.attributeValue("db.query.text")).As("raw_statement"),
+		goqu.L("fromUnixTimestamp64Nano(start_time_unix_nano)").As("time"),
+	).
+		Select(
+			goqu.C("trace_id"),
+			goqu.C("span_id"),
+			goqu.C("service"),
+			goqu.C("raw_statement"),
+			goqu.C("duration_ms"),
+			goqu.C("time"),
+			goqu.C("has_error"),
+		).
+		Order(goqu.C("duration_ms").Desc()).
+		Limit(req.Limit)
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	spans := []DBQuerySpan{}
+	for rows.Next() {
+		var span DBQuerySpan
+		if err := rows.Scan(&span.TraceID, &span.SpanID, &span.Service, &span.Statement, &span.DurationMs, &span.Time, &span.HasError); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		spans = append(spans, span)
+	}
+	return spans, rows.Err()
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"nabatshy/db"
+)
+
+const (
+	// edgeInterval is how often the service edges are aggregated
+	edgeInterval = time.Minute
+	// edgeLag is how long the aggregation waits for the spans of a minute to arrive
+	edgeLag = 5 * time.Minute
+	// edgeSlack is how long after its caller a called span may start
+	edgeSlack = 5 * time.Minute
+	// edgeBackfill is how far back the first aggregation goes
+	edgeBackfill = time.Hour
+	// edgeWatermark is the setting holding the end of the aggregated minutes
+	edgeWatermark = "service_edges_until"
+)
+
+// ParseServiceEdges parses the SERVICE_EDGES setting, "live" (the default) or
+// "precomputed", into whether the dependencies are read from service_edges
+func ParseServiceEdges(s string) (bool, error) {
+	switch s {
+	case "", "live":
+		return false, nil
+	case "precomputed":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid service edges %q, use \"live\" or \"precomputed\"", s)
+}
+
+// edgeService is the service of a span, its service.name or its scope without one
+const edgeService = `if(resource_attributes.value[indexOf(resource_attributes.key, 'service.name')] != '',
+		resource_attributes.value[indexOf(resource_attributes.key, 'service.name')], scope_name)`
+
+// EdgeCallsSQL selects the calls between services whose calling span started in
+// [start, end). A call is a client or producer span of one service with a server or
+// consumer span of another as its child, or linking to it from another trace as
+// consumers of a queue do. Spans stored before kinds were recorded are paired when
+// neither has a kind. Every call has its source, target and start, and the
+// trace_id, span_id, failed and duration_ms of the called span.
+func EdgeCallsSQL(start, end time.Time) string {
+	from, to, childTo := start.UnixNano(), end.UnixNano(), end.Add(edgeSlack).UnixNano()
+	return fmt.Sprintf(`
+		SELECT
+			caller.service AS source,
+			called.service AS target,
+			caller.start AS start,
+			called.trace_id AS trace_id,
+			called.span_id AS span_id,
+			called.failed AS failed,
+			called.duration_ms AS duration_ms
+		FROM (
+			SELECT trace_id, span_id, kind, %[1]s AS service, start_time_unix_nano AS start
+			FROM denormalized_span
+			WHERE start_time_unix_nano >= %[2]d AND start_time_unix_nano < %[3]d
+				AND kind IN ('client', 'producer', '')
+		) AS caller
+		INNER JOIN (
+			SELECT trace_id, span_id, parent_span_id AS caller_span_id, kind, %[1]s AS service,
+				has(events.name, 'exception') AS failed, duration_ns / 1000000 AS duration_ms
+			FROM denormalized_span
+			WHERE start_time_unix_nano >= %[2]d AND start_time_unix_nano < %[4]d
+				AND kind IN ('server', 'consumer', '') AND parent_span_id != ''
+			UNION ALL
+			SELECT links.trace_id AS trace_id, span_id, links.span_id AS caller_span_id, kind, %[1]s AS service,
+				has(events.name, 'exception') AS failed, duration_ns / 1000000 AS duration_ms
+			FROM denormalized_span
+			ARRAY JOIN links
+			WHERE start_time_unix_nano >= %[2]d AND start_time_unix_nano < %[4]d
+				AND kind IN ('server', 'consumer') AND links.span_id != parent_span_id
+		) AS called ON called.trace_id = caller.trace_id AND called.caller_span_id = caller.span_id
+		WHERE caller.service != called.service AND (caller.kind = '') = (called.kind = '')`,
+		edgeService, from, to, childTo)
+}
+
+// liveDependencies computes the dependencies from the spans
+func (s *TelemetryService) liveDependencies(ctx context.Context, dateRange DateRange) ([]ServiceDependency, error) {
+	query := fmt.Sprintf(`
+		SELECT source, target, count() AS call_count, countIf(failed) AS error_count,
+			quantiles(0.5, 0.95)(duration_ms) AS percentiles
+		FROM (%s)
+		GROUP BY source, target
+		ORDER BY call_count DESC`, EdgeCallsSQL(dateRange.Start, dateRange.End))
+	return s.queryDependencies(ctx, query)
+}
+
+// precomputedDependencies reads the dependencies of the minutes of the date range
+// from service_edges, the latest minutes are missing until they're aggregated
+func (s *TelemetryService) precomputedDependencies(ctx context.Context, dateRange DateRange) ([]ServiceDependency, error) {
+	query := fmt.Sprintf(`
+		SELECT source, target, sum(calls) AS call_count, sum(errors) AS error_count,
+			quantilesMerge(0.5, 0.95)(latency) AS percentiles
+		FROM service_edges
+		WHERE time >= toStartOfMinute(toDateTime(%d)) AND time <= toDateTime(%d)
+		GROUP BY source, target
+		ORDER BY call_count DESC`, dateRange.Start.Unix(), dateRange.End.Unix())
+	return s.queryDependencies(ctx, query)
+}
+
+func (s *TelemetryService) queryDependencies(ctx context.Context, query string) ([]ServiceDependency, error) {
+	rows, err := (*s.Ch).Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dependencies []ServiceDependency
+	for rows.Next() {
+		var d ServiceDependency
+		var percentiles []float64
+		if err := rows.Scan(&d.Source, &d.Target, &d.CallCount, &d.ErrorCount, &percentiles); err != nil {
+			return nil, err
+		}
+		if len(percentiles) == 2 {
+			d.P50Duration, d.P95Duration = percentiles[0], percentiles[1]
+		}
+		dependencies = append(dependencies, d)
+	}
+	return dependencies, rows.Err()
+}
+
+// EdgeAggregator fills service_edges with the calls between services of every
+// minute, edgeLag after the minute ends. A minute is aggregated once, the calls
+// of spans arriving later are left out.
+type EdgeAggregator struct {
+	service *TelemetryService
+}
+
+func NewEdgeAggregator(service *TelemetryService) *EdgeAggregator {
+	return &EdgeAggregator{service: service}
+}
+
+// Run aggregates the minutes every edgeInterval until ctx is done
+func (a *EdgeAggregator) Run(ctx context.Context) {
+	ticker := time.NewTicker(edgeInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.aggregate(ctx, time.Now()); err != nil {
+			log.Printf("edges: aggregation failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// aggregate aggregates the minutes between the watermark and now, an hour at a time
+func (a *EdgeAggregator) aggregate(ctx context.Context, now time.Time) error {
+	ch := *a.service.Ch
+	until := now.Add(-edgeLag).Truncate(time.Minute)
+	start := until.Add(-edgeBackfill)
+	value, found, err := db.GetSetting(ctx, ch, edgeWatermark)
+	if err != nil {
+		return err
+	}
+	if found {
+		sec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s setting %q", edgeWatermark, value)
+		}
+		start = time.Unix(sec, 0)
+	}
+
+	for start.Before(until) {
+		end := start.Add(time.Hour)
+		if end.After(until) {
+			end = until
+		}
+		query := fmt.Sprintf(`
+			INSERT INTO service_edges (time, source, target, calls, errors, latency)
+			SELECT toStartOfMinute(fromUnixTimestamp64Nano(start)) AS time, source, target,
+				count(), countIf(failed), quantilesState(0.5, 0.95)(duration_ms)
+			FROM (%s)
+			GROUP BY time, source, target`, EdgeCallsSQL(start, end))
+		if err := ch.Exec(ctx, query); err != nil {
+			return err
+		}
+		if err := db.SetSetting(ctx, ch, edgeWatermark, strconv.FormatInt(end.Unix(), 10)); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"nabatshy/db"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+const errorGroupsTable = "error_groups"
+
+// ErrorHistory is how far back the first occurrence of an error group is looked
+// for, a group first seen within the range of the inbox is new
+const ErrorHistory = 7 * 24 * time.Hour
+
+// Error group statuses. A resolved group that occurs again is open again.
+const (
+	ErrorGroupOpen     = "open"
+	ErrorGroupResolved = "resolved"
+	ErrorGroupIgnored  = "ignored"
+)
+
+// ErrorGroupState is the triage status of an error group, stored by fingerprint
+type ErrorGroupState struct {
+	Fingerprint string    `json:"fingerprint"`
+	Status      string    `json:"status"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// InboxEntry is an error group of the inbox, the exceptions with the same
+// fingerprint, i.e. the same type and normalized message
+type InboxEntry struct {
+	Fingerprint       string    `json:"fingerprint"`
+	Type              string    `json:"type"`
+	NormalizedMessage string    `json:"normalized_message"`
+	Message           string    `json:"message"`
+	Services          []string  `json:"services"`
+	Count             uint64    `json:"count"`
+	FirstSeen         time.Time `json:"first_seen"`
+	LastSeen          time.Time `json:"last_seen"`
+	TraceIDs          []string  `json:"trace_ids"`
+	Status            string    `json:"status"`
+	// New is set when the group was first seen within the range
+	New bool `json:"new"`
+	// Regressed is set when the group occurred again after it was resolved
+	Regressed bool `json:"regressed"`
+}
+
+// InboxRequest lists the error groups with the status, every group for "all"
+type InboxRequest struct {
+	ErrorRequest
+	Status string
+}
+
+// ParseInboxRequest reads the parameters of ParseErrorRequest and status, open by
+// default
+func ParseInboxRequest(q url.Values) (InboxRequest, error) {
+	errReq, err := ParseErrorRequest(q)
+	if err != nil {
+		return InboxRequest{}, err
+	}
+	req := InboxRequest{ErrorRequest: errReq, Status: q.Get("status")}
+	switch req.Status {
+	case "":
+		req.Status = ErrorGroupOpen
+	case ErrorGroupOpen, ErrorGroupResolved, ErrorGroupIgnored, "all":
+	default:
+		return req, fmt.Errorf("invalid status %q, use open, resolved, ignored or all", req.Status)
+	}
+	return req, nil
+}
+
+// GetErrorInbox lists the error groups that occurred in the range, most frequent
+// first, with their triage status
+func (s *TelemetryService) GetErrorInbox(ctx context.Context, req InboxRequest) ([]InboxEntry, error) {
+	states, err := s.errorGroupStates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// first_seen is looked for over the history before the range
+	history := req.ErrorRequest
+	if start := req.DateRange.End.Add(-ErrorHistory); start.Before(history.DateRange.Start) {
+		history.DateRange.Start = start
+	}
+	inRange := goqu.L("time >= ?", goqu.L("fromUnixTimestamp64Nano(?)", req.DateRange.Start.UnixNano()))
+	ds := s.exceptions(history).
+		Select(
+			goqu.C("fingerprint"),
+			goqu.L("any(type)"),
+			goqu.L("any(normalized_message)"),
+			goqu.L("anyIf(message, ?)", inRange),
+			goqu.L("groupUniqArrayIf(service, ?)", inRange),
+			goqu.L("countIf(?)", inRange).As("count"),
+			goqu.L("min(time)"),
+			goqu.L("max(time)"),
+			goqu.L("groupUniqArrayIf(?)(trace_id, ?)", errorExampleTraces, inRange),
+		).
+		Where(goqu.C("fingerprint").Neq("")).
+		GroupBy(goqu.C("fingerprint")).
+		Having(goqu.C("count").Gt(0)).
+		Order(goqu.C("count").Desc(), goqu.C("fingerprint").Asc())
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []InboxEntry{}
+	for rows.Next() {
+		var e InboxEntry
+		if err := rows.Scan(&e.Fingerprint, &e.Type, &e.NormalizedMessage, &e.Message, &e.Services, &e.Count, &e.FirstSeen, &e.LastSeen, &e.TraceIDs); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		slices.Sort(e.Services)
+		e.New = !e.FirstSeen.Before(req.DateRange.Start)
+		e.Status = ErrorGroupOpen
+		if state, ok := states[e.Fingerprint]; ok {
+			e.Status = state.Status
+			if state.Status == ErrorGroupResolved && e.LastSeen.After(state.UpdatedAt) {
+				e.Status, e.Regressed = ErrorGroupOpen, true
+			}
+		}
+		if req.Status == "all" || e.Status == req.Status {
+			entries = append(entries, e)
+		}
+		if uint(len(entries)) == req.Limit {
+			break
+		}
+	}
+	return entries, rows.Err()
+}
+
+func (s *TelemetryService) errorGroupStates(ctx context.Context) (map[string]ErrorGroupState, error) {
+	all, err := db.ListDocuments[ErrorGroupState](ctx, *s.Ch, errorGroupsTable)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]ErrorGroupState, len(all))
+	for _, state := range all {
+		states[state.Fingerprint] = state
+	}
+	return states, nil
+}
+
+// SetErrorGroupStatus triages an error group, open forgets its status
+func (s *TelemetryService) SetErrorGroupStatus(ctx context.Context, fingerprint, status string) (ErrorGroupState, error) {
+	state := ErrorGroupState{Fingerprint: fingerprint, Status: status, UpdatedAt: time.Now().UTC()}
+	switch status {
+	case ErrorGroupOpen:
+		return state, db.DeleteDocument(ctx, *s.Ch, errorGroupsTable, fingerprint)
+	case ErrorGroupResolved, ErrorGroupIgnored:
+		return state, db.PutDocument(ctx, *s.Ch, errorGroupsTable, fingerprint, fingerprint, state)
+	}
+	return state, fmt.Errorf("invalid status %q, use open, resolved or ignored", status)
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+const (
+	// DefaultErrorRange is the range errors are listed over when none is given
+	DefaultErrorRange = "24h"
+	// errorExampleTraces is how many trace IDs an error group lists
+	errorExampleTraces = 5
+	maxErrorGroups     = 500
+)
+
+// ErrorGroup gathers the exceptions of a service with the same type
+type ErrorGroup struct {
+	Service string `json:"service"`
+	Type    string `json:"type"`
+	// Message is the message of one of the exceptions
+	Message   string    `json:"message"`
+	Count     uint64    `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	TraceIDs  []string  `json:"trace_ids"`
+}
+
+// ErrorOccurrence is an exception recorded by a span
+type ErrorOccurrence struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+	Span    string `json:"span"`
+	Service string `json:"service"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	// Fingerprint is the error group of the exception, empty for spans ingested
+	// before exceptions were fingerprinted
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// ErrorRequest filters the exceptions, Type and Fingerprint only apply to occurrences
+type ErrorRequest struct {
+	DateRange   DateRange
+	Service     string
+	Type        string
+	Fingerprint string
+	Limit       uint
+}
+
+// ParseErrorRequest reads the start/end or timeRange, service, type, fingerprint
+// and limit parameters, the last DefaultErrorRange and 50 errors by default
+func ParseErrorRequest(q url.Values) (ErrorRequest, error) {
+	req := ErrorRequest{Service: q.Get("service"), Type: q.Get("type"), Fingerprint: q.Get("fingerprint"), Limit: 50}
+	dateRange, err := parseDateRangeOr(q, DefaultErrorRange)
+	if err != nil {
+		return req, fmt.Errorf("invalid date range")
+	}
+	req.DateRange = dateRange
+	if ls := q.Get("limit"); ls != "" {
+		l, err := strconv.ParseUint(ls, 10, 32)
+		if err != nil || l == 0 || l > maxErrorGroups {
+			return req, fmt.Errorf("invalid parameter 'limit'")
+		}
+		req.Limit = uint(l)
+	}
+	return req, nil
+}
+
+// exceptions selects a row per exception event of the matching spans, with the
+// exception.type, exception.message and fingerprint attributes of the event
+func (s *TelemetryService) exceptions(req ErrorRequest) *goqu.SelectDataset {
+	conds := []goqu.Expression{
+		goqu.C("start_time_unix_nano").Gte(req.DateRange.Start.UnixNano()),
+		goqu.C("start_time_unix_nano").Lte(req.DateRange.End.UnixNano()),
+		goqu.L("has(events.name, 'exception')"),
+	}
+	if req.Service != "" {
+		conds = append(conds, resourceAttribute("service.name").Eq(req.Service))
+	}
+	if req.Fingerprint != "" {
+		conds = append(conds, goqu.L("has(error_fingerprints, ?)", req.Fingerprint))
+	}
+	events := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("trace_id"),
+			goqu.C("span_id"),
+			goqu.C("name"),
+			resourceAttribute("service.name").As("service"),
+			goqu.L("arrayJoin(arrayFilter(i -> events.name[i] = 'exception', arrayEnumerate(events.name)))").As("event"),
+			goqu.L("events.attributes.value[event][indexOf(events.attributes.key[event], 'exception.type')]").As("type"),
+			goqu.L("events.attributes.value[event][indexOf(events.attributes.key[event], 'exception.message')]").As("message"),
+			goqu.L("events.attributes.value[event][indexOf(events.attributes.key[event], 'exception.fingerprint')]").As("fingerprint"),
+			goqu.L("events.attributes.value[event][indexOf(events.attributes.key[event], 'exception.normalized_message')]").As("normalized_message"),
+			goqu.L("fromUnixTimestamp64Nano(events.time_unix_nano[event])").As("time"),
+		).
+		Where(conds...)
+	return s.DB.From(events.As("exceptions"))
+}
+
+// GetErrorGroups lists the most frequent exceptions grouped by service and type
+func (s *TelemetryService) GetErrorGroups(ctx context.Context, req ErrorRequest) ([]ErrorGroup, error) {
+	ds := s.exceptions(req).
+		Select(
+			goqu.C("service"),
+			goqu.C("type"),
+			goqu.L("any(message)"),
+			goqu.L("count()").As("count"),
+			goqu.L("min(time)"),
+			goqu.L("max(time)"),
+			goqu.L("groupUniqArray(?)(trace_id)", errorExampleTraces),
+		).
+		GroupBy(goqu.C("service"), goqu.C("type")).
+		Order(goqu.C("count").Desc(), goqu.C("service").Asc(), goqu.C("type").Asc()).
+		Limit(req.Limit)
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	groups := []ErrorGroup{}
+	for rows.Next() {
+		var g ErrorGroup
+		if err := rows.Scan(&g.Service, &g.Type, &g.Message, &g.Count, &g.FirstSeen, &g.LastSeen, &g.TraceIDs); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// GetErrorOccurrences lists the latest exceptions, of the type when it's given
+func (s *TelemetryService) GetErrorOccurrences(ctx context.Context, req ErrorRequest) ([]ErrorOccurrence, error) {
+	ds := s.exceptions(req).
+		Select(
+			goqu.C("trace_id"),
+			goqu.C("span_id"),
+			goqu.C("name"),
+			goqu.C("service"),
+			goqu.C("type"),
+			goqu.C("message"),
+			goqu.C("fingerprint"),
+			goqu.C("time"),
+		).
+		Order(goqu.C("time").Desc()).
+		Limit(req.Limit)
+	if req.Type != "" {
+		ds = ds.Where(goqu.C("type").Eq(req.Type))
+	}
+	if req.Fingerprint != "" {
+		ds = ds.Where(goqu.C("fingerprint").Eq(req.Fingerprint))
+	}
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	occurrences := []ErrorOccurrence{}
+	for rows.Next() {
+		var o ErrorOccurrence
+		if err := rows.Scan(&o.TraceID, &o.SpanID, &o.Span, &o.Service, &o.Type, &o.Message, &o.Fingerprint, &o.Time); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		occurrences = append(occurrences, o)
+	}
+	return occurrences, rows.Err()
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"nabatshy/utils"
+)
+
+// exportFlushEvery is the number of rows written between flushes of the response
+const exportFlushEvery = 1000
+
+var exportCSVHeader = []string{
+	"trace_id", "span_id", "name", "service", "duration_ms",
+	"start_time_unix_nano", "end_time_unix_nano", "has_error", "resource_attributes",
+}
+
+// exportSearch streams all results of a search as NDJSON (the default) or CSV.
+// The response is written while rows are read, so errors after the first row
+// can only be logged and end the response early.
+func (c *TelemetryController) exportSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dateRange, err := ParseDateRange(q, "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		http.Error(w, "format must be ndjson or csv", http.StatusBadRequest)
+		return
+	}
+	var limit uint64
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.ParseUint(l, 10, 64); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	sort := ParseSortOption(q)
+
+	flusher, _ := w.(http.Flusher)
+	var csvWriter *csv.Writer
+	encoder := json.NewEncoder(w)
+	rowsWritten := 0
+
+	// start sets the headers and writes the CSV header once there's something to send
+	start := func() error {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="search.%s"`, format))
+		if format != "csv" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			return nil
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		csvWriter = csv.NewWriter(w)
+		return csvWriter.Write(exportCSVHeader)
+	}
+
+	emit := func(result SearchResult) error {
+		if rowsWritten == 0 {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+
+		if csvWriter != nil {
+			attrs, err := json.Marshal(result.ResourceAttrs)
+			if err != nil {
+				return err
+			}
+			err = csvWriter.Write([]string{
+				result.TraceID,
+				result.SpanID,
+				result.Name,
+				result.Service,
+				strconv.FormatFloat(result.Duration, 'f', -1, 64),
+				strconv.FormatInt(result.StartTime.UnixNano(), 10),
+				strconv.FormatInt(result.EndTime.UnixNano(), 10),
+				strconv.FormatBool(result.HasError),
+				string(attrs),
+			})
+			if err != nil {
+				return err
+			}
+		} else if err := encoder.Encode(utils.FormatTimestamps(r, result)); err != nil {
+			return err
+		}
+
+		rowsWritten++
+		if rowsWritten%exportFlushEvery == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	}
+
+	err = c.service.ExportSearch(r.Context(), dateRange, q.Get("query"), sort, q.Get("traceOrSpan"), uint(limit), emit)
+	if err != nil && rowsWritten == 0 {
+		http.Error(w, fmt.Sprintf("failed to export search: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("search export ended after %d rows: %v\n", rowsWritten, err)
+	}
+	if rowsWritten == 0 {
+		// empty exports still get the headers, CSV ones the header row
+		start()
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+	}
+}
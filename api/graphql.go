@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"nabatshy/graphql"
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// GraphQLController serves the GraphQL schema of the traces, spans, services and
+// metrics at /graphql, so that a client fetches the fields it needs in one request,
+// like a trace with the events of its spans
+type GraphQLController struct {
+	schema *graphql.Schema
+}
+
+func NewGraphQLController(service *TelemetryService) *GraphQLController {
+	return &GraphQLController{schema: NewGraphQLSchema(service)}
+}
+
+// query runs a query from the query, variables and operationName parameters of a
+// GET or the JSON body of a POST. Errors of the query are in the response, which is
+// a 400 only when the request can't be read.
+func (c *GraphQLController) query(w http.ResponseWriter, r *http.Request) {
+	var req graphql.Request
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeGraphQLError(w, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+	} else {
+		q := r.URL.Query()
+		if q.Get("query") == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			c.getGraphiQL(w, r)
+			return
+		}
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeGraphQLError(w, fmt.Sprintf("invalid variables: %v", err))
+				return
+			}
+		}
+	}
+	if req.Query == "" {
+		writeGraphQLError(w, "the request has no query")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.schema.Execute(r.Context(), req))
+}
+
+func writeGraphQLError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(graphql.Response{Errors: []*graphql.Error{{Message: message}}})
+}
+
+const graphiQL = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Nabatshy GraphQL</title>
+  <link rel="stylesheet" href="https://unpkg.com/graphiql@3/graphiql.min.css">
+  <style>body { margin: 0; } #graphiql { height: 100vh; }</style>
+</head>
+<body>
+  <div id="graphiql"></div>
+  <script src="https://unpkg.com/react@18/umd/react.production.min.js"></script>
+  <script src="https://unpkg.com/react-dom@18/umd/react-dom.production.min.js"></script>
+  <script src="https://unpkg.com/graphiql@3/graphiql.min.js"></script>
+  <script>
+    const fetcher = GraphiQL.createFetcher({url: "%s"});
+    ReactDOM.createRoot(document.getElementById("graphiql")).render(React.createElement(GraphiQL, {fetcher}));
+  </script>
+</body>
+</html>
+`
+
+// getGraphiQL serves GraphiQL to browsers opening /graphql
+func (c *GraphQLController) getGraphiQL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, graphiQL, html.EscapeString(r.URL.Path))
+}
+
+func (c *GraphQLController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: "GET", Path: "/graphql", Summary: "Run a GraphQL query",
+			Query: []openapi.Param{
+				{Name: "query", Description: "the GraphQL query, without it browsers get GraphiQL"},
+				{Name: "variables", Description: "the variables of the query as a JSON object"},
+				{Name: "operationName", Description: "the operation to run when the query has several"},
+			},
+			Response: graphql.Response{}, Error: graphql.Response{},
+			Description: "Queries the traces, spans, services and metrics, the schema is introspectable. Errors of the query are in the errors of a 200 response."},
+		{Method: "POST", Path: "/graphql", Summary: "Run a GraphQL query",
+			Request: graphql.Request{}, Response: graphql.Response{}, Error: graphql.Response{},
+			Description: "Queries the traces, spans, services and metrics, the schema is introspectable. Errors of the query are in the errors of a 200 response."},
+	}
+}
+
+func (c *GraphQLController) RegisterRoutes(r chi.Router) {
+	r.Get("/graphql", c.query)
+	r.Post("/graphql", c.query)
+}
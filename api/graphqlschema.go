@@ -0,0 +1,746 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"nabatshy/graphql"
+	"nabatshy/utils"
+)
+
+// The GraphQL schema reads what the /v2 routes do, its objects are the /v2 types
+// whose json tags are the names of their fields
+
+// timeScalar is an RFC 3339 time in UTC, like the times of /v2
+var timeScalar = &graphql.Scalar{
+	Name:        "Time",
+	Description: "A time in RFC 3339, written in UTC with nanoseconds",
+	Serialize: func(v any) (any, error) {
+		switch t := v.(type) {
+		case utils.Timestamp:
+			return t.UTC().Format(time.RFC3339Nano), nil
+		case time.Time:
+			return t.UTC().Format(time.RFC3339Nano), nil
+		}
+		return nil, fmt.Errorf("%T isn't a time", v)
+	},
+	Parse: func(v any) (any, error) {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a time in RFC 3339, got %v", v)
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("expected a time in RFC 3339, got %q", s)
+		}
+		return t, nil
+	},
+}
+
+// graphQLTraceSummary is a trace of the traces query
+type graphQLTraceSummary struct {
+	TraceID    string          `json:"traceId"`
+	RootSpan   string          `json:"rootSpan"`
+	SpanCount  uint64          `json:"spanCount"`
+	DurationMs float64         `json:"durationMs"`
+	StartTime  utils.Timestamp `json:"startTime"`
+	Issues     uint64          `json:"issues"`
+	Incomplete bool            `json:"incomplete"`
+}
+
+type graphQLTracePage struct {
+	Traces   []graphQLTraceSummary `json:"traces"`
+	Page     int                   `json:"page"`
+	PageSize int                   `json:"pageSize"`
+	Total    uint64                `json:"total"`
+}
+
+type graphQLSearchPage struct {
+	Results     []V2SearchResult `json:"results"`
+	Page        int              `json:"page"`
+	PageSize    int              `json:"pageSize"`
+	Total       uint64           `json:"total"`
+	TotalTraces uint64           `json:"totalTraces"`
+}
+
+// graphQLService is a service of the services query, its endpoints and dependencies
+// are of the date range of the query and are loaded once for all of its services
+type graphQLService struct {
+	V2Service
+	endpoints    *lazy[[]V2Endpoint]
+	dependencies *lazy[[]V2Dependency]
+}
+
+// lazy loads a value on its first use
+type lazy[T any] struct {
+	load   func() (T, error)
+	loaded bool
+	value  T
+	err    error
+}
+
+func (l *lazy[T]) get() (T, error) {
+	if !l.loaded {
+		l.value, l.err = l.load()
+		l.loaded = true
+	}
+	return l.value, l.err
+}
+
+// graphQLMetrics are the metrics of a date range, each series is queried when it's
+// selected
+type graphQLMetrics struct {
+	dateRange DateRange
+}
+
+type graphQLAttribute struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// graphQLAttributes lists the attributes of a map sorted by key
+func graphQLAttributes(attrs map[string]string) []graphQLAttribute {
+	list := make([]graphQLAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		list = append(list, graphQLAttribute{Key: k, Value: v})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// graphQLQuery turns the arguments of a field into the query parameters of the REST
+// routes, so they're parsed the same way
+func graphQLQuery(args map[string]any) url.Values {
+	q := url.Values{}
+	for name, value := range args {
+		switch v := value.(type) {
+		case time.Time:
+			q.Set(name, v.Format(time.RFC3339))
+		case string:
+			q.Set(name, v)
+		default:
+			q.Set(name, fmt.Sprint(v))
+		}
+	}
+	return q
+}
+
+// source returns the source of a resolver, the value of the object of the field
+func source[T any](p graphql.ResolveParams) (T, error) {
+	s, ok := p.Source.(T)
+	if !ok {
+		return s, fmt.Errorf("unexpected source %T", p.Source)
+	}
+	return s, nil
+}
+
+var (
+	nonNullString  = graphql.NonNullOf(graphql.String)
+	nonNullInt     = graphql.NonNullOf(graphql.Int)
+	nonNullFloat   = graphql.NonNullOf(graphql.Float)
+	nonNullBoolean = graphql.NonNullOf(graphql.Boolean)
+	nonNullTime    = graphql.NonNullOf(timeScalar)
+	nonNullID      = graphql.NonNullOf(graphql.ID)
+)
+
+func nonNullList(t graphql.Type) graphql.Type {
+	return graphql.NonNullOf(graphql.ListOf(graphql.NonNullOf(t)))
+}
+
+// rangeArgs are the arguments of the fields reading a date range, like the start,
+// end and timeRange query parameters
+func rangeArgs(defaultRange string) []*graphql.Arg {
+	return []*graphql.Arg{
+		{Name: "start", Description: "Start of the date range, with end", Type: timeScalar},
+		{Name: "end", Description: "End of the date range, with start", Type: timeScalar},
+		{Name: "timeRange", Description: "The last period like 15m, 24h or 7d, instead of start and end", Type: graphql.String, Default: defaultRange},
+	}
+}
+
+func args(groups ...[]*graphql.Arg) []*graphql.Arg {
+	var all []*graphql.Arg
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+// NewGraphQLSchema returns the schema of the /graphql route, reading the traces,
+// spans, services and metrics of service
+func NewGraphQLSchema(service *TelemetryService) *graphql.Schema {
+	attribute := &graphql.Object{
+		Name: "Attribute",
+		Fields: []*graphql.Field{
+			{Name: "key", Type: nonNullString},
+			{Name: "value", Type: nonNullString},
+		},
+	}
+	attributesOf := func(get func(source any) (map[string]string, error)) func(p graphql.ResolveParams) (any, error) {
+		return func(p graphql.ResolveParams) (any, error) {
+			attrs, err := get(p.Source)
+			if err != nil {
+				return nil, err
+			}
+			return graphQLAttributes(attrs), nil
+		}
+	}
+	event := &graphql.Object{
+		Name:        "Event",
+		Description: "An event recorded during a span",
+		Fields: []*graphql.Field{
+			{Name: "time", Type: nonNullTime},
+			{Name: "name", Type: nonNullString},
+			{Name: "attributes", Type: nonNullList(attribute), Resolve: attributesOf(func(s any) (map[string]string, error) {
+				e, ok := s.(V2Event)
+				if !ok {
+					return nil, fmt.Errorf("unexpected source %T", s)
+				}
+				return e.Attributes, nil
+			})},
+		},
+	}
+
+	trace := &graphql.Object{Name: "Trace", Description: "The spans of a trace"}
+	traceOf := func(traceID func(source any) (string, error)) func(p graphql.ResolveParams) (any, error) {
+		return func(p graphql.ResolveParams) (any, error) {
+			id, err := traceID(p.Source)
+			if err != nil {
+				return nil, err
+			}
+			return graphQLTrace(p.Context, service, id)
+		}
+	}
+
+	comparisonArgs := []*graphql.Arg{
+		{Name: "compareWindow", Description: "The period before the span the spans it's compared with started in, like 24h or 7d, or all", Type: graphql.String},
+		{Name: "compareServices", Description: "all compares with the spans of the name in every service", Type: graphql.String},
+	}
+	span := &graphql.Object{
+		Name:        "Span",
+		Description: "A span with its attributes and the duration statistics of the spans of its name and service",
+	}
+	spanOf := func(p graphql.ResolveParams, spanID string) (any, error) {
+		cmp, err := ParseSpanComparison(graphQLQuery(p.Args))
+		if err != nil {
+			return nil, err
+		}
+		detail, err := service.GetSpanDetails(p.Context, spanID, cmp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch span: %w", err)
+		}
+		return v2Span(detail), nil
+	}
+
+	traceSpan := &graphql.Object{
+		Name:        "TraceSpan",
+		Description: "A span of a trace, placed in its tree",
+		Fields: []*graphql.Field{
+			{Name: "spanId", Type: nonNullID},
+			{Name: "parentSpanId", Description: "Empty for root spans", Type: nonNullString},
+			{Name: "name", Type: nonNullString},
+			{Name: "service", Type: nonNullString},
+			{Name: "startTime", Type: nonNullTime},
+			{Name: "endTime", Type: nonNullTime},
+			{Name: "durationMs", Type: nonNullFloat},
+			{Name: "selfTimeMs", Description: "The duration not covered by child spans", Type: nonNullFloat},
+			{Name: "depth", Description: "0 for root spans, spans whose parent is missing count as roots", Type: nonNullInt},
+			{Name: "childCount", Type: nonNullInt},
+			{Name: "events", Type: nonNullList(event)},
+			{Name: "details", Description: "The attributes and duration statistics of the span", Type: span, Args: comparisonArgs,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					s, err := source[V2TraceSpan](p)
+					if err != nil {
+						return nil, err
+					}
+					return spanOf(p, s.SpanID)
+				}},
+		},
+	}
+	trace.Fields = []*graphql.Field{
+		{Name: "traceId", Type: nonNullID},
+		{Name: "spans", Description: "The spans ordered by their start, depth first", Type: nonNullList(traceSpan)},
+	}
+
+	span.Fields = []*graphql.Field{
+		{Name: "spanId", Type: nonNullID},
+		{Name: "traceId", Type: nonNullID},
+		{Name: "parentSpanId", Description: "Empty for root spans", Type: nonNullString},
+		{Name: "name", Type: nonNullString},
+		{Name: "service", Type: nonNullString},
+		{Name: "startTime", Type: nonNullTime},
+		{Name: "endTime", Type: nonNullTime},
+		{Name: "durationMs", Type: nonNullFloat},
+		{Name: "stats", Type: graphql.NonNullOf(&graphql.Object{
+			Name:        "LatencyStats",
+			Description: "The durations of the spans the span is compared with",
+			Fields: []*graphql.Field{
+				{Name: "avgMs", Type: nonNullFloat},
+				{Name: "p50Ms", Type: nonNullFloat},
+				{Name: "p90Ms", Type: nonNullFloat},
+				{Name: "p99Ms", Type: nonNullFloat},
+				{Name: "diffPercent", Description: "How much longer than the average the span took", Type: nonNullFloat},
+			},
+		})},
+		{Name: "resourceAttributes", Type: nonNullList(attribute), Resolve: attributesOf(func(s any) (map[string]string, error) {
+			span, ok := s.(V2Span)
+			if !ok {
+				return nil, fmt.Errorf("unexpected source %T", s)
+			}
+			return span.ResourceAttributes, nil
+		})},
+		{Name: "spanAttributes", Type: nonNullList(attribute), Resolve: attributesOf(func(s any) (map[string]string, error) {
+			span, ok := s.(V2Span)
+			if !ok {
+				return nil, fmt.Errorf("unexpected source %T", s)
+			}
+			return span.SpanAttributes, nil
+		})},
+		{Name: "events", Type: nonNullList(event)},
+		{Name: "sourceLink", Description: "Where the span is in the source, when its attributes tell", Type: &graphql.Object{
+			Name: "SourceLink",
+			Fields: []*graphql.Field{
+				{Name: "filePath", Type: nonNullString},
+				{Name: "lineNo", Type: graphql.String},
+				{Name: "function", Type: graphql.String},
+				{Name: "url", Description: "The file in the source browser", Type: graphql.String},
+			},
+		}},
+		{Name: "trace", Type: trace, Resolve: traceOf(func(s any) (string, error) {
+			span, ok := s.(V2Span)
+			if !ok {
+				return "", fmt.Errorf("unexpected source %T", s)
+			}
+			return span.TraceID, nil
+		})},
+	}
+
+	traceSummary := &graphql.Object{
+		Name:        "TraceSummary",
+		Description: "A trace of a page of traces",
+		Fields: []*graphql.Field{
+			{Name: "traceId", Type: nonNullID},
+			{Name: "rootSpan", Description: "The name of the root span, empty when it's missing", Type: nonNullString},
+			{Name: "spanCount", Type: nonNullFloat},
+			{Name: "durationMs", Type: nonNullFloat},
+			{Name: "startTime", Description: "The start of the first span", Type: nonNullTime},
+			{Name: "issues", Description: "The spans taking more than twice the average span of the trace", Type: nonNullFloat},
+			{Name: "incomplete", Description: "Whether the trace was found missing its root span or the parents of some spans", Type: nonNullBoolean},
+			{Name: "trace", Type: trace, Resolve: traceOf(func(s any) (string, error) {
+				t, ok := s.(graphQLTraceSummary)
+				if !ok {
+					return "", fmt.Errorf("unexpected source %T", s)
+				}
+				return t.TraceID, nil
+			})},
+		},
+	}
+	tracePage := &graphql.Object{
+		Name: "TracePage",
+		Fields: []*graphql.Field{
+			{Name: "traces", Type: nonNullList(traceSummary)},
+			{Name: "page", Type: nonNullInt},
+			{Name: "pageSize", Type: nonNullInt},
+			{Name: "total", Type: nonNullFloat},
+		},
+	}
+
+	searchResult := &graphql.Object{
+		Name:        "SearchResult",
+		Description: "A span matching a search",
+		Fields: []*graphql.Field{
+			{Name: "traceId", Type: nonNullID},
+			{Name: "spanId", Type: nonNullID},
+			{Name: "name", Type: nonNullString},
+			{Name: "service", Type: nonNullString},
+			{Name: "startTime", Type: nonNullTime},
+			{Name: "endTime", Type: nonNullTime},
+			{Name: "durationMs", Type: nonNullFloat},
+			{Name: "hasError", Type: nonNullBoolean},
+			{Name: "resourceAttributes", Type: nonNullList(attribute), Resolve: attributesOf(func(s any) (map[string]string, error) {
+				res, ok := s.(V2SearchResult)
+				if !ok {
+					return nil, fmt.Errorf("unexpected source %T", s)
+				}
+				return res.ResourceAttributes, nil
+			})},
+			{Name: "relevance", Description: "3 for a trace or span ID match, 2 for a name, 1 for an attribute or event, 0 for key=value searches", Type: nonNullInt},
+			{Name: "trace", Type: trace, Resolve: traceOf(func(s any) (string, error) {
+				res, ok := s.(V2SearchResult)
+				if !ok {
+					return "", fmt.Errorf("unexpected source %T", s)
+				}
+				return res.TraceID, nil
+			})},
+		},
+	}
+	searchPage := &graphql.Object{
+		Name: "SearchPage",
+		Fields: []*graphql.Field{
+			{Name: "results", Type: nonNullList(searchResult)},
+			{Name: "page", Type: nonNullInt},
+			{Name: "pageSize", Type: nonNullInt},
+			{Name: "total", Type: nonNullFloat},
+			{Name: "totalTraces", Type: nonNullFloat},
+		},
+	}
+
+	endpoint := &graphql.Object{
+		Name:        "Endpoint",
+		Description: "The latency of the root spans of a name",
+		Fields: []*graphql.Field{
+			{Name: "service", Type: nonNullString},
+			{Name: "endpoint", Type: nonNullString},
+			{Name: "requestCount", Type: nonNullFloat},
+			{Name: "latency", Type: graphql.NonNullOf(&graphql.Object{
+				Name: "Latency",
+				Fields: []*graphql.Field{
+					{Name: "avgMs", Type: nonNullFloat},
+					{Name: "minMs", Type: nonNullFloat},
+					{Name: "maxMs", Type: nonNullFloat},
+					{Name: "p50Ms", Type: nonNullFloat},
+					{Name: "p90Ms", Type: nonNullFloat},
+					{Name: "p95Ms", Type: nonNullFloat},
+					{Name: "p99Ms", Type: nonNullFloat},
+				},
+			})},
+			{Name: "target", Description: "The compliance with the latency target of the endpoint, null without one", Type: &graphql.Object{
+				Name: "LatencyTarget",
+				Fields: []*graphql.Field{
+					{Name: "percentile", Type: nonNullInt},
+					{Name: "thresholdMs", Type: nonNullFloat},
+					{Name: "currentMs", Type: nonNullFloat},
+					{Name: "breached", Type: nonNullBoolean},
+				},
+			}},
+		},
+	}
+	dependency := &graphql.Object{
+		Name:        "Dependency",
+		Description: "The calls of a service to another",
+		Fields: []*graphql.Field{
+			{Name: "source", Type: nonNullString},
+			{Name: "target", Type: nonNullString},
+			{Name: "callCount", Type: nonNullFloat},
+			{Name: "errorCount", Type: nonNullFloat},
+			{Name: "p50Ms", Description: "The latency of the calls, as seen by the target", Type: nonNullFloat},
+			{Name: "p95Ms", Type: nonNullFloat},
+		},
+	}
+
+	serviceType := &graphql.Object{
+		Name:        "Service",
+		Description: "A service that reported spans in the date range",
+		Fields: []*graphql.Field{
+			{Name: "name", Type: nonNullString},
+			{Name: "spanCount", Type: nonNullFloat},
+			{Name: "traceCount", Type: nonNullFloat},
+			{Name: "lastSeen", Type: nonNullTime},
+			{Name: "versions", Type: nonNullList(graphql.String)},
+			{Name: "environments", Type: nonNullList(graphql.String)},
+			{Name: "runbookUrl", Type: graphql.String},
+			{Name: "dashboardUrl", Type: graphql.String},
+			{Name: "owner", Type: &graphql.Object{
+				Name: "Owner",
+				Fields: []*graphql.Field{
+					{Name: "team", Type: nonNullString},
+					{Name: "slackChannel", Type: graphql.String},
+					{Name: "escalation", Type: graphql.String},
+				},
+			}},
+			{Name: "endpoints", Description: "The endpoints of the service in the date range, slowest first", Type: nonNullList(endpoint),
+				Args: []*graphql.Arg{{Name: "limit", Description: "The number of endpoints, all of them when 0", Type: graphql.Int, Default: 0}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					s, err := source[graphQLService](p)
+					if err != nil {
+						return nil, err
+					}
+					all, err := s.endpoints.get()
+					if err != nil {
+						return nil, err
+					}
+					endpoints := []V2Endpoint{}
+					for _, e := range all {
+						if e.Service == s.Name {
+							endpoints = append(endpoints, e)
+						}
+					}
+					if limit := p.Args["limit"].(int); limit > 0 && len(endpoints) > limit {
+						endpoints = endpoints[:limit]
+					}
+					return endpoints, nil
+				}},
+			{Name: "dependencies", Description: "The calls of the service and to it in the date range", Type: nonNullList(dependency),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					s, err := source[graphQLService](p)
+					if err != nil {
+						return nil, err
+					}
+					all, err := s.dependencies.get()
+					if err != nil {
+						return nil, err
+					}
+					dependencies := []V2Dependency{}
+					for _, d := range all {
+						if d.Source == s.Name || d.Target == s.Name {
+							dependencies = append(dependencies, d)
+						}
+					}
+					return dependencies, nil
+				}},
+		},
+	}
+
+	timeCount := &graphql.Object{
+		Name: "TimeCount",
+		Fields: []*graphql.Field{
+			{Name: "timestamp", Description: "The start of the interval", Type: nonNullTime},
+			{Name: "value", Type: nonNullFloat},
+		},
+	}
+	timeValue := &graphql.Object{
+		Name: "TimeValue",
+		Fields: []*graphql.Field{
+			{Name: "timestamp", Description: "The start of the interval", Type: nonNullTime},
+			{Name: "value", Description: "A duration in milliseconds", Type: nonNullFloat},
+		},
+	}
+	series := func(get func(ctx context.Context, dr DateRange, p graphql.ResolveParams) (any, error)) func(p graphql.ResolveParams) (any, error) {
+		return func(p graphql.ResolveParams) (any, error) {
+			m, err := source[graphQLMetrics](p)
+			if err != nil {
+				return nil, err
+			}
+			return get(p.Context, m.dateRange, p)
+		}
+	}
+	metricsType := &graphql.Object{
+		Name:        "Metrics",
+		Description: "Series of the spans of the date range, per interval",
+		Fields: []*graphql.Field{
+			{Name: "traceCounts", Description: "The number of spans", Type: nonNullList(timeCount),
+				Resolve: series(func(ctx context.Context, dr DateRange, _ graphql.ResolveParams) (any, error) {
+					return service.GetTraceCounts(ctx, dr)
+				})},
+			{Name: "errorCounts", Description: "The number of spans with an error status", Type: nonNullList(timeCount),
+				Resolve: series(func(ctx context.Context, dr DateRange, _ graphql.ResolveParams) (any, error) {
+					return service.GetErrorCounts(ctx, dr)
+				})},
+			{Name: "averageDuration", Description: "The average duration of the spans", Type: nonNullList(timeValue),
+				Resolve: series(func(ctx context.Context, dr DateRange, _ graphql.ResolveParams) (any, error) {
+					return service.GetAvgDuration(ctx, dr)
+				})},
+			{Name: "percentile", Description: "A percentile of the duration of the spans", Type: nonNullList(timeValue),
+				Args: []*graphql.Arg{{Name: "p", Description: "The percentile, like 95", Type: nonNullInt}},
+				Resolve: series(func(ctx context.Context, dr DateRange, p graphql.ResolveParams) (any, error) {
+					return service.GetPercentileSeries(ctx, dr, p.Args["p"].(int))
+				})},
+		},
+	}
+
+	query := &graphql.Object{
+		Name: "Query",
+		Fields: []*graphql.Field{
+			{Name: "trace", Description: "A trace by its ID, null when none of its spans are stored", Type: trace,
+				Args: []*graphql.Arg{{Name: "id", Type: nonNullID}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return graphQLTrace(p.Context, service, p.Args["id"].(string))
+				}},
+			{Name: "span", Description: "A span by its ID", Type: span,
+				Args: append([]*graphql.Arg{{Name: "id", Type: nonNullID}}, comparisonArgs...),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return spanOf(p, p.Args["id"].(string))
+				}},
+			{Name: "traces", Description: "A page of the traces whose root span started in the date range, newest first", Type: graphql.NonNullOf(tracePage),
+				Args: args(rangeArgs(DefaultTraceListRange), []*graphql.Arg{
+					{Name: "service", Description: "The service of the root span", Type: graphql.String},
+					{Name: "minDuration", Description: "Leaves out the traces whose root span is faster, a duration like 250ms or 2s", Type: graphql.String},
+					{Name: "completeness", Description: "Keeps the complete or the incomplete traces only", Type: &graphql.Enum{
+						Name: "Completeness",
+						Values: []graphql.EnumValue{
+							{Name: "COMPLETE", Description: "The traces that weren't found incomplete"},
+							{Name: "INCOMPLETE", Description: "The traces missing their root span or the parents of some spans"},
+						},
+					}},
+					{Name: "page", Type: graphql.Int, Default: 1},
+					{Name: "pageSize", Type: graphql.Int, Default: 20},
+				}),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					q := graphQLQuery(p.Args)
+					q.Set("completeness", strings.ToLower(q.Get("completeness")))
+					req, err := ParseTraceListRequest(q)
+					if err != nil {
+						return nil, err
+					}
+					list, err := service.GetTraceList(p.Context, req)
+					if err != nil {
+						return nil, fmt.Errorf("failed to list traces: %w", err)
+					}
+					page := graphQLTracePage{Traces: make([]graphQLTraceSummary, 0, len(list.Traces)), Page: list.Page, PageSize: list.PageSize, Total: list.Total}
+					for _, t := range list.Traces {
+						page.Traces = append(page.Traces, graphQLTraceSummary{
+							TraceID:    t.TraceID,
+							RootSpan:   t.RootSpan,
+							SpanCount:  t.TotalSpans,
+							DurationMs: t.Duration,
+							StartTime:  t.Timestamp,
+							Issues:     t.Issues,
+							Incomplete: t.Incomplete,
+						})
+					}
+					return page, nil
+				}},
+			{Name: "search", Description: "A page of the spans matching a search, like the search box of the UI", Type: graphql.NonNullOf(searchPage),
+				Args: args([]*graphql.Arg{
+					{Name: "query", Description: "Free text, or key=value conditions", Type: nonNullString},
+				}, rangeArgs("24h"), []*graphql.Arg{
+					{Name: "page", Type: graphql.Int, Default: 1},
+					{Name: "pageSize", Type: graphql.Int, Default: 10},
+					{Name: "sortField", Description: "start_time, end_time, duration or relevance", Type: graphql.String},
+					{Name: "sortOrder", Description: "asc or desc", Type: graphql.String, Default: "desc"},
+					{Name: "traceOrSpan", Description: "trace matches root spans only, span any span", Type: graphql.String},
+					{Name: "approx", Description: "Counts approximately, faster on large ranges", Type: graphql.Boolean, Default: false},
+				}),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					q := graphQLQuery(p.Args)
+					dr, err := parseDateRangeOr(q, "24h")
+					if err != nil {
+						return nil, fmt.Errorf("invalid date range: %w", err)
+					}
+					results, err := service.SearchTraces(p.Context, dr, q.Get("query"), p.Args["page"].(int), p.Args["pageSize"].(int),
+						ParseSortOption(q), q.Get("traceOrSpan"), SearchOptions{Approx: p.Args["approx"].(bool)})
+					if err != nil {
+						return nil, fmt.Errorf("failed to search: %w", err)
+					}
+					return graphQLSearchPage{
+						Results:     v2SearchResults(results.Results),
+						Page:        results.Page,
+						PageSize:    results.PageSize,
+						Total:       results.Total,
+						TotalTraces: results.TotalTraces,
+					}, nil
+				}},
+			{Name: "services", Description: "The services that reported spans in the date range", Type: nonNullList(serviceType),
+				Args: args(rangeArgs("24h"), []*graphql.Arg{
+					{Name: "approx", Description: "Counts approximately, faster on large ranges", Type: graphql.Boolean, Default: false},
+					{Name: "includeRetired", Description: "Lists the retired services too", Type: graphql.Boolean, Default: false},
+				}),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					dr, err := parseDateRangeOr(graphQLQuery(p.Args), "24h")
+					if err != nil {
+						return nil, fmt.Errorf("invalid date range: %w", err)
+					}
+					ctx, err := graphQLListingContext(p, service)
+					if err != nil {
+						return nil, err
+					}
+					services, err := service.GetServiceCatalog(ctx, dr, p.Args["approx"].(bool))
+					if err != nil {
+						return nil, fmt.Errorf("failed to list services: %w", err)
+					}
+					endpoints := &lazy[[]V2Endpoint]{load: func() ([]V2Endpoint, error) {
+						latencies, err := service.GetEndpointLatencies(ctx, EndpointLatencyRequest{DateRange: dr})
+						if err != nil {
+							return nil, fmt.Errorf("failed to list endpoints: %w", err)
+						}
+						return v2Endpoints(latencies), nil
+					}}
+					dependencies := &lazy[[]V2Dependency]{load: func() ([]V2Dependency, error) {
+						deps, err := service.GetServiceDependencies(ctx, dr)
+						if err != nil {
+							return nil, fmt.Errorf("failed to list dependencies: %w", err)
+						}
+						return v2Dependencies(deps), nil
+					}}
+					list := make([]graphQLService, 0, len(services))
+					for _, s := range v2Services(services) {
+						list = append(list, graphQLService{V2Service: s, endpoints: endpoints, dependencies: dependencies})
+					}
+					return list, nil
+				}},
+			{Name: "serviceNames", Description: "The names of every service", Type: nonNullList(graphql.String),
+				Args: []*graphql.Arg{{Name: "includeRetired", Description: "Lists the retired services too", Type: graphql.Boolean, Default: false}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					ctx, err := graphQLListingContext(p, service)
+					if err != nil {
+						return nil, err
+					}
+					names, err := service.GetUniqueServiceNames(ctx)
+					if err != nil {
+						return nil, fmt.Errorf("failed to get service names: %w", err)
+					}
+					return names, nil
+				}},
+			{Name: "endpoints", Description: "The latencies of the endpoints in the date range, slowest first", Type: nonNullList(endpoint),
+				Args: args(rangeArgs("24h"), []*graphql.Arg{
+					{Name: "service", Description: "The service of the endpoints, every service when not set", Type: graphql.String},
+					{Name: "limit", Description: "The number of endpoints, all of them when 0", Type: graphql.Int},
+					{Name: "offset", Type: graphql.Int},
+				}),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					req, err := ParseEndpointLatencyRequest(graphQLQuery(p.Args))
+					if err != nil {
+						return nil, err
+					}
+					latencies, err := service.GetEndpointLatencies(p.Context, req)
+					if err != nil {
+						return nil, fmt.Errorf("failed to list endpoints: %w", err)
+					}
+					return v2Endpoints(latencies), nil
+				}},
+			{Name: "dependencies", Description: "The calls between services in the date range", Type: nonNullList(dependency),
+				Args: rangeArgs("24h"),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					dr, err := parseDateRangeOr(graphQLQuery(p.Args), "24h")
+					if err != nil {
+						return nil, fmt.Errorf("invalid date range: %w", err)
+					}
+					deps, err := service.GetServiceDependencies(p.Context, dr)
+					if err != nil {
+						return nil, fmt.Errorf("failed to list dependencies: %w", err)
+					}
+					return v2Dependencies(deps), nil
+				}},
+			{Name: "metrics", Description: "Series of the spans of the date range", Type: graphql.NonNullOf(metricsType),
+				Args: rangeArgs("24h"),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					dr, err := parseDateRangeOr(graphQLQuery(p.Args), "24h")
+					if err != nil {
+						return nil, fmt.Errorf("invalid date range: %w", err)
+					}
+					return graphQLMetrics{dateRange: dr}, nil
+				}},
+		},
+	}
+
+	schema, err := graphql.NewSchema(query, "Traces, spans, services and metrics of the spans stored in ClickHouse. Counts are Floats since they may not fit in an Int.")
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// graphQLTrace returns the trace, nil when it isn't found
+func graphQLTrace(ctx context.Context, service *TelemetryService, traceID string) (any, error) {
+	spans, err := service.GetTraceDetails(ctx, traceID)
+	if errors.Is(err, ErrTraceNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch trace: %w", err)
+	}
+	return v2Trace(traceID, spans), nil
+}
+
+// graphQLListingContext leaves out the retired services unless includeRetired is set,
+// like listingContext
+func graphQLListingContext(p graphql.ResolveParams, service *TelemetryService) (context.Context, error) {
+	if p.Args["includeRetired"].(bool) {
+		return p.Context, nil
+	}
+	return service.WithoutRetired(p.Context)
+}
@@ -0,0 +1,433 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"nabatshy/api/querypb"
+	"nabatshy/auth"
+	"nabatshy/projects"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// defaultGRPCPercentiles are the percentiles GetMetrics returns when none are asked for
+var defaultGRPCPercentiles = []int32{50, 90, 99}
+
+// QueryServer serves the read API over gRPC, for programmatic clients that would
+// rather not decode JSON. See query.proto.
+type QueryServer struct {
+	querypb.UnimplementedQueryServiceServer
+	service *TelemetryService
+}
+
+// grpcPaths are the HTTP API paths whose timeouts bound the gRPC methods, see
+// Options.Timeouts
+var grpcPaths = map[string]string{
+	"Search":       "/v1/search",
+	"ExportSearch": "/v1/search/export",
+	"GetTrace":     "/v1/traces",
+	"GetSpan":      "/v1/spans",
+	"ListServices": "/v1/services",
+	"GetMetrics":   "/api/metrics",
+}
+
+// NewGRPCServer returns the gRPC server of the query API. With opts.Auth, calls need
+// a session or ID token as a bearer token in their authorization metadata and are
+// restricted to the services of the user, like the requests of the HTTP API. A
+// project in their project metadata scopes them to its services, and they time out
+// like the HTTP API paths they mirror.
+func NewGRPCServer(conn clickhouse.Conn, opts Options, serverOpts ...grpc.ServerOption) *grpc.Server {
+	serverOpts = append(serverOpts,
+		grpc.ChainUnaryInterceptor(grpcUnaryScope(opts)),
+		grpc.ChainStreamInterceptor(grpcStreamScope(opts)),
+	)
+	server := grpc.NewServer(serverOpts...)
+	querypb.RegisterQueryServiceServer(server, &QueryServer{service: NewTelemetryService(conn, opts)})
+	return server
+}
+
+func (s *QueryServer) Search(ctx context.Context, req *querypb.SearchRequest) (*querypb.SearchResponse, error) {
+	dr, err := grpcDateRange(req.GetTimeRange())
+	if err != nil {
+		return nil, err
+	}
+	page, pageSize := int(req.GetPage()), int(req.GetPageSize())
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = 10
+	}
+	results, err := s.service.SearchTraces(ctx, dr, req.GetQuery(), page, pageSize,
+		grpcSortOption(req.GetSortField(), req.GetSortOrder()), req.GetTraceOrSpan(),
+		SearchOptions{Approx: req.GetApprox()})
+	if err != nil {
+		return nil, grpcError(ctx, "failed to search", err)
+	}
+
+	resp := &querypb.SearchResponse{
+		Results:     make([]*querypb.SearchResult, 0, len(results.Results)),
+		Page:        int32(results.Page),
+		PageSize:    int32(results.PageSize),
+		Total:       results.Total,
+		TotalTraces: results.TotalTraces,
+	}
+	for _, r := range results.Results {
+		resp.Results = append(resp.Results, grpcSearchResult(r))
+	}
+	return resp, nil
+}
+
+func (s *QueryServer) ExportSearch(req *querypb.ExportSearchRequest, stream grpc.ServerStreamingServer[querypb.SearchResult]) error {
+	dr, err := grpcDateRange(req.GetTimeRange())
+	if err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	err = s.service.ExportSearch(ctx, dr, req.GetQuery(),
+		grpcSortOption(req.GetSortField(), req.GetSortOrder()), req.GetTraceOrSpan(), uint(req.GetLimit()),
+		func(r SearchResult) error {
+			return stream.Send(grpcSearchResult(r))
+		})
+	if err != nil {
+		return grpcError(ctx, "failed to export search", err)
+	}
+	return nil
+}
+
+func (s *QueryServer) GetTrace(ctx context.Context, req *querypb.GetTraceRequest) (*querypb.Trace, error) {
+	if req.GetTraceId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "trace_id is required")
+	}
+	spans, err := s.service.GetTraceDetails(ctx, req.GetTraceId())
+	if errors.Is(err, ErrTraceNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, grpcError(ctx, "failed to fetch trace", err)
+	}
+
+	trace := &querypb.Trace{TraceId: req.GetTraceId(), Spans: make([]*querypb.TraceSpan, 0, len(spans))}
+	for _, span := range spans {
+		trace.Spans = append(trace.Spans, &querypb.TraceSpan{
+			SpanId:       span.SpanID,
+			ParentSpanId: span.ParentSpanID,
+			Name:         span.Name,
+			Service:      span.Service,
+			StartTime:    timestamppb.New(span.StartTimeNS.Time),
+			EndTime:      timestamppb.New(span.EndTimeNS.Time),
+			DurationMs:   float64(span.DurationNS) / 1e6,
+			SelfTimeMs:   float64(span.SelfTimeNS) / 1e6,
+			Depth:        int32(span.Depth),
+			ChildCount:   int32(span.ChildCount),
+			Events:       grpcEvents(span.Events),
+		})
+	}
+	return trace, nil
+}
+
+func (s *QueryServer) GetSpan(ctx context.Context, req *querypb.GetSpanRequest) (*querypb.Span, error) {
+	if req.GetSpanId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "span_id is required")
+	}
+	q := url.Values{"compareWindow": {req.GetCompareWindow()}}
+	if req.GetCompareAllServices() {
+		q.Set("compareServices", "all")
+	}
+	cmp, err := ParseSpanComparison(q)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	detail, err := s.service.GetSpanDetails(ctx, req.GetSpanId(), cmp)
+	if errors.Is(err, ErrSpanNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, grpcError(ctx, "failed to fetch span", err)
+	}
+
+	span := &querypb.Span{
+		SpanId:       detail.SpanID,
+		TraceId:      detail.TraceID,
+		ParentSpanId: detail.ParentSpanID,
+		Name:         detail.Name,
+		Scope:        detail.Scope,
+		StartTime:    timestamppb.New(detail.StartTime.Time),
+		EndTime:      timestamppb.New(detail.EndTime.Time),
+		DurationMs:   detail.Duration,
+		Comparison: &querypb.Comparison{
+			Window:      detail.ComparisonWindow,
+			Count:       detail.ComparisonCount,
+			AvgMs:       detail.AvgDuration,
+			P50Ms:       detail.P50Duration,
+			P90Ms:       detail.P90Duration,
+			P99Ms:       detail.P99Duration,
+			DiffPercent: detail.DurationDiff,
+		},
+		ResourceAttributes: detail.ResourceAttributes,
+		SpanAttributes:     detail.SpanAttributes,
+		Events:             grpcEvents(detail.Events),
+	}
+	if l := detail.SourceLink; l != nil {
+		span.SourceLink = &querypb.SourceLink{FilePath: l.FilePath, LineNo: l.LineNo, Function: l.Function, Url: l.URL}
+	}
+	return span, nil
+}
+
+func (s *QueryServer) ListServices(ctx context.Context, req *querypb.ListServicesRequest) (*querypb.ListServicesResponse, error) {
+	dr, err := grpcDateRange(req.GetTimeRange())
+	if err != nil {
+		return nil, err
+	}
+	if !req.GetIncludeRetired() {
+		if ctx, err = s.service.WithoutRetired(ctx); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	services, err := s.service.GetServiceCatalog(ctx, dr, req.GetApprox())
+	if err != nil {
+		return nil, grpcError(ctx, "failed to list services", err)
+	}
+
+	resp := &querypb.ListServicesResponse{Services: make([]*querypb.Service, 0, len(services))}
+	for _, e := range services {
+		service := &querypb.Service{
+			Name:         e.Service,
+			SpanCount:    e.SpanCount,
+			TraceCount:   e.TraceCount,
+			LastSeen:     timestamppb.New(e.LastSeen.Time),
+			Versions:     e.Versions,
+			Environments: e.Environments,
+			RunbookUrl:   e.RunbookURL,
+			DashboardUrl: e.DashboardURL,
+		}
+		if o := e.Owner; o != nil {
+			service.Owner = &querypb.Owner{Team: o.Team, SlackChannel: o.SlackChannel, Escalation: o.Escalation}
+		}
+		resp.Services = append(resp.Services, service)
+	}
+	return resp, nil
+}
+
+func (s *QueryServer) GetMetrics(ctx context.Context, req *querypb.GetMetricsRequest) (*querypb.GetMetricsResponse, error) {
+	dr, err := grpcDateRange(req.GetTimeRange())
+	if err != nil {
+		return nil, err
+	}
+	percentiles := req.GetPercentiles()
+	if len(percentiles) == 0 {
+		percentiles = defaultGRPCPercentiles
+	}
+	for _, p := range percentiles {
+		if p < 0 || p > 100 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid percentile %d, expected 0 to 100", p)
+		}
+	}
+
+	traceCounts, err := s.service.GetTraceCounts(ctx, dr)
+	if err != nil {
+		return nil, grpcError(ctx, "failed to get trace counts", err)
+	}
+	errorCounts, err := s.service.GetErrorCounts(ctx, dr)
+	if err != nil {
+		return nil, grpcError(ctx, "failed to get error counts", err)
+	}
+	avgDuration, err := s.service.GetAvgDuration(ctx, dr)
+	if err != nil {
+		return nil, grpcError(ctx, "failed to get average duration", err)
+	}
+	resp := &querypb.GetMetricsResponse{
+		TraceCounts:     grpcCounts(traceCounts),
+		ErrorCounts:     grpcCounts(errorCounts),
+		AverageDuration: grpcDurations(avgDuration),
+	}
+	for _, p := range percentiles {
+		series, err := s.service.GetPercentileSeries(ctx, dr, int(p))
+		if err != nil {
+			return nil, grpcError(ctx, fmt.Sprintf("failed to get p%d", p), err)
+		}
+		resp.Percentiles = append(resp.Percentiles, &querypb.PercentileSeries{Percentile: p, Points: grpcDurations(series)})
+	}
+	return resp, nil
+}
+
+// grpcDateRange reads the time range of a call, the last 24h when it isn't set
+func grpcDateRange(tr *querypb.TimeRange) (DateRange, error) {
+	if tr.GetStart() != nil && tr.GetEnd() != nil {
+		if err := tr.GetStart().CheckValid(); err != nil {
+			return DateRange{}, status.Errorf(codes.InvalidArgument, "invalid start: %v", err)
+		}
+		if err := tr.GetEnd().CheckValid(); err != nil {
+			return DateRange{}, status.Errorf(codes.InvalidArgument, "invalid end: %v", err)
+		}
+		return DateRange{Start: tr.GetStart().AsTime(), End: tr.GetEnd().AsTime()}, nil
+	}
+	last := tr.GetLast()
+	if last == "" {
+		last = "24h"
+	}
+	d, err := utils.ParseTimeRange(last)
+	if err != nil {
+		return DateRange{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	end := time.Now()
+	return DateRange{Start: end.Add(-d), End: end}, nil
+}
+
+func grpcSortOption(field, order string) SortOption {
+	return ParseSortOption(url.Values{"sortField": {field}, "sortOrder": {order}})
+}
+
+// grpcError reports a failed query, with the status of the call's context when the
+// call was canceled or ran out of time
+func grpcError(ctx context.Context, msg string, err error) error {
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
+func grpcSearchResult(r SearchResult) *querypb.SearchResult {
+	return &querypb.SearchResult{
+		TraceId:            r.TraceID,
+		SpanId:             r.SpanID,
+		Name:               r.Name,
+		Service:            r.Service,
+		StartTime:          timestamppb.New(r.StartTime.Time),
+		EndTime:            timestamppb.New(r.EndTime.Time),
+		DurationMs:         r.Duration,
+		HasError:           r.HasError,
+		ResourceAttributes: r.ResourceAttrs,
+		Relevance:          uint32(r.Relevance),
+	}
+}
+
+func grpcEvents(events []SpanEvent) []*querypb.Event {
+	out := make([]*querypb.Event, 0, len(events))
+	for _, e := range events {
+		out = append(out, &querypb.Event{Time: timestamppb.New(e.TimeUnixNano.Time), Name: e.Name, Attributes: e.Attributes})
+	}
+	return out
+}
+
+func grpcCounts(counts []TimeCount) []*querypb.CountPoint {
+	out := make([]*querypb.CountPoint, 0, len(counts))
+	for _, c := range counts {
+		out = append(out, &querypb.CountPoint{Time: timestamppb.New(c.Timestamp.Time), Count: c.Value})
+	}
+	return out
+}
+
+func grpcDurations(series []TimePercentile) []*querypb.DurationPoint {
+	out := make([]*querypb.DurationPoint, 0, len(series))
+	for _, p := range series {
+		out = append(out, &querypb.DurationPoint{Time: timestamppb.New(p.Timestamp.Time), DurationMs: p.Value})
+	}
+	return out
+}
+
+// grpcAuthenticate checks the bearer token of a call like auth.Middleware checks the
+// requests of the HTTP API, every method of the query API reads
+func grpcAuthenticate(ctx context.Context, a *auth.Authenticator) (context.Context, error) {
+	var token string
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if t, ok := strings.CutPrefix(v, "Bearer "); ok {
+			token = t
+		}
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "not logged in")
+	}
+	user, err := a.AuthenticateToken(ctx, token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !user.Role.CanRead() {
+		return nil, status.Errorf(codes.PermissionDenied, "forbidden for role %s", user.Role)
+	}
+	return auth.Scope(ctx, user), nil
+}
+
+// grpcProject scopes a call with project metadata to the project's services, like
+// projects.Middleware scopes the requests of the HTTP API
+func grpcProject(ctx context.Context, service *projects.ProjectService) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	names := md.Get("project")
+	if service == nil || len(names) == 0 || names[0] == "" {
+		return ctx, nil
+	}
+	p, found, err := service.GetProject(ctx, names[0])
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get project: %v", err)
+	}
+	if !found {
+		return nil, status.Error(codes.NotFound, "project not found")
+	}
+	return utils.WithServiceFilter(ctx, "project:"+p.Name, p.Services), nil
+}
+
+// grpcScope returns the context of a call to method: bounded by the timeout of its
+// HTTP path, with its user and restricted to its project
+func grpcScope(ctx context.Context, opts Options, method string) (context.Context, context.CancelFunc, error) {
+	cancel := func() {}
+	if timeout := opts.Timeouts.For(grpcPaths[path.Base(method)]); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	var err error
+	if opts.Auth != nil {
+		if ctx, err = grpcAuthenticate(ctx, opts.Auth); err != nil {
+			cancel()
+			return nil, nil, err
+		}
+	}
+	if ctx, err = grpcProject(ctx, opts.Projects); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return ctx, cancel, nil
+}
+
+func grpcUnaryScope(opts Options) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, cancel, err := grpcScope(ctx, opts, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+func grpcStreamScope(opts Options) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel, err := grpcScope(stream.Context(), opts, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		return handler(srv, scopedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// scopedStream is a stream with the context of its call, see grpcScope
+type scopedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s scopedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// DefaultHTTPEndpointRange is the range HTTP endpoints are measured over when none is given
+const DefaultHTTPEndpointRange = "1h"
+
+const maxHTTPEndpoints = 1000
+
+// HTTPEndpointRequest lists the HTTP routes served in a range
+type HTTPEndpointRequest struct {
+	DateRange DateRange
+	Service   string
+	Method    string
+	Limit     uint
+}
+
+// StatusClasses counts the responses of an endpoint by status class, NoStatus those
+// without a status code
+type StatusClasses struct {
+	Informational uint64 `json:"1xx"`
+	Success       uint64 `json:"2xx"`
+	Redirect      uint64 `json:"3xx"`
+	ClientError   uint64 `json:"4xx"`
+	ServerError   uint64 `json:"5xx"`
+	NoStatus      uint64 `json:"none"`
+}
+
+// HTTPEndpoint is the traffic of a route and method of a service, from the server
+// spans with the http_route and http_method columns
+type HTTPEndpoint struct {
+	Service string        `json:"service"`
+	Method  string        `json:"method"`
+	Route   string        `json:"route"`
+	Calls   uint64        `json:"calls"`
+	AvgMs   float64       `json:"avg_ms"`
+	P50Ms   float64       `json:"p50_ms"`
+	P95Ms   float64       `json:"p95_ms"`
+	P99Ms   float64       `json:"p99_ms"`
+	Status  StatusClasses `json:"status"`
+	// ErrorRate is the share of 5xx responses, between 0 and 1
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// ParseHTTPEndpointRequest reads the start/end or timeRange, service, method and
+// limit parameters, the last DefaultHTTPEndpointRange and 100 endpoints by default
+func ParseHTTPEndpointRequest(q url.Values) (HTTPEndpointRequest, error) {
+	req := HTTPEndpointRequest{Service: q.Get("service"), Method: q.Get("method"), Limit: 100}
+	dateRange, err := parseDateRangeOr(q, DefaultHTTPEndpointRange)
+	if err != nil {
+		return req, fmt.Errorf("invalid date range")
+	}
+	req.DateRange = dateRange
+	if ls := q.Get("limit"); ls != "" {
+		l, err := strconv.ParseUint(ls, 10, 32)
+		if err != nil || l == 0 || l > maxHTTPEndpoints {
+			return req, fmt.Errorf("invalid parameter 'limit'")
+		}
+		req.Limit = uint(l)
+	}
+	return req, nil
+}
+
+// GetHTTPEndpoints returns the latency and status classes of the HTTP routes served
+// in the range, busiest first
+func (s *TelemetryService) GetHTTPEndpoints(ctx context.Context, req HTTPEndpointRequest) ([]HTTPEndpoint, error) {
+	conds := []goqu.Expression{
+		goqu.C("start_time_unix_nano").Gte(req.DateRange.Start.UnixNano()),
+		goqu.C("start_time_unix_nano").Lte(req.DateRange.End.UnixNano()),
+		goqu.C("http_route").Neq(""),
+		goqu.C("http_method").Neq(""),
+		goqu.C("kind").In("server", ""),
+	}
+	if req.Service != "" {
+		conds = append(conds, resourceAttribute("service.name").Eq(req.Service))
+	}
+	if req.Method != "" {
+		conds = append(conds, goqu.C("http_method").Eq(req.Method))
+	}
+
+	ds := s.DB.
+		From("denormalized_span").
+		Select(
+			resourceAttribute("service.name").As("service"),
+			goqu.C("http_method"),
+			goqu.C("http_route"),
+			goqu.L("count()").As("calls"),
+			goqu.L("avg(duration_ns) / 1e6"),
+			goqu.L("arrayMap(x -> x / 1e6, quantiles(0.5, 0.95, 0.99)(duration_ns))"),
+			goqu.L("countIf(http_status_code >= 100 AND http_status_code < 200)"),
+			goqu.L("countIf(http_status_code >= 200 AND http_status_code < 300)"),
+			goqu.L("countIf(http_status_code >= 300 AND http_status_code < 400)"),
+			goqu.L("countIf(http_status_code >= 400 AND http_status_code < 500)"),
+			goqu.L("countIf(http_status_code >= 500)"),
+			goqu.L("countIf(http_status_code < 100)"),
+		).
+		Where(conds...).
+		GroupBy(goqu.C("service"), goqu.C("http_method"), goqu.C("http_route")).
+		Order(goqu.C("calls").Desc(), goqu.C("service").Asc(), goqu.C("http_route").Asc(), goqu.C("http_method").Asc()).
+		Limit(req.Limit)
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	endpoints := []HTTPEndpoint{}
+	for rows.Next() {
+		var e HTTPEndpoint
+		var quantiles []float64
+		if err := rows.Scan(
+			&e.Service, &e.Method, &e.Route, &e.Calls, &e.AvgMs, &quantiles,
+			&e.Status.Informational, &e.Status.Success, &e.Status.Redirect,
+			&e.Status.ClientError, &e.Status.ServerError, &e.Status.NoStatus,
+		); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		if len(quantiles) == 3 {
+			e.P50Ms, e.P95Ms, e.P99Ms = quantiles[0], quantiles[1], quantiles[2]
+		}
+		e.ErrorRate = float64(e.Status.ServerError) / float64(e.Calls)
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
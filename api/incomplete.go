@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"nabatshy/db"
+	"nabatshy/utils"
+)
+
+const (
+	// DefaultCompletionWindow is how long the spans of a trace are waited for
+	// before the trace is checked
+	DefaultCompletionWindow = 5 * time.Minute
+	// completenessInterval is how often the traces are checked
+	completenessInterval = time.Minute
+	// completenessLookback is how long before its first checked span a trace may
+	// start, the spans of longer traces starting earlier aren't seen
+	completenessLookback = time.Hour
+	// completenessBackfill is how far back the first check goes
+	completenessBackfill = time.Hour
+	// completenessWatermark is the setting holding the end of the checked traces
+	completenessWatermark = "incomplete_traces_until"
+)
+
+// ParseCompletionWindow parses the TRACE_COMPLETION_WINDOW value like 5m, empty
+// means DefaultCompletionWindow and off disables the checks, returned as 0
+func ParseCompletionWindow(s string) (time.Duration, error) {
+	switch s {
+	case "":
+		return DefaultCompletionWindow, nil
+	case "off":
+		return 0, nil
+	}
+	d, err := utils.ParseTimeRange(s)
+	if err != nil || d < time.Minute || d > completenessLookback {
+		return 0, fmt.Errorf("invalid completion window %q, use off or a period between 1m and 1h like 5m", s)
+	}
+	return d, nil
+}
+
+// CompletenessChecker records the traces whose root span is missing or whose spans
+// have parents that aren't in the trace into incomplete_traces. A trace is checked
+// once, the completion window after the start of its first span, so that its late
+// spans had time to arrive. Spans arriving after the check are left out.
+type CompletenessChecker struct {
+	service *TelemetryService
+	window  time.Duration
+}
+
+func NewCompletenessChecker(service *TelemetryService, window time.Duration) *CompletenessChecker {
+	return &CompletenessChecker{service: service, window: window}
+}
+
+// Run checks the traces every completenessInterval until ctx is done
+func (c *CompletenessChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(completenessInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.check(ctx, time.Now()); err != nil {
+			log.Printf("completeness: check failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check checks the traces starting between the watermark and the completion window
+// before now, an hour at a time
+func (c *CompletenessChecker) check(ctx context.Context, now time.Time) error {
+	ch := *c.service.Ch
+	until := now.Add(-c.window).Truncate(time.Minute)
+	start := until.Add(-completenessBackfill)
+	value, found, err := db.GetSetting(ctx, ch, completenessWatermark)
+	if err != nil {
+		return err
+	}
+	if found {
+		sec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s setting %q", completenessWatermark, value)
+		}
+		start = time.Unix(sec, 0)
+	}
+
+	for start.Before(until) {
+		end := start.Add(time.Hour)
+		if end.After(until) {
+			end = until
+		}
+		if err := ch.Exec(ctx, incompleteTracesSQL(start, end)); err != nil {
+			return err
+		}
+		if err := db.SetSetting(ctx, ch, completenessWatermark, strconv.FormatInt(end.Unix(), 10)); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// incompleteTracesSQL inserts the incomplete traces whose first span started in
+// [start, end). The parents missing from a trace are the distinct parent span IDs
+// that aren't the ID of one of its spans.
+func incompleteTracesSQL(start, end time.Time) string {
+	from, to := start.UnixNano(), end.UnixNano()
+	lookback := start.Add(-completenessLookback).UnixNano()
+	return fmt.Sprintf(`
+		INSERT INTO incomplete_traces (trace_id, start_time_unix_nano, duration_ns, service, spans, missing_root, missing_parents)
+		SELECT
+			trace_id,
+			min(start_time_unix_nano) AS first,
+			max(end_time_unix_nano) - first AS duration,
+			argMin(%[1]s, start_time_unix_nano) AS service,
+			uniqExact(span_id) AS spans,
+			countIf(parent_span_id = '') = 0 AS missing_root,
+			length(arrayFilter(p -> p != '', groupUniqArray(parent_span_id)))
+				- length(arrayIntersect(groupUniqArray(parent_span_id), groupUniqArray(span_id))) AS missing_parents
+		FROM denormalized_span
+		WHERE start_time_unix_nano >= %[2]d
+			AND trace_id IN (
+				SELECT trace_id FROM denormalized_span
+				WHERE start_time_unix_nano >= %[3]d AND start_time_unix_nano < %[4]d
+			)
+		GROUP BY trace_id
+		HAVING first >= %[3]d AND first < %[4]d AND (missing_root OR missing_parents > 0)`,
+		edgeService, lookback, from, to)
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// ResponseMeta tells clients how much they can trust aggregated numbers
+type ResponseMeta struct {
+	SpansScanned  uint64          `json:"spans_scanned"`
+	BytesScanned  uint64          `json:"bytes_scanned"`
+	Sampled       bool            `json:"sampled"`
+	Approximate   bool            `json:"approximate"`
+	DataFreshness utils.Timestamp `json:"data_freshness"` // end time of the newest stored span
+	// Stale is set when ClickHouse was unreachable and cached results were returned,
+	// StaleAsOf is when the oldest of them was computed
+	Stale     bool             `json:"stale"`
+	StaleAsOf *utils.Timestamp `json:"stale_as_of,omitempty"`
+}
+
+// lastKnownCapacity is the number of dashboard query results kept for outages
+const lastKnownCapacity = 512
+
+// windowKey identifies the length of a date range, results of the same query over
+// a window of the same length stand in for each other while ClickHouse is down
+func windowKey(dr DateRange) string {
+	return dr.End.Sub(dr.Start).Round(time.Minute).String()
+}
+
+// cachedQuery shares identical concurrent queries between callers and, while
+// ClickHouse is unreachable, answers with the last result stored under lastKnownKey.
+// Keys are per service filter since it changes what the queries see.
+func cachedQuery[T any](s *TelemetryService, ctx context.Context, key, lastKnownKey string, fn func(ctx context.Context) (T, error)) (T, error) {
+	if filter := utils.ServiceFilterName(ctx); filter != "" {
+		key, lastKnownKey = filter+"|"+key, filter+"|"+lastKnownKey
+	}
+	return utils.WithLastKnown(s.LastKnown, ctx, lastKnownKey, func(ctx context.Context) (T, error) {
+		return utils.Coalesce(s.Coalescer, ctx, key, fn)
+	})
+}
+
+// freshnessTTL is how long the newest span time is cached for
+const freshnessTTL = 10 * time.Second
+
+type freshnessCache struct {
+	mu        sync.Mutex
+	newest    time.Time
+	checkedAt time.Time
+}
+
+// GetDataFreshness returns the end time of the newest stored span
+func (s *TelemetryService) GetDataFreshness(ctx context.Context) time.Time {
+	if s.freshness == nil {
+		return time.Time{}
+	}
+	s.freshness.mu.Lock()
+	defer s.freshness.mu.Unlock()
+
+	if time.Since(s.freshness.checkedAt) < freshnessTTL {
+		return s.freshness.newest
+	}
+
+	var newest int64
+	// run without the request's progress tracking so it doesn't count as scanned data,
+	// and without its settings so a project's service filter doesn't apply
+	freshnessCtx := clickhouse.Context(context.WithoutCancel(ctx),
+		clickhouse.WithProgress(nil), clickhouse.WithSettings(clickhouse.Settings{}))
+	if err := (*s.Ch).QueryRow(freshnessCtx, "SELECT max(end_time_unix_nano) FROM denormalized_span").Scan(&newest); err == nil {
+		s.freshness.newest = time.Unix(0, newest).UTC()
+		s.freshness.checkedAt = time.Now()
+	}
+	return s.freshness.newest
+}
+
+func (c *TelemetryController) responseMeta(ctx context.Context) *ResponseMeta {
+	meta := &ResponseMeta{DataFreshness: utils.NewTimestamp(c.service.GetDataFreshness(ctx))}
+	if qm := utils.QueryMetaFromContext(ctx); qm != nil {
+		meta.SpansScanned = qm.RowsRead()
+		meta.BytesScanned = qm.BytesRead()
+		meta.Sampled = qm.Sampled()
+		meta.Approximate = qm.Approximate()
+		if at, ok := qm.StaleAt(); ok {
+			meta.Stale = true
+			staleAsOf := utils.NewTimestamp(at)
+			meta.StaleAsOf = &staleAsOf
+		}
+	}
+	return meta
+}
+
+// metaHeaderWriter adds the response metadata headers right before the response is written,
+// when all queries of the request are done
+type metaHeaderWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	c           *TelemetryController
+	wroteHeader bool
+}
+
+func (w *metaHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		meta := w.c.responseMeta(w.r.Context())
+		h := w.Header()
+		h.Set("X-Nabatshy-Spans-Scanned", strconv.FormatUint(meta.SpansScanned, 10))
+		h.Set("X-Nabatshy-Bytes-Scanned", strconv.FormatUint(meta.BytesScanned, 10))
+		h.Set("X-Nabatshy-Sampled", strconv.FormatBool(meta.Sampled))
+		h.Set("X-Nabatshy-Approximate", strconv.FormatBool(meta.Approximate))
+		h.Set("X-Nabatshy-Stale", strconv.FormatBool(meta.Stale))
+		if meta.StaleAsOf != nil {
+			h.Set("X-Nabatshy-Stale-As-Of", meta.StaleAsOf.Format(time.RFC3339Nano))
+		}
+		if !meta.DataFreshness.IsZero() {
+			h.Set("X-Nabatshy-Data-Freshness", meta.DataFreshness.Format(time.RFC3339Nano))
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metaHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// queryMetaMiddleware tracks the data read by the request's queries and reports it
+// in X-Nabatshy-* headers
+func (c *TelemetryController) queryMetaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, _ := utils.WithQueryMeta(r.Context())
+		r = r.WithContext(ctx)
+		next.ServeHTTP(&metaHeaderWriter{ResponseWriter: w, r: r, c: c}, r)
+	})
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"net/http"
+
+	"nabatshy/openapi"
+)
+
+var (
+	pageParams = []openapi.Param{
+		{Name: "page", Type: "integer", Description: "page number, from 1"},
+		{Name: "pageSize", Type: "integer", Description: "results per page"},
+	}
+	sortParams = []openapi.Param{
+		{Name: "sortField", Description: "field to sort by, sort is an alias"},
+		{Name: "sortOrder", Description: "asc or desc, desc by default"},
+	}
+	searchParams = []openapi.Param{
+		{Name: "query", Description: "search query like service:api status:error"},
+		{Name: "traceOrSpan", Description: "trace to match root spans only, span to match any span"},
+	}
+	serviceParam    = openapi.Param{Name: "service", Description: "service name"}
+	limitParam      = openapi.Param{Name: "limit", Type: "integer", Description: "maximum number of results"}
+	approxParam     = openapi.Param{Name: "approx", Type: "boolean", Description: "answer from sampled data, faster and approximate"}
+	retiredParam    = openapi.Param{Name: "includeRetired", Type: "boolean", Description: "include retired services"}
+	attrKeyParam    = openapi.Param{Name: "key", Required: true, Description: "attribute key"}
+	comparisonQuery = []openapi.Param{
+		{Name: "compareWindow", Description: "period the span is compared over like 24h, or all"},
+		{Name: "compareServices", Description: "all to compare with spans of every service"},
+	}
+	errorParams = []openapi.Param{
+		serviceParam,
+		{Name: "type", Description: "exception type"},
+		{Name: "fingerprint", Description: "error group fingerprint"},
+		limitParam,
+	}
+)
+
+// params joins lists of query parameters
+func params(lists ...[]openapi.Param) []openapi.Param {
+	var all []openapi.Param
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	return all
+}
+
+func (c *TelemetryController) Operations() []openapi.Operation {
+	dr := openapi.DateRange
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/traces", Summary: "List traces, newest first", Response: TraceListResponse{},
+			Query: params(pageParams, dr, []openapi.Param{
+				serviceParam,
+				{Name: "minDuration", Description: "minimum duration like 250ms or 2s"},
+				{Name: "completeness", Description: "complete or incomplete"},
+			})},
+		{Method: http.MethodGet, Path: "/v1/traces/slowest", Summary: "The slowest traces", Response: []Trace{},
+			Query: params([]openapi.Param{{Name: "n", Type: "integer", Description: "number of traces, 10 by default"}, serviceParam}, dr)},
+		{Method: http.MethodGet, Path: "/v1/traces/service/{service}", Summary: "The traces of a service", Response: []ServiceTrace{}},
+		{Method: http.MethodGet, Path: "/v1/traces/{trace_id}", Summary: "The spans of a trace", Response: []TraceSpan{}},
+		{Method: http.MethodGet, Path: "/v1/traces/{trace_id}/flamegraph", Summary: "The flamegraph of a trace", Response: FlameNode{}},
+		{Method: http.MethodGet, Path: "/v1/traces/{trace_id}/graph", Summary: "The spans of a trace with their child and link edges", Response: TraceGraph{}},
+		{Method: http.MethodPost, Path: "/v1/traces/{trace_id}/share", Summary: "Mint a link to a trace", Response: TraceShare{}, Status: http.StatusCreated,
+			Query: []openapi.Param{{Name: "ttl", Description: "how long the link is valid like 24h"}}},
+		{Method: http.MethodGet, Path: "/v1/shared/{token}", Summary: "The spans of a shared trace", Response: []TraceSpan{}},
+		{Method: http.MethodGet, Path: "/v1/traces/endpoints", Summary: "Latency of the root spans by endpoint", Response: []EndpointLatency{},
+			Query: params([]openapi.Param{serviceParam, limitParam, {Name: "offset", Type: "integer"}}, dr)},
+		{Method: http.MethodGet, Path: "/v1/traces/dependencies", Summary: "Calls between services", Response: []ServiceDependency{}, Query: dr},
+		{Method: http.MethodGet, Path: "/v1/traces/heatmap", Summary: "Trace counts by time and duration bucket", Response: TraceHeatmap{},
+			Query: params([]openapi.Param{{Name: "bucket", Description: "minute, hour or day, hour by default"}}, dr)},
+		{Method: http.MethodGet, Path: "/v1/spans/{span_id}", Summary: "A span compared with the spans of its operation", Response: SpanDetail{}, Query: comparisonQuery},
+		{Method: http.MethodGet, Path: "/v1/spans/{span_id}/source", Summary: "Link to the source code of a span", Response: SourceLink{}},
+		{Method: http.MethodGet, Path: "/v1/search", Summary: "Search traces or spans", Response: SearchResponse{},
+			Query: params(searchParams, pageParams, sortParams, dr, []openapi.Param{
+				{Name: "includeFacets", Type: "boolean", Description: "count the results by facet"},
+				approxParam,
+			})},
+		{Method: http.MethodGet, Path: "/v1/search/export", Summary: "Export every result of a search",
+			Description: "Streams the results as NDJSON, or as CSV with format=csv", ContentType: "application/x-ndjson",
+			Query: params(searchParams, sortParams, dr, []openapi.Param{{Name: "format", Description: "ndjson or csv"}, limitParam})},
+		{Method: http.MethodGet, Path: "/v1/flamegraph", Summary: "The flamegraph of the traces matching a query", Response: FlameNode{},
+			Query: params([]openapi.Param{{Name: "query"}, limitParam}, dr)},
+		{Method: http.MethodGet, Path: "/v1/attributes/keys", Summary: "Attribute keys", Response: []AttributeKey{},
+			Query: params([]openapi.Param{{Name: "prefix", Description: "key prefix"}, limitParam}, dr)},
+		{Method: http.MethodGet, Path: "/v1/attributes/topk", Summary: "The most frequent values of an attribute", Response: []AttributeTopKBucket{},
+			Query: params([]openapi.Param{attrKeyParam, {Name: "k", Type: "integer", Description: "number of values, 5 by default"}, {Name: "query"}}, dr)},
+		{Method: http.MethodGet, Path: "/v1/attributes/stats", Summary: "The distribution of an attribute", Response: AttributeStats{},
+			Query: params([]openapi.Param{attrKeyParam, {Name: "k", Type: "integer", Description: "number of values, 10 by default"}, {Name: "query"}}, dr)},
+		{Method: http.MethodGet, Path: "/v1/analytics/cohorts", Summary: "Compare the latency and errors of two cohorts of spans", Response: CohortComparison{},
+			Query: params([]openapi.Param{
+				{Name: "a", Required: true, Description: "search query of the first cohort"},
+				{Name: "b", Required: true, Description: "search query of the second cohort"},
+			}, dr)},
+		{Method: http.MethodGet, Path: "/v1/analytics/attribution", Summary: "Attribute the latency of matching traces to services", Response: LatencyAttribution{},
+			Query: params([]openapi.Param{{Name: "query"}, limitParam}, dr)},
+		{Method: http.MethodGet, Path: "/v1/analysis/canary", Summary: "Compare a canary with its baseline", Response: CanaryAnalysis{},
+			Query: params([]openapi.Param{
+				{Name: "service", Required: true},
+				{Name: "split", Description: "attribute splitting the deployments, version by default"},
+				{Name: "baseline", Required: true, Description: "value of the baseline"},
+				{Name: "canary", Required: true, Description: "value of the canary"},
+			}, dr)},
+		{Method: http.MethodGet, Path: "/v1/errors", Summary: "Error groups", Response: []ErrorGroup{}, Query: params(errorParams, dr)},
+		{Method: http.MethodGet, Path: "/v1/errors/occurrences", Summary: "Occurrences of errors", Response: []ErrorOccurrence{}, Query: params(errorParams, dr)},
+		{Method: http.MethodGet, Path: "/v1/errors/inbox", Summary: "Error groups with their triage status", Response: []InboxEntry{},
+			Query: params(errorParams, dr, []openapi.Param{{Name: "status", Description: "open, resolved, ignored or all, open by default"}})},
+		{Method: http.MethodPut, Path: "/v1/errors/groups/{fingerprint}", Summary: "Triage an error group", Response: ErrorGroupState{},
+			Request: struct {
+				Status string `json:"status"`
+			}{}},
+		{Method: http.MethodGet, Path: "/v1/db/queries", Summary: "Database queries by fingerprint", Response: []DBQuery{},
+			Query: params([]openapi.Param{serviceParam, {Name: "system", Description: "database system like postgresql"},
+				{Name: "sort", Description: "total, calls, p95 or avg"}, limitParam}, dr)},
+		{Method: http.MethodGet, Path: "/v1/db/queries/{fingerprint}/spans", Summary: "Spans of a database query", Response: []DBQuerySpan{},
+			Query: params([]openapi.Param{serviceParam, {Name: "system"}, {Name: "sort"}, limitParam}, dr)},
+		{Method: http.MethodGet, Path: "/v1/http/endpoints", Summary: "HTTP routes with their latency and status classes", Response: []HTTPEndpoint{},
+			Query: params([]openapi.Param{serviceParam, {Name: "method", Description: "HTTP method"}, limitParam}, dr)},
+		{Method: http.MethodGet, Path: "/v1/services", Summary: "Service catalog", Response: []ServiceCatalogEntry{},
+			Query: params(dr, []openapi.Param{approxParam, retiredParam})},
+		{Method: http.MethodGet, Path: "/v1/services/health", Summary: "Service health against a baseline", Response: []ServiceHealth{},
+			Query: params(dr, []openapi.Param{{Name: "baseline", Description: "period before the range compared with, 7d by default"}, retiredParam})},
+		{Method: http.MethodGet, Path: "/v1/services/{service}/versions", Summary: "Versions of a service", Response: []ServiceVersion{}, Query: dr},
+
+		{Method: http.MethodGet, Path: "/api/metrics/traces", Summary: "Trace counts over time", Response: []TimeCount{}, Query: dr},
+		{Method: http.MethodGet, Path: "/api/metrics/services", Summary: "Metrics by service", Response: []ServiceMetrics{}, Query: params(dr, []openapi.Param{retiredParam})},
+		{Method: http.MethodGet, Path: "/api/metrics/endpoints", Summary: "Metrics by endpoint", Response: []EndpointMetrics{}, Query: dr},
+		{Method: http.MethodGet, Path: "/api/metrics/pseries", Summary: "A latency percentile over time", Response: []TimePercentile{},
+			Query: params([]openapi.Param{{Name: "percentile", Type: "integer", Description: "95 by default"}}, dr)},
+		{Method: http.MethodGet, Path: "/api/metrics/avg", Summary: "Average duration over time", Response: []TimePercentile{}, Query: dr},
+		{Method: http.MethodGet, Path: "/api/metrics/errors", Summary: "Error counts over time", Response: []TimeCount{}, Query: dr},
+		{Method: http.MethodGet, Path: "/api/metrics/search", Summary: "Metrics of the results of a search", Response: CombinedMetricsResult{},
+			Query: params(searchParams, []openapi.Param{{Name: "percentile", Type: "integer", Description: "95 by default"}}, dr)},
+		{Method: http.MethodGet, Path: "/api/metrics/queue-wait", Summary: "Time messages wait in queues", Response: []QueueWaitSeries{},
+			Query: params([]openapi.Param{{Name: "topic"}}, dr)},
+		{Method: http.MethodGet, Path: "/api/services", Summary: "Service names", Response: []string{}, Query: []openapi.Param{retiredParam}},
+
+		{Method: http.MethodGet, Path: "/v2/search", Summary: "Search traces or spans", Response: V2Response[[]V2SearchResult]{}, Error: V2Error{},
+			Query: params(searchParams, pageParams, sortParams, dr, []openapi.Param{approxParam})},
+		{Method: http.MethodGet, Path: "/v2/traces/{traceId}", Summary: "A trace", Response: V2Response[V2Trace]{}, Error: V2Error{}},
+		{Method: http.MethodGet, Path: "/v2/spans/{spanId}", Summary: "A span", Response: V2Response[V2Span]{}, Error: V2Error{}, Query: comparisonQuery},
+		{Method: http.MethodGet, Path: "/v2/services", Summary: "Services", Response: V2Response[[]V2Service]{}, Error: V2Error{},
+			Query: params(dr, []openapi.Param{approxParam, retiredParam})},
+		{Method: http.MethodGet, Path: "/v2/endpoints", Summary: "Endpoints", Response: V2Response[[]V2Endpoint]{}, Error: V2Error{},
+			Query: params([]openapi.Param{serviceParam, limitParam, {Name: "offset", Type: "integer"}}, dr)},
+		{Method: http.MethodGet, Path: "/v2/dependencies", Summary: "Calls between services", Response: V2Response[[]V2Dependency]{}, Error: V2Error{}, Query: dr},
+	}
+}
@@ -0,0 +1,5 @@
+// Package querypb holds the messages and the gRPC stubs of the query API, generated
+// from query.proto
+package querypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative query.proto
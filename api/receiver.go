@@ -1,29 +1,106 @@
 package api
 
 import (
-	"log"
 	"net/http"
 
+	"nabatshy/auth"
+	"nabatshy/catalog"
+	"nabatshy/health"
+	"nabatshy/metrics"
+	"nabatshy/openapi"
+	"nabatshy/projects"
+	"nabatshy/selftrace"
+	"nabatshy/utils"
+
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/doug-martin/goqu/v9"
 	"github.com/go-chi/chi/v5"
 )
 
-func Run(conn clickhouse.Conn) {
+// OpenAPIInfo is the info of the OpenAPI document of the API
+var OpenAPIInfo = openapi.Info{
+	Title:       "Nabatshy API",
+	Version:     "1",
+	Description: "Traces, services and analytics of the spans stored in ClickHouse. Errors are plain text messages, except on /v2 where they are JSON. Times in responses follow the ts_format query parameter: rfc3339, unix, unix_ms or unix_ns.",
+}
+
+// RouteRegistrar is implemented by controllers of other packages that serve
+// their routes from the API server
+type RouteRegistrar interface {
+	RegisterRoutes(r chi.Router)
+}
+
+// Options configures the API server
+type Options struct {
+	Promoted []utils.PromotedAttribute
+	// SourceLinkTemplate is the source browser URL template, see sourceLink
+	SourceLinkTemplate string
+	Catalog            *catalog.CatalogService
+	// JSONAttributes is set when spans are ingested with attributes stored as JSON
+	JSONAttributes bool
+	// Projects scopes requests with a project parameter to its services, may be nil
+	Projects *projects.ProjectService
+	// Tracer traces the server's own requests, may be nil
+	Tracer *selftrace.Tracer
+	// Checks are added to the readiness checks of the database
+	Checks []health.Check
+	// Auth requires users to log in, may be nil
+	Auth *auth.Authenticator
+	// Timeouts bound the requests, none when zero
+	Timeouts utils.QueryTimeouts
+	// PrecomputedEdges reads the service dependencies from service_edges
+	PrecomputedEdges bool
+	// Shares signs the links of shared traces, may be nil
+	Shares *auth.ShareSigner
+}
+
+// NewTelemetryService returns the service of the API's queries
+func NewTelemetryService(conn clickhouse.Conn, opts Options) *TelemetryService {
 	db := goqu.Dialect("default")
-	telService := TelemetryService{
-		Ch: &conn,
-		DB: &db,
+	return &TelemetryService{
+		Ch:                 &conn,
+		DB:                 &db,
+		Promoted:           opts.Promoted,
+		Coalescer:          utils.NewCoalescer(),
+		LastKnown:          utils.NewLastKnown(lastKnownCapacity),
+		SourceLinkTemplate: opts.SourceLinkTemplate,
+		Catalog:            opts.Catalog,
+		JSONAttributes:     opts.JSONAttributes,
+		PrecomputedEdges:   opts.PrecomputedEdges,
+		freshness:          &freshnessCache{},
 	}
+}
+
+// NewHandler returns the API router
+func NewHandler(conn clickhouse.Conn, opts Options, controllers ...RouteRegistrar) http.Handler {
 	telController := TelemetryController{
-		service: telService,
+		service: *NewTelemetryService(conn, opts),
+		shares:  opts.Shares,
 	}
 
 	r := chi.NewRouter()
+	r.Use(selftrace.Middleware(opts.Tracer))
+	r.Use(metrics.Middleware("api"))
+	r.Use(auth.Middleware(opts.Auth))
+	r.Use(utils.TimeoutMiddleware(opts.Timeouts))
+	r.Use(utils.TimeFormatMiddleware)
+	if opts.Projects != nil {
+		r.Use(projects.Middleware(opts.Projects))
+	}
 
-	telController.RegisterRoutes(r)
-	// Start HTTP server
-	addr := ":3000"
-	log.Printf("listening on %s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, r))
+	checks := append([]health.Check{health.ClickHouse(conn), health.SchemaVersion(conn)}, opts.Checks...)
+	registrars := append([]RouteRegistrar{
+		&telController,
+		NewGraphQLController(&telController.service),
+		health.NewHealthController(checks...),
+	}, controllers...)
+	var ops []openapi.Operation
+	for _, c := range registrars {
+		c.RegisterRoutes(r)
+		if d, ok := c.(openapi.Documented); ok {
+			ops = append(ops, d.Operations()...)
+		}
+	}
+	openapi.NewController(OpenAPIInfo, r, ops).RegisterRoutes(r)
+	return r
 }
@@ -3,16 +3,24 @@ package api
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"nabatshy/catalog"
+	"nabatshy/db"
 	"nabatshy/utils"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
 )
 
 var (
@@ -24,14 +32,41 @@ var (
 var GetIntervalFromDateRange = utils.GetIntervalFromDateRange
 
 type TelemetryService struct {
-	Ch *clickhouse.Conn
-	DB *goqu.DialectWrapper
+	Ch       *clickhouse.Conn
+	DB       *goqu.DialectWrapper
+	Promoted []utils.PromotedAttribute
+	// Coalescer shares identical concurrent aggregation queries, may be nil
+	Coalescer *utils.Coalescer
+	// LastKnown answers dashboard queries while ClickHouse is unreachable, may be nil
+	LastKnown *utils.LastKnown
+	// PrecomputedEdges reads the service dependencies from service_edges, see
+	// EdgeAggregator
+	PrecomputedEdges bool
+	// SourceLinkTemplate builds source browser URLs for spans with code.* attributes
+	SourceLinkTemplate string
+	// Catalog provides service metadata like runbook links, may be nil
+	Catalog *catalog.CatalogService
+	// JSONAttributes makes attribute filters also look at the attributes_json column
+	JSONAttributes bool
+	freshness      *freshnessCache
+}
+
+// dateRangeKey identifies a date range in coalescing keys. Relative ranges like
+// "last 1h" are resolved per request, so second precision lets dashboards that
+// refresh at the same time share the result.
+func dateRangeKey(dr DateRange) string {
+	return fmt.Sprintf("%d-%d", dr.Start.Unix(), dr.End.Unix())
 }
 
 type Trace struct {
-	TraceID  string  `db:"trace_id"`
-	Name     string  `db:"name"`
-	Duration float64 `db:"duration_ms"`
+	TraceID   string          `db:"trace_id"`
+	Name      string          `db:"name"`
+	Duration  float64         `db:"duration_ms"`
+	Service   string          `db:"service"`
+	StartTime utils.Timestamp `db:"start_time"`
+	SpanCount uint64          `db:"span_count"`
+	// HasError is set when a span of the trace recorded an exception
+	HasError bool `db:"has_error"`
 }
 
 type ServiceTrace struct {
@@ -41,20 +76,32 @@ type ServiceTrace struct {
 }
 
 type SpanEvent struct {
-	TimeUnixNano int64             `json:"timeUnixNano"`
+	TimeUnixNano utils.Timestamp   `json:"timeUnixNano"`
 	Name         string            `json:"name"`
 	Attributes   map[string]string `json:"attributes,omitempty"`
 }
 
+// ErrTraceNotFound is returned when no spans of a trace are stored. Traces
+// are only kept in ClickHouse, there's no cold storage tier to rehydrate from.
+var ErrTraceNotFound = errors.New("trace not found")
+
+// ErrSpanNotFound is returned when a span isn't stored
+var ErrSpanNotFound = errors.New("span not found")
+
 type TraceSpan struct {
-	SpanID       string      `db:"span_id"`
-	ParentSpanID string      `db:"parent_span_id"`
-	Name         string      `db:"name"`
-	Service      string      `db:"service_name"`
-	StartTimeNS  int64       `db:"start_time_unix_nano"`
-	EndTimeNS    int64       `db:"end_time_unix_nano"`
-	DurationNS   int64       `db:"duration"`
-	Events       []SpanEvent `json:"events"`
+	SpanID       string          `db:"span_id"`
+	ParentSpanID string          `db:"parent_span_id"`
+	Name         string          `db:"name"`
+	Service      string          `db:"service_name"`
+	StartTimeNS  utils.Timestamp `db:"start_time_unix_nano"`
+	EndTimeNS    utils.Timestamp `db:"end_time_unix_nano"`
+	DurationNS   int64           `db:"duration"`
+	Events       []SpanEvent     `json:"events"`
+	// SelfTimeNS is the duration not covered by child spans
+	SelfTimeNS int64
+	ChildCount int
+	// Depth is 0 for root spans, spans whose parent is missing count as roots
+	Depth int
 }
 
 type EndpointLatency struct {
@@ -65,20 +112,29 @@ type EndpointLatency struct {
 	MaxDuration  float64 `db:"max_duration_ms"`
 	P50Duration  float64 `db:"p50_duration_ms"`
 	P90Duration  float64 `db:"p90_duration_ms"`
+	P95Duration  float64 `db:"p95_duration_ms"`
 	P99Duration  float64 `db:"p99_duration_ms"`
 	RequestCount uint64  `db:"request_count"`
+	// Target is the compliance with the endpoint's latency target, nil without one
+	Target *catalog.Compliance `json:",omitempty"`
 }
 
 type ServiceDependency struct {
-	Source    string `db:"parent_service"`
-	Target    string `db:"child_service"`
-	CallCount uint64 `db:"call_count"`
+	Source     string `db:"parent_service"`
+	Target     string `db:"child_service"`
+	CallCount  uint64 `db:"call_count"`
+	ErrorCount uint64 `db:"error_count"`
+	// P50Duration and P95Duration are the latency of the called spans
+	P50Duration float64 `db:"p50_duration_ms"`
+	P95Duration float64 `db:"p95_duration_ms"`
 }
 
 type TraceHeatmapPoint struct {
-	Hour        time.Time `db:"hour"`
-	TraceCount  uint64    `db:"trace_count"`
-	AvgDuration float64   `db:"avg_duration_ms"`
+	Time        utils.Timestamp `db:"time"`
+	TraceCount  uint64          `db:"trace_count"`
+	AvgDuration float64         `db:"avg_duration_ms"`
+	// Counts are the traces of each duration bucket, see TraceHeatmap
+	Counts []uint64
 }
 
 type SpanDetail struct {
@@ -87,8 +143,8 @@ type SpanDetail struct {
 	ParentSpanID       string            `db:"parent_span_id"`
 	Name               string            `db:"name"`
 	Scope              string            `db:"scope_name"`
-	StartTime          int64             `db:"start_time_unix_nano"`
-	EndTime            int64             `db:"end_time_unix_nano"`
+	StartTime          utils.Timestamp   `db:"start_time_unix_nano"`
+	EndTime            utils.Timestamp   `db:"end_time_unix_nano"`
 	Duration           float64           `db:"duration_ms"`
 	AvgDuration        float64           `db:"avg_duration_ms"`
 	P50Duration        float64           `db:"p50_duration_ms"`
@@ -98,56 +154,110 @@ type SpanDetail struct {
 	ResourceAttributes map[string]string `json:"resourceAttributes"`
 	SpanAttributes     map[string]string `json:"spanAttributes"`
 	Events             []SpanEvent       `json:"events"`
+	SourceLink         *SourceLink       `json:"sourceLink,omitempty"`
+	// ComparisonWindow and ComparisonCount describe the spans the duration
+	// statistics come from, see SpanComparison
+	ComparisonWindow string `json:"comparisonWindow"`
+	ComparisonCount  uint64 `json:"comparisonCount"`
 }
 
 type TraceList struct {
-	TraceID    string  `db:"trace_id"`
-	RootSpan   string  `db:"root_span"`
-	TotalSpans uint64  `db:"total_spans"`
-	Duration   float64 `db:"duration_ms"`
-	Timestamp  int64   `db:"timestamp"`
-	Issues     uint64  `db:"issues"`
+	TraceID    string          `db:"trace_id"`
+	RootSpan   string          `db:"root_span"`
+	TotalSpans uint64          `db:"total_spans"`
+	Duration   float64         `db:"duration_ms"`
+	Timestamp  utils.Timestamp `db:"timestamp"`
+	Issues     uint64          `db:"issues"`
+	// Incomplete is set once the trace was checked and found missing its root span
+	// or the parents of some spans, see CompletenessChecker
+	Incomplete bool `db:"incomplete" json:"incomplete"`
 }
 
 type SearchResult struct {
-	TraceID       string  `db:"trace_id"`
-	SpanID        string  `db:"span_id"`
-	Name          string  `db:"name"`
-	Service       string  `db:"service_name"`
-	Duration      float64 `db:"duration_ms"`
-	StartTime     int64   `db:"start_time_unix_nano"`
-	EndTime       int64   `db:"end_time_unix_nano"`
-	HasError      bool    `db:"has_error" json:"hasError"`
+	TraceID       string          `db:"trace_id"`
+	SpanID        string          `db:"span_id"`
+	Name          string          `db:"name"`
+	Service       string          `db:"service_name"`
+	Duration      float64         `db:"duration_ms"`
+	StartTime     utils.Timestamp `db:"start_time_unix_nano"`
+	EndTime       utils.Timestamp `db:"end_time_unix_nano"`
+	HasError      bool            `db:"has_error" json:"hasError"`
 	ResourceAttrs map[string]string
+	// Relevance ranks the matches of a broad search: 3 for a trace or span ID, 2 for
+	// a span or service name and 1 for an attribute or event. It's 0 for key=value searches.
+	Relevance uint8 `db:"relevance" json:"relevance,omitempty"`
 }
 
 type SearchResponse struct {
-	Results  []SearchResult `json:"results"`
-	Page     int            `json:"page"`
-	PageSize int            `json:"pageSize"`
+	Results     []SearchResult `json:"results"`
+	Page        int            `json:"page"`
+	PageSize    int            `json:"pageSize"`
+	Total       uint64         `json:"total"`
+	TotalTraces uint64         `json:"totalTraces"`
+	Facets      *SearchFacets  `json:"facets,omitempty"`
+	Meta        *ResponseMeta  `json:"meta,omitempty"`
+}
+
+type FacetBucket struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+type AttributeFacetBucket struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+// SearchFacets are bucketed counts of all spans matching a search, not just the current page
+type SearchFacets struct {
+	Services   []FacetBucket          `json:"services"`
+	Names      []FacetBucket          `json:"names"`
+	Status     []FacetBucket          `json:"status"`
+	Attributes []AttributeFacetBucket `json:"attributes"`
+}
+
+// SearchOptions are the optional extras of a search
+type SearchOptions struct {
+	// IncludeFacets adds bucketed counts of all matching spans to the response
+	IncludeFacets bool
+	// Approx uses approximate distinct counts, much faster on large ranges
+	Approx bool
+}
+
+// distinctCount returns the aggregate counting distinct values of column,
+// uniqCombined is within ~1% of the exact count for a fraction of the memory
+func distinctCount(approx bool, column string) string {
+	if approx {
+		return "uniqCombined(" + column + ")"
+	}
+	return "uniqExact(" + column + ")"
 }
 
 type SortOption struct {
-	Field string `json:"field"` // "start_time", "end_time", or "duration"
+	Field string `json:"field"` // "start_time", "end_time", "duration" or "relevance"
 	Order string `json:"order"` // "asc" or "desc"
 }
 
+// ParseSortOption reads the sortField and sortOrder parameters of a search, sort is
+// taken as the field when sortField isn't set, e.g. sort=relevance
+func ParseSortOption(q url.Values) SortOption {
+	field := q.Get("sortField")
+	if field == "" {
+		field = q.Get("sort")
+	}
+	order := q.Get("sortOrder")
+	if order != "asc" && order != "desc" {
+		order = "desc" // default to descending
+	}
+	return SortOption{Field: field, Order: order}
+}
+
 type TimeRangeMetrics struct {
-	Timestamp   time.Time `json:"timestamp" db:"timestamp"`
-	Count       uint64    `json:"count" db:"count"`
-	AvgDuration float64   `json:"avg_duration_ms" db:"avg_duration"`
-	TraceID     string    `json:"trace_id" db:"trace_id"`
-}
-
-func (m TimeRangeMetrics) MarshalJSON() ([]byte, error) {
-	type Alias TimeRangeMetrics
-	return json.Marshal(&struct {
-		Timestamp string `json:"timestamp"`
-		*Alias
-	}{
-		Timestamp: m.Timestamp.Format(time.RFC3339),
-		Alias:     (*Alias)(&m),
-	})
+	Timestamp   utils.Timestamp `json:"timestamp" db:"timestamp"`
+	Count       uint64          `json:"count" db:"count"`
+	AvgDuration float64         `json:"avg_duration_ms" db:"avg_duration"`
+	TraceID     string          `json:"trace_id" db:"trace_id"`
 }
 
 type ServiceMetrics struct {
@@ -161,28 +271,59 @@ type EndpointMetrics struct {
 	Endpoint    string  `db:"endpoint" json:"endpoint"`
 	Count       uint64  `db:"count" json:"count"`
 	AvgDuration float64 `db:"avg_duration_ms" json:"avg_duration_ms"`
+	P50Duration float64 `db:"p50_duration_ms" json:"p50_duration_ms"`
+	P90Duration float64 `db:"p90_duration_ms" json:"p90_duration_ms"`
 	P95Duration float64 `db:"p95_duration_ms" json:"p95_duration_ms"`
+	P99Duration float64 `db:"p99_duration_ms" json:"p99_duration_ms"`
+	// Target is the compliance with the endpoint's latency target, only targets
+	// without a service apply since these metrics aren't split by service
+	Target *catalog.Compliance `json:"target,omitempty"`
 }
 
 type SlowTrace struct {
-	TraceID   string  `db:"trace_id" json:"trace_id"`
-	Name      string  `db:"name" json:"name"`
-	Duration  float64 `db:"duration_ms" json:"duration_ms"`
-	Service   string  `db:"service" json:"service"`
-	StartTime int64   `db:"start_time" json:"start_time"`
+	TraceID   string          `db:"trace_id" json:"trace_id"`
+	Name      string          `db:"name" json:"name"`
+	Duration  float64         `db:"duration_ms" json:"duration_ms"`
+	Service   string          `db:"service" json:"service"`
+	StartTime utils.Timestamp `db:"start_time" json:"start_time"`
 }
 
-func (s *TelemetryService) GetTopSlowTraces(ctx context.Context, n uint) ([]Trace, error) {
+// GetTopSlowTraces returns the n traces with the slowest root spans that started
+// in the date range, of a service's root spans when service isn't empty
+func (s *TelemetryService) GetTopSlowTraces(ctx context.Context, n uint, dateRange DateRange, service string) ([]Trace, error) {
+	rootConds := []goqu.Expression{
+		goqu.C("parent_span_id").Eq(""),
+		goqu.C("start_time_unix_nano").Gte(dateRange.Start.UnixNano()),
+		goqu.C("start_time_unix_nano").Lte(dateRange.End.UnixNano()),
+	}
+	if service != "" {
+		rootConds = append(rootConds, resourceAttribute("service.name").Eq(service))
+	}
+	slowest := s.DB.
+		From("denormalized_span").
+		Select(goqu.C("trace_id")).
+		Where(rootConds...).
+		Order(goqu.C("duration_ns").Desc()).
+		Limit(n)
+
 	ds := s.DB.
 		From("denormalized_span").
 		Select(
 			goqu.C("trace_id"),
-			goqu.C("name"),
-			goqu.L("duration_ns / 1000000").As("duration_ms"),
+			goqu.L("anyIf(name, parent_span_id = '')").As("name"),
+			goqu.L("maxIf(duration_ns, parent_span_id = '') / 1000000").As("duration_ms"),
+			goqu.L("anyIf(resource_attributes.value[indexOf(resource_attributes.key, 'service.name')], parent_span_id = '')").As("service"),
+			goqu.L("minIf(start_time_unix_nano, parent_span_id = '')").As("start_time"),
+			// each span once, see uniqueSpans
+			goqu.L("uniqExact(span_id)").As("span_count"),
+			goqu.L("max(has(events.name, 'exception'))").As("has_error"),
 		).
-		Where(goqu.C("parent_span_id").Eq("")).
-		Order(goqu.C("start_time_unix_nano").Desc(), goqu.C("duration_ms").Desc()).
-		Limit(n)
+		Where(
+			goqu.C("start_time_unix_nano").Gte(dateRange.Start.UnixNano()),
+			goqu.C("trace_id").In(slowest),
+		).
+		GroupBy(goqu.C("trace_id")).
+		Order(goqu.L("duration_ms").Desc())
 	sqlStr, args, err := ds.ToSQL()
 	if err != nil {
 		return nil, err
@@ -197,7 +338,7 @@ func (s *TelemetryService) GetTopSlowTraces(ctx context.Context, n uint) ([]Trac
 	var results []Trace
 	for rows.Next() {
 		var t Trace
-		if err := rows.Scan(&t.TraceID, &t.Name, &t.Duration); err != nil {
+		if err := rows.Scan(&t.TraceID, &t.Name, &t.Duration, &t.Service, &t.StartTime, &t.SpanCount, &t.HasError); err != nil {
 			return nil, err
 		}
 		results = append(results, t)
@@ -274,6 +415,7 @@ func (s *TelemetryService) GetTraceDetails(ctx context.Context, traceID string)
 	defer rows.Close()
 
 	var spans []TraceSpan
+	seen := make(map[string]bool)
 	for rows.Next() {
 		var s TraceSpan
 		var eventTimes []int64
@@ -284,12 +426,17 @@ func (s *TelemetryService) GetTraceDetails(ctx context.Context, traceID string)
 		if err := rows.Scan(&s.SpanID, &s.ParentSpanID, &s.Name, &s.Service, &s.StartTimeNS, &s.EndTimeNS, &s.DurationNS, &eventTimes, &eventNames, &eventAttrKeys, &eventAttrValues); err != nil {
 			return nil, err
 		}
+		// a span stored twice by a retried export is only shown once
+		if seen[s.SpanID] {
+			continue
+		}
+		seen[s.SpanID] = true
 
 		// Map events arrays to SpanEvent structs with attributes
 		s.Events = make([]SpanEvent, len(eventTimes))
 		for i := range eventTimes {
 			event := SpanEvent{
-				TimeUnixNano: eventTimes[i],
+				TimeUnixNano: utils.UnixNanoTimestamp(eventTimes[i]),
 				Name:         eventNames[i],
 			}
 
@@ -309,10 +456,80 @@ func (s *TelemetryService) GetTraceDetails(ctx context.Context, traceID string)
 
 		spans = append(spans, s)
 	}
-	return spans, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(spans) == 0 {
+		return nil, ErrTraceNotFound
+	}
+
+	annotateSpanTree(traceID, spans)
+	return spans, nil
+}
+
+// annotateSpanTree fills in the self time, child count and depth of each span
+func annotateSpanTree(traceID string, spans []TraceSpan) {
+	nodes := make([]*spanNode, len(spans))
+	for i, s := range spans {
+		nodes[i] = &spanNode{
+			TraceID:      traceID,
+			SpanID:       s.SpanID,
+			ParentSpanID: s.ParentSpanID,
+			Start:        s.StartTimeNS.UnixNano(),
+			End:          s.EndTimeNS.UnixNano(),
+		}
+	}
+	buildSpanTree(nodes)
+
+	for i, n := range nodes {
+		spans[i].SelfTimeNS = selfTime(n)
+		spans[i].ChildCount = len(n.children)
+		spans[i].Depth = n.depth
+	}
+}
+
+// EndpointLatencyRequest selects the root spans the endpoint latencies come from
+type EndpointLatencyRequest struct {
+	DateRange DateRange
+	// Service is the scope of the endpoints, empty for every service
+	Service string
+	// Limit is the number of endpoints returned, 0 for all of them
+	Limit  uint
+	Offset uint
 }
 
-func (s *TelemetryService) GetEndpointLatencies(ctx context.Context) ([]EndpointLatency, error) {
+// ParseEndpointLatencyRequest reads the start/end or timeRange, service, limit and
+// offset parameters. Without a date range the latencies are of the last 24 hours.
+func ParseEndpointLatencyRequest(q url.Values) (EndpointLatencyRequest, error) {
+	req := EndpointLatencyRequest{Service: q.Get("service")}
+	dateRange, err := parseDateRangeOr(q, "24h")
+	if err != nil {
+		return req, err
+	}
+	req.DateRange = dateRange
+	for name, dest := range map[string]*uint{"limit": &req.Limit, "offset": &req.Offset} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return req, fmt.Errorf("invalid %s %q", name, v)
+		}
+		*dest = uint(n)
+	}
+	return req, nil
+}
+
+func (s *TelemetryService) GetEndpointLatencies(ctx context.Context, req EndpointLatencyRequest) ([]EndpointLatency, error) {
+	conds := []goqu.Expression{
+		goqu.C("parent_span_id").Eq(""),
+		goqu.C("start_time_unix_nano").Gte(req.DateRange.Start.UnixNano()),
+		goqu.C("start_time_unix_nano").Lte(req.DateRange.End.UnixNano()),
+	}
+	if req.Service != "" {
+		conds = append(conds, goqu.C("scope_name").Eq(req.Service))
+	}
 	ds := s.DB.
 		From("denormalized_span").
 		Select(
@@ -323,12 +540,20 @@ func (s *TelemetryService) GetEndpointLatencies(ctx context.Context) ([]Endpoint
 			goqu.L("max(duration_ns / 1000000)").As("max_duration_ms"),
 			goqu.L("quantile(0.5)(duration_ns / 1000000)").As("p50_duration_ms"),
 			goqu.L("quantile(0.9)(duration_ns / 1000000)").As("p90_duration_ms"),
+			goqu.L("quantile(0.95)(duration_ns / 1000000)").As("p95_duration_ms"),
 			goqu.L("quantile(0.99)(duration_ns / 1000000)").As("p99_duration_ms"),
 			goqu.L("count(*)").As("request_count"),
 		).
-		Where(goqu.C("parent_span_id").Eq("")).
+		Where(conds...).
 		GroupBy(goqu.C("name"), goqu.C("scope_name")).
-		Order(goqu.L("avg_duration_ms").Desc())
+		// endpoint and service break ties so pages don't overlap
+		Order(goqu.L("avg_duration_ms").Desc(), goqu.C("endpoint").Asc(), goqu.C("service").Asc())
+	if req.Limit > 0 {
+		ds = ds.Limit(req.Limit)
+	}
+	if req.Offset > 0 {
+		ds = ds.Offset(req.Offset)
+	}
 
 	sqlStr, args, err := ds.ToSQL()
 	if err != nil {
@@ -352,6 +577,7 @@ func (s *TelemetryService) GetEndpointLatencies(ctx context.Context) ([]Endpoint
 			&l.MaxDuration,
 			&l.P50Duration,
 			&l.P90Duration,
+			&l.P95Duration,
 			&l.P99Duration,
 			&l.RequestCount,
 		); err != nil {
@@ -359,56 +585,138 @@ func (s *TelemetryService) GetEndpointLatencies(ctx context.Context) ([]Endpoint
 		}
 		latencies = append(latencies, l)
 	}
-	return latencies, rows.Err()
-}
-
-func (s *TelemetryService) GetServiceDependencies(ctx context.Context) ([]ServiceDependency, error) {
-	ds := s.DB.
-		From("denormalized_span").As("s1").
-		Join(goqu.T("denormalized_span").As("s2"), goqu.On(goqu.I("s1.span_id").Eq(goqu.I("s2.parent_span_id")))).
-		Select(
-			goqu.I("s1.scope_name").As("parent_service"),
-			goqu.I("s2.scope_name").As("child_service"),
-			goqu.L("count(*)").As("call_count"),
-		).
-		Where(goqu.I("s1.scope_name").Neq(goqu.I("s2.scope_name"))).
-		GroupBy(goqu.I("s1.scope_name"), goqu.I("s2.scope_name")).
-		Order(goqu.L("call_count").Desc())
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	sqlStr, args, err := ds.ToSQL()
+	targets, err := s.latencyTargets(ctx)
 	if err != nil {
 		return nil, err
 	}
+	for i, l := range latencies {
+		latencies[i].Target = targets.Check(l.Service, l.Endpoint, map[int]float64{
+			50: l.P50Duration, 90: l.P90Duration, 95: l.P95Duration, 99: l.P99Duration,
+		})
+	}
+	return latencies, nil
+}
 
-	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+// latencyTargets returns the configured endpoint latency targets, none without a catalog
+func (s *TelemetryService) latencyTargets(ctx context.Context) (catalog.LatencyTargets, error) {
+	if s.Catalog == nil {
+		return nil, nil
+	}
+	targets, err := s.Catalog.LatencyTargets(ctx)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to load latency targets: %w", err)
 	}
-	defer rows.Close()
+	return targets, nil
+}
 
-	var dependencies []ServiceDependency
-	for rows.Next() {
-		var d ServiceDependency
-		if err := rows.Scan(&d.Source, &d.Target, &d.CallCount); err != nil {
-			return nil, err
-		}
-		dependencies = append(dependencies, d)
+// WithoutRetired returns a context whose queries leave out the spans of retired
+// services, ctx itself without a catalog or retired services
+func (s *TelemetryService) WithoutRetired(ctx context.Context) (context.Context, error) {
+	if s.Catalog == nil {
+		return ctx, nil
+	}
+	retired, err := s.Catalog.RetiredServices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load retired services: %w", err)
+	}
+	if len(retired) == 0 {
+		return ctx, nil
+	}
+	return utils.WithoutServices(ctx, "retired:"+strings.Join(retired, ","), retired), nil
+}
+
+// GetServiceDependencies returns the calls between services whose calling span
+// started in the date range, with the errors and latency of the called spans. See
+// EdgeCallsSQL for what a call is. service_edges holds the calls of every service,
+// users whose queries see some services only get dependencies computed live.
+func (s *TelemetryService) GetServiceDependencies(ctx context.Context, dateRange DateRange) ([]ServiceDependency, error) {
+	if s.PrecomputedEdges && utils.ServiceFilterName(ctx) == "" {
+		return s.precomputedDependencies(ctx, dateRange)
+	}
+	return s.liveDependencies(ctx, dateRange)
+}
+
+// heatmapBuckets are the time bucket sizes of the trace heatmap and the functions
+// rounding a span's start down to its bucket
+var heatmapBuckets = map[string]struct {
+	size time.Duration
+	fn   string
+}{
+	"minute": {time.Minute, "toStartOfMinute"},
+	"hour":   {time.Hour, "toStartOfHour"},
+	"day":    {24 * time.Hour, "toStartOfDay"},
+}
+
+// HeatmapDurationBounds are the upper bounds in milliseconds of the duration buckets
+// of the trace heatmap, traces slower than the last one fall in an extra bucket
+var HeatmapDurationBounds = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// maxHeatmapBuckets bounds the time buckets of a heatmap
+const maxHeatmapBuckets = 5000
+
+// TraceHeatmapRequest selects the root spans of the trace heatmap and its time
+// bucket size, minute, hour or day
+type TraceHeatmapRequest struct {
+	DateRange DateRange
+	Bucket    string
+}
+
+type TraceHeatmap struct {
+	Bucket string `json:"bucket"`
+	// DurationBounds are HeatmapDurationBounds, Counts has one more entry
+	DurationBounds []float64           `json:"durationBounds"`
+	Points         []TraceHeatmapPoint `json:"points"`
+}
+
+// ParseTraceHeatmapRequest reads the start/end or timeRange and bucket parameters,
+// by default the hours of the last day
+func ParseTraceHeatmapRequest(q url.Values) (TraceHeatmapRequest, error) {
+	req := TraceHeatmapRequest{Bucket: q.Get("bucket")}
+	if req.Bucket == "" {
+		req.Bucket = "hour"
+	}
+	bucket, ok := heatmapBuckets[req.Bucket]
+	if !ok {
+		return req, fmt.Errorf("invalid bucket %q, use minute, hour or day", req.Bucket)
+	}
+	dateRange, err := parseDateRangeOr(q, "24h")
+	if err != nil {
+		return req, err
 	}
-	return dependencies, rows.Err()
+	req.DateRange = dateRange
+	if req.DateRange.End.Sub(req.DateRange.Start)/bucket.size > maxHeatmapBuckets {
+		return req, fmt.Errorf("the date range has more than %d %s buckets, use a larger bucket", maxHeatmapBuckets, req.Bucket)
+	}
+	return req, nil
 }
 
-func (s *TelemetryService) GetTraceHeatmap(ctx context.Context) ([]TraceHeatmapPoint, error) {
+// GetTraceHeatmap counts the traces of each time bucket by duration bucket. Time
+// buckets without traces are left out.
+func (s *TelemetryService) GetTraceHeatmap(ctx context.Context, req TraceHeatmapRequest) (*TraceHeatmap, error) {
+	bounds := make([]string, len(HeatmapDurationBounds))
+	for i, b := range HeatmapDurationBounds {
+		bounds[i] = strconv.FormatInt(int64(b*1e6), 10)
+	}
 	ds := s.DB.
 		From("denormalized_span").
 		Select(
-			goqu.L("toStartOfHour(fromUnixTimestamp64Nano(start_time_unix_nano))").As("hour"),
-			goqu.L("count(*)").As("trace_count"),
-			goqu.L("avg((end_time_unix_nano - start_time_unix_nano) / 1000000)").As("avg_duration_ms"),
+			goqu.L(heatmapBuckets[req.Bucket].fn+"(fromUnixTimestamp64Nano(start_time_unix_nano))").As("time"),
+			// 0 when the trace is slower than every bound
+			goqu.L("arrayFirstIndex(b -> duration_ns <= b, ["+strings.Join(bounds, ", ")+"])").As("duration_bucket"),
+			goqu.L("count()").As("trace_count"),
+			goqu.L("sum(duration_ns) / 1000000").As("total_duration_ms"),
 		).
-		Where(goqu.I("parent_span_id").Eq("")).
-		GroupBy(goqu.L("hour")).
-		Order(goqu.L("hour").Desc()).
-		Limit(24)
+		Where(
+			goqu.I("parent_span_id").Eq(""),
+			goqu.I("start_time_unix_nano").Gte(req.DateRange.Start.UnixNano()),
+			goqu.I("start_time_unix_nano").Lte(req.DateRange.End.UnixNano()),
+		).
+		GroupBy(goqu.L("time"), goqu.L("duration_bucket")).
+		Order(goqu.L("time").Asc())
 
 	sqlStr, args, err := ds.ToSQL()
 	if err != nil {
@@ -421,22 +729,78 @@ func (s *TelemetryService) GetTraceHeatmap(ctx context.Context) ([]TraceHeatmapP
 	}
 	defer rows.Close()
 
-	var heatmap []TraceHeatmapPoint
+	heatmap := &TraceHeatmap{Bucket: req.Bucket, DurationBounds: HeatmapDurationBounds, Points: []TraceHeatmapPoint{}}
+	// the summed durations of the points, for their average
+	var totals []float64
 	for rows.Next() {
-		var h TraceHeatmapPoint
-		if err := rows.Scan(&h.Hour, &h.TraceCount, &h.AvgDuration); err != nil {
+		var t utils.Timestamp
+		var bucket uint32
+		var count uint64
+		var duration float64
+		if err := rows.Scan(&t, &bucket, &count, &duration); err != nil {
 			return nil, err
 		}
-		heatmap = append(heatmap, h)
+		n := len(heatmap.Points)
+		if n == 0 || !heatmap.Points[n-1].Time.Equal(t.Time) {
+			heatmap.Points = append(heatmap.Points, TraceHeatmapPoint{
+				Time:   t,
+				Counts: make([]uint64, len(HeatmapDurationBounds)+1),
+			})
+			totals = append(totals, 0)
+			n++
+		}
+		if bucket == 0 {
+			bucket = uint32(len(HeatmapDurationBounds)) + 1
+		}
+		p := &heatmap.Points[n-1]
+		p.Counts[bucket-1] += count
+		p.TraceCount += count
+		totals[n-1] += duration
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	return heatmap, rows.Err()
+	for i := range heatmap.Points {
+		heatmap.Points[i].AvgDuration = totals[i] / float64(heatmap.Points[i].TraceCount)
+	}
+	return heatmap, nil
 }
 
 func encodeBytes(b []byte) string {
 	return base64.StdEncoding.EncodeToString(b)
 }
 
-func (s *TelemetryService) GetSpanDetails(ctx context.Context, spanID string) (*SpanDetail, error) {
+// DefaultComparisonWindow is how far back the spans a span is compared with go
+const DefaultComparisonWindow = 24 * time.Hour
+
+// SpanComparison picks the spans whose duration statistics a span is compared with:
+// those of the same name and service that started in the window before it
+type SpanComparison struct {
+	// Window is 0 to compare with every span of the name
+	Window time.Duration
+	// AllServices compares with the spans of the name in every service
+	AllServices bool
+}
+
+// ParseSpanComparison reads the compareWindow parameter, a period like 24h or 7d or
+// "all", and compareServices=all
+func ParseSpanComparison(q url.Values) (SpanComparison, error) {
+	c := SpanComparison{Window: DefaultComparisonWindow, AllServices: q.Get("compareServices") == "all"}
+	switch w := q.Get("compareWindow"); w {
+	case "":
+	case "all":
+		c.Window = 0
+	default:
+		window, err := utils.ParseTimeRange(w)
+		if err != nil {
+			return c, fmt.Errorf("invalid compareWindow: %w", err)
+		}
+		c.Window = window
+	}
+	return c, nil
+}
+
+func (s *TelemetryService) GetSpanDetails(ctx context.Context, spanID string, cmp SpanComparison) (*SpanDetail, error) {
 	ds := s.DB.
 		From(goqu.T("denormalized_span")).
 		Select(
@@ -456,6 +820,7 @@ func (s *TelemetryService) GetSpanDetails(ctx context.Context, spanID string) (*
 			goqu.C("events.name").As("event_names"),
 			goqu.C("events.attributes.key").As("event_attr_keys"),
 			goqu.C("events.attributes.value").As("event_attr_values"),
+			goqu.C("attributes_json"),
 		).
 		Where(goqu.I("span_id").Eq(spanID)).
 		GroupBy(
@@ -475,6 +840,7 @@ func (s *TelemetryService) GetSpanDetails(ctx context.Context, spanID string) (*
 			goqu.C("events.name"),
 			goqu.C("events.attributes.key"),
 			goqu.C("events.attributes.value"),
+			goqu.C("attributes_json"),
 		)
 
 	sqlStr, args, err := ds.ToSQL()
@@ -489,7 +855,7 @@ func (s *TelemetryService) GetSpanDetails(ctx context.Context, spanID string) (*
 	defer rows.Close()
 
 	if !rows.Next() {
-		return nil, fmt.Errorf("span not found: %s", spanID)
+		return nil, fmt.Errorf("%w: %s", ErrSpanNotFound, spanID)
 	}
 
 	var detail SpanDetail
@@ -498,6 +864,7 @@ func (s *TelemetryService) GetSpanDetails(ctx context.Context, spanID string) (*
 	var eventNames []string
 	var eventAttrKeys [][]string
 	var eventAttrValues [][]string
+	var attrsJSON string
 
 	if err := rows.Scan(
 		&detail.SpanID,
@@ -516,6 +883,7 @@ func (s *TelemetryService) GetSpanDetails(ctx context.Context, spanID string) (*
 		&eventNames,
 		&eventAttrKeys,
 		&eventAttrValues,
+		&attrsJSON,
 	); err != nil {
 		return nil, err
 	}
@@ -533,12 +901,14 @@ func (s *TelemetryService) GetSpanDetails(ctx context.Context, spanID string) (*
 		spanAttrs[spanKeys[i]] = spanValues[i]
 	}
 	detail.SpanAttributes = spanAttrs
+	utils.MergeAttributesJSON(attrsJSON, resourceAttrs, spanAttrs)
+	detail.SourceLink = sourceLink(s.SourceLinkTemplate, spanAttrs, resourceAttrs)
 
 	// Map events with attributes
 	detail.Events = make([]SpanEvent, len(eventTimes))
 	for i := range eventTimes {
 		event := SpanEvent{
-			TimeUnixNano: eventTimes[i],
+			TimeUnixNano: utils.UnixNanoTimestamp(eventTimes[i]),
 			Name:         eventNames[i],
 		}
 
@@ -556,59 +926,220 @@ func (s *TelemetryService) GetSpanDetails(ctx context.Context, spanID string) (*
 		detail.Events[i] = event
 	}
 
-	// calculate avg durations of spans of the same name
+	// the duration statistics of the spans of the same name, by default of the same
+	// service in the day before the span, which the primary key narrows down
+	cmpConds := []goqu.Expression{goqu.I("name").Eq(detail.Name)}
+	if !cmp.AllServices {
+		if service := resourceAttrs["service.name"]; service != "" {
+			cmpConds = append(cmpConds, resourceAttribute("service.name").Eq(service))
+		} else {
+			cmpConds = append(cmpConds, goqu.I("scope_name").Eq(detail.Scope))
+		}
+	}
+	detail.ComparisonWindow = "all"
+	if cmp.Window > 0 {
+		start := detail.StartTime.UnixNano()
+		cmpConds = append(cmpConds,
+			goqu.I("start_time_unix_nano").Gte(start-cmp.Window.Nanoseconds()),
+			goqu.I("start_time_unix_nano").Lte(start),
+		)
+		detail.ComparisonWindow = cmp.Window.String()
+	}
 	avgDS := s.DB.
 		From(goqu.T("denormalized_span")).
 		Select(
 			goqu.L("avg(duration_ns / 1000000)").As("avg_duration_ms"),
-			goqu.L("quantile(0.5)(duration_ns / 1000000)").As("p50_duration_ms"),
-			goqu.L("quantile(0.9)(duration_ns / 1000000)").As("p90_duration_ms"),
-			goqu.L("quantile(0.99)(duration_ns / 1000000)").As("p99_duration_ms"),
+			goqu.L("quantiles(0.5, 0.9, 0.99)(duration_ns / 1000000)").As("percentiles"),
+			goqu.L("count()").As("comparison_count"),
 		).
-		Where(goqu.I("name").Eq(detail.Name)).
-		GroupBy(goqu.I("name"))
+		Where(cmpConds...)
 	sqlAvgStr, avgArgs, err := avgDS.ToSQL()
 	if err != nil {
 		return nil, err
 	}
-	var avgResult struct {
-		AvgDuration float64 `db:"avg_duration_ms"`
-		P50Duration float64 `db:"p50_duration_ms"`
-		P90Duration float64 `db:"p90_duration_ms"`
-		P99Duration float64 `db:"p99_duration_ms"`
-	}
+	var percentiles []float64
 	if err := (*s.Ch).QueryRow(ctx, sqlAvgStr, avgArgs...).Scan(
-		&avgResult.AvgDuration,
-		&avgResult.P50Duration,
-		&avgResult.P90Duration,
-		&avgResult.P99Duration,
+		&detail.AvgDuration,
+		&percentiles,
+		&detail.ComparisonCount,
 	); err != nil {
 		return nil, fmt.Errorf("failed to get avg durations: %w", err)
 	}
-	detail.AvgDuration = avgResult.AvgDuration
-	detail.P50Duration = avgResult.P50Duration
-	detail.P90Duration = avgResult.P90Duration
-	detail.P99Duration = avgResult.P99Duration
-	detail.DurationDiff = (detail.Duration - avgResult.AvgDuration) / avgResult.AvgDuration * 100
+	if len(percentiles) == 3 {
+		detail.P50Duration, detail.P90Duration, detail.P99Duration = percentiles[0], percentiles[1], percentiles[2]
+	}
+	if detail.AvgDuration > 0 {
+		detail.DurationDiff = (detail.Duration - detail.AvgDuration) / detail.AvgDuration * 100
+	}
 
 	return &detail, nil
 }
 
-func (s *TelemetryService) GetTraceList(ctx context.Context) ([]TraceList, error) {
+const (
+	// DefaultTraceListRange is the date range of the trace list without one
+	DefaultTraceListRange = "24h"
+	// maxTraceListPageSize bounds the traces of a page
+	maxTraceListPageSize = 500
+)
+
+// TraceListRequest selects a page of the traces whose root span started in the
+// date range, newest first
+type TraceListRequest struct {
+	DateRange DateRange
+	// Service is the service.name of the root span, empty for every service
+	Service string
+	// MinDuration leaves out the traces whose root span is faster
+	MinDuration time.Duration
+	// Completeness keeps the complete or the incomplete traces only, every trace
+	// when empty
+	Completeness Completeness
+	Page         int
+	PageSize     int
+}
+
+// Completeness selects traces by whether they're complete
+type Completeness string
+
+const (
+	// TracesComplete are the traces that weren't found incomplete, the traces
+	// still in their completion window included
+	TracesComplete Completeness = "complete"
+	// TracesIncomplete are the traces found incomplete. Those missing their root
+	// span are listed by their first span and their root_span is empty.
+	TracesIncomplete Completeness = "incomplete"
+)
+
+type TraceListResponse struct {
+	Traces   []TraceList `json:"traces"`
+	Page     int         `json:"page"`
+	PageSize int         `json:"pageSize"`
+	Total    uint64      `json:"total"`
+}
+
+// parseDateRangeOr reads the start/end or timeRange parameters, the date range is
+// the last timeRange when there are none
+func parseDateRangeOr(q url.Values, timeRange string) (DateRange, error) {
+	if q.Get("timeRange") == "" && (q.Get("start") == "" || q.Get("end") == "") {
+		return GetDateRangeFromQuery(timeRange), nil
+	}
+	return ParseDateRange(q, "start", "end", "timeRange")
+}
+
+// ParseTraceListRequest reads the page, pageSize, start/end or timeRange, service,
+// minDuration and completeness parameters, minDuration being a duration like 250ms
+// or 2s and completeness complete or incomplete
+func ParseTraceListRequest(q url.Values) (TraceListRequest, error) {
+	req := TraceListRequest{Service: q.Get("service")}
+	dateRange, err := parseDateRangeOr(q, DefaultTraceListRange)
+	if err != nil {
+		return req, err
+	}
+	req.DateRange = dateRange
+	if v := q.Get("minDuration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return req, fmt.Errorf("invalid minDuration %q, use a duration like 250ms or 2s", v)
+		}
+		req.MinDuration = d
+	}
+	switch c := Completeness(q.Get("completeness")); c {
+	case "", TracesComplete, TracesIncomplete:
+		req.Completeness = c
+	default:
+		return req, fmt.Errorf("invalid completeness %q, use complete or incomplete", c)
+	}
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(q.Get("pageSize"))
+	if err != nil || pageSize < 1 {
+		pageSize = 20
+	}
+	req.Page, req.PageSize = page, min(pageSize, maxTraceListPageSize)
+	return req, nil
+}
+
+// GetTraceList returns a page of the traces matching the request. The root spans,
+// or the incomplete traces, are paged first and only the spans of the traces on the
+// page are aggregated.
+func (s *TelemetryService) GetTraceList(ctx context.Context, req TraceListRequest) (*TraceListResponse, error) {
+	if req.Completeness == TracesIncomplete {
+		return s.getIncompleteTraceList(ctx, req)
+	}
+	// a trace is checked by the start of its first span, which may be before its root
+	incomplete := s.DB.
+		From(goqu.T("incomplete_traces")).
+		Select(goqu.I("trace_id")).
+		Where(goqu.I("start_time_unix_nano").Gte(req.DateRange.Start.Add(-completenessLookback).UnixNano()))
+
+	rootConds := []goqu.Expression{
+		goqu.I("parent_span_id").Eq(""),
+		goqu.I("start_time_unix_nano").Gte(req.DateRange.Start.UnixNano()),
+		goqu.I("start_time_unix_nano").Lte(req.DateRange.End.UnixNano()),
+	}
+	if req.Service != "" {
+		rootConds = append(rootConds, resourceAttribute("service.name").Eq(req.Service))
+	}
+	if req.MinDuration > 0 {
+		rootConds = append(rootConds, goqu.I("duration_ns").Gte(req.MinDuration.Nanoseconds()))
+	}
+	if req.Completeness == TracesComplete {
+		rootConds = append(rootConds, goqu.I("trace_id").NotIn(incomplete))
+	}
+
+	roots := s.DB.
+		From(goqu.T("denormalized_span")).
+		Select(goqu.I("trace_id")).
+		Where(rootConds...).
+		Order(goqu.I("start_time_unix_nano").Desc()).
+		Limit(uint(req.PageSize)).
+		Offset(uint((req.Page - 1) * req.PageSize))
+
+	response := &TraceListResponse{Page: req.Page, PageSize: req.PageSize}
+	traces, err := s.aggregateTraces(ctx, req.DateRange.Start, roots, incomplete)
+	if err != nil {
+		return nil, err
+	}
+	response.Traces = traces
+
+	totalSQL, totalArgs, err := s.DB.
+		From(goqu.T("denormalized_span")).
+		Select(goqu.L("uniqExact(trace_id)")).
+		Where(rootConds...).
+		ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	if err := (*s.Ch).QueryRow(ctx, totalSQL, totalArgs...).Scan(&response.Total); err != nil {
+		return nil, fmt.Errorf("failed to count traces: %w", err)
+	}
+	return response, nil
+}
+
+// aggregateTraces returns the traces of ids, a query of trace IDs, from their spans
+// starting after since, newest first. Those in incomplete, a query of the incomplete
+// trace IDs, are flagged.
+func (s *TelemetryService) aggregateTraces(ctx context.Context, since time.Time, ids, incomplete *goqu.SelectDataset) ([]TraceList, error) {
 	ds := s.DB.
-		From(goqu.T("denormalized_span").As("s1")).
+		From(goqu.T("denormalized_span")).
 		Select(
-			goqu.I("s1.trace_id"),
-			goqu.I("s1.name").As("root_span"),
-			goqu.L("count(*)").As("total_spans"),
-			goqu.L("max(s1.duration_ns / 1000000)").As("duration_ms"),
-			goqu.L("min(s1.start_time_unix_nano)").As("timestamp"),
-			goqu.L("countIf(s1.duration_ns > avg(s1.duration_ns) * 2)").As("issues"),
+			goqu.I("trace_id"),
+			goqu.L("anyIf(name, parent_span_id = '')").As("root_span"),
+			goqu.L("uniqExact(span_id)").As("total_spans"),
+			goqu.L("max(duration_ns / 1000000)").As("duration_ms"),
+			goqu.L("min(start_time_unix_nano)").As("timestamp"),
+			// spans taking more than twice the average span of their trace, the
+			// average is passed as an array since lambdas can't hold aggregates
+			goqu.L("toUInt64(arrayCount((d, a) -> d > a * 2, groupArray(duration_ns), arrayWithConstant(count(), avg(duration_ns))))").As("issues"),
+			goqu.I("trace_id").In(incomplete).As("incomplete"),
 		).
-		Where(goqu.I("s1.parent_span_id").Eq("")).
-		GroupBy(goqu.I("s1.trace_id"), goqu.I("s1.name")).
-		Order(goqu.L("timestamp").Desc()).
-		Limit(100)
+		Where(
+			goqu.I("start_time_unix_nano").Gte(since.UnixNano()),
+			goqu.I("trace_id").In(ids),
+		).
+		GroupBy(goqu.I("trace_id")).
+		Order(goqu.L("timestamp").Desc())
 
 	sqlStr, args, err := ds.ToSQL()
 	if err != nil {
@@ -621,7 +1152,7 @@ func (s *TelemetryService) GetTraceList(ctx context.Context) ([]TraceList, error
 	}
 	defer rows.Close()
 
-	var traces []TraceList
+	traces := []TraceList{}
 	for rows.Next() {
 		var t TraceList
 		if err := rows.Scan(
@@ -631,6 +1162,7 @@ func (s *TelemetryService) GetTraceList(ctx context.Context) ([]TraceList, error
 			&t.Duration,
 			&t.Timestamp,
 			&t.Issues,
+			&t.Incomplete,
 		); err != nil {
 			return nil, err
 		}
@@ -639,6 +1171,51 @@ func (s *TelemetryService) GetTraceList(ctx context.Context) ([]TraceList, error
 	return traces, rows.Err()
 }
 
+// getIncompleteTraceList pages the incomplete traces whose first span started in
+// the date range, the service and minDuration being those of the first span and of
+// the whole trace
+func (s *TelemetryService) getIncompleteTraceList(ctx context.Context, req TraceListRequest) (*TraceListResponse, error) {
+	conds := []goqu.Expression{
+		goqu.I("start_time_unix_nano").Gte(req.DateRange.Start.UnixNano()),
+		goqu.I("start_time_unix_nano").Lte(req.DateRange.End.UnixNano()),
+	}
+	if req.Service != "" {
+		conds = append(conds, goqu.I("service").Eq(req.Service))
+	}
+	if req.MinDuration > 0 {
+		conds = append(conds, goqu.I("duration_ns").Gte(req.MinDuration.Nanoseconds()))
+	}
+	incomplete := s.DB.
+		From(goqu.T("incomplete_traces")).
+		Select(goqu.I("trace_id")).
+		Where(conds...)
+	page := incomplete.
+		Order(goqu.I("start_time_unix_nano").Desc()).
+		Limit(uint(req.PageSize)).
+		Offset(uint((req.Page - 1) * req.PageSize))
+
+	response := &TraceListResponse{Page: req.Page, PageSize: req.PageSize}
+	traces, err := s.aggregateTraces(ctx, req.DateRange.Start, page, incomplete)
+	if err != nil {
+		return nil, err
+	}
+	response.Traces = traces
+
+	// a trace checked twice has two rows until they're merged
+	totalSQL, totalArgs, err := s.DB.
+		From(goqu.T("incomplete_traces")).
+		Select(goqu.L("uniqExact(trace_id)")).
+		Where(conds...).
+		ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	if err := (*s.Ch).QueryRow(ctx, totalSQL, totalArgs...).Scan(&response.Total); err != nil {
+		return nil, fmt.Errorf("failed to count traces: %w", err)
+	}
+	return response, nil
+}
+
 // AttributeQuery represents a parsed key=value or key!=value pair
 type AttributeQuery struct {
 	Key      string
@@ -695,22 +1272,10 @@ func parseAttributeQuery(query string) []AttributeQuery {
 	return nil
 }
 
-func (s *TelemetryService) SearchTraces(ctx context.Context, dateRange DateRange, query string, page, pageSize int, sort SortOption, traceOrSpan string) (*SearchResponse, error) {
-	totalStart := time.Now()
-	defer func() {
-		fmt.Printf("[SearchTraces] Total function time: %v\n", time.Since(totalStart))
-	}()
-
-	startNano := dateRange.Start.UnixNano()
-	endNano := dateRange.End.UnixNano()
-
-	base := s.DB.From(goqu.T("denormalized_span"))
-
-	conds := []goqu.Expression{
-		goqu.I("start_time_unix_nano").Gte(startNano),
-		goqu.I("end_time_unix_nano").Lte(endNano),
-	}
-
+// searchConditions builds the WHERE conditions for a search query string, shared by
+// the search results and the search metrics so both always match the same spans
+func (s *TelemetryService) searchConditions(query string, traceOrSpan string) []goqu.Expression {
+	var conds []goqu.Expression
 	if query != "" {
 		// Try to parse as attribute query first
 		if attrs := parseAttributeQuery(query); attrs != nil {
@@ -734,41 +1299,61 @@ func (s *TelemetryService) SearchTraces(ctx context.Context, dateRange DateRange
 					case "!=":
 						attrConds = append(attrConds, goqu.I("scope_name").Neq(attr.Value))
 					}
+				case "text":
+					// Handle special "text" key for matching words, or parts of words, in
+					// the span name, attribute values and event names, e.g. text=timeou
+					switch attr.Operator {
+					case "=":
+						attrConds = append(attrConds, textMatch(attr.Value))
+					case "!=":
+						attrConds = append(attrConds, goqu.L("NOT ?", textMatch(attr.Value)))
+					}
+				case "event":
+					// Handle special "event" key for matching spans by event name, e.g. event=exception
+					switch attr.Operator {
+					case "=":
+						attrConds = append(attrConds, goqu.L("has(events.name, ?)", attr.Value))
+					case "!=":
+						attrConds = append(attrConds, goqu.L("NOT has(events.name, ?)", attr.Value))
+					}
 				default:
+					// "event." prefixed keys match event attributes, e.g. event.exception.type=TimeoutError
+					if key, ok := strings.CutPrefix(attr.Key, "event."); ok {
+						hasEventAttr := goqu.L(
+							"arrayExists((ks, vs) -> arrayExists((k, v) -> k = ? AND v = ?, ks, vs), events.attributes.key, events.attributes.value)",
+							key, attr.Value,
+						)
+						switch attr.Operator {
+						case "=":
+							attrConds = append(attrConds, hasEventAttr)
+						case "!=":
+							attrConds = append(attrConds, goqu.L("NOT ?", hasEventAttr))
+						}
+						continue
+					}
+					// Promoted attributes have their own column, no need to read the attribute maps
+					if promoted, ok := utils.FindPromotedAttribute(s.Promoted, attr.Key); ok {
+						switch attr.Operator {
+						case "=":
+							attrConds = append(attrConds, goqu.I(promoted.Column).Eq(attr.Value))
+						case "!=":
+							attrConds = append(attrConds, goqu.I(promoted.Column).Neq(attr.Value))
+						}
+						continue
+					}
 					// Handle regular attribute searches
+					hasAttr := goqu.Or(
+						attributeMapMatch("resource_attributes_map", attr.Key, attr.Value),
+						attributeMapMatch("span_attributes_map", attr.Key, attr.Value),
+						s.jsonAttributeMatch(attr.Key, attr.Value),
+					)
 					switch attr.Operator {
 					case "=":
 						// Equals: match spans that have this exact key=value pair
-						attrConds = append(attrConds, goqu.Or(
-							goqu.And(
-								goqu.L("has(resource_attributes.key, ?)", attr.Key),
-								goqu.L("has(resource_attributes.value, ?)", attr.Value),
-							),
-							goqu.And(
-								goqu.L("has(span_attributes.key, ?)", attr.Key),
-								goqu.L("has(span_attributes.value, ?)", attr.Value),
-							),
-						))
+						attrConds = append(attrConds, hasAttr)
 					case "!=":
 						// Not equals: match spans that don't have the key=value pair in either resource or span attributes
-						attrConds = append(attrConds, goqu.And(
-							// Resource attributes: key doesn't exist OR (key exists AND value is different)
-							goqu.Or(
-								goqu.L("NOT has(resource_attributes.key, ?)", attr.Key),
-								goqu.And(
-									goqu.L("has(resource_attributes.key, ?)", attr.Key),
-									goqu.L("NOT has(resource_attributes.value, ?)", attr.Value),
-								),
-							),
-							// Span attributes: key doesn't exist OR (key exists AND value is different)
-							goqu.Or(
-								goqu.L("NOT has(span_attributes.key, ?)", attr.Key),
-								goqu.And(
-									goqu.L("has(span_attributes.key, ?)", attr.Key),
-									goqu.L("NOT has(span_attributes.value, ?)", attr.Value),
-								),
-							),
-						))
+						attrConds = append(attrConds, goqu.L("NOT ?", hasAttr))
 					}
 				}
 			}
@@ -785,6 +1370,7 @@ func (s *TelemetryService) SearchTraces(ctx context.Context, dateRange DateRange
 				goqu.L("has(resource_attributes.value, ?)", query),
 				goqu.L("has(span_attributes.key, ?)", query),
 				goqu.L("has(span_attributes.value, ?)", query),
+				goqu.L("has(events.name, ?)", query),
 			))
 		}
 	}
@@ -803,47 +1389,60 @@ func (s *TelemetryService) SearchTraces(ctx context.Context, dateRange DateRange
 		}
 	}
 
-	offset := (page - 1) * pageSize
+	return conds
+}
 
-	ds := base.
-		Select(
-			goqu.I("trace_id"),
-			goqu.I("span_id"),
-			goqu.I("name"),
-			goqu.I("scope_name").As("service_name"),
-			goqu.L("duration_ns / 1000000").As("duration_ms"),
-			goqu.I("start_time_unix_nano"),
-			goqu.I("end_time_unix_nano"),
-			goqu.L("has(events.name, 'exception')").As("has_error"),
-			goqu.I("resource_attributes.key").As("resource_keys"),
-			goqu.I("resource_attributes.value").As("resource_values"),
-		).
-		Where(conds...)
+// textMatch matches spans whose search text has every word of text, case
+// insensitively, using the search_text_ngram index for words of 3 characters or more
+func textMatch(text string) exp.Expression {
+	words := strings.Fields(strings.ToLower(text))
+	if len(words) == 0 {
+		return goqu.L("1")
+	}
+	conds := make([]exp.Expression, len(words))
+	for i, word := range words {
+		conds[i] = goqu.L(db.SearchText+" LIKE ?", "%"+likeEscaper.Replace(word)+"%")
+	}
+	return goqu.And(conds...)
+}
 
-	switch sort.Field {
-	case "start_time":
-		if sort.Order == "asc" {
-			ds = ds.Order(goqu.I("start_time_unix_nano").Asc())
-		} else {
-			ds = ds.Order(goqu.I("start_time_unix_nano").Desc())
-		}
-	case "end_time":
-		if sort.Order == "asc" {
-			ds = ds.Order(goqu.I("end_time_unix_nano").Asc())
-		} else {
-			ds = ds.Order(goqu.I("end_time_unix_nano").Desc())
-		}
-	case "duration":
-		if sort.Order == "asc" {
-			ds = ds.Order(goqu.I("duration_ns").Asc())
-		} else {
-			ds = ds.Order(goqu.I("duration_ns").Desc())
-		}
-	default:
-		ds = ds.Order(goqu.I("start_time_unix_nano").Desc())
+// likeEscaper escapes the LIKE wildcards of a word, with the backslashes doubled
+// again since ClickHouse string literals take backslash escapes and the query is
+// interpolated
+var likeEscaper = strings.NewReplacer(`\`, `\\\\`, `%`, `\\%`, `_`, `\\_`)
+
+// attributeMapMatch matches spans whose attribute map has key set to value. A missing
+// key reads as an empty string, so empty values also check the key is there.
+func attributeMapMatch(column, key, value string) exp.Expression {
+	if value == "" {
+		return goqu.L("mapContains("+column+", ?) AND "+column+"[?] = ''", key, key)
 	}
+	return goqu.L(column+"[?] = ?", key, value)
+}
 
-	ds = ds.Limit(uint(pageSize)).Offset(uint(offset))
+// jsonAttributeMatch matches spans whose attributes_json has the key=value pair,
+// it matches nothing when attributes are only stored in the Nested columns
+func (s *TelemetryService) jsonAttributeMatch(key, value string) exp.Expression {
+	if !s.JSONAttributes {
+		return goqu.L("0")
+	}
+	return goqu.L(
+		"(JSONExtractString(attributes_json, 'span', ?) = ? OR JSONExtractString(attributes_json, 'resource', ?) = ?)",
+		key, value, key, value,
+	)
+}
+
+func (s *TelemetryService) SearchTraces(ctx context.Context, dateRange DateRange, query string, page, pageSize int, sort SortOption, traceOrSpan string, opts SearchOptions) (*SearchResponse, error) {
+	totalStart := time.Now()
+	defer func() {
+		fmt.Printf("[SearchTraces] Total function time: %v\n", time.Since(totalStart))
+	}()
+
+	conds := s.searchSpanConditions(dateRange, query, traceOrSpan)
+	offset := (page - 1) * pageSize
+	ds := s.searchResultsDataset(conds, query, sort)
+
+	ds = ds.Limit(uint(pageSize)).Offset(uint(offset))
 	sqlStr, args, err := ds.ToSQL()
 	if err != nil {
 		return nil, err
@@ -860,43 +1459,314 @@ func (s *TelemetryService) SearchTraces(ctx context.Context, dateRange DateRange
 
 	var results []SearchResult
 	for rows.Next() {
-		var r SearchResult
-		var resourceKeys, resourceValues []string
-		if err := rows.Scan(
-			&r.TraceID,
-			&r.SpanID,
-			&r.Name,
-			&r.Service,
-			&r.Duration,
-			&r.StartTime,
-			&r.EndTime,
-			&r.HasError,
-			&resourceKeys,
-			&resourceValues,
-		); err != nil {
+		r, err := scanSearchResult(rows)
+		if err != nil {
 			return nil, err
 		}
-		attrs := make(map[string]string)
-		for i := range resourceKeys {
-			attrs[resourceKeys[i]] = resourceValues[i]
-		}
-		r.ResourceAttrs = attrs
 		results = append(results, r)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	return &SearchResponse{
+	response := &SearchResponse{
 		Results:  results,
 		Page:     page,
 		PageSize: pageSize,
-	}, rows.Err()
+	}
+
+	totalsDS := s.DB.From(goqu.T("denormalized_span")).
+		Select(
+			// each span once, see uniqueSpans
+			goqu.L(distinctCount(opts.Approx, "trace_id, span_id")),
+			goqu.L(distinctCount(opts.Approx, "trace_id")),
+		).
+		Where(conds...)
+	totalsSQL, totalsArgs, err := totalsDS.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	if err := (*s.Ch).QueryRow(ctx, totalsSQL, totalsArgs...).Scan(&response.Total, &response.TotalTraces); err != nil {
+		return nil, fmt.Errorf("failed to count results: %w", err)
+	}
+	if opts.Approx {
+		utils.MarkApproximate(ctx)
+	}
+
+	if opts.IncludeFacets {
+		facets, err := s.searchFacets(ctx, conds)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute facets: %w", err)
+		}
+		response.Facets = facets
+	}
+	return response, nil
+}
+
+// searchSpanConditions matches the spans of a search in the date range
+func (s *TelemetryService) searchSpanConditions(dateRange DateRange, query, traceOrSpan string) []goqu.Expression {
+	conds := []goqu.Expression{
+		goqu.I("start_time_unix_nano").Gte(dateRange.Start.UnixNano()),
+		goqu.I("end_time_unix_nano").Lte(dateRange.End.UnixNano()),
+	}
+	return append(conds, s.searchConditions(query, traceOrSpan)...)
+}
+
+// relevance scores how a span matched a broad search, see SearchResult.Relevance
+func relevance(query string) exp.LiteralExpression {
+	if query == "" || parseAttributeQuery(query) != nil {
+		return goqu.L("toUInt8(0)")
+	}
+	return goqu.L(
+		"toUInt8(multiIf(trace_id = ? OR span_id = ?, 3, name = ? OR scope_name = ?, 2, 1))",
+		query, query, query, query,
+	)
+}
+
+// searchResultsDataset selects the SearchResult columns of the matching spans in sort order
+func (s *TelemetryService) searchResultsDataset(conds []goqu.Expression, query string, sort SortOption) *goqu.SelectDataset {
+	ds := s.DB.From(goqu.T("denormalized_span")).
+		Select(
+			goqu.I("trace_id"),
+			goqu.I("span_id"),
+			goqu.I("name"),
+			goqu.I("scope_name").As("service_name"),
+			goqu.L("duration_ns / 1000000").As("duration_ms"),
+			goqu.I("start_time_unix_nano"),
+			goqu.I("end_time_unix_nano"),
+			goqu.L("has(events.name, 'exception')").As("has_error"),
+			goqu.I("resource_attributes.key").As("resource_keys"),
+			goqu.I("resource_attributes.value").As("resource_values"),
+			relevance(query).As("relevance"),
+		).
+		Where(conds...)
+
+	switch sort.Field {
+	case "relevance":
+		// the newest spans first among equally relevant ones
+		if sort.Order == "asc" {
+			ds = ds.Order(goqu.I("relevance").Asc(), goqu.I("start_time_unix_nano").Desc())
+		} else {
+			ds = ds.Order(goqu.I("relevance").Desc(), goqu.I("start_time_unix_nano").Desc())
+		}
+	case "start_time":
+		if sort.Order == "asc" {
+			ds = ds.Order(goqu.I("start_time_unix_nano").Asc())
+		} else {
+			ds = ds.Order(goqu.I("start_time_unix_nano").Desc())
+		}
+	case "end_time":
+		if sort.Order == "asc" {
+			ds = ds.Order(goqu.I("end_time_unix_nano").Asc())
+		} else {
+			ds = ds.Order(goqu.I("end_time_unix_nano").Desc())
+		}
+	case "duration":
+		if sort.Order == "asc" {
+			ds = ds.Order(goqu.I("duration_ns").Asc())
+		} else {
+			ds = ds.Order(goqu.I("duration_ns").Desc())
+		}
+	default:
+		ds = ds.Order(goqu.I("start_time_unix_nano").Desc())
+	}
+	return ds
+}
+
+// scanSearchResult scans a row of searchResultsDataset
+func scanSearchResult(rows driver.Rows) (SearchResult, error) {
+	var r SearchResult
+	var resourceKeys, resourceValues []string
+	if err := rows.Scan(
+		&r.TraceID,
+		&r.SpanID,
+		&r.Name,
+		&r.Service,
+		&r.Duration,
+		&r.StartTime,
+		&r.EndTime,
+		&r.HasError,
+		&resourceKeys,
+		&resourceValues,
+		&r.Relevance,
+	); err != nil {
+		return r, err
+	}
+	attrs := make(map[string]string)
+	for i := range resourceKeys {
+		attrs[resourceKeys[i]] = resourceValues[i]
+	}
+	r.ResourceAttrs = attrs
+	return r, nil
+}
+
+// CountSearch counts the spans matching a search between start and end, trace
+// searches only match root spans so they count traces
+func (s *TelemetryService) CountSearch(ctx context.Context, query, traceOrSpan string, start, end time.Time) (uint64, error) {
+	ds := s.DB.From(goqu.T("denormalized_span")).
+		Select(goqu.L("uniqExact(trace_id, span_id)")).
+		Where(s.searchSpanConditions(DateRange{Start: start, End: end}, query, traceOrSpan)...)
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	if err := (*s.Ch).QueryRow(ctx, sqlStr, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count search matches: %w", err)
+	}
+	return n, nil
+}
+
+// ExportSearch streams every span matching a search to emit straight from the
+// query cursor, so exports aren't limited by memory. A limit of 0 exports all spans.
+func (s *TelemetryService) ExportSearch(ctx context.Context, dateRange DateRange, query string, sort SortOption, traceOrSpan string, limit uint, emit func(SearchResult) error) error {
+	ds := s.searchResultsDataset(s.searchSpanConditions(dateRange, query, traceOrSpan), query, sort)
+	if limit > 0 {
+		ds = ds.Limit(limit)
+	}
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanSearchResult(rows)
+		if err != nil {
+			return fmt.Errorf("scan error: %w", err)
+		}
+		if err := emit(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// facetLimit is the maximum number of buckets returned per facet
+const facetLimit = 10
+
+// searchFacets runs the facet aggregations for the spans matching conds concurrently
+func (s *TelemetryService) searchFacets(ctx context.Context, conds []goqu.Expression) (*SearchFacets, error) {
+	facets := &SearchFacets{}
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+
+	facetQuery := func(i int, expr exp.Expression, out *[]FacetBucket) {
+		defer wg.Done()
+		ds := s.DB.
+			From("denormalized_span").
+			Select(goqu.L("?", expr).As("value"), goqu.L("uniqExact(trace_id, span_id)").As("count")).
+			Where(conds...).
+			GroupBy(goqu.C("value")).
+			Order(goqu.L("count").Desc()).
+			Limit(facetLimit)
+		*out, errs[i] = s.queryFacetBuckets(ctx, ds)
+	}
+
+	wg.Add(4)
+	go facetQuery(0, resourceAttribute("service.name"), &facets.Services)
+	go facetQuery(1, goqu.C("name"), &facets.Names)
+	go facetQuery(2, goqu.L("if(has(events.name, 'exception'), 'error', 'ok')"), &facets.Status)
+	go func() {
+		defer wg.Done()
+		pairs := s.DB.
+			From("denormalized_span").
+			Select(goqu.I("trace_id"), goqu.I("span_id"), goqu.L(
+				"arrayJoin(arrayConcat(arrayZip(span_attributes.key, span_attributes.value), arrayZip(resource_attributes.key, resource_attributes.value)))",
+			).As("kv")).
+			Where(conds...)
+		ds := s.DB.
+			From(pairs.As("pairs")).
+			Select(
+				goqu.L("tupleElement(kv, 1)").As("key"),
+				goqu.L("tupleElement(kv, 2)").As("value"),
+				goqu.L("uniqExact(trace_id, span_id)").As("count"),
+			).
+			Where(goqu.L("tupleElement(kv, 1) != 'service.name'")).
+			GroupBy(goqu.C("key"), goqu.C("value")).
+			Order(goqu.L("count").Desc()).
+			Limit(facetLimit * 2)
+
+		sqlStr, args, err := ds.ToSQL()
+		if err != nil {
+			errs[3] = err
+			return
+		}
+		rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+		if err != nil {
+			errs[3] = err
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var b AttributeFacetBucket
+			if err := rows.Scan(&b.Key, &b.Value, &b.Count); err != nil {
+				errs[3] = err
+				return
+			}
+			facets.Attributes = append(facets.Attributes, b)
+		}
+		errs[3] = rows.Err()
+	}()
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return facets, nil
+}
+
+func (s *TelemetryService) queryFacetBuckets(ctx context.Context, ds *goqu.SelectDataset) ([]FacetBucket, error) {
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []FacetBucket
+	for rows.Next() {
+		var b FacetBucket
+		if err := rows.Scan(&b.Value, &b.Count); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
 }
 
 type TimeCount struct {
-	Timestamp time.Time `json:"timestamp"`
-	Value     uint64    `json:"value"`
+	Timestamp utils.Timestamp `json:"timestamp"`
+	Value     uint64          `json:"value"`
+}
+
+// uniqueSpans is a subquery of columns of the spans matching where, each span once.
+// Inserts are deduplicated by batch, see collector.dedupToken, so a span retried in
+// a batch of other spans than the first time is stored twice.
+func uniqueSpans(columns, where string) string {
+	return fmt.Sprintf("(SELECT trace_id, span_id, %s FROM denormalized_span WHERE %s LIMIT 1 BY trace_id, span_id)", columns, where)
+}
+
+// GetTraceCounts returns the number of spans per interval in the date range
+func (s *TelemetryService) GetTraceCounts(ctx context.Context, dateRange DateRange) ([]TimeCount, error) {
+	key := fmt.Sprintf("trace_counts:%s", dateRangeKey(dateRange))
+	return cachedQuery(s, ctx, key, "trace_counts:"+windowKey(dateRange), func(ctx context.Context) ([]TimeCount, error) {
+		return s.getTraceCounts(ctx, dateRange)
+	})
 }
 
-func (s *TelemetryService) GetTraceCounts(
+func (s *TelemetryService) getTraceCounts(
 	ctx context.Context,
 	dateRange DateRange,
 ) ([]TimeCount, error) {
@@ -915,11 +1785,10 @@ func (s *TelemetryService) GetTraceCounts(
                 INTERVAL %s
             ) AS ts,
             count() AS cnt
-        FROM denormalized_span
-        WHERE %s
+        FROM %s
         GROUP BY ts
         ORDER BY ts ASC
-    `, intervalSQL, timeFilter)
+    `, intervalSQL, uniqueSpans("start_time_unix_nano", timeFilter))
 
 	rows, err := (*s.Ch).Query(ctx, query)
 	if err != nil {
@@ -950,7 +1819,7 @@ func (s *TelemetryService) GetTraceCounts(
 	var result []TimeCount
 	for ts := alignedStart; !ts.After(dateRange.End); ts = ts.Add(intervalDur) {
 		result = append(result, TimeCount{
-			Timestamp: ts,
+			Timestamp: utils.NewTimestamp(ts),
 			Value:     counts[ts],
 		})
 	}
@@ -959,6 +1828,18 @@ func (s *TelemetryService) GetTraceCounts(
 }
 
 func (s *TelemetryService) GetServiceMetrics(ctx context.Context, timeRange string, start, end *time.Time) ([]ServiceMetrics, error) {
+	key := "service_metrics:" + timeRange
+	lastKnownKey := key
+	if start != nil && end != nil {
+		key = fmt.Sprintf("service_metrics:%d:%d", start.Unix(), end.Unix())
+		lastKnownKey = "service_metrics:" + windowKey(DateRange{Start: *start, End: *end})
+	}
+	return cachedQuery(s, ctx, key, lastKnownKey, func(ctx context.Context) ([]ServiceMetrics, error) {
+		return s.getServiceMetrics(ctx, timeRange, start, end)
+	})
+}
+
+func (s *TelemetryService) getServiceMetrics(ctx context.Context, timeRange string, start, end *time.Time) ([]ServiceMetrics, error) {
 	var timeFilter string
 
 	if start != nil && end != nil {
@@ -983,10 +1864,13 @@ func (s *TelemetryService) GetServiceMetrics(ctx context.Context, timeRange stri
 	query := `
 		WITH durations AS (
 			SELECT 
+				trace_id,
+				span_id,
 				scope_name AS service,
 				(end_time_unix_nano - start_time_unix_nano) / 1000000 AS duration_ms
 			FROM denormalized_span
 			WHERE ` + timeFilter + `
+			LIMIT 1 BY trace_id, span_id
 		),
 		service_stats AS (
 			SELECT 
@@ -1024,6 +1908,13 @@ func (s *TelemetryService) GetServiceMetrics(ctx context.Context, timeRange stri
 }
 
 func (s *TelemetryService) GetEndpointMetrics(ctx context.Context, dateRange DateRange) ([]EndpointMetrics, error) {
+	key := fmt.Sprintf("endpoint_metrics:%s", dateRangeKey(dateRange))
+	return cachedQuery(s, ctx, key, "endpoint_metrics:"+windowKey(dateRange), func(ctx context.Context) ([]EndpointMetrics, error) {
+		return s.getEndpointMetrics(ctx, dateRange)
+	})
+}
+
+func (s *TelemetryService) getEndpointMetrics(ctx context.Context, dateRange DateRange) ([]EndpointMetrics, error) {
 	start := strconv.FormatInt(dateRange.Start.UnixNano(), 10)
 	end := strconv.FormatInt(dateRange.End.UnixNano(), 10)
 	timeFilter := fmt.Sprintf(
@@ -1044,7 +1935,10 @@ func (s *TelemetryService) GetEndpointMetrics(ctx context.Context, dateRange Dat
 			endpoint,
 			count(*) AS count,
 			avg(duration_ms) AS avg_duration_ms,
-			quantile(0.95)(duration_ms) AS p95_duration_ms
+			quantile(0.5)(duration_ms) AS p50_duration_ms,
+			quantile(0.9)(duration_ms) AS p90_duration_ms,
+			quantile(0.95)(duration_ms) AS p95_duration_ms,
+			quantile(0.99)(duration_ms) AS p99_duration_ms
 		FROM durations
 		GROUP BY endpoint
 		--ORDER BY duration_ms DESC
@@ -1059,13 +1953,25 @@ func (s *TelemetryService) GetEndpointMetrics(ctx context.Context, dateRange Dat
 	var metrics []EndpointMetrics
 	for rows.Next() {
 		var m EndpointMetrics
-		if err := rows.Scan(&m.Endpoint, &m.Count, &m.AvgDuration, &m.P95Duration); err != nil {
+		if err := rows.Scan(&m.Endpoint, &m.Count, &m.AvgDuration, &m.P50Duration, &m.P90Duration, &m.P95Duration, &m.P99Duration); err != nil {
 			return nil, err
 		}
 		metrics = append(metrics, m)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	return metrics, rows.Err()
+	targets, err := s.latencyTargets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range metrics {
+		metrics[i].Target = targets.Check("", m.Endpoint, map[int]float64{
+			50: m.P50Duration, 90: m.P90Duration, 95: m.P95Duration, 99: m.P99Duration,
+		})
+	}
+	return metrics, nil
 }
 
 func (s *TelemetryService) GetSlowestTraces(ctx context.Context, timeRange string) ([]SlowTrace, error) {
@@ -1122,7 +2028,15 @@ func (s *TelemetryService) GetSlowestTraces(ctx context.Context, timeRange strin
 	return traces, rows.Err()
 }
 
-func (s *TelemetryService) GetPercentileSeries(
+func (s *TelemetryService) GetPercentileSeries(ctx context.Context, dateRange DateRange, percentile int) ([]TimePercentile, error) {
+	key := fmt.Sprintf("percentile_series:%d:%s", percentile, dateRangeKey(dateRange))
+	lastKnownKey := fmt.Sprintf("percentile_series:%d:%s", percentile, windowKey(dateRange))
+	return cachedQuery(s, ctx, key, lastKnownKey, func(ctx context.Context) ([]TimePercentile, error) {
+		return s.getPercentileSeries(ctx, dateRange, percentile)
+	})
+}
+
+func (s *TelemetryService) getPercentileSeries(
 	ctx context.Context,
 	dateRange DateRange,
 	percentile int,
@@ -1153,12 +2067,11 @@ func (s *TelemetryService) GetPercentileSeries(
             quantile(%f)(
                 (end_time_unix_nano - start_time_unix_nano) / 1000000
             ) AS pvalue
-        FROM denormalized_span
-        WHERE start_time_unix_nano >= %d
-          AND end_time_unix_nano   <= %d
+        FROM %s
         GROUP BY ts
         ORDER BY ts
-    `, intervalSQL, q, startNs, endNs)
+    `, intervalSQL, q, uniqueSpans("start_time_unix_nano, end_time_unix_nano",
+		fmt.Sprintf("start_time_unix_nano >= %d AND end_time_unix_nano <= %d", startNs, endNs)))
 
 	rows, err := (*s.Ch).Query(ctx, query)
 	if err != nil {
@@ -1170,7 +2083,14 @@ func (s *TelemetryService) GetPercentileSeries(
 	return PadQueryResult(rows, intervalSQL, dateRange)
 }
 
-func (s *TelemetryService) GetAvgDuration(
+func (s *TelemetryService) GetAvgDuration(ctx context.Context, dateRange DateRange) ([]TimePercentile, error) {
+	key := fmt.Sprintf("avg_duration:%s", dateRangeKey(dateRange))
+	return cachedQuery(s, ctx, key, "avg_duration:"+windowKey(dateRange), func(ctx context.Context) ([]TimePercentile, error) {
+		return s.getAvgDuration(ctx, dateRange)
+	})
+}
+
+func (s *TelemetryService) getAvgDuration(
 	ctx context.Context,
 	dateRange DateRange,
 ) ([]TimePercentile, error) {
@@ -1190,12 +2110,11 @@ func (s *TelemetryService) GetAvgDuration(
                 INTERVAL %s
             ) AS ts,
             avg((end_time_unix_nano - start_time_unix_nano) / 1000000) AS pvalue
-        FROM denormalized_span
-        WHERE start_time_unix_nano >= %d
-          AND end_time_unix_nano   <= %d
+        FROM %s
         GROUP BY ts
         ORDER BY ts
-    `, intervalSQL, startNs, endNs)
+    `, intervalSQL, uniqueSpans("start_time_unix_nano, end_time_unix_nano",
+		fmt.Sprintf("start_time_unix_nano >= %d AND end_time_unix_nano <= %d", startNs, endNs)))
 
 	rows, err := (*s.Ch).Query(ctx, query)
 	if err != nil {
@@ -1230,14 +2149,21 @@ func (s *TelemetryService) GetAvgDuration(
 	var series []TimePercentile
 	for ts := aligned; !ts.After(dateRange.End); ts = ts.Add(step) {
 		series = append(series, TimePercentile{
-			Timestamp: ts,
+			Timestamp: utils.NewTimestamp(ts),
 			Value:     vals[ts], // zero if missing
 		})
 	}
 	return series, nil
 }
 
-func (s *TelemetryService) GetErrorCounts(
+func (s *TelemetryService) GetErrorCounts(ctx context.Context, dateRange DateRange) ([]TimeCount, error) {
+	key := fmt.Sprintf("error_counts:%s", dateRangeKey(dateRange))
+	return cachedQuery(s, ctx, key, "error_counts:"+windowKey(dateRange), func(ctx context.Context) ([]TimeCount, error) {
+		return s.getErrorCounts(ctx, dateRange)
+	})
+}
+
+func (s *TelemetryService) getErrorCounts(
 	ctx context.Context,
 	dateRange DateRange,
 ) ([]TimeCount, error) {
@@ -1252,12 +2178,12 @@ func (s *TelemetryService) GetErrorCounts(
 				fromUnixTimestamp64Nano(start_time_unix_nano),
 				INTERVAL %s
 			) AS ts,
-			countIf(has(events.name, 'exception')) AS cnt
-		FROM denormalized_span
-		WHERE start_time_unix_nano >= %d AND start_time_unix_nano <= %d
+			countIf(failed) AS cnt
+		FROM %s
 		GROUP BY ts
 		ORDER BY ts ASC
-	`, intervalSQL, startNano, endNano)
+	`, intervalSQL, uniqueSpans("start_time_unix_nano, has(events.name, 'exception') AS failed",
+		fmt.Sprintf("start_time_unix_nano >= %d AND start_time_unix_nano <= %d", startNano, endNano)))
 
 	rows, err := (*s.Ch).Query(ctx, query)
 	if err != nil {
@@ -1288,7 +2214,7 @@ func (s *TelemetryService) GetErrorCounts(
 	var result []TimeCount
 	for ts := alignedStart; !ts.After(dateRange.End); ts = ts.Add(intervalDur) {
 		result = append(result, TimeCount{
-			Timestamp: ts,
+			Timestamp: utils.NewTimestamp(ts),
 			Value:     counts[ts],
 		})
 	}
@@ -1333,6 +2259,7 @@ type CombinedMetricsResult struct {
 	PercentileResults  []TimePercentile
 	TraceCountResults  []TimePercentile
 	AvgDurationResults []TimePercentile
+	Meta               *ResponseMeta `json:"meta,omitempty"`
 }
 
 // getCombinedMetricsForQuery executes a single combined query that computes
@@ -1407,15 +2334,15 @@ func (s *TelemetryService) getCombinedMetricsForQuery(
 
 	for ts := alignedStart; !ts.After(dateRange.End); ts = ts.Add(intervalDur) {
 		percentileResult = append(percentileResult, TimePercentile{
-			Timestamp: ts,
+			Timestamp: utils.NewTimestamp(ts),
 			Value:     percentileMap[ts],
 		})
 		traceCountResult = append(traceCountResult, TimePercentile{
-			Timestamp: ts,
+			Timestamp: utils.NewTimestamp(ts),
 			Value:     traceCountMap[ts],
 		})
 		avgDurationResult = append(avgDurationResult, TimePercentile{
-			Timestamp: ts,
+			Timestamp: utils.NewTimestamp(ts),
 			Value:     avgDurationMap[ts],
 		})
 	}
@@ -1429,6 +2356,14 @@ func (s *TelemetryService) getCombinedMetricsForQuery(
 
 // GetSearchMetrics returns metrics (percentile, trace count, avg duration) for a search query
 func (s *TelemetryService) GetSearchMetrics(ctx context.Context, dateRange DateRange, query string, percentile int, traceOrSpan string) (*CombinedMetricsResult, error) {
+	key := fmt.Sprintf("search_metrics:%s:%d:%s:%q", dateRangeKey(dateRange), percentile, traceOrSpan, query)
+	lastKnownKey := fmt.Sprintf("search_metrics:%s:%d:%s:%q", windowKey(dateRange), percentile, traceOrSpan, query)
+	return cachedQuery(s, ctx, key, lastKnownKey, func(ctx context.Context) (*CombinedMetricsResult, error) {
+		return s.getSearchMetrics(ctx, dateRange, query, percentile, traceOrSpan)
+	})
+}
+
+func (s *TelemetryService) getSearchMetrics(ctx context.Context, dateRange DateRange, query string, percentile int, traceOrSpan string) (*CombinedMetricsResult, error) {
 	startNano := dateRange.Start.UnixNano()
 	endNano := dateRange.End.UnixNano()
 
@@ -1439,98 +2374,18 @@ func (s *TelemetryService) GetSearchMetrics(ctx context.Context, dateRange DateR
 		goqu.I("end_time_unix_nano").Lte(endNano),
 	}
 
-	if query != "" {
-		// Try to parse as attribute query first
-		if attrs := parseAttributeQuery(query); attrs != nil {
-			// Build AND conditions for each key=value or key!=value pair
-			var attrConds []goqu.Expression
-			for _, attr := range attrs {
-				// Handle special "name" key for span name matching
-				switch attr.Key {
-				case "name":
-					switch attr.Operator {
-					case "=":
-						attrConds = append(attrConds, goqu.I("name").Eq(attr.Value))
-					case "!=":
-						attrConds = append(attrConds, goqu.I("name").Neq(attr.Value))
-					}
-				case "scope":
-					// Handle special "scope" key for scope name matching
-					switch attr.Operator {
-					case "=":
-						attrConds = append(attrConds, goqu.I("scope_name").Eq(attr.Value))
-					case "!=":
-						attrConds = append(attrConds, goqu.I("scope_name").Neq(attr.Value))
-					}
-				default:
-					// Handle regular attribute searches
-					switch attr.Operator {
-					case "=":
-						// Equals: match spans that have this exact key=value pair
-						attrConds = append(attrConds, goqu.Or(
-							goqu.And(
-								goqu.L("has(resource_attributes.key, ?)", attr.Key),
-								goqu.L("has(resource_attributes.value, ?)", attr.Value),
-							),
-							goqu.And(
-								goqu.L("has(span_attributes.key, ?)", attr.Key),
-								goqu.L("has(span_attributes.value, ?)", attr.Value),
-							),
-						))
-					case "!=":
-						// Not equals: match spans that don't have the key=value pair in either resource or span attributes
-						attrConds = append(attrConds, goqu.And(
-							// Resource attributes: key doesn't exist OR (key exists AND value is different)
-							goqu.Or(
-								goqu.L("NOT has(resource_attributes.key, ?)", attr.Key),
-								goqu.And(
-									goqu.L("has(resource_attributes.key, ?)", attr.Key),
-									goqu.L("NOT has(resource_attributes.value, ?)", attr.Value),
-								),
-							),
-							// Span attributes: key doesn't exist OR (key exists AND value is different)
-							goqu.Or(
-								goqu.L("NOT has(span_attributes.key, ?)", attr.Key),
-								goqu.And(
-									goqu.L("has(span_attributes.key, ?)", attr.Key),
-									goqu.L("NOT has(span_attributes.value, ?)", attr.Value),
-								),
-							),
-						))
-					}
-				}
-			}
-			// All attribute conditions must match (AND)
-			conds = append(conds, goqu.And(attrConds...))
-		} else {
-			// Fallback to original broad search
-			conds = append(conds, goqu.Or(
-				goqu.I("name").Eq(query),
-				goqu.I("scope_name").Eq(query),
-				goqu.I("trace_id").Eq(query),
-				goqu.I("span_id").Eq(query),
-				goqu.L("has(resource_attributes.key, ?)", query),
-				goqu.L("has(resource_attributes.value, ?)", query),
-				goqu.L("has(span_attributes.key, ?)", query),
-				goqu.L("has(span_attributes.value, ?)", query),
-			))
-		}
-	}
-
-	// Add traceOrSpan filter
-	switch traceOrSpan {
-	case "trace":
-		conds = append(conds, goqu.I("parent_span_id").Eq(""))
-	case "span":
-		conds = append(conds, goqu.I("parent_span_id").Neq(""))
-	}
+	conds = append(conds, s.searchConditions(query, traceOrSpan)...)
 
 	ds := base.Select(
+		goqu.I("trace_id"),
+		goqu.I("span_id"),
 		goqu.I("start_time_unix_nano"),
 		goqu.I("end_time_unix_nano"),
 	).Where(conds...)
 
 	queryString, _, _ := ds.ToSQL()
+	// goqu has no LIMIT BY, see uniqueSpans
+	queryString += " LIMIT 1 BY trace_id, span_id"
 	intervalSQL := GetIntervalFromDateRange(dateRange)
 
 	return s.getCombinedMetricsForQuery(ctx, queryString, intervalSQL, dateRange, percentile)
@@ -1568,3 +2423,497 @@ func (s *TelemetryService) GetUniqueServiceNames(ctx context.Context) ([]string,
 
 	return services, nil
 }
+
+type AttributeKey struct {
+	Key    string `db:"key" json:"key"`
+	Source string `db:"source" json:"source"` // "resource" or "span"
+	Count  uint64 `db:"count" json:"count"`
+}
+
+// GetAttributeKeys returns the distinct resource and span attribute keys seen in the
+// given date range along with how many spans carry them, optionally filtered by prefix
+func (s *TelemetryService) GetAttributeKeys(ctx context.Context, dateRange DateRange, prefix string, limit uint) ([]AttributeKey, error) {
+	conds := []goqu.Expression{
+		goqu.I("start_time_unix_nano").Gte(dateRange.Start.UnixNano()),
+		goqu.I("start_time_unix_nano").Lte(dateRange.End.UnixNano()),
+	}
+
+	resourceKeys := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.L("arrayJoin(resource_attributes.key)").As("key"),
+			goqu.L("'resource'").As("source"),
+		).
+		Where(conds...)
+	spanKeys := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.L("arrayJoin(span_attributes.key)").As("key"),
+			goqu.L("'span'").As("source"),
+		).
+		Where(conds...)
+
+	ds := s.DB.
+		From(resourceKeys.UnionAll(spanKeys).As("keys")).
+		Select(
+			goqu.C("key"),
+			goqu.C("source"),
+			goqu.L("count()").As("count"),
+		).
+		GroupBy(goqu.C("key"), goqu.C("source")).
+		Order(goqu.L("count").Desc(), goqu.C("key").Asc()).
+		Limit(limit)
+	if prefix != "" {
+		ds = ds.Where(goqu.L("startsWith(key, ?)", prefix))
+	}
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []AttributeKey
+	for rows.Next() {
+		var k AttributeKey
+		if err := rows.Scan(&k.Key, &k.Source, &k.Count); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+type ServiceCatalogEntry struct {
+	Service      string          `json:"service"`
+	SpanCount    uint64          `json:"span_count"`
+	TraceCount   uint64          `json:"trace_count"`
+	LastSeen     utils.Timestamp `json:"last_seen"`
+	Versions     []string        `json:"versions"`
+	Environments []string        `json:"environments"`
+	RunbookURL   string          `json:"runbook_url,omitempty"`
+	DashboardURL string          `json:"dashboard_url,omitempty"`
+	Owner        *catalog.Owner  `json:"owner,omitempty"`
+}
+
+// resourceAttribute returns an expression selecting the value of a resource attribute
+// (empty string when the span doesn't have it)
+func resourceAttribute(key string) exp.LiteralExpression {
+	return goqu.L("resource_attributes.value[indexOf(resource_attributes.key, ?)]", key)
+}
+
+// GetServiceCatalog lists every service that reported spans in the date range with
+// its span count, when it was last seen and its most common version/environment values
+func (s *TelemetryService) GetServiceCatalog(ctx context.Context, dateRange DateRange, approx bool) ([]ServiceCatalogEntry, error) {
+	spans := s.DB.
+		From("denormalized_span").
+		Select(
+			resourceAttribute("service.name").As("service_name"),
+			goqu.C("service_version"),
+			resourceAttribute("deployment.environment").As("environment"),
+			goqu.C("trace_id"),
+			goqu.C("span_id"),
+			goqu.C("start_time_unix_nano"),
+		).
+		Where(
+			goqu.I("start_time_unix_nano").Gte(dateRange.Start.UnixNano()),
+			goqu.I("start_time_unix_nano").Lte(dateRange.End.UnixNano()),
+		)
+
+	ds := s.DB.
+		From(spans.As("spans")).
+		Select(
+			goqu.C("service_name"),
+			// each span once, see uniqueSpans
+			goqu.L(distinctCount(approx, "trace_id, span_id")).As("span_count"),
+			goqu.L(distinctCount(approx, "trace_id")).As("trace_count"),
+			goqu.L("fromUnixTimestamp64Nano(max(start_time_unix_nano))").As("last_seen"),
+			goqu.L("arrayFilter(v -> v != '', topK(3)(service_version))").As("versions"),
+			goqu.L("arrayFilter(v -> v != '', topK(3)(environment))").As("environments"),
+		).
+		Where(goqu.C("service_name").Neq("")).
+		GroupBy(goqu.C("service_name")).
+		Order(goqu.L("span_count").Desc())
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	if approx {
+		utils.MarkApproximate(ctx)
+	}
+
+	var services []ServiceCatalogEntry
+	for rows.Next() {
+		var e ServiceCatalogEntry
+		if err := rows.Scan(&e.Service, &e.SpanCount, &e.TraceCount, &e.LastSeen, &e.Versions, &e.Environments); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		services = append(services, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.Catalog != nil {
+		metadata, err := s.Catalog.MetadataByService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i := range services {
+			m := metadata[services[i].Service]
+			services[i].RunbookURL = m.RunbookURL
+			services[i].DashboardURL = m.DashboardURL
+			services[i].Owner = m.Owner
+		}
+	}
+	return services, nil
+}
+
+type ServiceHealth struct {
+	Service            string         `json:"service"`
+	Score              float64        `json:"score"` // 0 (needs attention) to 100 (healthy)
+	SpanCount          uint64         `json:"span_count"`
+	ErrorRate          float64        `json:"error_rate"`
+	P95Duration        float64        `json:"p95_duration_ms"`
+	BaselineP95        float64        `json:"baseline_p95_duration_ms"`
+	Throughput         float64        `json:"throughput"` // spans per second
+	BaselineThroughput float64        `json:"baseline_throughput"`
+	LatencyPenalty     float64        `json:"latency_penalty"`
+	ErrorPenalty       float64        `json:"error_penalty"`
+	ThroughputPenalty  float64        `json:"throughput_penalty"`
+	Owner              *catalog.Owner `json:"owner,omitempty"`
+}
+
+// Weights of the health score components, they add up to 1
+const (
+	healthLatencyWeight    = 0.4
+	healthErrorWeight      = 0.4
+	healthThroughputWeight = 0.2
+)
+
+// GetServiceHealth scores every service active in the date range by comparing it to
+// the baseline period immediately before it, lowest (least healthy) scores first
+func (s *TelemetryService) GetServiceHealth(ctx context.Context, dateRange DateRange, baseline time.Duration) ([]ServiceHealth, error) {
+	curStart := dateRange.Start.UnixNano()
+	baseStart := dateRange.Start.Add(-baseline).UnixNano()
+
+	ds := s.DB.
+		From("denormalized_span").
+		Select(
+			resourceAttribute("service.name").As("service_name"),
+			goqu.L("countIf(start_time_unix_nano >= ?)", curStart).As("cur_count"),
+			goqu.L("countIf(start_time_unix_nano < ?)", curStart).As("base_count"),
+			goqu.L("countIf(start_time_unix_nano >= ? AND has(events.name, 'exception'))", curStart).As("cur_errors"),
+			// quantileIf is NaN without matching spans, e.g. the baseline of a new service
+			goqu.L("ifNotFinite(quantileIf(0.95)(duration_ns / 1000000, start_time_unix_nano >= ?), 0)", curStart).As("cur_p95"),
+			goqu.L("ifNotFinite(quantileIf(0.95)(duration_ns / 1000000, start_time_unix_nano < ?), 0)", curStart).As("base_p95"),
+		).
+		Where(
+			goqu.I("start_time_unix_nano").Gte(baseStart),
+			goqu.I("start_time_unix_nano").Lte(dateRange.End.UnixNano()),
+		).
+		GroupBy(goqu.C("service_name")).
+		Having(goqu.And(
+			goqu.C("service_name").Neq(""),
+			goqu.C("cur_count").Gt(0),
+		))
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	curSeconds := max(dateRange.End.Sub(dateRange.Start).Seconds(), 1)
+	baseSeconds := max(baseline.Seconds(), 1)
+
+	var health []ServiceHealth
+	for rows.Next() {
+		var h ServiceHealth
+		var baseCount, curErrors uint64
+		if err := rows.Scan(&h.Service, &h.SpanCount, &baseCount, &curErrors, &h.P95Duration, &h.BaselineP95); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		h.ErrorRate = float64(curErrors) / float64(h.SpanCount)
+		h.Throughput = float64(h.SpanCount) / curSeconds
+		h.BaselineThroughput = float64(baseCount) / baseSeconds
+		scoreServiceHealth(&h)
+		health = append(health, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.Catalog != nil {
+		metadata, err := s.Catalog.MetadataByService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i := range health {
+			health[i].Owner = metadata[health[i].Service].Owner
+		}
+	}
+
+	sort.Slice(health, func(i, j int) bool { return health[i].Score < health[j].Score })
+	return health, nil
+}
+
+// scoreServiceHealth fills in the penalties and the composite score. Each penalty is
+// in [0, 1]: latency is fully penalized at 2x the baseline p95, errors at a 10% error
+// rate and throughput when it moves 4x up or down from the baseline.
+func scoreServiceHealth(h *ServiceHealth) {
+	if h.BaselineP95 > 0 {
+		h.LatencyPenalty = clamp01(h.P95Duration/h.BaselineP95 - 1)
+	}
+	h.ErrorPenalty = clamp01(h.ErrorRate / 0.1)
+	if h.BaselineThroughput > 0 && h.Throughput > 0 {
+		h.ThroughputPenalty = clamp01(math.Abs(math.Log2(h.Throughput/h.BaselineThroughput)) / 2)
+	}
+
+	penalty := healthLatencyWeight*h.LatencyPenalty +
+		healthErrorWeight*h.ErrorPenalty +
+		healthThroughputWeight*h.ThroughputPenalty
+	h.Score = math.Round((1-penalty)*1000) / 10
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+type QueueWaitSeries struct {
+	Topic       string           `json:"topic"`
+	Count       uint64           `json:"count"`
+	AvgWait     []TimePercentile `json:"avg_wait_ms"`
+	P95Wait     []TimePercentile `json:"p95_wait_ms"`
+	MessageRate []TimePercentile `json:"messages"`
+}
+
+// queueWaitLookback bounds how long before the window a producer span may have ended
+const queueWaitLookback = time.Hour
+
+// GetQueueWaitSeries computes, per queue/topic, how long messages waited between the
+// producer span ending and the linked consumer span starting
+func (s *TelemetryService) GetQueueWaitSeries(ctx context.Context, dateRange DateRange, topic string) ([]QueueWaitSeries, error) {
+	startNs := dateRange.Start.UnixNano()
+	endNs := dateRange.End.UnixNano()
+	if endNs <= startNs {
+		return nil, fmt.Errorf("invalid date range")
+	}
+	intervalSQL := GetIntervalFromDateRange(dateRange)
+
+	topicExpr := "if(span_attributes.value[indexOf(span_attributes.key, 'messaging.destination.name')] != '', " +
+		"span_attributes.value[indexOf(span_attributes.key, 'messaging.destination.name')], " +
+		"span_attributes.value[indexOf(span_attributes.key, 'messaging.destination')])"
+
+	consumers := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.L(topicExpr).As("topic"),
+			goqu.C("start_time_unix_nano").As("consumer_start"),
+			goqu.L("arrayJoin(arrayZip(links.trace_id, links.span_id))").As("link"),
+		).
+		Where(
+			goqu.C("kind").Eq("consumer"),
+			goqu.C("start_time_unix_nano").Gte(startNs),
+			goqu.C("start_time_unix_nano").Lte(endNs),
+			goqu.L("notEmpty(links.span_id)"),
+		)
+	producers := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("trace_id"),
+			goqu.C("span_id"),
+			goqu.C("end_time_unix_nano").As("producer_end"),
+		).
+		Where(
+			goqu.C("kind").Eq("producer"),
+			goqu.C("start_time_unix_nano").Gte(dateRange.Start.Add(-queueWaitLookback).UnixNano()),
+			goqu.C("start_time_unix_nano").Lte(endNs),
+		)
+
+	ds := s.DB.
+		From(consumers.As("c")).
+		Join(producers.As("p"), goqu.On(
+			goqu.L("tupleElement(c.link, 1)").Eq(goqu.I("p.trace_id")),
+			goqu.L("tupleElement(c.link, 2)").Eq(goqu.I("p.span_id")),
+		)).
+		Select(
+			goqu.L("toStartOfInterval(fromUnixTimestamp64Nano(c.consumer_start), INTERVAL "+intervalSQL+")").As("ts"),
+			goqu.I("c.topic").As("topic"),
+			goqu.L("avg(greatest(c.consumer_start - p.producer_end, 0) / 1000000)").As("avg_wait"),
+			goqu.L("quantile(0.95)(greatest(c.consumer_start - p.producer_end, 0) / 1000000)").As("p95_wait"),
+			goqu.L("count()").As("cnt"),
+		).
+		GroupBy(goqu.C("ts"), goqu.C("topic")).
+		Order(goqu.C("ts").Asc())
+	if topic != "" {
+		ds = ds.Where(goqu.I("c.topic").Eq(topic))
+	}
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	type topicValues struct {
+		count uint64
+		avg   map[time.Time]float64
+		p95   map[time.Time]float64
+		rate  map[time.Time]float64
+	}
+	byTopic := make(map[string]*topicValues)
+	var topics []string
+	for rows.Next() {
+		var ts time.Time
+		var t string
+		var avgWait, p95Wait float64
+		var cnt uint64
+		if err := rows.Scan(&ts, &t, &avgWait, &p95Wait, &cnt); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		v, ok := byTopic[t]
+		if !ok {
+			v = &topicValues{
+				avg:  make(map[time.Time]float64),
+				p95:  make(map[time.Time]float64),
+				rate: make(map[time.Time]float64),
+			}
+			byTopic[t] = v
+			topics = append(topics, t)
+		}
+		v.count += cnt
+		v.avg[ts] = avgWait
+		v.p95[ts] = p95Wait
+		v.rate[ts] = float64(cnt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(topics)
+	var series []QueueWaitSeries
+	for _, t := range topics {
+		v := byTopic[t]
+		qs := QueueWaitSeries{Topic: t, Count: v.count}
+		if qs.AvgWait, err = utils.PadSeries(v.avg, intervalSQL, dateRange); err != nil {
+			return nil, err
+		}
+		if qs.P95Wait, err = utils.PadSeries(v.p95, intervalSQL, dateRange); err != nil {
+			return nil, err
+		}
+		if qs.MessageRate, err = utils.PadSeries(v.rate, intervalSQL, dateRange); err != nil {
+			return nil, err
+		}
+		series = append(series, qs)
+	}
+	return series, nil
+}
+
+// querySpanNodes runs ds, which must select trace_id, span_id, parent_span_id, name,
+// scope_name, start_time_unix_nano and end_time_unix_nano, and returns the spans
+func (s *TelemetryService) querySpanNodes(ctx context.Context, ds *goqu.SelectDataset) ([]*spanNode, error) {
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var spans []*spanNode
+	seen := make(map[string]bool)
+	for rows.Next() {
+		n := &spanNode{}
+		if err := rows.Scan(&n.TraceID, &n.SpanID, &n.ParentSpanID, &n.Name, &n.Service, &n.Start, &n.End); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		// a span stored twice by a retried export is only counted once
+		if key := n.TraceID + "/" + n.SpanID; !seen[key] {
+			seen[key] = true
+			spans = append(spans, n)
+		}
+	}
+	return spans, rows.Err()
+}
+
+var spanNodeColumns = []any{
+	goqu.C("trace_id"),
+	goqu.C("span_id"),
+	goqu.C("parent_span_id"),
+	goqu.C("name"),
+	goqu.C("scope_name"),
+	goqu.C("start_time_unix_nano"),
+	goqu.C("end_time_unix_nano"),
+}
+
+// GetTraceFlamegraph folds the span tree of a trace into a flamegraph
+func (s *TelemetryService) GetTraceFlamegraph(ctx context.Context, traceID string) (*FlameNode, error) {
+	ds := s.DB.
+		From("denormalized_span").
+		Select(spanNodeColumns...).
+		Where(goqu.C("trace_id").Eq(traceID))
+
+	spans, err := s.querySpanNodes(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+	if len(spans) == 0 {
+		return nil, ErrTraceNotFound
+	}
+	return foldFlamegraph(buildSpanTree(spans)), nil
+}
+
+// GetAggregatedFlamegraph folds the span trees of up to limit traces with spans
+// matching the search query into a single flamegraph. Only spans in the date
+// range are included.
+func (s *TelemetryService) GetAggregatedFlamegraph(ctx context.Context, dateRange DateRange, query string, limit uint) (*FlameNode, error) {
+	timeConds := []goqu.Expression{
+		goqu.I("start_time_unix_nano").Gte(dateRange.Start.UnixNano()),
+		goqu.I("start_time_unix_nano").Lte(dateRange.End.UnixNano()),
+	}
+
+	traceIDs := s.DB.
+		From("denormalized_span").
+		Select(goqu.C("trace_id")).
+		Distinct().
+		Where(append(timeConds, s.searchConditions(query, "")...)...).
+		Limit(limit)
+
+	ds := s.DB.
+		From("denormalized_span").
+		Select(spanNodeColumns...).
+		Where(append(timeConds, goqu.C("trace_id").In(traceIDs))...)
+
+	spans, err := s.querySpanNodes(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+	return foldFlamegraph(buildSpanTree(spans)), nil
+}
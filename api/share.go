@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"nabatshy/auth"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TraceShare is a minted link to a shared trace
+type TraceShare struct {
+	Token string `json:"token"`
+	// Path is the API route returning the trace, relative to the API's address
+	Path      string    `json:"path"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// shareTrace mints a link to a trace the user sees, valid for the ttl parameter
+func (c *TelemetryController) shareTrace(w http.ResponseWriter, r *http.Request) {
+	if c.shares == nil {
+		http.Error(w, "trace sharing isn't enabled", http.StatusNotImplemented)
+		return
+	}
+	traceID, err := url.QueryUnescape(chi.URLParam(r, "trace_id"))
+	if err != nil {
+		http.Error(w, "invalid trace_id", http.StatusBadRequest)
+		return
+	}
+	ttl, err := auth.ParseShareTTL(r.URL.Query().Get("ttl"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// only traces the user can see are shared
+	if _, err := c.service.GetTraceDetails(r.Context(), traceID); errors.Is(err, ErrTraceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to fetch trace details: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, share, err := c.shares.Sign(traceID, auth.UserFromContext(r.Context()), ttl, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to sign share token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(TraceShare{Token: token, Path: "/v1/shared/" + token, ExpiresAt: share.ExpiresAt})
+}
+
+// getSharedTrace returns the trace of a share token without logging in, with the
+// spans the user who shared it could see
+func (c *TelemetryController) getSharedTrace(w http.ResponseWriter, r *http.Request) {
+	if c.shares == nil {
+		http.Error(w, "trace sharing isn't enabled", http.StatusNotImplemented)
+		return
+	}
+	share, err := c.shares.Verify(chi.URLParam(r, "token"), time.Now())
+	if errors.Is(err, auth.ErrShareExpired) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, "shared trace not found", http.StatusNotFound)
+		return
+	}
+
+	// the link reads as a viewer seeing what the user who shared it saw
+	ctx := auth.Scope(r.Context(), &auth.User{
+		Role:           auth.RoleViewer,
+		Services:       share.Services,
+		HiddenServices: share.HiddenServices,
+	})
+	spans, err := c.service.GetTraceDetails(ctx, share.TraceID)
+	if errors.Is(err, ErrTraceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to fetch trace details: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, r, spans)
+}
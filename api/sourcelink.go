@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"nabatshy/utils"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// SourceLink points at the code that produced a span
+type SourceLink struct {
+	FilePath string `json:"filepath"`
+	LineNo   string `json:"lineno,omitempty"`
+	Function string `json:"function,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// sourceLink builds a SourceLink from the code.* attributes of a span, it returns nil
+// when the span has no file path. The URL is built from the template by replacing
+// {filepath}, {lineno}, {function}, {service} and {version}, e.g.
+//
+//	https://github.com/org/{service}/blob/{version}/{filepath}#L{lineno}
+//	https://gitlab.com/org/{service}/-/blob/{version}/{filepath}#L{lineno}
+//
+// No URL is set when the template is empty.
+func sourceLink(template string, spanAttrs, resourceAttrs map[string]string) *SourceLink {
+	// code.file.path and friends replaced code.filepath in newer semantic conventions
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := spanAttrs[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	link := &SourceLink{
+		FilePath: first("code.filepath", "code.file.path"),
+		LineNo:   first("code.lineno", "code.line.number"),
+		Function: first("code.function", "code.function.name"),
+	}
+	if link.FilePath == "" {
+		return nil
+	}
+	if template == "" {
+		return link
+	}
+
+	version := resourceAttrs["service.version"]
+	if version == "" {
+		version = "HEAD"
+	}
+	link.URL = strings.NewReplacer(
+		"{filepath}", strings.TrimPrefix(link.FilePath, "/"),
+		"{lineno}", link.LineNo,
+		"{function}", url.PathEscape(link.Function),
+		"{service}", url.PathEscape(resourceAttrs["service.name"]),
+		"{version}", url.PathEscape(version),
+	).Replace(template)
+	return link
+}
+
+// GetSourceLink returns a deep link to the code that produced a span
+func (s *TelemetryService) GetSourceLink(ctx context.Context, spanID string) (*SourceLink, error) {
+	ds := s.DB.
+		From(goqu.T("denormalized_span")).
+		Select(
+			goqu.I("resource_attributes.key"),
+			goqu.I("resource_attributes.value"),
+			goqu.I("span_attributes.key"),
+			goqu.I("span_attributes.value"),
+			goqu.I("attributes_json"),
+		).
+		Where(goqu.I("span_id").Eq(spanID)).
+		Limit(1)
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	var resourceKeys, resourceValues, spanKeys, spanValues []string
+	var attrsJSON string
+	if err := (*s.Ch).QueryRow(ctx, sqlStr, args...).Scan(&resourceKeys, &resourceValues, &spanKeys, &spanValues, &attrsJSON); err != nil {
+		return nil, fmt.Errorf("span not found: %s", spanID)
+	}
+
+	resourceAttrs, spanAttrs := zipAttributes(resourceKeys, resourceValues), zipAttributes(spanKeys, spanValues)
+	utils.MergeAttributesJSON(attrsJSON, resourceAttrs, spanAttrs)
+	link := sourceLink(s.SourceLinkTemplate, spanAttrs, resourceAttrs)
+	if link == nil {
+		return nil, fmt.Errorf("span %s has no code attributes", spanID)
+	}
+	return link, nil
+}
+
+func zipAttributes(keys, values []string) map[string]string {
+	attrs := make(map[string]string, len(keys))
+	for i := range keys {
+		if i < len(values) {
+			attrs[keys[i]] = values[i]
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"sort"
+)
+
+// spanNode is a span in a trace tree
+type spanNode struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Service      string
+	Start        int64
+	End          int64
+	children     []*spanNode
+	depth        int
+}
+
+// buildSpanTree links spans to their parents and returns the roots, spans whose
+// parent isn't in the list are treated as roots. Children are ordered by start time.
+func buildSpanTree(spans []*spanNode) []*spanNode {
+	byID := make(map[string]*spanNode, len(spans))
+	for _, s := range spans {
+		byID[s.TraceID+"/"+s.SpanID] = s
+	}
+
+	var roots []*spanNode
+	for _, s := range spans {
+		parent, ok := byID[s.TraceID+"/"+s.ParentSpanID]
+		if s.ParentSpanID == "" || !ok || parent == s {
+			roots = append(roots, s)
+			continue
+		}
+		parent.children = append(parent.children, s)
+	}
+
+	var walk func(n *spanNode, depth int)
+	walk = func(n *spanNode, depth int) {
+		n.depth = depth
+		sort.Slice(n.children, func(i, j int) bool { return n.children[i].Start < n.children[j].Start })
+		for _, c := range n.children {
+			walk(c, depth+1)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Start < roots[j].Start })
+	for _, r := range roots {
+		walk(r, 0)
+	}
+	return roots
+}
+
+// selfTime is the part of the span's duration not covered by any of its children,
+// overlapping children are only counted once
+func selfTime(n *spanNode) int64 {
+	duration := n.End - n.Start
+	if duration <= 0 {
+		return 0
+	}
+
+	var covered int64
+	curStart, curEnd := int64(0), int64(0)
+	open := false
+	// children are sorted by start time, merge their intervals clipped to the parent
+	for _, c := range n.children {
+		start, end := max(c.Start, n.Start), min(c.End, n.End)
+		if end <= start {
+			continue
+		}
+		if open && start <= curEnd {
+			curEnd = max(curEnd, end)
+			continue
+		}
+		if open {
+			covered += curEnd - curStart
+		}
+		curStart, curEnd, open = start, end, true
+	}
+	if open {
+		covered += curEnd - curStart
+	}
+	return duration - covered
+}
+
+// FlameNode is a node of a flamegraph, spans with the same service and name under
+// the same parent are folded into a single node
+type FlameNode struct {
+	Name     string       `json:"name"`
+	Service  string       `json:"service"`
+	Value    int64        `json:"value"` // self time in nanoseconds
+	Total    int64        `json:"total"` // self time of the node and all its descendants
+	Count    int          `json:"count"` // number of spans folded into the node
+	Children []*FlameNode `json:"children"`
+}
+
+// foldFlamegraph folds span trees into a flamegraph under a synthetic root
+func foldFlamegraph(roots []*spanNode) *FlameNode {
+	root := &FlameNode{Name: "all", Children: []*FlameNode{}}
+
+	var fold func(parent *FlameNode, n *spanNode)
+	fold = func(parent *FlameNode, n *spanNode) {
+		var node *FlameNode
+		for _, c := range parent.Children {
+			if c.Name == n.Name && c.Service == n.Service {
+				node = c
+				break
+			}
+		}
+		if node == nil {
+			node = &FlameNode{Name: n.Name, Service: n.Service, Children: []*FlameNode{}}
+			parent.Children = append(parent.Children, node)
+		}
+		node.Value += selfTime(n)
+		node.Count++
+		for _, c := range n.children {
+			fold(node, c)
+		}
+	}
+	for _, r := range roots {
+		fold(root, r)
+	}
+
+	var total func(n *FlameNode) int64
+	total = func(n *FlameNode) int64 {
+		n.Total = n.Value
+		for _, c := range n.Children {
+			n.Total += total(c)
+		}
+		sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Total > n.Children[j].Total })
+		return n.Total
+	}
+	total(root)
+	return root
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"nabatshy/utils"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+)
+
+// AttributeValueCount is how many spans of a bucket had an attribute value
+type AttributeValueCount struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+// AttributeTopKBucket holds the most common values of an attribute in a time bucket.
+// Other counts the spans with any other value so stacked charts add up to the total.
+type AttributeTopKBucket struct {
+	Timestamp utils.Timestamp       `json:"timestamp"`
+	Values    []AttributeValueCount `json:"values"`
+	Other     uint64                `json:"other"`
+}
+
+// attributeValue returns an expression selecting the value of an attribute, span
+// attributes first, then resource attributes (empty string when the span has neither)
+func (s *TelemetryService) attributeValue(key string) exp.Expression {
+	if promoted, ok := utils.FindPromotedAttribute(s.Promoted, key); ok {
+		return goqu.I(promoted.Column)
+	}
+	value := goqu.L(
+		"if(has(span_attributes.key, ?), span_attributes.value[indexOf(span_attributes.key, ?)], resource_attributes.value[indexOf(resource_attributes.key, ?)])",
+		key, key, key,
+	)
+	if !s.JSONAttributes {
+		return value
+	}
+	return goqu.L(
+		"if(? != '', ?, if(JSONHas(attributes_json, 'span', ?), JSONExtractString(attributes_json, 'span', ?), JSONExtractString(attributes_json, 'resource', ?)))",
+		value, value, key, key, key,
+	)
+}
+
+// GetAttributeTopK returns the k most common values of an attribute per time bucket
+// among the spans matching query. The values of a bucket are picked with topK, which
+// is approximate for high cardinality attributes, and then counted exactly.
+func (s *TelemetryService) GetAttributeTopK(ctx context.Context, dateRange DateRange, key, query string, k uint) ([]AttributeTopKBucket, error) {
+	intervalSQL := GetIntervalFromDateRange(dateRange)
+	conds := s.searchSpanConditions(dateRange, query, "")
+	spans := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.L("toStartOfInterval(fromUnixTimestamp64Nano(start_time_unix_nano), INTERVAL "+intervalSQL+")").As("ts"),
+			goqu.L("?", s.attributeValue(key)).As("value"),
+		).
+		Where(conds...)
+	spans = s.DB.From(spans.As("spans")).Where(goqu.C("value").Neq(""))
+
+	top := spans.
+		Select(goqu.C("ts"), goqu.L("arrayJoin(topK(?)(value))", k)).
+		GroupBy(goqu.C("ts"))
+	// values outside the top k of their bucket are grouped under ''
+	ds := spans.
+		Select(
+			goqu.C("ts"),
+			goqu.L("if((ts, value) IN ?, value, '')", top).As("top_value"),
+			goqu.L("count()").As("count"),
+		).
+		GroupBy(goqu.C("ts"), goqu.C("top_value")).
+		Order(goqu.C("ts").Asc(), goqu.C("count").Desc())
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	buckets := make(map[time.Time]*AttributeTopKBucket)
+	for rows.Next() {
+		var ts time.Time
+		var v AttributeValueCount
+		if err := rows.Scan(&ts, &v.Value, &v.Count); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		b, ok := buckets[ts]
+		if !ok {
+			b = &AttributeTopKBucket{Values: []AttributeValueCount{}}
+			buckets[ts] = b
+		}
+		if v.Value == "" {
+			b.Other = v.Count
+			continue
+		}
+		b.Values = append(b.Values, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	step, err := ParseInterval(intervalSQL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval: %w", err)
+	}
+	// every bucket of the range is returned so charts don't skip empty ones
+	var result []AttributeTopKBucket
+	for ts := AlignToInterval(dateRange.Start, step); !ts.After(dateRange.End); ts = ts.Add(step) {
+		b := AttributeTopKBucket{Values: []AttributeValueCount{}}
+		if found, ok := buckets[ts]; ok {
+			b = *found
+		}
+		b.Timestamp = utils.NewTimestamp(ts)
+		result = append(result, b)
+	}
+	return result, nil
+}
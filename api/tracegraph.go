@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// Trace graph edge types
+const (
+	EdgeChild = "child"
+	EdgeLink  = "link"
+)
+
+// TraceGraph is the structure of a trace, its spans and how they relate. Broken
+// traces are laid out as a forest: spans whose parent is missing are orphans and
+// roots of their own subtree.
+type TraceGraph struct {
+	TraceID string      `json:"trace_id"`
+	Nodes   []GraphNode `json:"nodes"`
+	Edges   []GraphEdge `json:"edges"`
+	// Roots are the spans without a parent, orphans included
+	Roots   []string `json:"roots"`
+	Orphans []string `json:"orphans"`
+	// Complete is set when the trace has a single root and no orphans
+	Complete bool `json:"complete"`
+}
+
+type GraphNode struct {
+	SpanID       string  `json:"span_id"`
+	ParentSpanID string  `json:"parent_span_id,omitempty"`
+	Name         string  `json:"name"`
+	Service      string  `json:"service"`
+	Kind         string  `json:"kind,omitempty"`
+	StartTime    int64   `json:"start_time_unix_nano"`
+	DurationMs   float64 `json:"duration_ms"`
+	HasError     bool    `json:"has_error"`
+	Depth        int     `json:"depth"`
+	// Orphan is set when the span has a parent that isn't in the trace, it may not
+	// have been sent, been sampled out or not have arrived yet
+	Orphan bool `json:"orphan"`
+}
+
+// GraphEdge goes from a parent to its child, or from a span to the span it links
+// to. Links to spans of other traces have the linked TraceID and External set.
+type GraphEdge struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Type     string `json:"type"`
+	TraceID  string `json:"trace_id,omitempty"`
+	External bool   `json:"external,omitempty"`
+}
+
+// GetTraceGraph returns the nodes and edges of a trace
+func (s *TelemetryService) GetTraceGraph(ctx context.Context, traceID string) (TraceGraph, error) {
+	ds := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("span_id"),
+			goqu.C("parent_span_id"),
+			goqu.C("name"),
+			goqu.C("scope_name"),
+			goqu.C("kind"),
+			goqu.C("start_time_unix_nano"),
+			goqu.L("duration_ns / 1e6"),
+			goqu.L("has(events.name, 'exception')"),
+			goqu.C("links.trace_id"),
+			goqu.C("links.span_id"),
+		).
+		Where(goqu.C("trace_id").Eq(traceID)).
+		Order(goqu.C("start_time_unix_nano").Asc(), goqu.C("span_id").Asc())
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return TraceGraph{}, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return TraceGraph{}, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var nodes []GraphNode
+	var links []GraphEdge
+	for rows.Next() {
+		var n GraphNode
+		var linkTraceIDs, linkSpanIDs []string
+		if err := rows.Scan(&n.SpanID, &n.ParentSpanID, &n.Name, &n.Service, &n.Kind, &n.StartTime, &n.DurationMs, &n.HasError, &linkTraceIDs, &linkSpanIDs); err != nil {
+			return TraceGraph{}, fmt.Errorf("scan error: %w", err)
+		}
+		for i := range min(len(linkTraceIDs), len(linkSpanIDs)) {
+			links = append(links, GraphEdge{From: n.SpanID, To: linkSpanIDs[i], Type: EdgeLink, TraceID: linkTraceIDs[i]})
+		}
+		nodes = append(nodes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return TraceGraph{}, fmt.Errorf("rows error: %w", err)
+	}
+	if len(nodes) == 0 {
+		return TraceGraph{}, ErrTraceNotFound
+	}
+	return buildTraceGraph(traceID, nodes, links), nil
+}
+
+// buildTraceGraph links the nodes to their parents, flags the orphans and computes
+// the depth of every node
+func buildTraceGraph(traceID string, nodes []GraphNode, links []GraphEdge) TraceGraph {
+	g := TraceGraph{TraceID: traceID, Nodes: nodes, Edges: []GraphEdge{}, Roots: []string{}, Orphans: []string{}}
+	index := make(map[string]int, len(nodes))
+	for i, n := range nodes {
+		index[n.SpanID] = i
+	}
+
+	children := make(map[string][]string)
+	for i := range g.Nodes {
+		n := &g.Nodes[i]
+		if _, ok := index[n.ParentSpanID]; n.ParentSpanID == "" || n.ParentSpanID == n.SpanID || !ok {
+			n.Orphan = n.ParentSpanID != "" && n.ParentSpanID != n.SpanID
+			if n.Orphan {
+				g.Orphans = append(g.Orphans, n.SpanID)
+			}
+			g.Roots = append(g.Roots, n.SpanID)
+			continue
+		}
+		children[n.ParentSpanID] = append(children[n.ParentSpanID], n.SpanID)
+		g.Edges = append(g.Edges, GraphEdge{From: n.ParentSpanID, To: n.SpanID, Type: EdgeChild})
+	}
+	for _, l := range links {
+		_, inTrace := index[l.To]
+		l.External = l.TraceID != traceID || !inTrace
+		if !l.External {
+			l.TraceID = ""
+		}
+		g.Edges = append(g.Edges, l)
+	}
+
+	// depths are walked from the roots, spans in a parent cycle are never reached
+	// and stay at 0
+	var walk func(spanID string, depth int)
+	seen := make(map[string]bool, len(nodes))
+	walk = func(spanID string, depth int) {
+		if seen[spanID] {
+			return
+		}
+		seen[spanID] = true
+		g.Nodes[index[spanID]].Depth = depth
+		for _, c := range children[spanID] {
+			walk(c, depth+1)
+		}
+	}
+	for _, r := range g.Roots {
+		walk(r, 0)
+	}
+	sort.Strings(g.Orphans)
+	g.Complete = len(g.Roots) == 1 && len(g.Orphans) == 0
+	return g
+}
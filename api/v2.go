@@ -0,0 +1,504 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"nabatshy/catalog"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The /v2 routes have a stable contract for integrators, /v1 keeps serving the UI
+// and may change with it. In /v2:
+//   - fields are camelCase
+//   - times are RFC 3339 strings in UTC with nanoseconds, or what the ts_format query
+//     parameter asks for, durations are float milliseconds in fields ending with Ms
+//   - responses are {"data": ..., "meta": {...}}, lists are never null
+//   - errors are {"error": {"status": 400, "message": "..."}}
+//
+// Fields are only ever added to /v2 responses, see docs/api-v2.md.
+
+// V2Meta describes the data behind a /v2 response
+type V2Meta struct {
+	Start    *utils.Timestamp `json:"start,omitempty"`
+	End      *utils.Timestamp `json:"end,omitempty"`
+	Count    int              `json:"count"`
+	Total    *uint64          `json:"total,omitempty"`
+	Page     int              `json:"page,omitempty"`
+	PageSize int              `json:"pageSize,omitempty"`
+
+	SpansScanned  uint64           `json:"spansScanned"`
+	BytesScanned  uint64           `json:"bytesScanned"`
+	Sampled       bool             `json:"sampled"`
+	Approximate   bool             `json:"approximate"`
+	DataFreshness *utils.Timestamp `json:"dataFreshness,omitempty"`
+	Stale         bool             `json:"stale"`
+	StaleAsOf     *utils.Timestamp `json:"staleAsOf,omitempty"`
+}
+
+type V2Response[T any] struct {
+	Data T      `json:"data"`
+	Meta V2Meta `json:"meta"`
+}
+
+type V2Error struct {
+	Error V2ErrorDetail `json:"error"`
+}
+
+type V2ErrorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type V2Event struct {
+	Time       utils.Timestamp   `json:"time"`
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type V2SearchResult struct {
+	TraceID            string            `json:"traceId"`
+	SpanID             string            `json:"spanId"`
+	Name               string            `json:"name"`
+	Service            string            `json:"service"`
+	StartTime          utils.Timestamp   `json:"startTime"`
+	EndTime            utils.Timestamp   `json:"endTime"`
+	DurationMs         float64           `json:"durationMs"`
+	HasError           bool              `json:"hasError"`
+	ResourceAttributes map[string]string `json:"resourceAttributes"`
+	Relevance          uint8             `json:"relevance,omitempty"`
+}
+
+type V2TraceSpan struct {
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId"`
+	Name         string          `json:"name"`
+	Service      string          `json:"service"`
+	StartTime    utils.Timestamp `json:"startTime"`
+	EndTime      utils.Timestamp `json:"endTime"`
+	DurationMs   float64         `json:"durationMs"`
+	SelfTimeMs   float64         `json:"selfTimeMs"`
+	Depth        int             `json:"depth"`
+	ChildCount   int             `json:"childCount"`
+	Events       []V2Event       `json:"events"`
+}
+
+type V2Trace struct {
+	TraceID string        `json:"traceId"`
+	Spans   []V2TraceSpan `json:"spans"`
+}
+
+// V2LatencyStats are the durations of other spans with the same name and service
+type V2LatencyStats struct {
+	AvgMs       float64 `json:"avgMs"`
+	P50Ms       float64 `json:"p50Ms"`
+	P90Ms       float64 `json:"p90Ms"`
+	P99Ms       float64 `json:"p99Ms"`
+	DiffPercent float64 `json:"diffPercent"`
+}
+
+type V2Span struct {
+	SpanID             string            `json:"spanId"`
+	TraceID            string            `json:"traceId"`
+	ParentSpanID       string            `json:"parentSpanId"`
+	Name               string            `json:"name"`
+	Service            string            `json:"service"`
+	StartTime          utils.Timestamp   `json:"startTime"`
+	EndTime            utils.Timestamp   `json:"endTime"`
+	DurationMs         float64           `json:"durationMs"`
+	Stats              V2LatencyStats    `json:"stats"`
+	ResourceAttributes map[string]string `json:"resourceAttributes"`
+	SpanAttributes     map[string]string `json:"spanAttributes"`
+	Events             []V2Event         `json:"events"`
+	SourceLink         *V2SourceLink     `json:"sourceLink,omitempty"`
+}
+
+type V2SourceLink struct {
+	FilePath string `json:"filePath"`
+	LineNo   string `json:"lineNo,omitempty"`
+	Function string `json:"function,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+type V2Owner struct {
+	Team         string `json:"team"`
+	SlackChannel string `json:"slackChannel,omitempty"`
+	Escalation   string `json:"escalation,omitempty"`
+}
+
+type V2Service struct {
+	Name         string          `json:"name"`
+	SpanCount    uint64          `json:"spanCount"`
+	TraceCount   uint64          `json:"traceCount"`
+	LastSeen     utils.Timestamp `json:"lastSeen"`
+	Versions     []string        `json:"versions"`
+	Environments []string        `json:"environments"`
+	RunbookURL   string          `json:"runbookUrl,omitempty"`
+	DashboardURL string          `json:"dashboardUrl,omitempty"`
+	Owner        *V2Owner        `json:"owner,omitempty"`
+}
+
+type V2Latency struct {
+	AvgMs float64 `json:"avgMs"`
+	MinMs float64 `json:"minMs"`
+	MaxMs float64 `json:"maxMs"`
+	P50Ms float64 `json:"p50Ms"`
+	P90Ms float64 `json:"p90Ms"`
+	P95Ms float64 `json:"p95Ms"`
+	P99Ms float64 `json:"p99Ms"`
+}
+
+type V2LatencyTarget struct {
+	Percentile  int     `json:"percentile"`
+	ThresholdMs float64 `json:"thresholdMs"`
+	CurrentMs   float64 `json:"currentMs"`
+	Breached    bool    `json:"breached"`
+}
+
+type V2Endpoint struct {
+	Service      string           `json:"service"`
+	Endpoint     string           `json:"endpoint"`
+	RequestCount uint64           `json:"requestCount"`
+	Latency      V2Latency        `json:"latency"`
+	Target       *V2LatencyTarget `json:"target,omitempty"`
+}
+
+type V2Dependency struct {
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	CallCount  uint64 `json:"callCount"`
+	ErrorCount uint64 `json:"errorCount"`
+	// P50Ms and P95Ms are the latency of the calls, as seen by the target
+	P50Ms float64 `json:"p50Ms"`
+	P95Ms float64 `json:"p95Ms"`
+}
+
+// v2Time writes t as RFC 3339 in UTC unless the request has a ts_format
+func v2Time(t utils.Timestamp) utils.Timestamp {
+	return utils.NewTimestamp(t.UTC())
+}
+
+func v2Events(events []SpanEvent) []V2Event {
+	out := make([]V2Event, 0, len(events))
+	for _, e := range events {
+		attrs := e.Attributes
+		if attrs == nil {
+			attrs = map[string]string{}
+		}
+		out = append(out, V2Event{Time: v2Time(e.TimeUnixNano), Name: e.Name, Attributes: attrs})
+	}
+	return out
+}
+
+// nonNil keeps empty maps and lists from being encoded as null
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+func nonNilMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+func (c *TelemetryController) v2Meta(r *http.Request, count int) V2Meta {
+	meta := c.responseMeta(r.Context())
+	v2 := V2Meta{
+		Count:        count,
+		SpansScanned: meta.SpansScanned,
+		BytesScanned: meta.BytesScanned,
+		Sampled:      meta.Sampled,
+		Approximate:  meta.Approximate,
+		Stale:        meta.Stale,
+	}
+	if meta.StaleAsOf != nil {
+		staleAsOf := v2Time(*meta.StaleAsOf)
+		v2.StaleAsOf = &staleAsOf
+	}
+	if !meta.DataFreshness.IsZero() {
+		freshness := v2Time(meta.DataFreshness)
+		v2.DataFreshness = &freshness
+	}
+	return v2
+}
+
+func withRange(meta V2Meta, dr DateRange) V2Meta {
+	start, end := utils.NewTimestamp(dr.Start.UTC()), utils.NewTimestamp(dr.End.UTC())
+	meta.Start, meta.End = &start, &end
+	return meta
+}
+
+func writeV2[T any](w http.ResponseWriter, r *http.Request, data T, meta V2Meta) {
+	utils.WriteJSON(w, r, V2Response[T]{Data: data, Meta: meta})
+}
+
+func writeV2Error(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(V2Error{Error: V2ErrorDetail{Status: status, Message: message}})
+}
+
+// The conversions of the results of the service into /v2 types, shared with GraphQL
+
+func v2SearchResults(results []SearchResult) []V2SearchResult {
+	data := make([]V2SearchResult, 0, len(results))
+	for _, res := range results {
+		data = append(data, V2SearchResult{
+			TraceID:            res.TraceID,
+			SpanID:             res.SpanID,
+			Name:               res.Name,
+			Service:            res.Service,
+			StartTime:          v2Time(res.StartTime),
+			EndTime:            v2Time(res.EndTime),
+			DurationMs:         res.Duration,
+			HasError:           res.HasError,
+			ResourceAttributes: nonNilMap(res.ResourceAttrs),
+			Relevance:          res.Relevance,
+		})
+	}
+	return data
+}
+
+func v2Trace(traceID string, spans []TraceSpan) V2Trace {
+	trace := V2Trace{TraceID: traceID, Spans: make([]V2TraceSpan, 0, len(spans))}
+	for _, s := range spans {
+		trace.Spans = append(trace.Spans, V2TraceSpan{
+			SpanID:       s.SpanID,
+			ParentSpanID: s.ParentSpanID,
+			Name:         s.Name,
+			Service:      s.Service,
+			StartTime:    v2Time(s.StartTimeNS),
+			EndTime:      v2Time(s.EndTimeNS),
+			DurationMs:   float64(s.DurationNS) / 1e6,
+			SelfTimeMs:   float64(s.SelfTimeNS) / 1e6,
+			Depth:        s.Depth,
+			ChildCount:   s.ChildCount,
+			Events:       v2Events(s.Events),
+		})
+	}
+	return trace
+}
+
+func v2Span(detail *SpanDetail) V2Span {
+	span := V2Span{
+		SpanID:       detail.SpanID,
+		TraceID:      detail.TraceID,
+		ParentSpanID: detail.ParentSpanID,
+		Name:         detail.Name,
+		Service:      detail.Scope,
+		StartTime:    v2Time(detail.StartTime),
+		EndTime:      v2Time(detail.EndTime),
+		DurationMs:   detail.Duration,
+		Stats: V2LatencyStats{
+			AvgMs:       detail.AvgDuration,
+			P50Ms:       detail.P50Duration,
+			P90Ms:       detail.P90Duration,
+			P99Ms:       detail.P99Duration,
+			DiffPercent: detail.DurationDiff,
+		},
+		ResourceAttributes: nonNilMap(detail.ResourceAttributes),
+		SpanAttributes:     nonNilMap(detail.SpanAttributes),
+		Events:             v2Events(detail.Events),
+	}
+	if l := detail.SourceLink; l != nil {
+		span.SourceLink = &V2SourceLink{FilePath: l.FilePath, LineNo: l.LineNo, Function: l.Function, URL: l.URL}
+	}
+	return span
+}
+
+func v2Services(services []ServiceCatalogEntry) []V2Service {
+	data := make([]V2Service, 0, len(services))
+	for _, s := range services {
+		svc := V2Service{
+			Name:         s.Service,
+			SpanCount:    s.SpanCount,
+			TraceCount:   s.TraceCount,
+			LastSeen:     v2Time(s.LastSeen),
+			Versions:     nonNil(s.Versions),
+			Environments: nonNil(s.Environments),
+			RunbookURL:   s.RunbookURL,
+			DashboardURL: s.DashboardURL,
+		}
+		if s.Owner != nil {
+			svc.Owner = &V2Owner{Team: s.Owner.Team, SlackChannel: s.Owner.SlackChannel, Escalation: s.Owner.Escalation}
+		}
+		data = append(data, svc)
+	}
+	return data
+}
+
+func v2Target(t *catalog.Compliance) *V2LatencyTarget {
+	if t == nil {
+		return nil
+	}
+	return &V2LatencyTarget{Percentile: t.Percentile, ThresholdMs: t.ThresholdMs, CurrentMs: t.CurrentMs, Breached: t.Breached}
+}
+
+func v2Endpoints(latencies []EndpointLatency) []V2Endpoint {
+	data := make([]V2Endpoint, 0, len(latencies))
+	for _, l := range latencies {
+		data = append(data, V2Endpoint{
+			Service:      l.Service,
+			Endpoint:     l.Endpoint,
+			RequestCount: l.RequestCount,
+			Latency: V2Latency{
+				AvgMs: l.AvgDuration,
+				MinMs: l.MinDuration,
+				MaxMs: l.MaxDuration,
+				P50Ms: l.P50Duration,
+				P90Ms: l.P90Duration,
+				P95Ms: l.P95Duration,
+				P99Ms: l.P99Duration,
+			},
+			Target: v2Target(l.Target),
+		})
+	}
+	return data
+}
+
+func v2Dependencies(dependencies []ServiceDependency) []V2Dependency {
+	data := make([]V2Dependency, 0, len(dependencies))
+	for _, d := range dependencies {
+		data = append(data, V2Dependency{
+			Source:     d.Source,
+			Target:     d.Target,
+			CallCount:  d.CallCount,
+			ErrorCount: d.ErrorCount,
+			P50Ms:      d.P50Duration,
+			P95Ms:      d.P95Duration,
+		})
+	}
+	return data
+}
+
+func (c *TelemetryController) searchV2(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dr, err := ParseDateRange(q, "start", "end", "timeRange")
+	if err != nil {
+		writeV2Error(w, http.StatusBadRequest, "invalid date range: "+err.Error())
+		return
+	}
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(q.Get("pageSize"))
+	if err != nil || pageSize < 1 {
+		pageSize = 10
+	}
+	results, err := c.service.SearchTraces(r.Context(), dr, q.Get("query"), page, pageSize,
+		ParseSortOption(q), q.Get("traceOrSpan"),
+		SearchOptions{Approx: q.Get("approx") == "true"})
+	if err != nil {
+		writeV2Error(w, http.StatusInternalServerError, fmt.Sprintf("failed to search: %v", err))
+		return
+	}
+
+	data := v2SearchResults(results.Results)
+	meta := withRange(c.v2Meta(r, len(data)), dr)
+	meta.Total = &results.Total
+	meta.Page, meta.PageSize = results.Page, results.PageSize
+	writeV2(w, r, data, meta)
+}
+
+func (c *TelemetryController) getTraceV2(w http.ResponseWriter, r *http.Request) {
+	traceID := chi.URLParam(r, "traceId")
+	spans, err := c.service.GetTraceDetails(r.Context(), traceID)
+	if errors.Is(err, ErrTraceNotFound) {
+		writeV2Error(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeV2Error(w, http.StatusInternalServerError, fmt.Sprintf("failed to fetch trace: %v", err))
+		return
+	}
+
+	trace := v2Trace(traceID, spans)
+	writeV2(w, r, trace, c.v2Meta(r, len(trace.Spans)))
+}
+
+func (c *TelemetryController) getSpanV2(w http.ResponseWriter, r *http.Request) {
+	cmp, err := ParseSpanComparison(r.URL.Query())
+	if err != nil {
+		writeV2Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	detail, err := c.service.GetSpanDetails(r.Context(), chi.URLParam(r, "spanId"), cmp)
+	if err != nil {
+		writeV2Error(w, http.StatusInternalServerError, fmt.Sprintf("failed to fetch span: %v", err))
+		return
+	}
+
+	writeV2(w, r, v2Span(detail), c.v2Meta(r, 1))
+}
+
+func (c *TelemetryController) listServicesV2(w http.ResponseWriter, r *http.Request) {
+	dr, err := ParseDateRange(r.URL.Query(), "start", "end", "timeRange")
+	if err != nil {
+		writeV2Error(w, http.StatusBadRequest, "invalid date range: "+err.Error())
+		return
+	}
+	ctx, err := c.listingContext(r)
+	if err != nil {
+		writeV2Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	services, err := c.service.GetServiceCatalog(ctx, dr, r.URL.Query().Get("approx") == "true")
+	if err != nil {
+		writeV2Error(w, http.StatusInternalServerError, fmt.Sprintf("failed to list services: %v", err))
+		return
+	}
+
+	data := v2Services(services)
+	writeV2(w, r, data, withRange(c.v2Meta(r, len(data)), dr))
+}
+
+func (c *TelemetryController) listEndpointsV2(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseEndpointLatencyRequest(r.URL.Query())
+	if err != nil {
+		writeV2Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	latencies, err := c.service.GetEndpointLatencies(r.Context(), req)
+	if err != nil {
+		writeV2Error(w, http.StatusInternalServerError, fmt.Sprintf("failed to list endpoints: %v", err))
+		return
+	}
+
+	data := v2Endpoints(latencies)
+	writeV2(w, r, data, withRange(c.v2Meta(r, len(data)), req.DateRange))
+}
+
+func (c *TelemetryController) listDependenciesV2(w http.ResponseWriter, r *http.Request) {
+	dr, err := parseDateRangeOr(r.URL.Query(), "24h")
+	if err != nil {
+		writeV2Error(w, http.StatusBadRequest, "invalid date range: "+err.Error())
+		return
+	}
+	dependencies, err := c.service.GetServiceDependencies(r.Context(), dr)
+	if err != nil {
+		writeV2Error(w, http.StatusInternalServerError, fmt.Sprintf("failed to list dependencies: %v", err))
+		return
+	}
+
+	data := v2Dependencies(dependencies)
+	writeV2(w, r, data, withRange(c.v2Meta(r, len(data)), dr))
+}
+
+func (c *TelemetryController) registerV2Routes(r chi.Router) {
+	r.Get("/v2/search", c.searchV2)
+	r.Get("/v2/traces/{traceId}", c.getTraceV2)
+	r.Get("/v2/spans/{spanId}", c.getSpanV2)
+	r.Get("/v2/services", c.listServicesV2)
+	r.Get("/v2/endpoints", c.listEndpointsV2)
+	r.Get("/v2/dependencies", c.listDependenciesV2)
+}
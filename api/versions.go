@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// DefaultVersionRange is the range versions are compared over when none is given
+const DefaultVersionRange = "7d"
+
+// ServiceVersion is the latency and errors of a version of a service, measured on
+// its server and root spans
+type ServiceVersion struct {
+	Version   string    `json:"version"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Spans     uint64    `json:"spans"`
+	Errors    uint64    `json:"errors"`
+	ErrorRate float64   `json:"error_rate"`
+	AvgMs     float64   `json:"avg_ms"`
+	P50Ms     float64   `json:"p50_ms"`
+	P90Ms     float64   `json:"p90_ms"`
+	P95Ms     float64   `json:"p95_ms"`
+	P99Ms     float64   `json:"p99_ms"`
+	// Change compares the version with the one seen before it
+	Change *VersionChange `json:"change,omitempty"`
+}
+
+// VersionChange is how a version differs from the previous one
+type VersionChange struct {
+	From         string             `json:"from"`
+	Deltas       CohortDeltas       `json:"deltas"`
+	Significance CohortSignificance `json:"significance"`
+}
+
+// GetServiceVersions compares the versions of a service that reported in the range,
+// in the order they were first seen
+func (s *TelemetryService) GetServiceVersions(ctx context.Context, service string, dateRange DateRange) ([]ServiceVersion, error) {
+	ds := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("service_version"),
+			goqu.L("fromUnixTimestamp64Nano(min(start_time_unix_nano))").As("first_seen"),
+			goqu.L("fromUnixTimestamp64Nano(max(start_time_unix_nano))"),
+			goqu.L("count()"),
+			goqu.L("countIf(has(events.name, 'exception'))"),
+			goqu.L("avg(duration_ns) / 1e6"),
+			goqu.L("arrayMap(x -> x / 1e6, quantiles(0.5, 0.9, 0.95, 0.99)(duration_ns))"),
+			goqu.L("avg(log1p(duration_ns))"),
+			goqu.L("varSamp(log1p(duration_ns))"),
+		).
+		Where(
+			goqu.C("start_time_unix_nano").Gte(dateRange.Start.UnixNano()),
+			goqu.C("start_time_unix_nano").Lte(dateRange.End.UnixNano()),
+			resourceAttribute("service.name").Eq(service),
+			goqu.C("service_version").Neq(""),
+			goqu.Or(goqu.C("kind").Eq("server"), goqu.C("parent_span_id").Eq("")),
+		).
+		GroupBy(goqu.C("service_version")).
+		Order(goqu.C("first_seen").Asc())
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	versions := []ServiceVersion{}
+	var previous CohortStats
+	for rows.Next() {
+		var v ServiceVersion
+		var quantiles []float64
+		var stats CohortStats
+		if err := rows.Scan(&v.Version, &v.FirstSeen, &v.LastSeen, &v.Spans, &v.Errors, &v.AvgMs, &quantiles, &stats.logMean, &stats.logVar); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		if len(quantiles) == 4 {
+			v.P50Ms, v.P90Ms, v.P95Ms, v.P99Ms = quantiles[0], quantiles[1], quantiles[2], quantiles[3]
+		}
+		v.ErrorRate = float64(v.Errors) / float64(v.Spans)
+
+		stats.Query, stats.Spans, stats.Errors, stats.ErrorRate = v.Version, v.Spans, v.Errors, v.ErrorRate
+		stats.AvgMs, stats.P50Ms, stats.P90Ms, stats.P95Ms, stats.P99Ms = v.AvgMs, v.P50Ms, v.P90Ms, v.P95Ms, v.P99Ms
+		if previous.Query != "" {
+			cmp := compareCohorts(previous, stats)
+			v.Change = &VersionChange{From: previous.Query, Deltas: cmp.Deltas, Significance: cmp.Significance}
+		}
+		previous = stats
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
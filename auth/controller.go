@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// loginCookie carries the state of a login between /auth/login and /auth/callback
+const loginCookie = "nabatshy_oidc"
+
+// loginTTL is how long users have to log in at the provider
+const loginTTL = 10 * time.Minute
+
+// AuthController serves the login flow, its routes are disabled when auth is nil
+type AuthController struct {
+	auth *Authenticator
+}
+
+func NewAuthController(auth *Authenticator) *AuthController {
+	return &AuthController{auth: auth}
+}
+
+// login is the state of a login in progress, signed so it can't be tampered with
+type login struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	Expiry   int64  `json:"exp"`
+}
+
+func (c *AuthController) login(w http.ResponseWriter, r *http.Request) {
+	l := login{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString(),
+		Redirect: c.safeRedirect(r.URL.Query().Get("redirect")),
+		Expiry:   time.Now().Add(loginTTL).Unix(),
+	}
+	value, err := c.signLogin(l)
+	if err != nil {
+		http.Error(w, "failed to start login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(loginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		// Lax so the cookie comes along when the provider redirects back
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(l.Verifier))
+	http.Redirect(w, r, c.auth.provider.AuthCodeURL(l.State, l.Nonce, b64.EncodeToString(challenge[:])), http.StatusFound)
+}
+
+func (c *AuthController) callback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login failed: "+e+" "+q.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil {
+		http.Error(w, "no login in progress", http.StatusBadRequest)
+		return
+	}
+	l, ok := c.verifyLogin(cookie.Value)
+	if !ok || l.State != q.Get("state") {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+
+	claims, err := c.auth.provider.Exchange(r.Context(), q.Get("code"), l.Verifier, l.Nonce)
+	if err != nil {
+		http.Error(w, "login failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	now := time.Now()
+	session, err := c.auth.newSession(claims, now)
+	if err != nil {
+		http.Error(w, "failed to create session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    session,
+		Path:     "/",
+		Expires:  now.Add(c.auth.ttl),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, l.Redirect, http.StatusFound)
+}
+
+func (c *AuthController) logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, c.safeRedirect(r.URL.Query().Get("redirect")), http.StatusFound)
+}
+
+func (c *AuthController) me(w http.ResponseWriter, r *http.Request) {
+	// /auth/ routes skip the middleware so the user is looked up here
+	user, err := c.auth.authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// safeRedirect only lets logins return to this server or the UI, so the login
+// routes can't be used to send users to another site
+func (c *AuthController) safeRedirect(redirect string) string {
+	if strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") && !strings.HasPrefix(redirect, "/\\") {
+		return redirect
+	}
+	if ui := strings.TrimSuffix(c.auth.uiURL, "/"); ui != "" && (redirect == ui || strings.HasPrefix(redirect, ui+"/")) {
+		return redirect
+	}
+	if c.auth.uiURL != "" {
+		return c.auth.uiURL
+	}
+	return "/"
+}
+
+func (c *AuthController) signLogin(l login) (string, error) {
+	payload, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	value := b64.EncodeToString(payload)
+	return value + "." + b64.EncodeToString(hmacSHA256(c.auth.secret, []byte(value))), nil
+}
+
+func (c *AuthController) verifyLogin(value string) (login, bool) {
+	var l login
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return l, false
+	}
+	mac, err := b64.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, hmacSHA256(c.auth.secret, []byte(payload))) {
+		return l, false
+	}
+	data, err := b64.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &l) != nil {
+		return l, false
+	}
+	return l, time.Now().Unix() < l.Expiry
+}
+
+// isHTTPS reports whether the client sees the server over HTTPS, directly or
+// through a proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func (c *AuthController) Operations() []openapi.Operation {
+	redirect := []openapi.Param{{Name: "redirect", Description: "where to return to afterwards, this server or the UI"}}
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/auth/login", Summary: "Log in with the identity provider", Status: http.StatusFound, Query: redirect},
+		{Method: http.MethodGet, Path: "/auth/callback", Summary: "Redirect target of the identity provider", Status: http.StatusFound},
+		{Method: http.MethodGet, Path: "/auth/logout", Summary: "Log out", Status: http.StatusFound, Query: redirect},
+		{Method: http.MethodGet, Path: "/auth/me", Summary: "The logged in user", Response: User{}},
+	}
+}
+
+func (c *AuthController) RegisterRoutes(r chi.Router) {
+	if c.auth == nil {
+		return
+	}
+	r.Get("/auth/login", c.login)
+	r.Get("/auth/callback", c.callback)
+	r.Get("/auth/logout", c.logout)
+	r.Get("/auth/me", c.me)
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512 for RS384, RS512 and the ES variants
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Claims are the JWT claims of ID tokens and session tokens
+type Claims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud,omitempty"`
+	Expiry   int64    `json:"exp"`
+	IssuedAt int64    `json:"iat,omitempty"`
+	Nonce    string   `json:"nonce,omitempty"`
+	Email    string   `json:"email,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	// Groups is the groups claim most providers can be configured to add
+	Groups []string `json:"groups,omitempty"`
+	// Restricted, Services and HiddenServices carry the service restrictions of the
+	// user who shared a trace, see ShareSigner
+	Restricted     bool     `json:"restricted,omitempty"`
+	Services       []string `json:"services,omitempty"`
+	HiddenServices []string `json:"hidden_services,omitempty"`
+}
+
+// audience is a JWT aud claim, a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// clockSkew is how far the clocks of the provider and this server may differ
+const clockSkew = time.Minute
+
+func (c *Claims) expired(now time.Time) bool {
+	return now.Add(-clockSkew).Unix() >= c.Expiry
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// parseJWT splits a compact JWT into its header, claims and the signed part
+func parseJWT(token string) (jwtHeader, Claims, []byte, []byte, error) {
+	var header jwtHeader
+	var claims Claims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, claims, nil, nil, errors.New("malformed token")
+	}
+	headerJSON, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return header, claims, nil, nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return header, claims, nil, nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	claimsJSON, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return header, claims, nil, nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return header, claims, nil, nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return header, claims, nil, nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+	return header, claims, []byte(parts[0] + "." + parts[1]), signature, nil
+}
+
+// ecCurves are the curves of the ES algorithms, RFC 7518 ties each to one
+var ecCurves = map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+
+// verifySignature checks a signature made with an asymmetric key of a JWKS
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s doesn't match an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("algorithm %s doesn't match an EC key", alg)
+		}
+		if curve := ecCurves[alg]; k.Curve.Params().Name != curve {
+			return fmt.Errorf("algorithm %s needs a %s key, not %s", alg, curve, k.Curve.Params().Name)
+		}
+		// JWS ECDSA signatures are r and s concatenated, each the size of the curve
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// signHS256 returns a compact JWT of claims signed with secret
+func signHS256(claims Claims, secret []byte) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	return signed + "." + b64.EncodeToString(hmacSHA256(secret, []byte(signed))), nil
+}
+
+// verifyHS256 returns the claims of a token signed with signHS256
+func verifyHS256(token string, secret []byte) (Claims, error) {
+	header, claims, signed, signature, err := parseJWT(token)
+	if err != nil {
+		return claims, err
+	}
+	if header.Alg != "HS256" {
+		return claims, fmt.Errorf("unexpected signing algorithm %q", header.Alg)
+	}
+	if !hmac.Equal(signature, hmacSHA256(secret, signed)) {
+		return claims, errors.New("invalid signature")
+	}
+	return claims, nil
+}
+
+func hmacSHA256(secret, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
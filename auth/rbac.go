@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Role is what a user may do through the API
+type Role string
+
+const (
+	// RoleNone can't use the API, for users no binding matches when they shouldn't
+	// have access by default
+	RoleNone Role = "none"
+	// RoleViewer may read
+	RoleViewer Role = "viewer"
+	// RoleEditor may also change alerts, searches, dashboards and the like
+	RoleEditor Role = "editor"
+	// RoleAdmin may also use the admin, debug and provisioning routes
+	RoleAdmin Role = "admin"
+)
+
+var roleRanks = map[Role]int{RoleNone: 0, RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// ParseRole parses the AUTH_DEFAULT_ROLE value, empty is viewer
+func ParseRole(s string) (Role, error) {
+	if s == "" {
+		return RoleViewer, nil
+	}
+	if _, ok := roleRanks[Role(s)]; !ok {
+		return "", fmt.Errorf("invalid role %q, expected none, viewer, editor or admin", s)
+	}
+	return Role(s), nil
+}
+
+// adminPrefixes are the routes only admins may use, whatever the method
+var adminPrefixes = []string{"/v1/admin/", "/v1/debug/", "/v1/provision/"}
+
+// ownPaths are the routes changing only the user's own data, which viewers may use
+// whatever the method
+var ownPaths = []string{"/v1/preferences"}
+
+// readPaths are the routes that only read whatever the method, GraphQL clients POST
+// their queries and the schema has no mutations
+var readPaths = []string{"/graphql"}
+
+// CanRead reports whether the role may read the traces and metrics
+func (r Role) CanRead() bool {
+	return roleRanks[r] >= roleRanks[RoleViewer]
+}
+
+// allows reports whether the role may make the request
+func (r Role) allows(method, path string) bool {
+	for _, p := range adminPrefixes {
+		if strings.HasPrefix(path, p) {
+			return r == RoleAdmin
+		}
+	}
+	if slices.Contains(ownPaths, path) || slices.Contains(readPaths, path) {
+		return roleRanks[r] >= roleRanks[RoleViewer]
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return roleRanks[r] >= roleRanks[RoleViewer]
+	}
+	return roleRanks[r] >= roleRanks[RoleEditor]
+}
+
+// RoleBinding gives a role to the users of a group, or to one user by email. With
+// Services the users only see spans of those services.
+type RoleBinding struct {
+	Subject  string   `json:"subject"`
+	Role     Role     `json:"role"`
+	Services []string `json:"services,omitempty"`
+}
+
+// ParseRoleBindings parses the AUTH_ROLES value, bindings separated by ; like
+//
+//	sre=admin;payments-team=editor:payments,checkout;jane@example.com=viewer
+func ParseRoleBindings(s string) ([]RoleBinding, error) {
+	var bindings []RoleBinding
+	for _, part := range strings.Split(s, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		subject, rest, ok := strings.Cut(part, "=")
+		if !ok || subject == "" {
+			return nil, fmt.Errorf("invalid role binding %q, expected subject=role[:services]", part)
+		}
+		roleName, services, _ := strings.Cut(rest, ":")
+		role, err := ParseRole(roleName)
+		if err != nil || roleName == "" {
+			return nil, fmt.Errorf("invalid role binding %q, use none, viewer, editor or admin", part)
+		}
+		b := RoleBinding{Subject: subject, Role: role}
+		for _, service := range strings.Split(services, ",") {
+			if service = strings.TrimSpace(service); service != "" {
+				b.Services = append(b.Services, service)
+			}
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+// ParseServiceRoles parses the AUTH_SERVICE_ROLES value, the least role that may see
+// the spans of a service, separated by ; like
+//
+//	billing=admin;user-profiles=editor
+func ParseServiceRoles(s string) (map[string]Role, error) {
+	roles := make(map[string]Role)
+	for _, part := range strings.Split(s, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		service, roleName, ok := strings.Cut(part, "=")
+		if !ok || service == "" {
+			return nil, fmt.Errorf("invalid service role %q, expected service=role", part)
+		}
+		role, err := ParseRole(roleName)
+		if err != nil || roleName == "" || role == RoleNone {
+			return nil, fmt.Errorf("invalid service role %q, use viewer, editor or admin", part)
+		}
+		roles[service] = role
+	}
+	return roles, nil
+}
+
+// Policy decides the role and visible services of users from the bindings matching
+// their groups and email, and hides services from roles below the one they need
+type Policy struct {
+	bindings     []RoleBinding
+	defaultRole  Role
+	serviceRoles map[string]Role
+}
+
+func NewPolicy(bindings []RoleBinding, defaultRole Role, serviceRoles map[string]Role) *Policy {
+	return &Policy{bindings: bindings, defaultRole: defaultRole, serviceRoles: serviceRoles}
+}
+
+// apply sets the role and services of the user. A user matching several bindings
+// gets the highest role and the services of all of them, a binding without
+// services lifts the restriction. Users matching none get the default role and
+// see every service.
+func (p *Policy) apply(u *User) {
+	if p == nil {
+		u.Role = RoleAdmin
+		return
+	}
+	u.Role, u.Services = RoleNone, nil
+	matched, restricted := false, true
+	for _, b := range p.bindings {
+		if b.Subject != u.Email && !slices.Contains(u.Groups, b.Subject) {
+			continue
+		}
+		matched = true
+		if roleRanks[b.Role] > roleRanks[u.Role] {
+			u.Role = b.Role
+		}
+		if len(b.Services) == 0 {
+			restricted = false
+		}
+		u.Services = append(u.Services, b.Services...)
+	}
+	if !matched {
+		u.Role = p.defaultRole
+		restricted = false
+	}
+	u.HiddenServices = nil
+	for service, role := range p.serviceRoles {
+		if roleRanks[u.Role] < roleRanks[role] {
+			u.HiddenServices = append(u.HiddenServices, service)
+		}
+	}
+	slices.Sort(u.HiddenServices)
+	if !restricted {
+		u.Services = nil
+		return
+	}
+	slices.Sort(u.Services)
+	u.Services = slices.Compact(u.Services)
+}
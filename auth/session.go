@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// SessionCookie holds the session token of a logged in user
+const SessionCookie = "nabatshy_session"
+
+// sessionIssuer is the iss claim of session tokens, to tell them from ID tokens
+const sessionIssuer = "nabatshy"
+
+// DefaultSessionTTL is how long a login lasts
+const DefaultSessionTTL = 12 * time.Hour
+
+// User is the logged in user of a request
+type User struct {
+	Subject string   `json:"subject"`
+	Email   string   `json:"email,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	// Role, Services and HiddenServices are set by the Policy on every request
+	Role     Role     `json:"role"`
+	Services []string `json:"services,omitempty"`
+	// HiddenServices need a higher role to be seen
+	HiddenServices []string `json:"hidden_services,omitempty"`
+}
+
+type userKey struct{}
+
+// UserFromContext returns the user of a request, nil when auth is off
+func UserFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userKey{}).(*User)
+	return u
+}
+
+// WithUser returns a context carrying the user
+func WithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// Authenticator logs users in with an OIDC provider and keeps them logged in with a
+// session token, sent as a cookie by the UI or as a bearer token by API clients.
+// Bearer ID tokens of the provider are accepted too, for clients that log in themselves.
+type Authenticator struct {
+	provider *Provider
+	policy   *Policy
+	secret   []byte
+	ttl      time.Duration
+	// uiURL is where users land after logging in and out
+	uiURL string
+}
+
+// NewAuthenticator returns an Authenticator signing sessions with secret. Without a
+// secret a random one is used, so sessions end when the server restarts. A nil
+// policy makes every user an admin.
+func NewAuthenticator(provider *Provider, policy *Policy, secret string, ttl time.Duration, uiURL string) (*Authenticator, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		log.Println("auth: no session secret set, sessions end when the server restarts")
+	}
+	return &Authenticator{provider: provider, policy: policy, secret: key, ttl: ttl, uiURL: uiURL}, nil
+}
+
+// ParseSessionTTL parses the SESSION_TTL value
+func ParseSessionTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return DefaultSessionTTL, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid session ttl %q", s)
+	}
+	return d, nil
+}
+
+// public are the routes reachable without logging in: health checks and metrics for
+// the infrastructure, the login flow itself, and webhooks and shared traces, which
+// have their own secrets
+var public = []string{"/healthz", "/readyz", "/metrics", "/auth/", "/v1/webhooks/", "/v1/shared/"}
+
+func isPublic(path string) bool {
+	for _, p := range public {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejects requests without a valid session or ID token or that the user's
+// role doesn't allow, and restricts the queries of users limited to some services.
+// A nil Authenticator lets every request through.
+func Middleware(a *Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := routePath(r)
+			if isPublic(path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			user, err := a.authenticate(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="nabatshy"`)
+				http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if !user.Role.allows(r.Method, path) {
+				http.Error(w, fmt.Sprintf("forbidden for role %s", user.Role), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(Scope(r.Context(), user)))
+		})
+	}
+}
+
+// Scope returns a context carrying the user whose queries only see the services the
+// user may see
+func Scope(ctx context.Context, user *User) context.Context {
+	ctx = WithUser(ctx, user)
+	if user.Services != nil {
+		ctx = utils.WithServiceFilter(ctx, "services:"+strings.Join(user.Services, ","), user.Services)
+	}
+	if len(user.HiddenServices) > 0 {
+		ctx = utils.WithoutServices(ctx, "hidden:"+strings.Join(user.HiddenServices, ","), user.HiddenServices)
+	}
+	return ctx
+}
+
+// routePath is the path of the request within the router, without the prefix the
+// router is mounted on in single port mode
+func routePath(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+		return rctx.RoutePath
+	}
+	return r.URL.Path
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (*User, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		c, err := r.Cookie(SessionCookie)
+		if err != nil {
+			return nil, errors.New("not logged in")
+		}
+		token = c.Value
+	}
+	return a.AuthenticateToken(r.Context(), token)
+}
+
+// AuthenticateToken returns the user of a session or ID token, for the servers that
+// don't take HTTP requests
+func (a *Authenticator) AuthenticateToken(ctx context.Context, token string) (*User, error) {
+	claims, err := verifyHS256(token, a.secret)
+	if err == nil && claims.Issuer == sessionIssuer {
+		if claims.expired(time.Now()) {
+			return nil, errors.New("session expired")
+		}
+	} else if claims, err = a.provider.Verify(ctx, token); err != nil {
+		// neither a session of this server nor an ID token of the provider
+		return nil, errors.New("invalid token")
+	}
+	user := userFromClaims(claims)
+	// roles come from the current bindings rather than the session, so changes to
+	// them apply to users already logged in
+	a.policy.apply(user)
+	return user, nil
+}
+
+func userFromClaims(c Claims) *User {
+	return &User{Subject: c.Subject, Email: c.Email, Name: c.Name, Groups: c.Groups}
+}
+
+// newSession returns a session token for the user of an ID token
+func (a *Authenticator) newSession(c Claims, now time.Time) (string, error) {
+	return signHS256(Claims{
+		Issuer:   sessionIssuer,
+		Subject:  c.Subject,
+		Email:    c.Email,
+		Name:     c.Name,
+		Groups:   c.Groups,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(a.ttl).Unix(),
+	}, a.secret)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// shareIssuer is the iss claim of share tokens
+const shareIssuer = "nabatshy-share"
+
+const (
+	// DefaultShareTTL is how long a shared trace link works
+	DefaultShareTTL = 24 * time.Hour
+	// MaxShareTTL bounds the lifetime of shared trace links
+	MaxShareTTL = 7 * 24 * time.Hour
+)
+
+// ErrShareExpired is returned for share tokens past their expiry
+var ErrShareExpired = errors.New("share link expired")
+
+// Share is what a share token grants: reading one trace, with the service
+// restrictions of the user who shared it
+type Share struct {
+	TraceID string
+	// Services is nil when the user saw every service
+	Services       []string
+	HiddenServices []string
+	ExpiresAt      time.Time
+}
+
+// ShareSigner mints and checks the tokens of shared trace links. They work without
+// logging in, so anyone with the link can read the trace until it expires.
+type ShareSigner struct {
+	secret []byte
+}
+
+// NewShareSigner returns a ShareSigner deriving its key from the session secret.
+// Without a secret a random key is used, so links stop working when the server
+// restarts.
+func NewShareSigner(secret string) (*ShareSigner, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		log.Println("auth: no session secret set, shared trace links stop working when the server restarts")
+	}
+	// a key of its own, so share tokens can never pass for sessions
+	return &ShareSigner{secret: hmacSHA256(key, []byte(shareIssuer))}, nil
+}
+
+// ParseShareTTL parses the ttl of a shared link, empty is DefaultShareTTL
+func ParseShareTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return DefaultShareTTL, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 || d > MaxShareTTL {
+		return 0, fmt.Errorf("invalid ttl %q, use a duration up to %s", s, MaxShareTTL)
+	}
+	return d, nil
+}
+
+// Sign returns a token sharing the trace for ttl with the restrictions of the user,
+// who is nil when auth is off
+func (s *ShareSigner) Sign(traceID string, user *User, ttl time.Duration, now time.Time) (string, Share, error) {
+	share := Share{TraceID: traceID, ExpiresAt: now.Add(ttl).UTC().Truncate(time.Second)}
+	claims := Claims{
+		Issuer:   shareIssuer,
+		Subject:  traceID,
+		IssuedAt: now.Unix(),
+		Expiry:   share.ExpiresAt.Unix(),
+	}
+	if user != nil {
+		share.Services, share.HiddenServices = user.Services, user.HiddenServices
+		claims.Services, claims.HiddenServices = user.Services, user.HiddenServices
+		// an empty list still restricts the user to no service
+		claims.Restricted = user.Services != nil
+	}
+	token, err := signHS256(claims, s.secret)
+	return token, share, err
+}
+
+// Verify returns the share of a token
+func (s *ShareSigner) Verify(token string, now time.Time) (Share, error) {
+	claims, err := verifyHS256(token, s.secret)
+	if err != nil || claims.Issuer != shareIssuer {
+		return Share{}, errors.New("invalid share token")
+	}
+	if claims.expired(now) {
+		return Share{}, ErrShareExpired
+	}
+	share := Share{
+		TraceID:        claims.Subject,
+		HiddenServices: claims.HiddenServices,
+		ExpiresAt:      time.Unix(claims.Expiry, 0).UTC(),
+	}
+	if claims.Restricted {
+		share.Services = append([]string{}, claims.Services...)
+	}
+	return share, nil
+}
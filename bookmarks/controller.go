@@ -0,0 +1,130 @@
+package bookmarks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"nabatshy/auth"
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type BookmarkController struct {
+	service *BookmarkService
+}
+
+func NewBookmarkController(service *BookmarkService) *BookmarkController {
+	return &BookmarkController{service: service}
+}
+
+// subject is the subject of the request's user, empty when auth is off
+func subject(r *http.Request) string {
+	if u := auth.UserFromContext(r.Context()); u != nil {
+		return u.Subject
+	}
+	return ""
+}
+
+// listBookmarks lists the bookmarked traces, those with the label parameter when
+// it's given
+func (c *BookmarkController) listBookmarks(w http.ResponseWriter, r *http.Request) {
+	bookmarks, err := c.service.ListBookmarks(r.Context(), subject(r), r.URL.Query().Get("label"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list bookmarks: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bookmarks)
+}
+
+func (c *BookmarkController) listTraceBookmarks(w http.ResponseWriter, r *http.Request) {
+	traceID, err := url.QueryUnescape(chi.URLParam(r, "trace_id"))
+	if err != nil {
+		http.Error(w, "invalid trace_id", http.StatusBadRequest)
+		return
+	}
+	bookmarks, err := c.service.TraceBookmarks(r.Context(), subject(r), traceID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list bookmarks: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bookmarks)
+}
+
+func (c *BookmarkController) createBookmark(w http.ResponseWriter, r *http.Request) {
+	traceID, err := url.QueryUnescape(chi.URLParam(r, "trace_id"))
+	if err != nil {
+		http.Error(w, "invalid trace_id", http.StatusBadRequest)
+		return
+	}
+	var bookmark Bookmark
+	if err := json.NewDecoder(r.Body).Decode(&bookmark); err != nil {
+		http.Error(w, "invalid bookmark: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bookmark.TraceID = traceID
+	bookmark.Owner = subject(r)
+	if err := bookmark.Validate(); err != nil {
+		http.Error(w, "invalid bookmark: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	found, err := c.service.AddBookmark(r.Context(), &bookmark)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create bookmark: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "trace not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bookmark)
+}
+
+func (c *BookmarkController) deleteBookmark(w http.ResponseWriter, r *http.Request) {
+	traceID, err := url.QueryUnescape(chi.URLParam(r, "trace_id"))
+	if err != nil {
+		http.Error(w, "invalid trace_id", http.StatusBadRequest)
+		return
+	}
+	bookmark, found, err := c.service.GetBookmark(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get bookmark: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found || bookmark.TraceID != traceID || !bookmark.VisibleTo(subject(r)) {
+		http.Error(w, "bookmark not found", http.StatusNotFound)
+		return
+	}
+	if err := c.service.RemoveBookmark(r.Context(), bookmark); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete bookmark: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *BookmarkController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/bookmarks", Summary: "Bookmarked traces", Response: []Bookmark{},
+			Query: []openapi.Param{{Name: "label", Description: "only the bookmarks with the label"}}},
+		{Method: http.MethodGet, Path: "/v1/traces/{trace_id}/bookmarks", Summary: "Bookmarks of a trace", Response: []Bookmark{}},
+		{Method: http.MethodPost, Path: "/v1/traces/{trace_id}/bookmarks", Summary: "Bookmark a trace", Request: Bookmark{}, Response: Bookmark{}, Status: http.StatusCreated},
+		{Method: http.MethodDelete, Path: "/v1/traces/{trace_id}/bookmarks/{id}", Summary: "Delete a bookmark", Status: http.StatusNoContent},
+	}
+}
+
+func (c *BookmarkController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/bookmarks", c.listBookmarks)
+	r.Get("/v1/traces/{trace_id}/bookmarks", c.listTraceBookmarks)
+	r.Post("/v1/traces/{trace_id}/bookmarks", c.createBookmark)
+	r.Delete("/v1/traces/{trace_id}/bookmarks/{id}", c.deleteBookmark)
+}
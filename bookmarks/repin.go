@@ -0,0 +1,76 @@
+package bookmarks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// RepinInterval is how often the spans of bookmarked traces that arrived after the
+// bookmark are pinned
+const RepinInterval = time.Hour
+
+// Repinner pins the spans of bookmarked traces stored after their bookmark was added,
+// so the span retention doesn't delete part of a bookmarked trace
+type Repinner struct {
+	service *BookmarkService
+}
+
+func NewRepinner(service *BookmarkService) *Repinner {
+	return &Repinner{service: service}
+}
+
+// Run pins the late spans every RepinInterval until ctx is done
+func (p *Repinner) Run(ctx context.Context) {
+	ticker := time.NewTicker(RepinInterval)
+	defer ticker.Stop()
+	for {
+		if err := p.service.repin(ctx); err != nil {
+			log.Printf("bookmarks: repinning failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// repin pins the unpinned spans of every bookmarked trace, in one mutation and only
+// when there are some
+func (s *BookmarkService) repin(ctx context.Context) error {
+	all, err := s.ListBookmarks(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(all))
+	traceIDs := make([]string, 0, len(all))
+	for _, b := range all {
+		if !seen[b.TraceID] {
+			seen[b.TraceID] = true
+			traceIDs = append(traceIDs, b.TraceID)
+		}
+	}
+	if len(traceIDs) == 0 {
+		return nil
+	}
+
+	var unpinned uint64
+	if err := (*s.Ch).QueryRow(ctx,
+		"SELECT count() FROM denormalized_span WHERE pinned = 0 AND has(?, trace_id)", traceIDs,
+	).Scan(&unpinned); err != nil {
+		return fmt.Errorf("query error: %w", err)
+	}
+	if unpinned == 0 {
+		return nil
+	}
+	err = (*s.Ch).Exec(ctx,
+		fmt.Sprintf("ALTER TABLE %s UPDATE pinned = 1 WHERE pinned = 0 AND has(?, trace_id)", s.Cluster.AlterTable("denormalized_span")),
+		traceIDs,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to pin spans: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package bookmarks
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"nabatshy/db"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/google/uuid"
+)
+
+const bookmarksTable = "bookmarks"
+
+// Bookmark marks a trace worth coming back to. The spans of a bookmarked trace are
+// pinned, the span retention doesn't delete them until its last bookmark is
+// removed. Spans arriving after the trace was bookmarked are pinned by the Repinner.
+type Bookmark struct {
+	ID      string   `json:"id"`
+	TraceID string   `json:"trace_id"`
+	Labels  []string `json:"labels"`
+	Note    string   `json:"note,omitempty"`
+	// Owner is the subject of the user who bookmarked the trace, empty for bookmarks
+	// made without auth, which everyone sees
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BookmarkService struct {
+	Ch      *clickhouse.Conn
+	Cluster db.Cluster
+}
+
+// Validate checks the bookmark
+func (b *Bookmark) Validate() error {
+	if b.TraceID == "" {
+		return fmt.Errorf("trace_id is required")
+	}
+	labels := make([]string, 0, len(b.Labels))
+	for _, label := range b.Labels {
+		if label = strings.TrimSpace(label); label == "" {
+			return fmt.Errorf("labels can't be empty")
+		}
+		if !slices.Contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	b.Labels = labels
+	return nil
+}
+
+// VisibleTo reports whether the user with the subject sees the bookmark, every
+// bookmark is visible without auth
+func (b *Bookmark) VisibleTo(subject string) bool {
+	return subject == "" || b.Owner == "" || b.Owner == subject
+}
+
+// ListBookmarks lists the bookmarks visible to the user with the subject, newest
+// first, those with the label only when it isn't empty
+func (s *BookmarkService) ListBookmarks(ctx context.Context, subject, label string) ([]Bookmark, error) {
+	all, err := db.ListDocuments[Bookmark](ctx, *s.Ch, bookmarksTable)
+	if err != nil {
+		return nil, err
+	}
+	bookmarks := make([]Bookmark, 0, len(all))
+	for _, b := range all {
+		if b.VisibleTo(subject) && (label == "" || slices.Contains(b.Labels, label)) {
+			bookmarks = append(bookmarks, b)
+		}
+	}
+	slices.SortFunc(bookmarks, func(a, b Bookmark) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return bookmarks, nil
+}
+
+// TraceBookmarks lists the bookmarks of a trace visible to the user with the subject
+func (s *BookmarkService) TraceBookmarks(ctx context.Context, subject, traceID string) ([]Bookmark, error) {
+	all, err := s.ListBookmarks(ctx, subject, "")
+	if err != nil {
+		return nil, err
+	}
+	bookmarks := []Bookmark{}
+	for _, b := range all {
+		if b.TraceID == traceID {
+			bookmarks = append(bookmarks, b)
+		}
+	}
+	return bookmarks, nil
+}
+
+func (s *BookmarkService) GetBookmark(ctx context.Context, id string) (Bookmark, bool, error) {
+	return db.GetDocument[Bookmark](ctx, *s.Ch, bookmarksTable, id)
+}
+
+// AddBookmark bookmarks a trace and pins its spans, it reports false when the trace
+// has no spans
+func (s *BookmarkService) AddBookmark(ctx context.Context, b *Bookmark) (bool, error) {
+	if err := b.Validate(); err != nil {
+		return false, err
+	}
+	var spans uint64
+	if err := (*s.Ch).QueryRow(ctx, "SELECT count() FROM denormalized_span WHERE trace_id = ?", b.TraceID).Scan(&spans); err != nil {
+		return false, fmt.Errorf("query error: %w", err)
+	}
+	if spans == 0 {
+		return false, nil
+	}
+
+	b.ID = uuid.New().String()
+	b.CreatedAt = time.Now().UTC()
+	if err := db.PutDocument(ctx, *s.Ch, bookmarksTable, b.ID, b.TraceID, b); err != nil {
+		return false, err
+	}
+	return true, s.pin(ctx, b.TraceID, true)
+}
+
+// RemoveBookmark removes a bookmark, the trace is unpinned with its last bookmark
+func (s *BookmarkService) RemoveBookmark(ctx context.Context, b Bookmark) error {
+	if err := db.DeleteDocument(ctx, *s.Ch, bookmarksTable, b.ID); err != nil {
+		return err
+	}
+	remaining, err := s.TraceBookmarks(ctx, "", b.TraceID)
+	if err != nil {
+		return err
+	}
+	if len(remaining) > 0 {
+		return nil
+	}
+	return s.pin(ctx, b.TraceID, false)
+}
+
+// pin sets the pinned column of the spans of a trace. The update is a ClickHouse
+// mutation that runs in the background.
+func (s *BookmarkService) pin(ctx context.Context, traceID string, pinned bool) error {
+	value := 0
+	if pinned {
+		value = 1
+	}
+	err := (*s.Ch).Exec(ctx,
+		fmt.Sprintf("ALTER TABLE %s UPDATE pinned = %d WHERE trace_id = ? AND pinned != %d", s.Cluster.AlterTable("denormalized_span"), value, value),
+		traceID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to pin spans: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type CatalogController struct {
+	service *CatalogService
+}
+
+func NewCatalogController(service *CatalogService) *CatalogController {
+	return &CatalogController{service: service}
+}
+
+func (c *CatalogController) listMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := c.service.ListMetadata(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list service metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
+}
+
+func (c *CatalogController) getMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, found, err := c.service.GetMetadata(r.Context(), chi.URLParam(r, "service"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get service metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "service metadata not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
+}
+
+func (c *CatalogController) putMetadata(w http.ResponseWriter, r *http.Request) {
+	var metadata Metadata
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		http.Error(w, "invalid service metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	metadata.Service = chi.URLParam(r, "service")
+	if err := metadata.Validate(); err != nil {
+		http.Error(w, "invalid service metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveMetadata(r.Context(), &metadata); err != nil {
+		http.Error(w, fmt.Sprintf("failed to save service metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
+}
+
+func (c *CatalogController) deleteMetadata(w http.ResponseWriter, r *http.Request) {
+	if err := c.service.DeleteMetadata(r.Context(), chi.URLParam(r, "service")); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete service metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *CatalogController) listTeamServices(w http.ResponseWriter, r *http.Request) {
+	metadata, err := c.service.ServicesOwnedBy(r.Context(), chi.URLParam(r, "team"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list team services: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
+}
+
+func (c *CatalogController) listLatencyTargets(w http.ResponseWriter, r *http.Request) {
+	targets, err := c.service.ListLatencyTargets(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list latency targets: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+}
+
+func (c *CatalogController) putLatencyTarget(w http.ResponseWriter, r *http.Request) {
+	var target LatencyTarget
+	if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+		http.Error(w, "invalid latency target: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := target.Validate(); err != nil {
+		http.Error(w, "invalid latency target: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveLatencyTarget(r.Context(), &target); err != nil {
+		http.Error(w, fmt.Sprintf("failed to save latency target: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(target)
+}
+
+// deleteLatencyTarget takes the service and endpoint as query parameters since
+// endpoint names usually contain slashes
+func (c *CatalogController) deleteLatencyTarget(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("endpoint") == "" {
+		http.Error(w, "endpoint is required", http.StatusBadRequest)
+		return
+	}
+	if err := c.service.DeleteLatencyTarget(r.Context(), q.Get("service"), q.Get("endpoint")); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete latency target: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *CatalogController) listRetired(w http.ResponseWriter, r *http.Request) {
+	retired, err := c.service.ListRetired(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list retired services: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retired)
+}
+
+func (c *CatalogController) retireService(w http.ResponseWriter, r *http.Request) {
+	retired, err := c.service.RetireService(r.Context(), chi.URLParam(r, "service"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to retire service: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retired)
+}
+
+func (c *CatalogController) unretireService(w http.ResponseWriter, r *http.Request) {
+	if err := c.service.UnretireService(r.Context(), chi.URLParam(r, "service")); err != nil {
+		http.Error(w, fmt.Sprintf("failed to unretire service: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeService answers 202 since ClickHouse deletes the spans in the background
+func (c *CatalogController) purgeService(w http.ResponseWriter, r *http.Request) {
+	retired, err := c.service.PurgeService(r.Context(), chi.URLParam(r, "service"))
+	if errors.Is(err, ErrNotRetired) {
+		http.Error(w, "only retired services can be purged", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to purge service: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(retired)
+}
+
+func (c *CatalogController) Operations() []openapi.Operation {
+	target := []openapi.Param{
+		{Name: "service", Description: "service of the target, empty for every service"},
+		{Name: "endpoint", Required: true},
+	}
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/services/metadata", Summary: "Metadata of every service", Response: []Metadata{}},
+		{Method: http.MethodGet, Path: "/v1/services/{service}/metadata", Summary: "Metadata of a service", Response: Metadata{}},
+		{Method: http.MethodPut, Path: "/v1/services/{service}/metadata", Summary: "Save the metadata of a service", Request: Metadata{}, Response: Metadata{}},
+		{Method: http.MethodDelete, Path: "/v1/services/{service}/metadata", Summary: "Delete the metadata of a service", Status: http.StatusNoContent},
+		{Method: http.MethodGet, Path: "/v1/services/retired", Summary: "Retired services", Response: []Retired{}},
+		{Method: http.MethodPut, Path: "/v1/services/{service}/retired", Summary: "Retire a service", Response: Retired{}},
+		{Method: http.MethodDelete, Path: "/v1/services/{service}/retired", Summary: "Unretire a service", Status: http.StatusNoContent},
+		{Method: http.MethodPost, Path: "/v1/admin/services/{service}/purge", Summary: "Delete the spans of a retired service",
+			Response: Retired{}, Status: http.StatusAccepted},
+		{Method: http.MethodGet, Path: "/v1/teams/{team}/services", Summary: "Metadata of the services a team owns", Response: []Metadata{}},
+		{Method: http.MethodGet, Path: "/v1/latency-targets", Summary: "Latency targets", Response: []LatencyTarget{}},
+		{Method: http.MethodPut, Path: "/v1/latency-targets", Summary: "Save a latency target", Request: LatencyTarget{}, Response: LatencyTarget{}},
+		{Method: http.MethodDelete, Path: "/v1/latency-targets", Summary: "Delete a latency target", Status: http.StatusNoContent, Query: target},
+	}
+}
+
+func (c *CatalogController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/services/metadata", c.listMetadata)
+	r.Get("/v1/services/{service}/metadata", c.getMetadata)
+	r.Put("/v1/services/{service}/metadata", c.putMetadata)
+	r.Delete("/v1/services/{service}/metadata", c.deleteMetadata)
+	r.Get("/v1/services/retired", c.listRetired)
+	r.Put("/v1/services/{service}/retired", c.retireService)
+	r.Delete("/v1/services/{service}/retired", c.unretireService)
+	r.Post("/v1/admin/services/{service}/purge", c.purgeService)
+	r.Get("/v1/teams/{team}/services", c.listTeamServices)
+	r.Get("/v1/latency-targets", c.listLatencyTargets)
+	r.Put("/v1/latency-targets", c.putLatencyTarget)
+	r.Delete("/v1/latency-targets", c.deleteLatencyTarget)
+}
@@ -0,0 +1,203 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"nabatshy/db"
+	"nabatshy/utils"
+)
+
+const retiredTable = "retired_services"
+
+const (
+	// DefaultIdleAfter is how long a service may go without spans before it's retired
+	DefaultIdleAfter = 7 * 24 * time.Hour
+	// RetirementCheckInterval is how often idle services are looked for
+	RetirementCheckInterval = time.Hour
+)
+
+// Reasons a service was retired
+const (
+	RetiredIdle   = "idle"
+	RetiredManual = "manual"
+)
+
+// ErrNotRetired is returned when purging a service that isn't retired
+var ErrNotRetired = errors.New("service isn't retired")
+
+// Retired is a service left out of the catalog, health and service lists by default,
+// either because it stopped reporting or by hand. A retired service that reports
+// again is brought back.
+type Retired struct {
+	Service   string    `json:"service"`
+	Reason    string    `json:"reason"`
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+	RetiredAt time.Time `json:"retired_at"`
+	// PurgedAt is when the deletion of the service's spans was requested
+	PurgedAt *time.Time `json:"purged_at,omitempty"`
+}
+
+// ParseIdleAfter parses the CATALOG_IDLE_AFTER value like 7d or 12h, empty means a
+// week and off disables the detection, returned as 0
+func ParseIdleAfter(s string) (time.Duration, error) {
+	switch s {
+	case "":
+		return DefaultIdleAfter, nil
+	case "off":
+		return 0, nil
+	}
+	d, err := utils.ParseTimeRange(s)
+	if err != nil || d < RetirementCheckInterval {
+		return 0, fmt.Errorf("invalid idle period %q, use off or a period of at least 1h like 7d", s)
+	}
+	return d, nil
+}
+
+func (s *CatalogService) ListRetired(ctx context.Context) ([]Retired, error) {
+	return db.ListDocuments[Retired](ctx, *s.Ch, retiredTable)
+}
+
+// RetiredServices returns the names of the retired services
+func (s *CatalogService) RetiredServices(ctx context.Context) ([]string, error) {
+	all, err := s.ListRetired(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(all))
+	for i, r := range all {
+		names[i] = r.Service
+	}
+	return names, nil
+}
+
+// RetireService retires a service by hand
+func (s *CatalogService) RetireService(ctx context.Context, service string) (Retired, error) {
+	r, found, err := db.GetDocument[Retired](ctx, *s.Ch, retiredTable, service)
+	if err != nil || found {
+		return r, err
+	}
+	r = Retired{Service: service, Reason: RetiredManual, RetiredAt: time.Now().UTC()}
+	return r, s.saveRetired(ctx, &r)
+}
+
+// UnretireService brings a retired service back into the catalog
+func (s *CatalogService) UnretireService(ctx context.Context, service string) error {
+	return db.DeleteDocument(ctx, *s.Ch, retiredTable, service)
+}
+
+func (s *CatalogService) saveRetired(ctx context.Context, r *Retired) error {
+	return db.PutDocument(ctx, *s.Ch, retiredTable, r.Service, r.Service, r)
+}
+
+// PurgeService deletes the spans of a retired service. The deletion is a ClickHouse
+// mutation that runs in the background, large tables may take a while.
+func (s *CatalogService) PurgeService(ctx context.Context, service string) (Retired, error) {
+	r, found, err := db.GetDocument[Retired](ctx, *s.Ch, retiredTable, service)
+	if err != nil {
+		return r, err
+	}
+	if !found {
+		return r, ErrNotRetired
+	}
+	err = (*s.Ch).Exec(ctx,
+		"ALTER TABLE "+s.Cluster.AlterTable("denormalized_span")+" DELETE WHERE resource_attributes.value[indexOf(resource_attributes.key, 'service.name')] = ?",
+		service,
+	)
+	if err != nil {
+		return r, fmt.Errorf("failed to delete spans: %w", err)
+	}
+	now := time.Now().UTC()
+	r.PurgedAt = &now
+	return r, s.saveRetired(ctx, &r)
+}
+
+// lastSeen returns when each service last reported a span
+func (s *CatalogService) lastSeen(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := (*s.Ch).Query(ctx, `
+		SELECT
+			resource_attributes.value[indexOf(resource_attributes.key, 'service.name')] AS service_name,
+			fromUnixTimestamp64Nano(max(start_time_unix_nano)) AS last_seen
+		FROM denormalized_span
+		GROUP BY service_name
+		HAVING service_name != ''
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	seen := make(map[string]time.Time)
+	for rows.Next() {
+		var service string
+		var at time.Time
+		if err := rows.Scan(&service, &at); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		seen[service] = at
+	}
+	return seen, rows.Err()
+}
+
+// RetirementDetector retires the services that haven't reported for a while and
+// brings back the retired ones that report again
+type RetirementDetector struct {
+	service   *CatalogService
+	idleAfter time.Duration
+}
+
+func NewRetirementDetector(service *CatalogService, idleAfter time.Duration) *RetirementDetector {
+	return &RetirementDetector{service: service, idleAfter: idleAfter}
+}
+
+// Run checks the services every RetirementCheckInterval until ctx is done
+func (d *RetirementDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(RetirementCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := d.check(ctx, time.Now()); err != nil {
+			log.Printf("catalog: retirement check failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *RetirementDetector) check(ctx context.Context, now time.Time) error {
+	seen, err := d.service.lastSeen(ctx)
+	if err != nil {
+		return err
+	}
+	all, err := d.service.ListRetired(ctx)
+	if err != nil {
+		return err
+	}
+	retired := make(map[string]Retired, len(all))
+	for _, r := range all {
+		retired[r.Service] = r
+	}
+
+	for service, at := range seen {
+		r, ok := retired[service]
+		switch {
+		case ok && at.After(r.RetiredAt):
+			log.Printf("catalog: %s reports again, bringing it back\n", service)
+			if err := d.service.UnretireService(ctx, service); err != nil {
+				return err
+			}
+		case !ok && now.Sub(at) > d.idleAfter:
+			log.Printf("catalog: retiring %s, last seen %s\n", service, at.Format(time.RFC3339))
+			r := Retired{Service: service, Reason: RetiredIdle, LastSeen: at.UTC(), RetiredAt: now.UTC()}
+			if err := d.service.saveRetired(ctx, &r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
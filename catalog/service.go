@@ -0,0 +1,117 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"nabatshy/db"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const metadataTable = "service_metadata"
+
+// Metadata is the manually maintained information about a service, keyed by service name
+type Metadata struct {
+	Service      string    `json:"service"`
+	RunbookURL   string    `json:"runbook_url,omitempty"`
+	DashboardURL string    `json:"dashboard_url,omitempty"`
+	Owner        *Owner    `json:"owner,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Owner is the team responsible for a service and how to reach it
+type Owner struct {
+	Team         string `json:"team"`
+	SlackChannel string `json:"slack_channel,omitempty"`
+	// Escalation is free form, e.g. a PagerDuty service key or an on-call rotation name
+	Escalation string `json:"escalation,omitempty"`
+}
+
+type CatalogService struct {
+	Ch      *clickhouse.Conn
+	Cluster db.Cluster
+}
+
+// Validate checks the metadata
+func (m *Metadata) Validate() error {
+	if m.Service == "" {
+		return fmt.Errorf("service is required")
+	}
+	if err := ValidateURL(m.RunbookURL); err != nil {
+		return fmt.Errorf("invalid runbook_url: %w", err)
+	}
+	if err := ValidateURL(m.DashboardURL); err != nil {
+		return fmt.Errorf("invalid dashboard_url: %w", err)
+	}
+	if m.Owner != nil && m.Owner.Team == "" {
+		return fmt.Errorf("owner team is required")
+	}
+	return nil
+}
+
+// ValidateURL accepts empty strings and absolute http(s) URLs
+func ValidateURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http(s) URL", s)
+	}
+	return nil
+}
+
+func (s *CatalogService) ListMetadata(ctx context.Context) ([]Metadata, error) {
+	return db.ListDocuments[Metadata](ctx, *s.Ch, metadataTable)
+}
+
+func (s *CatalogService) GetMetadata(ctx context.Context, service string) (Metadata, bool, error) {
+	return db.GetDocument[Metadata](ctx, *s.Ch, metadataTable, service)
+}
+
+// MetadataByService returns the metadata of every service that has some
+func (s *CatalogService) MetadataByService(ctx context.Context) (map[string]Metadata, error) {
+	all, err := s.ListMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byService := make(map[string]Metadata, len(all))
+	for _, m := range all {
+		byService[m.Service] = m
+	}
+	return byService, nil
+}
+
+// SaveMetadata creates or replaces the metadata of a service
+func (s *CatalogService) SaveMetadata(ctx context.Context, m *Metadata) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	m.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, metadataTable, m.Service, m.Service, m)
+}
+
+// ServicesOwnedBy returns the metadata of the services owned by team
+func (s *CatalogService) ServicesOwnedBy(ctx context.Context, team string) ([]Metadata, error) {
+	all, err := s.ListMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owned := []Metadata{}
+	for _, m := range all {
+		if m.Owner != nil && m.Owner.Team == team {
+			owned = append(owned, m)
+		}
+	}
+	return owned, nil
+}
+
+func (s *CatalogService) DeleteMetadata(ctx context.Context, service string) error {
+	return db.DeleteDocument(ctx, *s.Ch, metadataTable, service)
+}
@@ -0,0 +1,108 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"nabatshy/db"
+)
+
+const latencyTargetsTable = "latency_targets"
+
+// LatencyTargetPercentiles are the percentiles endpoint metrics are computed for
+var LatencyTargetPercentiles = []int{50, 90, 95, 99}
+
+// LatencyTarget is the latency an endpoint should stay under at a percentile.
+// A target without a service applies to endpoints of that name in every service.
+type LatencyTarget struct {
+	Service     string    `json:"service,omitempty"`
+	Endpoint    string    `json:"endpoint"`
+	Percentile  int       `json:"percentile"`
+	ThresholdMs float64   `json:"threshold_ms"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Compliance is an endpoint's current latency measured against its target
+type Compliance struct {
+	Percentile  int     `json:"percentile"`
+	ThresholdMs float64 `json:"threshold_ms"`
+	CurrentMs   float64 `json:"current_ms"`
+	Breached    bool    `json:"breached"`
+}
+
+// LatencyTargets looks up targets by service and endpoint
+type LatencyTargets map[string]LatencyTarget
+
+// Validate checks the target
+func (t *LatencyTarget) Validate() error {
+	if t.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	valid := false
+	for _, p := range LatencyTargetPercentiles {
+		valid = valid || t.Percentile == p
+	}
+	if !valid {
+		return fmt.Errorf("percentile must be one of %v", LatencyTargetPercentiles)
+	}
+	if t.ThresholdMs <= 0 {
+		return fmt.Errorf("threshold_ms must be positive")
+	}
+	return nil
+}
+
+// latencyTargetID escapes both parts so endpoints containing slashes can't collide
+func latencyTargetID(service, endpoint string) string {
+	return url.PathEscape(service) + "/" + url.PathEscape(endpoint)
+}
+
+func (s *CatalogService) ListLatencyTargets(ctx context.Context) ([]LatencyTarget, error) {
+	return db.ListDocuments[LatencyTarget](ctx, *s.Ch, latencyTargetsTable)
+}
+
+// LatencyTargets returns all targets for lookups with Check
+func (s *CatalogService) LatencyTargets(ctx context.Context) (LatencyTargets, error) {
+	all, err := s.ListLatencyTargets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(LatencyTargets, len(all))
+	for _, t := range all {
+		targets[latencyTargetID(t.Service, t.Endpoint)] = t
+	}
+	return targets, nil
+}
+
+// SaveLatencyTarget creates or replaces the target of an endpoint
+func (s *CatalogService) SaveLatencyTarget(ctx context.Context, t *LatencyTarget) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	t.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, latencyTargetsTable, latencyTargetID(t.Service, t.Endpoint), t.Endpoint, t)
+}
+
+func (s *CatalogService) DeleteLatencyTarget(ctx context.Context, service, endpoint string) error {
+	return db.DeleteDocument(ctx, *s.Ch, latencyTargetsTable, latencyTargetID(service, endpoint))
+}
+
+// Check returns the compliance of an endpoint with its target, preferring a target
+// of the same service over one for all services, or nil when it has no target.
+// percentiles maps each of LatencyTargetPercentiles to the endpoint's current value.
+func (t LatencyTargets) Check(service, endpoint string, percentiles map[int]float64) *Compliance {
+	target, ok := t[latencyTargetID(service, endpoint)]
+	if !ok {
+		if target, ok = t[latencyTargetID("", endpoint)]; !ok {
+			return nil
+		}
+	}
+	current := percentiles[target.Percentile]
+	return &Compliance{
+		Percentile:  target.Percentile,
+		ThresholdMs: target.ThresholdMs,
+		CurrentMs:   current,
+		Breached:    current > target.ThresholdMs,
+	}
+}
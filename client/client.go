@@ -0,0 +1,282 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a thin typed client for the nabatshy query API
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Token is sent as a bearer token to servers with authentication, a session
+	// token of the UI or an ID token of the provider
+	Token string
+}
+
+// APIError is returned when the API responds with a non 2xx status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("nabatshy api error (%d): %s", e.StatusCode, e.Message)
+}
+
+// New returns a client for the API at baseURL, e.g. "http://localhost:3000"
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// Search returns a page of spans matching the query
+func (c *Client) Search(ctx context.Context, q Query) (*SearchResponse, error) {
+	var resp SearchResponse
+	if err := c.get(ctx, "/v1/search", q.values(), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ExportSearch streams every span matching the query to fn, ignoring paging.
+// Large exports can take longer than the default HTTPClient timeout.
+func (c *Client) ExportSearch(ctx context.Context, q Query, fn func(SearchResult) error) error {
+	params := q.values()
+	params.Del("page")
+	params.Del("pageSize")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/v1/search/export?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return &APIError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(body)),
+		}
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var r SearchResult
+		if err := dec.Decode(&r); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+}
+
+// SearchMetrics returns the percentile, count and average duration series of the
+// spans matching the query
+func (c *Client) SearchMetrics(ctx context.Context, q Query, percentile int) (*CombinedMetricsResult, error) {
+	params := q.values()
+	params.Set("percentile", strconv.Itoa(percentile))
+
+	var resp CombinedMetricsResult
+	if err := c.get(ctx, "/api/metrics/search", params, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// TraceDetails returns all spans of a trace ordered by start time
+func (c *Client) TraceDetails(ctx context.Context, traceID string) ([]TraceSpan, error) {
+	var spans []TraceSpan
+	if err := c.get(ctx, "/v1/traces/"+url.PathEscape(traceID), nil, &spans); err != nil {
+		return nil, err
+	}
+	return spans, nil
+}
+
+// TraceFlamegraph returns the span tree of a trace folded into a flamegraph
+func (c *Client) TraceFlamegraph(ctx context.Context, traceID string) (*FlameNode, error) {
+	var flamegraph FlameNode
+	if err := c.get(ctx, "/v1/traces/"+url.PathEscape(traceID)+"/flamegraph", nil, &flamegraph); err != nil {
+		return nil, err
+	}
+	return &flamegraph, nil
+}
+
+// Flamegraph returns a flamegraph aggregated over up to limit traces matching q,
+// the server default is used when limit is 0
+func (c *Client) Flamegraph(ctx context.Context, q Query, limit int) (*FlameNode, error) {
+	params := q.values()
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	var flamegraph FlameNode
+	if err := c.get(ctx, "/v1/flamegraph", params, &flamegraph); err != nil {
+		return nil, err
+	}
+	return &flamegraph, nil
+}
+
+// SpanDetails returns a single span with its attributes and duration statistics
+func (c *Client) SpanDetails(ctx context.Context, spanID string) (*SpanDetail, error) {
+	var detail SpanDetail
+	if err := c.get(ctx, "/v1/spans/"+url.PathEscape(spanID), nil, &detail); err != nil {
+		return nil, err
+	}
+	return &detail, nil
+}
+
+// SourceLink returns a deep link to the code that produced a span
+func (c *Client) SourceLink(ctx context.Context, spanID string) (*SourceLink, error) {
+	var link SourceLink
+	if err := c.get(ctx, "/v1/spans/"+url.PathEscape(spanID)+"/source", nil, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// AttributeKeys returns the attribute keys seen in the query's time window
+// starting with prefix
+func (c *Client) AttributeKeys(ctx context.Context, q Query, prefix string) ([]AttributeKey, error) {
+	params := q.values()
+	if prefix != "" {
+		params.Set("prefix", prefix)
+	}
+
+	var keys []AttributeKey
+	if err := c.get(ctx, "/v1/attributes/keys", params, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Services returns the names of all services that reported spans
+func (c *Client) Services(ctx context.Context) ([]string, error) {
+	var services []string
+	if err := c.get(ctx, "/api/services", nil, &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// ServiceCatalog returns the services seen in the query's time window with their
+// span counts, last seen time and top versions/environments
+func (c *Client) ServiceCatalog(ctx context.Context, q Query) ([]ServiceCatalogEntry, error) {
+	var services []ServiceCatalogEntry
+	if err := c.get(ctx, "/v1/services", q.values(), &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// ServiceHealth returns the health score of every service active in the query's
+// time window, least healthy first
+func (c *Client) ServiceHealth(ctx context.Context, q Query) ([]ServiceHealth, error) {
+	var health []ServiceHealth
+	if err := c.get(ctx, "/v1/services/health", q.values(), &health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+// DisplayRules returns the rules for categorizing spans, clients can apply them with Categorize
+func (c *Client) DisplayRules(ctx context.Context) (*DisplayRules, error) {
+	var resp DisplayRules
+	if err := c.get(ctx, "/v1/display-rules", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, params url.Values, out any) error {
+	u := c.BaseURL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return &APIError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(body)),
+		}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return c.HTTPClient.Do(req)
+}
+
+func (q Query) values() url.Values {
+	params := url.Values{}
+	if q.Query != "" {
+		params.Set("query", q.Query)
+	}
+	if !q.Start.IsZero() && !q.End.IsZero() {
+		params.Set("start", q.Start.Format(time.RFC3339))
+		params.Set("end", q.End.Format(time.RFC3339))
+	} else if q.TimeRange != "" {
+		params.Set("timeRange", q.TimeRange)
+	}
+	if q.Page > 0 {
+		params.Set("page", strconv.Itoa(q.Page))
+	}
+	if q.PageSize > 0 {
+		params.Set("pageSize", strconv.Itoa(q.PageSize))
+	}
+	if q.SortField != "" {
+		params.Set("sortField", q.SortField)
+	}
+	if q.SortOrder != "" {
+		params.Set("sortOrder", q.SortOrder)
+	}
+	if q.TraceOrSpan != "" {
+		params.Set("traceOrSpan", q.TraceOrSpan)
+	}
+	if q.IncludeFacets {
+		params.Set("includeFacets", "true")
+	}
+	if q.Approx {
+		params.Set("approx", "true")
+	}
+	if q.Project != "" {
+		params.Set("project", q.Project)
+	}
+	return params
+}
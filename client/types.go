@@ -0,0 +1,52 @@
+package client
+
+import (
+	"time"
+
+	"nabatshy/api"
+	"nabatshy/display"
+)
+
+// Response types are shared with the api package so the client always decodes
+// exactly what the server encodes
+type (
+	SearchResponse        = api.SearchResponse
+	SearchResult          = api.SearchResult
+	SearchFacets          = api.SearchFacets
+	ResponseMeta          = api.ResponseMeta
+	FacetBucket           = api.FacetBucket
+	CombinedMetricsResult = api.CombinedMetricsResult
+	TraceSpan             = api.TraceSpan
+	SpanDetail            = api.SpanDetail
+	SpanEvent             = api.SpanEvent
+	AttributeKey          = api.AttributeKey
+	TimeCount             = api.TimeCount
+	TimePercentile        = api.TimePercentile
+	EndpointMetrics       = api.EndpointMetrics
+	ServiceMetrics        = api.ServiceMetrics
+	ServiceCatalogEntry   = api.ServiceCatalogEntry
+	ServiceHealth         = api.ServiceHealth
+	FlameNode             = api.FlameNode
+	SourceLink            = api.SourceLink
+	DisplayRules          = display.Rules
+)
+
+// Query describes a search over spans. Either Start and End or TimeRange
+// (e.g. "1h", "7d") selects the window, Start/End win when both are set.
+type Query struct {
+	Query       string
+	Start       time.Time
+	End         time.Time
+	TimeRange   string
+	Page        int
+	PageSize    int
+	SortField   string // "start_time", "end_time", or "duration"
+	SortOrder   string // "asc" or "desc"
+	TraceOrSpan string // "trace", "span" or "" for both
+	// IncludeFacets adds bucketed counts of all matching spans to search responses
+	IncludeFacets bool
+	// Approx trades exact distinct counts for speed on large ranges
+	Approx bool
+	// Project limits results to the services of a project
+	Project string
+}
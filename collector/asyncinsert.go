@@ -0,0 +1,106 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"nabatshy/db"
+	"nabatshy/metrics"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// InsertMode is how the collector writes batches to ClickHouse
+type InsertMode string
+
+const (
+	// InsertSync writes every batch as its own insert, the default
+	InsertSync InsertMode = "sync"
+	// InsertAsync lets ClickHouse buffer batches with other inserts and answers once
+	// the buffer is flushed
+	InsertAsync InsertMode = "async"
+	// InsertAsyncNoWait answers as soon as ClickHouse buffered the batch, spans are
+	// lost if the server goes down before flushing it
+	InsertAsyncNoWait InsertMode = "async-nowait"
+)
+
+// ParseInsertMode parses the INGEST_INSERT_MODE value, empty is sync
+func ParseInsertMode(s string) (InsertMode, error) {
+	switch InsertMode(s) {
+	case "":
+		return InsertSync, nil
+	case InsertSync, InsertAsync, InsertAsyncNoWait:
+		return InsertMode(s), nil
+	}
+	return "", fmt.Errorf("invalid insert mode %q, use sync, async or async-nowait", s)
+}
+
+// insertContext returns the context of the insert of a batch in the mode, token
+// deduplicates the batch, see dedupToken. ClickHouse only deduplicates async inserts
+// into replicated tables.
+func (m InsertMode) insertContext(ctx context.Context, token string) context.Context {
+	settings := clickhouse.Settings{"insert_deduplication_token": token}
+	if m == InsertAsync || m == InsertAsyncNoWait {
+		wait := 0
+		if m == InsertAsync {
+			wait = 1
+		}
+		settings["async_insert"] = 1
+		settings["wait_for_async_insert"] = wait
+		settings["async_insert_deduplicate"] = 1
+	}
+	return clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+}
+
+// insert writes a batch of denormalized spans to the database. Async inserts that
+// ClickHouse rejects, e.g. a server without async insert support, are retried as a
+// synchronous batch. Unreachable servers aren't, the WAL takes care of those.
+func (s *TelemetryCollectorService) insert(ctx context.Context, spans []utils.Span) error {
+	opts := utils.InsertOptions{
+		Promoted:       s.Promoted,
+		JSONAttributes: s.JSONAttributes,
+	}
+	n := float64(len(spans))
+	token := dedupToken(spans)
+	if s.InsertMode == "" || s.InsertMode == InsertSync {
+		err := InsertDenormalizedSpans(s.Ch, InsertSync.insertContext(ctx, token), spans, opts)
+		if err == nil {
+			metrics.SpansInserted.Add(n, "sync")
+		}
+		return err
+	}
+
+	err := InsertDenormalizedSpans(s.Ch, s.InsertMode.insertContext(ctx, token), spans, opts)
+	if err == nil {
+		if s.InsertMode == InsertAsync {
+			metrics.SpansInserted.Add(n, "acknowledged")
+		} else {
+			metrics.SpansInserted.Add(n, "fire_and_forget")
+		}
+		return nil
+	}
+	if utils.IsUnavailable(err) {
+		return err
+	}
+
+	log.Printf("collector: async insert failed, falling back to a synchronous batch: %v\n", err)
+	if err := InsertDenormalizedSpans(s.Ch, InsertSync.insertContext(ctx, token), spans, opts); err != nil {
+		return err
+	}
+	metrics.SpansInserted.Add(n, "fallback")
+	return nil
+}
+
+// FlushAsyncInserts has ClickHouse write the batches it buffered for async-nowait
+// inserts, on shutdown. Those spans were acknowledged already and would be lost if
+// ClickHouse went down before flushing them, like in a restart of both during a
+// deploy. Every replica or cluster node buffers its own inserts, so all of them are
+// flushed. Nothing is buffered in the other modes.
+func FlushAsyncInserts(ctx context.Context, ch clickhouse.Conn, cluster db.Cluster, mode InsertMode) error {
+	if mode != InsertAsyncNoWait {
+		return nil
+	}
+	return db.ExecEverywhere(ctx, ch, cluster, "SYSTEM FLUSH ASYNC INSERT QUEUE")
+}
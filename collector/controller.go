@@ -2,12 +2,18 @@ package collector
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 
+	"nabatshy/health"
+	"nabatshy/jaeger"
+	"nabatshy/metrics"
 	"nabatshy/utils"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
@@ -21,6 +27,10 @@ import (
 
 type Span = utils.Span
 
+// ImportHeader set to true marks an OTLP export as an import of past traces, whose
+// spans aren't rejected for being too old, see ImportTrace
+const ImportHeader = "X-Nabatshy-Import"
+
 type TelemetryCollectorController struct {
 	service TelemetryCollectorService
 }
@@ -53,20 +63,11 @@ func (c *TelemetryCollectorController) ingestTraceHTTPRequest(w http.ResponseWri
 		}
 	case "application/json":
 		{
-
-			if protoErr := protojson.Unmarshal(body, &req); protoErr != nil {
-				fmt.Println("Cannot marshal json data. Will try the old OTEL format...")
-				// try to handle the old format (instrumentationLibrary)
-				oldFormatErr := c.formatOldOTELData(body, &req)
-				if oldFormatErr != nil {
-					fmt.Println("json err", protoErr)
-					http.Error(w, "invalid json: "+protoErr.Error(), http.StatusBadRequest)
-					return
-				}
+			if jsonErr := UnmarshalJSON(body, &req); jsonErr != nil {
+				fmt.Println("json err", jsonErr)
+				http.Error(w, "invalid json: "+jsonErr.Error(), http.StatusBadRequest)
+				return
 			}
-
-			fmt.Printf("ingesting trace: %v\n", req)
-
 		}
 	default:
 		{
@@ -76,25 +77,122 @@ func (c *TelemetryCollectorController) ingestTraceHTTPRequest(w http.ResponseWri
 		}
 	}
 
-	ingestionErr := c.service.ingestTrace(&req)
+	c.service.Tap.capture(&req, r, time.Now())
+
+	ingest := c.service.IngestTrace
+	if r.Header.Get(ImportHeader) == "true" {
+		ingest = c.service.ImportTrace
+	}
+	rejected, ingestionErr := ingest(&req)
 	if ingestionErr != nil {
-		errMsg := fmt.Sprintf("ingestion err: %v\n", ingestionErr)
-		fmt.Println(errMsg)
-		panic(errMsg)
+		fmt.Println("ingestion err:", ingestionErr)
+		retryLater(w, "ingestion failed: "+ingestionErr.Error())
+		return
 	}
-	// Send empty success response
+	writeExportResponse(w, contentType, rejected)
+}
+
+// ingestRetryAfter is when exporters are told to retry a failed export
+const ingestRetryAfter = 5 * time.Second
+
+// retryLater fails an export with 503 and Retry-After, which OTLP exporters retry,
+// instead of losing the spans
+func retryLater(w http.ResponseWriter, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(ingestRetryAfter.Seconds())))
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// writeExportResponse reports the rejected spans as a partial success, the response
+// is empty when every span was accepted
+func writeExportResponse(w http.ResponseWriter, contentType string, rejected Rejections) {
 	resp := &coltrace.ExportTraceServiceResponse{}
-	out, err := proto.Marshal(resp)
+	if n := rejected.Total(); n > 0 {
+		resp.PartialSuccess = &coltrace.ExportTracePartialSuccess{
+			RejectedSpans: n,
+			ErrorMessage:  rejected.String(),
+		}
+	}
+	marshal := proto.Marshal
+	if contentType == "application/json" {
+		marshal = protojson.Marshal
+	}
+	out, err := marshal(resp)
 	if err != nil {
 		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(http.StatusOK)
 	w.Write(out)
 }
 
-func (c *TelemetryCollectorController) formatOldOTELData(
+// importJaegerHTTPRequest stores the traces of a Jaeger JSON export, like the
+// "Download JSON" of the Jaeger UI, answering like an OTLP/JSON export. Its spans
+// may be older than the span age bound.
+func (c *TelemetryCollectorController) importJaegerHTTPRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := jaeger.Convert(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Jaeger exports are saved investigations, often older than the span age bound
+	rejected, err := c.service.ImportTrace(req)
+	if err != nil {
+		retryLater(w, "ingestion failed: "+err.Error())
+		return
+	}
+	writeExportResponse(w, "application/json", rejected)
+}
+
+// UnmarshalJSON decodes an OTLP/JSON export, or one of the old format with
+// instrumentationLibrary instead of scope
+func UnmarshalJSON(data []byte, req *coltrace.ExportTraceServiceRequest) error {
+	if err := protojson.Unmarshal(data, req); err != nil {
+		if formatOldOTELData(data, req) != nil {
+			return err
+		}
+	}
+	decodeHexIDs(req)
+	return nil
+}
+
+// decodeHexIDs fixes the IDs protojson decoded as base64 where OTLP/JSON has them in
+// hex. A 32 or 16 digit hex ID is valid base64 decoding to 24 or 12 bytes, encoding
+// those back gives the hex digits. IDs sent as base64 by older exporters are already
+// 16 and 8 bytes and kept.
+func decodeHexIDs(req *coltrace.ExportTraceServiceRequest) {
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				span.TraceId = decodeHexID(span.TraceId, 16)
+				span.SpanId = decodeHexID(span.SpanId, 8)
+				span.ParentSpanId = decodeHexID(span.ParentSpanId, 8)
+				for _, link := range span.Links {
+					link.TraceId = decodeHexID(link.TraceId, 16)
+					link.SpanId = decodeHexID(link.SpanId, 8)
+				}
+			}
+		}
+	}
+}
+
+func decodeHexID(id []byte, size int) []byte {
+	if len(id) != size*3/2 {
+		return id
+	}
+	decoded, err := hex.DecodeString(base64.StdEncoding.EncodeToString(id))
+	if err != nil {
+		return id
+	}
+	return decoded
+}
+
+func formatOldOTELData(
 	data []byte,
 	req *coltrace.ExportTraceServiceRequest,
 ) error {
@@ -224,6 +322,7 @@ func (c *TelemetryCollectorController) formatOldOTELData(
 
 func (c *TelemetryCollectorController) RegisterRoutes(r chi.Router) {
 	r.Post("/v1/traces", c.ingestTraceHTTPRequest)
+	r.Post("/v1/import/jaeger", c.importJaegerHTTPRequest)
 }
 
 func InsertResource(
@@ -304,21 +403,81 @@ func generateUUID() string {
 	return uuid.New().String()
 }
 
-func Run(conn clickhouse.Conn) {
+// Options configures the collector
+type Options struct {
+	Promoted []utils.PromotedAttribute
+	// JSONAttributes stores attributes in the attributes_json column
+	JSONAttributes bool
+	// Tracker records what was ingested per trace, may be nil
+	Tracker *IngestTracker
+	// Tap mirrors sampled payloads for debugging, may be nil
+	Tap *IngestTap
+	// WAL buffers spans while ClickHouse is unreachable, may be nil. Its Run is left to the caller.
+	WAL *WAL
+	// Limiter caps the spans stored per trace, may be nil
+	Limiter *TraceLimiter
+	// Sampler drops traces by the sampling rules, may be nil
+	Sampler *Sampler
+	// Drainer rejects exports while the collector drains, may be nil. Its Run is left to the caller.
+	Drainer *Drainer
+	// Checks are added to the readiness checks of the database or WAL
+	Checks []health.Check
+	// InsertMode is how batches are written, sync when empty
+	InsertMode InsertMode
+	// Validation rejects malformed spans, the zero Validation only checks their IDs
+	// and the order of their timestamps
+	Validation Validation
+}
+
+// NewService returns the service storing the spans of exports
+func NewService(conn clickhouse.Conn, opts Options) *TelemetryCollectorService {
 	db := goqu.Dialect("default")
-	telService := TelemetryCollectorService{
-		Ch: &conn,
-		DB: &db,
+	return &TelemetryCollectorService{
+		Ch:             &conn,
+		DB:             &db,
+		Promoted:       opts.Promoted,
+		JSONAttributes: opts.JSONAttributes,
+		Tracker:        opts.Tracker,
+		Tap:            opts.Tap,
+		WAL:            opts.WAL,
+		InsertMode:     opts.InsertMode,
+		Limiter:        opts.Limiter,
+		Sampler:        opts.Sampler,
+		Validation:     opts.Validation,
+	}
+}
+
+// NewHandler returns the OTLP receiver router
+func NewHandler(conn clickhouse.Conn, opts Options) http.Handler {
+	telService := *NewService(conn, opts)
+	if opts.WAL != nil {
+		replay := telService
+		if replay.InsertMode == InsertAsyncNoWait {
+			// spans leave the WAL once inserted, so replays wait for ClickHouse to flush them
+			replay.InsertMode = InsertAsync
+		}
+		opts.WAL.insert = replay.insert
+		opts.WAL.tracker = opts.Tracker
 	}
 	telController := TelemetryCollectorController{
 		service: telService,
 	}
 
 	r := chi.NewRouter()
-
-	telController.RegisterRoutes(r)
-	// Start HTTP server
-	addr := ":4318"
-	log.Printf("listening on %s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, r))
+	r.Use(metrics.Middleware("collector"))
+
+	r.Group(func(r chi.Router) {
+		r.Use(opts.Drainer.Middleware)
+		telController.RegisterRoutes(r)
+	})
+	// with a WAL spans are accepted while ClickHouse is down, until the WAL fills up
+	checks := []health.Check{health.ClickHouse(conn), health.SchemaVersion(conn)}
+	if opts.WAL != nil {
+		checks = []health.Check{{Name: "wal", Run: opts.WAL.Check}}
+	}
+	if opts.Drainer != nil {
+		checks = append(checks, health.Check{Name: "drain", Run: opts.Drainer.Check})
+	}
+	health.NewHealthController(append(checks, opts.Checks...)...).RegisterRoutes(r)
+	return r
 }
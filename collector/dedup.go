@@ -0,0 +1,30 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+
+	"nabatshy/utils"
+)
+
+// dedupToken identifies a batch by the IDs and start times of its spans. It's the
+// insert_deduplication_token of the batch's insert, ClickHouse drops an insert whose
+// token is among those of the last inserts of the table, so a batch retried by an
+// exporter or replayed from the WAL after an insert that did succeed is stored once.
+// ClickHouse takes one token per insert, not per row, so a span retried along with
+// other spans than the first time still gets stored twice, the queries counting spans
+// read each once by trace_id and span_id for that, see api.uniqueSpans.
+func dedupToken(spans []utils.Span) string {
+	h := sha256.New()
+	var start [8]byte
+	for _, s := range spans {
+		h.Write([]byte(s.TraceID))
+		h.Write([]byte{0})
+		h.Write([]byte(s.SpanID))
+		h.Write([]byte{0})
+		binary.BigEndian.PutUint64(start[:], uint64(s.StartTimeUnixNano))
+		h.Write(start[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,214 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"nabatshy/openapi"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// drainRetryAfter is how long exporters are asked to wait before retrying on
+// another collector behind the load balancer
+const drainRetryAfter = 5 * time.Second
+
+// drainPollInterval is how often a drain checks for in-flight exports
+const drainPollInterval = 100 * time.Millisecond
+
+// Drainer takes a collector out of rotation for rolling upgrades. While draining,
+// exports are rejected with 503 and Retry-After so exporters retry elsewhere, the
+// collector reports not ready, and once in-flight exports finished the WAL is
+// replayed. The instance can be stopped without losing spans once it's drained.
+type Drainer struct {
+	wal *WAL
+
+	mu       sync.Mutex
+	draining bool
+	inFlight int
+	drained  bool
+	err      error
+	// start wakes Run when a drain begins
+	start chan struct{}
+}
+
+func NewDrainer(wal *WAL) *Drainer {
+	return &Drainer{wal: wal, start: make(chan struct{}, 1)}
+}
+
+// DrainStatus is the state of a drain
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+	// InFlight is the exports still being ingested
+	InFlight int   `json:"in_flight"`
+	WALBytes int64 `json:"wal_bytes"`
+	// Drained is set once nothing is in flight or buffered, the instance can be stopped
+	Drained bool   `json:"drained"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Drain stops accepting exports and starts flushing
+func (d *Drainer) Drain() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return
+	}
+	d.draining, d.drained, d.err = true, false, nil
+	select {
+	case d.start <- struct{}{}:
+	default:
+	}
+	log.Println("collector: draining")
+}
+
+// Resume accepts exports again
+func (d *Drainer) Resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		return
+	}
+	d.draining, d.drained, d.err = false, false, nil
+	log.Println("collector: resumed")
+}
+
+func (d *Drainer) Status() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := DrainStatus{Draining: d.draining, InFlight: d.inFlight, Drained: d.drained}
+	if d.wal != nil {
+		status.WALBytes = d.wal.Size()
+	}
+	if d.err != nil {
+		status.Error = d.err.Error()
+	}
+	return status
+}
+
+// Run flushes the collector whenever a drain begins, until ctx is done
+func (d *Drainer) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.start:
+		}
+		d.flush(ctx)
+	}
+}
+
+// flush waits for in-flight exports, then replays the WAL until it's empty. It
+// gives up when the drain is cancelled.
+func (d *Drainer) flush(ctx context.Context) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	lastReplay := time.Time{}
+	for {
+		d.mu.Lock()
+		draining, inFlight := d.draining, d.inFlight
+		d.mu.Unlock()
+		if !draining {
+			return
+		}
+		// a replay that failed, e.g. while ClickHouse is down, is retried at the WAL's
+		// own interval
+		if inFlight == 0 && time.Since(lastReplay) >= walReplayInterval {
+			err := d.wal.Flush(ctx)
+			lastReplay = time.Now()
+			d.mu.Lock()
+			d.err = err
+			if err == nil && !d.wal.Pending() && d.draining {
+				d.drained = true
+				d.mu.Unlock()
+				log.Println("collector: drained")
+				return
+			}
+			d.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Middleware rejects exports while draining and counts the ones in flight
+func (d *Drainer) Middleware(next http.Handler) http.Handler {
+	if d == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		if d.draining {
+			d.mu.Unlock()
+			w.Header().Set("Retry-After", strconv.Itoa(int(drainRetryAfter.Seconds())))
+			http.Error(w, "collector is draining", http.StatusServiceUnavailable)
+			return
+		}
+		d.inFlight++
+		d.mu.Unlock()
+		defer func() {
+			d.mu.Lock()
+			d.inFlight--
+			d.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Check fails while draining so the load balancer stops routing to the collector
+func (d *Drainer) Check(ctx context.Context) error {
+	if d.Status().Draining {
+		return errors.New("collector is draining")
+	}
+	return nil
+}
+
+// DrainController lets a deploy take the collector of this instance out of rotation
+type DrainController struct {
+	drainer *Drainer
+}
+
+func NewDrainController(drainer *Drainer) *DrainController {
+	return &DrainController{drainer: drainer}
+}
+
+func (c *DrainController) getDrain(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJSON(w, r, c.drainer.Status())
+}
+
+// startDrain begins a drain, callers poll GET until drained is set
+func (c *DrainController) startDrain(w http.ResponseWriter, r *http.Request) {
+	c.drainer.Drain()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	utils.WriteJSON(w, r, c.drainer.Status())
+}
+
+func (c *DrainController) resume(w http.ResponseWriter, r *http.Request) {
+	c.drainer.Resume()
+	utils.WriteJSON(w, r, c.drainer.Status())
+}
+
+func (c *DrainController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/admin/drain", Summary: "Drain status of the collector", Response: DrainStatus{}},
+		{Method: http.MethodPost, Path: "/v1/admin/drain", Summary: "Drain the collector, poll GET until drained is set",
+			Response: DrainStatus{}, Status: http.StatusAccepted},
+		{Method: http.MethodDelete, Path: "/v1/admin/drain", Summary: "Resume accepting exports", Response: DrainStatus{}},
+	}
+}
+
+func (c *DrainController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/admin/drain", c.getDrain)
+	r.Post("/v1/admin/drain", c.startDrain)
+	r.Delete("/v1/admin/drain", c.resume)
+}
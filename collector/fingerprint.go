@@ -0,0 +1,77 @@
+package collector
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// Event attributes added to exception events at ingest, exception.message is kept as sent
+const (
+	FingerprintAttribute       = "exception.fingerprint"
+	NormalizedMessageAttribute = "exception.normalized_message"
+)
+
+const maxNormalizedMessageLength = 512
+
+// messageNormalizers replace the variable parts of exception messages, in order,
+// so messages that only differ by IDs or values share a fingerprint
+var messageNormalizers = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), "<uuid>"},
+	{regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`), "<email>"},
+	{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`(?i)\b0x[0-9a-f]+\b`), "<hex>"},
+	// hex IDs such as object ids and hashes, at least one digit so words aren't replaced
+	{regexp.MustCompile(`(?i)\b[0-9a-f]*[0-9][0-9a-f]*[a-f][0-9a-f]*\b|\b[0-9a-f]*[a-f][0-9a-f]*[0-9][0-9a-f]*\b`), "<hex>"},
+	// quoted values such as Python's KeyError: 'user_42' or Java's For input string: "abc"
+	{regexp.MustCompile(`'[^']*'|"[^"]*"|` + "`[^`]*`"), "<str>"},
+	{regexp.MustCompile(`[-+]?\d+(\.\d+)?`), "<num>"},
+	{regexp.MustCompile(`\s+`), " "},
+}
+
+// NormalizeExceptionMessage strips IDs, numbers, hex values and quoted strings from
+// the first line of an exception message
+func NormalizeExceptionMessage(message string) string {
+	message, _, _ = strings.Cut(message, "\n")
+	for _, n := range messageNormalizers {
+		message = n.pattern.ReplaceAllString(message, n.replace)
+	}
+	message = strings.TrimSpace(message)
+	if len(message) > maxNormalizedMessageLength {
+		message = message[:maxNormalizedMessageLength]
+	}
+	return message
+}
+
+// normalizeExceptionType makes the type comparable across SDKs, e.g. Go reports
+// pointer types as *fs.PathError while other SDKs never prefix the type
+func normalizeExceptionType(typ string) string {
+	return strings.TrimLeft(strings.TrimSpace(typ), "*")
+}
+
+// ExceptionFingerprint returns a stable group ID for an exception and its normalized message.
+// When an SDK doesn't send a message the first line of the stack trace is used instead.
+func ExceptionFingerprint(typ, message, stacktrace string) (string, string) {
+	if message == "" {
+		message = strings.TrimSpace(stacktrace)
+	}
+	normalized := NormalizeExceptionMessage(message)
+	sum := sha1.Sum([]byte(normalizeExceptionType(typ) + "\n" + normalized))
+	return hex.EncodeToString(sum[:8]), normalized
+}
+
+// fingerprintException adds the fingerprint attributes to exception events
+func fingerprintException(name string, attrs map[string]string) {
+	if name != "exception" {
+		return
+	}
+	typ, message := attrs["exception.type"], attrs["exception.message"]
+	if typ == "" && message == "" {
+		return
+	}
+	attrs[FingerprintAttribute], attrs[NormalizedMessageAttribute] = ExceptionFingerprint(typ, message, attrs["exception.stacktrace"])
+}
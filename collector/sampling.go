@@ -0,0 +1,249 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"nabatshy/metrics"
+	"nabatshy/openapi"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultSamplerCapacity is how many traces the sampler remembers the rule of
+const DefaultSamplerCapacity = 100000
+
+// SampleRateAttribute is set on spans kept by a rule with a rate below 1, so counts
+// can be scaled back up
+const SampleRateAttribute = "nabatshy.sample_rate"
+
+// SamplingRule keeps Rate of the traces with a span whose Key is Value. Key is "name"
+// for the span name, otherwise a span or resource attribute like http.route. A Value
+// ending with * matches by prefix.
+type SamplingRule struct {
+	Key   string  `json:"key"`
+	Value string  `json:"value"`
+	Rate  float64 `json:"rate"`
+}
+
+func (r SamplingRule) matches(span *utils.Span) bool {
+	value, ok := span.Name, true
+	if r.Key != "name" {
+		value, ok = spanAttribute(span, r.Key)
+	}
+	if !ok {
+		return false
+	}
+	if prefix, found := strings.CutSuffix(r.Value, "*"); found {
+		return strings.HasPrefix(value, prefix)
+	}
+	return value == r.Value
+}
+
+func spanAttribute(span *utils.Span, key string) (string, bool) {
+	for _, a := range span.SpanAttributes {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+	for _, a := range span.ResourceAttributes {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// ParseSamplingRules parses the SAMPLING_RULES value, rules separated by ; like
+//
+//	http.route=/healthz:0.01;name=GET /checkout:1;http.route=/internal/*:0.1
+//
+// The first rule matching a trace applies, traces matching none are all kept.
+func ParseSamplingRules(s string) ([]SamplingRule, error) {
+	var rules []SamplingRule
+	for _, part := range strings.Split(s, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i, j := strings.Index(part, "="), strings.LastIndex(part, ":")
+		if i <= 0 || j < i {
+			return nil, fmt.Errorf("invalid sampling rule %q, expected key=value:rate", part)
+		}
+		rate, err := strconv.ParseFloat(part[j+1:], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid sampling rule %q, use a rate between 0 and 1", part)
+		}
+		rules = append(rules, SamplingRule{Key: part[:i], Value: part[i+1 : j], Rate: rate})
+	}
+	return rules, nil
+}
+
+// SamplingRuleStats counts the spans a rule applied to
+type SamplingRuleStats struct {
+	SamplingRule
+	Kept    uint64 `json:"kept"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Sampler drops a share of traces by rules, e.g. most health checks, before they're
+// stored. The decision is a hash of the trace ID, so every collector keeps the same
+// traces. A trace's rule is remembered for the most recently seen traces so its later
+// spans, like client spans with other names, follow it, spans received before the
+// span matching a rule are kept.
+type Sampler struct {
+	rules []SamplingRule
+
+	mu       sync.Mutex
+	capacity int
+	// decisions holds the index of the rule applying to a trace
+	decisions map[string]int
+	order     []string
+	next      int
+	kept      []uint64
+	dropped   []uint64
+}
+
+func NewSampler(rules []SamplingRule, capacity int) *Sampler {
+	return &Sampler{
+		rules:     rules,
+		capacity:  capacity,
+		decisions: make(map[string]int, capacity),
+		order:     make([]string, 0, capacity),
+		kept:      make([]uint64, len(rules)),
+		dropped:   make([]uint64, len(rules)),
+	}
+}
+
+// sample returns the spans of the traces that are kept
+func (s *Sampler) sample(spans []utils.Span) []utils.Span {
+	if s == nil || len(s.rules) == 0 {
+		return spans
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the first rule matching any span of a trace in the batch applies to all of them
+	batch := make(map[string]int)
+	for i := range spans {
+		for r, rule := range s.rules {
+			if rule.matches(&spans[i]) {
+				if prev, ok := batch[spans[i].TraceID]; !ok || r < prev {
+					batch[spans[i].TraceID] = r
+				}
+				break
+			}
+		}
+	}
+	for traceID, r := range batch {
+		s.decide(traceID, r)
+	}
+
+	sampled := spans[:0]
+	for _, span := range spans {
+		r, ok := batch[span.TraceID]
+		if !ok {
+			r, ok = s.decisions[span.TraceID]
+		}
+		if !ok {
+			sampled = append(sampled, span)
+			continue
+		}
+		rate := s.rules[r].Rate
+		if !keepTrace(span.TraceID, rate) {
+			s.dropped[r]++
+			continue
+		}
+		s.kept[r]++
+		if rate < 1 {
+			span.SpanAttributes = append(span.SpanAttributes, utils.ResourceAttribute{
+				Key:   SampleRateAttribute,
+				Value: strconv.FormatFloat(rate, 'f', -1, 64),
+			})
+		}
+		sampled = append(sampled, span)
+	}
+	return sampled
+}
+
+// decide records the rule of a trace unless an earlier rule already applies.
+// The lock must be held.
+func (s *Sampler) decide(traceID string, rule int) {
+	if r, ok := s.decisions[traceID]; ok {
+		s.decisions[traceID] = min(r, rule)
+		return
+	}
+	if len(s.order) < s.capacity {
+		s.order = append(s.order, traceID)
+	} else {
+		delete(s.decisions, s.order[s.next])
+		s.order[s.next] = traceID
+		s.next = (s.next + 1) % s.capacity
+	}
+	s.decisions[traceID] = rule
+}
+
+// keepTrace reports whether a trace falls in the kept share of rate
+func keepTrace(traceID string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(traceID))
+	return float64(h.Sum64()) < rate*math.MaxUint64
+}
+
+// Stats returns the rules with the spans they kept and dropped since the collector started
+func (s *Sampler) Stats() []SamplingRuleStats {
+	stats := []SamplingRuleStats{}
+	if s == nil {
+		return stats
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, rule := range s.rules {
+		stats = append(stats, SamplingRuleStats{SamplingRule: rule, Kept: s.kept[i], Dropped: s.dropped[i]})
+	}
+	return stats
+}
+
+// SamplingController serves the sampling rules and what they dropped
+type SamplingController struct {
+	sampler *Sampler
+}
+
+func NewSamplingController(sampler *Sampler) *SamplingController {
+	return &SamplingController{sampler: sampler}
+}
+
+func (c *SamplingController) getSampling(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.sampler.Stats())
+}
+
+func (c *SamplingController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/admin/sampling", Summary: "Spans kept and dropped by each sampling rule", Response: []SamplingRuleStats{}},
+	}
+}
+
+func (c *SamplingController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/admin/sampling", c.getSampling)
+}
+
+// sampleSpans is used by the collector to apply the sampling rules, dropped spans
+// are counted so the ingest metrics still add up to what was received
+func (s *TelemetryCollectorService) sampleSpans(spans []utils.Span) []utils.Span {
+	received := len(spans)
+	spans = s.Sampler.sample(spans)
+	if dropped := received - len(spans); dropped > 0 {
+		metrics.SpansIngested.Add(float64(dropped), "sampled")
+	}
+	return spans
+}
@@ -9,19 +9,36 @@ import (
 	"strings"
 	"time"
 
+	"nabatshy/metrics"
 	"nabatshy/utils"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/doug-martin/goqu/v9"
 	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
 )
 
 var InsertDenormalizedSpans = utils.InsertDenormalizedSpans
 
 type TelemetryCollectorService struct {
-	Ch *clickhouse.Conn
-	DB *goqu.DialectWrapper
+	Ch       *clickhouse.Conn
+	DB       *goqu.DialectWrapper
+	Promoted []utils.PromotedAttribute
+	// JSONAttributes stores attributes in the attributes_json column, see utils.InsertOptions
+	JSONAttributes bool
+	Tracker        *IngestTracker
+	Tap            *IngestTap
+	// WAL buffers spans while ClickHouse is unreachable, may be nil
+	WAL *WAL
+	// Limiter caps the spans stored per trace, may be nil
+	Limiter *TraceLimiter
+	// Sampler drops traces by the sampling rules, may be nil
+	Sampler *Sampler
+	// InsertMode is sync when empty
+	InsertMode InsertMode
+	// Validation rejects malformed spans
+	Validation Validation
 }
 
 type Trace struct {
@@ -97,8 +114,24 @@ type TraceList struct {
 	Issues     uint64  `db:"issues"`
 }
 
-func (s *TelemetryCollectorService) ingestTrace(req *coltrace.ExportTraceServiceRequest) error {
+// IngestTrace stores the spans of an export, the spans rejected by the validation
+// are left out and counted
+func (s *TelemetryCollectorService) IngestTrace(req *coltrace.ExportTraceServiceRequest) (Rejections, error) {
+	return s.ingest(req, s.Validation)
+}
+
+// ImportTrace stores the spans of an import of past traces like IngestTrace, except
+// that they aren't rejected for being older than the validation's MaxAge
+func (s *TelemetryCollectorService) ImportTrace(req *coltrace.ExportTraceServiceRequest) (Rejections, error) {
+	validation := s.Validation
+	validation.MaxAge = 0
+	return s.ingest(req, validation)
+}
+
+func (s *TelemetryCollectorService) ingest(req *coltrace.ExportTraceServiceRequest, validation Validation) (Rejections, error) {
 	ctx := context.Background()
+	now := time.Now()
+	rejected := make(Rejections)
 	for _, rs := range req.ResourceSpans {
 		resourceAttrs := extractAttributes(rs.Resource.Attributes)
 		resourceSchemaURL := rs.SchemaUrl
@@ -108,11 +141,17 @@ func (s *TelemetryCollectorService) ingestTrace(req *coltrace.ExportTraceService
 
 			var spans []utils.Span
 			for _, span := range ss.Spans {
+				if reason := validation.check(span, now); reason != "" {
+					rejected.add(reason)
+					continue
+				}
+
 				// Collect events for the span
 				var events []utils.Event
 				for _, e := range span.Events {
 					// Extract event attributes
 					eventAttrs := extractAttributes(e.Attributes)
+					fingerprintException(e.Name, eventAttrs)
 					var eventAttributes []utils.EventAttribute
 					for k, v := range eventAttrs {
 						eventAttributes = append(eventAttributes,
@@ -145,6 +184,7 @@ func (s *TelemetryCollectorService) ingestTrace(req *coltrace.ExportTraceService
 
 				// Extract span attributes (this is where db.statement will be)
 				spanAttrs := extractAttributes(span.Attributes)
+				fingerprintStatement(spanAttrs)
 				var spanAttributes []utils.ResourceAttribute
 				for k, v := range spanAttrs {
 					spanAttributes = append(spanAttributes,
@@ -155,6 +195,14 @@ func (s *TelemetryCollectorService) ingestTrace(req *coltrace.ExportTraceService
 					)
 				}
 
+				var links []utils.Link
+				for _, l := range span.Links {
+					links = append(links, utils.Link{
+						TraceID: encodeBytes(l.TraceId),
+						SpanID:  encodeBytes(l.SpanId),
+					})
+				}
+
 				// Append the denormalized span
 				spans = append(spans, utils.Span{
 					TraceID:            encodeBytes(span.TraceId),
@@ -169,16 +217,44 @@ func (s *TelemetryCollectorService) ingestTrace(req *coltrace.ExportTraceService
 					ResourceAttributes: resourceAttributes,
 					SpanAttributes:     spanAttributes,
 					Events:             events,
+					Kind:               spanKind(span.Kind),
+					Links:              links,
 				})
 			}
 
-			// Insert denormalized spans into the database
-			if err := InsertDenormalizedSpans(s.Ch, ctx, spans); err != nil {
-				return err
+			spans = s.limitTraceSizes(s.sampleSpans(spans))
+			if len(spans) == 0 {
+				continue
+			}
+			counts := traceCounts(spans)
+			s.Tracker.received(counts, time.Now())
+
+			// batches go to the WAL while it drains so they stay in order
+			buffer := s.WAL.Pending()
+			var err error
+			metrics.IngestBatchSize.Observe(float64(len(spans)))
+			if !buffer {
+				start := time.Now()
+				err = s.insert(ctx, spans)
+				metrics.InsertDuration.Observe(time.Since(start).Seconds())
+				buffer = err != nil && s.WAL != nil && utils.IsUnavailable(err)
+			}
+			if buffer {
+				if err = s.WAL.Append(spans); err == nil {
+					s.Tracker.buffered(counts, time.Now())
+					metrics.SpansIngested.Add(float64(len(spans)), "buffered")
+					continue
+				}
 			}
+			s.Tracker.committed(counts, err, time.Now())
+			if err != nil {
+				metrics.SpansIngested.Add(float64(len(spans)), "failed")
+				return rejected, err
+			}
+			metrics.SpansIngested.Add(float64(len(spans)), "committed")
 		}
 	}
-	return nil
+	return rejected, nil
 }
 
 func extractAttributes(attrs []*commonpb.KeyValue) map[string]string {
@@ -270,6 +346,24 @@ func isSimpleStringArray(values []*commonpb.AnyValue) bool {
 	return true
 }
 
+// spanKind maps the OTLP span kind to the short name stored in the kind column
+func spanKind(kind tracepb.Span_SpanKind) string {
+	switch kind {
+	case tracepb.Span_SPAN_KIND_SERVER:
+		return "server"
+	case tracepb.Span_SPAN_KIND_CLIENT:
+		return "client"
+	case tracepb.Span_SPAN_KIND_PRODUCER:
+		return "producer"
+	case tracepb.Span_SPAN_KIND_CONSUMER:
+		return "consumer"
+	case tracepb.Span_SPAN_KIND_INTERNAL:
+		return "internal"
+	default:
+		return ""
+	}
+}
+
 func encodeBytes(b []byte) string {
 	return base64.StdEncoding.EncodeToString(b)
 }
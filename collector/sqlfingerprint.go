@@ -0,0 +1,153 @@
+package collector
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// Span attributes added to database spans at ingest, db.statement is kept as sent
+const (
+	StatementFingerprintAttribute = "db.statement.fingerprint"
+	NormalizedStatementAttribute  = "db.statement.normalized"
+)
+
+// statementAttributes hold the query text of database spans, by semantic
+// conventions version
+var statementAttributes = []string{"db.statement", "db.query.text"}
+
+const maxNormalizedStatementLength = 2048
+
+var (
+	inListRe     = regexp.MustCompile(`(?i)\bIN ?\(\?(, \?)*\)`)
+	valuesListRe = regexp.MustCompile(`(?i)\bVALUES ?(\(\?(, \?)*\))(, \(\?(, \?)*\))+`)
+	listSpaces   = strings.NewReplacer("( ", "(", " )", ")", " ,", ",")
+	commaRe      = regexp.MustCompile(`, ?`)
+)
+
+// NormalizeStatement replaces the literals and placeholders of a SQL statement with
+// ?, drops its comments, collapses whitespace, IN lists and multi-row VALUES, so
+// statements that only differ by values share a fingerprint
+func NormalizeStatement(statement string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(statement); {
+		c := statement[i]
+		switch {
+		case c == '-' && strings.HasPrefix(statement[i:], "--"):
+			end := strings.IndexByte(statement[i:], '\n')
+			if end < 0 {
+				end = len(statement) - i
+			}
+			i += end
+			space = true
+			continue
+		case c == '/' && strings.HasPrefix(statement[i:], "/*"):
+			end := strings.Index(statement[i+2:], "*/")
+			if end < 0 {
+				end = len(statement) - i - 2
+			}
+			i += end + 4
+			space = true
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			space = true
+			continue
+		}
+
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		switch {
+		case c == '\'':
+			i = skipQuoted(statement, i)
+			b.WriteByte('?')
+		case c == '"' || c == '`':
+			// quoted identifiers are kept
+			end := skipQuoted(statement, i)
+			b.WriteString(statement[i:end])
+			i = end
+		case isDigit(c) && !isIdentifierEnd(statement, i):
+			for i < len(statement) && (isDigit(statement[i]) || statement[i] == '.' || statement[i] == 'e' || statement[i] == 'E' || statement[i] == 'x' || isHexLetter(statement[i])) {
+				i++
+			}
+			b.WriteByte('?')
+		case (c == '$' || c == ':' || c == '@') && i+1 < len(statement) && isIdentifierChar(statement[i+1]) && !(c == ':' && i > 0 && statement[i-1] == ':'):
+			// positional and named placeholders like $1, :name and @p1
+			i++
+			for i < len(statement) && isIdentifierChar(statement[i]) {
+				i++
+			}
+			b.WriteByte('?')
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	normalized := commaRe.ReplaceAllString(listSpaces.Replace(b.String()), ", ")
+	normalized = inListRe.ReplaceAllStringFunc(normalized, func(list string) string {
+		return list[:2] + " (...)"
+	})
+	normalized = valuesListRe.ReplaceAllString(normalized, "VALUES $1")
+	if len(normalized) > maxNormalizedStatementLength {
+		normalized = normalized[:maxNormalizedStatementLength]
+	}
+	return normalized
+}
+
+// skipQuoted returns the index after the quoted string starting at i, quotes are
+// escaped by doubling them or with a backslash
+func skipQuoted(s string, i int) int {
+	quote := s[i]
+	for i++; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexLetter(c byte) bool {
+	return (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isIdentifierEnd reports whether the digit at i continues an identifier like t1
+func isIdentifierEnd(s string, i int) bool {
+	return i > 0 && (isIdentifierChar(s[i-1]) || s[i-1] == '$')
+}
+
+// StatementFingerprint returns a stable ID for a SQL statement and its normalized text
+func StatementFingerprint(statement string) (string, string) {
+	normalized := NormalizeStatement(statement)
+	sum := sha1.Sum([]byte(normalized))
+	return hex.EncodeToString(sum[:8]), normalized
+}
+
+// fingerprintStatement adds the fingerprint attributes to database spans
+func fingerprintStatement(attrs map[string]string) {
+	for _, key := range statementAttributes {
+		if statement := strings.TrimSpace(attrs[key]); statement != "" {
+			attrs[StatementFingerprintAttribute], attrs[NormalizedStatementAttribute] = StatementFingerprint(statement)
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// DefaultTapCapacity is the number of payloads the tap keeps
+const DefaultTapCapacity = 100
+
+// TapEntry is a mirrored OTLP payload. The payload is the decoded request in
+// OTLP JSON whatever the wire format was, old format JSON appears as converted.
+type TapEntry struct {
+	ReceivedAt  time.Time       `json:"received_at"`
+	ContentType string          `json:"content_type"`
+	RemoteAddr  string          `json:"remote_addr"`
+	Spans       int             `json:"spans"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// IngestTap mirrors a sampled fraction of incoming payloads to a ring buffer,
+// for debugging SDK integrations. A nil tap captures nothing.
+type IngestTap struct {
+	rate     float64
+	mu       sync.Mutex
+	capacity int
+	entries  []TapEntry
+	next     int
+}
+
+func NewIngestTap(rate float64, capacity int) *IngestTap {
+	return &IngestTap{rate: rate, capacity: capacity, entries: make([]TapEntry, 0, capacity)}
+}
+
+// ParseTapRate parses the INGEST_TAP_RATE value, empty disables the tap
+func ParseTapRate(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid ingest tap rate %q, use a fraction between 0 and 1", s)
+	}
+	return rate, nil
+}
+
+// capture stores the request if it's sampled
+func (t *IngestTap) capture(req *coltrace.ExportTraceServiceRequest, r *http.Request, now time.Time) {
+	if t == nil || rand.Float64() >= t.rate {
+		return
+	}
+	payload, err := protojson.Marshal(req)
+	if err != nil {
+		return
+	}
+	spans := 0
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			spans += len(ss.Spans)
+		}
+	}
+	entry := TapEntry{
+		ReceivedAt:  now,
+		ContentType: r.Header.Get("Content-Type"),
+		RemoteAddr:  r.RemoteAddr,
+		Spans:       spans,
+		Payload:     payload,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.entries) < t.capacity {
+		t.entries = append(t.entries, entry)
+		return
+	}
+	t.entries[t.next] = entry
+	t.next = (t.next + 1) % t.capacity
+}
+
+// Entries returns the captured payloads, newest first
+func (t *IngestTap) Entries() []TapEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := make([]TapEntry, 0, len(t.entries))
+	for i := range t.entries {
+		// the newest entry is just before next, or last while the buffer fills
+		idx := (t.next - 1 - i + 2*len(t.entries)) % len(t.entries)
+		entries = append(entries, t.entries[idx])
+	}
+	return entries
+}
+
+func (t *IngestTap) Clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = t.entries[:0]
+	t.next = 0
+}
+
+// IngestTapController serves the payloads captured by the tap
+type IngestTapController struct {
+	tap *IngestTap
+}
+
+func NewIngestTapController(tap *IngestTap) *IngestTapController {
+	return &IngestTapController{tap: tap}
+}
+
+func (c *IngestTapController) enabled(w http.ResponseWriter) bool {
+	if c.tap == nil {
+		http.Error(w, "ingest tap is disabled, set INGEST_TAP_RATE to enable it", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (c *IngestTapController) listEntries(w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.tap.Entries())
+}
+
+func (c *IngestTapController) clearEntries(w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+	c.tap.Clear()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *IngestTapController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/debug/tap", Summary: "Sampled export payloads", Response: []TapEntry{}},
+		{Method: http.MethodDelete, Path: "/v1/debug/tap", Summary: "Clear the sampled payloads", Status: http.StatusNoContent},
+	}
+}
+
+func (c *IngestTapController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/debug/tap", c.listEntries)
+	r.Delete("/v1/debug/tap", c.clearEntries)
+}
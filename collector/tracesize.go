@@ -0,0 +1,220 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"nabatshy/metrics"
+	"nabatshy/openapi"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultMaxSpansPerTrace is how many spans of a trace are stored before the rest is dropped
+const DefaultMaxSpansPerTrace = 100000
+
+// DefaultTraceLimiterCapacity is how many traces the limiter counts spans for
+const DefaultTraceLimiterCapacity = 100000
+
+// TruncatedAttribute marks the last stored span of a trace that hit the span limit
+const TruncatedAttribute = "nabatshy.trace.truncated"
+
+// TraceLimiter caps the spans stored per trace so a runaway loop can't create a
+// trace too large to query. Spans are counted for the most recently received traces,
+// a trace that is evicted starts counting from zero again.
+type TraceLimiter struct {
+	max int
+
+	mu       sync.Mutex
+	capacity int
+	counts   map[string]int
+	// order holds trace IDs in the order they were first received, the oldest is evicted
+	order   []string
+	next    int
+	dropped uint64
+}
+
+func NewTraceLimiter(max, capacity int) *TraceLimiter {
+	return &TraceLimiter{
+		max:      max,
+		capacity: capacity,
+		counts:   make(map[string]int, capacity),
+		order:    make([]string, 0, capacity),
+	}
+}
+
+// ParseMaxSpansPerTrace parses the MAX_SPANS_PER_TRACE value, 0 disables the limit
+func ParseMaxSpansPerTrace(s string) (int, error) {
+	if s == "" {
+		return DefaultMaxSpansPerTrace, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid max spans per trace %q", s)
+	}
+	return n, nil
+}
+
+// admit returns the spans that fit under the limit of their trace. The first span
+// over the limit is kept with TruncatedAttribute set so the UI can tell the trace
+// is incomplete, later ones are dropped.
+func (l *TraceLimiter) admit(spans []utils.Span) []utils.Span {
+	if l == nil || l.max == 0 {
+		return spans
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	admitted := spans[:0]
+	for _, span := range spans {
+		n := l.count(span.TraceID)
+		switch {
+		case n <= l.max:
+		case n == l.max+1:
+			span.SpanAttributes = append(span.SpanAttributes, utils.ResourceAttribute{Key: TruncatedAttribute, Value: "true"})
+		default:
+			l.dropped++
+			continue
+		}
+		admitted = append(admitted, span)
+	}
+	return admitted
+}
+
+// count increments the span count of a trace and returns it. The lock must be held.
+func (l *TraceLimiter) count(traceID string) int {
+	if _, ok := l.counts[traceID]; !ok {
+		if len(l.order) < l.capacity {
+			l.order = append(l.order, traceID)
+		} else {
+			delete(l.counts, l.order[l.next])
+			l.order[l.next] = traceID
+			l.next = (l.next + 1) % l.capacity
+		}
+	}
+	l.counts[traceID]++
+	return l.counts[traceID]
+}
+
+// Dropped returns the number of spans dropped since the collector started
+func (l *TraceLimiter) Dropped() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+// TraceSizeBucket counts the traces with more than Spans/2 and at most Spans spans
+type TraceSizeBucket struct {
+	Spans  float64 `json:"spans"`
+	Traces uint64  `json:"traces"`
+}
+
+type TraceSizeResponse struct {
+	Traces uint64  `json:"traces"`
+	P50    float64 `json:"p50"`
+	P90    float64 `json:"p90"`
+	P99    float64 `json:"p99"`
+	Max    uint64  `json:"max"`
+	// Buckets is the distribution of spans per trace in powers of two
+	Buckets []TraceSizeBucket `json:"buckets"`
+	// MaxSpansPerTrace is the ingest limit, 0 when there's none
+	MaxSpansPerTrace int `json:"max_spans_per_trace"`
+	// DroppedSpans is the number of spans this collector dropped over the limit
+	DroppedSpans uint64 `json:"dropped_spans"`
+}
+
+// TraceSizeController serves the distribution of spans per trace
+type TraceSizeController struct {
+	limiter *TraceLimiter
+	ch      *clickhouse.Conn
+}
+
+func NewTraceSizeController(limiter *TraceLimiter, ch *clickhouse.Conn) *TraceSizeController {
+	return &TraceSizeController{limiter: limiter, ch: ch}
+}
+
+const traceSizesSubquery = `
+SELECT trace_id, count() AS spans
+FROM denormalized_span
+WHERE start_time_unix_nano BETWEEN ? AND ?
+GROUP BY trace_id`
+
+func (c *TraceSizeController) getTraceSizes(w http.ResponseWriter, r *http.Request) {
+	dr, err := utils.ParseDateRange(r.URL.Query(), "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("timeRange") == "" && r.URL.Query().Get("start") == "" {
+		// the last hour is enough to spot a runaway trace
+		dr = utils.GetDateRangeFromQuery("1h")
+	}
+	ctx := r.Context()
+	start, end := dr.Start.UnixNano(), dr.End.UnixNano()
+
+	resp := TraceSizeResponse{Buckets: []TraceSizeBucket{}, DroppedSpans: c.limiter.Dropped()}
+	if c.limiter != nil {
+		resp.MaxSpansPerTrace = c.limiter.max
+	}
+	// the quantiles are NaN without traces, which JSON can't encode
+	if err := (*c.ch).QueryRow(ctx, `
+SELECT count(), ifNotFinite(quantile(0.5)(spans), 0), ifNotFinite(quantile(0.9)(spans), 0),
+	ifNotFinite(quantile(0.99)(spans), 0), max(spans)
+FROM (`+traceSizesSubquery+`)`, start, end,
+	).Scan(&resp.Traces, &resp.P50, &resp.P90, &resp.P99, &resp.Max); err != nil {
+		http.Error(w, fmt.Sprintf("failed to get trace sizes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := (*c.ch).Query(ctx, `
+SELECT exp2(ceil(log2(spans))) AS bucket, count()
+FROM (`+traceSizesSubquery+`)
+GROUP BY bucket
+ORDER BY bucket`, start, end)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get trace size buckets: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b TraceSizeBucket
+		if err := rows.Scan(&b.Spans, &b.Traces); err != nil {
+			http.Error(w, fmt.Sprintf("failed to get trace size buckets: %v", err), http.StatusInternalServerError)
+			return
+		}
+		resp.Buckets = append(resp.Buckets, b)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (c *TraceSizeController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/admin/trace-sizes", Summary: "Distribution of the number of spans per trace",
+			Description: "Over the last hour without a date range", Response: TraceSizeResponse{}, Query: openapi.DateRange},
+	}
+}
+
+func (c *TraceSizeController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/admin/trace-sizes", c.getTraceSizes)
+}
+
+// limitTraceSizes is used by the collector to drop spans over the limit, dropped
+// spans are counted so the ingest metrics still add up to what was received
+func (s *TelemetryCollectorService) limitTraceSizes(spans []utils.Span) []utils.Span {
+	received := len(spans)
+	spans = s.Limiter.admit(spans)
+	if dropped := received - len(spans); dropped > 0 {
+		metrics.SpansIngested.Add(float64(dropped), "dropped")
+	}
+	return spans
+}
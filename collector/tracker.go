@@ -0,0 +1,193 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"nabatshy/openapi"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/go-chi/chi/v5"
+)
+
+// IngestRecord is what the collector saw of a trace. Each scope's spans are inserted
+// as one batch as soon as the request is decoded, so a span is either committed,
+// failed, still in flight, or buffered in the WAL while ClickHouse is unreachable.
+type IngestRecord struct {
+	TraceID        string     `json:"trace_id"`
+	FirstReceived  time.Time  `json:"first_received"`
+	LastReceived   time.Time  `json:"last_received"`
+	SpansReceived  int        `json:"spans_received"`
+	SpansCommitted int        `json:"spans_committed"`
+	SpansFailed    int        `json:"spans_failed"`
+	SpansBuffered  int        `json:"spans_buffered"`
+	LastCommitted  *time.Time `json:"last_committed,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// IngestTracker remembers the ingest records of the most recently received traces
+type IngestTracker struct {
+	mu       sync.Mutex
+	capacity int
+	records  map[string]*IngestRecord
+	// order holds trace IDs in the order they were first received, the oldest is evicted
+	order []string
+	next  int
+}
+
+func NewIngestTracker(capacity int) *IngestTracker {
+	return &IngestTracker{
+		capacity: capacity,
+		records:  make(map[string]*IngestRecord, capacity),
+		order:    make([]string, 0, capacity),
+	}
+}
+
+// record returns the record of a trace, creating it if needed. The lock must be held.
+func (t *IngestTracker) record(traceID string, now time.Time) *IngestRecord {
+	if r, ok := t.records[traceID]; ok {
+		return r
+	}
+	r := &IngestRecord{TraceID: traceID, FirstReceived: now}
+	if len(t.order) < t.capacity {
+		t.order = append(t.order, traceID)
+	} else {
+		delete(t.records, t.order[t.next])
+		t.order[t.next] = traceID
+		t.next = (t.next + 1) % t.capacity
+	}
+	t.records[traceID] = r
+	return r
+}
+
+// received records spans per trace ID that are about to be inserted
+func (t *IngestTracker) received(counts map[string]int, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for traceID, n := range counts {
+		r := t.record(traceID, now)
+		r.LastReceived = now
+		r.SpansReceived += n
+	}
+}
+
+// committed records the outcome of inserting spans per trace ID
+func (t *IngestTracker) committed(counts map[string]int, err error, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for traceID, n := range counts {
+		r := t.record(traceID, now)
+		if err != nil {
+			r.SpansFailed += n
+			r.LastError = err.Error()
+			continue
+		}
+		r.SpansCommitted += n
+		r.LastCommitted = &now
+	}
+}
+
+// buffered records spans per trace ID written to the WAL instead of ClickHouse
+func (t *IngestTracker) buffered(counts map[string]int, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for traceID, n := range counts {
+		t.record(traceID, now).SpansBuffered += n
+	}
+}
+
+// replayed records buffered spans per trace ID that were inserted from the WAL
+func (t *IngestTracker) replayed(counts map[string]int, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for traceID, n := range counts {
+		r := t.record(traceID, now)
+		r.SpansBuffered = max(r.SpansBuffered-n, 0)
+		r.SpansCommitted += n
+		r.LastCommitted = &now
+	}
+}
+
+// Lookup returns a copy of the record of a trace
+func (t *IngestTracker) Lookup(traceID string) (IngestRecord, bool) {
+	if t == nil {
+		return IngestRecord{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.records[traceID]
+	if !ok {
+		return IngestRecord{}, false
+	}
+	return *r, true
+}
+
+// IngestDebugController serves what the collector and ClickHouse know about a trace
+type IngestDebugController struct {
+	tracker *IngestTracker
+	ch      *clickhouse.Conn
+}
+
+func NewIngestDebugController(tracker *IngestTracker, ch *clickhouse.Conn) *IngestDebugController {
+	return &IngestDebugController{tracker: tracker, ch: ch}
+}
+
+type IngestDebugResponse struct {
+	TraceID string `json:"trace_id"`
+	// Received is false when the collector hasn't seen the trace since it started,
+	// or the trace is older than the most recent traces it remembers
+	Received bool          `json:"received"`
+	Record   *IngestRecord `json:"record,omitempty"`
+	// StoredSpans is the number of spans of the trace that are queryable
+	StoredSpans uint64 `json:"stored_spans"`
+}
+
+func (c *IngestDebugController) getIngest(w http.ResponseWriter, r *http.Request) {
+	traceID, err := url.QueryUnescape(chi.URLParam(r, "trace_id"))
+	if err != nil {
+		http.Error(w, "invalid trace_id", http.StatusBadRequest)
+		return
+	}
+
+	resp := IngestDebugResponse{TraceID: traceID}
+	if record, ok := c.tracker.Lookup(traceID); ok {
+		resp.Received = true
+		resp.Record = &record
+	}
+	if err := (*c.ch).QueryRow(context.Background(),
+		"SELECT count() FROM denormalized_span WHERE trace_id = ?", traceID,
+	).Scan(&resp.StoredSpans); err != nil {
+		http.Error(w, fmt.Sprintf("failed to count stored spans: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (c *IngestDebugController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/debug/ingest/{trace_id}", Summary: "What the collector received and stored of a trace", Response: IngestDebugResponse{}},
+	}
+}
+
+func (c *IngestDebugController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/debug/ingest/{trace_id}", c.getIngest)
+}
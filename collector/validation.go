@@ -0,0 +1,149 @@
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"nabatshy/metrics"
+	"nabatshy/utils"
+
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+const (
+	// DefaultMaxSpanAge is how long before it's received a span may have started
+	DefaultMaxSpanAge = 30 * 24 * time.Hour
+	// DefaultMaxClockSkew is how long after it's received a span may start or end
+	DefaultMaxClockSkew = time.Hour
+	// DefaultMaxNameLength is the longest span name in bytes
+	DefaultMaxNameLength = 1024
+)
+
+// Reasons a span is rejected
+const (
+	RejectedTraceID     = "invalid_trace_id"
+	RejectedSpanID      = "invalid_span_id"
+	RejectedEndBefore   = "end_before_start"
+	RejectedTooOld      = "too_old"
+	RejectedInFuture    = "in_future"
+	RejectedNameTooLong = "name_too_long"
+)
+
+// Validation rejects malformed spans at ingest: spans without a 16 byte trace ID and
+// an 8 byte span ID that aren't all zeros, ending before they start, with timestamps
+// out of bounds or with names that are too long. The zero Validation only checks the
+// IDs and the order of the timestamps.
+type Validation struct {
+	// MaxAge and MaxClockSkew bound the timestamps of a span around the time it's
+	// received, 0 doesn't bound them
+	MaxAge       time.Duration
+	MaxClockSkew time.Duration
+	// MaxNameLength is the longest span name in bytes, 0 doesn't limit it
+	MaxNameLength int
+}
+
+// ParseValidation parses the INGEST_MAX_SPAN_AGE and INGEST_MAX_CLOCK_SKEW values,
+// periods like 30d or 1h, and INGEST_MAX_NAME_LENGTH, a number of bytes. Empty values
+// are the defaults and off disables a check.
+func ParseValidation(maxAge, maxClockSkew, maxNameLength string) (Validation, error) {
+	v := Validation{MaxNameLength: DefaultMaxNameLength}
+	var err error
+	if v.MaxAge, err = parseSpanBound(maxAge, DefaultMaxSpanAge); err != nil {
+		return v, fmt.Errorf("invalid max span age %q, use off or a period like 30d", maxAge)
+	}
+	if v.MaxClockSkew, err = parseSpanBound(maxClockSkew, DefaultMaxClockSkew); err != nil {
+		return v, fmt.Errorf("invalid max clock skew %q, use off or a period like 1h", maxClockSkew)
+	}
+	switch maxNameLength {
+	case "":
+	case "off":
+		v.MaxNameLength = 0
+	default:
+		if v.MaxNameLength, err = strconv.Atoi(maxNameLength); err != nil || v.MaxNameLength <= 0 {
+			return v, fmt.Errorf("invalid max name length %q, use off or a number of bytes", maxNameLength)
+		}
+	}
+	return v, nil
+}
+
+func parseSpanBound(s string, def time.Duration) (time.Duration, error) {
+	switch s {
+	case "":
+		return def, nil
+	case "off":
+		return 0, nil
+	}
+	return utils.ParseTimeRange(s)
+}
+
+// check returns why a span received at now is rejected, empty when it's valid
+func (v Validation) check(span *tracepb.Span, now time.Time) string {
+	switch {
+	case !validID(span.TraceId, 16):
+		return RejectedTraceID
+	case !validID(span.SpanId, 8):
+		return RejectedSpanID
+	case span.EndTimeUnixNano < span.StartTimeUnixNano:
+		return RejectedEndBefore
+	case v.MaxAge > 0 && int64(span.StartTimeUnixNano) < now.Add(-v.MaxAge).UnixNano():
+		return RejectedTooOld
+	case v.MaxClockSkew > 0 && int64(span.EndTimeUnixNano) > now.Add(v.MaxClockSkew).UnixNano():
+		return RejectedInFuture
+	case v.MaxNameLength > 0 && len(span.Name) > v.MaxNameLength:
+		return RejectedNameTooLong
+	}
+	return ""
+}
+
+func validID(id []byte, size int) bool {
+	if len(id) != size {
+		return false
+	}
+	for _, b := range id {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejections counts the spans of an export rejected by the validation, by reason
+type Rejections map[string]int64
+
+func (r Rejections) add(reason string) {
+	r[reason]++
+	metrics.SpansIngested.Add(1, "rejected")
+	metrics.SpansRejected.Add(1, reason)
+}
+
+// Total returns the number of rejected spans
+func (r Rejections) Total() int64 {
+	var n int64
+	for _, count := range r {
+		n += count
+	}
+	return n
+}
+
+// String describes the rejections like "3 spans rejected: 2 end_before_start, 1 too_old",
+// the error message of the partial success of the export
+func (r Rejections) String() string {
+	reasons := make([]string, 0, len(r))
+	for reason := range r {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if r[reasons[i]] != r[reasons[j]] {
+			return r[reasons[i]] > r[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%d %s", r[reason], reason)
+	}
+	return fmt.Sprintf("%d spans rejected: %s", r.Total(), strings.Join(parts, ", "))
+}
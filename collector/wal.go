@@ -0,0 +1,288 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"nabatshy/metrics"
+	"nabatshy/utils"
+)
+
+// DefaultWALMaxBytes is the disk space the WAL may use before ingestion fails again
+const DefaultWALMaxBytes = 512 << 20
+
+// walReplayInterval is how often buffered spans are retried
+const walReplayInterval = 5 * time.Second
+
+var ErrWALFull = errors.New("write-ahead log is full")
+
+// WAL buffers span batches on disk while ClickHouse is unreachable and inserts
+// them once it's back. Batches are appended to a segment file as JSON lines, a
+// replay closes the current segment and inserts closed segments oldest first.
+type WAL struct {
+	dir      string
+	maxBytes int64
+	// insert and tracker are set by the collector
+	insert  func(ctx context.Context, spans []utils.Span) error
+	tracker *IngestTracker
+
+	// replaying is held during a replay, so a flush and the replay loop don't
+	// insert the same segment twice
+	replaying sync.Mutex
+
+	mu      sync.Mutex
+	current *os.File
+	// size is the total size of all segments
+	size int64
+}
+
+// OpenWAL opens the WAL in dir, segments left by a previous run are replayed
+// once the collector starts
+func OpenWAL(dir string, maxBytes int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create wal dir: %w", err)
+	}
+	w := &WAL{dir: dir, maxBytes: maxBytes}
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		info, err := os.Stat(seg)
+		if err != nil {
+			return nil, err
+		}
+		w.size += info.Size()
+	}
+	if w.size > 0 {
+		log.Printf("wal: %d bytes of spans left from the last run\n", w.size)
+	}
+	return w, nil
+}
+
+// ParseWALDir returns the WAL_DIR value, "off" disables the WAL
+func ParseWALDir(s string) string {
+	switch s {
+	case "":
+		return "wal"
+	case "off":
+		return ""
+	}
+	return s
+}
+
+// Pending reports whether there are buffered spans, new batches go straight to the
+// WAL until it's drained so a down database doesn't slow every request
+func (w *WAL) Pending() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size > 0
+}
+
+// Append buffers a batch of spans
+func (w *WAL) Append(spans []utils.Span) error {
+	line, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size+int64(len(line)) > w.maxBytes {
+		return ErrWALFull
+	}
+	if w.current == nil {
+		name := filepath.Join(w.dir, fmt.Sprintf("%020d.wal", time.Now().UnixNano()))
+		if w.current, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			return fmt.Errorf("failed to create wal segment: %w", err)
+		}
+	}
+	if _, err := w.current.Write(line); err != nil {
+		return fmt.Errorf("failed to write wal: %w", err)
+	}
+	if err := w.current.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	w.size += int64(len(line))
+	return nil
+}
+
+// segments returns the segment files oldest first
+func (w *WAL) segments() ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(w.dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// Run replays buffered spans until ctx is done
+func (w *WAL) Run(ctx context.Context) {
+	ticker := time.NewTicker(walReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !w.Pending() {
+			continue
+		}
+		if err := w.replay(ctx); err != nil {
+			log.Printf("wal: replay stopped: %v\n", err)
+		}
+	}
+}
+
+// Close closes the current segment once the collector stopped. Spans are only
+// acknowledged after they're inserted or synced to a segment, so the collector has
+// no in-memory buffer to save, whatever is left is replayed on the next start. The
+// spans ClickHouse buffers for async-nowait inserts are flushed by FlushAsyncInserts.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size > 0 {
+		log.Printf("wal: %d bytes of spans left for the next start\n", w.size)
+	}
+	if w.current == nil {
+		return nil
+	}
+	err := w.current.Close()
+	w.current = nil
+	return err
+}
+
+// Flush replays the buffered spans now instead of at the next interval
+func (w *WAL) Flush(ctx context.Context) error {
+	if !w.Pending() {
+		return nil
+	}
+	return w.replay(ctx)
+}
+
+func (w *WAL) replay(ctx context.Context) error {
+	w.replaying.Lock()
+	defer w.replaying.Unlock()
+
+	// close the current segment so appends during the replay go to a new one, the
+	// segments are listed under the same lock so that new one, still being appended
+	// to, isn't replayed and removed
+	w.mu.Lock()
+	if w.current != nil {
+		w.current.Close()
+		w.current = nil
+	}
+	segments, err := w.segments()
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if err := w.replaySegment(ctx, seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment inserts the batches of a closed segment. When an insert fails the
+// segment is rewritten with the remaining batches so nothing is inserted twice.
+func (w *WAL) replaySegment(ctx context.Context, seg string) error {
+	data, err := os.ReadFile(seg)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 1<<20), len(data)+1)
+	var done int64
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var spans []utils.Span
+		if err := json.Unmarshal(line, &spans); err != nil {
+			// a torn write from a crash, nothing after it can be trusted
+			log.Printf("wal: dropping corrupt batch in %s: %v\n", filepath.Base(seg), err)
+			break
+		}
+		if err := w.insert(ctx, spans); err != nil {
+			if done > 0 {
+				if err := os.WriteFile(seg, data[done:], 0o644); err != nil {
+					return err
+				}
+				w.shrink(done)
+			}
+			return err
+		}
+		w.tracker.replayed(traceCounts(spans), time.Now())
+		metrics.SpansIngested.Add(float64(len(spans)), "replayed")
+		done += int64(len(line)) + 1
+	}
+
+	if err := os.Remove(seg); err != nil {
+		return err
+	}
+	w.shrink(int64(len(data)))
+	log.Printf("wal: replayed %s\n", filepath.Base(seg))
+	return nil
+}
+
+func (w *WAL) shrink(n int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.size = max(w.size-n, 0)
+}
+
+// Size returns the bytes of buffered spans
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// walReadyRatio is how full the WAL may get before the collector reports not ready
+const walReadyRatio = 0.9
+
+// Check fails once the WAL is nearly full, so traffic moves to collectors with room
+func (w *WAL) Check(ctx context.Context) error {
+	if size := w.Size(); float64(size) >= float64(w.maxBytes)*walReadyRatio {
+		return fmt.Errorf("wal is %d%% full", size*100/w.maxBytes)
+	}
+	return nil
+}
+
+// ParseWALMaxBytes parses the WAL_MAX_BYTES value
+func ParseWALMaxBytes(s string) (int64, error) {
+	if s == "" {
+		return DefaultWALMaxBytes, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid wal max bytes %q", s)
+	}
+	return n, nil
+}
+
+func traceCounts(spans []utils.Span) map[string]int {
+	counts := make(map[string]int)
+	for _, span := range spans {
+		counts[span.TraceID]++
+	}
+	return counts
+}
@@ -0,0 +1,356 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of every component. Values are kept as written and
+// parsed by the components, so the file, the environment and flags take the same
+// syntax, e.g. ingest.tap_rate: "0.01" is INGEST_TAP_RATE=0.01 or --ingest-tap-rate=0.01.
+//
+// Sources override each other in order: defaults, the YAML file given by --config
+// or NABATSHY_CONFIG, the environment (with .env loaded outside of production),
+// then flags.
+type Config struct {
+	Server       Server       `yaml:"server"`
+	ClickHouse   ClickHouse   `yaml:"clickhouse"`
+	Attributes   Attributes   `yaml:"attributes"`
+	Ingest       Ingest       `yaml:"ingest"`
+	SelfTrace    SelfTrace    `yaml:"self_trace"`
+	StatsD       StatsD       `yaml:"statsd"`
+	SMTP         SMTP         `yaml:"smtp"`
+	Webhooks     Webhooks     `yaml:"webhooks"`
+	Auth         Auth         `yaml:"auth"`
+	Catalog      Catalog      `yaml:"catalog"`
+	Dependencies Dependencies `yaml:"dependencies"`
+	Traces       Traces       `yaml:"traces"`
+}
+
+type Server struct {
+	// SinglePortAddr serves the API under /api, the collector under /otlp and the UI
+	// under / on one address, instead of the three addresses below
+	SinglePortAddr string `yaml:"single_port_addr"`
+	APIAddr        string `yaml:"api_addr"`
+	CollectorAddr  string `yaml:"collector_addr"`
+	UIAddr         string `yaml:"ui_addr"`
+	// DebugAddr serves pprof and runtime stats when set
+	DebugAddr string `yaml:"debug_addr"`
+	// GRPCAddr serves the read API over gRPC when set, see api.QueryServer
+	GRPCAddr string `yaml:"grpc_addr"`
+	// UIURL is the public URL of the UI, used in notification links
+	UIURL string `yaml:"ui_url"`
+	TLS   TLS    `yaml:"tls"`
+	// QueryTimeout bounds API requests, QueryTimeouts overrides it by path, see
+	// utils.ParseQueryTimeouts
+	QueryTimeout  string `yaml:"query_timeout"`
+	QueryTimeouts string `yaml:"query_timeouts"`
+}
+
+// TLS serves the API, collector and UI over HTTPS, either with a certificate and
+// key or with certificates from Let's Encrypt for the autocert hosts
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// AutocertHosts is a comma separated list of host names
+	AutocertHosts    string `yaml:"autocert_hosts"`
+	AutocertCacheDir string `yaml:"autocert_cache_dir"`
+	// ClientCAFile is a CA bundle OTLP clients must present a certificate signed by
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+type ClickHouse struct {
+	// Addr is a comma separated list of the addresses of replicas
+	Addr      string `yaml:"addr"`
+	Balancing string `yaml:"balancing"`
+	// Cluster distributes the tables over the shards of this cluster, see db.Cluster
+	Cluster  string `yaml:"cluster"`
+	Database string `yaml:"database"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type Attributes struct {
+	// Promoted is a comma separated list of attributes stored in their own column
+	Promoted           string `yaml:"promoted"`
+	Storage            string `yaml:"storage"`
+	SourceLinkTemplate string `yaml:"source_link_template"`
+}
+
+type Ingest struct {
+	TapRate     string `yaml:"tap_rate"`
+	WALDir      string `yaml:"wal_dir"`
+	WALMaxBytes string `yaml:"wal_max_bytes"`
+	// MaxSpansPerTrace caps the spans stored per trace, 0 disables the limit
+	MaxSpansPerTrace string `yaml:"max_spans_per_trace"`
+	// SamplingRules keep a share of the traces matching them, see collector.ParseSamplingRules
+	SamplingRules string `yaml:"sampling_rules"`
+	// InsertMode is sync, async or async-nowait, see collector.InsertMode
+	InsertMode string `yaml:"insert_mode"`
+	// MaxSpanAge, MaxClockSkew and MaxNameLength bound the spans accepted, see
+	// collector.ParseValidation
+	MaxSpanAge    string `yaml:"max_span_age"`
+	MaxClockSkew  string `yaml:"max_clock_skew"`
+	MaxNameLength string `yaml:"max_name_length"`
+}
+
+type SelfTrace struct {
+	Endpoint string `yaml:"endpoint"`
+	Service  string `yaml:"service"`
+	Rate     string `yaml:"rate"`
+}
+
+type StatsD struct {
+	Addr     string `yaml:"addr"`
+	Flavor   string `yaml:"flavor"`
+	Prefix   string `yaml:"prefix"`
+	Interval string `yaml:"interval"`
+}
+
+type SMTP struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+type Webhooks struct {
+	GitHubSecret string `yaml:"github_secret"`
+	GitLabSecret string `yaml:"gitlab_secret"`
+}
+
+// Auth logs users of the API and UI in with an OpenID Connect provider like Okta,
+// Keycloak or Google, the API is open to anyone when OIDCIssuer is empty
+type Auth struct {
+	OIDCIssuer       string `yaml:"oidc_issuer"`
+	OIDCClientID     string `yaml:"oidc_client_id"`
+	OIDCClientSecret string `yaml:"oidc_client_secret"`
+	// OIDCRedirectURL is the public URL of the API's /auth/callback route
+	OIDCRedirectURL string `yaml:"oidc_redirect_url"`
+	// SessionSecret signs session cookies, a random one is used when empty
+	SessionSecret string `yaml:"session_secret"`
+	SessionTTL    string `yaml:"session_ttl"`
+	// Roles binds groups and emails to roles, see auth.ParseRoleBindings. Without
+	// bindings every logged in user is an admin.
+	Roles string `yaml:"roles"`
+	// DefaultRole is the role of users no binding matches, viewer when empty, or
+	// admin when there are no bindings either
+	DefaultRole string `yaml:"default_role"`
+	// ServiceRoles is the least role that sees the spans of a service, see
+	// auth.ParseServiceRoles. Services not listed are seen by every role.
+	ServiceRoles string `yaml:"service_roles"`
+}
+
+type Catalog struct {
+	// IdleAfter is how long a service goes without spans before it's retired, see
+	// catalog.ParseIdleAfter
+	IdleAfter string `yaml:"idle_after"`
+}
+
+type Dependencies struct {
+	// Edges is live or precomputed, see api.ParseServiceEdges
+	Edges string `yaml:"edges"`
+}
+
+type Traces struct {
+	// CompletionWindow is how long the spans of a trace are waited for before it's
+	// checked for missing spans, see api.ParseCompletionWindow
+	CompletionWindow string `yaml:"completion_window"`
+}
+
+// Default returns the configuration used for anything that isn't set. Components
+// apply their own defaults to empty values, e.g. the promoted attributes.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			APIAddr:       ":3000",
+			CollectorAddr: ":4318",
+			UIAddr:        ":8081",
+			UIURL:         "http://localhost:8081",
+		},
+	}
+}
+
+// setting binds a config value to its environment variable and flag
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  *string
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{env: "SINGLE_PORT_ADDR", flag: "single-port-addr", usage: "serve the API, collector and UI on this one address under /api, /otlp and /", value: &c.Server.SinglePortAddr},
+		{env: "API_ADDR", flag: "api-addr", usage: "API listen address", value: &c.Server.APIAddr},
+		{env: "COLLECTOR_ADDR", flag: "collector-addr", usage: "OTLP collector listen address", value: &c.Server.CollectorAddr},
+		{env: "UI_ADDR", flag: "ui-addr", usage: "UI listen address", value: &c.Server.UIAddr},
+		{env: "DEBUG_ADDR", flag: "debug-addr", usage: "pprof and runtime stats listen address, empty disables it", value: &c.Server.DebugAddr},
+		{env: "GRPC_ADDR", flag: "grpc-addr", usage: "gRPC query API listen address, empty disables it", value: &c.Server.GRPCAddr},
+		{env: "UI_URL", flag: "ui-url", usage: "public URL of the UI used in notifications", value: &c.Server.UIURL},
+		{env: "TLS_CERT_FILE", flag: "tls-cert-file", usage: "certificate file of the HTTPS listeners", value: &c.Server.TLS.CertFile},
+		{env: "TLS_KEY_FILE", flag: "tls-key-file", usage: "key file of the HTTPS listeners", value: &c.Server.TLS.KeyFile},
+		{env: "TLS_AUTOCERT_HOSTS", flag: "tls-autocert-hosts", usage: "comma separated hosts to get Let's Encrypt certificates for", value: &c.Server.TLS.AutocertHosts},
+		{env: "TLS_AUTOCERT_CACHE_DIR", flag: "tls-autocert-cache-dir", usage: "directory Let's Encrypt certificates are kept in", value: &c.Server.TLS.AutocertCacheDir},
+		{env: "TLS_CLIENT_CA_FILE", flag: "tls-client-ca-file", usage: "CA bundle OTLP clients' certificates must be signed by, empty accepts any client", value: &c.Server.TLS.ClientCAFile},
+		{env: "QUERY_TIMEOUT", flag: "query-timeout", usage: `how long API requests may take, like 30s, "off" disables it`, value: &c.Server.QueryTimeout},
+		{env: "QUERY_TIMEOUTS", flag: "query-timeouts", usage: "timeouts of API paths like /v1/search=1m, separated by ;", value: &c.Server.QueryTimeouts},
+		{env: "CLICKHOUSE_ADDR", flag: "clickhouse-addr", usage: "ClickHouse address, or comma separated addresses of replicas", value: &c.ClickHouse.Addr},
+		{env: "CLICKHOUSE_BALANCING", flag: "clickhouse-balancing", usage: "how queries are spread over replicas: round-robin or least-loaded", value: &c.ClickHouse.Balancing},
+		{env: "CLICKHOUSE_CLUSTER", flag: "clickhouse-cluster", usage: "cluster the tables are distributed over, empty for a single server", value: &c.ClickHouse.Cluster},
+		{env: "CLICKHOUSE_DB", flag: "clickhouse-db", usage: "ClickHouse database", value: &c.ClickHouse.Database},
+		{env: "CLICKHOUSE_USERNAME", flag: "clickhouse-username", usage: "ClickHouse username", value: &c.ClickHouse.Username},
+		{env: "CLICKHOUSE_PASSWORD", flag: "clickhouse-password", usage: "ClickHouse password", secret: true, value: &c.ClickHouse.Password},
+		{env: "PROMOTED_ATTRIBUTES", flag: "promoted-attributes", usage: "comma separated attributes stored in their own column", value: &c.Attributes.Promoted},
+		{env: "ATTRIBUTE_STORAGE", flag: "attribute-storage", usage: "attribute storage, nested or json", value: &c.Attributes.Storage},
+		{env: "SOURCE_LINK_TEMPLATE", flag: "source-link-template", usage: "source browser URL template", value: &c.Attributes.SourceLinkTemplate},
+		{env: "INGEST_TAP_RATE", flag: "ingest-tap-rate", usage: "fraction of OTLP payloads mirrored to /v1/debug/tap", value: &c.Ingest.TapRate},
+		{env: "WAL_DIR", flag: "wal-dir", usage: `write-ahead log directory, "off" disables it`, value: &c.Ingest.WALDir},
+		{env: "WAL_MAX_BYTES", flag: "wal-max-bytes", usage: "disk space the write-ahead log may use", value: &c.Ingest.WALMaxBytes},
+		{env: "MAX_SPANS_PER_TRACE", flag: "max-spans-per-trace", usage: "spans stored per trace before the rest is dropped, 0 disables the limit", value: &c.Ingest.MaxSpansPerTrace},
+		{env: "SAMPLING_RULES", flag: "sampling-rules", usage: "rules like http.route=/healthz:0.01, separated by ;", value: &c.Ingest.SamplingRules},
+		{env: "INGEST_INSERT_MODE", flag: "ingest-insert-mode", usage: "how spans are written to ClickHouse: sync, async or async-nowait", value: &c.Ingest.InsertMode},
+		{env: "INGEST_MAX_SPAN_AGE", flag: "ingest-max-span-age", usage: `how long before it's received a span may start, like 30d, "off" disables the check`, value: &c.Ingest.MaxSpanAge},
+		{env: "INGEST_MAX_CLOCK_SKEW", flag: "ingest-max-clock-skew", usage: `how long after it's received a span may end, like 1h, "off" disables the check`, value: &c.Ingest.MaxClockSkew},
+		{env: "INGEST_MAX_NAME_LENGTH", flag: "ingest-max-name-length", usage: `longest span name accepted in bytes, "off" disables the check`, value: &c.Ingest.MaxNameLength},
+		{env: "SELF_TRACE_ENDPOINT", flag: "self-trace-endpoint", usage: `OTLP endpoint of the server's own traces, "loopback" for this collector`, value: &c.SelfTrace.Endpoint},
+		{env: "SELF_TRACE_SERVICE", flag: "self-trace-service", usage: "service.name of the server's own traces", value: &c.SelfTrace.Service},
+		{env: "SELF_TRACE_RATE", flag: "self-trace-rate", usage: "fraction of requests traced", value: &c.SelfTrace.Rate},
+		{env: "STATSD_ADDR", flag: "statsd-addr", usage: "StatsD address metrics are pushed to, empty disables it", value: &c.StatsD.Addr},
+		{env: "STATSD_FLAVOR", flag: "statsd-flavor", usage: "statsd or dogstatsd", value: &c.StatsD.Flavor},
+		{env: "STATSD_PREFIX", flag: "statsd-prefix", usage: "StatsD metric prefix", value: &c.StatsD.Prefix},
+		{env: "STATSD_INTERVAL", flag: "statsd-interval", usage: "StatsD push interval", value: &c.StatsD.Interval},
+		{env: "SMTP_ADDR", flag: "smtp-addr", usage: "SMTP server address", value: &c.SMTP.Addr},
+		{env: "SMTP_USERNAME", flag: "smtp-username", usage: "SMTP username", value: &c.SMTP.Username},
+		{env: "SMTP_PASSWORD", flag: "smtp-password", usage: "SMTP password", secret: true, value: &c.SMTP.Password},
+		{env: "SMTP_FROM", flag: "smtp-from", usage: "sender of emails", value: &c.SMTP.From},
+		{env: "GITHUB_WEBHOOK_SECRET", flag: "github-webhook-secret", usage: "secret of GitHub deployment webhooks", secret: true, value: &c.Webhooks.GitHubSecret},
+		{env: "GITLAB_WEBHOOK_SECRET", flag: "gitlab-webhook-secret", usage: "token of GitLab deployment webhooks", secret: true, value: &c.Webhooks.GitLabSecret},
+		{env: "OIDC_ISSUER", flag: "oidc-issuer", usage: "issuer URL of the OpenID Connect provider users log in with, empty disables login", value: &c.Auth.OIDCIssuer},
+		{env: "OIDC_CLIENT_ID", flag: "oidc-client-id", usage: "OpenID Connect client ID", value: &c.Auth.OIDCClientID},
+		{env: "OIDC_CLIENT_SECRET", flag: "oidc-client-secret", usage: "OpenID Connect client secret", secret: true, value: &c.Auth.OIDCClientSecret},
+		{env: "OIDC_REDIRECT_URL", flag: "oidc-redirect-url", usage: "public URL of the API's /auth/callback route", value: &c.Auth.OIDCRedirectURL},
+		{env: "SESSION_SECRET", flag: "session-secret", usage: "secret signing session cookies, random per process when empty", secret: true, value: &c.Auth.SessionSecret},
+		{env: "SESSION_TTL", flag: "session-ttl", usage: "how long a login lasts, e.g. 12h", value: &c.Auth.SessionTTL},
+		{env: "AUTH_ROLES", flag: "auth-roles", usage: "role bindings like sre=admin;payments=viewer:payments,checkout, separated by ;", value: &c.Auth.Roles},
+		{env: "AUTH_SERVICE_ROLES", flag: "auth-service-roles", usage: "least role that sees a service's spans, like billing=admin, separated by ;", value: &c.Auth.ServiceRoles},
+		{env: "AUTH_DEFAULT_ROLE", flag: "auth-default-role", usage: "role of users no binding matches: none, viewer, editor or admin", value: &c.Auth.DefaultRole},
+		{env: "CATALOG_IDLE_AFTER", flag: "catalog-idle-after", usage: `how long a service goes without spans before it's retired, like 7d, "off" disables it`, value: &c.Catalog.IdleAfter},
+		{env: "SERVICE_EDGES", flag: "service-edges", usage: "how service dependencies are computed: live, or precomputed every minute into service_edges", value: &c.Dependencies.Edges},
+		{env: "TRACE_COMPLETION_WINDOW", flag: "trace-completion-window", usage: `how long the spans of a trace are waited for before it's checked for a missing root or parents, like 5m, "off" disables it`, value: &c.Traces.CompletionWindow},
+	}
+}
+
+// Load registers the config flags on fs, parses args and builds the configuration
+// from every source. Flags the caller registered on fs beforehand are parsed too.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	path := fs.String("config", os.Getenv("NABATSHY_CONFIG"), "path of the YAML config file")
+	// flags are only applied when set, so they're parsed into their own values
+	flags := make(map[string]*string)
+	for _, s := range Default().settings() {
+		flags[s.flag] = fs.String(s.flag, "", s.usage+" (env "+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	if os.Getenv("ENV") != "production" {
+		if err := loadDotEnv(".env"); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range cfg.settings() {
+		if v, ok := os.LookupEnv(s.env); ok {
+			*s.value = v
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range cfg.settings() {
+		if set[s.flag] {
+			*s.value = *flags[s.flag]
+		}
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// a typo in a key would otherwise be silently ignored
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadDotEnv sets the KEY=value lines of path as environment variables, without
+// overriding variables that are already set. A missing file is fine.
+func loadDotEnv(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		os.Setenv(key, strings.Trim(strings.TrimSpace(value), `"'`))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
+
+// Print writes the configuration as YAML with secrets redacted, it can be used as a config file
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	for _, s := range redacted.settings() {
+		if s.secret && *s.value != "" {
+			*s.value = "REDACTED"
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&redacted); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"nabatshy/alerts"
+	"nabatshy/annotations"
+	"nabatshy/anomaly"
+	"nabatshy/api"
+	"nabatshy/auth"
+	"nabatshy/bookmarks"
+	"nabatshy/catalog"
+	"nabatshy/collector"
+	"nabatshy/config"
+	"nabatshy/dashboards"
+	"nabatshy/db"
+	"nabatshy/display"
+	"nabatshy/metrics"
+	"nabatshy/notify"
+	"nabatshy/preferences"
+	"nabatshy/projects"
+	"nabatshy/provision"
+	"nabatshy/reports"
+	"nabatshy/searches"
+	"nabatshy/selfmonitor"
+	"nabatshy/slo"
+	"nabatshy/tempo"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/doug-martin/goqu/v9"
+)
+
+//go:generate sh -c "go run . --print-openapi > docs/openapi.json"
+
+// apiServices are what the controllers of the API serve
+type apiServices struct {
+	conn          clickhouse.Conn
+	cluster       db.Cluster
+	goquDB        goqu.DialectWrapper
+	jsonAttrs     bool
+	catalog       *catalog.CatalogService
+	projects      *projects.ProjectService
+	searches      *searches.SearchService
+	ingestTracker *collector.IngestTracker
+	ingestTap     *collector.IngestTap
+	traceLimiter  *collector.TraceLimiter
+	sampler       *collector.Sampler
+	drainer       *collector.Drainer
+	monitor       *selfmonitor.Monitor
+	provisioner   *provision.ProvisionService
+	alerts        *alerts.AlertService
+	slos          *slo.SLOService
+	sloEvaluator  *slo.Evaluator
+	channels      *notify.ChannelService
+	dispatcher    *notify.Dispatcher
+	anomalies     *anomaly.AnomalyService
+	reports       *reports.ReportService
+	annotations   annotations.AnnotationService
+	webhooks      config.Webhooks
+	authenticator *auth.Authenticator
+}
+
+// apiControllers are the controllers of the API besides the telemetry and health
+// ones api.NewHandler adds
+func apiControllers(s apiServices) []api.RouteRegistrar {
+	return []api.RouteRegistrar{
+		catalog.NewCatalogController(s.catalog),
+		metrics.NewMetricsController(),
+		projects.NewProjectController(s.projects),
+		searches.NewSearchController(s.searches),
+		dashboards.NewDashboardController(&dashboards.DashboardService{Ch: &s.conn}),
+		bookmarks.NewBookmarkController(&bookmarks.BookmarkService{Ch: &s.conn, Cluster: s.cluster}),
+		preferences.NewPreferenceController(&preferences.PreferenceService{Ch: &s.conn}),
+		display.NewDisplayController(&display.DisplayService{Ch: &s.conn}),
+		tempo.NewTempoController(&tempo.TempoService{Ch: &s.conn, DB: &s.goquDB, JSONAttributes: s.jsonAttrs}),
+		collector.NewIngestDebugController(s.ingestTracker, &s.conn),
+		collector.NewIngestTapController(s.ingestTap),
+		collector.NewTraceSizeController(s.traceLimiter, &s.conn),
+		collector.NewSamplingController(s.sampler),
+		collector.NewDrainController(s.drainer),
+		selfmonitor.NewSelfMonitorController(s.monitor),
+		provision.NewProvisionController(s.provisioner),
+		alerts.NewAlertController(s.alerts),
+		slo.NewSLOController(s.slos, s.sloEvaluator),
+		notify.NewNotifyController(s.channels, s.dispatcher),
+		anomaly.NewAnomalyController(s.anomalies),
+		reports.NewReportController(s.reports),
+		annotations.NewAnnotationController(
+			s.annotations,
+			s.webhooks.GitHubSecret,
+			s.webhooks.GitLabSecret,
+		),
+		auth.NewAuthController(s.authenticator),
+	}
+}
+
+// writeOpenAPI writes the OpenAPI document the API serves, from the routes of
+// controllers without services or a database. docs/openapi.json is generated with it.
+func writeOpenAPI(w io.Writer) error {
+	handler := api.NewHandler(nil, api.Options{}, apiControllers(apiServices{})...)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("failed to build the openapi document: %s", rec.Body)
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, rec.Body.Bytes(), "", "  "); err != nil {
+		return err
+	}
+	_, err := out.WriteTo(w)
+	return err
+}
@@ -0,0 +1,131 @@
+package dashboards
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nabatshy/auth"
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type DashboardController struct {
+	service *DashboardService
+}
+
+func NewDashboardController(service *DashboardService) *DashboardController {
+	return &DashboardController{service: service}
+}
+
+func (c *DashboardController) listDashboards(w http.ResponseWriter, r *http.Request) {
+	dashboards, err := c.service.ListDashboards(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list dashboards: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dashboards)
+}
+
+func (c *DashboardController) getDashboard(w http.ResponseWriter, r *http.Request) {
+	dashboard, found, err := c.service.GetDashboard(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get dashboard: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "dashboard not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dashboard)
+}
+
+func (c *DashboardController) createDashboard(w http.ResponseWriter, r *http.Request) {
+	var dashboard Dashboard
+	if err := json.NewDecoder(r.Body).Decode(&dashboard); err != nil {
+		http.Error(w, "invalid dashboard: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dashboard.ID = ""
+	dashboard.Owner = ""
+	if u := auth.UserFromContext(r.Context()); u != nil {
+		dashboard.Owner = u.Subject
+	}
+	if err := dashboard.Validate(); err != nil {
+		http.Error(w, "invalid dashboard: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveDashboard(r.Context(), &dashboard); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create dashboard: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(dashboard)
+}
+
+func (c *DashboardController) updateDashboard(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	existing, found, err := c.service.GetDashboard(r.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get dashboard: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "dashboard not found", http.StatusNotFound)
+		return
+	}
+
+	var dashboard Dashboard
+	if err := json.NewDecoder(r.Body).Decode(&dashboard); err != nil {
+		http.Error(w, "invalid dashboard: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dashboard.ID = id
+	dashboard.Owner = existing.Owner
+	if err := dashboard.Validate(); err != nil {
+		http.Error(w, "invalid dashboard: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveDashboard(r.Context(), &dashboard); err != nil {
+		http.Error(w, fmt.Sprintf("failed to update dashboard: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dashboard)
+}
+
+func (c *DashboardController) deleteDashboard(w http.ResponseWriter, r *http.Request) {
+	if err := c.service.DeleteDashboard(r.Context(), chi.URLParam(r, "id")); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete dashboard: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *DashboardController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/dashboards", Summary: "Dashboards", Response: []Dashboard{}},
+		{Method: http.MethodPost, Path: "/v1/dashboards", Summary: "Create a dashboard", Request: Dashboard{}, Response: Dashboard{}, Status: http.StatusCreated},
+		{Method: http.MethodGet, Path: "/v1/dashboards/{id}", Summary: "A dashboard", Response: Dashboard{}},
+		{Method: http.MethodPut, Path: "/v1/dashboards/{id}", Summary: "Update a dashboard", Request: Dashboard{}, Response: Dashboard{}},
+		{Method: http.MethodDelete, Path: "/v1/dashboards/{id}", Summary: "Delete a dashboard", Status: http.StatusNoContent},
+	}
+}
+
+func (c *DashboardController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/dashboards", c.listDashboards)
+	r.Post("/v1/dashboards", c.createDashboard)
+	r.Get("/v1/dashboards/{id}", c.getDashboard)
+	r.Put("/v1/dashboards/{id}", c.updateDashboard)
+	r.Delete("/v1/dashboards/{id}", c.deleteDashboard)
+}
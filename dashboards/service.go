@@ -0,0 +1,142 @@
+package dashboards
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"nabatshy/db"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/google/uuid"
+)
+
+const dashboardsTable = "dashboards"
+
+// GridColumns is the width of the grid panels are laid out on
+const GridColumns = 12
+
+// Endpoints are the API paths panels can show the data of
+var Endpoints = []string{
+	"/api/metrics/traces",
+	"/api/metrics/services",
+	"/api/metrics/endpoints",
+	"/api/metrics/pseries",
+	"/api/metrics/avg",
+	"/api/metrics/errors",
+	"/api/metrics/search",
+	"/api/metrics/queue-wait",
+	"/v1/traces",
+	"/v1/traces/slowest",
+	"/v1/traces/endpoints",
+	"/v1/traces/dependencies",
+	"/v1/traces/heatmap",
+	"/v1/services/health",
+	"/v1/attributes/topk",
+}
+
+// PanelTypes are how the UI can draw the data of a panel
+var PanelTypes = []string{"timeseries", "bar", "table", "stat", "heatmap"}
+
+// Dashboard is a set of panels shared by everyone, laid out on a grid
+type Dashboard struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// TimeRange is the range the dashboard opens with, like 1h or 7d, 24h when empty
+	TimeRange string  `json:"time_range,omitempty"`
+	Panels    []Panel `json:"panels"`
+	// Owner is the subject of the user who created the dashboard, empty without auth
+	Owner     string    `json:"owner,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Panel shows the data of an API endpoint over the dashboard's time range
+type Panel struct {
+	Title    string `json:"title"`
+	Type     string `json:"type"`
+	Endpoint string `json:"endpoint"`
+	// Params are the query parameters of the endpoint besides the time range, like
+	// service, percentile or query
+	Params map[string]string `json:"params,omitempty"`
+	Layout Layout            `json:"layout"`
+}
+
+// Layout places a panel on the grid, in columns and rows from the top left
+type Layout struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type DashboardService struct {
+	Ch *clickhouse.Conn
+}
+
+// Validate checks the dashboard
+func (d *Dashboard) Validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if d.TimeRange != "" {
+		if _, err := utils.ParseTimeRange(d.TimeRange); err != nil {
+			return err
+		}
+	}
+	if d.Panels == nil {
+		d.Panels = []Panel{}
+	}
+	for i, p := range d.Panels {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("panel %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (p *Panel) validate() error {
+	if !slices.Contains(PanelTypes, p.Type) {
+		return fmt.Errorf("invalid type %q, use one of %v", p.Type, PanelTypes)
+	}
+	if !slices.Contains(Endpoints, p.Endpoint) {
+		return fmt.Errorf("unsupported endpoint %q", p.Endpoint)
+	}
+	for key := range p.Params {
+		switch key {
+		case "start", "end", "timeRange":
+			return fmt.Errorf("the time range is the dashboard's, %s can't be set", key)
+		}
+	}
+	l := p.Layout
+	if l.X < 0 || l.Y < 0 || l.W < 1 || l.H < 1 || l.X+l.W > GridColumns {
+		return fmt.Errorf("layout must fit in %d columns with a width and height of at least 1", GridColumns)
+	}
+	return nil
+}
+
+func (s *DashboardService) ListDashboards(ctx context.Context) ([]Dashboard, error) {
+	return db.ListDocuments[Dashboard](ctx, *s.Ch, dashboardsTable)
+}
+
+func (s *DashboardService) GetDashboard(ctx context.Context, id string) (Dashboard, bool, error) {
+	return db.GetDocument[Dashboard](ctx, *s.Ch, dashboardsTable, id)
+}
+
+// SaveDashboard creates the dashboard when it has no ID, otherwise replaces it
+func (s *DashboardService) SaveDashboard(ctx context.Context, d *Dashboard) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if d.ID == "" {
+		d.ID = uuid.New().String()
+	}
+	d.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, dashboardsTable, d.ID, d.Name, d)
+}
+
+func (s *DashboardService) DeleteDashboard(ctx context.Context, id string) error {
+	return db.DeleteDocument(ctx, *s.Ch, dashboardsTable, id)
+}
@@ -7,24 +7,41 @@ import (
 	"github.com/ClickHouse/clickhouse-go/v2"
 )
 
-func InitClickHouse(addr, db, username, password string) clickhouse.Conn {
-	var err error
+// InitClickHouse connects to ClickHouse at addr, a comma separated list of the
+// addresses of replicas that operations are spread over by balancing
+func InitClickHouse(addr, db, username, password string, balancing Balancing, cluster Cluster) clickhouse.Conn {
+	settings := clickhouse.Settings{
+		"max_execution_time": 60,
+	}
+	if cluster.Enabled() {
+		// documents are read back right after they're written
+		settings["insert_distributed_sync"] = 1
+		// the subqueries of spans join the spans of the same trace, which sit on one shard
+		settings["distributed_product_mode"] = "local"
+	}
+	open := func(addr string) (clickhouse.Conn, error) {
+		return clickhouse.Open(&clickhouse.Options{
+			Addr: []string{addr},
+			Auth: clickhouse.Auth{
+				Database: db,
+				Username: username,
+				Password: password,
+			},
+			Settings:    settings,
+			DialTimeout: 5 * time.Second,
+			Compression: &clickhouse.Compression{
+				Method: clickhouse.CompressionLZ4,
+			},
+		})
+	}
+
 	var ch clickhouse.Conn
-	ch, err = clickhouse.Open(&clickhouse.Options{
-		Addr: []string{addr},
-		Auth: clickhouse.Auth{
-			Database: db,
-			Username: username,
-			Password: password,
-		},
-		Settings: clickhouse.Settings{
-			"max_execution_time": 60,
-		},
-		DialTimeout: 5 * time.Second,
-		Compression: &clickhouse.Compression{
-			Method: clickhouse.CompressionLZ4,
-		},
-	})
+	var err error
+	if addrs := ParseAddrs(addr); len(addrs) > 1 {
+		ch, err = newReplicaConn(addrs, balancing, open)
+	} else {
+		ch, err = open(addr)
+	}
 	if err != nil {
 		errMsg := fmt.Sprintf("connecting to clickhouse err: %v", err)
 		panic(errMsg)
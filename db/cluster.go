@@ -0,0 +1,108 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Cluster lays the schema out over a sharded ClickHouse cluster. Every table is
+// created as a Replicated*MergeTree named <table>_local on each node, behind a
+// Distributed table of the original name, so queries and inserts keep using the
+// names they use on a single server. The zero Cluster is a single server.
+type Cluster struct {
+	// Name is the cluster of the server's remote_servers configuration
+	Name string
+}
+
+// LocalSuffix is appended to the names of the tables holding the data of a shard
+const LocalSuffix = "_local"
+
+var (
+	createTableRe = regexp.MustCompile(`^\s*CREATE TABLE IF NOT EXISTS (\w+) \(`)
+	alterTableRe  = regexp.MustCompile(`^\s*ALTER TABLE (\w+)`)
+	// skip indexes and storage settings only exist on the tables holding the data
+	indexRe  = regexp.MustCompile(`\b((ADD|DROP|MATERIALIZE|CLEAR) INDEX|MODIFY SETTING)\b`)
+	engineRe = regexp.MustCompile(`ENGINE = (\w*MergeTree)(?:\(([^)]*)\))?`)
+)
+
+// shardingKeys spread rows by the first column a table has: the spans of a trace
+// stay on one shard so the joins and IN subqueries of a trace run locally, and
+// every version of a document lands on the same shard for FINAL to merge them
+var shardingKeys = []struct{ column, key string }{
+	{"trace_id", "cityHash64(trace_id)"},
+	{"id", "cityHash64(id)"},
+	{"key", "cityHash64(key)"},
+}
+
+// Enabled reports whether the tables are distributed
+func (c Cluster) Enabled() bool {
+	return c.Name != ""
+}
+
+// onCluster is the ON CLUSTER clause of DDL statements
+func (c Cluster) onCluster() string {
+	return " ON CLUSTER `" + strings.ReplaceAll(c.Name, "`", "\\`") + "`"
+}
+
+// AlterTable returns what ALTER TABLE statements changing the data or storage of
+// table, like deletes and TTLs, should name
+func (c Cluster) AlterTable(table string) string {
+	if !c.Enabled() {
+		return table
+	}
+	return table + LocalSuffix + c.onCluster()
+}
+
+// Statements returns the statements applying a schema change written for a single
+// server. A CREATE TABLE becomes the replicated local table and the Distributed
+// table over it, an ALTER TABLE is applied to both, or to the local table only when
+// it changes skip indexes or storage settings.
+func (c Cluster) Statements(sql string) ([]string, error) {
+	if !c.Enabled() {
+		return []string{sql}, nil
+	}
+
+	if m := createTableRe.FindStringSubmatchIndex(sql); m != nil {
+		table := sql[m[2]:m[3]]
+		local := table + LocalSuffix
+		create := sql[:m[2]] + local + c.onCluster() + sql[m[3]:]
+
+		engine := engineRe.FindStringSubmatchIndex(create)
+		if engine == nil {
+			return nil, fmt.Errorf("table %s has no MergeTree engine to replicate", table)
+		}
+		args := fmt.Sprintf("'/clickhouse/tables/{shard}/{database}/%s', '{replica}'", local)
+		if engine[4] >= 0 && create[engine[4]:engine[5]] != "" {
+			args += ", " + create[engine[4]:engine[5]]
+		}
+		create = create[:engine[0]] + "ENGINE = Replicated" + create[engine[2]:engine[3]] + "(" + args + ")" + create[engine[1]:]
+
+		distributed := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s AS %s ENGINE = Distributed('%s', currentDatabase(), '%s', %s)",
+			table, c.onCluster(), local, escapeString(c.Name), local, shardingKey(sql))
+		return []string{create, distributed}, nil
+	}
+
+	if m := alterTableRe.FindStringSubmatchIndex(sql); m != nil {
+		table := sql[m[2]:m[3]]
+		rest := sql[m[3]:]
+		if indexRe.MatchString(rest) {
+			return []string{sql[:m[2]] + table + LocalSuffix + c.onCluster() + rest}, nil
+		}
+		return []string{
+			sql[:m[2]] + table + LocalSuffix + c.onCluster() + rest,
+			sql[:m[2]] + table + c.onCluster() + rest,
+		}, nil
+	}
+	return nil, fmt.Errorf("can't apply %q to a cluster", strings.TrimSpace(sql))
+}
+
+// shardingKey returns the sharding key of the table created by sql
+func shardingKey(sql string) string {
+	for _, k := range shardingKeys {
+		if regexp.MustCompile(`\n\s*` + k.column + ` `).MatchString(sql) {
+			return k.key
+		}
+	}
+	return "rand()"
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// Document tables hold small metadata objects (alert rules, SLOs, ...) as JSON
+// definitions. Every write inserts a new version of the row and the
+// ReplacingMergeTree keeps the latest one, deletes are tombstones.
+func documentTableSQL(table string) string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+    id String,
+    name String,
+    definition String,
+    deleted UInt8 DEFAULT 0,
+    updated_at DateTime64(3) DEFAULT now64(3)
+) ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY id`, table)
+}
+
+// ListDocuments returns the current version of every document in table
+func ListDocuments[T any](ctx context.Context, ch clickhouse.Conn, table string) ([]T, error) {
+	rows, err := ch.Query(ctx, fmt.Sprintf("SELECT definition FROM %s FINAL WHERE deleted = 0 ORDER BY name", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	docs := []T{}
+	for rows.Next() {
+		var definition string
+		if err := rows.Scan(&definition); err != nil {
+			return nil, err
+		}
+		var doc T
+		if err := json.Unmarshal([]byte(definition), &doc); err != nil {
+			return nil, fmt.Errorf("invalid %s definition: %w", table, err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+// GetDocument returns the current version of a document and whether it exists
+func GetDocument[T any](ctx context.Context, ch clickhouse.Conn, table, id string) (T, bool, error) {
+	var doc T
+	rows, err := ch.Query(ctx, fmt.Sprintf("SELECT definition FROM %s FINAL WHERE id = ? AND deleted = 0", table), id)
+	if err != nil {
+		return doc, false, fmt.Errorf("failed to get %s %s: %w", table, id, err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return doc, false, rows.Err()
+	}
+	var definition string
+	if err := rows.Scan(&definition); err != nil {
+		return doc, false, err
+	}
+	if err := json.Unmarshal([]byte(definition), &doc); err != nil {
+		return doc, false, fmt.Errorf("invalid %s definition: %w", table, err)
+	}
+	return doc, true, nil
+}
+
+// PutDocument creates or replaces a document
+func PutDocument(ctx context.Context, ch clickhouse.Conn, table, id, name string, doc any) error {
+	definition, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	err = ch.Exec(ctx,
+		fmt.Sprintf("INSERT INTO %s (id, name, definition, deleted, updated_at) VALUES (?, ?, ?, 0, ?)", table),
+		id, name, string(definition), time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write %s %s: %w", table, id, err)
+	}
+	return nil
+}
+
+// DeleteDocument marks a document as deleted
+func DeleteDocument(ctx context.Context, ch clickhouse.Conn, table, id string) error {
+	err := ch.Exec(ctx,
+		fmt.Sprintf("INSERT INTO %s (id, name, definition, deleted, updated_at) VALUES (?, '', '', 1, ?)", table),
+		id, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s %s: %w", table, id, err)
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// Migration is a single versioned schema change
+type Migration struct {
+	Version uint32
+	Name    string
+	SQL     string
+}
+
+// Migrations are applied in order and recorded in the schema_migrations table.
+// Never edit an existing entry, append a new one instead.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_denormalized_span",
+		SQL: `
+CREATE TABLE IF NOT EXISTS denormalized_span (
+    trace_id String,
+    span_id String,
+    parent_span_id String,
+    flags Int32,
+    name String,
+    start_time_unix_nano Int64,
+    end_time_unix_nano Int64,
+    duration_ns Int64 MATERIALIZED (end_time_unix_nano - start_time_unix_nano),
+    scope_id UUID,
+    scope_name String,
+    resource_id UUID,
+    resource_schema_url String,
+    resource_attributes Nested (key String, value String),
+    span_attributes Nested (key String, value String),
+    events Nested (
+        time_unix_nano Int64,
+        name String
+    ),
+    ` + "`events.attributes.key`" + ` Array(Array(String)),
+    ` + "`events.attributes.value`" + ` Array(Array(String)),
+    PRIMARY KEY (start_time_unix_nano)
+) ENGINE = MergeTree
+ORDER BY (start_time_unix_nano, trace_id)`,
+	},
+	{
+		Version: 2,
+		Name:    "create_settings",
+		SQL: `
+CREATE TABLE IF NOT EXISTS settings (
+    key String,
+    value String,
+    updated_at DateTime64(3) DEFAULT now64(3)
+) ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY key`,
+	},
+	{
+		Version: 3,
+		Name:    "create_annotations",
+		SQL: `
+CREATE TABLE IF NOT EXISTS annotations (
+    id UUID,
+    time DateTime64(3),
+    title String,
+    text String,
+    tags Array(String),
+    service String,
+    source LowCardinality(String),
+    url String,
+    created_at DateTime64(3) DEFAULT now64(3)
+) ENGINE = MergeTree
+ORDER BY (time, id)`,
+	},
+	{
+		Version: 4,
+		Name:    "add_span_kind_and_links",
+		SQL: `
+ALTER TABLE denormalized_span
+    ADD COLUMN IF NOT EXISTS kind LowCardinality(String) DEFAULT '',
+    ADD COLUMN IF NOT EXISTS links Nested (trace_id String, span_id String)`,
+	},
+	{
+		Version: 5,
+		Name:    "create_alert_rules",
+		SQL:     documentTableSQL("alert_rules"),
+	},
+	{
+		Version: 6,
+		Name:    "create_alert_events",
+		SQL: `
+CREATE TABLE IF NOT EXISTS alert_events (
+    rule_id String,
+    rule_name String,
+    state LowCardinality(String),
+    value Float64,
+    threshold Float64,
+    message String,
+    time DateTime64(3) DEFAULT now64(3)
+) ENGINE = MergeTree
+ORDER BY (time, rule_id)`,
+	},
+	{
+		Version: 7,
+		Name:    "create_service_metadata",
+		SQL:     documentTableSQL("service_metadata"),
+	},
+	{
+		Version: 8,
+		Name:    "add_alert_event_links",
+		SQL: `
+ALTER TABLE alert_events
+    ADD COLUMN IF NOT EXISTS runbook_url String DEFAULT '',
+    ADD COLUMN IF NOT EXISTS dashboard_url String DEFAULT ''`,
+	},
+	{
+		Version: 9,
+		Name:    "add_alert_event_owner",
+		SQL: `
+ALTER TABLE alert_events
+    ADD COLUMN IF NOT EXISTS owner_team String DEFAULT '',
+    ADD COLUMN IF NOT EXISTS owner_slack_channel String DEFAULT '',
+    ADD COLUMN IF NOT EXISTS owner_escalation String DEFAULT ''`,
+	},
+	{
+		Version: 10,
+		Name:    "create_slos",
+		SQL:     documentTableSQL("slos"),
+	},
+	{
+		Version: 11,
+		Name:    "create_notification_channels",
+		SQL:     documentTableSQL("notification_channels"),
+	},
+	{
+		Version: 12,
+		Name:    "create_anomalies",
+		SQL: `
+CREATE TABLE IF NOT EXISTS anomalies (
+    time DateTime64(3),
+    service String,
+    endpoint String,
+    metric LowCardinality(String),
+    value Float64,
+    baseline Float64,
+    score Float64
+) ENGINE = MergeTree
+ORDER BY (time, service)`,
+	},
+	{
+		Version: 13,
+		Name:    "add_attributes_json",
+		SQL: `
+ALTER TABLE denormalized_span
+    ADD COLUMN IF NOT EXISTS attributes_json String DEFAULT '' CODEC(ZSTD(3))`,
+	},
+	{
+		Version: 14,
+		Name:    "create_reports",
+		SQL:     documentTableSQL("reports"),
+	},
+	{
+		Version: 15,
+		Name:    "create_latency_targets",
+		SQL:     documentTableSQL("latency_targets"),
+	},
+	{
+		Version: 16,
+		Name:    "create_projects",
+		SQL:     documentTableSQL("projects"),
+	},
+	{
+		Version: 17,
+		Name:    "create_saved_searches",
+		SQL:     documentTableSQL("saved_searches"),
+	},
+	{
+		Version: 18,
+		Name:    "create_retired_services",
+		SQL:     documentTableSQL("retired_services"),
+	},
+	{
+		// the maps pair every key with its value, unlike has() on the key and value
+		// arrays. Parts written before are computed on read.
+		Version: 19,
+		Name:    "add_attribute_maps",
+		SQL: `
+ALTER TABLE denormalized_span
+    ADD COLUMN IF NOT EXISTS resource_attributes_map Map(String, String) MATERIALIZED mapFromArrays(resource_attributes.key, resource_attributes.value),
+    ADD COLUMN IF NOT EXISTS span_attributes_map Map(String, String) MATERIALIZED mapFromArrays(span_attributes.key, span_attributes.value)`,
+	},
+	{
+		// the calls between services per minute, filled by api.EdgeAggregator
+		Version: 20,
+		Name:    "create_service_edges",
+		SQL: `
+CREATE TABLE IF NOT EXISTS service_edges (
+    time DateTime,
+    source String,
+    target String,
+    calls SimpleAggregateFunction(sum, UInt64),
+    errors SimpleAggregateFunction(sum, UInt64),
+    latency AggregateFunction(quantiles(0.5, 0.95), Float64)
+) ENGINE = AggregatingMergeTree
+ORDER BY (time, source, target)`,
+	},
+	{
+		// an n-gram index over the searchable text of a span, see api.searchText.
+		// Parts written before aren't indexed until they're merged.
+		Version: 21,
+		Name:    "add_search_text_index",
+		SQL: `
+ALTER TABLE denormalized_span
+    ADD INDEX IF NOT EXISTS search_text_ngram ` + SearchText + ` TYPE ngrambf_v1(3, 65536, 2, 0) GRANULARITY 4`,
+	},
+	{
+		Version: 22,
+		Name:    "create_dashboards",
+		SQL:     documentTableSQL("dashboards"),
+	},
+	{
+		Version: 23,
+		Name:    "create_preferences",
+		SQL:     documentTableSQL("preferences"),
+	},
+	{
+		Version: 24,
+		Name:    "create_bookmarks",
+		SQL:     documentTableSQL("bookmarks"),
+	},
+	{
+		// the spans of bookmarked traces, which the span retention keeps
+		Version: 25,
+		Name:    "add_span_pinned",
+		SQL: `
+ALTER TABLE denormalized_span
+    ADD COLUMN IF NOT EXISTS pinned UInt8 DEFAULT 0`,
+	},
+	{
+		// the exception.fingerprint attributes the collector adds to exception events,
+		// see collector.ExceptionFingerprint. Parts written before are computed on read.
+		Version: 26,
+		Name:    "add_error_fingerprints",
+		SQL: `
+ALTER TABLE denormalized_span
+    ADD COLUMN IF NOT EXISTS error_fingerprints Array(String) MATERIALIZED
+        arrayFilter(f -> f != '', arrayMap((ks, vs) -> vs[indexOf(ks, 'exception.fingerprint')], events.attributes.key, events.attributes.value))`,
+	},
+	{
+		Version: 27,
+		Name:    "create_error_groups",
+		SQL:     documentTableSQL("error_groups"),
+	},
+	{
+		// the HTTP semantic convention attributes, see utils.HTTPFields. Spans written
+		// before have them empty.
+		Version: 28,
+		Name:    "add_http_columns",
+		SQL: `
+ALTER TABLE denormalized_span
+    ADD COLUMN IF NOT EXISTS http_method LowCardinality(String) DEFAULT '',
+    ADD COLUMN IF NOT EXISTS http_route LowCardinality(String) DEFAULT '',
+    ADD COLUMN IF NOT EXISTS http_status_code UInt16 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS http_target String DEFAULT ''`,
+	},
+	{
+		// service.version is always kept in the Nested resource attributes, see
+		// utils.NestedResourceAttributes. Parts written before are computed on read.
+		Version: 29,
+		Name:    "add_service_version",
+		SQL: `
+ALTER TABLE denormalized_span
+    ADD COLUMN IF NOT EXISTS service_version LowCardinality(String) MATERIALIZED
+        resource_attributes.value[indexOf(resource_attributes.key, 'service.version')]`,
+	},
+	{
+		// the traces missing their root span or the parents of some spans, filled by
+		// api.CompletenessChecker once the traces had time to arrive
+		Version: 30,
+		Name:    "create_incomplete_traces",
+		SQL: `
+CREATE TABLE IF NOT EXISTS incomplete_traces (
+    trace_id String,
+    start_time_unix_nano Int64,
+    duration_ns Int64,
+    service String,
+    spans UInt64,
+    missing_root UInt8,
+    missing_parents UInt64,
+    evaluated_at DateTime DEFAULT now()
+) ENGINE = ReplacingMergeTree(evaluated_at)
+ORDER BY trace_id`,
+	},
+	{
+		// remembers the tokens of the last inserts so retried batches are dropped, see
+		// collector.dedupToken. Replicated tables deduplicate without it.
+		Version: 31,
+		Name:    "add_span_insert_deduplication",
+		SQL: `
+ALTER TABLE denormalized_span
+    MODIFY SETTING non_replicated_deduplication_window = 1000`,
+	},
+}
+
+// SearchText is the lowercased text full-text searches match, the span name, the
+// attribute values and the event names. Queries must use the exact expression for
+// the search_text_ngram index to apply, it can't change once migration 21 ran.
+const SearchText = "lower(concat(name, ' ', arrayStringConcat(resource_attributes.value, ' '), ' ', " +
+	"arrayStringConcat(span_attributes.value, ' '), ' ', arrayStringConcat(events.name, ' '), ' ', attributes_json))"
+
+// Migrate creates the schema_migrations table if needed and applies any
+// migrations that haven't been applied yet, over the cluster when it's enabled
+func Migrate(ctx context.Context, ch clickhouse.Conn, cluster Cluster) error {
+	if err := execAll(ctx, ch, cluster, `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version UInt32,
+    name String,
+    applied_at DateTime DEFAULT now()
+) ENGINE = MergeTree
+ORDER BY version`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	current, err := SchemaVersion(ctx, ch)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range Migrations {
+		if m.Version <= current {
+			continue
+		}
+		log.Printf("applying migration %d_%s\n", m.Version, m.Name)
+		if err := execAll(ctx, ch, cluster, m.SQL); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+		if err := ch.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+			return fmt.Errorf("failed to record migration %d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// execAll runs a schema change written for a single server on the cluster
+func execAll(ctx context.Context, ch clickhouse.Conn, cluster Cluster, sql string) error {
+	statements, err := cluster.Statements(sql)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range statements {
+		if err := ch.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the highest applied migration version
+func SchemaVersion(ctx context.Context, ch clickhouse.Conn) (uint32, error) {
+	var version uint32
+	if err := ch.QueryRow(ctx, "SELECT max(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// LatestSchemaVersion is the version the schema will be at once all migrations are applied
+func LatestSchemaVersion() uint32 {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// PromoteAttributes adds a LowCardinality column for every promoted attribute.
+// The column defaults to the attribute value so existing rows are readable
+// without a backfill, while new rows get the value populated at ingest.
+func PromoteAttributes(ctx context.Context, ch clickhouse.Conn, promoted []utils.PromotedAttribute, cluster Cluster) error {
+	for _, p := range promoted {
+		query := fmt.Sprintf(`
+ALTER TABLE denormalized_span
+ADD COLUMN IF NOT EXISTS %s LowCardinality(String)
+DEFAULT if(
+    has(span_attributes.key, '%[2]s'),
+    span_attributes.value[indexOf(span_attributes.key, '%[2]s')],
+    resource_attributes.value[indexOf(resource_attributes.key, '%[2]s')]
+)`, p.Column, escapeString(p.Key))
+		if err := execAll(ctx, ch, cluster, query); err != nil {
+			return fmt.Errorf("failed to promote attribute %s: %w", p.Key, err)
+		}
+	}
+	return nil
+}
+
+func escapeString(s string) string {
+	var out []rune
+	for _, r := range s {
+		if r == '\'' || r == '\\' {
+			out = append(out, '\\')
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
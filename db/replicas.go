@@ -0,0 +1,265 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Balancing is how operations are spread over the ClickHouse replicas
+type Balancing string
+
+const (
+	RoundRobin Balancing = "round-robin"
+	// LeastLoaded picks the replica with the fewest operations in flight
+	LeastLoaded Balancing = "least-loaded"
+)
+
+// replicaBackoff is how long a replica that failed to connect is skipped
+const replicaBackoff = 10 * time.Second
+
+// ParseBalancing parses the CLICKHOUSE_BALANCING value, empty is round-robin
+func ParseBalancing(s string) (Balancing, error) {
+	switch Balancing(s) {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, LeastLoaded:
+		return Balancing(s), nil
+	}
+	return "", fmt.Errorf("invalid clickhouse balancing %q, use round-robin or least-loaded", s)
+}
+
+// ParseAddrs splits the comma separated CLICKHOUSE_ADDR value
+func ParseAddrs(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+type replica struct {
+	addr     string
+	conn     driver.Conn
+	inFlight atomic.Int64
+	// downUntil is the unix nano time until which the replica is skipped
+	downUntil atomic.Int64
+}
+
+func (r *replica) up(now time.Time) bool {
+	return r.downUntil.Load() <= now.UnixNano()
+}
+
+// replicaConn spreads operations over the connection pools of several replicas of
+// the same data. An operation that fails because its replica can't be reached is
+// retried on the next one, and the replica is skipped for replicaBackoff. Query
+// errors reported by ClickHouse itself aren't retried.
+type replicaConn struct {
+	replicas  []*replica
+	balancing Balancing
+	next      atomic.Uint64
+}
+
+// newReplicaConn returns a connection over one pool per address
+func newReplicaConn(addrs []string, balancing Balancing, open func(addr string) (driver.Conn, error)) (*replicaConn, error) {
+	c := &replicaConn{balancing: balancing}
+	for _, addr := range addrs {
+		conn, err := open(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		c.replicas = append(c.replicas, &replica{addr: addr, conn: conn})
+	}
+	return c, nil
+}
+
+// order returns the replicas in the order they should be tried, those that are up
+// first
+func (c *replicaConn) order() []*replica {
+	n := len(c.replicas)
+	start := int(c.next.Add(1)-1) % n
+	if c.balancing == LeastLoaded {
+		for i, r := range c.replicas {
+			if r.inFlight.Load() < c.replicas[start].inFlight.Load() {
+				start = i
+			}
+		}
+	}
+
+	now := time.Now()
+	var up, down []*replica
+	for i := range n {
+		r := c.replicas[(start+i)%n]
+		if r.up(now) {
+			up = append(up, r)
+		} else {
+			down = append(down, r)
+		}
+	}
+	// when every replica is down they're still tried, one may have come back
+	return append(up, down...)
+}
+
+// do runs op on the replicas until one is reachable
+func (c *replicaConn) do(ctx context.Context, op func(r *replica) error) error {
+	var err error
+	for _, r := range c.order() {
+		r.inFlight.Add(1)
+		err = op(r)
+		r.inFlight.Add(-1)
+		if err == nil || !utils.IsUnavailable(err) || ctx.Err() != nil {
+			if err == nil && !r.up(time.Now()) {
+				r.downUntil.Store(0)
+				log.Printf("clickhouse: replica %s is back\n", r.addr)
+			}
+			return err
+		}
+		if r.up(time.Now()) {
+			log.Printf("clickhouse: replica %s is unreachable, failing over: %v\n", r.addr, err)
+		}
+		r.downUntil.Store(time.Now().Add(replicaBackoff).UnixNano())
+	}
+	return err
+}
+
+// ExecEverywhere runs a statement acting on the server it's sent to, like a SYSTEM
+// statement, on every node: ON CLUSTER when a cluster is configured, else on each
+// replica of conn. Replicas that fail don't stop the others, the first error is
+// returned.
+func ExecEverywhere(ctx context.Context, conn driver.Conn, cluster Cluster, query string) error {
+	if cluster.Enabled() {
+		return conn.Exec(ctx, query+cluster.onCluster())
+	}
+	for {
+		w, ok := conn.(interface{ Unwrap() driver.Conn })
+		if !ok {
+			break
+		}
+		conn = w.Unwrap()
+	}
+	c, ok := conn.(*replicaConn)
+	if !ok {
+		return conn.Exec(ctx, query)
+	}
+	var first error
+	for _, r := range c.replicas {
+		if err := r.conn.Exec(ctx, query); err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", r.addr, err)
+		}
+	}
+	return first
+}
+
+func (c *replicaConn) Contributors() []string {
+	return c.replicas[0].conn.Contributors()
+}
+
+func (c *replicaConn) ServerVersion() (*driver.ServerVersion, error) {
+	var version *driver.ServerVersion
+	err := c.do(context.Background(), func(r *replica) (err error) {
+		version, err = r.conn.ServerVersion()
+		return err
+	})
+	return version, err
+}
+
+func (c *replicaConn) Select(ctx context.Context, dest any, query string, args ...any) error {
+	return c.do(ctx, func(r *replica) error {
+		return r.conn.Select(ctx, dest, query, args...)
+	})
+}
+
+func (c *replicaConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	var rows driver.Rows
+	err := c.do(ctx, func(r *replica) (err error) {
+		rows, err = r.conn.Query(ctx, query, args...)
+		if err == nil {
+			// the query stays in flight until its rows are read
+			r.inFlight.Add(1)
+			rows = &replicaRows{Rows: rows, replica: r}
+		}
+		return err
+	})
+	return rows, err
+}
+
+func (c *replicaConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	var row driver.Row
+	c.do(ctx, func(r *replica) error {
+		row = r.conn.QueryRow(ctx, query, args...)
+		return row.Err()
+	})
+	return row
+}
+
+func (c *replicaConn) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	var batch driver.Batch
+	err := c.do(ctx, func(r *replica) (err error) {
+		batch, err = r.conn.PrepareBatch(ctx, query, opts...)
+		return err
+	})
+	return batch, err
+}
+
+func (c *replicaConn) Exec(ctx context.Context, query string, args ...any) error {
+	return c.do(ctx, func(r *replica) error {
+		return r.conn.Exec(ctx, query, args...)
+	})
+}
+
+func (c *replicaConn) AsyncInsert(ctx context.Context, query string, wait bool, args ...any) error {
+	return c.do(ctx, func(r *replica) error {
+		return r.conn.AsyncInsert(ctx, query, wait, args...)
+	})
+}
+
+// Ping succeeds when any replica answers
+func (c *replicaConn) Ping(ctx context.Context) error {
+	return c.do(ctx, func(r *replica) error {
+		return r.conn.Ping(ctx)
+	})
+}
+
+func (c *replicaConn) Stats() driver.Stats {
+	var stats driver.Stats
+	for _, r := range c.replicas {
+		s := r.conn.Stats()
+		stats.MaxOpenConns += s.MaxOpenConns
+		stats.MaxIdleConns += s.MaxIdleConns
+		stats.Open += s.Open
+		stats.Idle += s.Idle
+	}
+	return stats
+}
+
+func (c *replicaConn) Close() error {
+	var first error
+	for _, r := range c.replicas {
+		if err := r.conn.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// replicaRows releases the replica's in flight slot when closed
+type replicaRows struct {
+	driver.Rows
+	replica *replica
+	once    sync.Once
+}
+
+func (r *replicaRows) Close() error {
+	r.once.Do(func() { r.replica.inFlight.Add(-1) })
+	return r.Rows.Close()
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// GetSetting returns the current value of a setting and whether it is set
+func GetSetting(ctx context.Context, ch clickhouse.Conn, key string) (string, bool, error) {
+	rows, err := ch.Query(ctx, "SELECT value FROM settings FINAL WHERE key = ?", key)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read setting %s: %w", key, err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return "", false, rows.Err()
+	}
+	var value string
+	if err := rows.Scan(&value); err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SetSetting stores the value of a setting, replacing any previous value
+func SetSetting(ctx context.Context, ch clickhouse.Conn, key, value string) error {
+	if err := ch.Exec(ctx, "INSERT INTO settings (key, value) VALUES (?, ?)", key, value); err != nil {
+		return fmt.Errorf("failed to write setting %s: %w", key, err)
+	}
+	return nil
+}
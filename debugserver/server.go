@@ -0,0 +1,86 @@
+package debugserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	rpprof "runtime/pprof"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	GoVersion string            `json:"go_version"`
+	Path      string            `json:"path"`
+	Version   string            `json:"version"`
+	Settings  map[string]string `json:"settings"`
+}
+
+// RuntimeStats is a snapshot of the Go runtime, for spotting memory and goroutine leaks
+type RuntimeStats struct {
+	Goroutines   int    `json:"goroutines"`
+	HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+	HeapInuse    uint64 `json:"heap_inuse_bytes"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Sys          uint64 `json:"sys_bytes"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"gc_pause_total_ns"`
+}
+
+func getBuildInfo(w http.ResponseWriter, r *http.Request) {
+	info := BuildInfo{GoVersion: runtime.Version(), Settings: map[string]string{}}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Path = bi.Main.Path
+		info.Version = bi.Main.Version
+		// vcs.revision, vcs.time, GOOS, GOARCH...
+		for _, s := range bi.Settings {
+			info.Settings[s.Key] = s.Value
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func getRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RuntimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		PauseTotalNs: m.PauseTotalNs,
+	})
+}
+
+// getGoroutines dumps the stack of every goroutine
+func getGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// NewRouter serves the pprof and runtime endpoints. They expose stacks and command
+// line arguments, so the server is opt-in and meant to be bound to localhost or a
+// private network.
+func NewRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/debug/buildinfo", getBuildInfo)
+	r.Get("/debug/runtime", getRuntimeStats)
+	r.Get("/debug/goroutines", getGoroutines)
+	r.HandleFunc("/debug/pprof/", pprof.Index)
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// heap, allocs, goroutine, block, mutex and threadcreate
+	r.HandleFunc("/debug/pprof/{profile}", pprof.Index)
+	return r
+}
@@ -0,0 +1,62 @@
+package display
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type DisplayController struct {
+	service *DisplayService
+}
+
+func NewDisplayController(service *DisplayService) *DisplayController {
+	return &DisplayController{service: service}
+}
+
+func (c *DisplayController) getRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := c.service.GetRules(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get display rules: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func (c *DisplayController) putRules(w http.ResponseWriter, r *http.Request) {
+	var rules Rules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, "invalid display rules: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rules.Validate(); err != nil {
+		http.Error(w, "invalid display rules: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveRules(r.Context(), &rules); err != nil {
+		http.Error(w, fmt.Sprintf("failed to save display rules: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func (c *DisplayController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/display-rules", Summary: "Rules assigning display categories to spans", Response: Rules{}},
+		{Method: http.MethodPut, Path: "/v1/display-rules", Summary: "Save the display rules", Request: Rules{}, Response: Rules{}},
+	}
+}
+
+func (c *DisplayController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/display-rules", c.getRules)
+	r.Put("/v1/display-rules", c.putRules)
+}
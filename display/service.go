@@ -0,0 +1,130 @@
+package display
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"nabatshy/db"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// rulesSetting is the settings key the rules are stored under, as one ordered list
+const rulesSetting = "display_rules"
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Condition matches spans with an attribute, span attributes win over resource
+// attributes of the same key. An empty Value matches any value.
+type Condition struct {
+	Attribute string `json:"attribute"`
+	Value     string `json:"value,omitempty"`
+}
+
+// Rule assigns a display category to spans matching all of its conditions
+type Rule struct {
+	Name       string      `json:"name"`
+	Conditions []Condition `json:"conditions"`
+	Category   string      `json:"category"`
+	// Color is an optional #rrggbb hint, clients pick their own color per category otherwise
+	Color string `json:"color,omitempty"`
+}
+
+// Rules are evaluated in order, the first matching rule wins
+type Rules struct {
+	Rules     []Rule    `json:"rules"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// DefaultRules are used until an admin saves rules, they follow the OpenTelemetry
+// semantic conventions
+var DefaultRules = []Rule{
+	{Name: "database", Conditions: []Condition{{Attribute: "db.system"}}, Category: "database"},
+	{Name: "messaging", Conditions: []Condition{{Attribute: "messaging.system"}}, Category: "messaging"},
+	{Name: "rpc", Conditions: []Condition{{Attribute: "rpc.system"}}, Category: "rpc"},
+	{Name: "http", Conditions: []Condition{{Attribute: "http.request.method"}}, Category: "http"},
+	{Name: "http (legacy)", Conditions: []Condition{{Attribute: "http.method"}}, Category: "http"},
+}
+
+type DisplayService struct {
+	Ch *clickhouse.Conn
+}
+
+// Validate checks the rules
+func (r *Rules) Validate() error {
+	for i, rule := range r.Rules {
+		if rule.Category == "" {
+			return fmt.Errorf("rule %d: category is required", i)
+		}
+		if len(rule.Conditions) == 0 {
+			return fmt.Errorf("rule %d: at least one condition is required", i)
+		}
+		for _, c := range rule.Conditions {
+			if c.Attribute == "" {
+				return fmt.Errorf("rule %d: condition attribute is required", i)
+			}
+		}
+		if rule.Color != "" && !colorPattern.MatchString(rule.Color) {
+			return fmt.Errorf("rule %d: color must be #rrggbb", i)
+		}
+	}
+	return nil
+}
+
+// GetRules returns the saved rules, or DefaultRules when none were saved
+func (s *DisplayService) GetRules(ctx context.Context) (Rules, error) {
+	value, found, err := db.GetSetting(ctx, *s.Ch, rulesSetting)
+	if err != nil {
+		return Rules{}, err
+	}
+	if !found {
+		return Rules{Rules: DefaultRules}, nil
+	}
+	var rules Rules
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return Rules{}, fmt.Errorf("failed to decode display rules: %w", err)
+	}
+	return rules, nil
+}
+
+// SaveRules replaces all rules
+func (s *DisplayService) SaveRules(ctx context.Context, rules *Rules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	if rules.Rules == nil {
+		rules.Rules = []Rule{}
+	}
+	rules.UpdatedAt = time.Now().UTC()
+	value, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	return db.SetSetting(ctx, *s.Ch, rulesSetting, string(value))
+}
+
+// Categorize returns the first rule matching a span's attributes
+func (r Rules) Categorize(spanAttrs, resourceAttrs map[string]string) (Rule, bool) {
+	for _, rule := range r.Rules {
+		if rule.matches(spanAttrs, resourceAttrs) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (r Rule) matches(spanAttrs, resourceAttrs map[string]string) bool {
+	for _, c := range r.Conditions {
+		value, ok := spanAttrs[c.Attribute]
+		if !ok {
+			value, ok = resourceAttrs[c.Attribute]
+		}
+		if !ok || (c.Value != "" && value != c.Value) {
+			return false
+		}
+	}
+	return true
+}
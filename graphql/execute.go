@@ -0,0 +1,771 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Request is a query with its variables, as sent in the body of a POST
+type Request struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables,omitempty"`
+	OperationName string         `json:"operationName,omitempty"`
+}
+
+// Response is the result of a request, Data is nil when the request isn't valid
+type Response struct {
+	Data   *OrderedMap `json:"data,omitempty"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+// Error is an error of a request, Path is the response keys and list indexes of the
+// field whose resolver failed
+type Error struct {
+	Message   string     `json:"message"`
+	Locations []Location `json:"locations,omitempty"`
+	Path      []any      `json:"path,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// OrderedMap is a JSON object keeping the order of its keys, the order of the
+// fields of the query
+type OrderedMap struct {
+	keys   []string
+	values map[string]any
+}
+
+func newOrderedMap(size int) *OrderedMap {
+	return &OrderedMap{keys: make([]string, 0, size), values: make(map[string]any, size)}
+}
+
+func (m *OrderedMap) set(key string, value any) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// Get returns the value of a key
+func (m *OrderedMap) Get(key string) any {
+	return m.values[key]
+}
+
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Execute runs the query of a request. A request that doesn't parse or isn't valid
+// against the schema returns errors only, errors of resolvers are returned with the
+// data, the failed fields being null.
+func (s *Schema) Execute(ctx context.Context, req Request) *Response {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return errorResponse(err)
+	}
+	op, err := selectOperation(doc, req.OperationName)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if op.kind != "query" {
+		return errorResponse(&Error{Message: fmt.Sprintf("%ss aren't supported, only queries", op.kind), Locations: []Location{op.loc}})
+	}
+	v := &validator{schema: s, doc: doc, op: op}
+	if errs := v.validate(); len(errs) > 0 {
+		return &Response{Errors: errs}
+	}
+	vars, err := coerceVariables(s, op, req.Variables)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	e := &executor{ctx: ctx, schema: s, doc: doc, vars: vars}
+	data, _ := e.selectionSet(s.Query, []*field{{selection: op.selection}}, nil, nil)
+	return &Response{Data: data, Errors: e.errors}
+}
+
+func errorResponse(err error) *Response {
+	var gqlErr *Error
+	if !errors.As(err, &gqlErr) {
+		gqlErr = &Error{Message: err.Error()}
+	}
+	return &Response{Errors: []*Error{gqlErr}}
+}
+
+func selectOperation(doc *document, name string) (*operation, error) {
+	if name == "" {
+		if len(doc.operations) != 1 {
+			return nil, &Error{Message: "the query has several operations, operationName must name the one to run"}
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, &Error{Message: fmt.Sprintf("the query has no operation named %q", name)}
+}
+
+// validator checks a query against the schema before it runs
+type validator struct {
+	schema *Schema
+	doc    *document
+	op     *operation
+	errs   []*Error
+	// spreading are the fragments being validated, to detect cycles
+	spreading map[string]bool
+}
+
+func (v *validator) errorf(loc Location, format string, args ...any) {
+	v.errs = append(v.errs, &Error{Message: fmt.Sprintf(format, args...), Locations: []Location{loc}})
+}
+
+func (v *validator) validate() []*Error {
+	v.spreading = make(map[string]bool)
+	defined := make(map[string]bool)
+	for _, vd := range v.op.variables {
+		if defined[vd.name] {
+			v.errorf(vd.loc, "there can be only one variable named $%s", vd.name)
+		}
+		defined[vd.name] = true
+		if t := v.schema.inputType(vd.typ); t == nil {
+			v.errorf(vd.loc, "variable $%s has type %s, which isn't a scalar or an enum of the schema", vd.name, vd.typ)
+		}
+	}
+	v.selectionSet(v.schema.Query, v.op.selection, 1)
+	for _, name := range undefinedVariables(v.op, v.doc, defined) {
+		v.errorf(v.op.loc, "variable $%s isn't defined by the operation", name)
+	}
+	return v.errs
+}
+
+func (v *validator) selectionSet(obj *Object, sel []selection, depth int) {
+	if depth > v.schema.MaxDepth {
+		v.errorf(sel[0].(locatable).location(), "the query is nested deeper than %d fields", v.schema.MaxDepth)
+		return
+	}
+	for _, s := range sel {
+		switch s := s.(type) {
+		case *field:
+			v.field(obj, s, depth)
+		case *inlineFragment:
+			v.directives(s.directives)
+			if s.on != "" && !v.typeCondition(obj, s.on, s.loc) {
+				continue
+			}
+			v.selectionSet(obj, s.selection, depth)
+		case *fragmentSpread:
+			v.directives(s.directives)
+			f, ok := v.doc.fragments[s.name]
+			if !ok {
+				v.errorf(s.loc, "fragment %s isn't defined", s.name)
+				continue
+			}
+			if v.spreading[s.name] {
+				v.errorf(s.loc, "fragment %s spreads itself", s.name)
+				continue
+			}
+			if !v.typeCondition(obj, f.on, f.loc) {
+				continue
+			}
+			v.spreading[s.name] = true
+			v.selectionSet(obj, f.selection, depth)
+			delete(v.spreading, s.name)
+		}
+	}
+}
+
+// typeCondition reports whether a fragment on the type applies to obj, without
+// interfaces or unions it's only the case for obj itself
+func (v *validator) typeCondition(obj *Object, on string, loc Location) bool {
+	t, ok := v.schema.types[on]
+	if !ok {
+		v.errorf(loc, "unknown type %s", on)
+		return false
+	}
+	if _, isObject := t.(*Object); !isObject {
+		v.errorf(loc, "a fragment can't be on %s, it isn't an object type", on)
+		return false
+	}
+	if t != obj {
+		v.errorf(loc, "a fragment on %s can't be spread in %s", on, obj.Name)
+		return false
+	}
+	return true
+}
+
+func (v *validator) field(obj *Object, f *field, depth int) {
+	v.directives(f.directives)
+	if f.name == "__typename" {
+		if f.args != nil || f.selection != nil {
+			v.errorf(f.loc, "field __typename has no arguments or subfields")
+		}
+		return
+	}
+	def := v.schema.fieldOf(obj, f.name)
+	if def == nil {
+		v.errorf(f.loc, "type %s has no field %s", obj.Name, f.name)
+		return
+	}
+	for _, a := range f.args {
+		argDef := def.arg(a.name)
+		if argDef == nil {
+			v.errorf(a.loc, "field %s.%s has no argument %s", obj.Name, f.name, a.name)
+			continue
+		}
+		v.literal(argDef.Type, a.value, a.loc, fmt.Sprintf("argument %s of %s.%s", a.name, obj.Name, f.name))
+	}
+	for _, argDef := range def.Args {
+		if isNonNull(argDef.Type) && argDef.Default == nil && argumentOf(f.args, argDef.Name) == nil {
+			v.errorf(f.loc, "field %s.%s requires argument %s", obj.Name, f.name, argDef.Name)
+		}
+	}
+
+	child, isObject := namedType(def.Type).(*Object)
+	switch {
+	case isObject && f.selection == nil:
+		v.errorf(f.loc, "field %s.%s of type %s must have a selection of subfields", obj.Name, f.name, def.Type)
+	case !isObject && f.selection != nil:
+		v.errorf(f.loc, "field %s.%s of type %s can't have a selection of subfields", obj.Name, f.name, def.Type)
+	case isObject:
+		v.selectionSet(child, f.selection, depth+1)
+	}
+}
+
+func (v *validator) directives(dirs []*directive) {
+	for _, d := range dirs {
+		if d.name != "skip" && d.name != "include" {
+			v.errorf(d.loc, "unknown directive @%s", d.name)
+			continue
+		}
+		if len(d.args) != 1 || d.args[0].name != "if" {
+			v.errorf(d.loc, "directive @%s takes one argument, if", d.name)
+			continue
+		}
+		v.literal(NonNullOf(Boolean), d.args[0].value, d.args[0].loc, "argument if of @"+d.name)
+	}
+}
+
+// literal checks a value of the query against its type, variables are checked when
+// they're coerced
+func (v *validator) literal(t Type, value any, loc Location, what string) {
+	if _, ok := value.(variable); ok {
+		return
+	}
+	if _, err := coerceLiteral(t, value, nil); err != nil {
+		v.errorf(loc, "%s: %v", what, err)
+	}
+}
+
+func argumentOf(args []*argument, name string) *argument {
+	for _, a := range args {
+		if a.name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// undefinedVariables lists the variables used by the operation, in its selections or
+// in the fragments it spreads, that it doesn't define
+func undefinedVariables(op *operation, doc *document, defined map[string]bool) []string {
+	var undefined []string
+	seen := make(map[string]bool)
+	var walkValue func(value any)
+	walkValue = func(value any) {
+		switch value := value.(type) {
+		case variable:
+			if !defined[string(value)] && !seen[string(value)] {
+				undefined = append(undefined, string(value))
+			}
+			seen[string(value)] = true
+		case []any:
+			for _, item := range value {
+				walkValue(item)
+			}
+		case map[string]any:
+			for _, item := range value {
+				walkValue(item)
+			}
+		}
+	}
+	walkArgs := func(args []*argument, dirs []*directive) {
+		for _, a := range args {
+			walkValue(a.value)
+		}
+		for _, d := range dirs {
+			for _, a := range d.args {
+				walkValue(a.value)
+			}
+		}
+	}
+	spread := make(map[string]bool)
+	var walk func(sel []selection)
+	walk = func(sel []selection) {
+		for _, s := range sel {
+			switch s := s.(type) {
+			case *field:
+				walkArgs(s.args, s.directives)
+				walk(s.selection)
+			case *inlineFragment:
+				walkArgs(nil, s.directives)
+				walk(s.selection)
+			case *fragmentSpread:
+				walkArgs(nil, s.directives)
+				if f, ok := doc.fragments[s.name]; ok && !spread[s.name] {
+					spread[s.name] = true
+					walk(f.selection)
+				}
+			}
+		}
+	}
+	walk(op.selection)
+	return undefined
+}
+
+// inputType returns the type of a variable, nil when it isn't a scalar, an enum or
+// a list of them
+func (s *Schema) inputType(ref *typeRef) Type {
+	var t Type
+	if ref.list != nil {
+		of := s.inputType(ref.list)
+		if of == nil {
+			return nil
+		}
+		t = ListOf(of)
+	} else {
+		t = s.types[ref.name]
+		if _, isObject := t.(*Object); t == nil || isObject {
+			return nil
+		}
+	}
+	if ref.nonNull {
+		t = NonNullOf(t)
+	}
+	return t
+}
+
+// fieldOf returns a field of obj, the introspection fields included on the query
+func (s *Schema) fieldOf(obj *Object, name string) *Field {
+	if obj == s.Query {
+		switch name {
+		case "__schema":
+			return schemaField
+		case "__type":
+			return typeField
+		}
+	}
+	return obj.field(name)
+}
+
+// coerceVariables parses the JSON values of the variables by their types
+func coerceVariables(s *Schema, op *operation, values map[string]any) (map[string]any, error) {
+	vars := make(map[string]any, len(op.variables))
+	for _, vd := range op.variables {
+		t := s.inputType(vd.typ)
+		value, given := values[vd.name]
+		if !given {
+			if vd.def != nil {
+				def, err := coerceLiteral(t, vd.def, nil)
+				if err != nil {
+					return nil, &Error{Message: fmt.Sprintf("default value of variable $%s: %v", vd.name, err), Locations: []Location{vd.loc}}
+				}
+				vars[vd.name] = def
+			} else if isNonNull(t) {
+				return nil, &Error{Message: fmt.Sprintf("variable $%s of type %s is required", vd.name, vd.typ), Locations: []Location{vd.loc}}
+			}
+			continue
+		}
+		// the values of variables are JSON, where enum values are strings
+		coerced, err := coerceLiteral(t, fromJSON(value), map[string]any{})
+		if err != nil {
+			return nil, &Error{Message: fmt.Sprintf("variable $%s: %v", vd.name, err), Locations: []Location{vd.loc}}
+		}
+		vars[vd.name] = coerced
+	}
+	return vars, nil
+}
+
+// fromJSON turns a decoded JSON value into a value of a query, integral numbers
+// becoming int64 and strings being valid enum values too
+func fromJSON(value any) any {
+	switch value := value.(type) {
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+			return int64(value)
+		}
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n
+		}
+		f, _ := value.Float64()
+		return f
+	case []any:
+		list := make([]any, len(value))
+		for i, item := range value {
+			list[i] = fromJSON(item)
+		}
+		return list
+	}
+	return value
+}
+
+// coerceLiteral parses a value of the query by its type, substituting the variables.
+// vars is nil for the constant values of the query, where strings aren't enum values.
+func coerceLiteral(t Type, value any, vars map[string]any) (any, error) {
+	if name, ok := value.(variable); ok {
+		v, given := vars[string(name)]
+		if !given || v == nil {
+			if isNonNull(t) && vars != nil {
+				return nil, fmt.Errorf("variable $%s is null but %s can't be", name, t)
+			}
+			return nil, nil
+		}
+		return v, nil
+	}
+	if nn, ok := t.(*NonNull); ok {
+		if value == nil {
+			return nil, fmt.Errorf("expected a value of type %s, got null", t)
+		}
+		return coerceLiteral(nn.Of, value, vars)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	switch t := t.(type) {
+	case *List:
+		items, ok := value.([]any)
+		if !ok {
+			// a single value is a list of one value
+			items = []any{value}
+		}
+		list := make([]any, len(items))
+		for i, item := range items {
+			coerced, err := coerceLiteral(t.Of, item, vars)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = coerced
+		}
+		return list, nil
+	case *Enum:
+		var name string
+		switch v := value.(type) {
+		case enumValue:
+			name = string(v)
+		case string:
+			if vars == nil {
+				return nil, fmt.Errorf("expected a value of %s, got %s", t.Name, describe(value))
+			}
+			name = v
+		}
+		if !t.has(name) {
+			return nil, fmt.Errorf("expected a value of %s, got %s", t.Name, describe(value))
+		}
+		return name, nil
+	case *Scalar:
+		if _, ok := value.(enumValue); ok {
+			return nil, fmt.Errorf("expected a %s, got %s", t.Name, describe(value))
+		}
+		return t.Parse(value)
+	}
+	return nil, fmt.Errorf("%s isn't an input type", t)
+}
+
+// errNull is returned by the completion of a non-null field that resolved to null,
+// the null propagates to the closest nullable field
+var errNull = errors.New("null")
+
+// executor runs the selections of a valid query
+type executor struct {
+	ctx    context.Context
+	schema *Schema
+	doc    *document
+	vars   map[string]any
+	errors []*Error
+}
+
+func (e *executor) fail(f *field, path []any, err error) {
+	if errors.Is(err, errNull) {
+		return
+	}
+	e.errors = append(e.errors, &Error{Message: err.Error(), Locations: []Location{f.loc}, Path: append([]any(nil), path...)})
+}
+
+// selectionSet resolves the subfields of the fields of obj, fields merged under one
+// response key have their selections merged
+func (e *executor) selectionSet(obj *Object, fields []*field, source any, path []any) (*OrderedMap, error) {
+	var sel []selection
+	for _, f := range fields {
+		sel = append(sel, f.selection...)
+	}
+	grouped := newOrderedMap(len(sel))
+	e.collectFields(sel, grouped, make(map[string]bool))
+
+	result := newOrderedMap(len(grouped.keys))
+	for _, key := range grouped.keys {
+		same := grouped.values[key].([]*field)
+		value, err := e.field(obj, same, source, append(path, key))
+		if err != nil {
+			return nil, errNull
+		}
+		result.set(key, value)
+	}
+	return result, nil
+}
+
+// collectFields groups the fields of a selection by their response key, the
+// fragments of a valid query always apply so they're flattened
+func (e *executor) collectFields(sel []selection, grouped *OrderedMap, spread map[string]bool) {
+	for _, s := range sel {
+		switch s := s.(type) {
+		case *field:
+			if !e.included(s.directives) {
+				continue
+			}
+			fields, _ := grouped.values[s.key()].([]*field)
+			grouped.set(s.key(), append(fields, s))
+		case *inlineFragment:
+			if e.included(s.directives) {
+				e.collectFields(s.selection, grouped, spread)
+			}
+		case *fragmentSpread:
+			if !e.included(s.directives) || spread[s.name] {
+				continue
+			}
+			spread[s.name] = true
+			e.collectFields(e.doc.fragments[s.name].selection, grouped, spread)
+		}
+	}
+}
+
+// included applies @skip and @include
+func (e *executor) included(dirs []*directive) bool {
+	for _, d := range dirs {
+		value, _ := coerceLiteral(Boolean, d.args[0].value, e.vars)
+		b, _ := value.(bool)
+		if d.name == "skip" && b || d.name == "include" && !b {
+			return false
+		}
+	}
+	return true
+}
+
+// field resolves the fields under a response key, an error means the field was
+// null though it's non-null
+func (e *executor) field(obj *Object, fields []*field, source any, path []any) (any, error) {
+	f := fields[0]
+	if f.name == "__typename" {
+		return obj.Name, nil
+	}
+	def := e.schema.fieldOf(obj, f.name)
+	args, err := e.arguments(def, f.args)
+	if err != nil {
+		e.fail(f, path, err)
+		return e.null(def.Type)
+	}
+
+	resolve := def.Resolve
+	if resolve == nil {
+		resolve = defaultResolver(def.Name)
+	}
+	value, err := resolve(ResolveParams{Context: e.ctx, Source: source, Args: args, schema: e.schema})
+	if err != nil {
+		e.fail(f, path, err)
+		return e.null(def.Type)
+	}
+	completed, err := e.complete(def.Type, fields, value, path)
+	if err != nil {
+		e.fail(f, path, err)
+		return e.null(def.Type)
+	}
+	return completed, nil
+}
+
+// null is the value of a failed field, an error propagates it when it can't be null
+func (e *executor) null(t Type) (any, error) {
+	if isNonNull(t) {
+		return nil, errNull
+	}
+	return nil, nil
+}
+
+func (e *executor) arguments(def *Field, args []*argument) (map[string]any, error) {
+	values := make(map[string]any, len(def.Args))
+	for _, argDef := range def.Args {
+		a := argumentOf(args, argDef.Name)
+		if a == nil {
+			if argDef.Default != nil {
+				values[argDef.Name] = argDef.Default
+			}
+			continue
+		}
+		if name, ok := a.value.(variable); ok {
+			if _, given := e.vars[string(name)]; !given {
+				if argDef.Default != nil {
+					values[argDef.Name] = argDef.Default
+				} else if isNonNull(argDef.Type) {
+					return nil, fmt.Errorf("argument %s is required but variable $%s isn't set", argDef.Name, name)
+				}
+				continue
+			}
+		}
+		value, err := coerceLiteral(argDef.Type, a.value, e.vars)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %v", argDef.Name, err)
+		}
+		// an argument set to null has its default, so the resolvers only check
+		// the arguments without one
+		if value == nil {
+			value = argDef.Default
+		}
+		if value != nil {
+			values[argDef.Name] = value
+		}
+	}
+	return values, nil
+}
+
+// complete turns a resolved value into its JSON value by its type
+func (e *executor) complete(t Type, fields []*field, value any, path []any) (any, error) {
+	if nn, ok := t.(*NonNull); ok {
+		completed, err := e.complete(nn.Of, fields, value, path)
+		if err != nil {
+			return nil, err
+		}
+		if completed == nil {
+			return nil, fmt.Errorf("%s can't be null", nn)
+		}
+		return completed, nil
+	}
+	if isNil(value) {
+		return nil, nil
+	}
+
+	switch t := t.(type) {
+	case *Scalar:
+		return t.Serialize(value)
+	case *Enum:
+		name := fmt.Sprint(value)
+		if !t.has(name) {
+			return nil, fmt.Errorf("%q isn't a value of %s", name, t.Name)
+		}
+		return name, nil
+	case *Object:
+		result, err := e.selectionSet(t, fields, value, path)
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	case *List:
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, fmt.Errorf("%T isn't a list", value)
+		}
+		list := make([]any, rv.Len())
+		for i := range list {
+			itemPath := append(path, i)
+			item, err := e.complete(t.Of, fields, rv.Index(i).Interface(), itemPath)
+			if err != nil {
+				if !errors.Is(err, errNull) {
+					e.fail(fields[0], itemPath, err)
+				}
+				if isNonNull(t.Of) {
+					return nil, errNull
+				}
+				continue
+			}
+			list[i] = item
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unknown type %s", t)
+}
+
+func isNil(value any) bool {
+	if value == nil {
+		return true
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// defaultResolver reads the field from a map or from the struct field with the
+// name as its json tag, in the struct or its embedded structs
+func defaultResolver(name string) func(p ResolveParams) (any, error) {
+	return func(p ResolveParams) (any, error) {
+		if m, ok := p.Source.(map[string]any); ok {
+			return m[name], nil
+		}
+		rv := reflect.ValueOf(p.Source)
+		for rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				return nil, nil
+			}
+			rv = rv.Elem()
+		}
+		if rv.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("can't read field %s of %T", name, p.Source)
+		}
+		if v, ok := structField(rv, name); ok {
+			return v.Interface(), nil
+		}
+		return nil, fmt.Errorf("%T has no field %s", p.Source, name)
+	}
+}
+
+func structField(rv reflect.Value, name string) (reflect.Value, bool) {
+	t := rv.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && tag == "" {
+			embedded := rv.Field(i)
+			if embedded.Kind() == reflect.Pointer {
+				if embedded.IsNil() {
+					continue
+				}
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if v, ok := structField(embedded, name); ok {
+					return v, true
+				}
+			}
+			continue
+		}
+		if f.IsExported() && tag == name {
+			return rv.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,213 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testSpan struct {
+	Name       string  `json:"name"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+type testTrace struct {
+	ID    string     `json:"id"`
+	Spans []testSpan `json:"spans"`
+}
+
+var testTraces = []testTrace{
+	{ID: "t1", Spans: []testSpan{{"GET /", 12.5}, {"SELECT", 3}}},
+	{ID: "t2", Spans: []testSpan{{"POST /cart", 7}}},
+}
+
+func testSchema(t *testing.T) *Schema {
+	t.Helper()
+	kind := &Enum{Name: "Kind", Values: []EnumValue{{Name: "SERVER"}, {Name: "CLIENT"}}}
+	span := &Object{Name: "Span", Fields: []*Field{
+		{Name: "name", Type: NonNullOf(String)},
+		{Name: "durationMs", Type: Float},
+	}}
+	trace := &Object{Name: "Trace", Description: "A trace", Fields: []*Field{
+		{Name: "id", Type: NonNullOf(ID)},
+		{Name: "spans", Type: NonNullOf(ListOf(NonNullOf(span)))},
+	}}
+	query := &Object{Name: "Query", Fields: []*Field{
+		{Name: "hello", Type: String,
+			Args: []*Arg{{Name: "name", Type: String, Default: "world"}},
+			Resolve: func(p ResolveParams) (any, error) {
+				return "hello " + p.Args["name"].(string), nil
+			}},
+		{Name: "trace", Type: trace,
+			Args: []*Arg{{Name: "id", Type: NonNullOf(ID)}},
+			Resolve: func(p ResolveParams) (any, error) {
+				for _, tr := range testTraces {
+					if tr.ID == p.Args["id"] {
+						return tr, nil
+					}
+				}
+				return nil, nil
+			}},
+		{Name: "traces", Type: NonNullOf(ListOf(NonNullOf(trace))),
+			Args: []*Arg{{Name: "limit", Type: Int, Default: 10}, {Name: "kinds", Type: ListOf(kind)}},
+			Resolve: func(p ResolveParams) (any, error) {
+				return testTraces[:min(p.Args["limit"].(int), len(testTraces))], nil
+			}},
+		{Name: "fail", Type: String, Resolve: func(p ResolveParams) (any, error) {
+			return nil, errors.New("boom")
+		}},
+		{Name: "failRequired", Type: NonNullOf(String), Resolve: func(p ResolveParams) (any, error) {
+			return nil, errors.New("boom")
+		}},
+	}}
+	s, err := NewSchema(query, "test schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func execute(t *testing.T, s *Schema, req Request) string {
+	t.Helper()
+	out, err := json.Marshal(s.Execute(context.Background(), req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestExecute(t *testing.T) {
+	s := testSchema(t)
+	tests := []struct {
+		name string
+		req  Request
+		want string
+	}{
+		{"default argument", Request{Query: `{ hello }`},
+			`{"data":{"hello":"hello world"}}`},
+		{"aliases", Request{Query: `{ a: hello(name: "a") b: hello(name: "b") }`},
+			`{"data":{"a":"hello a","b":"hello b"}}`},
+		{"nested lists", Request{Query: `{ traces { id spans { name durationMs } } }`},
+			`{"data":{"traces":[{"id":"t1","spans":[{"name":"GET /","durationMs":12.5},{"name":"SELECT","durationMs":3}]},{"id":"t2","spans":[{"name":"POST /cart","durationMs":7}]}]}}`},
+		{"variables", Request{
+			Query:     `query Q($id: ID!, $limit: Int = 1) { trace(id: $id) { id } traces(limit: $limit) { id } }`,
+			Variables: map[string]any{"id": "t2"}},
+			`{"data":{"trace":{"id":"t2"},"traces":[{"id":"t1"}]}}`},
+		{"enum list variable", Request{
+			Query:     `query Q($kinds: [Kind]) { traces(limit: 1, kinds: $kinds) { id } }`,
+			Variables: map[string]any{"kinds": []any{"SERVER"}}},
+			`{"data":{"traces":[{"id":"t1"}]}}`},
+		{"null object", Request{Query: `{ trace(id: "nope") { id } }`},
+			`{"data":{"trace":null}}`},
+		{"fragments", Request{Query: `
+			{ trace(id: "t1") { ...Ids ... on Trace { spans { ...Names } } } }
+			fragment Ids on Trace { id }
+			fragment Names on Span { name }`},
+			`{"data":{"trace":{"id":"t1","spans":[{"name":"GET /"},{"name":"SELECT"}]}}}`},
+		{"merged fields", Request{Query: `{ trace(id: "t1") { id spans { name } ... on Trace { spans { durationMs } } } }`},
+			`{"data":{"trace":{"id":"t1","spans":[{"name":"GET /","durationMs":12.5},{"name":"SELECT","durationMs":3}]}}}`},
+		{"skip and include", Request{
+			Query:     `query Q($yes: Boolean!) { a: hello @skip(if: $yes) b: hello @include(if: $yes) c: hello @include(if: false) }`,
+			Variables: map[string]any{"yes": true}},
+			`{"data":{"b":"hello world"}}`},
+		{"operation name", Request{Query: `query A { a: hello } query B { b: hello }`, OperationName: "B"},
+			`{"data":{"b":"hello world"}}`},
+		{"typename", Request{Query: `{ __typename trace(id: "t1") { __typename } }`},
+			`{"data":{"__typename":"Query","trace":{"__typename":"Trace"}}}`},
+		{"resolver error", Request{Query: `{ hello fail }`},
+			`{"data":{"hello":"hello world","fail":null},"errors":[{"message":"boom","locations":[{"line":1,"column":9}],"path":["fail"]}]}`},
+		{"non-null resolver error", Request{Query: `{ hello failRequired }`},
+			`{"errors":[{"message":"boom","locations":[{"line":1,"column":9}],"path":["failRequired"]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := execute(t, s, tt.req); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	s := testSchema(t)
+	tests := []struct {
+		name string
+		req  Request
+		want string
+	}{
+		{"unknown field", Request{Query: `{ nope }`}, "type Query has no field nope"},
+		{"missing argument", Request{Query: `{ trace { id } }`}, "requires argument id"},
+		{"wrong argument type", Request{Query: `{ traces(limit: "x") { id } }`}, "argument limit of Query.traces"},
+		{"unknown enum value", Request{Query: `{ traces(kinds: [NOPE]) { id } }`}, "argument kinds of Query.traces"},
+		{"missing subfields", Request{Query: `{ trace(id: "t1") }`}, "must have a selection of subfields"},
+		{"subfields of a leaf", Request{Query: `{ hello { x } }`}, "can't have a selection of subfields"},
+		{"undefined variable", Request{Query: `{ trace(id: $id) { id } }`}, "variable $id isn't defined"},
+		{"missing variable", Request{Query: `query Q($id: ID!) { trace(id: $id) { id } }`}, "$id"},
+		{"wrong variable type", Request{Query: `query Q($n: Int) { traces(limit: $n) { id } }`, Variables: map[string]any{"n": "x"}}, "$n"},
+		{"undefined fragment", Request{Query: `{ trace(id: "t1") { ...F } }`}, "fragment F isn't defined"},
+		{"fragment cycle", Request{Query: `{ trace(id: "t1") { ...A } } fragment A on Trace { ...B } fragment B on Trace { ...A }`}, "spreads itself"},
+		{"fragment on another type", Request{Query: `{ trace(id: "t1") { ...F } } fragment F on Span { name }`}, "can't be spread in Trace"},
+		{"mutation", Request{Query: `mutation { hello }`}, "mutations aren't supported"},
+		{"several operations", Request{Query: `query A { hello } query B { hello }`}, "operationName"},
+		{"unknown directive", Request{Query: `{ hello @nope }`}, "unknown directive @nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := s.Execute(context.Background(), tt.req)
+			if resp.Data != nil {
+				t.Errorf("got data %v, want none", resp.Data)
+			}
+			if len(resp.Errors) == 0 || !strings.Contains(resp.Errors[0].Message, tt.want) {
+				t.Errorf("got errors %v, want one containing %q", resp.Errors, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteMaxDepth(t *testing.T) {
+	s := testSchema(t)
+	s.MaxDepth = 2
+	resp := s.Execute(context.Background(), Request{Query: `{ trace(id: "t1") { spans { name } } }`})
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "nested deeper than 2") {
+		t.Errorf("got errors %v, want the query nested too deep", resp.Errors)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	s := testSchema(t)
+	got := execute(t, s, Request{Query: `{
+		__schema { description queryType { name } mutationType { name } }
+		__type(name: "Trace") {
+			kind name description
+			fields { name args { name } type { kind name ofType { kind name ofType { kind name ofType { kind name } } } } }
+		}
+		kind: __type(name: "Kind") { kind enumValues { name } }
+		hello: __type(name: "Query") { fields { name args { name defaultValue type { name } } } }
+	}`})
+	want := `{"data":{` +
+		`"__schema":{"description":"test schema","queryType":{"name":"Query"},"mutationType":null},` +
+		`"__type":{"kind":"OBJECT","name":"Trace","description":"A trace","fields":[` +
+		`{"name":"id","args":[],"type":{"kind":"NON_NULL","name":null,"ofType":{"kind":"SCALAR","name":"ID","ofType":null}}},` +
+		`{"name":"spans","args":[],"type":{"kind":"NON_NULL","name":null,"ofType":{"kind":"LIST","name":null,"ofType":{"kind":"NON_NULL","name":null,"ofType":{"kind":"OBJECT","name":"Span"}}}}}]},` +
+		`"kind":{"kind":"ENUM","enumValues":[{"name":"SERVER"},{"name":"CLIENT"}]},` +
+		`"hello":{"fields":[` +
+		`{"name":"hello","args":[{"name":"name","defaultValue":"\"world\"","type":{"name":"String"}}]},` +
+		`{"name":"trace","args":[{"name":"id","defaultValue":null,"type":{"name":null}}]},` +
+		`{"name":"traces","args":[{"name":"limit","defaultValue":"10","type":{"name":"Int"}},{"name":"kinds","defaultValue":null,"type":{"name":null}}]},` +
+		`{"name":"fail","args":[]},` +
+		`{"name":"failRequired","args":[]}]}}}`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	// the types of the introspection schema itself are introspectable, as GraphiQL
+	// needs them
+	got = execute(t, s, Request{Query: `{ __schema { types { name } } }`})
+	for _, name := range []string{"Query", "Trace", "Span", "Kind", "String", "__Schema", "__Type", "__Field"} {
+		if !strings.Contains(got, `"name":"`+name+`"`) {
+			t.Errorf("types %s don't include %s", got, name)
+		}
+	}
+}
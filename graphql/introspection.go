@@ -0,0 +1,290 @@
+package graphql
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The introspection types describe the schema with the engine itself, the resolvers
+// get the Types, Fields and Args of the schema as their sources
+
+type directiveDef struct {
+	Name        string
+	Description string
+	Locations   []string
+	Args        []*Arg
+}
+
+var directives = []*directiveDef{
+	{
+		Name:        "include",
+		Description: "Includes this field or fragment only when the if argument is true",
+		Locations:   []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		Args:        []*Arg{{Name: "if", Description: "Included when true", Type: NonNullOf(Boolean)}},
+	},
+	{
+		Name:        "skip",
+		Description: "Skips this field or fragment when the if argument is true",
+		Locations:   []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		Args:        []*Arg{{Name: "if", Description: "Skipped when true", Type: NonNullOf(Boolean)}},
+	},
+}
+
+var typeKind = &Enum{
+	Name:        "__TypeKind",
+	Description: "The kind of a type",
+	Values: []EnumValue{
+		{Name: "SCALAR"}, {Name: "OBJECT"}, {Name: "INTERFACE"}, {Name: "UNION"},
+		{Name: "ENUM"}, {Name: "INPUT_OBJECT"}, {Name: "LIST"}, {Name: "NON_NULL"},
+	},
+}
+
+var directiveLocation = &Enum{
+	Name:        "__DirectiveLocation",
+	Description: "Where a directive may be used",
+	Values: []EnumValue{
+		{Name: "QUERY"}, {Name: "MUTATION"}, {Name: "SUBSCRIPTION"}, {Name: "FIELD"},
+		{Name: "FRAGMENT_DEFINITION"}, {Name: "FRAGMENT_SPREAD"}, {Name: "INLINE_FRAGMENT"},
+		{Name: "VARIABLE_DEFINITION"},
+	},
+}
+
+var (
+	schemaType     = &Object{Name: "__Schema", Description: "The types and directives of the schema"}
+	typeType       = &Object{Name: "__Type", Description: "A type of the schema, or a list or non-null wrapping one"}
+	fieldType      = &Object{Name: "__Field", Description: "A field of an object type"}
+	inputValueType = &Object{Name: "__InputValue", Description: "An argument of a field or a directive"}
+	enumValueType  = &Object{Name: "__EnumValue", Description: "A value of an enum type"}
+	directiveType  = &Object{Name: "__Directive", Description: "A directive the queries may use"}
+)
+
+// schemaField and typeField are the introspection fields of the query type
+var (
+	schemaField = &Field{
+		Name:        "__schema",
+		Description: "Describes the schema",
+		Type:        NonNullOf(schemaType),
+		Resolve:     func(p ResolveParams) (any, error) { return p.schema, nil },
+	}
+	typeField = &Field{
+		Name:        "__type",
+		Description: "Describes a type of the schema by its name",
+		Type:        typeType,
+		Args:        []*Arg{{Name: "name", Type: NonNullOf(String)}},
+		Resolve: func(p ResolveParams) (any, error) {
+			t, ok := p.schema.types[p.Args["name"].(string)]
+			if !ok {
+				return nil, nil
+			}
+			return t, nil
+		},
+	}
+)
+
+// resolveWith wraps a resolver of the source's type
+func resolveWith[T any](fn func(source T, p ResolveParams) (any, error)) func(p ResolveParams) (any, error) {
+	return func(p ResolveParams) (any, error) {
+		source, ok := p.Source.(T)
+		if !ok {
+			return nil, fmt.Errorf("unexpected source %T", p.Source)
+		}
+		return fn(source, p)
+	}
+}
+
+func constant(value any) func(p ResolveParams) (any, error) {
+	return func(ResolveParams) (any, error) { return value, nil }
+}
+
+var includeDeprecated = []*Arg{{Name: "includeDeprecated", Type: Boolean, Default: false}}
+
+func init() {
+	typeList := NonNullOf(ListOf(NonNullOf(typeType)))
+
+	schemaType.Fields = []*Field{
+		{Name: "description", Type: String, Resolve: resolveWith(func(s *Schema, _ ResolveParams) (any, error) {
+			return optional(s.Description), nil
+		})},
+		{Name: "types", Type: typeList, Resolve: resolveWith(func(s *Schema, _ ResolveParams) (any, error) {
+			names := make([]string, 0, len(s.types))
+			for name := range s.types {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			types := make([]Type, len(names))
+			for i, name := range names {
+				types[i] = s.types[name]
+			}
+			return types, nil
+		})},
+		{Name: "queryType", Type: NonNullOf(typeType), Resolve: resolveWith(func(s *Schema, _ ResolveParams) (any, error) {
+			return s.Query, nil
+		})},
+		{Name: "mutationType", Type: typeType, Resolve: constant(nil)},
+		{Name: "subscriptionType", Type: typeType, Resolve: constant(nil)},
+		{Name: "directives", Type: NonNullOf(ListOf(NonNullOf(directiveType))), Resolve: constant(directives)},
+	}
+
+	typeType.Fields = []*Field{
+		{Name: "kind", Type: NonNullOf(typeKind), Resolve: resolveWith(func(t Type, _ ResolveParams) (any, error) {
+			switch t.(type) {
+			case *Scalar:
+				return "SCALAR", nil
+			case *Enum:
+				return "ENUM", nil
+			case *Object:
+				return "OBJECT", nil
+			case *List:
+				return "LIST", nil
+			}
+			return "NON_NULL", nil
+		})},
+		{Name: "name", Type: String, Resolve: resolveWith(func(t Type, _ ResolveParams) (any, error) {
+			switch t.(type) {
+			case *List, *NonNull:
+				return nil, nil
+			}
+			return t.String(), nil
+		})},
+		{Name: "description", Type: String, Resolve: resolveWith(func(t Type, _ ResolveParams) (any, error) {
+			switch t := t.(type) {
+			case *Scalar:
+				return optional(t.Description), nil
+			case *Enum:
+				return optional(t.Description), nil
+			case *Object:
+				return optional(t.Description), nil
+			}
+			return nil, nil
+		})},
+		{Name: "specifiedByURL", Type: String, Resolve: constant(nil)},
+		{Name: "fields", Type: ListOf(NonNullOf(fieldType)), Args: includeDeprecated, Resolve: resolveWith(func(t Type, _ ResolveParams) (any, error) {
+			if obj, ok := t.(*Object); ok {
+				return obj.Fields, nil
+			}
+			return nil, nil
+		})},
+		{Name: "interfaces", Type: ListOf(NonNullOf(typeType)), Resolve: resolveWith(func(t Type, _ ResolveParams) (any, error) {
+			if _, ok := t.(*Object); ok {
+				return []Type{}, nil
+			}
+			return nil, nil
+		})},
+		{Name: "possibleTypes", Type: ListOf(NonNullOf(typeType)), Resolve: constant(nil)},
+		{Name: "enumValues", Type: ListOf(NonNullOf(enumValueType)), Args: includeDeprecated, Resolve: resolveWith(func(t Type, _ ResolveParams) (any, error) {
+			if e, ok := t.(*Enum); ok {
+				return e.Values, nil
+			}
+			return nil, nil
+		})},
+		{Name: "inputFields", Type: ListOf(NonNullOf(inputValueType)), Resolve: constant(nil)},
+		{Name: "ofType", Type: typeType, Resolve: resolveWith(func(t Type, _ ResolveParams) (any, error) {
+			switch t := t.(type) {
+			case *List:
+				return t.Of, nil
+			case *NonNull:
+				return t.Of, nil
+			}
+			return nil, nil
+		})},
+	}
+
+	fieldType.Fields = []*Field{
+		{Name: "name", Type: NonNullOf(String), Resolve: resolveWith(func(f *Field, _ ResolveParams) (any, error) {
+			return f.Name, nil
+		})},
+		{Name: "description", Type: String, Resolve: resolveWith(func(f *Field, _ ResolveParams) (any, error) {
+			return optional(f.Description), nil
+		})},
+		{Name: "args", Type: NonNullOf(ListOf(NonNullOf(inputValueType))), Args: includeDeprecated, Resolve: resolveWith(func(f *Field, _ ResolveParams) (any, error) {
+			return nonNilArgs(f.Args), nil
+		})},
+		{Name: "type", Type: NonNullOf(typeType), Resolve: resolveWith(func(f *Field, _ ResolveParams) (any, error) {
+			return f.Type, nil
+		})},
+		{Name: "isDeprecated", Type: NonNullOf(Boolean), Resolve: constant(false)},
+		{Name: "deprecationReason", Type: String, Resolve: constant(nil)},
+	}
+
+	inputValueType.Fields = []*Field{
+		{Name: "name", Type: NonNullOf(String), Resolve: resolveWith(func(a *Arg, _ ResolveParams) (any, error) {
+			return a.Name, nil
+		})},
+		{Name: "description", Type: String, Resolve: resolveWith(func(a *Arg, _ ResolveParams) (any, error) {
+			return optional(a.Description), nil
+		})},
+		{Name: "type", Type: NonNullOf(typeType), Resolve: resolveWith(func(a *Arg, _ ResolveParams) (any, error) {
+			return a.Type, nil
+		})},
+		{Name: "defaultValue", Type: String, Resolve: resolveWith(func(a *Arg, _ ResolveParams) (any, error) {
+			if a.Default == nil {
+				return nil, nil
+			}
+			return literal(a.Type, a.Default), nil
+		})},
+		{Name: "isDeprecated", Type: NonNullOf(Boolean), Resolve: constant(false)},
+		{Name: "deprecationReason", Type: String, Resolve: constant(nil)},
+	}
+
+	enumValueType.Fields = []*Field{
+		{Name: "name", Type: NonNullOf(String), Resolve: resolveWith(func(v EnumValue, _ ResolveParams) (any, error) {
+			return v.Name, nil
+		})},
+		{Name: "description", Type: String, Resolve: resolveWith(func(v EnumValue, _ ResolveParams) (any, error) {
+			return optional(v.Description), nil
+		})},
+		{Name: "isDeprecated", Type: NonNullOf(Boolean), Resolve: constant(false)},
+		{Name: "deprecationReason", Type: String, Resolve: constant(nil)},
+	}
+
+	directiveType.Fields = []*Field{
+		{Name: "name", Type: NonNullOf(String), Resolve: resolveWith(func(d *directiveDef, _ ResolveParams) (any, error) {
+			return d.Name, nil
+		})},
+		{Name: "description", Type: String, Resolve: resolveWith(func(d *directiveDef, _ ResolveParams) (any, error) {
+			return optional(d.Description), nil
+		})},
+		{Name: "locations", Type: NonNullOf(ListOf(NonNullOf(directiveLocation))), Resolve: resolveWith(func(d *directiveDef, _ ResolveParams) (any, error) {
+			return d.Locations, nil
+		})},
+		{Name: "args", Type: NonNullOf(ListOf(NonNullOf(inputValueType))), Resolve: resolveWith(func(d *directiveDef, _ ResolveParams) (any, error) {
+			return nonNilArgs(d.Args), nil
+		})},
+		{Name: "isRepeatable", Type: NonNullOf(Boolean), Resolve: constant(false)},
+	}
+}
+
+// optional is nil for an empty string, descriptions that aren't set are null
+func optional(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nonNilArgs(args []*Arg) []*Arg {
+	if args == nil {
+		return []*Arg{}
+	}
+	return args
+}
+
+// literal writes a default value the way a query would, like "24h", 20 or ERROR
+func literal(t Type, value any) string {
+	switch named := namedType(t).(type) {
+	case *Enum:
+		if list, ok := value.([]string); ok {
+			return "[" + strings.Join(list, ", ") + "]"
+		}
+		return fmt.Sprint(value)
+	case *Scalar:
+		if named == String || named == ID {
+			if s, ok := value.(string); ok {
+				return strconv.Quote(s)
+			}
+		}
+	}
+	return fmt.Sprint(value)
+}
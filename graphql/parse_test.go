@@ -0,0 +1,112 @@
+package graphql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOperations(t *testing.T) {
+	doc, err := parse(`
+		# a comment
+		query Traces($limit: Int = 10, $ids: [ID!]!) @skip(if: false) {
+			recent: traces(limit: $limit) { id ...TraceFields }
+		}
+		{ hello }
+		fragment TraceFields on Trace { name spans { name } }
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 2 {
+		t.Fatalf("got %d operations, want 2", len(doc.operations))
+	}
+	op := doc.operations[0]
+	if op.kind != "query" || op.name != "Traces" {
+		t.Errorf("got %s %q, want query \"Traces\"", op.kind, op.name)
+	}
+	if len(op.variables) != 2 {
+		t.Fatalf("got %d variables, want 2", len(op.variables))
+	}
+	if v := op.variables[0]; v.name != "limit" || v.typ.String() != "Int" || v.def != int64(10) {
+		t.Errorf("got variable %s: %s = %v, want limit: Int = 10", v.name, v.typ, v.def)
+	}
+	if v := op.variables[1]; v.name != "ids" || v.typ.String() != "[ID!]!" {
+		t.Errorf("got variable %s: %s, want ids: [ID!]!", v.name, v.typ)
+	}
+	f, ok := op.selection[0].(*field)
+	if !ok || f.alias != "recent" || f.name != "traces" || f.key() != "recent" {
+		t.Fatalf("got %#v, want the field traces aliased recent", op.selection[0])
+	}
+	if _, ok := f.selection[1].(*fragmentSpread); !ok {
+		t.Errorf("got %#v, want a fragment spread", f.selection[1])
+	}
+	if doc.operations[1].kind != "query" || doc.operations[1].name != "" {
+		t.Errorf("got %s %q, want an anonymous query", doc.operations[1].kind, doc.operations[1].name)
+	}
+	if fr := doc.fragments["TraceFields"]; fr == nil || fr.on != "Trace" || len(fr.selection) != 2 {
+		t.Errorf("got fragment %#v, want TraceFields on Trace with 2 fields", fr)
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	doc, err := parse(`{ f(a: -12, b: 1.5e3, c: "tab\there é", d: true, e: null, g: [1, "x"], h: RED, i: """
+		block
+		  string
+	""") }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := doc.operations[0].selection[0].(*field).args
+	want := map[string]any{
+		"a": int64(-12),
+		"b": 1500.0,
+		"c": "tab\there é",
+		"d": true,
+		"e": nil,
+		"h": enumValue("RED"),
+		"i": "block\n  string",
+	}
+	for _, a := range args {
+		if w, ok := want[a.name]; ok && a.value != w {
+			t.Errorf("%s: got %#v, want %#v", a.name, a.value, w)
+		}
+	}
+	list, ok := args[5].value.([]any)
+	if !ok || len(list) != 2 || list[0] != int64(1) || list[1] != "x" {
+		t.Errorf("g: got %#v, want [1 \"x\"]", args[5].value)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		loc   Location
+	}{
+		{"", "no operation", Location{1, 1}},
+		{"{ hello", "", Location{1, 8}},
+		{"{ hello(a: ) }", "", Location{1, 12}},
+		{"query {\n  a\n  $b\n}", "", Location{3, 3}},
+		{`{ a(s: "unterminated) }`, "", Location{1, 8}},
+		{"fragment F on T { a } fragment F on T { b } { a }", "only one fragment", Location{1, 23}},
+		{"{ a(n: 01) }", "", Location{1, 8}},
+	}
+	for _, tt := range tests {
+		_, err := parse(tt.query)
+		if err == nil {
+			t.Errorf("%q: got no error", tt.query)
+			continue
+		}
+		gqlErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: got %T, want *Error", tt.query, err)
+			continue
+		}
+		if !strings.Contains(gqlErr.Message, tt.want) {
+			t.Errorf("%q: got %q, want it to contain %q", tt.query, gqlErr.Message, tt.want)
+		}
+		if len(gqlErr.Locations) != 1 || gqlErr.Locations[0] != tt.loc {
+			t.Errorf("%q: got locations %v, want %v", tt.query, gqlErr.Locations, tt.loc)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+// Package graphql serves queries of a GraphQL schema. It implements the executable
+// part of the spec a read-only API needs: queries with variables, aliases,
+// fragments, @skip and @include, and introspection. Mutations, subscriptions,
+// interfaces, unions and input objects aren't supported.
+package graphql
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Type is a *Scalar, an *Enum, an *Object, a *List or a *NonNull
+type Type interface {
+	String() string
+}
+
+// Scalar is a leaf type
+type Scalar struct {
+	Name        string
+	Description string
+	// Serialize turns a resolved value into its JSON value
+	Serialize func(v any) (any, error)
+	// Parse turns the value of an argument into what the resolvers get, the value is
+	// an int64, a float64, a string or a bool
+	Parse func(v any) (any, error)
+}
+
+func (s *Scalar) String() string { return s.Name }
+
+// Enum is a leaf type of names, resolved from and parsed into strings
+type Enum struct {
+	Name        string
+	Description string
+	Values      []EnumValue
+}
+
+type EnumValue struct {
+	Name        string
+	Description string
+}
+
+func (e *Enum) String() string { return e.Name }
+
+func (e *Enum) has(name string) bool {
+	for _, v := range e.Values {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Object is a type with fields, listed in the order they are introspected
+type Object struct {
+	Name        string
+	Description string
+	Fields      []*Field
+}
+
+func (o *Object) String() string { return o.Name }
+
+func (o *Object) field(name string) *Field {
+	for _, f := range o.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// List is a list of values of a type
+type List struct {
+	Of Type
+}
+
+func (l *List) String() string { return "[" + l.Of.String() + "]" }
+
+// NonNull is a type whose values can't be null
+type NonNull struct {
+	Of Type
+}
+
+func (n *NonNull) String() string { return n.Of.String() + "!" }
+
+// ListOf and NonNullOf shorten the types of fields, like NonNullOf(ListOf(String))
+func ListOf(t Type) *List       { return &List{Of: t} }
+func NonNullOf(t Type) *NonNull { return &NonNull{Of: t} }
+
+// namedType removes the lists and non-nulls around a type
+func namedType(t Type) Type {
+	for {
+		switch w := t.(type) {
+		case *NonNull:
+			t = w.Of
+		case *List:
+			t = w.Of
+		default:
+			return t
+		}
+	}
+}
+
+func isNonNull(t Type) bool {
+	_, ok := t.(*NonNull)
+	return ok
+}
+
+func isLeaf(t Type) bool {
+	_, ok := namedType(t).(*Object)
+	return !ok
+}
+
+// Field is a field of an Object
+type Field struct {
+	Name        string
+	Description string
+	Type        Type
+	Args        []*Arg
+	// Resolve returns the value of the field, when nil it's the value of the struct
+	// field of the source with the field's name as its json tag, or of the map key
+	Resolve func(p ResolveParams) (any, error)
+}
+
+func (f *Field) arg(name string) *Arg {
+	for _, a := range f.Args {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// Arg is an argument of a Field, its type is a scalar, an enum or a list of them
+type Arg struct {
+	Name        string
+	Description string
+	Type        Type
+	// Default is the value when the argument isn't given, nil for none
+	Default any
+}
+
+// ResolveParams are the inputs of a resolver
+type ResolveParams struct {
+	Context context.Context
+	// Source is the value of the object the field is of, nil for the query
+	Source any
+	// Args holds the arguments given or with a default, parsed by their types
+	Args map[string]any
+
+	schema *Schema
+}
+
+// Built-in scalars
+var (
+	Int = &Scalar{
+		Name:        "Int",
+		Description: "A signed 32 bit integer",
+		Serialize:   serializeInt,
+		Parse: func(v any) (any, error) {
+			n, ok := v.(int64)
+			if !ok || n < math.MinInt32 || n > math.MaxInt32 {
+				return nil, fmt.Errorf("expected a 32 bit integer, got %s", describe(v))
+			}
+			return int(n), nil
+		},
+	}
+	Float = &Scalar{
+		Name:        "Float",
+		Description: "A double precision floating point number",
+		Serialize:   serializeFloat,
+		Parse: func(v any) (any, error) {
+			switch v := v.(type) {
+			case int64:
+				return float64(v), nil
+			case float64:
+				return v, nil
+			}
+			return nil, fmt.Errorf("expected a number, got %s", describe(v))
+		},
+	}
+	String = &Scalar{
+		Name:        "String",
+		Description: "A UTF-8 string",
+		Serialize:   serializeString,
+		Parse:       parseString,
+	}
+	Boolean = &Scalar{
+		Name:        "Boolean",
+		Description: "true or false",
+		Serialize: func(v any) (any, error) {
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, fmt.Errorf("%T isn't a boolean", v)
+		},
+		Parse: func(v any) (any, error) {
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, fmt.Errorf("expected a boolean, got %s", describe(v))
+		},
+	}
+	ID = &Scalar{
+		Name:        "ID",
+		Description: "A unique identifier, written as a string",
+		Serialize:   serializeString,
+		Parse: func(v any) (any, error) {
+			if n, ok := v.(int64); ok {
+				return strconv.FormatInt(n, 10), nil
+			}
+			return parseString(v)
+		},
+	}
+)
+
+func serializeInt(v any) (any, error) {
+	var n int64
+	switch v := v.(type) {
+	case int:
+		n = int64(v)
+	case int8:
+		n = int64(v)
+	case int16:
+		n = int64(v)
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	case uint:
+		n = int64(v)
+	case uint8:
+		n = int64(v)
+	case uint16:
+		n = int64(v)
+	case uint32:
+		n = int64(v)
+	case uint64:
+		if v > math.MaxInt32 {
+			return nil, fmt.Errorf("%d doesn't fit in an Int", v)
+		}
+		n = int64(v)
+	default:
+		return nil, fmt.Errorf("%T isn't an integer", v)
+	}
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		return nil, fmt.Errorf("%d doesn't fit in an Int", n)
+	}
+	return n, nil
+}
+
+func serializeFloat(v any) (any, error) {
+	switch v := v.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v isn't a finite number", v)
+		}
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	}
+	return nil, fmt.Errorf("%T isn't a number", v)
+}
+
+func serializeString(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case fmt.Stringer:
+		return v.String(), nil
+	}
+	return nil, fmt.Errorf("%T isn't a string", v)
+}
+
+func parseString(v any) (any, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("expected a string, got %s", describe(v))
+}
+
+// describe writes a value of a query for error messages
+func describe(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case enumValue:
+		return string(v)
+	case []any:
+		return "a list"
+	case map[string]any:
+		return "an object"
+	}
+	return fmt.Sprint(v)
+}
+
+// Schema is the types reachable from a query type
+type Schema struct {
+	Query       *Object
+	Description string
+	// types are the named types by name, the introspection types included
+	types map[string]Type
+	// MaxDepth bounds the nesting of the fields of a query
+	MaxDepth int
+}
+
+// DefaultMaxDepth is the deepest nesting of fields of a query, deep enough for the
+// introspection query of GraphiQL
+const DefaultMaxDepth = 15
+
+// NewSchema returns the schema of a query type, the names of its types must be
+// unique. The introspection fields __schema and __type are added to query.
+func NewSchema(query *Object, description string) (*Schema, error) {
+	s := &Schema{Query: query, Description: description, types: make(map[string]Type), MaxDepth: DefaultMaxDepth}
+	for _, scalar := range []*Scalar{Int, Float, String, Boolean, ID} {
+		s.types[scalar.Name] = scalar
+	}
+	if err := s.collect(query); err != nil {
+		return nil, err
+	}
+	if err := s.collect(schemaType); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Schema) collect(t Type) error {
+	t = namedType(t)
+	name := t.String()
+	if existing, ok := s.types[name]; ok {
+		if existing != t {
+			return fmt.Errorf("graphql: there are two types named %s", name)
+		}
+		return nil
+	}
+	s.types[name] = t
+	obj, ok := t.(*Object)
+	if !ok {
+		return nil
+	}
+	for _, f := range obj.Fields {
+		if err := s.collect(f.Type); err != nil {
+			return err
+		}
+		for _, a := range f.Args {
+			if !isLeaf(a.Type) {
+				return fmt.Errorf("graphql: argument %s of %s.%s isn't a scalar or an enum", a.Name, obj.Name, f.Name)
+			}
+			if err := s.collect(a.Type); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Type returns the named type, nil when the schema doesn't have it
+func (s *Schema) Type(name string) Type {
+	return s.types[name]
+}
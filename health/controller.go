@@ -0,0 +1,109 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"nabatshy/db"
+	"nabatshy/openapi"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/go-chi/chi/v5"
+)
+
+// checkTimeout bounds every check so a hung database fails the probe instead of timing it out
+const checkTimeout = 2 * time.Second
+
+// Check is a readiness condition, Run returns why the server isn't ready
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// CheckResult is the outcome of a check
+type CheckResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Readiness is the /readyz response
+type Readiness struct {
+	Ready  bool          `json:"ready"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// ClickHouse checks the database answers a ping
+func ClickHouse(conn clickhouse.Conn) Check {
+	return Check{Name: "clickhouse", Run: func(ctx context.Context) error {
+		return conn.Ping(ctx)
+	}}
+}
+
+// SchemaVersion checks every migration of this build was applied. A newer schema is
+// fine since migrations only add to it, so older builds keep serving during rollouts.
+func SchemaVersion(conn clickhouse.Conn) Check {
+	return Check{Name: "schema", Run: func(ctx context.Context) error {
+		current, err := db.SchemaVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if latest := db.LatestSchemaVersion(); current < latest {
+			return fmt.Errorf("database is at version %d, this build needs %d", current, latest)
+		}
+		return nil
+	}}
+}
+
+// HealthController serves the liveness and readiness probes
+type HealthController struct {
+	checks []Check
+}
+
+func NewHealthController(checks ...Check) *HealthController {
+	return &HealthController{checks: checks}
+}
+
+// getHealthz answers as long as the process serves requests
+func (c *HealthController) getHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+func (c *HealthController) getReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := Readiness{Ready: true, Checks: make([]CheckResult, 0, len(c.checks))}
+	for _, check := range c.checks {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		err := check.Run(ctx)
+		cancel()
+
+		result := CheckResult{Name: check.Name, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			readiness.Ready = false
+		}
+		readiness.Checks = append(readiness.Checks, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
+
+func (c *HealthController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/healthz", Summary: "Liveness probe", ContentType: "text/plain"},
+		{Method: http.MethodGet, Path: "/readyz", Summary: "Readiness probe, 503 with the failed checks when not ready",
+			Response: Readiness{}, Error: Readiness{}},
+	}
+}
+
+func (c *HealthController) RegisterRoutes(r chi.Router) {
+	r.Get("/healthz", c.getHealthz)
+	r.Get("/readyz", c.getReadyz)
+}
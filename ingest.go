@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"nabatshy/collector"
+
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// ingest sends OTLP trace files to the collector of a running server, JSON files or
+// protobuf ones ending with .pb or .binpb, - reads JSON from stdin. With -format jaeger
+// the files are Jaeger JSON exports. The exports are sent as imports, spans older
+// than the collector's INGEST_MAX_SPAN_AGE are kept.
+func ingest(args []string) {
+	log.SetFlags(0)
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	collectorURL := fs.String("collector-url", envOr("NABATSHY_COLLECTOR_URL", "http://localhost:4318"), "URL of the OTLP collector, ending with /otlp in single port mode (env NABATSHY_COLLECTOR_URL)")
+	format := fs.String("format", "otlp", "format of the files, otlp or jaeger for the JSON of the Jaeger UI's \"Download JSON\"")
+	dir := fs.String("dir", "", "send the OTLP files under this directory, like the output of the OTel Collector's file exporter, instead of FILE arguments")
+	batchSize := fs.Int("batch-size", 5000, "spans per export request with -dir")
+	progressFile := fs.String("progress-file", "", "where -dir records the files sent, to resume an interrupted import (default DIR/"+progressFileName+")")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: nabatshy ingest [flags] FILE...\n       nabatshy ingest -dir DIR [flags]")
+		fmt.Fprint(fs.Output(), "\nThe files are imported as past traces: spans older than the collector's\nINGEST_MAX_SPAN_AGE are kept, the other validation still applies.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (fs.NArg() == 0) == (*dir == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *dir != "" && (*format != "otlp" || *batchSize <= 0) {
+		log.Fatal("-dir reads OTLP files only and -batch-size must be positive")
+	}
+
+	endpoint := strings.TrimRight(*collectorURL, "/")
+	switch *format {
+	case "otlp":
+		endpoint += "/v1/traces"
+	case "jaeger":
+		endpoint += "/v1/import/jaeger"
+	default:
+		log.Fatalf("invalid -format %q, expected otlp or jaeger", *format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	httpClient := &http.Client{Timeout: time.Minute}
+	if *dir != "" {
+		if err := ingestDir(ctx, httpClient, endpoint, *dir, *batchSize, *progressFile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	failed := false
+	for _, path := range fs.Args() {
+		if err := ingestFile(ctx, httpClient, endpoint, *format, path); err != nil {
+			log.Printf("%s: %v", path, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func ingestFile(ctx context.Context, httpClient *http.Client, endpoint, format, path string) error {
+	var body []byte
+	var err error
+	if path == "-" {
+		body, err = io.ReadAll(os.Stdin)
+	} else {
+		body, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	contentType := "application/json"
+	unmarshal := protojson.Unmarshal
+	// Jaeger exports are always JSON
+	if ext := filepath.Ext(path); format == "otlp" && (ext == ".pb" || ext == ".binpb") {
+		contentType = "application/x-protobuf"
+		unmarshal = proto.Unmarshal
+	}
+
+	partial, err := postExport(ctx, httpClient, endpoint, contentType, body, unmarshal)
+	if err != nil {
+		return err
+	}
+	if partial.GetRejectedSpans() > 0 {
+		fmt.Printf("%s: ingested, %d spans rejected: %s\n", path, partial.GetRejectedSpans(), partial.GetErrorMessage())
+		return nil
+	}
+	fmt.Printf("%s: ingested\n", path)
+	return nil
+}
+
+// postExport sends an export to the collector and returns the partial success the
+// collector reports the spans it rejected with
+func postExport(ctx context.Context, httpClient *http.Client, endpoint, contentType string, body []byte, unmarshal func([]byte, proto.Message) error) (*coltrace.ExportTracePartialSuccess, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(collector.ImportHeader, "true")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("collector error (%d): %s", resp.StatusCode, strings.TrimSpace(string(out)))
+	}
+	var result coltrace.ExportTraceServiceResponse
+	if err := unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("invalid collector response: %w", err)
+	}
+	return result.GetPartialSuccess(), nil
+}
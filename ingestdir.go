@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"nabatshy/collector"
+
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// progressFileName is where ingest -dir records the files it sent, in the directory
+// unless -progress-file is set
+const progressFileName = ".nabatshy-ingested"
+
+// otlpExtensions are the files ingest -dir reads
+var otlpExtensions = []string{".json", ".jsonl", ".pb", ".binpb"}
+
+// ingestDir sends the OTLP files under dir, like the output of the OTel Collector's
+// file exporter, in batches of batchSize spans. The files sent are recorded in
+// progressFile, so running it again after an interruption sends the files left.
+func ingestDir(ctx context.Context, httpClient *http.Client, endpoint, dir string, batchSize int, progressFile string) error {
+	if progressFile == "" {
+		progressFile = filepath.Join(dir, progressFileName)
+	}
+	done, err := readProgress(progressFile)
+	if err != nil {
+		return err
+	}
+	var files []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && slices.Contains(otlpExtensions, filepath.Ext(path)) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	progress, err := os.OpenFile(progressFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+
+	start := time.Now()
+	var spans, rejected int64
+	skipped, failed := 0, 0
+	for i, path := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		// a file that grew since it was sent, still written by the exporter then, is
+		// sent again whole
+		if size, ok := done[rel]; ok && size == info.Size() {
+			skipped++
+			continue
+		}
+		sent, rej, err := ingestOTLPFile(ctx, httpClient, endpoint, path, batchSize)
+		spans += sent
+		rejected += rej
+		var invalid invalidFileError
+		switch {
+		case errors.As(err, &invalid):
+			// unreadable files are left for the next run, the others can still be sent
+			log.Printf("[%d/%d] %s: %v", i+1, len(files), rel, err)
+			failed++
+			continue
+		case err != nil:
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		if _, err := fmt.Fprintf(progress, "%d\t%s\n", info.Size(), rel); err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+		fmt.Printf("[%d/%d] %s: %d spans, %d rejected (%.0f spans/s overall)\n", i+1, len(files), rel, sent, rej, float64(spans)/elapsed.Seconds())
+	}
+	fmt.Printf("ingested %d spans from %d files in %s, %d rejected, %d skipped as already ingested\n",
+		spans, len(files)-skipped-failed, time.Since(start).Round(time.Millisecond), rejected, skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d files couldn't be read", failed)
+	}
+	return nil
+}
+
+// readProgress returns the size of the files recorded in a progress file by their
+// path, none when it doesn't exist yet
+func readProgress(path string) (map[string]int64, error) {
+	done := make(map[string]int64)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		size, rel, ok := strings.Cut(scanner.Text(), "\t")
+		n, err := strconv.ParseInt(size, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%s: invalid line %q", path, scanner.Text())
+		}
+		done[rel] = n
+	}
+	return done, scanner.Err()
+}
+
+// invalidFileError is a file that isn't OTLP
+type invalidFileError struct {
+	err error
+}
+
+func (e invalidFileError) Error() string { return e.err.Error() }
+
+// ingestOTLPFile sends the exports of a file in batches and returns the spans sent
+// and the spans rejected
+func ingestOTLPFile(ctx context.Context, httpClient *http.Client, endpoint, path string, batchSize int) (int64, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, invalidFileError{err}
+	}
+	exports, err := readExports(data, filepath.Ext(path))
+	if err != nil {
+		return 0, 0, invalidFileError{err}
+	}
+
+	var sent, rejected int64
+	batch := &coltrace.ExportTraceServiceRequest{}
+	size := 0
+	flush := func() error {
+		if size == 0 {
+			return nil
+		}
+		body, err := proto.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		partial, err := postExport(ctx, httpClient, endpoint, "application/x-protobuf", body, proto.Unmarshal)
+		if err != nil {
+			return err
+		}
+		sent += int64(size)
+		rejected += partial.GetRejectedSpans()
+		batch, size = &coltrace.ExportTraceServiceRequest{}, 0
+		return nil
+	}
+	for _, export := range exports {
+		for _, rs := range export.ResourceSpans {
+			batch.ResourceSpans = append(batch.ResourceSpans, rs)
+			size += countSpans(rs)
+			if size >= batchSize {
+				if err := flush(); err != nil {
+					return sent, rejected, err
+				}
+			}
+		}
+	}
+	return sent, rejected, flush()
+}
+
+// readExports decodes the exports of a file. JSON files hold one export or one per
+// line, like the file exporter writes them. Protobuf files hold one export, or exports
+// each after its length as 4 bytes big endian as the file exporter writes them, told
+// apart by the first byte which is never 0 for an export.
+func readExports(data []byte, ext string) ([]*coltrace.ExportTraceServiceRequest, error) {
+	var exports []*coltrace.ExportTraceServiceRequest
+	if ext == ".pb" || ext == ".binpb" {
+		if len(data) == 0 || data[0] != 0 {
+			var export coltrace.ExportTraceServiceRequest
+			if err := proto.Unmarshal(data, &export); err != nil {
+				return nil, err
+			}
+			return append(exports, &export), nil
+		}
+		for len(data) > 0 {
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated length")
+			}
+			n := binary.BigEndian.Uint32(data)
+			if uint32(len(data)-4) < n {
+				return nil, fmt.Errorf("truncated export")
+			}
+			var export coltrace.ExportTraceServiceRequest
+			if err := proto.Unmarshal(data[4:4+n], &export); err != nil {
+				return nil, err
+			}
+			exports = append(exports, &export)
+			data = data[4+n:]
+		}
+		return exports, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return exports, nil
+		} else if err != nil {
+			return nil, err
+		}
+		// decoded like the collector decodes JSON exports, so the IDs are the same
+		// whether a file is sent as is or with -dir
+		var export coltrace.ExportTraceServiceRequest
+		if err := collector.UnmarshalJSON(raw, &export); err != nil {
+			return nil, err
+		}
+		exports = append(exports, &export)
+	}
+}
+
+func countSpans(rs *tracepb.ResourceSpans) int {
+	n := 0
+	for _, ss := range rs.ScopeSpans {
+		n += len(ss.Spans)
+	}
+	return n
+}
@@ -0,0 +1,349 @@
+// Package jaeger converts the JSON of the Jaeger UI and query API to OTLP, to import
+// traces saved from a Jaeger installation
+package jaeger
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// export is the JSON of the Jaeger UI's "Download JSON" and of /api/traces
+type export struct {
+	Data []trace `json:"data"`
+}
+
+type trace struct {
+	TraceID   string             `json:"traceID"`
+	Spans     []span             `json:"spans"`
+	Processes map[string]process `json:"processes"`
+}
+
+type span struct {
+	TraceID       string      `json:"traceID"`
+	SpanID        string      `json:"spanID"`
+	Flags         uint32      `json:"flags"`
+	OperationName string      `json:"operationName"`
+	References    []reference `json:"references"`
+	// StartTime and Duration are in microseconds
+	StartTime uint64     `json:"startTime"`
+	Duration  uint64     `json:"duration"`
+	Tags      []tag      `json:"tags"`
+	Logs      []logEntry `json:"logs"`
+	ProcessID string     `json:"processID"`
+	// Process is set instead of ProcessID by some exporters
+	Process *process `json:"process"`
+}
+
+type reference struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type process struct {
+	ServiceName string `json:"serviceName"`
+	Tags        []tag  `json:"tags"`
+}
+
+type logEntry struct {
+	Timestamp uint64 `json:"timestamp"`
+	Fields    []tag  `json:"fields"`
+}
+
+type tag struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// Raw is a string, a bool or a json.Number
+	Raw any `json:"value"`
+}
+
+// Convert reads a Jaeger JSON export, an object with the traces under "data", an
+// array of traces or a single trace
+func Convert(data []byte) (*coltrace.ExportTraceServiceRequest, error) {
+	traces, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	req := &coltrace.ExportTraceServiceRequest{}
+	for i, t := range traces {
+		rs, err := convertTrace(t)
+		if err != nil {
+			if t.TraceID == "" {
+				return nil, fmt.Errorf("trace %d: %w", i, err)
+			}
+			return nil, fmt.Errorf("trace %s: %w", t.TraceID, err)
+		}
+		req.ResourceSpans = append(req.ResourceSpans, rs...)
+	}
+	return req, nil
+}
+
+func decode(data []byte) ([]trace, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var traces []trace
+		if err := unmarshal(data, &traces); err != nil {
+			return nil, fmt.Errorf("invalid Jaeger JSON: %w", err)
+		}
+		return traces, nil
+	}
+	var doc struct {
+		export
+		trace
+	}
+	if err := unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid Jaeger JSON: %w", err)
+	}
+	if doc.Data == nil && doc.Spans == nil {
+		return nil, fmt.Errorf("invalid Jaeger JSON: no data or spans")
+	}
+	if doc.Spans != nil {
+		return append(doc.Data, doc.trace), nil
+	}
+	return doc.Data, nil
+}
+
+// unmarshal keeps the numbers of tag values as written, int64 tags don't fit a float64
+func unmarshal(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// convertTrace returns the spans of a trace grouped by process and instrumentation
+// scope
+func convertTrace(t trace) ([]*tracepb.ResourceSpans, error) {
+	var out []*tracepb.ResourceSpans
+	resources := make(map[string]*tracepb.ResourceSpans)
+	scopes := make(map[string]*tracepb.ScopeSpans)
+	for i, s := range t.Spans {
+		converted, scope, err := convertSpan(s, t.TraceID)
+		if err != nil {
+			return nil, fmt.Errorf("span %d: %w", i, err)
+		}
+
+		p, processID := s.Process, s.ProcessID
+		if p == nil {
+			found, ok := t.Processes[processID]
+			if !ok {
+				return nil, fmt.Errorf("span %d: unknown process %q", i, processID)
+			}
+			p = &found
+		} else {
+			processID = fmt.Sprintf("span-%d", i)
+		}
+		rs, ok := resources[processID]
+		if !ok {
+			rs = &tracepb.ResourceSpans{Resource: convertProcess(*p)}
+			resources[processID] = rs
+			out = append(out, rs)
+		}
+		key := processID + "\x00" + scope.GetName() + "\x00" + scope.GetVersion()
+		ss, ok := scopes[key]
+		if !ok {
+			ss = &tracepb.ScopeSpans{Scope: scope}
+			scopes[key] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+		ss.Spans = append(ss.Spans, converted)
+	}
+	return out, nil
+}
+
+func convertProcess(p process) *resourcepb.Resource {
+	attrs := []*commonpb.KeyValue{{Key: "service.name", Value: stringValue(p.ServiceName)}}
+	for _, t := range p.Tags {
+		if t.Key == "service.name" {
+			continue
+		}
+		attrs = append(attrs, &commonpb.KeyValue{Key: t.Key, Value: t.value()})
+	}
+	return &resourcepb.Resource{Attributes: attrs}
+}
+
+// convertSpan maps the tags Jaeger derives from OTLP fields back to them: span.kind,
+// the error and otel.status_* tags and the otel.scope.* or otel.library.* ones
+func convertSpan(s span, traceID string) (*tracepb.Span, *commonpb.InstrumentationScope, error) {
+	if s.TraceID == "" {
+		s.TraceID = traceID
+	}
+	tid, err := decodeID(s.TraceID, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid traceID: %w", err)
+	}
+	sid, err := decodeID(s.SpanID, 8)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid spanID: %w", err)
+	}
+	out := &tracepb.Span{
+		TraceId:           tid,
+		SpanId:            sid,
+		Flags:             s.Flags & 0xff,
+		Name:              s.OperationName,
+		Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+		StartTimeUnixNano: s.StartTime * 1000,
+		EndTimeUnixNano:   (s.StartTime + s.Duration) * 1000,
+	}
+
+	// the first CHILD_OF reference is the parent, or the first reference when there
+	// is no CHILD_OF one, the others are links
+	parent := -1
+	for i, r := range s.References {
+		if r.RefType == "CHILD_OF" {
+			parent = i
+			break
+		}
+	}
+	if parent < 0 && len(s.References) > 0 {
+		parent = 0
+	}
+	for i, r := range s.References {
+		refTrace, err := decodeID(r.TraceID, 16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid reference traceID: %w", err)
+		}
+		refSpan, err := decodeID(r.SpanID, 8)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid reference spanID: %w", err)
+		}
+		if i == parent && bytes.Equal(refTrace, tid) {
+			out.ParentSpanId = refSpan
+			continue
+		}
+		out.Links = append(out.Links, &tracepb.Span_Link{TraceId: refTrace, SpanId: refSpan})
+	}
+
+	scope := &commonpb.InstrumentationScope{}
+	failed := false
+	status := &tracepb.Status{}
+	for _, t := range s.Tags {
+		switch t.Key {
+		case "span.kind":
+			out.Kind = spanKind(t.String())
+		case "error":
+			failed = failed || t.String() == "true"
+		case "otel.status_code":
+			switch t.String() {
+			case "ERROR":
+				failed = true
+			case "OK":
+				status.Code = tracepb.Status_STATUS_CODE_OK
+			}
+		case "otel.status_description":
+			status.Message = t.String()
+		case "otel.scope.name", "otel.library.name":
+			scope.Name = t.String()
+		case "otel.scope.version", "otel.library.version":
+			scope.Version = t.String()
+		case "internal.span.format":
+		default:
+			out.Attributes = append(out.Attributes, &commonpb.KeyValue{Key: t.Key, Value: t.value()})
+		}
+	}
+
+	hasException := false
+	for _, l := range s.Logs {
+		event := &tracepb.Span_Event{TimeUnixNano: l.Timestamp * 1000, Name: "log"}
+		for _, f := range l.Fields {
+			if f.Key == "event" {
+				event.Name = f.String()
+				continue
+			}
+			event.Attributes = append(event.Attributes, &commonpb.KeyValue{Key: f.Key, Value: f.value()})
+		}
+		hasException = hasException || event.Name == "exception"
+		out.Events = append(out.Events, event)
+	}
+	if failed {
+		status.Code = tracepb.Status_STATUS_CODE_ERROR
+		// failed spans are the ones with an exception event
+		if !hasException {
+			message := status.Message
+			if message == "" {
+				message = "error"
+			}
+			out.Events = append(out.Events, &tracepb.Span_Event{
+				TimeUnixNano: out.EndTimeUnixNano,
+				Name:         "exception",
+				Attributes:   []*commonpb.KeyValue{{Key: "exception.message", Value: stringValue(message)}},
+			})
+		}
+	}
+	if status.Code != tracepb.Status_STATUS_CODE_UNSET {
+		out.Status = status
+	}
+	return out, scope, nil
+}
+
+func spanKind(kind string) tracepb.Span_SpanKind {
+	switch strings.ToLower(kind) {
+	case "server":
+		return tracepb.Span_SPAN_KIND_SERVER
+	case "client":
+		return tracepb.Span_SPAN_KIND_CLIENT
+	case "producer":
+		return tracepb.Span_SPAN_KIND_PRODUCER
+	case "consumer":
+		return tracepb.Span_SPAN_KIND_CONSUMER
+	}
+	return tracepb.Span_SPAN_KIND_INTERNAL
+}
+
+// decodeID decodes a hex ID, Jaeger drops the leading zeros and writes 64 bit trace
+// IDs with 16 digits
+func decodeID(id string, size int) ([]byte, error) {
+	if id == "" || len(id) > size*2 {
+		return nil, fmt.Errorf("%q isn't a %d byte hex ID", id, size)
+	}
+	b, err := hex.DecodeString(strings.Repeat("0", size*2-len(id)) + id)
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't a %d byte hex ID", id, size)
+	}
+	return b, nil
+}
+
+// String returns the value of the tag as text
+func (t tag) String() string {
+	switch v := t.Raw.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (t tag) value() *commonpb.AnyValue {
+	switch v := t.Raw.(type) {
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v}}
+	case json.Number:
+		if i, err := v.Int64(); err == nil && t.Type != "float64" {
+			return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: i}}
+		}
+		if f, err := v.Float64(); err == nil {
+			return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: f}}
+		}
+	case string:
+		if t.Type == "binary" {
+			if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+				return &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: b}}
+			}
+		}
+	}
+	return stringValue(t.String())
+}
+
+func stringValue(s string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+}
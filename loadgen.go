@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"nabatshy/loadgen"
+)
+
+// generateLoad sends synthetic traces to the collector of a running server at a fixed
+// span rate, to benchmark ingestion and size ClickHouse
+func generateLoad(args []string) {
+	log.SetFlags(0)
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	collectorURL := fs.String("collector-url", envOr("NABATSHY_COLLECTOR_URL", "http://localhost:4318"), "URL of the OTLP collector, ending with /otlp in single port mode (env NABATSHY_COLLECTOR_URL)")
+	rate := fs.Int("rate", 1000, "spans sent per second")
+	batchSize := fs.Int("batch-size", 500, "spans per export request")
+	workers := fs.Int("workers", 4, "export requests in flight")
+	duration := fs.Duration("duration", 0, "how long to run, until interrupted when 0")
+	services := fs.Int("services", 0, "generate a random topology of this many services instead of the online shop one")
+	seed := fs.Uint64("seed", 0, "seed of the random topology and traces, random when 0")
+	interval := fs.Duration("report-interval", 5*time.Second, "how often to print the rate reached")
+	fs.Parse(args)
+	if *rate <= 0 || *batchSize <= 0 || *workers <= 0 || *services < 0 || *interval <= 0 {
+		log.Fatal("-rate, -batch-size, -workers and -report-interval must be positive and -services not negative")
+	}
+	if *seed == 0 {
+		*seed = rand.Uint64()
+	}
+
+	topology := loadgen.ShopTopology()
+	if *services > 0 {
+		topology = loadgen.RandomTopology(*services, *seed)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	opts := loadgen.Options{
+		Endpoint:  strings.TrimRight(*collectorURL, "/") + "/v1/traces",
+		SpanRate:  *rate,
+		BatchSize: *batchSize,
+		Workers:   *workers,
+		Topology:  topology,
+		Seed:      *seed,
+	}
+	fmt.Printf("sending %d spans/s of %d services to %s (seed %d)\n", *rate, len(topology.Services()), opts.Endpoint, *seed)
+	total := loadgen.Run(ctx, opts, *interval, func(s loadgen.Stats) { fmt.Println(s) })
+	fmt.Println("total:", total)
+	if total.Requests > 0 && total.Failed == total.Requests {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,163 @@
+package loadgen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// scopeName is the instrumentation scope of the generated spans
+const scopeName = "nabatshy-loadgen"
+
+// podsPerService is how many hosts the spans of a service are spread over
+const podsPerService = 3
+
+// Generator builds the traces of a topology, a Generator isn't safe for concurrent use
+type Generator struct {
+	topology  *Topology
+	rnd       *rand.Rand
+	resources map[string][]*resourcepb.Resource
+}
+
+func NewGenerator(topology *Topology, seed uint64) *Generator {
+	g := &Generator{
+		topology:  topology,
+		rnd:       rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)),
+		resources: make(map[string][]*resourcepb.Resource),
+	}
+	for _, service := range topology.Services() {
+		for i := 0; i < podsPerService; i++ {
+			g.resources[service] = append(g.resources[service], &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				stringAttribute("service.name", service),
+				stringAttribute("service.version", fmt.Sprintf("1.%d.0", len(service)%5)),
+				stringAttribute("deployment.environment", "loadgen"),
+				stringAttribute("host.name", fmt.Sprintf("%s-%d", service, i)),
+			}})
+		}
+	}
+	return g
+}
+
+// GeneratedSpan is a span with the resource of its service
+type GeneratedSpan struct {
+	Resource *resourcepb.Resource
+	Span     *tracepb.Span
+}
+
+// Trace returns the spans of a trace starting at start, from a root picked at random
+func (g *Generator) Trace(start time.Time) []GeneratedSpan {
+	root := g.topology.Roots[g.rnd.IntN(len(g.topology.Roots))]
+	traceID := g.id(16)
+	// every service of a trace runs on one of its pods
+	pods := make(map[string]*resourcepb.Resource)
+	var spans []GeneratedSpan
+	g.span(root, traceID, nil, start, pods, &spans)
+	return spans
+}
+
+// span appends the spans of a call of op and returns when it ends and whether it failed
+func (g *Generator) span(op *Operation, traceID, parentID []byte, start time.Time, pods map[string]*resourcepb.Resource, spans *[]GeneratedSpan) (time.Time, bool) {
+	resource, ok := pods[op.Service]
+	if !ok {
+		candidates := g.resources[op.Service]
+		resource = candidates[g.rnd.IntN(len(candidates))]
+		pods[op.Service] = resource
+	}
+	span := &tracepb.Span{
+		TraceId:           traceID,
+		SpanId:            g.id(8),
+		ParentSpanId:      parentID,
+		Name:              op.Name,
+		Kind:              op.Kind,
+		StartTimeUnixNano: uint64(start.UnixNano()),
+	}
+	*spans = append(*spans, GeneratedSpan{Resource: resource, Span: span})
+
+	// the operation's own time is split around its calls
+	self := g.duration(op.Duration)
+	t := start.Add(self / 2)
+	failed := g.rnd.Float64() < op.ErrorRate
+	for _, call := range op.Calls {
+		end, callFailed := g.span(call, traceID, span.SpanId, t.Add(g.gap()), pods, spans)
+		t = end
+		if callFailed {
+			failed = true
+			break
+		}
+	}
+	end := t.Add(self - self/2)
+	span.EndTimeUnixNano = uint64(end.UnixNano())
+
+	for _, k := range slices.Sorted(maps.Keys(op.Attributes)) {
+		span.Attributes = append(span.Attributes, stringAttribute(k, op.Attributes[k]))
+	}
+	if op.Attributes["http.method"] != "" {
+		status := "200"
+		if failed {
+			status = "500"
+		}
+		span.Attributes = append(span.Attributes, stringAttribute("http.status_code", status))
+	}
+	if failed {
+		span.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: op.Name + " failed"}
+		span.Events = append(span.Events, &tracepb.Span_Event{
+			TimeUnixNano: span.EndTimeUnixNano,
+			Name:         "exception",
+			Attributes: []*commonpb.KeyValue{
+				stringAttribute("exception.type", "LoadgenError"),
+				stringAttribute("exception.message", op.Name+" failed"),
+			},
+		})
+	}
+	return end, failed
+}
+
+// duration varies a median duration log-normally, with a slow tail of 1% of the calls
+func (g *Generator) duration(median time.Duration) time.Duration {
+	d := float64(median) * math.Exp(g.rnd.NormFloat64()*0.4)
+	if g.rnd.Float64() < 0.01 {
+		d *= 5 + g.rnd.Float64()*5
+	}
+	return time.Duration(d)
+}
+
+// gap is the network time before a call starts
+func (g *Generator) gap() time.Duration {
+	return time.Duration(100+g.rnd.IntN(400)) * time.Microsecond
+}
+
+func (g *Generator) id(n int) []byte {
+	id := make([]byte, n)
+	for i := 0; i < n; i += 8 {
+		binary.BigEndian.PutUint64(id[i:], g.rnd.Uint64())
+	}
+	return id
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// ResourceSpans groups spans by their resource, for an export request
+func ResourceSpans(spans []GeneratedSpan) []*tracepb.ResourceSpans {
+	var out []*tracepb.ResourceSpans
+	index := make(map[*resourcepb.Resource]*tracepb.ScopeSpans)
+	for _, s := range spans {
+		scope, ok := index[s.Resource]
+		if !ok {
+			scope = &tracepb.ScopeSpans{Scope: &commonpb.InstrumentationScope{Name: scopeName, Version: "1"}}
+			index[s.Resource] = scope
+			out = append(out, &tracepb.ResourceSpans{Resource: s.Resource, ScopeSpans: []*tracepb.ScopeSpans{scope}})
+		}
+		scope.Spans = append(scope.Spans, s.Span)
+	}
+	return out
+}
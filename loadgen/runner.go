@@ -0,0 +1,244 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// latencySamples bounds the export latencies kept for the percentiles of a whole run
+const latencySamples = 10000
+
+// Options configures a run
+type Options struct {
+	// Endpoint is the OTLP/HTTP traces endpoint, like http://localhost:4318/v1/traces
+	Endpoint string
+	// SpanRate is the spans sent per second
+	SpanRate int
+	// BatchSize is the spans of an export request
+	BatchSize int
+	// Workers is the number of export requests in flight, a collector that can't
+	// keep up lowers the rate reached
+	Workers  int
+	Topology *Topology
+	Seed     uint64
+}
+
+// Stats are the counts of a run or of an interval of it
+type Stats struct {
+	Elapsed time.Duration
+	Traces  uint64
+	Spans   uint64
+	// Rejected are the spans the collector reported as rejected
+	Rejected uint64
+	Requests uint64
+	// Failed are the requests that got an error or a non 2xx status, their spans
+	// count as sent
+	Failed uint64
+	// P50 and P99 are the latencies of the export requests
+	P50 time.Duration
+	P99 time.Duration
+	// LastError is the error of the last failed request
+	LastError error
+}
+
+func (s Stats) String() string {
+	rate := 0.0
+	if s.Elapsed > 0 {
+		rate = float64(s.Spans) / s.Elapsed.Seconds()
+	}
+	line := fmt.Sprintf("%d spans in %d traces over %s (%.0f spans/s), %d rejected, %d of %d requests failed, export p50 %s p99 %s",
+		s.Spans, s.Traces, s.Elapsed.Round(time.Millisecond), rate, s.Rejected, s.Failed, s.Requests,
+		s.P50.Round(time.Microsecond), s.P99.Round(time.Microsecond))
+	if s.LastError != nil {
+		line += fmt.Sprintf(" (last error: %v)", s.LastError)
+	}
+	return line
+}
+
+// recorder collects the stats of the workers
+type recorder struct {
+	mu        sync.Mutex
+	total     Stats
+	interval  Stats
+	latencies []time.Duration
+	// samples is a reservoir of the latencies of the whole run
+	samples []time.Duration
+	seen    int
+	started time.Time
+	since   time.Time
+}
+
+func (r *recorder) sent(traces, spans int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range []*Stats{&r.total, &r.interval} {
+		s.Traces += uint64(traces)
+		s.Spans += uint64(spans)
+	}
+}
+
+func (r *recorder) exported(latency time.Duration, rejected int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range []*Stats{&r.total, &r.interval} {
+		s.Requests++
+		s.Rejected += uint64(rejected)
+		if err != nil {
+			s.Failed++
+			s.LastError = err
+		}
+	}
+	r.latencies = append(r.latencies, latency)
+	r.seen++
+	if len(r.samples) < latencySamples {
+		r.samples = append(r.samples, latency)
+	} else if i := rand.IntN(r.seen); i < latencySamples {
+		r.samples[i] = latency
+	}
+}
+
+// flush returns the stats of the interval since the last flush
+func (r *recorder) flush(now time.Time) Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.interval
+	s.Elapsed = now.Sub(r.since)
+	s.P50, s.P99 = percentiles(r.latencies)
+	r.interval, r.latencies, r.since = Stats{}, r.latencies[:0], now
+	return s
+}
+
+func (r *recorder) totals(now time.Time) Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.total
+	s.Elapsed = now.Sub(r.started)
+	s.P50, s.P99 = percentiles(r.samples)
+	return s
+}
+
+func percentiles(latencies []time.Duration) (time.Duration, time.Duration) {
+	if len(latencies) == 0 {
+		return 0, 0
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2], sorted[len(sorted)*99/100]
+}
+
+// Run sends traces at opts.SpanRate until ctx is done and returns the stats of the
+// whole run. report gets the stats of every interval while it runs.
+func Run(ctx context.Context, opts Options, interval time.Duration, report func(Stats)) Stats {
+	now := time.Now()
+	rec := &recorder{started: now, since: now}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: opts.Workers},
+	}
+	batches := make(chan []GeneratedSpan, opts.Workers)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				start := time.Now()
+				rejected, err := export(client, opts.Endpoint, batch)
+				rec.exported(time.Since(start), rejected, err)
+			}
+		}()
+	}
+
+	reporting, stopReporting := context.WithCancel(context.Background())
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-reporting.Done():
+				return
+			case t := <-ticker.C:
+				report(rec.flush(t))
+			}
+		}
+	}()
+
+	produce(ctx, opts, rec, batches)
+	close(batches)
+	// the batches already generated are still exported
+	wg.Wait()
+	stopReporting()
+	<-reported
+	return rec.totals(time.Now())
+}
+
+// produce generates traces into batches, waiting between batches to keep the rate
+func produce(ctx context.Context, opts Options, rec *recorder, batches chan<- []GeneratedSpan) {
+	gen := NewGenerator(opts.Topology, opts.Seed)
+	start := time.Now()
+	sent := 0
+	for {
+		batch := make([]GeneratedSpan, 0, opts.BatchSize)
+		traces := 0
+		for len(batch) < opts.BatchSize {
+			batch = append(batch, gen.Trace(time.Now())...)
+			traces++
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case batches <- batch:
+		}
+		rec.sent(traces, len(batch))
+
+		sent += len(batch)
+		due := start.Add(time.Duration(float64(sent) / float64(opts.SpanRate) * float64(time.Second)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(due)):
+		}
+	}
+}
+
+// export sends a batch and returns the spans the collector rejected
+func export(client *http.Client, endpoint string, batch []GeneratedSpan) (int64, error) {
+	body, err := proto.Marshal(&coltrace.ExportTraceServiceRequest{ResourceSpans: ResourceSpans(batch)})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	var result coltrace.ExportTraceServiceResponse
+	if err := proto.Unmarshal(out, &result); err != nil {
+		return 0, fmt.Errorf("invalid response: %w", err)
+	}
+	return result.GetPartialSuccess().GetRejectedSpans(), nil
+}
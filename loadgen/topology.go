@@ -0,0 +1,185 @@
+// Package loadgen generates synthetic traces of multi-service topologies and exports
+// them as OTLP, to benchmark ingestion and size ClickHouse with realistic data
+package loadgen
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// Operation is an endpoint of a service and the operations it calls, one span per
+// call
+type Operation struct {
+	Service string
+	Name    string
+	Kind    tracepb.Span_SpanKind
+	// Duration is the median time spent in the operation itself, spans vary around it
+	Duration time.Duration
+	// ErrorRate is the fraction of calls failing, a failure fails the callers too
+	ErrorRate  float64
+	Attributes map[string]string
+	// Calls are made one after the other
+	Calls []*Operation
+}
+
+// Topology is the operations traces start from, a trace starts from one of them at
+// random
+type Topology struct {
+	Roots []*Operation
+}
+
+// Services returns the names of the services of the topology
+func (t *Topology) Services() []string {
+	seen := make(map[string]bool)
+	var services []string
+	var walk func(op *Operation)
+	walk = func(op *Operation) {
+		if !seen[op.Service] {
+			seen[op.Service] = true
+			services = append(services, op.Service)
+		}
+		for _, c := range op.Calls {
+			walk(c)
+		}
+	}
+	for _, r := range t.Roots {
+		walk(r)
+	}
+	return services
+}
+
+func server(service, method, route string, d time.Duration, calls ...*Operation) *Operation {
+	return &Operation{
+		Service:    service,
+		Name:       method + " " + route,
+		Kind:       tracepb.Span_SPAN_KIND_SERVER,
+		Duration:   d,
+		ErrorRate:  0.002,
+		Attributes: map[string]string{"http.method": method, "http.route": route},
+		Calls:      calls,
+	}
+}
+
+func rpc(service, method string, d time.Duration, calls ...*Operation) *Operation {
+	return &Operation{
+		Service:    service,
+		Name:       method,
+		Kind:       tracepb.Span_SPAN_KIND_SERVER,
+		Duration:   d,
+		ErrorRate:  0.005,
+		Attributes: map[string]string{"rpc.system": "grpc", "rpc.method": method},
+		Calls:      calls,
+	}
+}
+
+func query(service, system, statement string, d time.Duration) *Operation {
+	return &Operation{
+		Service:    service,
+		Name:       system + " " + statement,
+		Kind:       tracepb.Span_SPAN_KIND_CLIENT,
+		Duration:   d,
+		ErrorRate:  0.001,
+		Attributes: map[string]string{"db.system": system, "db.statement": statement},
+	}
+}
+
+func producer(service, topic string, d time.Duration) *Operation {
+	return &Operation{
+		Service:    service,
+		Name:       topic + " publish",
+		Kind:       tracepb.Span_SPAN_KIND_PRODUCER,
+		Duration:   d,
+		Attributes: map[string]string{"messaging.system": "kafka", "messaging.destination": topic},
+	}
+}
+
+// ShopTopology is an online shop: a frontend and the catalog, cart, checkout,
+// payment, shipping, currency and email services behind it with their databases
+func ShopTopology() *Topology {
+	ms := time.Millisecond
+	currency := rpc("currency", "Convert", 2*ms)
+	products := func() *Operation {
+		return rpc("product-catalog", "GetProduct", 3*ms, query("product-catalog", "postgresql", "SELECT products", 4*ms))
+	}
+	cart := func() *Operation {
+		return rpc("cart", "GetCart", 2*ms, query("cart", "redis", "HGETALL", ms))
+	}
+	return &Topology{Roots: []*Operation{
+		server("frontend", "GET", "/", 5*ms,
+			rpc("product-catalog", "ListProducts", 5*ms, query("product-catalog", "postgresql", "SELECT products", 8*ms)),
+			currency,
+			rpc("ad", "GetAds", 3*ms),
+		),
+		server("frontend", "GET", "/product/{id}", 4*ms,
+			products(),
+			currency,
+			rpc("recommendation", "ListRecommendations", 12*ms, rpc("product-catalog", "ListProducts", 5*ms, query("product-catalog", "postgresql", "SELECT products", 8*ms))),
+			cart(),
+		),
+		server("frontend", "POST", "/cart", 3*ms,
+			products(),
+			rpc("cart", "AddItem", 2*ms, query("cart", "redis", "HSET", ms)),
+		),
+		server("frontend", "POST", "/checkout", 6*ms,
+			rpc("checkout", "PlaceOrder", 8*ms,
+				cart(),
+				products(),
+				currency,
+				rpc("shipping", "GetQuote", 4*ms),
+				&Operation{
+					Service:    "payment",
+					Name:       "Charge",
+					Kind:       tracepb.Span_SPAN_KIND_SERVER,
+					Duration:   45 * ms,
+					ErrorRate:  0.02,
+					Attributes: map[string]string{"rpc.system": "grpc", "rpc.method": "Charge"},
+				},
+				rpc("shipping", "ShipOrder", 6*ms, query("shipping", "postgresql", "INSERT shipments", 5*ms)),
+				query("checkout", "postgresql", "INSERT orders", 6*ms),
+				producer("checkout", "orders", ms),
+				rpc("email", "SendOrderConfirmation", 20*ms),
+			),
+		),
+	}}
+}
+
+// RandomTopology is services services calling each other in layers, for sizing with
+// more services, endpoints and attributes than ShopTopology has. The same seed gives
+// the same topology, services must be at least 1.
+func RandomTopology(services int, seed uint64) *Topology {
+	rnd := rand.New(rand.NewPCG(seed, seed))
+	// layers of services call the layers below, the last one is databases
+	layers := make([][]string, min(services, 4))
+	for i := 0; i < services; i++ {
+		layer := i * len(layers) / services
+		layers[layer] = append(layers[layer], fmt.Sprintf("service-%03d", i+1))
+	}
+
+	var operation func(layer int, service string) *Operation
+	operation = func(layer int, service string) *Operation {
+		d := time.Duration(1+rnd.IntN(20)) * time.Millisecond
+		op := rpc(service, fmt.Sprintf("Op%d", 1+rnd.IntN(5)), d)
+		if layer == 0 {
+			op = server(service, "GET", fmt.Sprintf("/api/v1/resource%d", 1+rnd.IntN(10)), d)
+		}
+		if layer == len(layers)-1 {
+			op.Calls = append(op.Calls, query(service, "postgresql", fmt.Sprintf("SELECT table%d", 1+rnd.IntN(10)), d))
+			return op
+		}
+		next := layers[layer+1]
+		for i := rnd.IntN(4); i >= 0; i-- {
+			op.Calls = append(op.Calls, operation(layer+1, next[rnd.IntN(len(next))]))
+		}
+		return op
+	}
+	t := &Topology{}
+	for _, service := range layers[0] {
+		for i := 0; i < 3; i++ {
+			t.Roots = append(t.Roots, operation(0, service))
+		}
+	}
+	return t
+}
@@ -1,13 +1,48 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"nabatshy/alerts"
+	"nabatshy/annotations"
+	"nabatshy/anomaly"
 	"nabatshy/api"
+	"nabatshy/auth"
+	"nabatshy/bookmarks"
+	"nabatshy/catalog"
 	"nabatshy/collector"
+	"nabatshy/config"
 	"nabatshy/db"
+	"nabatshy/debugserver"
+	"nabatshy/health"
+	"nabatshy/metrics"
+	"nabatshy/notify"
+	"nabatshy/projects"
+	"nabatshy/provision"
+	"nabatshy/reports"
+	"nabatshy/searches"
+	"nabatshy/selfmonitor"
+	"nabatshy/selftrace"
+	"nabatshy/servertls"
+	"nabatshy/slo"
+	"nabatshy/statsd"
+	"nabatshy/supervisor"
 	"nabatshy/utils"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/go-chi/chi/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 //go:embed ui/dist/*
@@ -15,18 +50,456 @@ var content embed.FS
 
 const uiDir = "ui/dist"
 
+const usage = `usage: nabatshy <command> [flags] [args]
+
+commands:
+  serve     run the collector, API and UI, the default when no command is given
+  migrate   run the ClickHouse migrations, then exit
+  query     search spans and read traces, spans and services through the API
+  ingest    send OTLP trace files to the collector
+  loadgen   send synthetic traces to the collector at a fixed rate, for benchmarking
+  seed-demo store a few hours of sample traces in ClickHouse to explore the UI with
+
+Run nabatshy <command> -h for the flags of a command.
+`
+
 func main() {
-	if os.Getenv("ENV") != "production" {
-		envPath := ".env"
-		utils.LoadEnv(envPath)
-	}
-
-	databaseAddr := os.Getenv("CLICKHOUSE_ADDR")
-	databaseDB := os.Getenv("CLICKHOUSE_DB")
-	databaseUsername := os.Getenv("CLICKHOUSE_USERNAME")
-	databasePassword := os.Getenv("CLICKHOUSE_PASSWORD")
-	conn := db.InitClickHouse(databaseAddr, databaseDB, databaseUsername, databasePassword)
-	go func() { collector.Run(conn) }()
-	go utils.ServeUI(content, uiDir)
-	api.Run(conn)
+	command, args := "serve", os.Args[1:]
+	// flags without a command are those of serve, as before there were commands
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		serve(args)
+	case "migrate":
+		migrate(args)
+	case "query":
+		query(args)
+	case "ingest":
+		ingest(args)
+	case "loadgen":
+		generateLoad(args)
+	case "seed-demo":
+		seedDemo(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// serve runs every component until SIGINT or SIGTERM
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	validate := fs.Bool("validate-config", false, "check the config, ClickHouse connectivity and schema version, then exit")
+	printConfig := fs.Bool("print-config", false, "print the config with secrets redacted, then exit")
+	printOpenAPI := fs.Bool("print-openapi", false, "print the OpenAPI document of the API, then exit")
+	runMigrations := fs.Bool("migrate", true, "run the ClickHouse migrations before serving, -migrate=false when nabatshy migrate runs them")
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *printOpenAPI {
+		if err := writeOpenAPI(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	tlsConfig, err := servertls.Config(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile, cfg.Server.TLS.AutocertHosts, cfg.Server.TLS.AutocertCacheDir)
+	if err != nil && !*validate {
+		log.Fatal(err)
+	}
+	collectorTLS := tlsConfig
+	if caFile := cfg.Server.TLS.ClientCAFile; caFile != "" && !*validate {
+		// with a single port the API and UI share the listener, so a missing client
+		// certificate is only rejected under /otlp
+		if collectorTLS, err = servertls.WithClientCAs(tlsConfig, caFile, cfg.Server.SinglePortAddr == ""); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cluster := db.Cluster{Name: cfg.ClickHouse.Cluster}
+	balancing, err := db.ParseBalancing(cfg.ClickHouse.Balancing)
+	if err != nil && !*validate {
+		log.Fatal(err)
+	}
+	conn := metrics.InstrumentConn(db.InitClickHouse(cfg.ClickHouse.Addr, cfg.ClickHouse.Database, cfg.ClickHouse.Username, cfg.ClickHouse.Password, balancing, cluster))
+	var tracer *selftrace.Tracer
+	if endpoint := selftrace.ParseEndpoint(cfg.SelfTrace.Endpoint, localCollectorURL(cfg.Server)); endpoint != "" && !*validate {
+		rate, err := selftrace.ParseRate(cfg.SelfTrace.Rate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		service := cfg.SelfTrace.Service
+		if service == "" {
+			service = selftrace.DefaultServiceName
+		}
+		tracer = selftrace.NewTracer(endpoint, service, rate)
+		conn = selftrace.InstrumentConn(conn)
+	}
+
+	promoted, err := promotedAttributes(cfg)
+	if err != nil && !*validate {
+		log.Fatal(err)
+	}
+	jsonAttributes, err := utils.ParseAttributeStorage(cfg.Attributes.Storage)
+	if err != nil && !*validate {
+		log.Fatal(err)
+	}
+
+	if *validate {
+		os.Exit(validateConfig(cfg, conn))
+	}
+
+	goquDB := goqu.Dialect("default")
+	// stop the servers and loops gracefully on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runMigrations {
+		if err := runMigrate(ctx, conn, cluster, promoted); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ingestTracker := collector.NewIngestTracker(10000)
+	tapRate, err := collector.ParseTapRate(cfg.Ingest.TapRate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var wal *collector.WAL
+	if walDir := collector.ParseWALDir(cfg.Ingest.WALDir); walDir != "" {
+		walMaxBytes, err := collector.ParseWALMaxBytes(cfg.Ingest.WALMaxBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if wal, err = collector.OpenWAL(walDir, walMaxBytes); err != nil {
+			log.Fatal(err)
+		}
+	}
+	maxSpansPerTrace, err := collector.ParseMaxSpansPerTrace(cfg.Ingest.MaxSpansPerTrace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	traceLimiter := collector.NewTraceLimiter(maxSpansPerTrace, collector.DefaultTraceLimiterCapacity)
+	samplingRules, err := collector.ParseSamplingRules(cfg.Ingest.SamplingRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sampler := collector.NewSampler(samplingRules, collector.DefaultSamplerCapacity)
+	drainer := collector.NewDrainer(wal)
+	var ingestTap *collector.IngestTap
+	if tapRate > 0 {
+		ingestTap = collector.NewIngestTap(tapRate, collector.DefaultTapCapacity)
+	}
+
+	sup := supervisor.New(ctx)
+	// the collector comes first so spans are accepted as early as possible, the API
+	// last so it only reports ready once everything else runs
+	singlePort := cfg.Server.SinglePortAddr != ""
+	insertMode, err := collector.ParseInsertMode(cfg.Ingest.InsertMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	validation, err := collector.ParseValidation(cfg.Ingest.MaxSpanAge, cfg.Ingest.MaxClockSkew, cfg.Ingest.MaxNameLength)
+	if err != nil {
+		log.Fatal(err)
+	}
+	collectorHandler := collector.NewHandler(conn, collector.Options{
+		Promoted:       promoted,
+		JSONAttributes: jsonAttributes,
+		Tracker:        ingestTracker,
+		Tap:            ingestTap,
+		WAL:            wal,
+		Limiter:        traceLimiter,
+		Sampler:        sampler,
+		Drainer:        drainer,
+		Checks:         []health.Check{sup.Check()},
+		InsertMode:     insertMode,
+		Validation:     validation,
+	})
+	var components []supervisor.Component
+	if !singlePort {
+		components = append(components, supervisor.HTTPServer("collector", cfg.Server.CollectorAddr, collectorHandler, collectorTLS))
+	}
+	if wal != nil {
+		components = append(components, supervisor.Loop("wal", wal.Run))
+	}
+	components = append(components, supervisor.Loop("drain", drainer.Run))
+	monitor := selfmonitor.New(conn, wal, drainer, selfmonitor.DefaultRetention)
+	components = append(components, supervisor.Loop("selfmonitor", monitor.Run))
+	if tracer != nil {
+		components = append(components, supervisor.Loop("selftrace", tracer.Run))
+	}
+
+	catalogService := &catalog.CatalogService{Ch: &conn, Cluster: cluster}
+	idleAfter, err := catalog.ParseIdleAfter(cfg.Catalog.IdleAfter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if idleAfter > 0 {
+		components = append(components, supervisor.Loop("retirement", catalog.NewRetirementDetector(catalogService, idleAfter).Run))
+	}
+	// spans of a bookmarked trace that arrive after the bookmark are pinned too
+	components = append(components, supervisor.Loop("repin", bookmarks.NewRepinner(&bookmarks.BookmarkService{Ch: &conn, Cluster: cluster}).Run))
+	projectService := &projects.ProjectService{Ch: &conn}
+	channelService := &notify.ChannelService{Ch: &conn}
+	dispatcher := notify.NewDispatcher(channelService, cfg.Server.UIURL, notify.SMTPConfig{
+		Addr:     cfg.SMTP.Addr,
+		Username: cfg.SMTP.Username,
+		Password: cfg.SMTP.Password,
+		From:     cfg.SMTP.From,
+	})
+	searchService := &searches.SearchService{Ch: &conn}
+	alertService := &alerts.AlertService{
+		Ch:       &conn,
+		DB:       &goquDB,
+		Catalog:  catalogService,
+		Notifier: dispatcher,
+		Searches: searchService,
+		// search rules use the search of the API, including its attribute storage
+		SearchCounter: &api.TelemetryService{Ch: &conn, DB: &goquDB, Promoted: promoted, JSONAttributes: jsonAttributes},
+	}
+	reportService := &reports.ReportService{Ch: &conn, DB: &goquDB, Sender: dispatcher}
+	anomalyService := &anomaly.AnomalyService{Ch: &conn, DB: &goquDB}
+	sloService := &slo.SLOService{Ch: &conn, DB: &goquDB}
+	sloEvaluator := slo.NewEvaluator(sloService, time.Minute)
+	components = append(components,
+		supervisor.Loop("alerts", alerts.NewEvaluator(alertService, time.Minute).Run),
+		supervisor.Loop("reports", reports.NewScheduler(reportService).Run),
+		supervisor.Loop("anomaly", anomaly.NewAnalyzer(anomalyService, 5*time.Minute).Run),
+		supervisor.Loop("slo", sloEvaluator.Run),
+	)
+	precomputedEdges, err := api.ParseServiceEdges(cfg.Dependencies.Edges)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if precomputedEdges {
+		edges := api.NewEdgeAggregator(&api.TelemetryService{Ch: &conn, DB: &goquDB})
+		components = append(components, supervisor.Loop("edges", edges.Run))
+	}
+	completionWindow, err := api.ParseCompletionWindow(cfg.Traces.CompletionWindow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if completionWindow > 0 {
+		checker := api.NewCompletenessChecker(&api.TelemetryService{Ch: &conn, DB: &goquDB}, completionWindow)
+		components = append(components, supervisor.Loop("completeness", checker.Run))
+	}
+
+	if addr := cfg.StatsD.Addr; addr != "" {
+		flavor, err := statsd.ParseFlavor(cfg.StatsD.Flavor)
+		if err != nil {
+			log.Fatal(err)
+		}
+		interval, err := statsd.ParseInterval(cfg.StatsD.Interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prefix := cfg.StatsD.Prefix
+		if prefix == "" {
+			prefix = statsd.DefaultPrefix
+		}
+		exporter := &statsd.Exporter{Ch: &conn, DB: &goquDB, Addr: addr, Flavor: flavor, Prefix: prefix, Interval: interval}
+		components = append(components, supervisor.Loop("statsd", exporter.Run))
+	}
+
+	var uiHandler http.Handler
+	if singlePort {
+		uiHandler = utils.UIHandler(content, uiDir, "/api")
+	} else {
+		uiHandler = utils.UIHandler(content, uiDir, "")
+		components = append(components, supervisor.HTTPServer("ui", cfg.Server.UIAddr, uiHandler, tlsConfig))
+	}
+	// the debug server is meant for localhost and stays plain HTTP
+	if addr := cfg.Server.DebugAddr; addr != "" {
+		components = append(components, supervisor.HTTPServer("debug", addr, debugserver.NewRouter(), nil))
+	}
+
+	provisioner := provision.NewProvisionService(
+		&provision.RetentionProvider{Ch: &conn, Cluster: cluster},
+		alerts.NewProvider(alertService),
+		slo.NewProvider(sloService),
+		searches.NewProvider(searchService),
+	)
+	annotationService := annotations.AnnotationService{Ch: &conn, DB: &goquDB}
+	var authenticator *auth.Authenticator
+	if cfg.Auth.OIDCIssuer != "" {
+		if authenticator, err = newAuthenticator(ctx, cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	timeouts, err := utils.ParseQueryTimeouts(cfg.Server.QueryTimeout, cfg.Server.QueryTimeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shares, err := auth.NewShareSigner(cfg.Auth.SessionSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiOptions := api.Options{
+		Promoted:           promoted,
+		SourceLinkTemplate: cfg.Attributes.SourceLinkTemplate,
+		Catalog:            catalogService,
+		JSONAttributes:     jsonAttributes,
+		Projects:           projectService,
+		Tracer:             tracer,
+		Checks:             []health.Check{sup.Check()},
+		Auth:               authenticator,
+		Timeouts:           timeouts,
+		PrecomputedEdges:   precomputedEdges,
+		Shares:             shares,
+	}
+	apiHandler := api.NewHandler(conn, apiOptions,
+		apiControllers(apiServices{
+			conn:          conn,
+			cluster:       cluster,
+			goquDB:        goquDB,
+			jsonAttrs:     jsonAttributes,
+			catalog:       catalogService,
+			projects:      projectService,
+			searches:      searchService,
+			ingestTracker: ingestTracker,
+			ingestTap:     ingestTap,
+			traceLimiter:  traceLimiter,
+			sampler:       sampler,
+			drainer:       drainer,
+			monitor:       monitor,
+			provisioner:   provisioner,
+			alerts:        alertService,
+			slos:          sloService,
+			sloEvaluator:  sloEvaluator,
+			channels:      channelService,
+			dispatcher:    dispatcher,
+			anomalies:     anomalyService,
+			reports:       reportService,
+			annotations:   annotationService,
+			webhooks:      cfg.Webhooks,
+			authenticator: authenticator,
+		})...,
+	)
+	if addr := cfg.Server.GRPCAddr; addr != "" {
+		var serverOpts []grpc.ServerOption
+		if tlsConfig != nil {
+			serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer := api.NewGRPCServer(conn, apiOptions, serverOpts...)
+		components = append(components, supervisor.GRPCServer("grpc", addr, grpcServer, tlsConfig != nil))
+	}
+	if singlePort {
+		if cfg.Server.TLS.ClientCAFile != "" {
+			collectorHandler = servertls.RequireClientCert(collectorHandler)
+		}
+		components = append(components, supervisor.HTTPServer("server", cfg.Server.SinglePortAddr,
+			singlePortHandler(apiHandler, collectorHandler, uiHandler), collectorTLS))
+	} else {
+		components = append(components, supervisor.HTTPServer("api", cfg.Server.APIAddr, apiHandler, tlsConfig))
+	}
+
+	for _, c := range components {
+		// a component that can't start stops the ones already running
+		if err := sup.Add(c); err != nil {
+			break
+		}
+	}
+	err = sup.Wait()
+	// the collector has drained its requests, nothing appends to the WAL anymore
+	if wal != nil {
+		if err := wal.Close(); err != nil {
+			log.Printf("failed to close wal: %v\n", err)
+		}
+	}
+	// nor inserts into ClickHouse, whose async insert buffer can be flushed
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := collector.FlushAsyncInserts(flushCtx, conn, cluster, insertMode); err != nil {
+		log.Printf("failed to flush async inserts: %v\n", err)
+	}
+	cancel()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("stopped")
+}
+
+// promotedAttributes are the attributes stored in their own column
+func promotedAttributes(cfg *config.Config) ([]utils.PromotedAttribute, error) {
+	keys := cfg.Attributes.Promoted
+	if keys == "" {
+		keys = utils.DefaultPromotedAttributes
+	}
+	return utils.ParsePromotedAttributes(keys)
+}
+
+// newAuthenticator discovers the OIDC provider users log in with
+func newAuthenticator(ctx context.Context, cfg *config.Config) (*auth.Authenticator, error) {
+	if err := validateAuth(cfg.Auth); err != nil {
+		return nil, err
+	}
+	ttl, err := auth.ParseSessionTTL(cfg.Auth.SessionTTL)
+	if err != nil {
+		return nil, err
+	}
+	var policy *auth.Policy
+	if cfg.Auth.Roles != "" || cfg.Auth.ServiceRoles != "" {
+		bindings, err := auth.ParseRoleBindings(cfg.Auth.Roles)
+		if err != nil {
+			return nil, err
+		}
+		defaultRole, err := auth.ParseRole(cfg.Auth.DefaultRole)
+		if err != nil {
+			return nil, err
+		}
+		// service roles alone only hide services from the roles set as default
+		if len(bindings) == 0 && cfg.Auth.DefaultRole == "" {
+			defaultRole = auth.RoleAdmin
+		}
+		serviceRoles, err := auth.ParseServiceRoles(cfg.Auth.ServiceRoles)
+		if err != nil {
+			return nil, err
+		}
+		policy = auth.NewPolicy(bindings, defaultRole, serviceRoles)
+	}
+	provider, err := auth.Discover(ctx, cfg.Auth.OIDCIssuer, cfg.Auth.OIDCClientID, cfg.Auth.OIDCClientSecret, cfg.Auth.OIDCRedirectURL)
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewAuthenticator(provider, policy, cfg.Auth.SessionSecret, ttl, cfg.Server.UIURL)
+}
+
+// singlePortHandler serves the API under /api, the collector under /otlp, so OTLP
+// exporters use http://host/otlp as their endpoint, and the UI under /
+func singlePortHandler(api, collector, ui http.Handler) http.Handler {
+	r := chi.NewRouter()
+	r.Mount("/api", api)
+	r.Mount("/otlp", collector)
+	r.Mount("/", ui)
+	return r
+}
+
+// localCollectorURL is the base URL of this process's collector
+func localCollectorURL(server config.Server) string {
+	scheme := "http://"
+	if server.TLS.CertFile != "" || server.TLS.AutocertHosts != "" {
+		scheme = "https://"
+	}
+	if server.SinglePortAddr != "" {
+		return scheme + localAddr(server.SinglePortAddr) + "/otlp"
+	}
+	return scheme + localAddr(server.CollectorAddr)
+}
+
+// localAddr turns a listen address like ":4318" into one to connect to
+func localAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "localhost" + addr
+	}
+	return addr
 }
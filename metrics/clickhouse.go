@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// instrumentedConn records the duration and errors of the queries run through it
+type instrumentedConn struct {
+	driver.Conn
+}
+
+// InstrumentConn wraps conn so every query, statement and batch is measured
+func InstrumentConn(conn clickhouse.Conn) clickhouse.Conn {
+	return &instrumentedConn{Conn: conn}
+}
+
+// observe records a finished operation, cancelled requests aren't ClickHouse errors
+func observe(op string, start time.Time, err error) {
+	ClickHouseQueryDuration.Observe(time.Since(start).Seconds(), op)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		ClickHouseErrors.Inc(op)
+	}
+}
+
+// Unwrap returns the wrapped connection, for what needs to reach its replicas
+func (c *instrumentedConn) Unwrap() driver.Conn {
+	return c.Conn
+}
+
+func (c *instrumentedConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.Conn.Query(ctx, query, args...)
+	observe("query", start, err)
+	return rows, err
+}
+
+func (c *instrumentedConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	return &instrumentedRow{Row: c.Conn.QueryRow(ctx, query, args...), start: time.Now()}
+}
+
+func (c *instrumentedConn) Exec(ctx context.Context, query string, args ...any) error {
+	start := time.Now()
+	err := c.Conn.Exec(ctx, query, args...)
+	observe("exec", start, err)
+	return err
+}
+
+func (c *instrumentedConn) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	batch, err := c.Conn.PrepareBatch(ctx, query, opts...)
+	if err != nil {
+		ClickHouseErrors.Inc("batch")
+		return nil, err
+	}
+	return &instrumentedBatch{Batch: batch}, nil
+}
+
+// instrumentedRow records when the row is scanned, that's when QueryRow errors surface
+type instrumentedRow struct {
+	driver.Row
+	start time.Time
+}
+
+func (r *instrumentedRow) Scan(dest ...any) error {
+	err := r.Row.Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		observe("query", r.start, nil)
+	} else {
+		observe("query", r.start, err)
+	}
+	return err
+}
+
+type instrumentedBatch struct {
+	driver.Batch
+}
+
+func (b *instrumentedBatch) Send() error {
+	start := time.Now()
+	err := b.Batch.Send()
+	observe("batch", start, err)
+	return err
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware records the duration of every request of a chi router. Requests are
+// labelled with the route pattern, so IDs in paths don't create new series.
+func Middleware(server string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			HTTPRequestDuration.Observe(time.Since(start).Seconds(), server, route, r.Method, strconv.Itoa(rec.status))
+		})
+	}
+}
+
+// MetricsController serves the Default registry
+type MetricsController struct{}
+
+func NewMetricsController() *MetricsController {
+	return &MetricsController{}
+}
+
+func (c *MetricsController) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	Default.Write(w)
+}
+
+func (c *MetricsController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/metrics", Summary: "Metrics in the Prometheus text format", ContentType: "text/plain"},
+	}
+}
+
+func (c *MetricsController) RegisterRoutes(r chi.Router) {
+	r.Get("/metrics", c.getMetrics)
+}
@@ -0,0 +1,28 @@
+package metrics
+
+// Collector metrics
+var (
+	SpansIngested = NewCounter("nabatshy_spans_ingested_total",
+		"Spans received by the collector by outcome: committed, failed or buffered to the WAL, buffered spans later replayed, spans dropped by sampling or the spans per trace limit, and spans rejected by the validation.", "outcome")
+	SpansRejected = NewCounter("nabatshy_spans_rejected_total",
+		"Spans rejected by the ingest validation by reason: invalid_trace_id, invalid_span_id, end_before_start, too_old, in_future or name_too_long.", "reason")
+	IngestBatchSize = NewHistogram("nabatshy_ingest_batch_spans",
+		"Spans per insert batch.", []float64{1, 10, 50, 100, 500, 1000, 5000, 10000})
+	InsertDuration = NewHistogram("nabatshy_insert_duration_seconds",
+		"Time taken to insert a batch of spans into ClickHouse.", DefaultBuckets)
+	SpansInserted = NewCounter("nabatshy_spans_inserted_total",
+		"Spans written to ClickHouse by write: sync batches, async inserts acknowledged once flushed, fire_and_forget async inserts, and sync batches after an async insert failed.", "write")
+)
+
+// HTTP metrics of the API and collector servers
+var HTTPRequestDuration = NewHistogram("nabatshy_http_request_duration_seconds",
+	"HTTP request durations by server, route pattern, method and status code.", DefaultBuckets,
+	"server", "route", "method", "code")
+
+// ClickHouse metrics, recorded by InstrumentConn
+var (
+	ClickHouseQueryDuration = NewHistogram("nabatshy_clickhouse_query_duration_seconds",
+		"Time until ClickHouse answered a query or statement.", DefaultBuckets, "op")
+	ClickHouseErrors = NewCounter("nabatshy_clickhouse_errors_total",
+		"Failed ClickHouse queries, statements and batch inserts.", "op")
+)
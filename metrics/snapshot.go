@@ -0,0 +1,105 @@
+package metrics
+
+import "strings"
+
+// matches reports whether the series of key has the label values in match. The
+// lock must be held.
+func (f *family) matches(key string, match map[string]string) bool {
+	if len(match) == 0 {
+		return true
+	}
+	values := strings.Split(key, "\xff")
+	for i, label := range f.labels {
+		if want, ok := match[label]; ok && values[i] != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Sum returns the total of the series with the label values in match, every series
+// when match is empty
+func (c *Counter) Sum(match map[string]string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum float64
+	for key, s := range c.series {
+		if c.matches(key, match) {
+			sum += s.(*counterSeries).value
+		}
+	}
+	return sum
+}
+
+// HistogramSnapshot is the state of a histogram at one point, or the observations
+// between two points when subtracted
+type HistogramSnapshot struct {
+	Buckets []float64
+	// Counts are cumulative like the le buckets of the exposition format
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+// Snapshot merges the series with the label values in match, every series when
+// match is empty
+func (h *Histogram) Snapshot(match map[string]string) HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snap := HistogramSnapshot{Buckets: h.buckets, Counts: make([]uint64, len(h.buckets))}
+	for key, s := range h.series {
+		if !h.matches(key, match) {
+			continue
+		}
+		hs := s.(*histogramSeries)
+		for i, c := range hs.counts {
+			snap.Counts[i] += c
+		}
+		snap.Sum += hs.sum
+		snap.Count += hs.count
+	}
+	return snap
+}
+
+// Sub returns the observations made since prev
+func (s HistogramSnapshot) Sub(prev HistogramSnapshot) HistogramSnapshot {
+	diff := HistogramSnapshot{Buckets: s.Buckets, Counts: make([]uint64, len(s.Counts)), Sum: s.Sum - prev.Sum, Count: s.Count - prev.Count}
+	for i := range s.Counts {
+		diff.Counts[i] = s.Counts[i]
+		if i < len(prev.Counts) {
+			diff.Counts[i] -= prev.Counts[i]
+		}
+	}
+	return diff
+}
+
+// Mean returns the average observation, 0 without any
+func (s HistogramSnapshot) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+// Quantile estimates the q quantile by linear interpolation within its bucket, like
+// Prometheus' histogram_quantile. Observations above the last bucket are reported
+// as the last bucket's bound.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 || len(s.Buckets) == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	var lower float64
+	var below uint64
+	for i, upper := range s.Buckets {
+		if float64(s.Counts[i]) >= rank {
+			inBucket := s.Counts[i] - below
+			if inBucket == 0 {
+				return upper
+			}
+			return lower + (upper-lower)*(rank-float64(below))/float64(inBucket)
+		}
+		lower, below = upper, s.Counts[i]
+	}
+	return s.Buckets[len(s.Buckets)-1]
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"nabatshy/config"
+	"nabatshy/db"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// migrate runs the ClickHouse migrations and promotes the configured attributes, so
+// deployments can migrate once before starting servers with -migrate=false
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	balancing, err := db.ParseBalancing(cfg.ClickHouse.Balancing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	promoted, err := promotedAttributes(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cluster := db.Cluster{Name: cfg.ClickHouse.Cluster}
+	conn := db.InitClickHouse(cfg.ClickHouse.Addr, cfg.ClickHouse.Database, cfg.ClickHouse.Username, cfg.ClickHouse.Password, balancing, cluster)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := runMigrate(ctx, conn, cluster, promoted); err != nil {
+		log.Fatal(err)
+	}
+	version, err := db.SchemaVersion(ctx, conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("schema is at version %d\n", version)
+}
+
+func runMigrate(ctx context.Context, conn clickhouse.Conn, cluster db.Cluster, promoted []utils.PromotedAttribute) error {
+	if err := db.Migrate(ctx, conn, cluster); err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	if err := db.PromoteAttributes(ctx, conn, promoted, cluster); err != nil {
+		return fmt.Errorf("attribute promotion failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type NotifyController struct {
+	service    *ChannelService
+	dispatcher *Dispatcher
+}
+
+func NewNotifyController(service *ChannelService, dispatcher *Dispatcher) *NotifyController {
+	return &NotifyController{service: service, dispatcher: dispatcher}
+}
+
+func (c *NotifyController) listChannels(w http.ResponseWriter, r *http.Request) {
+	channels, err := c.service.ListChannels(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list channels: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channels)
+}
+
+// findChannel writes the error response and returns false when the channel can't be loaded
+func (c *NotifyController) findChannel(w http.ResponseWriter, r *http.Request) (Channel, bool) {
+	channel, found, err := c.service.GetChannel(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get channel: %v", err), http.StatusInternalServerError)
+		return channel, false
+	}
+	if !found {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return channel, false
+	}
+	return channel, true
+}
+
+func (c *NotifyController) getChannel(w http.ResponseWriter, r *http.Request) {
+	channel, ok := c.findChannel(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channel)
+}
+
+func (c *NotifyController) createChannel(w http.ResponseWriter, r *http.Request) {
+	var channel Channel
+	if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+		http.Error(w, "invalid channel: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	channel.ID = ""
+	if err := channel.Validate(); err != nil {
+		http.Error(w, "invalid channel: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveChannel(r.Context(), &channel); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create channel: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(channel)
+}
+
+func (c *NotifyController) updateChannel(w http.ResponseWriter, r *http.Request) {
+	existing, ok := c.findChannel(w, r)
+	if !ok {
+		return
+	}
+
+	var channel Channel
+	if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+		http.Error(w, "invalid channel: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	channel.ID = existing.ID
+	if err := channel.Validate(); err != nil {
+		http.Error(w, "invalid channel: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveChannel(r.Context(), &channel); err != nil {
+		http.Error(w, fmt.Sprintf("failed to update channel: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channel)
+}
+
+func (c *NotifyController) deleteChannel(w http.ResponseWriter, r *http.Request) {
+	if err := c.service.DeleteChannel(r.Context(), chi.URLParam(r, "id")); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete channel: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *NotifyController) testChannel(w http.ResponseWriter, r *http.Request) {
+	channel, ok := c.findChannel(w, r)
+	if !ok {
+		return
+	}
+
+	if err := c.dispatcher.Test(r.Context(), channel); err != nil {
+		http.Error(w, fmt.Sprintf("test notification failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *NotifyController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/notifications/channels", Summary: "Notification channels", Response: []Channel{}},
+		{Method: http.MethodPost, Path: "/v1/notifications/channels", Summary: "Create a notification channel", Request: Channel{}, Response: Channel{}, Status: http.StatusCreated},
+		{Method: http.MethodGet, Path: "/v1/notifications/channels/{id}", Summary: "A notification channel", Response: Channel{}},
+		{Method: http.MethodPut, Path: "/v1/notifications/channels/{id}", Summary: "Update a notification channel", Request: Channel{}, Response: Channel{}},
+		{Method: http.MethodDelete, Path: "/v1/notifications/channels/{id}", Summary: "Delete a notification channel", Status: http.StatusNoContent},
+		{Method: http.MethodPost, Path: "/v1/notifications/channels/{id}/test", Summary: "Send a test notification, 502 when it fails", Status: http.StatusNoContent},
+	}
+}
+
+func (c *NotifyController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/notifications/channels", c.listChannels)
+	r.Post("/v1/notifications/channels", c.createChannel)
+	r.Get("/v1/notifications/channels/{id}", c.getChannel)
+	r.Put("/v1/notifications/channels/{id}", c.updateChannel)
+	r.Delete("/v1/notifications/channels/{id}", c.deleteChannel)
+	r.Post("/v1/notifications/channels/{id}/test", c.testChannel)
+}
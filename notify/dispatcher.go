@@ -0,0 +1,208 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"nabatshy/alerts"
+	"nabatshy/utils"
+)
+
+// DefaultTemplate renders the text of notifications for channels without a template
+const DefaultTemplate = `{{.Event.Message}}
+Traces: {{.SearchURL}}{{if .Event.DashboardURL}}
+Dashboard: {{.Event.DashboardURL}}{{end}}`
+
+// Notification is what templates render and webhook channels receive
+type Notification struct {
+	Rule  alerts.Rule  `json:"rule"`
+	Event alerts.Event `json:"event"`
+	// SearchURL opens the spans the rule looked at in the UI
+	SearchURL string `json:"search_url"`
+	Text      string `json:"text"`
+}
+
+// Dispatcher delivers alert events to the channels of their rule, retrying
+// failed deliveries with exponential backoff
+type Dispatcher struct {
+	channels *ChannelService
+	client   *http.Client
+	uiURL    string
+	smtp     SMTPConfig
+
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func NewDispatcher(channels *ChannelService, uiURL string, smtp SMTPConfig) *Dispatcher {
+	return &Dispatcher{
+		channels:    channels,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		uiURL:       strings.TrimSuffix(uiURL, "/"),
+		smtp:        smtp,
+		maxAttempts: 5,
+		backoff:     2 * time.Second,
+	}
+}
+
+// Notify sends the event to every channel of the rule in the background, channels
+// are referenced by ID or name
+func (d *Dispatcher) Notify(ctx context.Context, rule alerts.Rule, event alerts.Event) {
+	if len(rule.Channels) == 0 {
+		return
+	}
+	channels, err := d.channels.ListChannels(ctx)
+	if err != nil {
+		log.Printf("notify: failed to list channels: %v\n", err)
+		return
+	}
+
+	for _, ref := range rule.Channels {
+		channel, ok := findChannel(channels, ref)
+		if !ok {
+			log.Printf("notify: rule %s references unknown channel %q\n", rule.Name, ref)
+			continue
+		}
+		n, err := d.render(channel, rule, event)
+		if err != nil {
+			log.Printf("notify: failed to render notification for channel %s: %v\n", channel.Name, err)
+			continue
+		}
+		go d.deliver(ctx, channel, n)
+	}
+}
+
+// Test sends a sample notification to the channel once
+func (d *Dispatcher) Test(ctx context.Context, channel Channel) error {
+	rule := alerts.Rule{ID: "test", Name: "Test notification", Scope: alerts.ScopeService, Service: "nabatshy", Window: "5m"}
+	event := alerts.Event{
+		RuleID:   rule.ID,
+		RuleName: rule.Name,
+		State:    alerts.StateFiring,
+		Message:  fmt.Sprintf("[%s] %s: this is a test of channel %s", alerts.StateFiring, rule.Name, channel.Name),
+		Time:     time.Now(),
+	}
+	n, err := d.render(channel, rule, event)
+	if err != nil {
+		return err
+	}
+	send := d.sender(channel.Type)
+	if send == nil {
+		return fmt.Errorf("unsupported channel type %q", channel.Type)
+	}
+	return send(ctx, d.client, channel, n)
+}
+
+func findChannel(channels []Channel, ref string) (Channel, bool) {
+	for _, c := range channels {
+		if c.ID == ref || c.Name == ref {
+			return c, true
+		}
+	}
+	return Channel{}, false
+}
+
+func (d *Dispatcher) render(channel Channel, rule alerts.Rule, event alerts.Event) (Notification, error) {
+	n := Notification{Rule: rule, Event: event, SearchURL: d.searchURL(rule, event)}
+
+	text := channel.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New(channel.Name).Parse(text)
+	if err != nil {
+		return n, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return n, err
+	}
+	n.Text = buf.String()
+	return n, nil
+}
+
+// searchURL links to the spans of the watched service (the target for edge rules)
+// over the rule window that ended at the event
+func (d *Dispatcher) searchURL(rule alerts.Rule, event alerts.Event) string {
+	service := rule.Service
+	if rule.Scope == alerts.ScopeEdge {
+		service = rule.Target
+	}
+	window, err := utils.ParseTimeRange(rule.Window)
+	if err != nil {
+		window = 5 * time.Minute
+	}
+
+	params := url.Values{}
+	params.Set("query", "scope="+service)
+	params.Set("start", event.Time.Add(-window).UTC().Format(time.RFC3339))
+	params.Set("end", event.Time.UTC().Format(time.RFC3339))
+	return d.uiURL + "/search?" + params.Encode()
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, channel Channel, n Notification) {
+	send := d.sender(channel.Type)
+	if send == nil {
+		log.Printf("notify: unsupported channel type %q\n", channel.Type)
+		return
+	}
+	if err := d.retry(ctx, channel, func() error { return send(ctx, d.client, channel, n) }); err != nil {
+		log.Printf("notify: giving up on channel %s: %v\n", channel.Name, err)
+	}
+}
+
+// Send delivers a message that isn't about an alert, like a report, to a channel
+// referenced by ID or name. Webhook channels receive body as JSON, the others the
+// text. PagerDuty channels only take alerts.
+func (d *Dispatcher) Send(ctx context.Context, ref, subject, text string, body any) error {
+	channels, err := d.channels.ListChannels(ctx)
+	if err != nil {
+		return err
+	}
+	channel, ok := findChannel(channels, ref)
+	if !ok {
+		return fmt.Errorf("unknown channel %q", ref)
+	}
+
+	var send func() error
+	switch channel.Type {
+	case TypeWebhook:
+		send = func() error { return postJSON(ctx, d.client, channel.URL, body) }
+	case TypeSlack:
+		send = func() error { return postJSON(ctx, d.client, channel.URL, map[string]string{"text": text}) }
+	case TypeEmail:
+		send = func() error { return d.mail(channel.To, subject, text) }
+	default:
+		return fmt.Errorf("channel %s of type %s can't deliver %q", channel.Name, channel.Type, subject)
+	}
+	return d.retry(ctx, channel, send)
+}
+
+// retry calls send until it succeeds, backing off exponentially between attempts
+func (d *Dispatcher) retry(ctx context.Context, channel Channel, send func() error) error {
+	backoff := d.backoff
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil {
+			return nil
+		}
+		if attempt == d.maxAttempts {
+			return fmt.Errorf("failed after %d attempts: %w", attempt, err)
+		}
+		log.Printf("notify: delivery to channel %s failed (attempt %d), retrying in %s: %v\n", channel.Name, attempt, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,129 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"strings"
+
+	"nabatshy/alerts"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// SMTPConfig is the mail server email channels send through
+type SMTPConfig struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+// sender delivers a rendered notification to a channel
+type sender func(ctx context.Context, client *http.Client, channel Channel, n Notification) error
+
+func (d *Dispatcher) sender(channelType string) sender {
+	switch channelType {
+	case TypeWebhook:
+		return sendWebhook
+	case TypeSlack:
+		return sendSlack
+	case TypeEmail:
+		return d.sendEmail
+	case TypePagerDuty:
+		return sendPagerDuty
+	}
+	return nil
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %d: %s", url, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func sendWebhook(ctx context.Context, client *http.Client, channel Channel, n Notification) error {
+	return postJSON(ctx, client, channel.URL, n)
+}
+
+func sendSlack(ctx context.Context, client *http.Client, channel Channel, n Notification) error {
+	msg := map[string]string{"text": n.Text}
+	// route to the owning team's channel, only honored by legacy incoming webhooks
+	if n.Event.Owner != nil && n.Event.Owner.SlackChannel != "" {
+		msg["channel"] = n.Event.Owner.SlackChannel
+	}
+	return postJSON(ctx, client, channel.URL, msg)
+}
+
+func sendPagerDuty(ctx context.Context, client *http.Client, channel Channel, n Notification) error {
+	action := "trigger"
+	if n.Event.State == alerts.StateResolved {
+		action = "resolve"
+	}
+	source := n.Rule.Service
+	if n.Rule.Scope == alerts.ScopeEdge {
+		source = n.Rule.Source + " -> " + n.Rule.Target
+	}
+
+	links := []map[string]string{}
+	if n.SearchURL != "" {
+		links = append(links, map[string]string{"href": n.SearchURL, "text": "Traces"})
+	}
+	if n.Event.RunbookURL != "" {
+		links = append(links, map[string]string{"href": n.Event.RunbookURL, "text": "Runbook"})
+	}
+	return postJSON(ctx, client, pagerDutyEventsURL, map[string]any{
+		"routing_key":  channel.RoutingKey,
+		"event_action": action,
+		// one incident per rule, resolved when the rule stops firing
+		"dedup_key": n.Rule.ID,
+		"payload": map[string]any{
+			"summary":        n.Text,
+			"source":         source,
+			"severity":       "error",
+			"custom_details": n.Event,
+		},
+		"links": links,
+	})
+}
+
+func (d *Dispatcher) sendEmail(ctx context.Context, client *http.Client, channel Channel, n Notification) error {
+	return d.mail(channel.To, fmt.Sprintf("[%s] %s", n.Event.State, n.Rule.Name), n.Text)
+}
+
+// mail sends a plain text email through the configured SMTP server
+func (d *Dispatcher) mail(to []string, subject, text string) error {
+	if d.smtp.Addr == "" {
+		return fmt.Errorf("SMTP is not configured")
+	}
+	host, _, _ := strings.Cut(d.smtp.Addr, ":")
+	var auth smtp.Auth
+	if d.smtp.Username != "" {
+		auth = smtp.PlainAuth("", d.smtp.Username, d.smtp.Password, host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		d.smtp.From, strings.Join(to, ", "), subject, text)
+	return smtp.SendMail(d.smtp.Addr, auth, d.smtp.From, to, []byte(msg))
+}
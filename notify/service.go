@@ -0,0 +1,101 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"text/template"
+	"time"
+
+	"nabatshy/catalog"
+	"nabatshy/db"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/google/uuid"
+)
+
+const channelsTable = "notification_channels"
+
+// Channel types
+const (
+	TypeWebhook   = "webhook"
+	TypeSlack     = "slack"
+	TypeEmail     = "email"
+	TypePagerDuty = "pagerduty"
+)
+
+// Channel is a destination alert notifications are delivered to
+type Channel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// URL is the endpoint of webhook channels and the incoming webhook URL of Slack channels
+	URL string `json:"url,omitempty"`
+	// To are the recipients of email channels
+	To []string `json:"to,omitempty"`
+	// RoutingKey is the integration key of PagerDuty channels
+	RoutingKey string `json:"routing_key,omitempty"`
+	// Template is a text/template rendering the message text from a Notification,
+	// DefaultTemplate is used when empty
+	Template  string    `json:"template,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ChannelService struct {
+	Ch *clickhouse.Conn
+}
+
+// Validate checks the channel has what its type needs
+func (c *Channel) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch c.Type {
+	case TypeWebhook, TypeSlack:
+		if c.URL == "" {
+			return fmt.Errorf("url is required for %s channels", c.Type)
+		}
+		if err := catalog.ValidateURL(c.URL); err != nil {
+			return fmt.Errorf("invalid url: %w", err)
+		}
+	case TypeEmail:
+		if len(c.To) == 0 {
+			return fmt.Errorf("to is required for email channels")
+		}
+	case TypePagerDuty:
+		if c.RoutingKey == "" {
+			return fmt.Errorf("routing_key is required for pagerduty channels")
+		}
+	default:
+		return fmt.Errorf("invalid type %q", c.Type)
+	}
+	if c.Template != "" {
+		if _, err := template.New(c.Name).Parse(c.Template); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *ChannelService) ListChannels(ctx context.Context) ([]Channel, error) {
+	return db.ListDocuments[Channel](ctx, *s.Ch, channelsTable)
+}
+
+func (s *ChannelService) GetChannel(ctx context.Context, id string) (Channel, bool, error) {
+	return db.GetDocument[Channel](ctx, *s.Ch, channelsTable, id)
+}
+
+// SaveChannel creates the channel when it has no ID, otherwise replaces it
+func (s *ChannelService) SaveChannel(ctx context.Context, channel *Channel) error {
+	if err := channel.Validate(); err != nil {
+		return err
+	}
+	if channel.ID == "" {
+		channel.ID = uuid.New().String()
+	}
+	channel.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, channelsTable, channel.ID, channel.Name, channel)
+}
+
+func (s *ChannelService) DeleteChannel(ctx context.Context, id string) error {
+	return db.DeleteDocument(ctx, *s.Ch, channelsTable, id)
+}
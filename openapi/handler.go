@@ -0,0 +1,88 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Controller serves the document of a router at /openapi.json and a Swagger UI
+// reading it at /docs
+type Controller struct {
+	info   Info
+	routes chi.Routes
+	ops    []Operation
+
+	once sync.Once
+	doc  *Document
+}
+
+// NewController documents the routes of routes, the document is built on the first
+// request so it holds the routes registered after the controller
+func NewController(info Info, routes chi.Routes, ops []Operation) *Controller {
+	c := &Controller{info: info, routes: routes}
+	c.ops = append(ops, c.Operations()...)
+	return c
+}
+
+func (c *Controller) document() *Document {
+	c.once.Do(func() {
+		c.doc = Build(c.info, c.routes, c.ops)
+	})
+	return c.doc
+}
+
+// prefix is the path the router is mounted under, like /api on a single port
+func prefix(r *http.Request, route string) string {
+	return strings.TrimSuffix(r.URL.Path, route)
+}
+
+func (c *Controller) getDocument(w http.ResponseWriter, r *http.Request) {
+	doc := *c.document()
+	url := prefix(r, "/openapi.json")
+	if url == "" {
+		url = "/"
+	}
+	doc.Servers = []Server{{URL: url}}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+const swaggerUI = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>%[1]s</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({url: "%[2]s/openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+func (c *Controller) getDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, swaggerUI, html.EscapeString(c.info.Title), html.EscapeString(prefix(r, "/docs")))
+}
+
+func (c *Controller) Operations() []Operation {
+	return []Operation{
+		{Method: "GET", Path: "/openapi.json", Summary: "The OpenAPI document of the API", Response: Document{}},
+		{Method: "GET", Path: "/docs", Summary: "Swagger UI browsing the OpenAPI document", ContentType: "text/html"},
+	}
+}
+
+func (c *Controller) RegisterRoutes(r chi.Router) {
+	r.Get("/openapi.json", c.getDocument)
+	r.Get("/docs", c.getDocs)
+}
@@ -0,0 +1,226 @@
+// Package openapi describes the HTTP API as an OpenAPI 3 document. The paths come
+// from the routes of the router, so every route is in the document, and their
+// parameters and bodies from the Operations of the controllers, whose schemas are
+// generated from the Go types of the bodies.
+package openapi
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Version is the OpenAPI version of the documents
+const Version = "3.0.3"
+
+// Operation describes a route
+type Operation struct {
+	Method string
+	// Path is the chi pattern of the route like /v1/traces/{trace_id}
+	Path        string
+	Summary     string
+	Description string
+	Query       []Param
+	// Request and Response are values of the types of the JSON bodies, nil when
+	// the route has none
+	Request  any
+	Response any
+	// Status is the status of a successful response, 200 when 0
+	Status int
+	// ContentType is the type of a response that isn't JSON, like text/csv
+	ContentType string
+	// Error is a value of the type of the JSON body of errors, nil when they're text
+	Error any
+}
+
+// Param is a query parameter
+type Param struct {
+	Name        string
+	Description string
+	// Type is string, integer, number or boolean, string when empty
+	Type     string
+	Required bool
+}
+
+// Documented is implemented by the controllers that describe their routes
+type Documented interface {
+	Operations() []Operation
+}
+
+// DateRange are the parameters of the routes reading a date range
+var DateRange = []Param{
+	{Name: "start", Description: "start of the date range in RFC 3339, with end"},
+	{Name: "end", Description: "end of the date range in RFC 3339, with start"},
+	{Name: "timeRange", Description: "the last period like 15m, 24h or 7d, instead of start and end"},
+}
+
+// Info is the info object of a document
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+// Document is an OpenAPI document
+type Document struct {
+	OpenAPI    string                        `json:"openapi"`
+	Info       Info                          `json:"info"`
+	Servers    []Server                      `json:"servers,omitempty"`
+	Paths      map[string]map[string]*PathOp `json:"paths"`
+	Components Components                    `json:"components"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+// PathOp is the operation object of a method of a path
+type PathOp struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []ParamObject        `json:"parameters,omitempty"`
+	RequestBody *Body                `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type ParamObject struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type Body struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+var patternParamRe = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// Build returns the document of the routes, described by ops when they're among
+// them. Routes without an Operation are documented by their path alone and logged,
+// Operations without a route are left out. Without routes the document holds ops.
+func Build(info Info, routes chi.Routes, ops []Operation) *Document {
+	described := make(map[string]Operation, len(ops))
+	for _, op := range ops {
+		described[op.Method+" "+op.Path] = op
+	}
+
+	var found []Operation
+	if routes == nil {
+		found = ops
+	} else {
+		chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			route = strings.TrimSuffix(strings.ReplaceAll(route, "/*/", "/"), "/*")
+			op, ok := described[method+" "+route]
+			if !ok {
+				log.Printf("openapi: %s %s isn't documented\n", method, route)
+				op = Operation{Method: method, Path: route}
+			}
+			found = append(found, op)
+			return nil
+		})
+	}
+
+	doc := &Document{OpenAPI: Version, Info: info, Paths: make(map[string]map[string]*PathOp)}
+	g := newGenerator()
+	for _, op := range found {
+		path := patternParamRe.ReplaceAllString(op.Path, "{$1}")
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*PathOp)
+		}
+		doc.Paths[path][strings.ToLower(op.Method)] = g.operation(op, path)
+	}
+	doc.Components.Schemas = g.schemas
+	return doc
+}
+
+func (g *generator) operation(op Operation, path string) *PathOp {
+	p := &PathOp{
+		OperationID: operationID(op.Method, path),
+		Summary:     op.Summary,
+		Description: op.Description,
+		Tags:        []string{tag(path)},
+		Responses:   make(map[string]*Response),
+	}
+	for _, m := range patternParamRe.FindAllStringSubmatch(op.Path, -1) {
+		p.Parameters = append(p.Parameters, ParamObject{Name: m[1], In: "path", Required: true, Schema: &Schema{Type: "string"}})
+	}
+	for _, q := range op.Query {
+		t := q.Type
+		if t == "" {
+			t = "string"
+		}
+		p.Parameters = append(p.Parameters, ParamObject{Name: q.Name, In: "query", Description: q.Description, Required: q.Required, Schema: &Schema{Type: t}})
+	}
+	if op.Request != nil {
+		p.RequestBody = &Body{Required: true, Content: map[string]*MediaType{
+			"application/json": {Schema: g.schema(op.Request)},
+		}}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := &Response{Description: http.StatusText(status)}
+	switch {
+	case op.ContentType != "":
+		ok.Content = map[string]*MediaType{op.ContentType: {Schema: &Schema{Type: "string"}}}
+	case op.Response != nil:
+		ok.Content = map[string]*MediaType{"application/json": {Schema: g.schema(op.Response)}}
+	}
+	p.Responses[strconv.Itoa(status)] = ok
+	if op.Error != nil {
+		p.Responses["default"] = &Response{Description: "Error", Content: map[string]*MediaType{
+			"application/json": {Schema: g.schema(op.Error)},
+		}}
+	} else {
+		p.Responses["default"] = &Response{Description: "Error, the message is in the text body"}
+	}
+	return p
+}
+
+// operationID is the method and the path in camel case, like getV1TracesTraceId
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+	}) {
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return b.String()
+}
+
+// tag groups a path by its first segment after the API version, like traces
+func tag(path string) string {
+	segments := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+	for i, s := range segments {
+		if (s == "v1" || s == "v2" || s == "api") && i+1 < len(segments) {
+			continue
+		}
+		return strings.Trim(s, "{}")
+	}
+	return "root"
+}
@@ -0,0 +1,82 @@
+package preferences
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nabatshy/auth"
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type PreferenceController struct {
+	service *PreferenceService
+}
+
+func NewPreferenceController(service *PreferenceService) *PreferenceController {
+	return &PreferenceController{service: service}
+}
+
+// subject is the subject of the request's user, empty when auth is off and
+// everyone shares the preferences
+func subject(r *http.Request) string {
+	if u := auth.UserFromContext(r.Context()); u != nil {
+		return u.Subject
+	}
+	return ""
+}
+
+func (c *PreferenceController) getPreferences(w http.ResponseWriter, r *http.Request) {
+	prefs, err := c.service.GetPreferences(r.Context(), subject(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get preferences: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+func (c *PreferenceController) savePreferences(w http.ResponseWriter, r *http.Request) {
+	var prefs Preferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		http.Error(w, "invalid preferences: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := prefs.Validate(); err != nil {
+		http.Error(w, "invalid preferences: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SavePreferences(r.Context(), subject(r), &prefs); err != nil {
+		http.Error(w, fmt.Sprintf("failed to save preferences: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+func (c *PreferenceController) resetPreferences(w http.ResponseWriter, r *http.Request) {
+	if err := c.service.ResetPreferences(r.Context(), subject(r)); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reset preferences: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *PreferenceController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/preferences", Summary: "Preferences of the user", Response: Preferences{}},
+		{Method: http.MethodPut, Path: "/v1/preferences", Summary: "Save the preferences of the user", Request: Preferences{}, Response: Preferences{}},
+		{Method: http.MethodDelete, Path: "/v1/preferences", Summary: "Reset the preferences of the user", Status: http.StatusNoContent},
+	}
+}
+
+func (c *PreferenceController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/preferences", c.getPreferences)
+	r.Put("/v1/preferences", c.savePreferences)
+	r.Delete("/v1/preferences", c.resetPreferences)
+}
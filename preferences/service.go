@@ -0,0 +1,85 @@
+package preferences
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"nabatshy/db"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const preferencesTable = "preferences"
+
+// sharedUser is the key of the preferences used when auth is off
+const sharedUser = "default"
+
+// Preferences are the UI settings of a user
+type Preferences struct {
+	// TimeRange is the range pages open with, like 1h or 7d
+	TimeRange string `json:"time_range,omitempty"`
+	// Percentile is the latency percentile charts show, like 95
+	Percentile     int      `json:"percentile,omitempty"`
+	PinnedServices []string `json:"pinned_services"`
+	// Theme is light, dark or system
+	Theme     string    `json:"theme,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+type PreferenceService struct {
+	Ch *clickhouse.Conn
+}
+
+// Validate checks the preferences
+func (p *Preferences) Validate() error {
+	if p.TimeRange != "" {
+		if _, err := utils.ParseTimeRange(p.TimeRange); err != nil {
+			return err
+		}
+	}
+	if p.Percentile < 0 || p.Percentile > 100 {
+		return fmt.Errorf("percentile must be between 1 and 100")
+	}
+	switch p.Theme {
+	case "", "light", "dark", "system":
+	default:
+		return fmt.Errorf("invalid theme %q, use light, dark or system", p.Theme)
+	}
+	if p.PinnedServices == nil {
+		p.PinnedServices = []string{}
+	}
+	return nil
+}
+
+// key is the document of a user's preferences, subject is empty when auth is off
+func key(subject string) string {
+	if subject == "" {
+		return sharedUser
+	}
+	return subject
+}
+
+// GetPreferences returns the preferences of the user, empty ones when none were saved
+func (s *PreferenceService) GetPreferences(ctx context.Context, subject string) (Preferences, error) {
+	p, found, err := db.GetDocument[Preferences](ctx, *s.Ch, preferencesTable, key(subject))
+	if err != nil || found {
+		return p, err
+	}
+	return Preferences{PinnedServices: []string{}}, nil
+}
+
+// SavePreferences replaces the preferences of the user
+func (s *PreferenceService) SavePreferences(ctx context.Context, subject string, p *Preferences) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	p.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, preferencesTable, key(subject), key(subject), p)
+}
+
+// ResetPreferences forgets the preferences of the user
+func (s *PreferenceService) ResetPreferences(ctx context.Context, subject string) error {
+	return db.DeleteDocument(ctx, *s.Ch, preferencesTable, key(subject))
+}
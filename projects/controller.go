@@ -0,0 +1,144 @@
+package projects
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nabatshy/openapi"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type ProjectController struct {
+	service *ProjectService
+}
+
+func NewProjectController(service *ProjectService) *ProjectController {
+	return &ProjectController{service: service}
+}
+
+// Middleware scopes the queries of requests with a project parameter to the
+// project's services, unknown projects are rejected
+func Middleware(service *ProjectService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := r.URL.Query().Get("project")
+			if name == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p, found, err := service.GetProject(r.Context(), name)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to get project: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "project not found", http.StatusNotFound)
+				return
+			}
+			ctx := utils.WithServiceFilter(r.Context(), "project:"+p.Name, p.Services)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func (c *ProjectController) listProjects(w http.ResponseWriter, r *http.Request) {
+	projects, err := c.service.ListProjects(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list projects: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+func (c *ProjectController) getProject(w http.ResponseWriter, r *http.Request) {
+	p, found, err := c.service.GetProject(r.Context(), chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get project: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "project not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (c *ProjectController) putProject(w http.ResponseWriter, r *http.Request) {
+	var p Project
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "invalid project: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.Name = chi.URLParam(r, "name")
+	if err := p.Validate(); err != nil {
+		http.Error(w, "invalid project: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveProject(r.Context(), &p); err != nil {
+		http.Error(w, fmt.Sprintf("failed to save project: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (c *ProjectController) deleteProject(w http.ResponseWriter, r *http.Request) {
+	if err := c.service.DeleteProject(r.Context(), chi.URLParam(r, "name")); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete project: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *ProjectController) addService(w http.ResponseWriter, r *http.Request) {
+	p, found, err := c.service.AddService(r.Context(), chi.URLParam(r, "name"), chi.URLParam(r, "service"))
+	c.writeMembership(w, p, found, err)
+}
+
+func (c *ProjectController) removeService(w http.ResponseWriter, r *http.Request) {
+	p, found, err := c.service.RemoveService(r.Context(), chi.URLParam(r, "name"), chi.URLParam(r, "service"))
+	c.writeMembership(w, p, found, err)
+}
+
+func (c *ProjectController) writeMembership(w http.ResponseWriter, p Project, found bool, err error) {
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to update project services: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "project not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (c *ProjectController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/projects", Summary: "Projects", Response: []Project{}},
+		{Method: http.MethodGet, Path: "/v1/projects/{name}", Summary: "A project", Response: Project{}},
+		{Method: http.MethodPut, Path: "/v1/projects/{name}", Summary: "Save a project", Request: Project{}, Response: Project{}},
+		{Method: http.MethodDelete, Path: "/v1/projects/{name}", Summary: "Delete a project", Status: http.StatusNoContent},
+		{Method: http.MethodPut, Path: "/v1/projects/{name}/services/{service}", Summary: "Add a service to a project", Response: Project{}},
+		{Method: http.MethodDelete, Path: "/v1/projects/{name}/services/{service}", Summary: "Remove a service from a project", Response: Project{}},
+	}
+}
+
+func (c *ProjectController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/projects", c.listProjects)
+	r.Get("/v1/projects/{name}", c.getProject)
+	r.Put("/v1/projects/{name}", c.putProject)
+	r.Delete("/v1/projects/{name}", c.deleteProject)
+	r.Put("/v1/projects/{name}/services/{service}", c.addService)
+	r.Delete("/v1/projects/{name}/services/{service}", c.removeService)
+}
@@ -0,0 +1,92 @@
+package projects
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
+	"nabatshy/db"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const projectsTable = "projects"
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Project groups services under a name. Query endpoints take project=<name> to only
+// see spans of its services.
+type Project struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Services    []string  `json:"services"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type ProjectService struct {
+	Ch *clickhouse.Conn
+}
+
+// Validate checks the project
+func (p *Project) Validate() error {
+	if !namePattern.MatchString(p.Name) {
+		return fmt.Errorf("name must be letters, digits, '_', '.' or '-'")
+	}
+	for _, s := range p.Services {
+		if s == "" {
+			return fmt.Errorf("service names can't be empty")
+		}
+	}
+	return nil
+}
+
+func (s *ProjectService) ListProjects(ctx context.Context) ([]Project, error) {
+	return db.ListDocuments[Project](ctx, *s.Ch, projectsTable)
+}
+
+func (s *ProjectService) GetProject(ctx context.Context, name string) (Project, bool, error) {
+	return db.GetDocument[Project](ctx, *s.Ch, projectsTable, name)
+}
+
+// SaveProject creates or replaces a project
+func (s *ProjectService) SaveProject(ctx context.Context, p *Project) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if p.Services == nil {
+		p.Services = []string{}
+	}
+	slices.Sort(p.Services)
+	p.Services = slices.Compact(p.Services)
+	p.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, projectsTable, p.Name, p.Name, p)
+}
+
+func (s *ProjectService) DeleteProject(ctx context.Context, name string) error {
+	return db.DeleteDocument(ctx, *s.Ch, projectsTable, name)
+}
+
+// AddService adds a service to a project, found is false when the project doesn't exist
+func (s *ProjectService) AddService(ctx context.Context, name, service string) (Project, bool, error) {
+	return s.updateServices(ctx, name, func(services []string) []string {
+		return append(services, service)
+	})
+}
+
+// RemoveService removes a service from a project, found is false when the project doesn't exist
+func (s *ProjectService) RemoveService(ctx context.Context, name, service string) (Project, bool, error) {
+	return s.updateServices(ctx, name, func(services []string) []string {
+		return slices.DeleteFunc(services, func(s string) bool { return s == service })
+	})
+}
+
+func (s *ProjectService) updateServices(ctx context.Context, name string, update func([]string) []string) (Project, bool, error) {
+	p, found, err := s.GetProject(ctx, name)
+	if err != nil || !found {
+		return p, found, err
+	}
+	p.Services = update(p.Services)
+	return p, true, s.SaveProject(ctx, &p)
+}
@@ -0,0 +1,72 @@
+package provision
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type ProvisionController struct {
+	service *ProvisionService
+}
+
+func NewProvisionController(service *ProvisionService) *ProvisionController {
+	return &ProvisionController{service: service}
+}
+
+type provisionResponse struct {
+	Applied bool     `json:"applied"`
+	Changes []Change `json:"changes"`
+}
+
+func (c *ProvisionController) plan(w http.ResponseWriter, r *http.Request) {
+	var file map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&file); err != nil {
+		http.Error(w, "invalid provisioning file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes, err := c.service.Plan(r.Context(), file)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to plan: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(provisionResponse{Applied: false, Changes: changes})
+}
+
+func (c *ProvisionController) apply(w http.ResponseWriter, r *http.Request) {
+	var file map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&file); err != nil {
+		http.Error(w, "invalid provisioning file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes, err := c.service.Apply(r.Context(), file)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to apply: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(provisionResponse{Applied: true, Changes: changes})
+}
+
+func (c *ProvisionController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodPost, Path: "/v1/provision/plan", Summary: "The changes applying a provisioning file would make",
+			Request: map[string]json.RawMessage{}, Response: provisionResponse{}},
+		{Method: http.MethodPost, Path: "/v1/provision/apply", Summary: "Apply a provisioning file",
+			Request: map[string]json.RawMessage{}, Response: provisionResponse{}},
+	}
+}
+
+func (c *ProvisionController) RegisterRoutes(r chi.Router) {
+	r.Post("/v1/provision/plan", c.plan)
+	r.Post("/v1/provision/apply", c.apply)
+}
@@ -0,0 +1,100 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Document is a resource stored as a document (see db.PutDocument) that a
+// DocumentProvider manages
+type Document[T any] interface {
+	*T
+	Validate() error
+	// DocumentName is the name documents are matched by between the file and the
+	// current state, DocumentID the ID they are stored under
+	DocumentName() string
+	DocumentID() string
+	// Adopt takes what the file doesn't declare from the current version of the
+	// document, its ID and update time at least. A new document adopts the zero T.
+	Adopt(current T)
+}
+
+// DocumentProvider manages the documents of a section of the file, a list of them
+// matched by name
+type DocumentProvider[T any, P Document[T]] struct {
+	// Section is the key of the section in the file, Noun what errors call a document
+	Section string
+	Noun    string
+	List    func(ctx context.Context) ([]T, error)
+	Save    func(ctx context.Context, doc *T) error
+	Delete  func(ctx context.Context, id string) error
+}
+
+func (p *DocumentProvider[T, P]) Kind() string {
+	return p.Section
+}
+
+func (p *DocumentProvider[T, P]) Plan(ctx context.Context, desired json.RawMessage) ([]Change, error) {
+	var want []T
+	if err := json.Unmarshal(desired, &want); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", p.Section, err)
+	}
+
+	current, err := p.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]T, len(current))
+	for _, doc := range current {
+		byName[P(&doc).DocumentName()] = doc
+	}
+
+	var changes []Change
+	seen := make(map[string]bool)
+	for _, doc := range want {
+		name := P(&doc).DocumentName()
+		if err := P(&doc).Validate(); err != nil {
+			return nil, fmt.Errorf("%s %q: %w", p.Noun, name, err)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate %s %q", p.Noun, name)
+		}
+		seen[name] = true
+
+		existing, ok := byName[name]
+		P(&doc).Adopt(existing)
+		if !ok {
+			changes = append(changes, Change{Kind: p.Section, Name: name, Action: ActionCreate, After: doc})
+			continue
+		}
+		if !reflect.DeepEqual(doc, existing) {
+			changes = append(changes, Change{Kind: p.Section, Name: name, Action: ActionUpdate, Before: existing, After: doc})
+		}
+	}
+	for _, doc := range current {
+		if name := P(&doc).DocumentName(); !seen[name] {
+			changes = append(changes, Change{Kind: p.Section, Name: name, Action: ActionDelete, Before: doc})
+		}
+	}
+	return changes, nil
+}
+
+func (p *DocumentProvider[T, P]) Apply(ctx context.Context, changes []Change) error {
+	for _, c := range changes {
+		switch c.Action {
+		case ActionCreate, ActionUpdate:
+			doc := c.After.(T)
+			if err := p.Save(ctx, &doc); err != nil {
+				return err
+			}
+		case ActionDelete:
+			doc := c.Before.(T)
+			if err := p.Delete(ctx, P(&doc).DocumentID()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
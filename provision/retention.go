@@ -0,0 +1,142 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"nabatshy/db"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const spanRetentionSetting = "retention.spans"
+
+// Retention is the "retention" section of the provisioning file
+type Retention struct {
+	// Spans is how long spans are kept, e.g. "30d". Empty keeps them forever.
+	Spans string `json:"spans"`
+}
+
+// RetentionProvider manages the TTL of the span table. The spans of bookmarked
+// traces are pinned and kept, a retention set before migration 25 that deletes them
+// too is applied again.
+type RetentionProvider struct {
+	Ch      *clickhouse.Conn
+	Cluster db.Cluster
+}
+
+func (p *RetentionProvider) Kind() string {
+	return "retention"
+}
+
+func (p *RetentionProvider) Plan(ctx context.Context, desired json.RawMessage) ([]Change, error) {
+	var want Retention
+	if err := json.Unmarshal(desired, &want); err != nil {
+		return nil, fmt.Errorf("invalid retention: %w", err)
+	}
+	if _, err := parseRetentionDays(want.Spans); err != nil {
+		return nil, err
+	}
+
+	current, found, err := db.GetSetting(ctx, *p.Ch, spanRetentionSetting)
+	if err != nil {
+		return nil, err
+	}
+	keepsPinned, err := p.ttlKeepsPinned(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current == want.Spans && keepsPinned {
+		return nil, nil
+	}
+
+	change := Change{
+		Kind:   p.Kind(),
+		Name:   "spans",
+		Action: ActionUpdate,
+		Before: current,
+		After:  want.Spans,
+	}
+	if !found || current == "" {
+		change.Action = ActionCreate
+		change.Before = nil
+	}
+	if current == want.Spans && current != "" {
+		// the same retention, applied again to keep the pinned spans
+		change.Before = current + ", pinned spans included"
+	}
+	if want.Spans == "" {
+		change.Action = ActionDelete
+		change.After = nil
+	}
+	return []Change{change}, nil
+}
+
+func (p *RetentionProvider) Apply(ctx context.Context, changes []Change) error {
+	for _, c := range changes {
+		value, _ := c.After.(string)
+		days, err := parseRetentionDays(value)
+		if err != nil {
+			return err
+		}
+
+		table := p.Cluster.AlterTable("denormalized_span")
+		query := "ALTER TABLE " + table + " REMOVE TTL"
+		if days > 0 {
+			query = fmt.Sprintf(
+				"ALTER TABLE %s MODIFY TTL toDateTime(intDiv(start_time_unix_nano, 1000000000)) + toIntervalDay(%d) WHERE pinned = 0",
+				table, days,
+			)
+		}
+		if err := (*p.Ch).Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to update span retention: %w", err)
+		}
+		if err := db.SetSetting(ctx, *p.Ch, spanRetentionSetting, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ttlKeepsPinned reports whether the TTL of the span table, if it has one, leaves the
+// pinned spans alone
+func (p *RetentionProvider) ttlKeepsPinned(ctx context.Context) (bool, error) {
+	table := "denormalized_span"
+	if p.Cluster.Enabled() {
+		table += db.LocalSuffix
+	}
+	var engine string
+	if err := (*p.Ch).QueryRow(ctx,
+		"SELECT engine_full FROM system.tables WHERE database = currentDatabase() AND name = ?", table,
+	).Scan(&engine); err != nil {
+		return false, fmt.Errorf("failed to read the span table TTL: %w", err)
+	}
+	_, ttl, found := strings.Cut(engine, " TTL ")
+	return !found || strings.Contains(ttl, "pinned"), nil
+}
+
+// parseRetentionDays parses retention periods like "30d" or "2w", "" means no retention
+func parseRetentionDays(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if len(value) < 2 {
+		return 0, fmt.Errorf("invalid retention period %q", value)
+	}
+
+	n, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid retention period %q", value)
+	}
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "d":
+		return n, nil
+	case "w":
+		return n * 7, nil
+	default:
+		return 0, fmt.Errorf("unsupported retention unit in %q, use d or w", value)
+	}
+}
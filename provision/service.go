@@ -0,0 +1,103 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// Change is a single difference between the declared and the current state
+type Change struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Action Action `json:"action"`
+	Before any    `json:"before,omitempty"`
+	After  any    `json:"after,omitempty"`
+}
+
+// Provider manages one top level section of the declarative file. A section
+// that is present is authoritative: resources of that kind missing from it
+// are deleted, while sections that are absent are left untouched.
+type Provider interface {
+	// Kind is the key of the section in the file, e.g. "retention"
+	Kind() string
+	// Plan diffs the declared section against the current state
+	Plan(ctx context.Context, desired json.RawMessage) ([]Change, error)
+	// Apply applies changes previously returned by Plan
+	Apply(ctx context.Context, changes []Change) error
+}
+
+type ProvisionService struct {
+	providers map[string]Provider
+}
+
+func NewProvisionService(providers ...Provider) *ProvisionService {
+	s := &ProvisionService{providers: make(map[string]Provider)}
+	for _, p := range providers {
+		s.Register(p)
+	}
+	return s
+}
+
+// Register adds a provider, replacing any provider of the same kind
+func (s *ProvisionService) Register(p Provider) {
+	s.providers[p.Kind()] = p
+}
+
+// Plan returns the changes needed to bring the current state in line with the file
+func (s *ProvisionService) Plan(ctx context.Context, file map[string]json.RawMessage) ([]Change, error) {
+	changes := []Change{}
+	for _, kind := range s.kinds(file) {
+		p, ok := s.providers[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown resource kind %q", kind)
+		}
+		c, err := p.Plan(ctx, file[kind])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", kind, err)
+		}
+		changes = append(changes, c...)
+	}
+	return changes, nil
+}
+
+// Apply plans and applies the file, returning the changes that were made
+func (s *ProvisionService) Apply(ctx context.Context, file map[string]json.RawMessage) ([]Change, error) {
+	changes, err := s.Plan(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	byKind := make(map[string][]Change)
+	for _, c := range changes {
+		byKind[c.Kind] = append(byKind[c.Kind], c)
+	}
+	for _, kind := range s.kinds(file) {
+		if len(byKind[kind]) == 0 {
+			continue
+		}
+		if err := s.providers[kind].Apply(ctx, byKind[kind]); err != nil {
+			return nil, fmt.Errorf("%s: %w", kind, err)
+		}
+	}
+	return changes, nil
+}
+
+// kinds returns the sections of the file in a stable order
+func (s *ProvisionService) kinds(file map[string]json.RawMessage) []string {
+	kinds := make([]string, 0, len(file))
+	for kind := range file {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
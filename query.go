@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"nabatshy/client"
+)
+
+const queryUsage = `usage: nabatshy query <search|trace|span|services> [flags] [args]
+
+  search [flags] QUERY   spans matching a search, like the search box of the UI
+  trace ID               the spans of a trace
+  span ID                a span with its attributes and duration statistics
+  services [flags]       the services that reported spans
+
+Flags go before the arguments. The results are printed as JSON.
+`
+
+// query reads the API of a running server, for scripts that would otherwise use curl
+func query(args []string) {
+	log.SetFlags(0)
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, queryUsage)
+		os.Exit(2)
+	}
+	command, args := args[0], args[1:]
+	fs := flag.NewFlagSet("query "+command, flag.ExitOnError)
+	apiURL := fs.String("api-url", envOr("NABATSHY_API_URL", "http://localhost:3000"), "URL of the API, ending with /api in single port mode (env NABATSHY_API_URL)")
+	token := fs.String("token", os.Getenv("NABATSHY_TOKEN"), "bearer token for servers with authentication (env NABATSHY_TOKEN)")
+	var q client.Query
+	var export bool
+	switch command {
+	case "search":
+		queryRangeFlags(fs, &q)
+		fs.IntVar(&q.Page, "page", 1, "page of the results")
+		fs.IntVar(&q.PageSize, "page-size", 10, "results per page")
+		fs.StringVar(&q.SortField, "sort-field", "", "start_time, end_time, duration or relevance")
+		fs.StringVar(&q.SortOrder, "sort-order", "desc", "asc or desc")
+		fs.StringVar(&q.TraceOrSpan, "trace-or-span", "", "trace to match root spans only")
+		fs.BoolVar(&q.Approx, "approx", false, "count approximately, faster on large ranges")
+		fs.BoolVar(&export, "export", false, "print every matching span as a JSON line instead of a page")
+	case "services":
+		queryRangeFlags(fs, &q)
+	case "trace", "span":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown query %q\n\n%s", command, queryUsage)
+		os.Exit(2)
+	}
+	fs.Parse(args)
+	if err := queryTimes(fs, &q); err != nil {
+		log.Fatal(err)
+	}
+
+	c := client.New(*apiURL)
+	c.Token = *token
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	var result any
+	var err error
+	switch command {
+	case "search":
+		if fs.NArg() != 1 {
+			log.Fatal("usage: nabatshy query search [flags] QUERY")
+		}
+		q.Query = fs.Arg(0)
+		if export {
+			// one span per line so the output can be piped to jq or split
+			lines := json.NewEncoder(os.Stdout)
+			c.HTTPClient.Timeout = 0
+			if err := c.ExportSearch(ctx, q, func(r client.SearchResult) error { return lines.Encode(r) }); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		result, err = c.Search(ctx, q)
+	case "trace":
+		if fs.NArg() != 1 {
+			log.Fatal("usage: nabatshy query trace ID")
+		}
+		result, err = c.TraceDetails(ctx, fs.Arg(0))
+	case "span":
+		if fs.NArg() != 1 {
+			log.Fatal("usage: nabatshy query span ID")
+		}
+		result, err = c.SpanDetails(ctx, fs.Arg(0))
+	case "services":
+		result, err = c.ServiceCatalog(ctx, q)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := enc.Encode(result); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// queryRangeFlags adds the flags of the time window and project of a query
+func queryRangeFlags(fs *flag.FlagSet, q *client.Query) {
+	fs.StringVar(&q.TimeRange, "time-range", "1h", "how far back to look, like 15m, 1h or 7d")
+	fs.String("start", "", "start of the window as RFC 3339, with -end instead of -time-range")
+	fs.String("end", "", "end of the window as RFC 3339")
+	fs.StringVar(&q.Project, "project", "", "limit the results to the services of a project")
+}
+
+// queryTimes reads the -start and -end flags into q
+func queryTimes(fs *flag.FlagSet, q *client.Query) error {
+	start, end := fs.Lookup("start"), fs.Lookup("end")
+	if start == nil || start.Value.String() == "" && end.Value.String() == "" {
+		return nil
+	}
+	var err error
+	if q.Start, err = time.Parse(time.RFC3339, start.Value.String()); err != nil {
+		return fmt.Errorf("invalid -start: %w", err)
+	}
+	if q.End, err = time.Parse(time.RFC3339, end.Value.String()); err != nil {
+		return fmt.Errorf("invalid -end: %w", err)
+	}
+	return nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
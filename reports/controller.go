@@ -0,0 +1,164 @@
+package reports
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type ReportController struct {
+	service *ReportService
+}
+
+func NewReportController(service *ReportService) *ReportController {
+	return &ReportController{service: service}
+}
+
+func (c *ReportController) listReports(w http.ResponseWriter, r *http.Request) {
+	reports, err := c.service.ListReports(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list reports: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// findReport writes the error response and returns false when the report can't be loaded
+func (c *ReportController) findReport(w http.ResponseWriter, r *http.Request) (Report, bool) {
+	report, found, err := c.service.GetReport(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get report: %v", err), http.StatusInternalServerError)
+		return report, false
+	}
+	if !found {
+		http.Error(w, "report not found", http.StatusNotFound)
+		return report, false
+	}
+	return report, true
+}
+
+func (c *ReportController) getReport(w http.ResponseWriter, r *http.Request) {
+	report, ok := c.findReport(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (c *ReportController) createReport(w http.ResponseWriter, r *http.Request) {
+	var report Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.ID = ""
+	if err := report.Validate(); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveReport(r.Context(), &report); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (c *ReportController) updateReport(w http.ResponseWriter, r *http.Request) {
+	existing, ok := c.findReport(w, r)
+	if !ok {
+		return
+	}
+
+	var report Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.ID = existing.ID
+	if err := report.Validate(); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveReport(r.Context(), &report); err != nil {
+		http.Error(w, fmt.Sprintf("failed to update report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (c *ReportController) deleteReport(w http.ResponseWriter, r *http.Request) {
+	if err := c.service.DeleteReport(r.Context(), chi.URLParam(r, "id")); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete report: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// previewReport generates the report for the period ending now without sending it
+func (c *ReportController) previewReport(w http.ResponseWriter, r *http.Request) {
+	report, ok := c.findReport(w, r)
+	if !ok {
+		return
+	}
+
+	rendered, err := c.service.Generate(r.Context(), report, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rendered)
+}
+
+// sendReport generates the report for the period ending now and sends it
+func (c *ReportController) sendReport(w http.ResponseWriter, r *http.Request) {
+	report, ok := c.findReport(w, r)
+	if !ok {
+		return
+	}
+
+	if err := c.service.Deliver(r.Context(), report, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *ReportController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/reports", Summary: "Scheduled reports", Response: []Report{}},
+		{Method: http.MethodPost, Path: "/v1/reports", Summary: "Create a report", Request: Report{}, Response: Report{}, Status: http.StatusCreated},
+		{Method: http.MethodGet, Path: "/v1/reports/{id}", Summary: "A report", Response: Report{}},
+		{Method: http.MethodPut, Path: "/v1/reports/{id}", Summary: "Update a report", Request: Report{}, Response: Report{}},
+		{Method: http.MethodDelete, Path: "/v1/reports/{id}", Summary: "Delete a report", Status: http.StatusNoContent},
+		{Method: http.MethodGet, Path: "/v1/reports/{id}/preview", Summary: "Generate a report without sending it", Response: Rendered{}},
+		{Method: http.MethodPost, Path: "/v1/reports/{id}/send", Summary: "Generate and send a report, 502 when sending fails", Status: http.StatusNoContent},
+	}
+}
+
+func (c *ReportController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/reports", c.listReports)
+	r.Post("/v1/reports", c.createReport)
+	r.Get("/v1/reports/{id}", c.getReport)
+	r.Put("/v1/reports/{id}", c.updateReport)
+	r.Delete("/v1/reports/{id}", c.deleteReport)
+	r.Get("/v1/reports/{id}/preview", c.previewReport)
+	r.Post("/v1/reports/{id}/send", c.sendReport)
+}
@@ -0,0 +1,73 @@
+package reports
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"nabatshy/db"
+)
+
+// Scheduler delivers every report once per period, at its configured time
+type Scheduler struct {
+	service *ReportService
+}
+
+func NewScheduler(service *ReportService) *Scheduler {
+	return &Scheduler{service: service}
+}
+
+// Run checks for due reports every minute until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		s.runDue(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func lastRunKey(id string) string {
+	return "reports.last_run." + id
+}
+
+func (s *Scheduler) runDue(ctx context.Context, now time.Time) {
+	reports, err := s.service.ListReports(ctx)
+	if err != nil {
+		log.Printf("reports: failed to list reports: %v\n", err)
+		return
+	}
+
+	for _, report := range reports {
+		due := report.lastDue(now)
+		// a report created after its due time waits for the next one
+		if report.UpdatedAt.After(due) {
+			continue
+		}
+		// the last run is kept in settings so a restart doesn't resend reports
+		value, found, err := db.GetSetting(ctx, *s.service.Ch, lastRunKey(report.ID))
+		if err != nil {
+			log.Printf("reports: failed to read last run of %s: %v\n", report.Name, err)
+			continue
+		}
+		if found {
+			if lastRun, err := time.Parse(time.RFC3339, value); err == nil && !lastRun.Before(due) {
+				continue
+			}
+		}
+
+		if err := s.service.Deliver(ctx, report, due); err != nil {
+			log.Printf("reports: %v\n", err)
+		} else {
+			log.Printf("reports: delivered %s\n", report.Name)
+		}
+		// failed deliveries were already retried by the sender, don't retry every minute
+		if err := db.SetSetting(ctx, *s.service.Ch, lastRunKey(report.ID), due.Format(time.RFC3339)); err != nil {
+			log.Printf("reports: failed to record last run of %s: %v\n", report.Name, err)
+		}
+	}
+}
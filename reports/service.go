@@ -0,0 +1,330 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+	"time"
+
+	"nabatshy/db"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/google/uuid"
+)
+
+const reportsTable = "reports"
+
+// Report schedules
+const (
+	ScheduleDaily  = "daily"
+	ScheduleWeekly = "weekly"
+)
+
+// summaryLimit is the number of entries in each section of a summary
+const summaryLimit = 10
+
+// DefaultTemplate renders reports without a template
+const DefaultTemplate = `{{.Name}}: {{.Summary.Start.Format "2006-01-02 15:04"}} to {{.Summary.End.Format "2006-01-02 15:04"}} UTC
+
+Slowest endpoints (p95):
+{{range .Summary.SlowEndpoints}}  {{.Service}} {{.Endpoint}}: {{printf "%.1f" .P95}}ms over {{.Count}} requests
+{{else}}  none
+{{end}}
+Most errors:
+{{range .Summary.ErrorLeaders}}  {{.Service}}: {{.Errors}} errors ({{printf "%.2f" .ErrorRate}}%)
+{{else}}  none
+{{end}}
+Traffic changes from the previous period:
+{{range .Summary.TrafficChanges}}  {{.Service}}: {{.Previous}} -> {{.Current}} spans ({{printf "%+.1f" .Change}}%)
+{{else}}  none
+{{end}}`
+
+type Report struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	// Hour is the UTC hour of day the report is sent at
+	Hour int `json:"hour"`
+	// Weekday the report is sent on for weekly reports, 0 is Sunday
+	Weekday time.Weekday `json:"weekday,omitempty"`
+	// Channels are the IDs or names of the notification channels the report is sent to
+	Channels []string `json:"channels"`
+	// Template is a text/template rendering the report text from a Rendered,
+	// DefaultTemplate is used when empty
+	Template  string    `json:"template,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type EndpointStat struct {
+	Service  string  `json:"service"`
+	Endpoint string  `json:"endpoint"`
+	P95      float64 `json:"p95_duration_ms"`
+	Count    uint64  `json:"count"`
+}
+
+type ErrorStat struct {
+	Service   string  `json:"service"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+type TrafficChange struct {
+	Service  string  `json:"service"`
+	Current  uint64  `json:"current"`
+	Previous uint64  `json:"previous"`
+	Change   float64 `json:"change"` // percent, 100 for new services
+}
+
+// Summary describes the period a report covers
+type Summary struct {
+	Start          time.Time       `json:"start"`
+	End            time.Time       `json:"end"`
+	SlowEndpoints  []EndpointStat  `json:"slow_endpoints"`
+	ErrorLeaders   []ErrorStat     `json:"error_leaders"`
+	TrafficChanges []TrafficChange `json:"traffic_changes"`
+}
+
+// Rendered is a generated report, webhook channels receive it as JSON
+type Rendered struct {
+	Name    string  `json:"name"`
+	Summary Summary `json:"summary"`
+	Text    string  `json:"text"`
+}
+
+// Sender delivers a message to a notification channel
+type Sender interface {
+	Send(ctx context.Context, channel, subject, text string, body any) error
+}
+
+type ReportService struct {
+	Ch *clickhouse.Conn
+	DB *goqu.DialectWrapper
+	// Sender delivers reports, may be nil when reports are only previewed
+	Sender Sender
+}
+
+// Validate checks the report
+func (r *Report) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch r.Schedule {
+	case ScheduleDaily, ScheduleWeekly:
+	default:
+		return fmt.Errorf("invalid schedule %q, use %q or %q", r.Schedule, ScheduleDaily, ScheduleWeekly)
+	}
+	if r.Hour < 0 || r.Hour > 23 {
+		return fmt.Errorf("hour must be between 0 and 23")
+	}
+	if r.Weekday < time.Sunday || r.Weekday > time.Saturday {
+		return fmt.Errorf("weekday must be between 0 and 6")
+	}
+	if len(r.Channels) == 0 {
+		return fmt.Errorf("channels are required")
+	}
+	if r.Template != "" {
+		if _, err := template.New(r.Name).Parse(r.Template); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	return nil
+}
+
+// period is the length of time a report covers
+func (r *Report) period() time.Duration {
+	if r.Schedule == ScheduleWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// lastDue returns the most recent time at or before now the report was due
+func (r *Report) lastDue(now time.Time) time.Time {
+	now = now.UTC()
+	due := time.Date(now.Year(), now.Month(), now.Day(), r.Hour, 0, 0, 0, time.UTC)
+	if r.Schedule == ScheduleWeekly {
+		due = due.AddDate(0, 0, int(r.Weekday-due.Weekday()))
+	}
+	for due.After(now) {
+		due = due.Add(-r.period())
+	}
+	return due
+}
+
+func (s *ReportService) ListReports(ctx context.Context) ([]Report, error) {
+	return db.ListDocuments[Report](ctx, *s.Ch, reportsTable)
+}
+
+func (s *ReportService) GetReport(ctx context.Context, id string) (Report, bool, error) {
+	return db.GetDocument[Report](ctx, *s.Ch, reportsTable, id)
+}
+
+// SaveReport creates the report when it has no ID, otherwise replaces it
+func (s *ReportService) SaveReport(ctx context.Context, report *Report) error {
+	if err := report.Validate(); err != nil {
+		return err
+	}
+	if report.ID == "" {
+		report.ID = uuid.New().String()
+	}
+	report.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, reportsTable, report.ID, report.Name, report)
+}
+
+func (s *ReportService) DeleteReport(ctx context.Context, id string) error {
+	return db.DeleteDocument(ctx, *s.Ch, reportsTable, id)
+}
+
+// Generate builds and renders the report for the period ending at end
+func (s *ReportService) Generate(ctx context.Context, report Report, end time.Time) (Rendered, error) {
+	summary, err := s.summarize(ctx, end.Add(-report.period()), end)
+	if err != nil {
+		return Rendered{}, err
+	}
+	rendered := Rendered{Name: report.Name, Summary: summary}
+
+	text := report.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New(report.Name).Parse(text)
+	if err != nil {
+		return Rendered{}, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, rendered); err != nil {
+		return Rendered{}, fmt.Errorf("failed to render report: %w", err)
+	}
+	rendered.Text = buf.String()
+	return rendered, nil
+}
+
+// Deliver generates the report and sends it to all of its channels
+func (s *ReportService) Deliver(ctx context.Context, report Report, end time.Time) error {
+	if s.Sender == nil {
+		return fmt.Errorf("no sender configured")
+	}
+	rendered, err := s.Generate(ctx, report, end)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, channel := range report.Channels {
+		if err := s.Sender.Send(ctx, channel, report.Name, rendered.Text, rendered); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", channel, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to deliver report %s: %v", report.Name, failed)
+	}
+	return nil
+}
+
+func (s *ReportService) summarize(ctx context.Context, start, end time.Time) (Summary, error) {
+	summary := Summary{Start: start.UTC(), End: end.UTC()}
+	startNano, endNano := start.UnixNano(), end.UnixNano()
+	inPeriod := []goqu.Expression{
+		goqu.C("start_time_unix_nano").Gte(startNano),
+		goqu.C("start_time_unix_nano").Lt(endNano),
+	}
+
+	slow := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("scope_name"),
+			goqu.C("name"),
+			goqu.L("quantile(0.95)(duration_ns / 1000000)").As("p95"),
+			goqu.L("count()"),
+		).
+		Where(append(inPeriod, goqu.C("parent_span_id").Eq(""))...).
+		GroupBy(goqu.C("scope_name"), goqu.C("name")).
+		Order(goqu.C("p95").Desc()).
+		Limit(summaryLimit)
+	err := s.scan(ctx, slow, func(scan func(...any) error) error {
+		var e EndpointStat
+		if err := scan(&e.Service, &e.Endpoint, &e.P95, &e.Count); err != nil {
+			return err
+		}
+		summary.SlowEndpoints = append(summary.SlowEndpoints, e)
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	errorLeaders := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("scope_name"),
+			goqu.L("countIf(has(events.name, 'exception'))").As("errors"),
+			goqu.L("errors * 100 / count()"),
+		).
+		Where(inPeriod...).
+		GroupBy(goqu.C("scope_name")).
+		Having(goqu.C("errors").Gt(0)).
+		Order(goqu.C("errors").Desc()).
+		Limit(summaryLimit)
+	err = s.scan(ctx, errorLeaders, func(scan func(...any) error) error {
+		var e ErrorStat
+		if err := scan(&e.Service, &e.Errors, &e.ErrorRate); err != nil {
+			return err
+		}
+		summary.ErrorLeaders = append(summary.ErrorLeaders, e)
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	prevStart := startNano - (endNano - startNano)
+	traffic := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("scope_name"),
+			goqu.L("countIf(start_time_unix_nano >= ?)", startNano).As("current"),
+			goqu.L("countIf(start_time_unix_nano < ?)", startNano).As("previous"),
+		).
+		Where(
+			goqu.C("start_time_unix_nano").Gte(prevStart),
+			goqu.C("start_time_unix_nano").Lt(endNano),
+		).
+		GroupBy(goqu.C("scope_name")).
+		Order(goqu.L("abs(toInt64(current) - toInt64(previous))").Desc()).
+		Limit(summaryLimit)
+	err = s.scan(ctx, traffic, func(scan func(...any) error) error {
+		var t TrafficChange
+		if err := scan(&t.Service, &t.Current, &t.Previous); err != nil {
+			return err
+		}
+		t.Change = 100
+		if t.Previous > 0 {
+			t.Change = (float64(t.Current) - float64(t.Previous)) / float64(t.Previous) * 100
+		}
+		summary.TrafficChanges = append(summary.TrafficChanges, t)
+		return nil
+	})
+	return summary, err
+}
+
+// scan runs the query and calls row for every result row
+func (s *ReportService) scan(ctx context.Context, ds *goqu.SelectDataset, row func(scan func(...any) error) error) error {
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := row(rows.Scan); err != nil {
+			return fmt.Errorf("scan error: %w", err)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,146 @@
+package searches
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"nabatshy/auth"
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type SearchController struct {
+	service *SearchService
+}
+
+func NewSearchController(service *SearchService) *SearchController {
+	return &SearchController{service: service}
+}
+
+// subject is the subject of the request's user, empty when auth is off
+func subject(r *http.Request) string {
+	if u := auth.UserFromContext(r.Context()); u != nil {
+		return u.Subject
+	}
+	return ""
+}
+
+func (c *SearchController) listSearches(w http.ResponseWriter, r *http.Request) {
+	searches, err := c.service.ListUserSearches(r.Context(), subject(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list saved searches: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(searches)
+}
+
+func (c *SearchController) getSearch(w http.ResponseWriter, r *http.Request) {
+	search, found, err := c.service.GetSearch(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get saved search: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found || !search.VisibleTo(subject(r)) {
+		http.Error(w, "saved search not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(search)
+}
+
+func (c *SearchController) createSearch(w http.ResponseWriter, r *http.Request) {
+	var search SavedSearch
+	if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+		http.Error(w, "invalid saved search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	search.ID = ""
+	search.Owner = subject(r)
+	if err := search.Validate(); err != nil {
+		http.Error(w, "invalid saved search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveSearch(r.Context(), &search); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create saved search: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(search)
+}
+
+func (c *SearchController) updateSearch(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	existing, found, err := c.service.GetSearch(r.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get saved search: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found || !existing.VisibleTo(subject(r)) {
+		http.Error(w, "saved search not found", http.StatusNotFound)
+		return
+	}
+
+	var search SavedSearch
+	if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+		http.Error(w, "invalid saved search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	search.ID = id
+	search.Owner = existing.Owner
+	if err := search.Validate(); err != nil {
+		http.Error(w, "invalid saved search: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveSearch(r.Context(), &search); err != nil {
+		http.Error(w, fmt.Sprintf("failed to update saved search: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(search)
+}
+
+func (c *SearchController) deleteSearch(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	search, found, err := c.service.GetSearch(r.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get saved search: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if found && !search.VisibleTo(subject(r)) {
+		http.Error(w, "saved search not found", http.StatusNotFound)
+		return
+	}
+	if err := c.service.DeleteSearch(r.Context(), id); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete saved search: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *SearchController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/searches", Summary: "The saved searches the user sees", Response: []SavedSearch{}},
+		{Method: http.MethodPost, Path: "/v1/searches", Summary: "Save a search", Request: SavedSearch{}, Response: SavedSearch{}, Status: http.StatusCreated},
+		{Method: http.MethodGet, Path: "/v1/searches/{id}", Summary: "A saved search", Response: SavedSearch{}},
+		{Method: http.MethodPut, Path: "/v1/searches/{id}", Summary: "Update a saved search", Request: SavedSearch{}, Response: SavedSearch{}},
+		{Method: http.MethodDelete, Path: "/v1/searches/{id}", Summary: "Delete a saved search", Status: http.StatusNoContent},
+	}
+}
+
+func (c *SearchController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/searches", c.listSearches)
+	r.Post("/v1/searches", c.createSearch)
+	r.Get("/v1/searches/{id}", c.getSearch)
+	r.Put("/v1/searches/{id}", c.updateSearch)
+	r.Delete("/v1/searches/{id}", c.deleteSearch)
+}
@@ -0,0 +1,41 @@
+package searches
+
+import (
+	"context"
+
+	"nabatshy/provision"
+)
+
+// NewProvider manages the saved searches everyone sees from the "searches" section
+// of a provisioning file. Searches are matched by name, the searches users saved
+// for themselves are left alone.
+func NewProvider(s *SearchService) provision.Provider {
+	return &provision.DocumentProvider[SavedSearch, *SavedSearch]{
+		Section: "searches",
+		Noun:    "search",
+		List: func(ctx context.Context) ([]SavedSearch, error) {
+			all, err := s.ListSearches(ctx)
+			if err != nil {
+				return nil, err
+			}
+			shared := make([]SavedSearch, 0, len(all))
+			for _, search := range all {
+				if search.Owner == "" {
+					shared = append(shared, search)
+				}
+			}
+			return shared, nil
+		},
+		Save:   s.SaveSearch,
+		Delete: s.DeleteSearch,
+	}
+}
+
+func (s *SavedSearch) DocumentName() string { return s.Name }
+
+func (s *SavedSearch) DocumentID() string { return s.ID }
+
+// Adopt also drops the owner, provisioned searches are shared
+func (s *SavedSearch) Adopt(current SavedSearch) {
+	s.ID, s.UpdatedAt, s.Owner = current.ID, current.UpdatedAt, ""
+}
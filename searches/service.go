@@ -0,0 +1,122 @@
+package searches
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"nabatshy/db"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/google/uuid"
+)
+
+const searchesTable = "saved_searches"
+
+// SavedSearch is a named search query with the parameters of /v1/search
+type SavedSearch struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	// TraceOrSpan is "trace", "span" or empty for both, like in /v1/search
+	TraceOrSpan string `json:"trace_or_span,omitempty"`
+	// TimeRange is a relative range like 1h or 7d, or Start and End an absolute one.
+	// Without either the UI keeps its current range.
+	TimeRange string     `json:"time_range,omitempty"`
+	Start     *time.Time `json:"start,omitempty"`
+	End       *time.Time `json:"end,omitempty"`
+	// SortField and SortOrder are the sortField and sortOrder of /v1/search
+	SortField string `json:"sort_field,omitempty"`
+	SortOrder string `json:"sort_order,omitempty"`
+	// Owner is the subject of the user who saved the search, empty for searches
+	// saved without auth, which everyone sees
+	Owner     string    `json:"owner,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SearchService struct {
+	Ch *clickhouse.Conn
+}
+
+// Validate checks the saved search
+func (s *SavedSearch) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch s.TraceOrSpan {
+	case "", "trace", "span":
+	default:
+		return fmt.Errorf("invalid trace_or_span %q, use trace, span or leave it empty", s.TraceOrSpan)
+	}
+	if s.TimeRange != "" {
+		if s.Start != nil || s.End != nil {
+			return fmt.Errorf("use either time_range or start and end")
+		}
+		if _, err := utils.ParseTimeRange(s.TimeRange); err != nil {
+			return err
+		}
+	}
+	if (s.Start == nil) != (s.End == nil) {
+		return fmt.Errorf("start and end go together")
+	}
+	if s.Start != nil && !s.Start.Before(*s.End) {
+		return fmt.Errorf("start must be before end")
+	}
+	switch s.SortField {
+	case "", "start_time", "end_time", "duration", "relevance":
+	default:
+		return fmt.Errorf("invalid sort_field %q, use start_time, end_time, duration or relevance", s.SortField)
+	}
+	switch s.SortOrder {
+	case "", "asc", "desc":
+	default:
+		return fmt.Errorf("invalid sort_order %q, use asc or desc", s.SortOrder)
+	}
+	return nil
+}
+
+// VisibleTo reports whether the user with the subject sees the search, every
+// search is visible without auth
+func (s *SavedSearch) VisibleTo(subject string) bool {
+	return subject == "" || s.Owner == "" || s.Owner == subject
+}
+
+func (s *SearchService) ListSearches(ctx context.Context) ([]SavedSearch, error) {
+	return db.ListDocuments[SavedSearch](ctx, *s.Ch, searchesTable)
+}
+
+// ListUserSearches lists the searches visible to the user with the subject
+func (s *SearchService) ListUserSearches(ctx context.Context, subject string) ([]SavedSearch, error) {
+	all, err := s.ListSearches(ctx)
+	if err != nil {
+		return nil, err
+	}
+	searches := make([]SavedSearch, 0, len(all))
+	for _, search := range all {
+		if search.VisibleTo(subject) {
+			searches = append(searches, search)
+		}
+	}
+	return searches, nil
+}
+
+func (s *SearchService) GetSearch(ctx context.Context, id string) (SavedSearch, bool, error) {
+	return db.GetDocument[SavedSearch](ctx, *s.Ch, searchesTable, id)
+}
+
+// SaveSearch creates the search when it has no ID, otherwise replaces it
+func (s *SearchService) SaveSearch(ctx context.Context, search *SavedSearch) error {
+	if err := search.Validate(); err != nil {
+		return err
+	}
+	if search.ID == "" {
+		search.ID = uuid.New().String()
+	}
+	search.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, searchesTable, search.ID, search.Name, search)
+}
+
+func (s *SearchService) DeleteSearch(ctx context.Context, id string) error {
+	return db.DeleteDocument(ctx, *s.Ch, searchesTable, id)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"nabatshy/collector"
+	"nabatshy/config"
+	"nabatshy/db"
+	"nabatshy/loadgen"
+	"nabatshy/utils"
+
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+)
+
+// seedBatchSpans is the spans of a seed-demo insert
+const seedBatchSpans = 5000
+
+// seedDemo stores a few hours of sample traces of an online shop in ClickHouse, so the
+// UI can be explored before any service is instrumented
+func seedDemo(args []string) {
+	fs := flag.NewFlagSet("seed-demo", flag.ExitOnError)
+	period := fs.Duration("duration", 3*time.Hour, "how far back the sample traces go")
+	tracesPerMinute := fs.Float64("traces-per-minute", 30, "average traces per minute, traffic varies around it")
+	seed := fs.Uint64("seed", 0, "seed of the sample traces, random when 0")
+	runMigrations := fs.Bool("migrate", true, "run the migrations before seeding")
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *period <= 0 || *tracesPerMinute <= 0 {
+		log.Fatal("-duration and -traces-per-minute must be positive")
+	}
+	if *seed == 0 {
+		*seed = rand.Uint64()
+	}
+	balancing, err := db.ParseBalancing(cfg.ClickHouse.Balancing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jsonAttributes, err := utils.ParseAttributeStorage(cfg.Attributes.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	promoted, err := promotedAttributes(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cluster := db.Cluster{Name: cfg.ClickHouse.Cluster}
+	conn := db.InitClickHouse(cfg.ClickHouse.Addr, cfg.ClickHouse.Database, cfg.ClickHouse.Username, cfg.ClickHouse.Password, balancing, cluster)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *runMigrations {
+		if err := runMigrate(ctx, conn, cluster, promoted); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// spans go through the collector's ingestion, as if they had been exported
+	service := collector.NewService(conn, collector.Options{Promoted: promoted, JSONAttributes: jsonAttributes})
+	topology := loadgen.ShopTopology()
+	gen := loadgen.NewGenerator(topology, *seed)
+	rnd := rand.New(rand.NewPCG(*seed, *seed))
+	end := time.Now().Add(-time.Second)
+	traces, spans := 0, 0
+	var batch []loadgen.GeneratedSpan
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		rejected, err := service.IngestTrace(&coltrace.ExportTraceServiceRequest{ResourceSpans: loadgen.ResourceSpans(batch)})
+		if err != nil {
+			log.Fatalf("seeding failed after %d traces: %v", traces, err)
+		}
+		if rejected.Total() > 0 {
+			log.Printf("%s", rejected)
+		}
+		spans += len(batch) - int(rejected.Total())
+		batch = batch[:0]
+	}
+	for t := end.Add(-*period); t.Before(end); {
+		if ctx.Err() != nil {
+			break
+		}
+		batch = append(batch, gen.Trace(t)...)
+		traces++
+		if len(batch) >= seedBatchSpans {
+			flush()
+		}
+		// traffic peaks and dips over the hours, with the arrivals of a Poisson process
+		phase := float64(t.Sub(end)) / float64(4*time.Hour) * 2 * math.Pi
+		rate := *tracesPerMinute * (1 + 0.5*math.Sin(phase)) / 60
+		t = t.Add(time.Duration(rnd.ExpFloat64() / rate * float64(time.Second)))
+	}
+	flush()
+	fmt.Printf("seeded %d spans in %d traces of %d services over the last %s (seed %d)\n", spans, traces, len(topology.Services()), *period, *seed)
+}
@@ -0,0 +1,128 @@
+package selfmonitor
+
+import (
+	"net/http"
+
+	"nabatshy/openapi"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type IngestSeries struct {
+	ReceivedPerSecond []utils.TimePercentile `json:"received_per_second"`
+	// OutcomesPerSecond is keyed by the outcomes of nabatshy_spans_ingested_total
+	OutcomesPerSecond map[string][]utils.TimePercentile `json:"outcomes_per_second"`
+}
+
+type QuerySeries struct {
+	APIRequestsPerSecond []utils.TimePercentile `json:"api_requests_per_second"`
+	APIAvgMs             []utils.TimePercentile `json:"api_avg_ms"`
+	APIP95Ms             []utils.TimePercentile `json:"api_p95_ms"`
+	ClickHouseAvgMs      []utils.TimePercentile `json:"clickhouse_avg_ms"`
+	ClickHouseP95Ms      []utils.TimePercentile `json:"clickhouse_p95_ms"`
+	InsertP95Ms          []utils.TimePercentile `json:"insert_p95_ms"`
+}
+
+type BufferSeries struct {
+	WALBytes        []utils.TimePercentile `json:"wal_bytes"`
+	InFlightExports []utils.TimePercentile `json:"in_flight_exports"`
+}
+
+type ClickHouseSeries struct {
+	// Up is 1 for the intervals ClickHouse answered a ping
+	Up              []utils.TimePercentile `json:"up"`
+	PingMs          []utils.TimePercentile `json:"ping_ms"`
+	ErrorsPerSecond []utils.TimePercentile `json:"errors_per_second"`
+}
+
+// SelfMonitorController serves the series of this instance in the format of the
+// dashboard's charts
+type SelfMonitorController struct {
+	monitor *Monitor
+}
+
+func NewSelfMonitorController(monitor *Monitor) *SelfMonitorController {
+	return &SelfMonitorController{monitor: monitor}
+}
+
+// dateRange reads the date range of a request, the last hour by default
+func dateRange(r *http.Request) (utils.DateRange, error) {
+	q := r.URL.Query()
+	if q.Get("timeRange") == "" && q.Get("start") == "" {
+		return utils.GetDateRangeFromQuery("1h"), nil
+	}
+	return utils.ParseDateRange(q, "start", "end", "timeRange")
+}
+
+// writeSeries writes the series of names built into a response by build
+func (c *SelfMonitorController) writeSeries(w http.ResponseWriter, r *http.Request, names []string, build func(map[string][]utils.TimePercentile) any) {
+	dr, err := dateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := c.monitor.series(dr, names...)
+	if err != nil {
+		http.Error(w, "failed to build series: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.WriteJSON(w, r, build(series))
+}
+
+func (c *SelfMonitorController) getIngest(w http.ResponseWriter, r *http.Request) {
+	names := []string{spansReceived}
+	for _, o := range outcomes {
+		names = append(names, outcomeSeriesPrefix+o)
+	}
+	c.writeSeries(w, r, names, func(s map[string][]utils.TimePercentile) any {
+		res := IngestSeries{ReceivedPerSecond: s[spansReceived], OutcomesPerSecond: make(map[string][]utils.TimePercentile)}
+		for _, o := range outcomes {
+			res.OutcomesPerSecond[o] = s[outcomeSeriesPrefix+o]
+		}
+		return res
+	})
+}
+
+func (c *SelfMonitorController) getQueries(w http.ResponseWriter, r *http.Request) {
+	names := []string{apiRequests, apiAvgMs, apiP95Ms, clickHouseAvgMs, clickHouseP95Ms, insertP95Ms}
+	c.writeSeries(w, r, names, func(s map[string][]utils.TimePercentile) any {
+		return QuerySeries{
+			APIRequestsPerSecond: s[apiRequests],
+			APIAvgMs:             s[apiAvgMs],
+			APIP95Ms:             s[apiP95Ms],
+			ClickHouseAvgMs:      s[clickHouseAvgMs],
+			ClickHouseP95Ms:      s[clickHouseP95Ms],
+			InsertP95Ms:          s[insertP95Ms],
+		}
+	})
+}
+
+func (c *SelfMonitorController) getBuffers(w http.ResponseWriter, r *http.Request) {
+	c.writeSeries(w, r, []string{walBytes, inFlightExports}, func(s map[string][]utils.TimePercentile) any {
+		return BufferSeries{WALBytes: s[walBytes], InFlightExports: s[inFlightExports]}
+	})
+}
+
+func (c *SelfMonitorController) getClickHouse(w http.ResponseWriter, r *http.Request) {
+	c.writeSeries(w, r, []string{clickHouseUp, clickHousePingMs, clickHouseErrors}, func(s map[string][]utils.TimePercentile) any {
+		return ClickHouseSeries{Up: s[clickHouseUp], PingMs: s[clickHousePingMs], ErrorsPerSecond: s[clickHouseErrors]}
+	})
+}
+
+func (c *SelfMonitorController) Operations() []openapi.Operation {
+	query := openapi.DateRange
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/self/ingest", Summary: "Spans received per second and their outcomes", Response: IngestSeries{}, Query: query},
+		{Method: http.MethodGet, Path: "/v1/self/queries", Summary: "Latency of the API and of ClickHouse", Response: QuerySeries{}, Query: query},
+		{Method: http.MethodGet, Path: "/v1/self/buffers", Summary: "Size of the WAL and exports in flight", Response: BufferSeries{}, Query: query},
+		{Method: http.MethodGet, Path: "/v1/self/clickhouse", Summary: "Availability of ClickHouse", Response: ClickHouseSeries{}, Query: query},
+	}
+}
+
+func (c *SelfMonitorController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/self/ingest", c.getIngest)
+	r.Get("/v1/self/queries", c.getQueries)
+	r.Get("/v1/self/buffers", c.getBuffers)
+	r.Get("/v1/self/clickhouse", c.getClickHouse)
+}
@@ -0,0 +1,204 @@
+// Package selfmonitor samples nabatshy's own metrics into time series for an
+// "about this instance" page, so the instance can be watched without Prometheus
+package selfmonitor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"nabatshy/collector"
+	"nabatshy/metrics"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const (
+	// Interval is the resolution of the series
+	Interval = time.Minute
+	// intervalSQL is Interval as written for utils.PadSeries
+	intervalSQL = "1 minute"
+	// DefaultRetention is how far back the series go
+	DefaultRetention = 24 * time.Hour
+
+	pingTimeout = 2 * time.Second
+)
+
+// outcomes are the values of the outcome label of metrics.SpansIngested
+var outcomes = []string{"committed", "failed", "buffered", "replayed", "dropped", "sampled"}
+
+// Series names
+const (
+	spansReceived       = "spans_received"
+	apiRequests         = "api_requests"
+	apiAvgMs            = "api_avg_ms"
+	apiP95Ms            = "api_p95_ms"
+	clickHouseAvgMs     = "clickhouse_avg_ms"
+	clickHouseP95Ms     = "clickhouse_p95_ms"
+	insertP95Ms         = "insert_p95_ms"
+	clickHouseErrors    = "clickhouse_errors"
+	clickHouseUp        = "clickhouse_up"
+	clickHousePingMs    = "clickhouse_ping_ms"
+	walBytes            = "wal_bytes"
+	inFlightExports     = "in_flight_exports"
+	outcomeSeriesPrefix = "spans_"
+)
+
+// sample is the values of every series for one interval
+type sample struct {
+	at     time.Time
+	values map[string]float64
+}
+
+// snapshot is the cumulative metrics at one point, samples are the difference of two
+type snapshot struct {
+	spans      map[string]float64
+	api        metrics.HistogramSnapshot
+	clickHouse metrics.HistogramSnapshot
+	insert     metrics.HistogramSnapshot
+	errors     float64
+}
+
+func takeSnapshot() snapshot {
+	s := snapshot{
+		spans:      make(map[string]float64, len(outcomes)),
+		api:        metrics.HTTPRequestDuration.Snapshot(map[string]string{"server": "api"}),
+		clickHouse: metrics.ClickHouseQueryDuration.Snapshot(nil),
+		insert:     metrics.InsertDuration.Snapshot(nil),
+		errors:     metrics.ClickHouseErrors.Sum(nil),
+	}
+	for _, o := range outcomes {
+		s.spans[o] = metrics.SpansIngested.Sum(map[string]string{"outcome": o})
+	}
+	return s
+}
+
+// Monitor samples the metrics of this instance every Interval and keeps the samples
+// of the retention in a ring
+type Monitor struct {
+	conn    clickhouse.Conn
+	wal     *collector.WAL
+	drainer *collector.Drainer
+
+	mu       sync.Mutex
+	capacity int
+	samples  []sample
+	next     int
+}
+
+// New returns a Monitor, wal and drainer may be nil
+func New(conn clickhouse.Conn, wal *collector.WAL, drainer *collector.Drainer, retention time.Duration) *Monitor {
+	capacity := int(retention / Interval)
+	return &Monitor{
+		conn:     conn,
+		wal:      wal,
+		drainer:  drainer,
+		capacity: capacity,
+		samples:  make([]sample, 0, capacity),
+	}
+}
+
+// Run samples the metrics until ctx is done
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	prev := takeSnapshot()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cur := takeSnapshot()
+		m.record(sample{
+			// the sample covers the interval that just ended
+			at:     utils.AlignToInterval(time.Now().Add(-Interval/2), Interval),
+			values: m.values(ctx, prev, cur),
+		})
+		prev = cur
+	}
+}
+
+func (m *Monitor) values(ctx context.Context, prev, cur snapshot) map[string]float64 {
+	seconds := Interval.Seconds()
+	values := make(map[string]float64)
+
+	var received float64
+	for _, o := range outcomes {
+		rate := (cur.spans[o] - prev.spans[o]) / seconds
+		values[outcomeSeriesPrefix+o] = rate
+		// replayed spans were already counted as buffered when they arrived
+		if o != "replayed" {
+			received += rate
+		}
+	}
+	values[spansReceived] = received
+
+	api := cur.api.Sub(prev.api)
+	values[apiRequests] = float64(api.Count) / seconds
+	values[apiAvgMs] = api.Mean() * 1000
+	values[apiP95Ms] = api.Quantile(0.95) * 1000
+	ch := cur.clickHouse.Sub(prev.clickHouse)
+	values[clickHouseAvgMs] = ch.Mean() * 1000
+	values[clickHouseP95Ms] = ch.Quantile(0.95) * 1000
+	values[insertP95Ms] = cur.insert.Sub(prev.insert).Quantile(0.95) * 1000
+	values[clickHouseErrors] = (cur.errors - prev.errors) / seconds
+
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	start := time.Now()
+	err := m.conn.Ping(pingCtx)
+	cancel()
+	if err == nil {
+		values[clickHouseUp] = 1
+		values[clickHousePingMs] = float64(time.Since(start).Microseconds()) / 1000
+	}
+
+	if m.wal != nil {
+		values[walBytes] = float64(m.wal.Size())
+	}
+	if m.drainer != nil {
+		values[inFlightExports] = float64(m.drainer.Status().InFlight)
+	}
+	return values
+}
+
+func (m *Monitor) record(s sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.samples) < m.capacity {
+		m.samples = append(m.samples, s)
+		return
+	}
+	m.samples[m.next] = s
+	m.next = (m.next + 1) % m.capacity
+}
+
+// series returns the padded series of each name over the date range, intervals
+// without a sample, e.g. before the instance started, are zero
+func (m *Monitor) series(dr utils.DateRange, names ...string) (map[string][]utils.TimePercentile, error) {
+	vals := make(map[string]map[time.Time]float64, len(names))
+	for _, name := range names {
+		vals[name] = make(map[time.Time]float64)
+	}
+	m.mu.Lock()
+	for _, s := range m.samples {
+		if s.at.Before(dr.Start.Add(-Interval)) || s.at.After(dr.End) {
+			continue
+		}
+		for _, name := range names {
+			vals[name][s.at] = s.values[name]
+		}
+	}
+	m.mu.Unlock()
+
+	series := make(map[string][]utils.TimePercentile, len(names))
+	for _, name := range names {
+		padded, err := utils.PadSeries(vals[name], intervalSQL, dr)
+		if err != nil {
+			return nil, err
+		}
+		series[name] = padded
+	}
+	return series, nil
+}
@@ -0,0 +1,137 @@
+package selftrace
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"go.opentelemetry.io/otel/trace"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// maxStatementLength keeps generated queries with long IN lists from bloating spans
+const maxStatementLength = 4096
+
+// tracedConn records a client span for every query run during a traced request
+type tracedConn struct {
+	driver.Conn
+}
+
+// InstrumentConn wraps conn so queries of traced requests get a span. The span
+// context is passed on to ClickHouse, whose own spans join the trace when its
+// opentelemetry_span_log is enabled.
+func InstrumentConn(conn clickhouse.Conn) clickhouse.Conn {
+	return &tracedConn{Conn: conn}
+}
+
+func startQuery(ctx context.Context, op, query string) (context.Context, *Span) {
+	ctx, span := startChild(ctx, "clickhouse "+op, tracepb.Span_SPAN_KIND_CLIENT)
+	if span == nil {
+		return ctx, nil
+	}
+	statement := strings.TrimSpace(query)
+	if len(statement) > maxStatementLength {
+		statement = statement[:maxStatementLength] + "..."
+	}
+	span.SetAttribute("db.system", "clickhouse")
+	span.SetAttribute("db.statement", statement)
+	if fields := strings.Fields(statement); len(fields) > 0 {
+		span.SetAttribute("db.operation", strings.ToUpper(fields[0]))
+	}
+
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	copy(traceID[:], span.span.TraceId)
+	copy(spanID[:], span.span.SpanId)
+	ctx = clickhouse.Context(ctx, clickhouse.WithSpan(trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})))
+	return ctx, span
+}
+
+func (c *tracedConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	ctx, span := startQuery(ctx, "query", query)
+	rows, err := c.Conn.Query(ctx, query, args...)
+	if err != nil || span == nil {
+		span.End(err)
+		return rows, err
+	}
+	return &tracedRows{Rows: rows, span: span}, nil
+}
+
+func (c *tracedConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	ctx, span := startQuery(ctx, "query", query)
+	return &tracedRow{Row: c.Conn.QueryRow(ctx, query, args...), span: span}
+}
+
+func (c *tracedConn) Exec(ctx context.Context, query string, args ...any) error {
+	ctx, span := startQuery(ctx, "exec", query)
+	err := c.Conn.Exec(ctx, query, args...)
+	span.End(err)
+	return err
+}
+
+func (c *tracedConn) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	ctx, span := startQuery(ctx, "batch", query)
+	batch, err := c.Conn.PrepareBatch(ctx, query, opts...)
+	if err != nil || span == nil {
+		span.End(err)
+		return batch, err
+	}
+	return &tracedBatch{Batch: batch, span: span}, nil
+}
+
+// tracedRows ends the span once the rows are read, streaming is part of the query
+type tracedRows struct {
+	driver.Rows
+	span *Span
+}
+
+func (r *tracedRows) Close() error {
+	err := r.Rows.Close()
+	if err == nil {
+		err = r.Rows.Err()
+	}
+	r.span.End(err)
+	return err
+}
+
+// tracedRow ends the span when the row is scanned, that's when QueryRow errors surface
+type tracedRow struct {
+	driver.Row
+	span *Span
+}
+
+func (r *tracedRow) Scan(dest ...any) error {
+	err := r.Row.Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		r.span.End(nil)
+	} else {
+		r.span.End(err)
+	}
+	return err
+}
+
+type tracedBatch struct {
+	driver.Batch
+	span *Span
+}
+
+func (b *tracedBatch) Send() error {
+	b.span.SetAttribute("db.rows", strconv.Itoa(b.Batch.Rows()))
+	err := b.Batch.Send()
+	b.span.End(err)
+	return err
+}
+
+func (b *tracedBatch) Abort() error {
+	err := b.Batch.Abort()
+	b.span.End(errors.New("batch aborted"))
+	return err
+}
@@ -0,0 +1,49 @@
+package selftrace
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Middleware traces every request of a chi router, continuing the caller's trace
+// when the request has a sampled traceparent header
+func Middleware(t *Tracer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if t == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceID, parentID := parseTraceparent(r.Header.Get("traceparent"))
+			ctx, span := t.startRoot(r.Context(), r.Method, traceID, parentID)
+			if span == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			// the route is only known once chi has routed the request
+			if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+				span.SetName(r.Method + " " + rctx.RoutePattern())
+				span.SetAttribute("http.route", rctx.RoutePattern())
+			}
+			span.SetAttribute("http.request.method", r.Method)
+			span.SetAttribute("url.path", r.URL.Path)
+			span.SetAttribute("url.query", r.URL.RawQuery)
+			span.SetAttribute("http.response.status_code", strconv.Itoa(status))
+			var err error
+			if status >= 500 {
+				err = fmt.Errorf("%d %s", status, http.StatusText(status))
+			}
+			span.End(err)
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package selftrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultServiceName is the service.name of nabatshy's own spans
+	DefaultServiceName = "nabatshy"
+	flushInterval      = 5 * time.Second
+	// maxPending drops spans instead of growing without bound while the endpoint is down
+	maxPending = 10000
+)
+
+// Tracer records spans of nabatshy's own handlers and queries and exports them as
+// OTLP to an endpoint, which may be nabatshy's own collector. A nil tracer records
+// nothing.
+type Tracer struct {
+	endpoint string
+	rate     float64
+	resource *resourcepb.Resource
+	client   *http.Client
+	mu       sync.Mutex
+	pending  []*tracepb.Span
+}
+
+func NewTracer(endpoint, service string, rate float64) *Tracer {
+	return &Tracer{
+		endpoint: endpoint,
+		rate:     rate,
+		resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttribute("service.name", service)}},
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ParseEndpoint parses the SELF_TRACE_ENDPOINT value, empty disables self-tracing
+// and "loopback" sends the spans to this process's collector at collectorURL
+func ParseEndpoint(s, collectorURL string) string {
+	if s == "loopback" {
+		return strings.TrimSuffix(collectorURL, "/") + "/v1/traces"
+	}
+	return s
+}
+
+// ParseRate parses the SELF_TRACE_RATE value, the fraction of requests traced,
+// empty traces every request
+func ParseRate(s string) (float64, error) {
+	if s == "" {
+		return 1, nil
+	}
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid self trace rate %q, use a fraction between 0 and 1", s)
+	}
+	return rate, nil
+}
+
+// Span is an in-progress span, nil spans ignore every call
+type Span struct {
+	tracer *Tracer
+	span   *tracepb.Span
+}
+
+type spanKey struct{}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// startRoot starts a span that continues the remote parent when traceID is set,
+// otherwise a new trace sampled at the tracer's rate
+func (t *Tracer) startRoot(ctx context.Context, name string, traceID, parentID []byte) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if traceID == nil {
+		if rand.Float64() >= t.rate {
+			return ctx, nil
+		}
+		traceID = randomID(16)
+	}
+	return t.start(ctx, name, tracepb.Span_SPAN_KIND_SERVER, traceID, parentID)
+}
+
+// startChild starts a span under the span of ctx, nothing is recorded outside of
+// a traced request
+func startChild(ctx context.Context, name string, kind tracepb.Span_SpanKind) (context.Context, *Span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.start(ctx, name, kind, parent.span.TraceId, parent.span.SpanId)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind tracepb.Span_SpanKind, traceID, parentID []byte) (context.Context, *Span) {
+	span := &Span{
+		tracer: t,
+		span: &tracepb.Span{
+			TraceId:           traceID,
+			SpanId:            randomID(8),
+			ParentSpanId:      parentID,
+			Name:              name,
+			Kind:              kind,
+			StartTimeUnixNano: uint64(time.Now().UnixNano()),
+		},
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *Span) SetName(name string) {
+	if s != nil {
+		s.span.Name = name
+	}
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s != nil {
+		s.span.Attributes = append(s.span.Attributes, stringAttribute(key, value))
+	}
+}
+
+// End finishes the span, a non-nil err marks it as failed. Only the first call counts.
+func (s *Span) End(err error) {
+	if s == nil || s.span.EndTimeUnixNano != 0 {
+		return
+	}
+	s.span.EndTimeUnixNano = uint64(time.Now().UnixNano())
+	if err != nil {
+		s.span.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: err.Error()}
+	}
+
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) < maxPending {
+		t.pending = append(t.pending, s.span)
+	}
+}
+
+// Run exports the finished spans every few seconds until ctx is done
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := t.flush(ctx); err != nil {
+			log.Printf("selftrace: failed to export spans: %v\n", err)
+		}
+	}
+}
+
+func (t *Tracer) flush(ctx context.Context) error {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := proto.Marshal(&coltrace.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: t.resource,
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: DefaultServiceName},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// parseTraceparent returns the trace and parent span IDs of a W3C traceparent
+// header, nil when it's missing, malformed or not sampled
+func parseTraceparent(header string) ([]byte, []byte) {
+	// version-traceid-parentid-flags, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	if len(header) != 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return nil, nil
+	}
+	traceID, err := hex.DecodeString(header[3:35])
+	if err != nil {
+		return nil, nil
+	}
+	parentID, err := hex.DecodeString(header[36:52])
+	if err != nil {
+		return nil, nil
+	}
+	flags, err := hex.DecodeString(header[53:55])
+	if err != nil || flags[0]&1 == 0 {
+		return nil, nil
+	}
+	return traceID, parentID
+}
+
+func randomID(n int) []byte {
+	id := make([]byte, n)
+	for i := 0; i < n; i += 8 {
+		binary.BigEndian.PutUint64(id[i:], rand.Uint64())
+	}
+	return id
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
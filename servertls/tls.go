@@ -0,0 +1,100 @@
+package servertls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultAutocertCacheDir is where certificates from Let's Encrypt are kept
+const DefaultAutocertCacheDir = "autocert"
+
+// Config returns the TLS config of the HTTP listeners, nil when TLS is off. With a
+// certificate and key files that certificate is served. With autocert hosts, a comma
+// separated list, certificates are requested from Let's Encrypt on the first
+// handshake using the TLS-ALPN-01 challenge, so a listener has to be on port 443.
+func Config(certFile, keyFile, autocertHosts, cacheDir string) (*tls.Config, error) {
+	hosts := parseHosts(autocertHosts)
+	switch {
+	case certFile == "" && keyFile == "" && len(hosts) == 0:
+		return nil, nil
+	case (certFile != "" || keyFile != "") && len(hosts) > 0:
+		return nil, errors.New("tls: set either a certificate or autocert hosts, not both")
+	case len(hosts) > 0:
+		if cacheDir == "" {
+			cacheDir = DefaultAutocertCacheDir
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(cacheDir),
+		}
+		cfg := m.TLSConfig()
+		cfg.MinVersion = tls.VersionTLS12
+		return cfg, nil
+	case certFile == "" || keyFile == "":
+		return nil, errors.New("tls: both a certificate and a key file are needed")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: failed to load certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func parseHosts(s string) []string {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// WithClientCAs returns a copy of cfg verifying client certificates against the CA
+// bundle in caFile. When require is false a connection without a certificate is
+// accepted, handlers are expected to check it with RequireClientCert.
+func WithClientCAs(cfg *tls.Config, caFile string, require bool) (*tls.Config, error) {
+	if cfg == nil {
+		return nil, errors.New("tls: client certificates need a certificate or autocert hosts")
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: failed to read client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates in client CA bundle %s", caFile)
+	}
+
+	cfg = cfg.Clone()
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if require {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// RequireClientCert rejects requests that didn't present a verified client
+// certificate, for listeners shared with clients that don't have one
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
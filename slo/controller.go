@@ -0,0 +1,194 @@
+package slo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"nabatshy/openapi"
+	"nabatshy/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type SLOController struct {
+	service   *SLOService
+	evaluator *Evaluator
+}
+
+// NewSLOController serves SLOs, status requests use the latest results of the
+// evaluator when it is set and has evaluated the SLO
+func NewSLOController(service *SLOService, evaluator *Evaluator) *SLOController {
+	return &SLOController{service: service, evaluator: evaluator}
+}
+
+func (c *SLOController) listSLOs(w http.ResponseWriter, r *http.Request) {
+	slos, err := c.service.ListSLOs(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list slos: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slos)
+}
+
+// findSLO writes the error response and returns false when the SLO can't be loaded
+func (c *SLOController) findSLO(w http.ResponseWriter, r *http.Request) (SLO, bool) {
+	slo, found, err := c.service.GetSLO(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get slo: %v", err), http.StatusInternalServerError)
+		return slo, false
+	}
+	if !found {
+		http.Error(w, "slo not found", http.StatusNotFound)
+		return slo, false
+	}
+	return slo, true
+}
+
+func (c *SLOController) getSLO(w http.ResponseWriter, r *http.Request) {
+	slo, ok := c.findSLO(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slo)
+}
+
+func (c *SLOController) createSLO(w http.ResponseWriter, r *http.Request) {
+	var slo SLO
+	if err := json.NewDecoder(r.Body).Decode(&slo); err != nil {
+		http.Error(w, "invalid slo: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	slo.ID = ""
+	if err := slo.Validate(); err != nil {
+		http.Error(w, "invalid slo: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveSLO(r.Context(), &slo); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create slo: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(slo)
+}
+
+func (c *SLOController) updateSLO(w http.ResponseWriter, r *http.Request) {
+	existing, ok := c.findSLO(w, r)
+	if !ok {
+		return
+	}
+
+	var slo SLO
+	if err := json.NewDecoder(r.Body).Decode(&slo); err != nil {
+		http.Error(w, "invalid slo: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	slo.ID = existing.ID
+	if err := slo.Validate(); err != nil {
+		http.Error(w, "invalid slo: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.service.SaveSLO(r.Context(), &slo); err != nil {
+		http.Error(w, fmt.Sprintf("failed to update slo: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slo)
+}
+
+func (c *SLOController) deleteSLO(w http.ResponseWriter, r *http.Request) {
+	if err := c.service.DeleteSLO(r.Context(), chi.URLParam(r, "id")); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete slo: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *SLOController) listStatuses(w http.ResponseWriter, r *http.Request) {
+	statuses := []Status{}
+	if c.evaluator != nil {
+		statuses = c.evaluator.Statuses()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func (c *SLOController) getStatus(w http.ResponseWriter, r *http.Request) {
+	slo, ok := c.findSLO(w, r)
+	if !ok {
+		return
+	}
+
+	status, cached := Status{}, false
+	if c.evaluator != nil && r.URL.Query().Get("fresh") != "true" {
+		status, cached = c.evaluator.Status(slo.ID)
+	}
+	if !cached {
+		var err error
+		status, err = c.service.GetStatus(r.Context(), slo, time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get slo status: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (c *SLOController) getBurnRate(w http.ResponseWriter, r *http.Request) {
+	dr, err := utils.ParseDateRange(r.URL.Query(), "start", "end", "timeRange")
+	if err != nil {
+		http.Error(w, "invalid date range", http.StatusBadRequest)
+		return
+	}
+	slo, ok := c.findSLO(w, r)
+	if !ok {
+		return
+	}
+
+	series, err := c.service.GetBurnRateSeries(r.Context(), slo, dr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get burn rate: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+func (c *SLOController) Operations() []openapi.Operation {
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/v1/slos", Summary: "SLOs", Response: []SLO{}},
+		{Method: http.MethodPost, Path: "/v1/slos", Summary: "Create an SLO", Request: SLO{}, Response: SLO{}, Status: http.StatusCreated},
+		{Method: http.MethodGet, Path: "/v1/slos/status", Summary: "The last evaluated status of every SLO", Response: []Status{}},
+		{Method: http.MethodGet, Path: "/v1/slos/{id}", Summary: "An SLO", Response: SLO{}},
+		{Method: http.MethodPut, Path: "/v1/slos/{id}", Summary: "Update an SLO", Request: SLO{}, Response: SLO{}},
+		{Method: http.MethodDelete, Path: "/v1/slos/{id}", Summary: "Delete an SLO", Status: http.StatusNoContent},
+		{Method: http.MethodGet, Path: "/v1/slos/{id}/status", Summary: "Status of an SLO", Response: Status{},
+			Query: []openapi.Param{{Name: "fresh", Type: "boolean", Description: "evaluate the SLO instead of returning the last evaluation"}}},
+		{Method: http.MethodGet, Path: "/v1/slos/{id}/burn-rate", Summary: "Error budget burn rate of an SLO over time", Response: []utils.TimePercentile{}, Query: openapi.DateRange},
+	}
+}
+
+func (c *SLOController) RegisterRoutes(r chi.Router) {
+	r.Get("/v1/slos", c.listSLOs)
+	r.Post("/v1/slos", c.createSLO)
+	r.Get("/v1/slos/status", c.listStatuses)
+	r.Get("/v1/slos/{id}", c.getSLO)
+	r.Put("/v1/slos/{id}", c.updateSLO)
+	r.Delete("/v1/slos/{id}", c.deleteSLO)
+	r.Get("/v1/slos/{id}/status", c.getStatus)
+	r.Get("/v1/slos/{id}/burn-rate", c.getBurnRate)
+}
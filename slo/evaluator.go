@@ -0,0 +1,84 @@
+package slo
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Evaluator periodically computes the status of every SLO and keeps the latest
+// results so status requests don't scan the whole SLO window
+type Evaluator struct {
+	service  *SLOService
+	interval time.Duration
+
+	mu       sync.RWMutex
+	statuses map[string]Status
+}
+
+func NewEvaluator(service *SLOService, interval time.Duration) *Evaluator {
+	return &Evaluator{
+		service:  service,
+		interval: interval,
+		statuses: make(map[string]Status),
+	}
+}
+
+// Run evaluates the SLOs every interval until ctx is done
+func (e *Evaluator) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.evaluateAll(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the latest computed status of an SLO
+func (e *Evaluator) Status(id string) (Status, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	status, ok := e.statuses[id]
+	return status, ok
+}
+
+// Statuses returns the latest computed status of every SLO
+func (e *Evaluator) Statuses() []Status {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	statuses := make([]Status, 0, len(e.statuses))
+	for _, s := range e.statuses {
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+func (e *Evaluator) evaluateAll(ctx context.Context, now time.Time) {
+	slos, err := e.service.ListSLOs(ctx)
+	if err != nil {
+		log.Printf("slo: failed to list slos: %v\n", err)
+		return
+	}
+
+	statuses := make(map[string]Status, len(slos))
+	for _, slo := range slos {
+		status, err := e.service.GetStatus(ctx, slo, now)
+		if err != nil {
+			log.Printf("slo: failed to evaluate %s: %v\n", slo.Name, err)
+			continue
+		}
+		if previous, ok := e.Status(slo.ID); status.BudgetRemaining <= 0 && (!ok || previous.BudgetRemaining > 0) {
+			log.Printf("slo: error budget of %s is exhausted (sli %.3f%%, target %.3f%%)\n", slo.Name, status.SLI, slo.Target)
+		}
+		statuses[slo.ID] = status
+	}
+
+	e.mu.Lock()
+	e.statuses = statuses
+	e.mu.Unlock()
+}
@@ -0,0 +1,25 @@
+package slo
+
+import (
+	"nabatshy/provision"
+)
+
+// NewProvider manages SLOs from the "slos" section of a provisioning
+// file. SLOs are matched by name.
+func NewProvider(s *SLOService) provision.Provider {
+	return &provision.DocumentProvider[SLO, *SLO]{
+		Section: "slos",
+		Noun:    "slo",
+		List:    s.ListSLOs,
+		Save:    s.SaveSLO,
+		Delete:  s.DeleteSLO,
+	}
+}
+
+func (s *SLO) DocumentName() string { return s.Name }
+
+func (s *SLO) DocumentID() string { return s.ID }
+
+func (s *SLO) Adopt(current SLO) {
+	s.ID, s.UpdatedAt = current.ID, current.UpdatedAt
+}
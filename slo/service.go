@@ -0,0 +1,232 @@
+package slo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"nabatshy/db"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/google/uuid"
+)
+
+const slosTable = "slos"
+
+// SLO objectives
+const (
+	ObjectiveAvailability = "availability" // spans without an exception event
+	ObjectiveLatency      = "latency"      // spans faster than the latency threshold
+)
+
+type SLO struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Service string `json:"service"`
+	// Endpoint restricts the SLO to spans with this name, all spans of the service
+	// count when empty
+	Endpoint  string `json:"endpoint,omitempty"`
+	Objective string `json:"objective"`
+	// Target is the percentage of good spans, e.g. 99.9
+	Target float64 `json:"target"`
+	// LatencyThreshold in milliseconds, spans slower than this are bad for latency objectives
+	LatencyThreshold float64   `json:"latency_threshold_ms,omitempty"`
+	Window           string    `json:"window"` // e.g. "30d"
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// Status is the state of an SLO's error budget over its window
+type Status struct {
+	SLOID string `json:"slo_id"`
+	Name  string `json:"name"`
+	Total uint64 `json:"total"`
+	Bad   uint64 `json:"bad"`
+	// SLI is the percentage of good spans over the window, 100 when there were no spans
+	SLI float64 `json:"sli"`
+	// BudgetConsumed is the fraction of the error budget used, above 1 once exhausted
+	BudgetConsumed  float64 `json:"budget_consumed"`
+	BudgetRemaining float64 `json:"budget_remaining"`
+	// BurnRate is how fast the budget was used in the last hour, 1 uses it up exactly over the window
+	BurnRate  float64   `json:"burn_rate"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SLOService struct {
+	Ch *clickhouse.Conn
+	DB *goqu.DialectWrapper
+}
+
+// Validate checks the SLO and fills in defaults
+func (s *SLO) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Service == "" {
+		return fmt.Errorf("service is required")
+	}
+	switch s.Objective {
+	case ObjectiveAvailability:
+	case ObjectiveLatency:
+		if s.LatencyThreshold <= 0 {
+			return fmt.Errorf("latency_threshold_ms is required for latency objectives")
+		}
+	default:
+		return fmt.Errorf("invalid objective %q, use %q or %q", s.Objective, ObjectiveAvailability, ObjectiveLatency)
+	}
+	if s.Target <= 0 || s.Target >= 100 {
+		return fmt.Errorf("target must be between 0 and 100 exclusive")
+	}
+	if s.Window == "" {
+		s.Window = "30d"
+	}
+	if _, err := utils.ParseTimeRange(s.Window); err != nil {
+		return fmt.Errorf("invalid window: %w", err)
+	}
+	return nil
+}
+
+func (s *SLOService) ListSLOs(ctx context.Context) ([]SLO, error) {
+	return db.ListDocuments[SLO](ctx, *s.Ch, slosTable)
+}
+
+func (s *SLOService) GetSLO(ctx context.Context, id string) (SLO, bool, error) {
+	return db.GetDocument[SLO](ctx, *s.Ch, slosTable, id)
+}
+
+// SaveSLO creates the SLO when it has no ID, otherwise replaces it
+func (s *SLOService) SaveSLO(ctx context.Context, slo *SLO) error {
+	if err := slo.Validate(); err != nil {
+		return err
+	}
+	if slo.ID == "" {
+		slo.ID = uuid.New().String()
+	}
+	slo.UpdatedAt = time.Now().UTC()
+	return db.PutDocument(ctx, *s.Ch, slosTable, slo.ID, slo.Name, slo)
+}
+
+func (s *SLOService) DeleteSLO(ctx context.Context, id string) error {
+	return db.DeleteDocument(ctx, *s.Ch, slosTable, id)
+}
+
+// badExpression is a ClickHouse boolean expression matching spans that count against the SLO
+func badExpression(slo SLO) goqu.Expression {
+	if slo.Objective == ObjectiveLatency {
+		return goqu.L("duration_ns / 1000000 > ?", slo.LatencyThreshold)
+	}
+	return goqu.L("has(events.name, 'exception')")
+}
+
+func (s *SLOService) spans(slo SLO, start, end time.Time) *goqu.SelectDataset {
+	ds := s.DB.
+		From("denormalized_span").
+		Where(
+			goqu.C("scope_name").Eq(slo.Service),
+			goqu.C("start_time_unix_nano").Gte(start.UnixNano()),
+			goqu.C("start_time_unix_nano").Lt(end.UnixNano()),
+		)
+	if slo.Endpoint != "" {
+		ds = ds.Where(goqu.C("name").Eq(slo.Endpoint))
+	}
+	return ds
+}
+
+// spanCounts selects the number of spans and bad spans of the SLO, each span once
+// as a span may be stored twice, see api.uniqueSpans
+func spanCounts(slo SLO) []any {
+	return []any{
+		goqu.L("uniqExact(trace_id, span_id)"),
+		goqu.L("uniqExactIf(trace_id, span_id, ?)", badExpression(slo)),
+	}
+}
+
+// counts returns the number of spans and bad spans of the SLO between start and end
+func (s *SLOService) counts(ctx context.Context, slo SLO, start, end time.Time) (total, bad uint64, err error) {
+	ds := s.spans(slo, start, end).Select(spanCounts(slo)...)
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := (*s.Ch).QueryRow(ctx, sqlStr, args...).Scan(&total, &bad); err != nil {
+		return 0, 0, fmt.Errorf("failed to query slo counts: %w", err)
+	}
+	return total, bad, nil
+}
+
+// burnRate is the bad span ratio relative to the ratio the target allows
+func burnRate(slo SLO, total, bad uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / (1 - slo.Target/100)
+}
+
+// GetStatus computes the error budget of the SLO over its window ending at now
+func (s *SLOService) GetStatus(ctx context.Context, slo SLO, now time.Time) (Status, error) {
+	window, err := utils.ParseTimeRange(slo.Window)
+	if err != nil {
+		return Status{}, err
+	}
+
+	total, bad, err := s.counts(ctx, slo, now.Add(-window), now)
+	if err != nil {
+		return Status{}, err
+	}
+	recentTotal, recentBad, err := s.counts(ctx, slo, now.Add(-time.Hour), now)
+	if err != nil {
+		return Status{}, err
+	}
+
+	status := Status{
+		SLOID:     slo.ID,
+		Name:      slo.Name,
+		Total:     total,
+		Bad:       bad,
+		SLI:       100,
+		BurnRate:  burnRate(slo, recentTotal, recentBad),
+		UpdatedAt: now,
+	}
+	if total > 0 {
+		status.SLI = float64(total-bad) / float64(total) * 100
+	}
+	status.BudgetConsumed = burnRate(slo, total, bad)
+	status.BudgetRemaining = 1 - status.BudgetConsumed
+	return status, nil
+}
+
+// GetBurnRateSeries returns the burn rate of the SLO per interval over the date range
+func (s *SLOService) GetBurnRateSeries(ctx context.Context, slo SLO, dateRange utils.DateRange) ([]utils.TimePercentile, error) {
+	intervalSQL := utils.GetIntervalFromDateRange(dateRange)
+	columns := append([]any{
+		goqu.L(fmt.Sprintf("toStartOfInterval(fromUnixTimestamp64Nano(start_time_unix_nano), INTERVAL %s)", intervalSQL)).As("ts"),
+	}, spanCounts(slo)...)
+	ds := s.spans(slo, dateRange.Start, dateRange.End).
+		Select(columns...).
+		GroupBy(goqu.C("ts"))
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	rates := make(map[time.Time]float64)
+	for rows.Next() {
+		var ts time.Time
+		var total, bad uint64
+		if err := rows.Scan(&ts, &total, &bad); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		rates[ts] = burnRate(slo, total, bad)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return utils.PadSeries(rates, intervalSQL, dateRange)
+}
@@ -0,0 +1,203 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/doug-martin/goqu/v9"
+)
+
+const (
+	FlavorStatsD    = "statsd"
+	FlavorDogStatsD = "dogstatsd"
+
+	DefaultPrefix   = "nabatshy"
+	DefaultInterval = time.Minute
+
+	// ingestLag delays every window so late spans are counted in it
+	ingestLag = 30 * time.Second
+	// maxPacketSize keeps packets under the usual MTU so they aren't fragmented
+	maxPacketSize = 1432
+)
+
+// ServiceStats are the metrics of one service over an export interval
+type ServiceStats struct {
+	Service string
+	Spans   uint64
+	Errors  uint64
+	P95Ms   float64
+}
+
+// Exporter pushes per-service throughput, p95 latency and error rate to a StatsD
+// or DogStatsD agent over UDP. Plain StatsD gets the service in the metric name,
+// e.g. nabatshy.checkout.p95_ms, DogStatsD gets it as a service tag.
+type Exporter struct {
+	Ch       *clickhouse.Conn
+	DB       *goqu.DialectWrapper
+	Addr     string
+	Flavor   string
+	Prefix   string
+	Interval time.Duration
+}
+
+// ParseFlavor parses the STATSD_FLAVOR value, empty means dogstatsd
+func ParseFlavor(s string) (string, error) {
+	switch s {
+	case "", FlavorDogStatsD:
+		return FlavorDogStatsD, nil
+	case FlavorStatsD:
+		return FlavorStatsD, nil
+	}
+	return "", fmt.Errorf("invalid statsd flavor %q, use statsd or dogstatsd", s)
+}
+
+// ParseInterval parses the STATSD_INTERVAL value, empty means a minute
+func ParseInterval(s string) (time.Duration, error) {
+	if s == "" {
+		return DefaultInterval, nil
+	}
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval < time.Second {
+		return 0, fmt.Errorf("invalid statsd interval %q, use a duration of at least 1s", s)
+	}
+	return interval, nil
+}
+
+// Run exports the metrics of every interval until ctx is done
+func (e *Exporter) Run(ctx context.Context) {
+	conn, err := net.Dial("udp", e.Addr)
+	if err != nil {
+		log.Printf("statsd: failed to dial %s: %v\n", e.Addr, err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	end := time.Now().Add(-ingestLag).Truncate(e.Interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// catch up on the windows that passed, e.g. after a slow query
+		for next := end.Add(e.Interval); !next.After(time.Now().Add(-ingestLag)); next = next.Add(e.Interval) {
+			if err := e.export(ctx, conn, end, next); err != nil {
+				log.Printf("statsd: failed to export metrics: %v\n", err)
+			}
+			end = next
+		}
+	}
+}
+
+func (e *Exporter) export(ctx context.Context, conn net.Conn, start, end time.Time) error {
+	stats, err := e.Stats(ctx, start, end)
+	if err != nil {
+		return err
+	}
+
+	var packet strings.Builder
+	for _, line := range e.lines(stats, end.Sub(start)) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			if _, err := conn.Write([]byte(packet.String())); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, err = conn.Write([]byte(packet.String()))
+	}
+	return err
+}
+
+// Stats computes the metrics of every service with spans between start and end
+func (e *Exporter) Stats(ctx context.Context, start, end time.Time) ([]ServiceStats, error) {
+	ds := e.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("scope_name"),
+			goqu.L("count()"),
+			goqu.L("countIf(has(events.name, 'exception'))"),
+			goqu.L("quantile(0.95)(duration_ns / 1000000)"),
+		).
+		Where(
+			goqu.C("start_time_unix_nano").Gte(start.UnixNano()),
+			goqu.C("start_time_unix_nano").Lt(end.UnixNano()),
+		).
+		GroupBy(goqu.C("scope_name"))
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*e.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []ServiceStats
+	for rows.Next() {
+		var s ServiceStats
+		if err := rows.Scan(&s.Service, &s.Spans, &s.Errors, &s.P95Ms); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// lines formats the stats as StatsD lines
+func (e *Exporter) lines(stats []ServiceStats, window time.Duration) []string {
+	var lines []string
+	for _, s := range stats {
+		errorRate := 0.0
+		if s.Spans > 0 {
+			errorRate = float64(s.Errors) / float64(s.Spans) * 100
+		}
+		metrics := []struct {
+			name  string
+			value string
+			typ   string
+		}{
+			{"spans", fmt.Sprint(s.Spans), "c"},
+			{"errors", fmt.Sprint(s.Errors), "c"},
+			{"throughput", fmt.Sprintf("%.3f", float64(s.Spans)/window.Seconds()), "g"},
+			{"p95_ms", fmt.Sprintf("%.3f", s.P95Ms), "g"},
+			{"error_rate", fmt.Sprintf("%.3f", errorRate), "g"},
+		}
+		service := sanitize(s.Service)
+		for _, m := range metrics {
+			if e.Flavor == FlavorStatsD {
+				lines = append(lines, fmt.Sprintf("%s.%s.%s:%s|%s", e.Prefix, service, m.name, m.value, m.typ))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s.%s:%s|%s|#service:%s", e.Prefix, m.name, m.value, m.typ, service))
+			}
+		}
+	}
+	return lines
+}
+
+// sanitize replaces the characters StatsD uses as separators in names and tags
+func sanitize(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
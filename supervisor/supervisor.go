@@ -0,0 +1,297 @@
+package supervisor
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nabatshy/health"
+)
+
+const (
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateStopped    = "stopped"
+	StateFailed     = "failed"
+
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	// shutdownTimeout is how long servers get to finish in-flight requests
+	shutdownTimeout = 10 * time.Second
+)
+
+// Component is a long running part of the process, like a server or a background loop
+type Component struct {
+	Name string
+	// Start prepares the component, e.g. binds its listener, it may be nil.
+	// Components are started one after the other in the order they're added.
+	Start func(ctx context.Context) error
+	// Run runs the component until ctx is done
+	Run func(ctx context.Context) error
+	// Restart restarts the component with a backoff when Run fails or panics,
+	// otherwise a failure stops the whole process
+	Restart bool
+}
+
+// Status is the state of a component
+type Status struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// Supervisor runs components like an errgroup: the first component that fails for
+// good cancels the context of the others and is returned by Wait. Recoverable
+// components are restarted instead, a panic counts as a failure.
+type Supervisor struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	status map[string]*Status
+}
+
+// New returns a supervisor whose components stop when ctx is done
+func New(ctx context.Context) *Supervisor {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &Supervisor{ctx: ctx, cancel: cancel, status: make(map[string]*Status)}
+}
+
+// Context is done once the supervisor stops
+func (s *Supervisor) Context() context.Context {
+	return s.ctx
+}
+
+// Add starts c, Start runs before Add returns so the next component only starts
+// once c is ready. A failing Start stops the supervisor.
+func (s *Supervisor) Add(c Component) error {
+	if c.Start != nil {
+		if err := c.Start(s.ctx); err != nil {
+			err = fmt.Errorf("%s: %w", c.Name, err)
+			s.setStatus(c.Name, StateFailed, err)
+			s.cancel(err)
+			return err
+		}
+	}
+	s.setStatus(c.Name, StateRunning, nil)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.supervise(c)
+	}()
+	return nil
+}
+
+func (s *Supervisor) supervise(c Component) {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := run(s.ctx, c)
+		if s.ctx.Err() != nil {
+			s.setStatus(c.Name, StateStopped, nil)
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped unexpectedly")
+		}
+		err = fmt.Errorf("%s: %w", c.Name, err)
+		if !c.Restart {
+			s.setStatus(c.Name, StateFailed, err)
+			s.cancel(err)
+			return
+		}
+
+		// a component that ran for a while failed for a new reason
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		log.Printf("supervisor: %v, restarting in %s\n", err, backoff)
+		s.setStatus(c.Name, StateRestarting, err)
+		select {
+		case <-s.ctx.Done():
+			s.setStatus(c.Name, StateStopped, nil)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+		s.setStatus(c.Name, StateRunning, nil)
+	}
+}
+
+// run calls c.Run, turning a panic into an error
+func run(ctx context.Context, c Component) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.Run(ctx)
+}
+
+func (s *Supervisor) setStatus(name, state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.status[name]
+	if !ok {
+		st = &Status{Name: name}
+		s.status[name] = st
+	}
+	if state == StateRunning && st.State == StateRestarting {
+		st.Restarts++
+	}
+	if st.State != state {
+		st.Since = time.Now().UTC()
+	}
+	st.State = state
+	if err != nil {
+		st.LastError = err.Error()
+	}
+}
+
+// Statuses returns the state of every component by name
+func (s *Supervisor) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]Status, 0, len(s.status))
+	for _, st := range s.status {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Check fails while a component isn't running
+func (s *Supervisor) Check() health.Check {
+	return health.Check{Name: "components", Run: func(ctx context.Context) error {
+		var down []string
+		for _, st := range s.Statuses() {
+			if st.State != StateRunning {
+				down = append(down, fmt.Sprintf("%s is %s", st.Name, st.State))
+			}
+		}
+		if len(down) > 0 {
+			return errors.New(strings.Join(down, ", "))
+		}
+		return nil
+	}}
+}
+
+// Wait stops the components once one fails for good or the parent context is
+// done, it returns the failure
+func (s *Supervisor) Wait() error {
+	<-s.ctx.Done()
+	s.wg.Wait()
+	if err := context.Cause(s.ctx); !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// Loop is a restarted component for background loops that run until ctx is done
+func Loop(name string, loop func(ctx context.Context)) Component {
+	return Component{
+		Name: name,
+		Run: func(ctx context.Context) error {
+			loop(ctx)
+			return nil
+		},
+		Restart: true,
+	}
+}
+
+// HTTPServer is a component serving handler on addr. The address is bound when the
+// component starts, and in-flight requests are given time to finish on shutdown.
+// It serves HTTPS when tlsConfig isn't nil.
+func HTTPServer(name, addr string, handler http.Handler, tlsConfig *tls.Config) Component {
+	var ln net.Listener
+	server := &http.Server{Addr: addr, Handler: handler}
+	return Component{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			var err error
+			if ln, err = net.Listen("tcp", addr); err != nil {
+				return err
+			}
+			if tlsConfig != nil {
+				ln = tls.NewListener(ln, tlsConfig)
+				log.Printf("%s listening on %s (https)\n", name, addr)
+				return nil
+			}
+			log.Printf("%s listening on %s\n", name, addr)
+			return nil
+		},
+		Run: func(ctx context.Context) error {
+			errc := make(chan error, 1)
+			go func() { errc <- server.Serve(ln) }()
+			select {
+			case err := <-errc:
+				return err
+			case <-ctx.Done():
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer cancel()
+				return server.Shutdown(shutdownCtx)
+			}
+		},
+	}
+}
+
+// GracefulServer is the part of a *grpc.Server that GRPCServer runs
+type GracefulServer interface {
+	Serve(ln net.Listener) error
+	GracefulStop()
+	Stop()
+}
+
+// GRPCServer returns a component serving server on addr, TLS is set up by the
+// server's credentials. Calls still running after the shutdown timeout, like long
+// streams, are canceled.
+func GRPCServer(name, addr string, server GracefulServer, secure bool) Component {
+	var ln net.Listener
+	return Component{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			var err error
+			if ln, err = net.Listen("tcp", addr); err != nil {
+				return err
+			}
+			if secure {
+				log.Printf("%s listening on %s (grpc, tls)\n", name, addr)
+				return nil
+			}
+			log.Printf("%s listening on %s (grpc)\n", name, addr)
+			return nil
+		},
+		Run: func(ctx context.Context) error {
+			errc := make(chan error, 1)
+			go func() { errc <- server.Serve(ln) }()
+			select {
+			case err := <-errc:
+				return err
+			case <-ctx.Done():
+				stopped := make(chan struct{})
+				go func() {
+					server.GracefulStop()
+					close(stopped)
+				}()
+				select {
+				case <-stopped:
+				case <-time.After(shutdownTimeout):
+					server.Stop()
+				}
+				return nil
+			}
+		},
+	}
+}
@@ -0,0 +1,278 @@
+package tempo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nabatshy/openapi"
+
+	"github.com/go-chi/chi/v5"
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultSearchWindow is searched when a request has no start and end
+const defaultSearchWindow = time.Hour
+
+// TempoController serves the subset of the Grafana Tempo HTTP API the Tempo
+// datasource uses: trace lookup, search and tag autocompletion
+type TempoController struct {
+	service *TempoService
+}
+
+func NewTempoController(service *TempoService) *TempoController {
+	return &TempoController{service: service}
+}
+
+// parseRange reads the start and end parameters, Tempo uses unix seconds
+func parseRange(q url.Values) (time.Time, time.Time, error) {
+	end := time.Now()
+	start := end.Add(-defaultSearchWindow)
+	if s := q.Get("start"); s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid start")
+		}
+		start = time.Unix(sec, 0)
+	}
+	if e := q.Get("end"); e != "" {
+		sec, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid end")
+		}
+		end = time.Unix(sec, 0)
+	}
+	return start, end, nil
+}
+
+func (c *TempoController) echo(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("echo"))
+}
+
+// getTrace returns the trace as a tempopb.Trace, whose only field is the batches
+// of resource spans, so it's encoded like an OTLP export request
+func (c *TempoController) getTrace(w http.ResponseWriter, r *http.Request) {
+	batches, err := c.service.GetTrace(r.Context(), chi.URLParam(r, "trace_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(batches) == 0 {
+		http.Error(w, "trace not found", http.StatusNotFound)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/protobuf") {
+		out, err := proto.Marshal(&coltrace.ExportTraceServiceRequest{ResourceSpans: batches})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode trace: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/protobuf")
+		w.Write(out)
+		return
+	}
+
+	encoded := make([]json.RawMessage, len(batches))
+	for i, b := range batches {
+		if encoded[i], err = protojson.Marshal(b); err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode trace: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"batches": encoded})
+}
+
+func (c *TempoController) search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end, err := parseRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := SearchRequest{Start: start, End: end, Limit: 20}
+
+	if traceQL := q.Get("q"); traceQL != "" {
+		if req.Conditions, err = parseTraceQL(traceQL); err != nil {
+			http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if tags := q.Get("tags"); tags != "" {
+		conds, err := parseTags(tags)
+		if err != nil {
+			http.Error(w, "invalid tags: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Conditions = append(req.Conditions, conds...)
+	}
+	if v := q.Get("minDuration"); v != "" {
+		if req.MinDuration, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "invalid minDuration", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("maxDuration"); v != "" {
+		if req.MaxDuration, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "invalid maxDuration", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || limit == 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		req.Limit = uint(limit)
+	}
+
+	traces, err := c.service.Search(r.Context(), req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to search traces: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"traces": traces})
+}
+
+func (c *TempoController) tagNames(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names, err := c.service.TagNames(r.Context(), start, end)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get tag names: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/api/search/tags" {
+		// v1 has no scopes, the tags search matches attributes of either scope
+		var all []string
+		seen := make(map[string]bool)
+		for _, scope := range []string{scopeResource, scopeSpan} {
+			for _, name := range names[scope] {
+				if !seen[name] {
+					seen[name] = true
+					all = append(all, name)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"tagNames": all})
+		return
+	}
+
+	type scopeTags struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	var scopes []scopeTags
+	for _, scope := range []string{scopeResource, scopeSpan, scopeIntrinsic} {
+		scopes = append(scopes, scopeTags{Name: scope, Tags: names[scope]})
+	}
+	json.NewEncoder(w).Encode(map[string]any{"scopes": scopes})
+}
+
+func (c *TempoController) tagValues(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag := chi.URLParam(r, "tag")
+	v2 := strings.HasPrefix(r.URL.Path, "/api/v2/")
+	if !v2 {
+		// v1 tags are unscoped attribute names
+		tag = "." + tag
+	}
+	values, err := c.service.TagValues(r.Context(), tag, start, end)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get tag values: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !v2 {
+		json.NewEncoder(w).Encode(map[string]any{"tagValues": values})
+		return
+	}
+	type typedValue struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	typed := make([]typedValue, len(values))
+	for i, v := range values {
+		typed[i] = typedValue{Type: "string", Value: v}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"tagValues": typed})
+}
+
+func (c *TempoController) Operations() []openapi.Operation {
+	rangeParams := []openapi.Param{
+		{Name: "start", Type: "integer", Description: "unix seconds, an hour before end by default"},
+		{Name: "end", Type: "integer", Description: "unix seconds, now by default"},
+	}
+	tagNames := struct {
+		TagNames []string `json:"tagNames"`
+	}{}
+	scopes := struct {
+		Scopes []struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		} `json:"scopes"`
+	}{}
+	tagValues := struct {
+		TagValues []string `json:"tagValues"`
+	}{}
+	typedValues := struct {
+		TagValues []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"tagValues"`
+	}{}
+	return []openapi.Operation{
+		{Method: http.MethodGet, Path: "/api/echo", Summary: "Tempo datasource connection test", ContentType: "text/plain"},
+		{Method: http.MethodGet, Path: "/api/traces/{trace_id}", Summary: "A trace as Tempo returns it",
+			Description: "The batches of resource spans of the trace in OTLP JSON, or as protobuf with Accept: application/protobuf",
+			Response: struct {
+				Batches []json.RawMessage `json:"batches"`
+			}{}},
+		{Method: http.MethodGet, Path: "/api/search", Summary: "Search traces like Tempo",
+			Response: struct {
+				Traces []TraceSearchMetadata `json:"traces"`
+			}{},
+			Query: append([]openapi.Param{
+				{Name: "q", Description: "TraceQL query"},
+				{Name: "tags", Description: "logfmt encoded tags like service.name=api"},
+				{Name: "minDuration", Description: "duration like 100ms"},
+				{Name: "maxDuration", Description: "duration like 1s"},
+				{Name: "limit", Type: "integer", Description: "20 by default"},
+			}, rangeParams...)},
+		{Method: http.MethodGet, Path: "/api/search/tags", Summary: "Attribute names", Response: tagNames, Query: rangeParams},
+		{Method: http.MethodGet, Path: "/api/v2/search/tags", Summary: "Attribute names by scope", Response: scopes, Query: rangeParams},
+		{Method: http.MethodGet, Path: "/api/search/tag/{tag}/values", Summary: "Values of an attribute", Response: tagValues, Query: rangeParams},
+		{Method: http.MethodGet, Path: "/api/v2/search/tag/{tag}/values", Summary: "Values of a scoped attribute like .http.route",
+			Response: typedValues, Query: rangeParams},
+	}
+}
+
+func (c *TempoController) RegisterRoutes(r chi.Router) {
+	r.Get("/api/echo", c.echo)
+	r.Get("/api/traces/{trace_id}", c.getTrace)
+	r.Get("/api/search", c.search)
+	r.Get("/api/search/tags", c.tagNames)
+	r.Get("/api/v2/search/tags", c.tagNames)
+	r.Get("/api/search/tag/{tag}/values", c.tagValues)
+	r.Get("/api/v2/search/tag/{tag}/values", c.tagValues)
+}
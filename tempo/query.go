@@ -0,0 +1,189 @@
+package tempo
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes of a condition, "" matches span or resource attributes
+const (
+	scopeResource  = "resource"
+	scopeSpan      = "span"
+	scopeIntrinsic = "intrinsic"
+)
+
+// intrinsics are the span fields that aren't attributes
+var intrinsics = []string{"name", "status", "kind", "duration"}
+
+// condition matches spans, a trace matches when one of its spans matches all conditions
+type condition struct {
+	scope string
+	key   string
+	op    string // "=", "!=", ">", ">=", "<" or "<="
+	value string
+}
+
+var clausePattern = regexp.MustCompile(`^([\w.\-]+)\s*(=|!=|>=|<=|>|<)\s*("(?:[^"\\]|\\.)*"|\S+)$`)
+
+// parseTraceQL supports the subset of TraceQL Grafana's search builder produces:
+// one spanset of conditions joined with &&, e.g.
+//
+//	{resource.service.name="api" && span.http.status_code>=500 && duration>1s}
+func parseTraceQL(q string) ([]condition, error) {
+	q = strings.TrimSpace(q)
+	if !strings.HasPrefix(q, "{") || !strings.HasSuffix(q, "}") {
+		return nil, fmt.Errorf("only a single spanset like {span.key=\"value\"} is supported")
+	}
+	inner := strings.TrimSpace(q[1 : len(q)-1])
+	if inner == "" {
+		return nil, nil
+	}
+
+	var conds []condition
+	for _, clause := range splitClauses(inner) {
+		clause = strings.TrimSpace(clause)
+		m := clausePattern.FindStringSubmatch(clause)
+		if m == nil {
+			return nil, fmt.Errorf("unsupported condition %q, only && of comparisons is supported", clause)
+		}
+		c, err := newCondition(m[1], m[2], m[3])
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, c)
+	}
+	return conds, nil
+}
+
+// splitClauses splits on && outside of quoted values
+func splitClauses(s string) []string {
+	var clauses []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(s[i:], "&&"):
+			clauses = append(clauses, s[start:i])
+			start = i + 2
+			i++
+		}
+	}
+	return append(clauses, s[start:])
+}
+
+// parseTags parses the logfmt tags of the search API, e.g. service.name=api name="GET /"
+func parseTags(tags string) ([]condition, error) {
+	var conds []condition
+	for _, pair := range splitLogfmt(tags) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid tag %q, use key=value", pair)
+		}
+		if key == "status.code" {
+			key = "status"
+		}
+		c, err := newCondition(key, "=", value)
+		if err != nil {
+			return nil, err
+		}
+		// tags are unscoped attribute names, only name and status are intrinsics
+		if key != "name" && key != "status" {
+			c.scope, c.key = "", key
+		}
+		conds = append(conds, c)
+	}
+	return conds, nil
+}
+
+// splitLogfmt splits on spaces outside of quoted values
+func splitLogfmt(s string) []string {
+	var pairs []string
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if current.Len() > 0 {
+				pairs = append(pairs, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if current.Len() > 0 {
+		pairs = append(pairs, current.String())
+	}
+	return pairs
+}
+
+// parseAttributeRef splits a TraceQL attribute reference like resource.service.name,
+// span.http.route or .http.route into its scope and key. Names without a scope are
+// intrinsics when they are one, otherwise attributes of either scope.
+func parseAttributeRef(ref string) (string, string) {
+	switch {
+	case strings.HasPrefix(ref, "resource."):
+		return scopeResource, strings.TrimPrefix(ref, "resource.")
+	case strings.HasPrefix(ref, "span."):
+		return scopeSpan, strings.TrimPrefix(ref, "span.")
+	case strings.HasPrefix(ref, "."):
+		return "", strings.TrimPrefix(ref, ".")
+	}
+	for _, i := range intrinsics {
+		if ref == i {
+			return scopeIntrinsic, ref
+		}
+	}
+	return "", ref
+}
+
+func newCondition(ref, op, value string) (condition, error) {
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return condition{}, fmt.Errorf("invalid value %s: %w", value, err)
+		}
+		value = unquoted
+	}
+	scope, key := parseAttributeRef(ref)
+	c := condition{scope: scope, key: key, op: op, value: value}
+
+	ordered := op != "=" && op != "!="
+	if scope == scopeIntrinsic {
+		switch key {
+		case "duration":
+			if _, err := time.ParseDuration(value); err != nil {
+				return c, fmt.Errorf("invalid duration %q", value)
+			}
+			return c, nil
+		case "status":
+			if value != "error" && value != "ok" && value != "unset" {
+				return c, fmt.Errorf("status must be error, ok or unset")
+			}
+		}
+		if ordered {
+			return c, fmt.Errorf("%s only supports = and !=", key)
+		}
+		return c, nil
+	}
+	if ordered {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return c, fmt.Errorf("%s %s needs a number, got %q", ref, op, value)
+		}
+	}
+	return c, nil
+}
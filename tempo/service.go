@@ -0,0 +1,462 @@
+package tempo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// tagLimit is the maximum number of tag names or values returned per scope
+const tagLimit = 1000
+
+// TempoService answers Grafana Tempo API queries from denormalized_span
+type TempoService struct {
+	Ch *clickhouse.Conn
+	DB *goqu.DialectWrapper
+	// JSONAttributes makes attribute filters also look at the attributes_json column
+	JSONAttributes bool
+}
+
+// TraceSearchMetadata is a search result in Tempo's format
+type TraceSearchMetadata struct {
+	TraceID           string `json:"traceID"`
+	RootServiceName   string `json:"rootServiceName"`
+	RootTraceName     string `json:"rootTraceName"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	DurationMs        uint64 `json:"durationMs"`
+}
+
+type SearchRequest struct {
+	Conditions  []condition
+	Start       time.Time
+	End         time.Time
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	Limit       uint
+}
+
+// traceIDToStored converts a hex trace ID as used by Tempo to the stored base64 form.
+// Tempo accepts IDs with leading zeros left out, so short IDs are padded.
+func traceIDToStored(id string) (string, error) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if len(id) > 32 {
+		return "", fmt.Errorf("trace ID is longer than 32 hex characters")
+	}
+	b, err := hex.DecodeString(strings.Repeat("0", 32-len(id)) + id)
+	if err != nil {
+		return "", fmt.Errorf("invalid trace ID: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func storedToHex(id string) string {
+	b, err := base64.StdEncoding.DecodeString(id)
+	if err != nil {
+		return id
+	}
+	return hex.EncodeToString(b)
+}
+
+func decodeID(id string) []byte {
+	if id == "" {
+		return nil
+	}
+	b, _ := base64.StdEncoding.DecodeString(id)
+	return b
+}
+
+// GetTrace returns the spans of a trace grouped as OTLP resource spans, nil when
+// the trace isn't stored
+func (s *TempoService) GetTrace(ctx context.Context, traceID string) ([]*tracepb.ResourceSpans, error) {
+	stored, err := traceIDToStored(traceID)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("trace_id"),
+			goqu.C("span_id"),
+			goqu.C("parent_span_id"),
+			goqu.C("flags"),
+			goqu.C("name"),
+			goqu.C("kind"),
+			goqu.C("start_time_unix_nano"),
+			goqu.C("end_time_unix_nano"),
+			goqu.C("scope_name"),
+			goqu.C("resource_schema_url"),
+			goqu.C("resource_attributes.key"),
+			goqu.C("resource_attributes.value"),
+			goqu.C("span_attributes.key"),
+			goqu.C("span_attributes.value"),
+			goqu.C("events.time_unix_nano"),
+			goqu.C("events.name"),
+			goqu.C("events.attributes.key"),
+			goqu.C("events.attributes.value"),
+			goqu.C("links.trace_id"),
+			goqu.C("links.span_id"),
+			goqu.C("attributes_json"),
+		).
+		Where(goqu.C("trace_id").Eq(stored)).
+		Order(goqu.C("start_time_unix_nano").Asc())
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var batches []*tracepb.ResourceSpans
+	resources := make(map[string]*tracepb.ResourceSpans)
+	scopes := make(map[string]*tracepb.ScopeSpans)
+	for rows.Next() {
+		var (
+			traceID, spanID, parentSpanID, name, kind, scope, schemaURL, attrsJSON string
+			flags                                                                  int32
+			start, end                                                             int64
+			resourceKeys, resourceValues, spanKeys, spanValues                     []string
+			eventTimes                                                             []int64
+			eventNames                                                             []string
+			eventAttrKeys, eventAttrValues                                         [][]string
+			linkTraceIDs, linkSpanIDs                                              []string
+		)
+		if err := rows.Scan(
+			&traceID, &spanID, &parentSpanID, &flags, &name, &kind, &start, &end, &scope, &schemaURL,
+			&resourceKeys, &resourceValues, &spanKeys, &spanValues,
+			&eventTimes, &eventNames, &eventAttrKeys, &eventAttrValues,
+			&linkTraceIDs, &linkSpanIDs, &attrsJSON,
+		); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		resourceAttrs := zip(resourceKeys, resourceValues)
+		spanAttrs := zip(spanKeys, spanValues)
+		utils.MergeAttributesJSON(attrsJSON, resourceAttrs, spanAttrs)
+
+		resourceKey := schemaURL + "\x00" + attributesKey(resourceAttrs)
+		rs, ok := resources[resourceKey]
+		if !ok {
+			rs = &tracepb.ResourceSpans{
+				Resource:  &resourcepb.Resource{Attributes: keyValues(resourceAttrs)},
+				SchemaUrl: schemaURL,
+			}
+			resources[resourceKey] = rs
+			batches = append(batches, rs)
+		}
+		ss, ok := scopes[resourceKey+"\x00"+scope]
+		if !ok {
+			ss = &tracepb.ScopeSpans{Scope: &commonpb.InstrumentationScope{Name: scope}}
+			scopes[resourceKey+"\x00"+scope] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+
+		span := &tracepb.Span{
+			TraceId:           decodeID(traceID),
+			SpanId:            decodeID(spanID),
+			ParentSpanId:      decodeID(parentSpanID),
+			Flags:             uint32(flags),
+			Name:              name,
+			Kind:              spanKind(kind),
+			StartTimeUnixNano: uint64(start),
+			EndTimeUnixNano:   uint64(end),
+			Attributes:        keyValues(spanAttrs),
+			Status:            &tracepb.Status{},
+		}
+		for i := range eventTimes {
+			event := &tracepb.Span_Event{TimeUnixNano: uint64(eventTimes[i]), Name: eventNames[i]}
+			if i < len(eventAttrKeys) && i < len(eventAttrValues) {
+				event.Attributes = keyValues(zip(eventAttrKeys[i], eventAttrValues[i]))
+			}
+			span.Events = append(span.Events, event)
+			// status isn't stored, exceptions are what marks spans as failed everywhere else
+			if eventNames[i] == "exception" {
+				span.Status.Code = tracepb.Status_STATUS_CODE_ERROR
+			}
+		}
+		for i := range linkTraceIDs {
+			if i < len(linkSpanIDs) {
+				span.Links = append(span.Links, &tracepb.Span_Link{
+					TraceId: decodeID(linkTraceIDs[i]),
+					SpanId:  decodeID(linkSpanIDs[i]),
+				})
+			}
+		}
+		ss.Spans = append(ss.Spans, span)
+	}
+	return batches, rows.Err()
+}
+
+func zip(keys, values []string) map[string]string {
+	m := make(map[string]string, len(keys))
+	for i := range keys {
+		if i < len(values) {
+			m[keys[i]] = values[i]
+		}
+	}
+	return m
+}
+
+// attributesKey identifies a set of attributes regardless of order
+func attributesKey(attrs map[string]string) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(attrs[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// keyValues converts attributes to OTLP string attributes sorted by key,
+// values are stored as strings whatever their original type
+func keyValues(attrs map[string]string) []*commonpb.KeyValue {
+	kvs := make([]*commonpb.KeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kvs = append(kvs, &commonpb.KeyValue{
+			Key:   k,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}},
+		})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+// spanKind maps the kind column back to the OTLP span kind
+func spanKind(kind string) tracepb.Span_SpanKind {
+	switch kind {
+	case "server":
+		return tracepb.Span_SPAN_KIND_SERVER
+	case "client":
+		return tracepb.Span_SPAN_KIND_CLIENT
+	case "producer":
+		return tracepb.Span_SPAN_KIND_PRODUCER
+	case "consumer":
+		return tracepb.Span_SPAN_KIND_CONSUMER
+	case "internal":
+		return tracepb.Span_SPAN_KIND_INTERNAL
+	default:
+		return tracepb.Span_SPAN_KIND_UNSPECIFIED
+	}
+}
+
+// Search returns the traces with a span matching all conditions, newest first
+func (s *TempoService) Search(ctx context.Context, req SearchRequest) ([]TraceSearchMetadata, error) {
+	inRange := []goqu.Expression{
+		goqu.C("start_time_unix_nano").Gte(req.Start.UnixNano()),
+		goqu.C("start_time_unix_nano").Lte(req.End.UnixNano()),
+	}
+	matching := s.DB.
+		From("denormalized_span").
+		Select(goqu.C("trace_id")).
+		Where(append(inRange, s.conditionExpressions(req.Conditions)...)...)
+
+	ds := s.DB.
+		From("denormalized_span").
+		Select(
+			goqu.C("trace_id"),
+			goqu.L("argMin(resource_attributes.value[indexOf(resource_attributes.key, 'service.name')], start_time_unix_nano)"),
+			goqu.L("argMin(name, start_time_unix_nano)"),
+			goqu.L("min(start_time_unix_nano)").As("trace_start"),
+			goqu.L("toUInt64((max(end_time_unix_nano) - min(start_time_unix_nano)) / 1000000)").As("duration_ms"),
+		).
+		Where(append(inRange, goqu.C("trace_id").In(matching))...).
+		GroupBy(goqu.C("trace_id")).
+		Order(goqu.C("trace_start").Desc()).
+		Limit(req.Limit)
+	if req.MinDuration > 0 {
+		ds = ds.Having(goqu.C("duration_ms").Gte(req.MinDuration.Milliseconds()))
+	}
+	if req.MaxDuration > 0 {
+		ds = ds.Having(goqu.C("duration_ms").Lte(req.MaxDuration.Milliseconds()))
+	}
+
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	traces := []TraceSearchMetadata{}
+	for rows.Next() {
+		var t TraceSearchMetadata
+		var start int64
+		if err := rows.Scan(&t.TraceID, &t.RootServiceName, &t.RootTraceName, &start, &t.DurationMs); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		t.TraceID = storedToHex(t.TraceID)
+		t.StartTimeUnixNano = strconv.FormatInt(start, 10)
+		traces = append(traces, t)
+	}
+	return traces, rows.Err()
+}
+
+func (s *TempoService) conditionExpressions(conds []condition) []goqu.Expression {
+	exprs := make([]goqu.Expression, 0, len(conds))
+	for _, c := range conds {
+		exprs = append(exprs, s.conditionExpression(c))
+	}
+	return exprs
+}
+
+func (s *TempoService) conditionExpression(c condition) exp.Expression {
+	if c.scope == scopeIntrinsic {
+		switch c.key {
+		case "duration":
+			d, _ := time.ParseDuration(c.value)
+			return goqu.L("duration_ns "+c.op+" ?", d.Nanoseconds())
+		case "status":
+			failed := goqu.L("has(events.name, 'exception')")
+			if (c.value == "error") == (c.op == "=") {
+				return failed
+			}
+			return goqu.L("NOT ?", failed)
+		default:
+			return goqu.L(c.key+" "+c.op+" ?", c.value)
+		}
+	}
+
+	scopes := []string{scopeSpan, scopeResource}
+	if c.scope != "" {
+		scopes = []string{c.scope}
+	}
+	var matches []exp.Expression
+	for _, scope := range scopes {
+		exists, value := s.attribute(scope, c.key)
+		cmp := goqu.L("? "+c.op+" ?", value, c.value)
+		if c.op != "=" && c.op != "!=" {
+			number, _ := strconv.ParseFloat(c.value, 64)
+			cmp = goqu.L("toFloat64OrNull(?) "+c.op+" ?", value, number)
+		}
+		matches = append(matches, goqu.And(exists, cmp))
+	}
+	return goqu.Or(matches...)
+}
+
+// attribute returns whether a span has an attribute of scope, and its value
+func (s *TempoService) attribute(scope, key string) (exp.Expression, exp.Expression) {
+	column := scope + "_attributes"
+	exists := goqu.L("has("+column+".key, ?)", key)
+	value := goqu.L(column+".value[indexOf("+column+".key, ?)]", key)
+	if !s.JSONAttributes {
+		return exists, value
+	}
+	return goqu.Or(exists, goqu.L("JSONHas(attributes_json, ?, ?)", scope, key)),
+		goqu.L("if(?, ?, JSONExtractString(attributes_json, ?, ?))", exists, value, scope, key)
+}
+
+// TagNames returns the attribute keys seen in the range per scope
+func (s *TempoService) TagNames(ctx context.Context, start, end time.Time) (map[string][]string, error) {
+	names := map[string][]string{scopeIntrinsic: intrinsics}
+	for _, scope := range []string{scopeResource, scopeSpan} {
+		keys := goqu.L("arrayJoin(" + scope + "_attributes.key)")
+		if s.JSONAttributes {
+			keys = goqu.L("arrayJoin(arrayConcat("+scope+"_attributes.key, JSONExtractKeys(attributes_json, ?)))", scope)
+		}
+		values, err := s.distinct(ctx, keys, start, end, nil)
+		if err != nil {
+			return nil, err
+		}
+		names[scope] = values
+	}
+	return names, nil
+}
+
+// TagValues returns the values of a tag seen in the range, see parseAttributeRef
+func (s *TempoService) TagValues(ctx context.Context, tag string, start, end time.Time) ([]string, error) {
+	scope, key := parseAttributeRef(tag)
+	if scope == scopeIntrinsic {
+		switch key {
+		case "status":
+			return []string{"error", "ok", "unset"}, nil
+		case "duration":
+			return []string{}, nil
+		}
+		return s.distinct(ctx, goqu.C(key), start, end, nil)
+	}
+
+	scopes := []string{scopeResource, scopeSpan}
+	if scope != "" {
+		scopes = []string{scope}
+	}
+	seen := make(map[string]bool)
+	values := []string{}
+	for _, scope := range scopes {
+		exists, value := s.attribute(scope, key)
+		scopeValues, err := s.distinct(ctx, value, start, end, exists)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range scopeValues {
+			if !seen[v] {
+				seen[v] = true
+				values = append(values, v)
+			}
+		}
+	}
+	return values, nil
+}
+
+func (s *TempoService) distinct(ctx context.Context, value exp.Expression, start, end time.Time, filter exp.Expression) ([]string, error) {
+	conds := []goqu.Expression{
+		goqu.C("start_time_unix_nano").Gte(start.UnixNano()),
+		goqu.C("start_time_unix_nano").Lte(end.UnixNano()),
+	}
+	if filter != nil {
+		conds = append(conds, filter)
+	}
+	ds := s.DB.
+		From("denormalized_span").
+		Select(goqu.L("DISTINCT ?", value).As("value")).
+		Where(conds...).
+		Order(goqu.C("value").Asc()).
+		Limit(tagLimit)
+	sqlStr, args, err := ds.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*s.Ch).Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values, rows.Err()
+}
@@ -1,3 +1,6 @@
+// the server sets window.__NABATSHY__ when the UI and API share a port
+const injected = (window as { __NABATSHY__?: { backendUrl?: string } }).__NABATSHY__
+
 export const config = {
-  backendUrl: 'http://localhost:3000'
+  backendUrl: injected?.backendUrl ?? 'http://localhost:3000'
 }
@@ -2,6 +2,24 @@ import { StrictMode } from 'react'
 import { createRoot } from 'react-dom/client'
 import './index.css'
 import App from './App.tsx'
+import { config } from './config'
+
+// requests to the API carry the session cookie, and a 401 means the user has to log
+// in, which returns them to the page they were on
+const originalFetch = window.fetch.bind(window)
+// the backend URL is relative when the UI and API share a port
+const backendUrl = new URL(config.backendUrl, window.location.href).href
+window.fetch = async (input, init) => {
+  const url = new URL(input instanceof Request ? input.url : input.toString(), window.location.href).href
+  if (!url.startsWith(backendUrl)) {
+    return originalFetch(input, init)
+  }
+  const response = await originalFetch(input, { credentials: 'include', ...init })
+  if (response.status === 401) {
+    window.location.href = `${config.backendUrl}/auth/login?redirect=${encodeURIComponent(window.location.href)}`
+  }
+  return response
+}
 
 createRoot(document.getElementById('root')!).render(
   <StrictMode>
@@ -2,6 +2,10 @@ export interface Trace {
   TraceID: string;
   Name: string;
   Duration: number;
+  Service: string;
+  StartTime: string;
+  SpanCount: number;
+  HasError: boolean;
 }
 
 export interface TraceListResponse {
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// Coalescer shares a single execution of a function between concurrent callers
+// using the same key. The shared execution runs on its own context which is only
+// cancelled once every caller waiting on it has gone away.
+type Coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done    chan struct{}
+	val     any
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// Do runs fn, or waits for an in-flight run with the same key, and returns its result.
+// The result is shared between callers and must not be modified.
+func (c *Coalescer) Do(ctx context.Context, key string, fn func(ctx context.Context) (any, error)) (any, error) {
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &coalescedCall{done: make(chan struct{}), cancel: cancel}
+		c.calls[key] = call
+		go func() {
+			call.val, call.err = fn(callCtx)
+			c.mu.Lock()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+			c.mu.Unlock()
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// nobody is interested anymore, stop the query and let the next caller start over
+			call.cancel()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Coalesce is a typed wrapper around Coalescer.Do, a nil coalescer just calls fn
+func Coalesce[T any](c *Coalescer, ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	if c == nil {
+		return fn(ctx)
+	}
+	val, err := c.Do(ctx, key, func(ctx context.Context) (any, error) {
+		return fn(ctx)
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return val.(T), nil
+}
@@ -0,0 +1,44 @@
+package utils
+
+import "strconv"
+
+// HTTPFields are the HTTP semantic convention attributes of a span stored in the
+// http_* columns, read from the current attribute names or the older ones
+type HTTPFields struct {
+	Method     string
+	Route      string
+	StatusCode uint16
+	// Target is the path and query of the request
+	Target string
+}
+
+// HTTPFields returns the HTTP attributes of the span, zero for non HTTP spans
+func (s Span) HTTPFields() HTTPFields {
+	attr := func(keys ...string) string {
+		for _, key := range keys {
+			for _, a := range s.SpanAttributes {
+				if a.Key == key && a.Value != "" {
+					return a.Value
+				}
+			}
+		}
+		return ""
+	}
+
+	f := HTTPFields{
+		Method: attr("http.request.method", "http.method"),
+		Route:  attr("http.route"),
+		Target: attr("http.target"),
+	}
+	if status, err := strconv.ParseUint(attr("http.response.status_code", "http.status_code"), 10, 16); err == nil {
+		f.StatusCode = uint16(status)
+	}
+	if f.Target == "" {
+		if f.Target = attr("url.path"); f.Target != "" {
+			if query := attr("url.query"); query != "" {
+				f.Target += "?" + query
+			}
+		}
+	}
+	return f
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// LastKnown keeps the most recent successful result per key, so reads can be
+// answered with stale data while ClickHouse is unreachable
+type LastKnown struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]lastKnownEntry
+	// order holds keys from least to most recently stored, the first is evicted
+	order []string
+}
+
+type lastKnownEntry struct {
+	val any
+	at  time.Time
+}
+
+func NewLastKnown(capacity int) *LastKnown {
+	return &LastKnown{capacity: capacity, entries: make(map[string]lastKnownEntry, capacity)}
+}
+
+func (l *LastKnown) store(key string, val any, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[key]; ok {
+		for i, k := range l.order {
+			if k == key {
+				l.order = append(l.order[:i], l.order[i+1:]...)
+				break
+			}
+		}
+	} else if len(l.order) >= l.capacity {
+		delete(l.entries, l.order[0])
+		l.order = l.order[1:]
+	}
+	l.entries[key] = lastKnownEntry{val: val, at: at}
+	l.order = append(l.order, key)
+}
+
+func (l *LastKnown) load(key string) (lastKnownEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	return e, ok
+}
+
+// WithLastKnown calls fn and remembers its result. When fn fails because ClickHouse
+// is unreachable the last result stored under key is returned instead, and the
+// request's QueryMeta is marked stale. A nil LastKnown just calls fn.
+func WithLastKnown[T any](l *LastKnown, ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	val, err := fn(ctx)
+	if l == nil {
+		return val, err
+	}
+	if err == nil {
+		l.store(key, val, time.Now())
+		return val, nil
+	}
+	if !IsUnavailable(err) {
+		return val, err
+	}
+	e, ok := l.load(key)
+	if !ok {
+		return val, err
+	}
+	MarkStale(ctx, e.at)
+	return e.val.(T), nil
+}
+
+// IsUnavailable reports whether err means ClickHouse couldn't be reached, as
+// opposed to the server rejecting or failing a query
+func IsUnavailable(err error) bool {
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return false
+	}
+	// context errors pass for net.Errors, but mean the request timed out or went away
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, clickhouse.ErrAcquireConnTimeout)
+}
@@ -1,40 +0,0 @@
-package utils
-
-import (
-	"bufio"
-	"log"
-	"os"
-	"strings"
-)
-
-func LoadEnv(path string) {
-	file, err := os.Open(path)
-	if err != nil {
-		log.Fatalf("Error opening .env file: %v", err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-
-		value = strings.Trim(value, `"'`)
-
-		os.Setenv(key, value)
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading .env file: %v", err)
-	}
-}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultPromotedAttributes are the attribute keys stored in dedicated columns
+// when PROMOTED_ATTRIBUTES is not set
+const DefaultPromotedAttributes = "http.route,db.system,rpc.method"
+
+// PromotedAttribute is a span/resource attribute that is copied into its own
+// LowCardinality column at ingest so filters on it don't scan the Nested arrays
+type PromotedAttribute struct {
+	Key    string
+	Column string
+}
+
+// ParsePromotedAttributes parses a comma separated list of attribute keys like
+// "http.route,db.system" into promoted attributes with their column names. Keys
+// mapping to the same column, like http.route and http_route, are an error.
+func ParsePromotedAttributes(keys string) ([]PromotedAttribute, error) {
+	var promoted []PromotedAttribute
+	columns := make(map[string]string)
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		column := PromotedAttributeColumn(key)
+		if other, ok := columns[column]; ok {
+			if other == key {
+				continue
+			}
+			return nil, fmt.Errorf("promoted attributes %q and %q both map to column %s", other, key, column)
+		}
+		columns[column] = key
+		promoted = append(promoted, PromotedAttribute{Key: key, Column: column})
+	}
+	return promoted, nil
+}
+
+// PromotedAttributeColumn returns the column name used for a promoted attribute key,
+// e.g. "http.route" -> "attr_http_route"
+func PromotedAttributeColumn(key string) string {
+	var b strings.Builder
+	b.WriteString("attr_")
+	for _, r := range strings.ToLower(key) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// FindPromotedAttribute returns the promoted attribute for key, if any
+func FindPromotedAttribute(promoted []PromotedAttribute, key string) (PromotedAttribute, bool) {
+	for _, p := range promoted {
+		if p.Key == key {
+			return p, true
+		}
+	}
+	return PromotedAttribute{}, false
+}
+
+// PromotedValue returns the value of a promoted attribute for a span, preferring
+// span attributes over resource attributes
+func (s Span) PromotedValue(key string) string {
+	for _, attr := range s.SpanAttributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	for _, attr := range s.ResourceAttributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// QueryMeta accumulates what the ClickHouse queries of a single request read,
+// so responses can tell users how much data their numbers are based on
+type QueryMeta struct {
+	rowsRead  atomic.Uint64
+	bytesRead atomic.Uint64
+	sampled   atomic.Bool
+	approx    atomic.Bool
+	// staleAt is when the oldest stale result used by the request was computed, 0 if none
+	staleAt atomic.Int64
+}
+
+type queryMetaKey struct{}
+
+// WithQueryMeta returns a context that reports the progress of every ClickHouse
+// query run with it into the returned QueryMeta
+func WithQueryMeta(ctx context.Context) (context.Context, *QueryMeta) {
+	meta := &QueryMeta{}
+	ctx = context.WithValue(ctx, queryMetaKey{}, meta)
+	ctx = clickhouse.Context(ctx, clickhouse.WithProgress(func(p *clickhouse.Progress) {
+		meta.rowsRead.Add(p.Rows)
+		meta.bytesRead.Add(p.Bytes)
+	}))
+	return ctx, meta
+}
+
+// QueryMetaFromContext returns the request's QueryMeta or nil
+func QueryMetaFromContext(ctx context.Context) *QueryMeta {
+	meta, _ := ctx.Value(queryMetaKey{}).(*QueryMeta)
+	return meta
+}
+
+// MarkSampled records that an answer was computed from sampled or approximated data
+func MarkSampled(ctx context.Context) {
+	if meta := QueryMetaFromContext(ctx); meta != nil {
+		meta.sampled.Store(true)
+	}
+}
+
+// MarkApproximate records that an answer used approximate aggregates
+func MarkApproximate(ctx context.Context) {
+	if meta := QueryMetaFromContext(ctx); meta != nil {
+		meta.approx.Store(true)
+	}
+}
+
+// MarkStale records that an answer is a cached result computed at, because the
+// database couldn't be reached
+func MarkStale(ctx context.Context, at time.Time) {
+	meta := QueryMetaFromContext(ctx)
+	if meta == nil {
+		return
+	}
+	for {
+		current := meta.staleAt.Load()
+		if current != 0 && current <= at.UnixNano() {
+			return
+		}
+		if meta.staleAt.CompareAndSwap(current, at.UnixNano()) {
+			return
+		}
+	}
+}
+
+func (m *QueryMeta) RowsRead() uint64 {
+	return m.rowsRead.Load()
+}
+
+func (m *QueryMeta) BytesRead() uint64 {
+	return m.bytesRead.Load()
+}
+
+func (m *QueryMeta) Sampled() bool {
+	return m.sampled.Load()
+}
+
+func (m *QueryMeta) Approximate() bool {
+	return m.approx.Load()
+}
+
+// StaleAt returns when the oldest stale result of the request was computed
+func (m *QueryMeta) StaleAt() (time.Time, bool) {
+	at := m.staleAt.Load()
+	if at == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, at).UTC(), true
+}
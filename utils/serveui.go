@@ -1,9 +1,9 @@
 package utils
 
 import (
+	"bytes"
 	"embed"
 	"fmt"
-	"log"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -11,8 +11,10 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
-// ServeUI serves static UI files using chi router and embed.FS
-func ServeUI(content embed.FS, uiDir string) {
+// UIHandler serves static UI files using chi router and embed.FS. When backendURL
+// is set it's given to the UI in index.html, instead of the UI's default of the
+// API on port 3000.
+func UIHandler(content embed.FS, uiDir string, backendURL string) http.Handler {
 	r := chi.NewRouter()
 	// Serve static assets
 	r.Get("/assets/*", func(w http.ResponseWriter, r *http.Request) {
@@ -51,6 +53,10 @@ func ServeUI(content embed.FS, uiDir string) {
 				http.NotFound(w, r)
 				return
 			}
+			if backendURL != "" {
+				script := fmt.Sprintf("<script>window.__NABATSHY__ = {backendUrl: %q};</script></head>", backendURL)
+				data = bytes.Replace(data, []byte("</head>"), []byte(script), 1)
+			}
 			w.Header().Set("Content-Type", "text/html")
 			w.Write(data)
 			return
@@ -66,8 +72,5 @@ func ServeUI(content embed.FS, uiDir string) {
 		w.Write(data)
 	})
 
-	addr := ":8081"
-
-	log.Printf("listening on %s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, r))
+	return r
 }
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+type serviceFilterKey struct{}
+
+// serviceFilter is the services a context's queries see: those of allow, every one
+// when allow is nil, except those of deny
+type serviceFilter struct {
+	name  string
+	allow []string
+	deny  []string
+}
+
+// WithServiceFilter returns a context whose ClickHouse queries only see spans of the
+// services, by scope name or service.name, and incomplete traces of them. The filter
+// is applied by ClickHouse to every read of denormalized_span and incomplete_traces,
+// including subqueries, through the additional_table_filters setting. name identifies the filter in cache keys.
+// Filters stack, a context that already has one only sees the services of both,
+// e.g. the project a user asked for among the services their role lets them see.
+func WithServiceFilter(ctx context.Context, name string, services []string) context.Context {
+	filter, ok := ctx.Value(serviceFilterKey{}).(serviceFilter)
+	if ok && filter.allow != nil {
+		services = slices.DeleteFunc(slices.Clone(services), func(s string) bool {
+			return !slices.Contains(filter.allow, s)
+		})
+	}
+	if services == nil {
+		services = []string{}
+	}
+	filter.allow = services
+	return withFilter(ctx, filter, name)
+}
+
+// WithoutServices returns a context whose ClickHouse queries don't see spans of the
+// services, on top of any service filter it already has
+func WithoutServices(ctx context.Context, name string, services []string) context.Context {
+	filter, _ := ctx.Value(serviceFilterKey{}).(serviceFilter)
+	filter.deny = append(slices.Clone(filter.deny), services...)
+	return withFilter(ctx, filter, name)
+}
+
+func withFilter(ctx context.Context, filter serviceFilter, name string) context.Context {
+	if filter.name != "" {
+		name = filter.name + "&" + name
+	}
+	filter.name = name
+
+	ctx = context.WithValue(ctx, serviceFilterKey{}, filter)
+	// the local tables are named for the queries shards run for a distributed table,
+	// incomplete_traces has the service of each trace's root span
+	spans := filter.condition(spansMatch)
+	traces := filter.condition(func(list string) string { return "service IN " + list })
+	return clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"additional_table_filters": "{'denormalized_span': " + spans + ", 'denormalized_span_local': " + spans +
+			", 'incomplete_traces': " + traces + ", 'incomplete_traces_local': " + traces + "}",
+	}))
+}
+
+// condition returns the quoted condition of the filter, match being the condition
+// matching the rows of a parenthesized list of services
+func (f serviceFilter) condition(match func(list string) string) string {
+	var conds []string
+	if f.allow != nil {
+		conds = append(conds, "("+servicesMatch(f.allow, match)+")")
+	}
+	if len(f.deny) > 0 {
+		conds = append(conds, "NOT ("+servicesMatch(f.deny, match)+")")
+	}
+	return "'" + escapeLiteral(strings.Join(conds, " AND ")) + "'"
+}
+
+// servicesMatch is the match condition of the services, 0 without any
+func servicesMatch(services []string, match func(list string) string) string {
+	if len(services) == 0 {
+		return "0"
+	}
+	quoted := make([]string, len(services))
+	for i, s := range services {
+		quoted[i] = "'" + escapeLiteral(s) + "'"
+	}
+	return match("(" + strings.Join(quoted, ", ") + ")")
+}
+
+// spansMatch is the condition matching spans of the list of services by scope name
+// or service.name
+func spansMatch(list string) string {
+	return "scope_name IN " + list +
+		" OR resource_attributes.value[indexOf(resource_attributes.key, 'service.name')] IN " + list
+}
+
+// ServiceFilterName returns the name of the context's service filter, "" without one
+func ServiceFilterName(ctx context.Context) string {
+	filter, _ := ctx.Value(serviceFilterKey{}).(serviceFilter)
+	return filter.name
+}
+
+// escapeLiteral escapes s for use in a single quoted ClickHouse string literal
+func escapeLiteral(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
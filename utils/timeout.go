@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultQueryTimeout bounds API requests whose path has no timeout of its own
+const DefaultQueryTimeout = 30 * time.Second
+
+// defaultPathTimeouts are the built in timeouts of paths that are slow by design,
+// overridden by QUERY_TIMEOUTS
+var defaultPathTimeouts = map[string]time.Duration{
+	"/v1/search/export": 10 * time.Minute,
+}
+
+// QueryTimeouts is how long API requests may take, by path prefix
+type QueryTimeouts struct {
+	Default time.Duration
+	// Paths are matched by prefix, the longest wins. 0 means no timeout.
+	Paths map[string]time.Duration
+}
+
+// ParseQueryTimeouts parses the QUERY_TIMEOUT value, a duration where empty is
+// DefaultQueryTimeout and off disables it, and the QUERY_TIMEOUTS value, timeouts of
+// path prefixes separated by ; like
+//
+//	/v1/traces/heatmap=90s;/v1/search=1m;/v1/flamegraph=off
+func ParseQueryTimeouts(def, paths string) (QueryTimeouts, error) {
+	t := QueryTimeouts{Default: DefaultQueryTimeout, Paths: make(map[string]time.Duration)}
+	for path, d := range defaultPathTimeouts {
+		t.Paths[path] = d
+	}
+	var err error
+	if def != "" {
+		if t.Default, err = parseTimeout(def); err != nil {
+			return QueryTimeouts{}, fmt.Errorf("invalid query timeout %q, use off or a duration like 30s", def)
+		}
+	}
+	for _, part := range strings.Split(paths, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		path, value, ok := strings.Cut(part, "=")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return QueryTimeouts{}, fmt.Errorf("invalid query timeout %q, expected /path=duration", part)
+		}
+		if t.Paths[path], err = parseTimeout(value); err != nil {
+			return QueryTimeouts{}, fmt.Errorf("invalid query timeout %q, use off or a duration like 30s", part)
+		}
+	}
+	return t, nil
+}
+
+func parseTimeout(s string) (time.Duration, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+	return d, nil
+}
+
+// For returns the timeout of a request path, 0 when it has none
+func (t QueryTimeouts) For(path string) time.Duration {
+	timeout, longest := t.Default, -1
+	for prefix, d := range t.Paths {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			timeout, longest = d, len(prefix)
+		}
+	}
+	return timeout
+}
+
+// TimeoutMiddleware cancels the context of requests, and so their ClickHouse
+// queries, once their timeout passes. ClickHouse is also given the deadline as the
+// max_execution_time of the queries. A request that fails after its timeout gets a
+// 504 instead of the error of the handler. Queries of requests whose client went
+// away are cancelled through the request context regardless of the timeout.
+func TimeoutMiddleware(t QueryTimeouts) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := t.For(r.URL.Path)
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(&timeoutWriter{ResponseWriter: w, ctx: ctx, timeout: timeout}, r.WithContext(ctx))
+		})
+	}
+}
+
+// timeoutWriter replaces the server errors written after the deadline with a 504
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	timeout     time.Duration
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (w *timeoutWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status < 500 || !errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.timedOut = true
+	message := fmt.Sprintf("query timed out after %s, try a shorter time range or a narrower query", w.timeout)
+	h := w.Header()
+	h.Del("Content-Length")
+	if strings.HasPrefix(h.Get("Content-Type"), "application/json") {
+		w.ResponseWriter.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w.ResponseWriter).Encode(map[string]any{
+			"error": map[string]any{"status": http.StatusGatewayTimeout, "message": message},
+		})
+		return
+	}
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.ResponseWriter.WriteHeader(http.StatusGatewayTimeout)
+	fmt.Fprintln(w.ResponseWriter, message)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.timedOut {
+		// the handler's error is dropped for the 504's message
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
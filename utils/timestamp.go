@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"nabatshy/openapi"
+)
+
+// TimeFormat is how Timestamps are written in JSON responses
+type TimeFormat string
+
+const (
+	TimeFormatRFC3339   TimeFormat = "rfc3339"
+	TimeFormatUnix      TimeFormat = "unix"
+	TimeFormatUnixMilli TimeFormat = "unix_ms"
+	TimeFormatUnixNano  TimeFormat = "unix_ns"
+)
+
+// ParseTimeFormat parses the ts_format query parameter, empty keeps the format
+// each field always had
+func ParseTimeFormat(s string) (TimeFormat, error) {
+	switch f := TimeFormat(s); f {
+	case "", TimeFormatRFC3339, TimeFormatUnix, TimeFormatUnixMilli, TimeFormatUnixNano:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid ts_format %q, expected rfc3339, unix, unix_ms or unix_ns", s)
+}
+
+// Timestamp is a point in time in a JSON response. Without a ts_format it's written
+// the way the field was before Timestamp existed, RFC 3339 for times and unix
+// nanoseconds for fields that held them, so existing clients keep working.
+type Timestamp struct {
+	time.Time
+	// legacy is the format written without a ts_format
+	legacy TimeFormat
+	format TimeFormat
+}
+
+// NewTimestamp returns a Timestamp written as RFC 3339 by default
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{Time: t, legacy: TimeFormatRFC3339}
+}
+
+// UnixNanoTimestamp returns a Timestamp written as unix nanoseconds by default
+func UnixNanoTimestamp(ns int64) Timestamp {
+	return Timestamp{Time: time.Unix(0, ns).UTC(), legacy: TimeFormatUnixNano}
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	format := t.format
+	if format == "" {
+		format = t.legacy
+	}
+	switch format {
+	case TimeFormatUnix:
+		return strconv.AppendInt(nil, t.Unix(), 10), nil
+	case TimeFormatUnixMilli:
+		return strconv.AppendInt(nil, t.UnixMilli(), 10), nil
+	case TimeFormatUnixNano:
+		return strconv.AppendInt(nil, t.UnixNano(), 10), nil
+	}
+	return json.Marshal(t.Time.Format(time.RFC3339Nano))
+}
+
+// OpenAPISchema is either an RFC 3339 string or a unix time in seconds, milliseconds or
+// nanoseconds, depending on the ts_format and the field
+func (Timestamp) OpenAPISchema() *openapi.Schema {
+	return &openapi.Schema{
+		Description: "RFC 3339, or unix seconds, milliseconds or nanoseconds as set by ts_format",
+		OneOf: []*openapi.Schema{
+			{Type: "string", Format: "date-time"},
+			{Type: "integer", Format: "int64"},
+		},
+	}
+}
+
+// UnmarshalJSON reads what MarshalJSON writes without a ts_format, a number is
+// taken as unix nanoseconds
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	if ns, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+		*t = UnixNanoTimestamp(ns)
+		return nil
+	}
+	var tm time.Time
+	if err := json.Unmarshal(data, &tm); err != nil {
+		return err
+	}
+	*t = NewTimestamp(tm)
+	return nil
+}
+
+// Scan lets ClickHouse scan DateTime and Int64 nanosecond columns into a Timestamp
+func (t *Timestamp) Scan(src any) error {
+	switch v := src.(type) {
+	case time.Time:
+		*t = NewTimestamp(v)
+	case int64:
+		*t = UnixNanoTimestamp(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a Timestamp", src)
+	}
+	return nil
+}
+
+type timeFormatKey struct{}
+
+// TimeFormatMiddleware reads the ts_format query parameter for WriteJSON
+func TimeFormatMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format, err := ParseTimeFormat(r.URL.Query().Get("ts_format"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if format != "" {
+			r = r.WithContext(context.WithValue(r.Context(), timeFormatKey{}, format))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WriteJSON writes v as JSON with the Timestamps in the format of the request
+func WriteJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(FormatTimestamps(r, v))
+}
+
+// FormatTimestamps returns v with its Timestamps in the format of the request, for
+// responses that aren't written with WriteJSON
+func FormatTimestamps(r *http.Request, v any) any {
+	if format, ok := r.Context().Value(timeFormatKey{}).(TimeFormat); ok && v != nil {
+		return withTimeFormat(reflect.ValueOf(v), format).Interface()
+	}
+	return v
+}
+
+var timestampType = reflect.TypeOf(Timestamp{})
+
+// withTimeFormat returns a copy of v with the format of every Timestamp set. Values
+// are copied rather than changed in place since results may be cached and shared.
+func withTimeFormat(v reflect.Value, format TimeFormat) reflect.Value {
+	if !hasTimestamp(v.Type()) {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(withTimeFormat(v.Elem(), format))
+		return out
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		if v.Type() == timestampType {
+			out.Addr().Interface().(*Timestamp).format = format
+			return out
+		}
+		for i := range v.NumField() {
+			if out.Field(i).CanSet() {
+				out.Field(i).Set(withTimeFormat(v.Field(i), format))
+			}
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := range v.Len() {
+			out.Index(i).Set(withTimeFormat(v.Index(i), format))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := range v.Len() {
+			out.Index(i).Set(withTimeFormat(v.Index(i), format))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), withTimeFormat(iter.Value(), format))
+		}
+		return out
+	}
+	return v
+}
+
+// timestampTypes caches whether a type contains a Timestamp, so the strings and
+// numbers making up most of a response aren't copied
+var timestampTypes sync.Map
+
+func hasTimestamp(t reflect.Type) bool {
+	if has, ok := timestampTypes.Load(t); ok {
+		return has.(bool)
+	}
+	has := findTimestamp(t, map[reflect.Type]bool{})
+	timestampTypes.Store(t, has)
+	return has
+}
+
+func findTimestamp(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == timestampType {
+		return true
+	}
+	// recursive types are only looked at once
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return findTimestamp(t.Elem(), seen)
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if f := t.Field(i); f.IsExported() && findTimestamp(f.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
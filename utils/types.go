@@ -7,7 +7,7 @@ import (
 )
 
 type TimePercentile struct {
-	Timestamp time.Time `json:"timestamp"`
+	Timestamp Timestamp `json:"timestamp"`
 	Value     float64   `json:"value"`
 }
 
@@ -32,6 +32,11 @@ type Event struct {
 	Attributes   []EventAttribute
 }
 
+type Link struct {
+	TraceID string
+	SpanID  string
+}
+
 type Span struct {
 	TraceID            string
 	SpanID             string
@@ -48,4 +53,6 @@ type Span struct {
 	ResourceAttributes []ResourceAttribute
 	SpanAttributes     []ResourceAttribute
 	Events             []Event
+	Kind               string // "server", "client", "producer", "consumer", "internal" or ""
+	Links              []Link
 }
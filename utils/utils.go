@@ -2,8 +2,11 @@ package utils
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -25,6 +28,12 @@ func PadQueryResult(rows clickhouseDriver.Rows, intervalSQL string, dateRange Da
 		return nil, err
 	}
 
+	return PadSeries(vals, intervalSQL, dateRange)
+}
+
+// PadSeries turns bucketed values into a series with one point per interval in the
+// date range, buckets without a value are zero
+func PadSeries(vals map[time.Time]float64, intervalSQL string, dateRange DateRange) ([]TimePercentile, error) {
 	// determine step duration
 	step, err := ParseInterval(intervalSQL)
 	if err != nil {
@@ -38,7 +47,7 @@ func PadQueryResult(rows clickhouseDriver.Rows, intervalSQL string, dateRange Da
 	var series []TimePercentile
 	for ts := aligned; !ts.After(dateRange.End); ts = ts.Add(step) {
 		series = append(series, TimePercentile{
-			Timestamp: ts,
+			Timestamp: NewTimestamp(ts),
 			Value:     vals[ts], // zero if missing
 		})
 	}
@@ -102,88 +111,244 @@ func ParseDateRange(query url.Values, startField, endField, timeRangeField strin
 
 func GetDateRangeFromQuery(timeRange string) DateRange {
 	end := time.Now()
-	if len(timeRange) < 2 {
+	duration, err := ParseTimeRange(timeRange)
+	if err != nil {
 		return DateRange{Start: end, End: end} // invalid input fallback
 	}
 
+	start := end.Add(-duration)
+	dateRange := DateRange{Start: start, End: end}
+
+	fmt.Printf("dateRange: %v\n", dateRange)
+	return dateRange
+}
+
+// ParseTimeRange parses relative time ranges like "30s", "15m", "1h" or "7d"
+func ParseTimeRange(timeRange string) (time.Duration, error) {
+	if len(timeRange) < 2 {
+		return 0, fmt.Errorf("invalid time range: %q", timeRange)
+	}
+
 	unit := timeRange[len(timeRange)-1:]
 	valueStr := timeRange[:len(timeRange)-1]
 	value, err := strconv.Atoi(valueStr)
-	if err != nil {
-		return DateRange{Start: end, End: end} // invalid number
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid time range: %q", timeRange)
 	}
 
-	var duration time.Duration
 	switch unit {
 	case "s":
-		duration = time.Duration(value) * time.Second
+		return time.Duration(value) * time.Second, nil
 	case "m":
-		duration = time.Duration(value) * time.Minute
+		return time.Duration(value) * time.Minute, nil
 	case "h":
-		duration = time.Duration(value) * time.Hour
+		return time.Duration(value) * time.Hour, nil
 	case "d":
-		duration = time.Duration(value) * 24 * time.Hour
+		return time.Duration(value) * 24 * time.Hour, nil
 	default:
-		return DateRange{Start: end, End: end} // unsupported unit
+		return 0, fmt.Errorf("unsupported time range unit: %q", timeRange)
 	}
-
-	start := end.Add(-duration)
-	dateRange := DateRange{Start: start, End: end}
-
-	fmt.Printf("dateRange: %v\n", dateRange)
-	return dateRange
 }
 
 // DenormalizedSpanRow represents a row in the denormalized_span table
 type DenormalizedSpanRow struct {
-	TraceID                 string   `ch:"trace_id"`
-	SpanID                  string   `ch:"span_id"`
-	ParentSpanID            string   `ch:"parent_span_id"`
-	Flags                   int32    `ch:"flags"`
-	Name                    string   `ch:"name"`
-	StartTimeUnixNano       int64    `ch:"start_time_unix_nano"`
-	EndTimeUnixNano         int64    `ch:"end_time_unix_nano"`
-	ScopeID                 string   `ch:"scope_id"`
-	ScopeName               string   `ch:"scope_name"`
-	ResourceID              string   `ch:"resource_id"`
-	ResourceSchemaURL       string   `ch:"resource_schema_url"`
-	ResourceAttributesKey      []string   `ch:"resource_attributes.key"`
-	ResourceAttributesValue    []string   `ch:"resource_attributes.value"`
-	SpanAttributesKey          []string   `ch:"span_attributes.key"`
-	SpanAttributesValue        []string   `ch:"span_attributes.value"`
-	EventsTimeUnixNano         []int64    `ch:"events.time_unix_nano"`
-	EventsName                 []string   `ch:"events.name"`
-	EventsAttributesKey        [][]string `ch:"events.attributes.key"`
-	EventsAttributesValue      [][]string `ch:"events.attributes.value"`
+	TraceID                 string     `ch:"trace_id"`
+	SpanID                  string     `ch:"span_id"`
+	ParentSpanID            string     `ch:"parent_span_id"`
+	Flags                   int32      `ch:"flags"`
+	Name                    string     `ch:"name"`
+	StartTimeUnixNano       int64      `ch:"start_time_unix_nano"`
+	EndTimeUnixNano         int64      `ch:"end_time_unix_nano"`
+	ScopeID                 string     `ch:"scope_id"`
+	ScopeName               string     `ch:"scope_name"`
+	ResourceID              string     `ch:"resource_id"`
+	ResourceSchemaURL       string     `ch:"resource_schema_url"`
+	ResourceAttributesKey   []string   `ch:"resource_attributes.key"`
+	ResourceAttributesValue []string   `ch:"resource_attributes.value"`
+	SpanAttributesKey       []string   `ch:"span_attributes.key"`
+	SpanAttributesValue     []string   `ch:"span_attributes.value"`
+	EventsTimeUnixNano      []int64    `ch:"events.time_unix_nano"`
+	EventsName              []string   `ch:"events.name"`
+	EventsAttributesKey     [][]string `ch:"events.attributes.key"`
+	EventsAttributesValue   [][]string `ch:"events.attributes.value"`
+	Kind                    string     `ch:"kind"`
+	LinksTraceID            []string   `ch:"links.trace_id"`
+	LinksSpanID             []string   `ch:"links.span_id"`
+	AttributesJSON          string     `ch:"attributes_json"`
+	HTTPMethod              string     `ch:"http_method"`
+	HTTPRoute               string     `ch:"http_route"`
+	HTTPStatusCode          uint16     `ch:"http_status_code"`
+	HTTPTarget              string     `ch:"http_target"`
+}
+
+// denormalizedSpanColumns are the columns written for every span, in the order
+// returned by DenormalizedSpanRow.values
+var denormalizedSpanColumns = []string{
+	"trace_id",
+	"span_id",
+	"parent_span_id",
+	"flags",
+	"name",
+	"start_time_unix_nano",
+	"end_time_unix_nano",
+	"scope_id",
+	"scope_name",
+	"resource_id",
+	"resource_schema_url",
+	"`resource_attributes.key`",
+	"`resource_attributes.value`",
+	"`span_attributes.key`",
+	"`span_attributes.value`",
+	"`events.time_unix_nano`",
+	"`events.name`",
+	"`events.attributes.key`",
+	"`events.attributes.value`",
+	"kind",
+	"`links.trace_id`",
+	"`links.span_id`",
+	"attributes_json",
+	"http_method",
+	"http_route",
+	"http_status_code",
+	"http_target",
+}
+
+func (r *DenormalizedSpanRow) values() []any {
+	return []any{
+		r.TraceID,
+		r.SpanID,
+		r.ParentSpanID,
+		r.Flags,
+		r.Name,
+		r.StartTimeUnixNano,
+		r.EndTimeUnixNano,
+		r.ScopeID,
+		r.ScopeName,
+		r.ResourceID,
+		r.ResourceSchemaURL,
+		r.ResourceAttributesKey,
+		r.ResourceAttributesValue,
+		r.SpanAttributesKey,
+		r.SpanAttributesValue,
+		r.EventsTimeUnixNano,
+		r.EventsName,
+		r.EventsAttributesKey,
+		r.EventsAttributesValue,
+		r.Kind,
+		r.LinksTraceID,
+		r.LinksSpanID,
+		r.AttributesJSON,
+		r.HTTPMethod,
+		r.HTTPRoute,
+		r.HTTPStatusCode,
+		r.HTTPTarget,
+	}
+}
+
+// InsertOptions controls how spans are written
+type InsertOptions struct {
+	Promoted []PromotedAttribute
+	// JSONAttributes stores span and resource attributes in the ZSTD compressed
+	// attributes_json column instead of the Nested columns, only the resource
+	// attributes in NestedResourceAttributes are kept in the Nested columns
+	JSONAttributes bool
+}
+
+// NestedResourceAttributes are always stored in the Nested resource attribute
+// columns since service level queries group by them
+var NestedResourceAttributes = []string{"service.name", "service.version", "deployment.environment"}
+
+// ParseAttributeStorage parses the ATTRIBUTE_STORAGE setting, "nested" (the default)
+// or "json", into whether attributes are stored as JSON
+func ParseAttributeStorage(s string) (bool, error) {
+	switch s {
+	case "", "nested":
+		return false, nil
+	case "json":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid attribute storage %q, use \"nested\" or \"json\"", s)
+}
+
+// attributesJSON encodes the attributes of a span as {"resource": {...}, "span": {...}}
+func attributesJSON(span Span) (string, error) {
+	doc := map[string]map[string]string{
+		"resource": make(map[string]string, len(span.ResourceAttributes)),
+		"span":     make(map[string]string, len(span.SpanAttributes)),
+	}
+	for _, attr := range span.ResourceAttributes {
+		doc["resource"][attr.Key] = attr.Value
+	}
+	for _, attr := range span.SpanAttributes {
+		doc["span"][attr.Key] = attr.Value
+	}
+	out, err := json.Marshal(doc)
+	return string(out), err
+}
+
+// MergeAttributesJSON adds the attributes stored in attributes_json to the maps
+func MergeAttributesJSON(attrsJSON string, resourceAttrs, spanAttrs map[string]string) {
+	if attrsJSON == "" {
+		return
+	}
+	var doc struct {
+		Resource map[string]string `json:"resource"`
+		Span     map[string]string `json:"span"`
+	}
+	if err := json.Unmarshal([]byte(attrsJSON), &doc); err != nil {
+		return
+	}
+	maps.Copy(resourceAttrs, doc.Resource)
+	maps.Copy(spanAttrs, doc.Span)
 }
 
 func InsertDenormalizedSpans(
 	ch *clickhouseDriver.Conn,
 	ctx context.Context,
 	spans []Span,
+	opts InsertOptions,
 ) error {
 	if len(spans) == 0 {
 		return nil
 	}
 
-	batch, err := (*ch).PrepareBatch(ctx, "INSERT INTO denormalized_span")
+	columns := append([]string{}, denormalizedSpanColumns...)
+	for _, p := range opts.Promoted {
+		columns = append(columns, p.Column)
+	}
+
+	batch, err := (*ch).PrepareBatch(ctx, "INSERT INTO denormalized_span ("+strings.Join(columns, ", ")+")")
 	if err != nil {
 		return fmt.Errorf("failed to prepare batch: %w", err)
 	}
 
 	for _, span := range spans {
+		var attrsJSON string
+		nestedResource, nestedSpan := span.ResourceAttributes, span.SpanAttributes
+		if opts.JSONAttributes {
+			if attrsJSON, err = attributesJSON(span); err != nil {
+				return fmt.Errorf("failed to encode attributes: %w", err)
+			}
+			nestedResource, nestedSpan = nil, nil
+			for _, attr := range span.ResourceAttributes {
+				if slices.Contains(NestedResourceAttributes, attr.Key) {
+					nestedResource = append(nestedResource, attr)
+				}
+			}
+		}
+
 		// Extract resource attribute keys and values
-		resourceKeys := make([]string, len(span.ResourceAttributes))
-		resourceValues := make([]string, len(span.ResourceAttributes))
-		for i, attr := range span.ResourceAttributes {
+		resourceKeys := make([]string, len(nestedResource))
+		resourceValues := make([]string, len(nestedResource))
+		for i, attr := range nestedResource {
 			resourceKeys[i] = attr.Key
 			resourceValues[i] = attr.Value
 		}
 
 		// Extract span attribute keys and values
-		spanKeys := make([]string, len(span.SpanAttributes))
-		spanValues := make([]string, len(span.SpanAttributes))
-		for i, attr := range span.SpanAttributes {
+		spanKeys := make([]string, len(nestedSpan))
+		spanValues := make([]string, len(nestedSpan))
+		for i, attr := range nestedSpan {
 			spanKeys[i] = attr.Key
 			spanValues[i] = attr.Value
 		}
@@ -209,6 +374,14 @@ func InsertDenormalizedSpans(
 			eventAttrValues[i] = values
 		}
 
+		linkTraceIDs := make([]string, len(span.Links))
+		linkSpanIDs := make([]string, len(span.Links))
+		for i, link := range span.Links {
+			linkTraceIDs[i] = link.TraceID
+			linkSpanIDs[i] = link.SpanID
+		}
+
+		httpFields := span.HTTPFields()
 		row := DenormalizedSpanRow{
 			TraceID:                 span.TraceID,
 			SpanID:                  span.SpanID,
@@ -229,9 +402,22 @@ func InsertDenormalizedSpans(
 			EventsName:              eventNames,
 			EventsAttributesKey:     eventAttrKeys,
 			EventsAttributesValue:   eventAttrValues,
+			Kind:                    span.Kind,
+			LinksTraceID:            linkTraceIDs,
+			LinksSpanID:             linkSpanIDs,
+			AttributesJSON:          attrsJSON,
+			HTTPMethod:              httpFields.Method,
+			HTTPRoute:               httpFields.Route,
+			HTTPStatusCode:          httpFields.StatusCode,
+			HTTPTarget:              httpFields.Target,
+		}
+
+		values := row.values()
+		for _, p := range opts.Promoted {
+			values = append(values, span.PromotedValue(p.Key))
 		}
 
-		if err := batch.AppendStruct(&row); err != nil {
+		if err := batch.Append(values...); err != nil {
 			return fmt.Errorf("failed to append span: %w", err)
 		}
 	}
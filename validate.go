@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"nabatshy/api"
+	"nabatshy/auth"
+	"nabatshy/catalog"
+	"nabatshy/collector"
+	"nabatshy/config"
+	"nabatshy/db"
+	"nabatshy/selftrace"
+	"nabatshy/servertls"
+	"nabatshy/statsd"
+	"nabatshy/utils"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// validateConfig checks the configuration and the database without starting any
+// server or changing the schema, it prints every problem and returns the exit code
+func validateConfig(cfg *config.Config, conn clickhouse.Conn) int {
+	var problems []string
+	check := func(name string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+
+	check("clickhouse address", requireValue("clickhouse.addr", cfg.ClickHouse.Addr))
+	_, err := db.ParseBalancing(cfg.ClickHouse.Balancing)
+	check("clickhouse balancing", err)
+	tlsConfig, err := servertls.Config(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile, cfg.Server.TLS.AutocertHosts, cfg.Server.TLS.AutocertCacheDir)
+	check("tls", err)
+	if caFile := cfg.Server.TLS.ClientCAFile; caFile != "" && err == nil {
+		_, err := servertls.WithClientCAs(tlsConfig, caFile, true)
+		check("tls client CA", err)
+	}
+	_, err = utils.ParseQueryTimeouts(cfg.Server.QueryTimeout, cfg.Server.QueryTimeouts)
+	check("query timeouts", err)
+	_, err = promotedAttributes(cfg)
+	check("promoted attributes", err)
+	check("source link template", validateSourceLinkTemplate(cfg.Attributes.SourceLinkTemplate))
+	_, err = utils.ParseAttributeStorage(cfg.Attributes.Storage)
+	check("attribute storage", err)
+	_, err = collector.ParseTapRate(cfg.Ingest.TapRate)
+	check("ingest tap rate", err)
+	_, err = collector.ParseWALMaxBytes(cfg.Ingest.WALMaxBytes)
+	check("wal max bytes", err)
+	_, err = collector.ParseMaxSpansPerTrace(cfg.Ingest.MaxSpansPerTrace)
+	check("max spans per trace", err)
+	_, err = collector.ParseSamplingRules(cfg.Ingest.SamplingRules)
+	check("sampling rules", err)
+	_, err = collector.ParseInsertMode(cfg.Ingest.InsertMode)
+	check("insert mode", err)
+	_, err = collector.ParseValidation(cfg.Ingest.MaxSpanAge, cfg.Ingest.MaxClockSkew, cfg.Ingest.MaxNameLength)
+	check("ingest validation", err)
+	_, err = selftrace.ParseRate(cfg.SelfTrace.Rate)
+	check("self trace rate", err)
+	_, err = statsd.ParseFlavor(cfg.StatsD.Flavor)
+	check("statsd flavor", err)
+	_, err = statsd.ParseInterval(cfg.StatsD.Interval)
+	check("statsd interval", err)
+	_, err = auth.ParseSessionTTL(cfg.Auth.SessionTTL)
+	check("session ttl", err)
+	_, err = auth.ParseRoleBindings(cfg.Auth.Roles)
+	check("role bindings", err)
+	_, err = auth.ParseRole(cfg.Auth.DefaultRole)
+	check("default role", err)
+	_, err = auth.ParseServiceRoles(cfg.Auth.ServiceRoles)
+	check("service roles", err)
+	_, err = catalog.ParseIdleAfter(cfg.Catalog.IdleAfter)
+	check("catalog idle period", err)
+	_, err = api.ParseServiceEdges(cfg.Dependencies.Edges)
+	check("service edges", err)
+	_, err = api.ParseCompletionWindow(cfg.Traces.CompletionWindow)
+	check("trace completion window", err)
+	if cfg.Auth.OIDCIssuer != "" {
+		err := validateAuth(cfg.Auth)
+		check("oidc", err)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			_, err = auth.Discover(ctx, cfg.Auth.OIDCIssuer, cfg.Auth.OIDCClientID, cfg.Auth.OIDCClientSecret, cfg.Auth.OIDCRedirectURL)
+			cancel()
+			check("oidc discovery", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = conn.Ping(ctx)
+	check("clickhouse connectivity", err)
+	if err == nil {
+		check("schema version", validateSchemaVersion(ctx, conn))
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Println("config is valid")
+	return 0
+}
+
+func requireValue(key, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is not set", key)
+	}
+	return nil
+}
+
+// validateAuth checks the settings the login flow needs besides the issuer
+func validateAuth(a config.Auth) error {
+	if err := requireValue("auth.oidc_client_id", a.OIDCClientID); err != nil {
+		return err
+	}
+	if err := requireValue("auth.oidc_redirect_url", a.OIDCRedirectURL); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(a.OIDCRedirectURL, "http://") && !strings.HasPrefix(a.OIDCRedirectURL, "https://") {
+		return fmt.Errorf("%q is not an http(s) URL", a.OIDCRedirectURL)
+	}
+	return nil
+}
+
+// validatePromotedAttributes rejects keys that would share a column, e.g. "http.route" and "http_route"
+func validateSourceLinkTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	if !strings.HasPrefix(template, "http://") && !strings.HasPrefix(template, "https://") {
+		return fmt.Errorf("%q is not an http(s) URL", template)
+	}
+	if !strings.Contains(template, "{filepath}") {
+		return fmt.Errorf("%q has no {filepath} placeholder", template)
+	}
+	return nil
+}
+
+// validateSchemaVersion fails when the database was migrated by a newer build.
+// Pending migrations are fine, they are applied on startup.
+func validateSchemaVersion(ctx context.Context, conn clickhouse.Conn) error {
+	var exists uint8
+	if err := conn.QueryRow(ctx, "EXISTS TABLE schema_migrations").Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		fmt.Printf("     fresh database, %d migrations will be applied\n", len(db.Migrations))
+		return nil
+	}
+
+	current, err := db.SchemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	latest := db.LatestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("database is at version %d but this build only knows up to %d", current, latest)
+	}
+	if current < latest {
+		fmt.Printf("     database is at version %d, migrations up to %d will be applied\n", current, latest)
+	}
+	return nil
+}